@@ -0,0 +1,303 @@
+// Package acme obtains and renews the TLS certificates for the SFTPGo services using the ACME protocol,
+// for example from Let's Encrypt. The HTTP-01 and TLS-ALPN-01 challenges are supported. The certificates
+// are obtained on the first TLS handshake for a configured domain and they are renewed automatically
+// before their expiration
+package acme
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender        = "acme"
+	defaultCertsPath = "certs"
+)
+
+// Supported protocols, a protocol uses the ACME certificates only if it has no configured certificate
+const (
+	ProtocolHTTP   = "HTTP"
+	ProtocolFTP    = "FTP"
+	ProtocolWebDAV = "DAV"
+)
+
+var (
+	supportedProtocols = []string{ProtocolHTTP, ProtocolFTP, ProtocolWebDAV}
+	mutex              sync.RWMutex
+	manager            *autocert.Manager
+	currentConfig      Config
+	// the running challenge listeners, they are stopped on re-initialization and on shutdown
+	listenersMutex    sync.Mutex
+	http01Server      *http.Server
+	http01Listener    net.Listener
+	tlsALPN01Listener net.Listener
+)
+
+// HTTP01Challenge defines the configuration for the HTTP-01 challenge
+type HTTP01Challenge struct {
+	// Port for the HTTP-01 challenge listener, the CA always connects to port 80 so a different
+	// port requires a port forwarding. 0 means disabled
+	Port int `json:"port" mapstructure:"port"`
+}
+
+// TLSALPN01Challenge defines the configuration for the TLS-ALPN-01 challenge
+type TLSALPN01Challenge struct {
+	// Port for a dedicated TLS-ALPN-01 challenge listener, the CA always connects to port 443.
+	// The challenge is answered by any service using the ACME certificates too, so this listener
+	// is not required if one of them is bound to port 443. 0 means disabled
+	Port int `json:"port" mapstructure:"port"`
+}
+
+// Config defines the ACME configuration
+type Config struct {
+	// Domains to obtain certificates for. Leave empty to disable ACME
+	Domains []string `json:"domains" mapstructure:"domains"`
+	// Email address used for the ACME account registration, it is optional but the CA uses it to
+	// notify certificate problems
+	Email string `json:"email" mapstructure:"email"`
+	// ACME directory URL. Empty means Let's Encrypt production, use
+	// "https://acme-staging-v02.api.letsencrypt.org/directory" for testing
+	CAEndpoint string `json:"ca_endpoint" mapstructure:"ca_endpoint"`
+	// Directory to store the account key and the certificates. This can be an absolute path or a
+	// path relative to the config dir. Empty means "certs"
+	CertsPath string `json:"certs_path" mapstructure:"certs_path"`
+	// Days before the expiration to renew the certificates. 0 means 30 days
+	RenewDays int `json:"renew_days" mapstructure:"renew_days"`
+	// Protocols using the ACME certificates, supported values: "HTTP", "FTP", "DAV"
+	Protocols          []string           `json:"protocols" mapstructure:"protocols"`
+	HTTP01Challenge    HTTP01Challenge    `json:"http01_challenge" mapstructure:"http01_challenge"`
+	TLSALPN01Challenge TLSALPN01Challenge `json:"tls_alpn01_challenge" mapstructure:"tls_alpn01_challenge"`
+}
+
+// IsEnabled returns true if ACME is configured
+func (c *Config) IsEnabled() bool {
+	return len(c.Domains) > 0
+}
+
+func (c *Config) validate() error {
+	for _, domain := range c.Domains {
+		if len(domain) == 0 || strings.ContainsAny(domain, ":/ ") {
+			return fmt.Errorf("invalid domain %#v", domain)
+		}
+	}
+	for _, protocol := range c.Protocols {
+		if !utils.IsStringInSlice(protocol, supportedProtocols) {
+			return fmt.Errorf("unsupported protocol %#v", protocol)
+		}
+	}
+	if c.RenewDays < 0 {
+		return fmt.Errorf("invalid renew days: %v", c.RenewDays)
+	}
+	if c.HTTP01Challenge.Port < 0 || c.HTTP01Challenge.Port > 65535 {
+		return fmt.Errorf("invalid HTTP-01 challenge port: %v", c.HTTP01Challenge.Port)
+	}
+	if c.TLSALPN01Challenge.Port < 0 || c.TLSALPN01Challenge.Port > 65535 {
+		return fmt.Errorf("invalid TLS-ALPN-01 challenge port: %v", c.TLSALPN01Challenge.Port)
+	}
+	if c.HTTP01Challenge.Port > 0 && c.HTTP01Challenge.Port == c.TLSALPN01Challenge.Port {
+		return errors.New("the HTTP-01 and TLS-ALPN-01 challenges must use different ports")
+	}
+	return nil
+}
+
+// Initialize configures ACME and starts the configured challenge listeners.
+// The challenge listeners started by a previous initialization are stopped
+func Initialize(config Config, configDir string) error {
+	if !config.IsEnabled() {
+		stopChallengeListeners()
+		mutex.Lock()
+		defer mutex.Unlock()
+		manager = nil
+		currentConfig = config
+		return nil
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	certsPath := config.CertsPath
+	if len(certsPath) == 0 {
+		certsPath = defaultCertsPath
+	}
+	if !filepath.IsAbs(certsPath) {
+		certsPath = filepath.Join(configDir, certsPath)
+	}
+	m := &autocert.Manager{
+		Prompt:      autocert.AcceptTOS,
+		Cache:       autocert.DirCache(certsPath),
+		HostPolicy:  autocert.HostWhitelist(config.Domains...),
+		RenewBefore: time.Duration(config.RenewDays) * 24 * time.Hour,
+		Email:       config.Email,
+	}
+	if len(config.CAEndpoint) > 0 {
+		m.Client = &acme.Client{DirectoryURL: config.CAEndpoint}
+	}
+	// the HTTP-01 challenge is enabled by autocert only if the HTTP handler is requested
+	var httpHandler http.Handler
+	if config.HTTP01Challenge.Port > 0 {
+		httpHandler = m.HTTPHandler(nil)
+	}
+
+	stopChallengeListeners()
+	mutex.Lock()
+	manager = m
+	currentConfig = config
+	mutex.Unlock()
+
+	logger.Info(logSender, "", "ACME enabled for domains %v, certificates path: %#v, protocols: %v", config.Domains,
+		certsPath, config.Protocols)
+	if httpHandler != nil {
+		startHTTP01Challenge(config.HTTP01Challenge.Port, httpHandler)
+	}
+	if config.TLSALPN01Challenge.Port > 0 {
+		startTLSALPN01Challenge(config.TLSALPN01Challenge.Port)
+	}
+	return nil
+}
+
+// Shutdown stops the challenge listeners, the certificates already obtained can still be used
+func Shutdown() {
+	stopChallengeListeners()
+}
+
+// IsEnabledForProtocol returns true if the given protocol must use the ACME certificates
+func IsEnabledForProtocol(protocol string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return manager != nil && utils.IsStringInSlice(protocol, currentConfig.Protocols)
+}
+
+// GetTLSConfig returns a TLS configuration using the ACME certificates.
+// The TLS-ALPN-01 challenges are answered too, the HTTP server adds its own protocols
+func GetTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: GetCertificateFunc(),
+		NextProtos:     []string{acme.ALPNProto},
+		MinVersion:     tls.VersionTLS12,
+	}
+}
+
+// GetCertificateFunc returns the function to get the ACME certificates during the TLS handshakes.
+// The first configured domain is used for the clients that do not send the server name, for
+// example some FTP clients
+func GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		mutex.RLock()
+		m := manager
+		domains := currentConfig.Domains
+		mutex.RUnlock()
+		if m == nil {
+			return nil, errors.New("ACME is not enabled")
+		}
+		if len(hello.ServerName) == 0 {
+			h := *hello
+			h.ServerName = domains[0]
+			hello = &h
+		}
+		cert, err := m.GetCertificate(hello)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get certificate for %#v: %v", hello.ServerName, err)
+		}
+		return cert, err
+	}
+}
+
+// startHTTP01Challenge starts the HTTP-01 challenge listener, errors are logged and they do not
+// prevent the certificates from being obtained using the TLS-ALPN-01 challenge
+func startHTTP01Challenge(port int, handler http.Handler) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		logger.Error(logSender, "", "unable to start the HTTP-01 challenge listener: %v", err)
+		return
+	}
+	server := &http.Server{
+		Handler:        handler,
+		ReadTimeout:    30 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		MaxHeaderBytes: 1 << 16, // 64KB
+	}
+	listenersMutex.Lock()
+	http01Server = server
+	http01Listener = listener
+	listenersMutex.Unlock()
+
+	logger.Info(logSender, "", "started HTTP-01 challenge listener on port %v", port)
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error(logSender, "", "HTTP-01 challenge listener error: %v", err)
+		}
+	}()
+}
+
+// startTLSALPN01Challenge starts the dedicated TLS-ALPN-01 challenge listener, errors are logged
+func startTLSALPN01Challenge(port int) {
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), GetTLSConfig())
+	if err != nil {
+		logger.Error(logSender, "", "unable to start the TLS-ALPN-01 challenge listener: %v", err)
+		return
+	}
+	listenersMutex.Lock()
+	tlsALPN01Listener = listener
+	listenersMutex.Unlock()
+
+	logger.Info(logSender, "", "started TLS-ALPN-01 challenge listener on port %v", port)
+	go serveTLSALPN01Challenge(listener)
+}
+
+func serveTLSALPN01Challenge(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			listenersMutex.Lock()
+			stopped := tlsALPN01Listener != listener
+			listenersMutex.Unlock()
+			if stopped {
+				logger.Debug(logSender, "", "TLS-ALPN-01 challenge listener stopped")
+			} else {
+				logger.Error(logSender, "", "TLS-ALPN-01 challenge listener error: %v", err)
+			}
+			return
+		}
+		// the challenge is completed during the handshake, the connection is not used
+		go func(conn *tls.Conn) {
+			conn.SetDeadline(time.Now().Add(30 * time.Second))
+			conn.Handshake()
+			conn.Close()
+		}(conn.(*tls.Conn))
+	}
+}
+
+// stopChallengeListeners closes the running challenge listeners, if any
+func stopChallengeListeners() {
+	listenersMutex.Lock()
+	defer listenersMutex.Unlock()
+
+	if http01Server != nil {
+		// the listener is closed here too since Serve could be not yet started, so the
+		// port is released when this function returns. It is already closed otherwise
+		http01Server.Close()
+		http01Listener.Close()
+		logger.Debug(logSender, "", "HTTP-01 challenge listener stopped")
+		http01Server = nil
+		http01Listener = nil
+	}
+	if tlsALPN01Listener != nil {
+		listener := tlsALPN01Listener
+		tlsALPN01Listener = nil
+		if err := listener.Close(); err != nil {
+			logger.Warn(logSender, "", "unable to stop the TLS-ALPN-01 challenge listener: %v", err)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package acme
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestConfigValidation(t *testing.T) {
+	c := Config{
+		Domains:   []string{"sftpgo.example.com"},
+		Protocols: []string{ProtocolHTTP, ProtocolFTP, ProtocolWebDAV},
+	}
+	if err := c.validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+	invalidConfigs := []Config{
+		{Domains: []string{""}},
+		{Domains: []string{"https://sftpgo.example.com"}},
+		{Domains: []string{"sftpgo.example.com"}, Protocols: []string{"SSH"}},
+		{Domains: []string{"sftpgo.example.com"}, RenewDays: -1},
+		{Domains: []string{"sftpgo.example.com"}, HTTP01Challenge: HTTP01Challenge{Port: 65536}},
+		{Domains: []string{"sftpgo.example.com"}, TLSALPN01Challenge: TLSALPN01Challenge{Port: -1}},
+		{Domains: []string{"sftpgo.example.com"}, HTTP01Challenge: HTTP01Challenge{Port: 8443},
+			TLSALPN01Challenge: TLSALPN01Challenge{Port: 8443}},
+	}
+	for _, config := range invalidConfigs {
+		if err := Initialize(config, os.TempDir()); err == nil {
+			t.Errorf("invalid config must fail: %+v", config)
+		}
+	}
+}
+
+func TestInitialize(t *testing.T) {
+	err := Initialize(Config{Protocols: []string{ProtocolHTTP}}, os.TempDir())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if IsEnabledForProtocol(ProtocolHTTP) {
+		t.Errorf("ACME must be disabled without domains")
+	}
+	_, err = GetCertificateFunc()(&tls.ClientHelloInfo{ServerName: "sftpgo.example.com"})
+	if err == nil {
+		t.Errorf("getting a certificate with ACME disabled must fail")
+	}
+	certsPath := filepath.Join(os.TempDir(), "acme_certs")
+	err = Initialize(Config{
+		Domains:   []string{"sftpgo.example.com"},
+		CertsPath: certsPath,
+		Protocols: []string{ProtocolHTTP},
+	}, os.TempDir())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !IsEnabledForProtocol(ProtocolHTTP) {
+		t.Errorf("ACME must be enabled for HTTP")
+	}
+	if IsEnabledForProtocol(ProtocolFTP) {
+		t.Errorf("ACME must be disabled for FTP")
+	}
+	// the host policy is checked before contacting the CA
+	_, err = GetCertificateFunc()(&tls.ClientHelloInfo{ServerName: "other.example.com"})
+	if err == nil {
+		t.Errorf("getting a certificate for a domain not configured must fail")
+	}
+	err = Initialize(Config{}, os.TempDir())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	os.RemoveAll(certsPath)
+}
+
+func TestHTTP01ChallengeListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to get a free port: %v", err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	certsPath := filepath.Join(os.TempDir(), "acme_certs")
+	err = Initialize(Config{
+		Domains:         []string{"sftpgo.example.com"},
+		CertsPath:       certsPath,
+		HTTP01Challenge: HTTP01Challenge{Port: port},
+	}, os.TempDir())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		resp, err = client.Get(fmt.Sprintf("http://127.0.0.1:%v/web", port))
+		if err == nil {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("unable to connect to the HTTP-01 challenge listener: %v", err)
+	}
+	resp.Body.Close()
+	// the requests that are not challenges are redirected to HTTPS
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	// the challenge tokens are served only for the configured domains
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%v/.well-known/acme-challenge/missing",
+		port), nil)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("unexpected status code for a domain not configured: %v", resp.StatusCode)
+		}
+	}
+	req.Host = "sftpgo.example.com"
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else {
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("unexpected status code for a missing token: %v", resp.StatusCode)
+		}
+	}
+	Initialize(Config{}, os.TempDir())
+	os.RemoveAll(certsPath)
+}
+
+func TestChallengeListenersStop(t *testing.T) {
+	var ports []int
+	for i := 0; i < 2; i++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to get a free port: %v", err)
+		}
+		ports = append(ports, listener.Addr().(*net.TCPAddr).Port)
+		listener.Close()
+	}
+	certsPath := filepath.Join(os.TempDir(), "acme_certs")
+	config := Config{
+		Domains:            []string{"sftpgo.example.com"},
+		CertsPath:          certsPath,
+		HTTP01Challenge:    HTTP01Challenge{Port: ports[0]},
+		TLSALPN01Challenge: TLSALPN01Challenge{Port: ports[1]},
+	}
+	// the listeners started by the first initialization are replaced
+	for i := 0; i < 2; i++ {
+		if err := Initialize(config, os.TempDir()); err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		listenersMutex.Lock()
+		if http01Server == nil || tlsALPN01Listener == nil {
+			t.Errorf("the challenge listeners must be started")
+		}
+		listenersMutex.Unlock()
+	}
+	Shutdown()
+	listenersMutex.Lock()
+	if http01Server != nil || tlsALPN01Listener != nil {
+		t.Errorf("the challenge listeners must be stopped")
+	}
+	listenersMutex.Unlock()
+	// the ports must be available again
+	for _, port := range ports {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			t.Errorf("port %v not released: %v", port, err)
+		} else {
+			listener.Close()
+		}
+	}
+	Initialize(Config{}, os.TempDir())
+	os.RemoveAll(certsPath)
+}
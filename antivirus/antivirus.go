@@ -0,0 +1,218 @@
+// Package antivirus scans the completed uploads using a clamd daemon or an ICAP server.
+// The infected files are deleted or moved to a quarantine directory
+package antivirus
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	logSender          = "antivirus"
+	quarantineLayout   = "20060102T150405"
+	defaultScanTimeout = 60
+)
+
+// Supported scan engines
+const (
+	EngineClamd = "clamd"
+	EngineICAP  = "icap"
+)
+
+// Supported actions for the infected files
+const (
+	ActionDelete     = "delete"
+	ActionQuarantine = "quarantine"
+)
+
+var (
+	mutex         sync.RWMutex
+	currentConfig Config
+	scanner       fileScanner
+)
+
+// Config defines the antivirus configuration
+type Config struct {
+	// Scan engine: "clamd" or "icap". Leave empty to disable the antivirus
+	Engine string `json:"engine" mapstructure:"engine"`
+	// For clamd, the absolute path to the unix socket or the TCP address as host:port.
+	// For ICAP, the service URL, for example icap://127.0.0.1:1344/avscan
+	Address string `json:"address" mapstructure:"address"`
+	// Timeout in seconds for each scan, 0 means 60 seconds
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+	// Action for the infected files: "delete" or "quarantine"
+	InfectedAction string `json:"infected_action" mapstructure:"infected_action"`
+	// Directory where the infected files are moved for the quarantine action.
+	// This can be an absolute path or a path relative to the config dir
+	QuarantinePath string `json:"quarantine_path" mapstructure:"quarantine_path"`
+	// Files bigger than this size, in bytes, are not scanned. 0 means no limit
+	MaxSize int64 `json:"max_size" mapstructure:"max_size"`
+}
+
+// InfectedError is returned if a virus is found inside a scanned file
+type InfectedError struct {
+	Signature string
+}
+
+func (e *InfectedError) Error() string {
+	return fmt.Sprintf("infected file detected: %v", e.Signature)
+}
+
+type fileScanner interface {
+	// scan returns the detected signature, empty if the file is clean
+	scan(r io.Reader, name string) (string, error)
+}
+
+func (c *Config) validate(configDir string) error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid antivirus timeout: %v", c.Timeout)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = defaultScanTimeout
+	}
+	if len(c.Address) == 0 {
+		return fmt.Errorf("the antivirus address is required for engine %#v", c.Engine)
+	}
+	switch c.InfectedAction {
+	case "", ActionDelete:
+		c.InfectedAction = ActionDelete
+	case ActionQuarantine:
+		if len(c.QuarantinePath) == 0 {
+			return fmt.Errorf("the quarantine action requires a quarantine path")
+		}
+		if !filepath.IsAbs(c.QuarantinePath) {
+			c.QuarantinePath = filepath.Join(configDir, c.QuarantinePath)
+		}
+		if err := os.MkdirAll(c.QuarantinePath, 0700); err != nil {
+			return fmt.Errorf("unable to create the quarantine path %#v: %v", c.QuarantinePath, err)
+		}
+	default:
+		return fmt.Errorf("invalid infected action: %#v", c.InfectedAction)
+	}
+	return nil
+}
+
+// Initialize configures the antivirus. The previous configuration, if any, is replaced
+func Initialize(config Config, configDir string) error {
+	var s fileScanner
+	switch config.Engine {
+	case "":
+	case EngineClamd:
+		if err := config.validate(configDir); err != nil {
+			return err
+		}
+		s = newClamdScanner(config.Address, time.Duration(config.Timeout)*time.Second)
+	case EngineICAP:
+		if err := config.validate(configDir); err != nil {
+			return err
+		}
+		icap, err := newICAPScanner(config.Address, time.Duration(config.Timeout)*time.Second)
+		if err != nil {
+			return err
+		}
+		s = icap
+	default:
+		return fmt.Errorf("unsupported antivirus engine: %#v", config.Engine)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	currentConfig = config
+	scanner = s
+	if s != nil {
+		logger.Debug(logSender, "", "antivirus configured, engine: %#v, address: %#v, infected action: %#v",
+			config.Engine, config.Address, config.InfectedAction)
+	}
+	return nil
+}
+
+// IsEnabled returns true if an antivirus engine is configured
+func IsEnabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return scanner != nil
+}
+
+// ScanFile scans the given local file. targetPath is the final path for the file, it differs from filePath
+// for the atomic uploads. If a virus is found the file is deleted or quarantined, based on the configured
+// action, and an *InfectedError is returned together with the quarantine path, if any.
+// The scan errors are logged and the file is considered clean, so a scan engine failure does not
+// block the uploads
+func ScanFile(filePath, targetPath, username, connectionID string) (string, error) {
+	mutex.RLock()
+	s := scanner
+	config := currentConfig
+	mutex.RUnlock()
+	if s == nil {
+		return "", nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to stat file %#v to scan: %v", filePath, err)
+		return "", nil
+	}
+	if config.MaxSize > 0 && info.Size() > config.MaxSize {
+		logger.Debug(logSender, connectionID, "file %#v not scanned, size %v is greater than the limit",
+			filePath, info.Size())
+		return "", nil
+	}
+	f, err := os.Open(filePath)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to open file %#v to scan: %v", filePath, err)
+		return "", nil
+	}
+	startTime := time.Now()
+	signature, err := s.scan(f, filepath.Base(targetPath))
+	f.Close()
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to scan file %#v: %v", filePath, err)
+		return "", nil
+	}
+	logger.Debug(logSender, connectionID, "file %#v scanned, elapsed: %v, signature: %#v", filePath,
+		time.Since(startTime), signature)
+	if len(signature) == 0 {
+		return "", nil
+	}
+	quarantinePath := handleInfectedFile(config, filePath, targetPath, username, connectionID, signature)
+	return quarantinePath, &InfectedError{Signature: signature}
+}
+
+// handleInfectedFile deletes or quarantines the given infected file, it returns the quarantine path, if any.
+// If the file cannot be moved to the quarantine directory it is deleted
+func handleInfectedFile(config Config, filePath, targetPath, username, connectionID, signature string) string {
+	if config.InfectedAction == ActionQuarantine {
+		quarantinePath := filepath.Join(config.QuarantinePath, fmt.Sprintf("%v_%v_%v", sanitizeName(username),
+			time.Now().Format(quarantineLayout), filepath.Base(targetPath)))
+		err := os.Rename(filePath, quarantinePath)
+		logger.Warn(logSender, connectionID, "infected file %#v, user %#v, signature %#v, moved to quarantine %#v, error: %v",
+			filePath, username, signature, quarantinePath, err)
+		if err == nil {
+			return quarantinePath
+		}
+	}
+	err := os.Remove(filePath)
+	logger.Warn(logSender, connectionID, "infected file %#v, user %#v, signature %#v, deleted, error: %v",
+		filePath, username, signature, err)
+	return ""
+}
+
+func sanitizeName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == os.PathSeparator {
+			return '_'
+		}
+		return r
+	}, name)
+}
+
+// IsInfected returns true if the given error is an *InfectedError
+func IsInfected(err error) bool {
+	_, ok := err.(*InfectedError)
+	return ok
+}
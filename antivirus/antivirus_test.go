@@ -0,0 +1,273 @@
+package antivirus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const infectedContent = "this file contains a virus"
+
+// startClamdServer starts a minimal clamd emulation, the streams containing
+// infectedContent are reported as infected
+func startClamdServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleClamdConn(conn)
+		}
+	}()
+	return l
+}
+
+func handleClamdConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	cmd, err := r.ReadString('\x00')
+	if err != nil || cmd != "zINSTREAM\x00" {
+		conn.Write([]byte("UNKNOWN COMMAND\x00"))
+		return
+	}
+	var data bytes.Buffer
+	size := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, size); err != nil {
+			return
+		}
+		n := binary.BigEndian.Uint32(size)
+		if n == 0 {
+			break
+		}
+		if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+			return
+		}
+	}
+	if strings.Contains(data.String(), infectedContent) {
+		conn.Write([]byte("stream: Test-Signature FOUND\x00"))
+	} else {
+		conn.Write([]byte("stream: OK\x00"))
+	}
+}
+
+// startICAPServer starts a minimal ICAP emulation, the responses containing
+// infectedContent are reported as infected
+func startICAPServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleICAPConn(conn)
+		}
+	}()
+	return l
+}
+
+func handleICAPConn(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewReader(bufio.NewReader(conn))
+	requestLine, err := tp.ReadLine()
+	if err != nil || !strings.HasPrefix(requestLine, "RESPMOD ") {
+		return
+	}
+	if _, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	// encapsulated HTTP response headers
+	if _, err = tp.ReadLine(); err != nil {
+		return
+	}
+	if _, err = tp.ReadMIMEHeader(); err != nil {
+		return
+	}
+	var data bytes.Buffer
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		n, err := strconv.ParseInt(line, 16, 64)
+		if err != nil {
+			return
+		}
+		if n == 0 {
+			break
+		}
+		if _, err = io.CopyN(&data, tp.R, n); err != nil {
+			return
+		}
+		if _, err = tp.ReadLine(); err != nil {
+			return
+		}
+	}
+	if strings.Contains(data.String(), infectedContent) {
+		fmt.Fprintf(conn, "ICAP/1.0 200 OK\r\nX-Infection-Found: Type=0; Resolution=2; Threat=ICAP-Signature;\r\n"+
+			"Encapsulated: null-body=0\r\n\r\n")
+	} else {
+		fmt.Fprintf(conn, "ICAP/1.0 204 No Content\r\nEncapsulated: null-body=0\r\n\r\n")
+	}
+}
+
+func writeTestFile(t *testing.T, name, content string) string {
+	filePath := filepath.Join(os.TempDir(), name)
+	if err := ioutil.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	return filePath
+}
+
+func TestInitialize(t *testing.T) {
+	invalidConfigs := []Config{
+		{Engine: "unknown", Address: "127.0.0.1:3310"},
+		{Engine: EngineClamd},
+		{Engine: EngineClamd, Address: "127.0.0.1:3310", Timeout: -1},
+		{Engine: EngineClamd, Address: "127.0.0.1:3310", InfectedAction: "unknown"},
+		{Engine: EngineClamd, Address: "127.0.0.1:3310", InfectedAction: ActionQuarantine},
+		{Engine: EngineICAP, Address: "http://127.0.0.1:1344/avscan"},
+		{Engine: EngineICAP, Address: "icap://"},
+	}
+	for _, c := range invalidConfigs {
+		if err := Initialize(c, os.TempDir()); err == nil {
+			t.Errorf("config %+v must be invalid", c)
+		}
+	}
+	if err := Initialize(Config{}, os.TempDir()); err != nil {
+		t.Errorf("unable to disable the antivirus: %v", err)
+	}
+	if IsEnabled() {
+		t.Error("the antivirus must be disabled")
+	}
+	filePath := writeTestFile(t, "antivirus_disabled", infectedContent)
+	defer os.Remove(filePath)
+	if _, err := ScanFile(filePath, filePath, "user", ""); err != nil {
+		t.Errorf("unexpected error with the antivirus disabled: %v", err)
+	}
+	if _, err := os.Stat(filePath); err != nil {
+		t.Errorf("the file must not be removed with the antivirus disabled: %v", err)
+	}
+	s, err := newICAPScanner("icap://127.0.0.1/avscan", defaultScanTimeout)
+	if err != nil {
+		t.Errorf("unable to create ICAP scanner: %v", err)
+	} else if s.host != "127.0.0.1:1344" {
+		t.Errorf("unexpected ICAP host: %#v", s.host)
+	}
+}
+
+func TestClamdScan(t *testing.T) {
+	l := startClamdServer(t)
+	defer l.Close()
+	err := Initialize(Config{Engine: EngineClamd, Address: l.Addr().String()}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize antivirus: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+	if !IsEnabled() {
+		t.Error("the antivirus must be enabled")
+	}
+	cleanFile := writeTestFile(t, "antivirus_clean", "clean content")
+	defer os.Remove(cleanFile)
+	if _, err = ScanFile(cleanFile, cleanFile, "user", ""); err != nil {
+		t.Errorf("unexpected error for a clean file: %v", err)
+	}
+	infectedFile := writeTestFile(t, "antivirus_infected", infectedContent)
+	defer os.Remove(infectedFile)
+	quarantinePath, err := ScanFile(infectedFile, infectedFile, "user", "")
+	if !IsInfected(err) {
+		t.Errorf("the file must be infected: %v", err)
+	} else if err.(*InfectedError).Signature != "Test-Signature" {
+		t.Errorf("unexpected signature: %#v", err.(*InfectedError).Signature)
+	}
+	if len(quarantinePath) > 0 {
+		t.Errorf("unexpected quarantine path: %#v", quarantinePath)
+	}
+	if _, err = os.Stat(infectedFile); !os.IsNotExist(err) {
+		t.Errorf("the infected file must be deleted: %v", err)
+	}
+	// scan errors do not block the uploads
+	l.Close()
+	infectedFile = writeTestFile(t, "antivirus_infected", infectedContent)
+	if _, err = ScanFile(infectedFile, infectedFile, "user", ""); err != nil {
+		t.Errorf("a scan error must be ignored: %v", err)
+	}
+	if _, err = os.Stat(infectedFile); err != nil {
+		t.Errorf("the file must be preserved after a scan error: %v", err)
+	}
+	_, err = parseClamdResponse("stream: Size limit exceeded ERROR")
+	if err == nil {
+		t.Error("a clamd error response must fail")
+	}
+	_, err = parseClamdResponse("unexpected")
+	if err == nil {
+		t.Error("an unexpected clamd response must fail")
+	}
+}
+
+func TestICAPScanAndQuarantine(t *testing.T) {
+	l := startICAPServer(t)
+	defer l.Close()
+	quarantineDir := filepath.Join(os.TempDir(), "antivirus_quarantine")
+	os.RemoveAll(quarantineDir)
+	defer os.RemoveAll(quarantineDir)
+	err := Initialize(Config{
+		Engine:         EngineICAP,
+		Address:        fmt.Sprintf("icap://%v/avscan", l.Addr().String()),
+		InfectedAction: ActionQuarantine,
+		QuarantinePath: quarantineDir,
+		MaxSize:        100,
+	}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize antivirus: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+	cleanFile := writeTestFile(t, "antivirus_clean", "clean content")
+	defer os.Remove(cleanFile)
+	if _, err = ScanFile(cleanFile, cleanFile, "user", ""); err != nil {
+		t.Errorf("unexpected error for a clean file: %v", err)
+	}
+	infectedFile := writeTestFile(t, "antivirus_tmp_upload", infectedContent)
+	defer os.Remove(infectedFile)
+	quarantinePath, err := ScanFile(infectedFile, "/home/user/file.txt", "user", "")
+	if !IsInfected(err) {
+		t.Errorf("the file must be infected: %v", err)
+	} else if err.(*InfectedError).Signature != "ICAP-Signature" {
+		t.Errorf("unexpected signature: %#v", err.(*InfectedError).Signature)
+	}
+	if filepath.Dir(quarantinePath) != quarantineDir || !strings.HasPrefix(filepath.Base(quarantinePath), "user_") ||
+		!strings.HasSuffix(quarantinePath, "_file.txt") {
+		t.Errorf("unexpected quarantine path: %#v", quarantinePath)
+	}
+	if _, err = os.Stat(quarantinePath); err != nil {
+		t.Errorf("the infected file must be quarantined: %v", err)
+	}
+	if _, err = os.Stat(infectedFile); !os.IsNotExist(err) {
+		t.Errorf("the infected file must be moved: %v", err)
+	}
+	// files bigger than max_size are not scanned
+	bigFile := writeTestFile(t, "antivirus_big", infectedContent+strings.Repeat("a", 100))
+	defer os.Remove(bigFile)
+	if _, err = ScanFile(bigFile, bigFile, "user", ""); err != nil {
+		t.Errorf("a file bigger than max_size must not be scanned: %v", err)
+	}
+}
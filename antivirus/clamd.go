@@ -0,0 +1,97 @@
+package antivirus
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	clamdChunkSize      = 32768
+	clamdFoundSuffix    = " FOUND"
+	clamdErrorSuffix    = " ERROR"
+	clamdResponsePrefix = "stream: "
+)
+
+// clamdScanner scans the files using the clamd INSTREAM command
+type clamdScanner struct {
+	network string
+	address string
+	timeout time.Duration
+}
+
+func newClamdScanner(address string, timeout time.Duration) *clamdScanner {
+	network := "tcp"
+	if filepath.IsAbs(address) {
+		network = "unix"
+	}
+	return &clamdScanner{
+		network: network,
+		address: address,
+		timeout: timeout,
+	}
+}
+
+func (s *clamdScanner) scan(r io.Reader, name string) (string, error) {
+	conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err = conn.Write(size); err != nil {
+				return "", err
+			}
+			if _, err = conn.Write(buf[:n]); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	// a zero length chunk terminates the stream
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return "", err
+	}
+	response, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	return parseClamdResponse(response)
+}
+
+// parseClamdResponse parses responses such as "stream: OK" or "stream: Eicar-Signature FOUND"
+func parseClamdResponse(response string) (string, error) {
+	response = strings.TrimSpace(strings.TrimRight(response, "\x00"))
+	result := strings.TrimPrefix(response, clamdResponsePrefix)
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, clamdFoundSuffix):
+		return strings.TrimSuffix(result, clamdFoundSuffix), nil
+	case strings.HasSuffix(result, clamdErrorSuffix):
+		return "", fmt.Errorf("clamd error: %v", strings.TrimSuffix(result, clamdErrorSuffix))
+	}
+	return "", fmt.Errorf("unexpected clamd response: %#v", response)
+}
@@ -0,0 +1,137 @@
+package antivirus
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	icapDefaultPort = "1344"
+	icapChunkSize   = 32768
+)
+
+// headers used by the ICAP servers to report the detected virus
+var icapVirusHeaders = []string{"X-Virus-Id", "X-Infection-Found", "X-Violations-Found"}
+
+// icapScanner scans the files using the ICAP RESPMOD method, the file is sent
+// as the body of an HTTP response
+type icapScanner struct {
+	serviceURL string
+	host       string
+	timeout    time.Duration
+}
+
+func newICAPScanner(serviceURL string, timeout time.Duration) (*icapScanner, error) {
+	u, err := url.Parse(serviceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ICAP service URL %#v: %v", serviceURL, err)
+	}
+	if u.Scheme != "icap" || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid ICAP service URL %#v", serviceURL)
+	}
+	host := u.Host
+	if len(u.Port()) == 0 {
+		host = net.JoinHostPort(u.Hostname(), icapDefaultPort)
+	}
+	return &icapScanner{
+		serviceURL: serviceURL,
+		host:       host,
+		timeout:    timeout,
+	}, nil
+}
+
+func (s *icapScanner) scan(r io.Reader, name string) (string, error) {
+	conn, err := net.DialTimeout("tcp", s.host, s.timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		return "", err
+	}
+	resHeader := fmt.Sprintf("HTTP/1.1 200 OK\r\nContent-Type: application/octet-stream\r\n"+
+		"Content-Disposition: attachment; filename=%v\r\n\r\n", strconv.Quote(name))
+	request := fmt.Sprintf("RESPMOD %v ICAP/1.0\r\nHost: %v\r\nAllow: 204\r\nEncapsulated: res-hdr=0, res-body=%v\r\n\r\n",
+		s.serviceURL, s.host, len(resHeader))
+	w := bufio.NewWriter(conn)
+	if _, err = w.WriteString(request + resHeader); err != nil {
+		return "", err
+	}
+	buf := make([]byte, icapChunkSize)
+	for {
+		n, readErr := r.Read(buf)
+		if n > 0 {
+			if _, err = fmt.Fprintf(w, "%x\r\n", n); err != nil {
+				return "", err
+			}
+			if _, err = w.Write(buf[:n]); err != nil {
+				return "", err
+			}
+			if _, err = w.WriteString("\r\n"); err != nil {
+				return "", err
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return "", readErr
+		}
+	}
+	if _, err = w.WriteString("0\r\n\r\n"); err != nil {
+		return "", err
+	}
+	if err = w.Flush(); err != nil {
+		return "", err
+	}
+	return readICAPResponse(bufio.NewReader(conn))
+}
+
+// readICAPResponse returns the detected signature, if any. 204 means the file is clean,
+// 200 means the ICAP server modified the content, so the file is infected
+func readICAPResponse(r *bufio.Reader) (string, error) {
+	tp := textproto.NewReader(r)
+	statusLine, err := tp.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(statusLine, " ", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[0], "ICAP/") {
+		return "", fmt.Errorf("unexpected ICAP status line: %#v", statusLine)
+	}
+	headers, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	switch parts[1] {
+	case "204":
+		return "", nil
+	case "200":
+		for _, h := range icapVirusHeaders {
+			if value := headers.Get(h); len(value) > 0 {
+				return parseICAPVirusHeader(value), nil
+			}
+		}
+		return "unknown", nil
+	}
+	return "", fmt.Errorf("unexpected ICAP status: %#v", statusLine)
+}
+
+// parseICAPVirusHeader extracts the threat name from headers such as
+// "Type=0; Resolution=2; Threat=Eicar-Test-Signature;"
+func parseICAPVirusHeader(value string) string {
+	for _, field := range strings.Split(value, ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "Threat=") {
+			return strings.TrimPrefix(field, "Threat=")
+		}
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,278 @@
+// Package audit emits structured events about logins and file operations, for compliance purposes.
+// The events are written as JSON lines to a dedicated rotating file and/or sent to a remote
+// UDP or TCP sink. The audit stream is separate from the application log and its field names
+// are stable.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	lumberjack "gopkg.in/natefinch/lumberjack.v2"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender  = "audit"
+	timeFormat = "2006-01-02T15:04:05.000Z07:00"
+	// the events not yet sent to the remote sink are dropped once this limit is reached
+	maxPendingEvents = 1000
+	sinkTimeout      = 5 * time.Second
+)
+
+// Supported audit events
+const (
+	EventLogin            = "login"
+	EventLoginFailed      = "login_failed"
+	EventLogout           = "logout"
+	EventUpload           = "upload"
+	EventDownload         = "download"
+	EventDelete           = "delete"
+	EventRename           = "rename"
+	EventPermissionDenied = "permission_denied"
+)
+
+var (
+	mutex   sync.RWMutex
+	current *auditLogger
+)
+
+// Config defines the audit log configuration
+type Config struct {
+	// Path to the audit log file. This can be an absolute path or a path relative to the
+	// config dir. Leave empty to disable the audit log file
+	LogFilePath string `json:"log_file_path" mapstructure:"log_file_path"`
+	// Maximum size in megabytes of the audit log file before it gets rotated
+	LogMaxSize int `json:"log_max_size" mapstructure:"log_max_size"`
+	// Maximum number of old audit log files to retain
+	LogMaxBackups int `json:"log_max_backups" mapstructure:"log_max_backups"`
+	// Maximum number of days to retain old audit log files
+	LogMaxAge int `json:"log_max_age" mapstructure:"log_max_age"`
+	// Set to true to compress the rotated audit log files
+	LogCompress bool `json:"log_compress" mapstructure:"log_compress"`
+	// Address, as host:port, of the remote sink. Leave empty to disable the remote sink
+	RemoteAddress string `json:"remote_address" mapstructure:"remote_address"`
+	// Network for the remote sink: "udp" or "tcp". Empty means "udp"
+	RemoteNetwork string `json:"remote_network" mapstructure:"remote_network"`
+}
+
+// Event defines an audit event. All the fields are always included in the JSON output,
+// the not applicable ones have their zero value
+type Event struct {
+	// Event time as RFC3339 with milliseconds, it is set by Log
+	Time string `json:"time"`
+	// Event type, for example login or upload
+	Event    string `json:"event"`
+	Username string `json:"username"`
+	// Protocol: SSH, SFTP, SCP, FTP, DAV, HTTP
+	Protocol     string `json:"protocol"`
+	ConnectionID string `json:"connection_id"`
+	RemoteIP     string `json:"remote_ip"`
+	// Denied operation, for permission_denied events only
+	Operation string `json:"operation"`
+	// Login method, for login and login_failed events only
+	LoginMethod string `json:"login_method"`
+	// Path affected by the file operations, it is the same path reported in the application log.
+	// For permission_denied events it is the requested virtual path
+	Path string `json:"path"`
+	// Target path for the rename events
+	TargetPath string `json:"target_path"`
+	// Transferred bytes for the upload and download events
+	SizeBytes int64 `json:"size_bytes"`
+	// Transfer duration for the upload and download events
+	ElapsedMs int64 `json:"elapsed_ms"`
+	// Error, if any
+	Error string `json:"error"`
+}
+
+type auditLogger struct {
+	file *lumberjack.Logger
+	sink *remoteSink
+}
+
+type remoteSink struct {
+	network string
+	address string
+	conn    net.Conn
+	events  chan []byte
+	done    chan bool
+}
+
+// Initialize configures the audit log. The previous configuration, if any, is replaced.
+// If both the log file path and the remote address are empty the audit log is disabled
+func Initialize(config Config, configDir string) error {
+	var l *auditLogger
+	if len(config.LogFilePath) > 0 || len(config.RemoteAddress) > 0 {
+		l = &auditLogger{}
+		if len(config.LogFilePath) > 0 {
+			if !utils.IsFileInputValid(config.LogFilePath) {
+				return fmt.Errorf("invalid audit log file path: %#v", config.LogFilePath)
+			}
+			logFilePath := config.LogFilePath
+			if !filepath.IsAbs(logFilePath) {
+				logFilePath = filepath.Join(configDir, logFilePath)
+			}
+			l.file = &lumberjack.Logger{
+				Filename:   logFilePath,
+				MaxSize:    config.LogMaxSize,
+				MaxBackups: config.LogMaxBackups,
+				MaxAge:     config.LogMaxAge,
+				Compress:   config.LogCompress,
+			}
+		}
+		if len(config.RemoteAddress) > 0 {
+			network := config.RemoteNetwork
+			if len(network) == 0 {
+				network = "udp"
+			}
+			if network != "udp" && network != "tcp" {
+				return fmt.Errorf("invalid audit remote network: %#v", config.RemoteNetwork)
+			}
+			if _, _, err := net.SplitHostPort(config.RemoteAddress); err != nil {
+				return fmt.Errorf("invalid audit remote address %#v: %v", config.RemoteAddress, err)
+			}
+			l.sink = &remoteSink{
+				network: network,
+				address: config.RemoteAddress,
+				events:  make(chan []byte, maxPendingEvents),
+				done:    make(chan bool),
+			}
+			go l.sink.run()
+		}
+	}
+
+	mutex.Lock()
+	previous := current
+	current = l
+	mutex.Unlock()
+
+	if previous != nil {
+		previous.close()
+	}
+	return nil
+}
+
+// IsEnabled returns true if the audit log is enabled
+func IsEnabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return current != nil
+}
+
+// Log emits the given audit event, it does nothing if the audit log is disabled.
+// The events are sent to the remote sink asynchronously, so a slow sink does not
+// affect the protocol servers
+func Log(event Event) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	if current == nil {
+		return
+	}
+	event.Time = time.Now().UTC().Format(timeFormat)
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Warn(logSender, event.ConnectionID, "unable to marshal audit event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+	if current.file != nil {
+		if _, err = current.file.Write(data); err != nil {
+			logger.Warn(logSender, event.ConnectionID, "unable to write audit event: %v", err)
+		}
+	}
+	if current.sink != nil {
+		select {
+		case current.sink.events <- data:
+		default:
+			logger.Warn(logSender, event.ConnectionID, "too many pending events for the remote audit sink, event %#v dropped",
+				event.Event)
+		}
+	}
+}
+
+// LogTransfer emits an upload or download event for a completed or failed transfer
+func LogTransfer(isUpload bool, username, protocol, connectionID, remoteIP, path string, size int64,
+	elapsed time.Duration, err error) {
+	event := Event{
+		Event:        EventDownload,
+		Username:     username,
+		Protocol:     protocol,
+		ConnectionID: connectionID,
+		RemoteIP:     remoteIP,
+		Path:         path,
+		SizeBytes:    size,
+		ElapsedMs:    elapsed.Nanoseconds() / 1000000,
+	}
+	if isUpload {
+		event.Event = EventUpload
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Log(event)
+}
+
+// LogOperation emits an event for a file operation such as delete or rename
+func LogOperation(event, username, protocol, connectionID, remoteIP, path, target string) {
+	Log(Event{
+		Event:        event,
+		Username:     username,
+		Protocol:     protocol,
+		ConnectionID: connectionID,
+		RemoteIP:     remoteIP,
+		Path:         path,
+		TargetPath:   target,
+	})
+}
+
+func (l *auditLogger) close() {
+	if l.sink != nil {
+		close(l.sink.events)
+		<-l.sink.done
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+}
+
+func (s *remoteSink) run() {
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+		close(s.done)
+	}()
+
+	for data := range s.events {
+		if err := s.send(data); err != nil {
+			logger.Warn(logSender, "", "unable to send audit event to %v %#v: %v", s.network, s.address, err)
+		}
+	}
+}
+
+// send writes the event to the remote sink. The connection is established on demand and
+// it is closed on write errors, so it will be established again for the next event
+func (s *remoteSink) send(data []byte) error {
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	_, err := s.conn.Write(data)
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
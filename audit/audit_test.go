@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInvalidConfig(t *testing.T) {
+	if err := Initialize(Config{LogFilePath: "."}, os.TempDir()); err == nil {
+		t.Error("invalid log file path must fail")
+	}
+	if err := Initialize(Config{RemoteAddress: "127.0.0.1:5140", RemoteNetwork: "unix"}, os.TempDir()); err == nil {
+		t.Error("invalid remote network must fail")
+	}
+	if err := Initialize(Config{RemoteAddress: "127.0.0.1"}, os.TempDir()); err == nil {
+		t.Error("remote address without a port must fail")
+	}
+	if err := Initialize(Config{}, os.TempDir()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if IsEnabled() {
+		t.Error("an empty configuration must disable the audit log")
+	}
+	// this must not panic
+	Log(Event{Event: EventLogin})
+}
+
+func TestLogFile(t *testing.T) {
+	configDir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(configDir)
+
+	err = Initialize(Config{LogFilePath: "audit.log", LogMaxSize: 1}, configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize audit log: %v", err)
+	}
+	if !IsEnabled() {
+		t.Error("audit log must be enabled")
+	}
+	Log(Event{Event: EventLogin, Username: "user", Protocol: "SSH", RemoteIP: "127.0.0.1", LoginMethod: "password"})
+	Log(Event{Event: EventUpload, Username: "user", Protocol: "SFTP", Path: "/file", SizeBytes: 100})
+	Initialize(Config{}, configDir)
+
+	data, err := ioutil.ReadFile(filepath.Join(configDir, "audit.log"))
+	if err != nil {
+		t.Fatalf("unable to read audit log: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("unexpected audit log lines: %v", lines)
+	}
+	var event Event
+	if err = json.Unmarshal([]byte(lines[1]), &event); err != nil {
+		t.Fatalf("unable to parse audit event: %v", err)
+	}
+	if event.Event != EventUpload || event.Path != "/file" || event.SizeBytes != 100 || event.Time == "" {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+	// all the fields are always included
+	var fields map[string]interface{}
+	if err = json.Unmarshal([]byte(lines[0]), &fields); err != nil {
+		t.Fatalf("unable to parse audit event: %v", err)
+	}
+	for _, field := range []string{"time", "event", "username", "protocol", "connection_id", "remote_ip", "operation",
+		"login_method", "path", "target_path", "size_bytes", "elapsed_ms", "error"} {
+		if _, ok := fields[field]; !ok {
+			t.Errorf("field %#v not found in audit event %v", field, lines[0])
+		}
+	}
+}
+
+func TestUDPSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer conn.Close()
+
+	err = Initialize(Config{RemoteAddress: conn.LocalAddr().String()}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize audit log: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+
+	Log(Event{Event: EventDelete, Username: "user", Protocol: "FTP", Path: "/file"})
+	buf := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("unable to read audit event: %v", err)
+	}
+	var event Event
+	if err = json.Unmarshal(buf[:n], &event); err != nil {
+		t.Fatalf("unable to parse audit event: %v", err)
+	}
+	if event.Event != EventDelete || event.Protocol != "FTP" {
+		t.Errorf("unexpected audit event: %+v", event)
+	}
+}
+
+func TestTCPSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer listener.Close()
+
+	err = Initialize(Config{RemoteAddress: listener.Addr().String(), RemoteNetwork: "tcp"}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize audit log: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+
+	Log(Event{Event: EventRename, Username: "user", Protocol: "DAV", Path: "/a", TargetPath: "/b"})
+	Log(Event{Event: EventLogout, Username: "user", Protocol: "DAV"})
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("unable to accept: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	scanner := bufio.NewScanner(conn)
+	var events []string
+	for len(events) < 2 && scanner.Scan() {
+		var event Event
+		if err = json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatalf("unable to parse audit event: %v", err)
+		}
+		events = append(events, event.Event)
+	}
+	if len(events) != 2 || events[0] != EventRename || events[1] != EventLogout {
+		t.Errorf("unexpected audit events: %v", events)
+	}
+}
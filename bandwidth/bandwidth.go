@@ -0,0 +1,206 @@
+// Package bandwidth implements server level bandwidth limits based on the source network.
+// All the transfers from the same source IP share the configured limits, regardless of
+// the connection and the user
+package bandwidth
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender = "bandwidth"
+	// the throttled sources without pending data are removed once this limit is reached
+	maxSources = 1000
+)
+
+var (
+	supportedProtocols = []string{"SFTP", "SCP", "SSH", "FTP", "DAV", "HTTP"}
+	limiter            *sourceLimiter
+)
+
+// Limit defines the bandwidth limits for a group of source networks
+type Limit struct {
+	// IP addresses or CIDR networks this limit applies to
+	Sources []string `json:"sources" mapstructure:"sources"`
+	// Protocols this limit applies to. Supported values: SFTP, SCP, SSH, FTP, DAV, HTTP.
+	// Empty means all the supported protocols
+	Protocols []string `json:"protocols" mapstructure:"protocols"`
+	// Maximum upload bandwidth as KB/s shared by all the transfers from the same source IP, 0 means unlimited
+	UploadBandwidth int64 `json:"upload_bandwidth" mapstructure:"upload_bandwidth"`
+	// Maximum download bandwidth as KB/s shared by all the transfers from the same source IP, 0 means unlimited
+	DownloadBandwidth int64 `json:"download_bandwidth" mapstructure:"download_bandwidth"`
+}
+
+// Config defines the server level bandwidth limits
+type Config struct {
+	// Limits are evaluated in order, the first limit matching the source IP
+	// and the protocol is applied
+	Limits []Limit `json:"limits" mapstructure:"limits"`
+}
+
+type limit struct {
+	networks          []*net.IPNet
+	protocols         []string
+	uploadBandwidth   int64
+	downloadBandwidth int64
+}
+
+type sourceKey struct {
+	limit    int
+	ip       string
+	isUpload bool
+}
+
+type sourceLimiter struct {
+	sync.Mutex
+	limits []limit
+	// for each throttled source we store the time when the data already
+	// transferred is allowed by the bandwidth limit
+	sources map[sourceKey]time.Time
+}
+
+// Initialize configures the bandwidth limits, an empty configuration disables them
+func Initialize(config Config) error {
+	if len(config.Limits) == 0 {
+		limiter = nil
+		return nil
+	}
+	var limits []limit
+	for idx, l := range config.Limits {
+		if l.UploadBandwidth < 0 || l.DownloadBandwidth < 0 {
+			return fmt.Errorf("invalid bandwidth for limit %v, upload: %v download: %v", idx, l.UploadBandwidth,
+				l.DownloadBandwidth)
+		}
+		networks, err := parseIPList(l.Sources)
+		if err != nil {
+			return fmt.Errorf("invalid sources for limit %v: %v", idx, err)
+		}
+		if len(networks) == 0 {
+			return fmt.Errorf("no sources defined for limit %v", idx)
+		}
+		for _, protocol := range l.Protocols {
+			if !utils.IsStringInSlice(protocol, supportedProtocols) {
+				return fmt.Errorf("invalid protocol %#v for limit %v", protocol, idx)
+			}
+		}
+		limits = append(limits, limit{
+			networks:          networks,
+			protocols:         l.Protocols,
+			uploadBandwidth:   l.UploadBandwidth,
+			downloadBandwidth: l.DownloadBandwidth,
+		})
+	}
+	limiter = &sourceLimiter{
+		limits:  limits,
+		sources: make(map[sourceKey]time.Time),
+	}
+	logger.Debug(logSender, "", "bandwidth limits initialized with config %+v", config)
+	return nil
+}
+
+// Throttle must be called after transferring size bytes from or to the given source IP,
+// it sleeps as needed to respect the bandwidth limit, if any
+func Throttle(ip, protocol string, isUpload bool, size int64) {
+	if limiter == nil || size <= 0 {
+		return
+	}
+	limiter.throttle(ip, protocol, isUpload, size)
+}
+
+// getLimitIndex returns the index of the first limit matching the given IP and protocol or -1
+func (l *sourceLimiter) getLimitIndex(ip, protocol string) int {
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return -1
+	}
+	for idx, lim := range l.limits {
+		if len(lim.protocols) > 0 && !utils.IsStringInSlice(protocol, lim.protocols) {
+			continue
+		}
+		for _, network := range lim.networks {
+			if network.Contains(parsedIP) {
+				return idx
+			}
+		}
+	}
+	return -1
+}
+
+func (l *sourceLimiter) throttle(ip, protocol string, isUpload bool, size int64) {
+	idx := l.getLimitIndex(ip, protocol)
+	if idx < 0 {
+		return
+	}
+	wantedBandwidth := l.limits[idx].downloadBandwidth
+	if isUpload {
+		wantedBandwidth = l.limits[idx].uploadBandwidth
+	}
+	if wantedBandwidth <= 0 {
+		return
+	}
+	key := sourceKey{
+		limit:    idx,
+		ip:       ip,
+		isUpload: isUpload,
+	}
+	l.Lock()
+	now := time.Now()
+	allowedAt, ok := l.sources[key]
+	if !ok {
+		l.cleanup(now)
+	}
+	if allowedAt.Before(now) {
+		allowedAt = now
+	}
+	// the bandwidth is KB/s, so size bytes need size / bandwidth milliseconds
+	allowedAt = allowedAt.Add(time.Duration(size) * time.Millisecond / time.Duration(wantedBandwidth))
+	l.sources[key] = allowedAt
+	l.Unlock()
+
+	if toSleep := time.Until(allowedAt); toSleep > 0 {
+		time.Sleep(toSleep)
+	}
+}
+
+// cleanup removes the sources without pending data if there are too many sources.
+// The caller must hold the lock
+func (l *sourceLimiter) cleanup(now time.Time) {
+	if len(l.sources) < maxSources {
+		return
+	}
+	for k, v := range l.sources {
+		if v.Before(now) {
+			delete(l.sources, k)
+		}
+	}
+}
+
+func parseIPList(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
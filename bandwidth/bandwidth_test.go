@@ -0,0 +1,131 @@
+package bandwidth
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInvalidConfig(t *testing.T) {
+	config := Config{
+		Limits: []Limit{
+			{Sources: []string{"127.0.0.1"}, UploadBandwidth: -1},
+		},
+	}
+	if err := Initialize(config); err == nil {
+		t.Error("negative bandwidth must fail")
+	}
+	config.Limits[0].UploadBandwidth = 100
+	config.Limits[0].Sources = []string{"192.168.1.1/33"}
+	if err := Initialize(config); err == nil {
+		t.Error("invalid sources must fail")
+	}
+	config.Limits[0].Sources = []string{" "}
+	if err := Initialize(config); err == nil {
+		t.Error("empty sources must fail")
+	}
+	config.Limits[0].Sources = []string{"127.0.0.1"}
+	config.Limits[0].Protocols = []string{"SFTP", "invalid"}
+	if err := Initialize(config); err == nil {
+		t.Error("invalid protocols must fail")
+	}
+	if err := Initialize(Config{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if limiter != nil {
+		t.Error("an empty configuration must disable the limits")
+	}
+	// this must not block
+	Throttle("127.0.0.1", "SFTP", true, 1000000)
+}
+
+func TestLimitMatching(t *testing.T) {
+	config := Config{
+		Limits: []Limit{
+			{Sources: []string{"192.168.0.0/16"}},
+			{Sources: []string{"0.0.0.0/0"}, Protocols: []string{"DAV"}, DownloadBandwidth: 200},
+			{Sources: []string{"0.0.0.0/0", "::1"}, UploadBandwidth: 100, DownloadBandwidth: 100},
+		},
+	}
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize bandwidth limits: %v", err)
+	}
+	defer Initialize(Config{})
+
+	for _, test := range []struct {
+		ip       string
+		protocol string
+		index    int
+	}{
+		{"192.168.1.2", "DAV", 0},
+		{"10.8.0.1", "DAV", 1},
+		{"10.8.0.1", "SFTP", 2},
+		{"::1", "FTP", 2},
+		{"::2", "FTP", -1},
+		{"invalid ip", "FTP", -1},
+	} {
+		if idx := limiter.getLimitIndex(test.ip, test.protocol); idx != test.index {
+			t.Errorf("unexpected limit index for %v %v: %v, expected: %v", test.ip, test.protocol, idx, test.index)
+		}
+	}
+	// unlimited bandwidth must not track the source
+	Throttle("192.168.1.2", "SFTP", true, 1000000)
+	Throttle("10.8.0.1", "DAV", true, 1000000)
+	if len(limiter.sources) != 0 {
+		t.Errorf("unexpected number of sources: %v", len(limiter.sources))
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	config := Config{
+		Limits: []Limit{
+			{Sources: []string{"127.0.0.0/8"}, UploadBandwidth: 100, DownloadBandwidth: 200},
+		},
+	}
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize bandwidth limits: %v", err)
+	}
+	defer Initialize(Config{})
+
+	startTime := time.Now()
+	// 100 KB/s, 10000 bytes requires 100 ms, the data is shared by the transfers from the same IP
+	Throttle("127.0.0.1", "SFTP", true, 5000)
+	Throttle("127.0.0.1", "FTP", true, 5000)
+	elapsed := time.Since(startTime)
+	if elapsed < 90*time.Millisecond {
+		t.Errorf("upload bandwidth limit not respected, elapsed: %v", elapsed)
+	}
+	// other sources and the downloads are tracked separately
+	startTime = time.Now()
+	Throttle("127.0.0.2", "SFTP", true, 5000)
+	Throttle("127.0.0.1", "SFTP", false, 5000)
+	elapsed = time.Since(startTime)
+	if elapsed < 65*time.Millisecond || elapsed > 500*time.Millisecond {
+		t.Errorf("unexpected elapsed time: %v", elapsed)
+	}
+	if len(limiter.sources) != 3 {
+		t.Errorf("unexpected number of sources: %v", len(limiter.sources))
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := &sourceLimiter{
+		sources: make(map[sourceKey]time.Time),
+	}
+	now := time.Now()
+	for i := 0; i < maxSources; i++ {
+		l.sources[sourceKey{ip: fmt.Sprintf("10.0.%v.%v", i/256, i%256)}] = now.Add(-1 * time.Second)
+	}
+	l.sources[sourceKey{ip: "127.0.0.1"}] = now.Add(time.Minute)
+	l.cleanup(now)
+	if len(l.sources) != 1 {
+		t.Errorf("unexpected number of sources: %v", len(l.sources))
+	}
+	if _, ok := l.sources[sourceKey{ip: "127.0.0.1"}]; !ok {
+		t.Error("the sources with pending data must be kept")
+	}
+	l.cleanup(now)
+	if len(l.sources) != 1 {
+		t.Errorf("unexpected number of sources: %v", len(l.sources))
+	}
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/config"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	dumpOutputFile string
+	dumpIndent     bool
+	dumpDataCmd    = &cobra.Command{
+		Use:   "dumpdata",
+		Short: "Backup the configured data provider to a JSON file",
+		Long: `This command reads the data provider connection details from the specified configuration file and saves
+all the users, groups, admins and API keys to the specified JSON file.
+
+The generated file can be restored using the "loaddata" command or the "loaddata" REST API, so you can
+use it for disaster recovery or to migrate between different data providers.
+
+The SFTPGo service does not need to be running, but the bolt data provider cannot be accessed by two
+processes at the same time, so for bolt you need to stop the service or to use the "dumpdata" REST API.
+
+Usage example:
+
+sftpgo dumpdata --output-file /srv/backups/sftpgo.json
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = utils.CleanDirInput(configDir)
+			config.LoadConfig(configDir, configFile)
+			providerConf := config.GetProviderConf()
+			logger.DebugToConsole("Dumping provider: %#v config file: %#v, output file: %#v", providerConf.Driver,
+				viper.ConfigFileUsed(), dumpOutputFile)
+			err := dataprovider.Initialize(providerConf, configDir)
+			if err != nil {
+				logger.WarnToConsole("Unable to initialize data provider: %v", err)
+				os.Exit(1)
+			}
+			provider := dataprovider.GetProvider()
+			backup, err := dataprovider.DumpData(provider)
+			dataprovider.Close(provider)
+			if err != nil {
+				logger.WarnToConsole("Unable to dump data: %v", err)
+				os.Exit(1)
+			}
+			var dump []byte
+			if dumpIndent {
+				dump, err = json.MarshalIndent(backup, "", "  ")
+			} else {
+				dump, err = json.Marshal(backup)
+			}
+			if err == nil {
+				os.MkdirAll(filepath.Dir(dumpOutputFile), 0700)
+				err = ioutil.WriteFile(dumpOutputFile, dump, 0600)
+			}
+			if err != nil {
+				logger.WarnToConsole("Unable to save data: %v", err)
+				os.Exit(1)
+			}
+			logger.DebugToConsole("Data saved, users: %v, groups: %v, admins: %v, API keys: %v", len(backup.Users),
+				len(backup.Groups), len(backup.Admins), len(backup.APIKeys))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(dumpDataCmd)
+	addConfigFlags(dumpDataCmd)
+	dumpDataCmd.Flags().StringVarP(&dumpOutputFile, "output-file", "o", "", "Path for the JSON backup file. Required")
+	dumpDataCmd.Flags().BoolVarP(&dumpIndent, "indent", "i", false, "Indent the generated JSON")
+	dumpDataCmd.MarkFlagRequired("output-file")
+}
@@ -27,6 +27,7 @@ Please take a look at the usage below to customize the startup options`,
 				LogMaxAge:     logMaxAge,
 				LogCompress:   logCompress,
 				LogVerbose:    logVerbose,
+				LogSinks:      logSinks,
 				Shutdown:      make(chan bool),
 			}
 			winService := service.WindowsService{
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+
+	"github.com/rs/zerolog"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/drakkan/sftpgo/config"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	loadInputFile string
+	loadMode      int
+	loadDataCmd   = &cobra.Command{
+		Use:   "loaddata",
+		Short: "Restore a JSON backup to the configured data provider",
+		Long: `This command reads the data provider connection details from the specified configuration file and restores
+the users, groups, admins and API keys from the specified JSON file, generated using the "dumpdata" command
+or the "dumpdata" REST API.
+
+The supported modes are:
+
+0 - new objects are added, existing objects are updated. This is the default
+1 - new objects are added, existing objects are not modified
+
+The existing API keys are never updated. The used quota of the restored users is preserved for the existing
+users and it is reset for the new ones, you can update it using the quota scan REST API.
+The objects are restored one by one and the restore is stopped at the first error, so a partial restore
+could happen.
+
+The SFTPGo service does not need to be running, but the bolt data provider cannot be accessed by two
+processes at the same time, so for bolt you need to stop the service or to use the "loaddata" REST API.
+The memory data provider is not supported, since the restored data would be lost on exit.
+
+Usage example:
+
+sftpgo loaddata --input-file /srv/backups/sftpgo.json --mode 1
+
+Please take a look at the usage below to customize the options.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger.DisableLogger()
+			logger.EnableConsoleLogger(zerolog.DebugLevel)
+			configDir = utils.CleanDirInput(configDir)
+			config.LoadConfig(configDir, configFile)
+			providerConf := config.GetProviderConf()
+			if providerConf.Driver == dataprovider.MemoryDataProviderName {
+				logger.WarnToConsole("The memory data provider is not supported, you can use the backup file as its source")
+				os.Exit(1)
+			}
+			logger.DebugToConsole("Restoring provider: %#v config file: %#v, input file: %#v, mode: %v",
+				providerConf.Driver, viper.ConfigFileUsed(), loadInputFile, loadMode)
+			content, err := ioutil.ReadFile(loadInputFile)
+			if err != nil {
+				logger.WarnToConsole("Unable to read input file: %v", err)
+				os.Exit(1)
+			}
+			var dump dataprovider.BackupData
+			err = json.Unmarshal(content, &dump)
+			if err != nil {
+				logger.WarnToConsole("Unable to parse input file: %v", err)
+				os.Exit(1)
+			}
+			err = dataprovider.Initialize(providerConf, configDir)
+			if err != nil {
+				logger.WarnToConsole("Unable to initialize data provider: %v", err)
+				os.Exit(1)
+			}
+			provider := dataprovider.GetProvider()
+			restoredUsers, err := dataprovider.RestoreData(provider, dump, loadMode)
+			dataprovider.Close(provider)
+			if err != nil {
+				logger.WarnToConsole("Unable to restore data, restored users: %v, error: %v", len(restoredUsers), err)
+				os.Exit(1)
+			}
+			logger.DebugToConsole("Data restored, users: %v, groups: %v, admins: %v, API keys: %v", len(dump.Users),
+				len(dump.Groups), len(dump.Admins), len(dump.APIKeys))
+		},
+	}
+)
+
+func init() {
+	rootCmd.AddCommand(loadDataCmd)
+	addConfigFlags(loadDataCmd)
+	loadDataCmd.Flags().StringVarP(&loadInputFile, "input-file", "i", "", "Path for the JSON backup file to restore. Required")
+	loadDataCmd.Flags().IntVarP(&loadMode, "mode", "m", dataprovider.RestoreModeAddAndUpdate, "Restore mode, see the description above")
+	loadDataCmd.MarkFlagRequired("input-file")
+}
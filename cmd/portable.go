@@ -29,6 +29,8 @@ var (
 	portableSSHCommands          []string
 	portableAllowedExtensions    []string
 	portableDeniedExtensions     []string
+	portableAllowedPatterns      []string
+	portableDeniedPatterns       []string
 	portableFsProvider           int
 	portableS3Bucket             string
 	portableS3Region             string
@@ -42,6 +44,23 @@ var (
 	portableGCSAutoCredentials   int
 	portableGCSStorageClass      string
 	portableGCSKeyPrefix         string
+	portableAzContainer          string
+	portableAzAccountName        string
+	portableAzAccountKey         string
+	portableAzEndpoint           string
+	portableAzAccessTier         string
+	portableAzSASURL             string
+	portableAzKeyPrefix          string
+	portableAzULPartSize         int
+	portableAzULConcurrency      int
+	portableAzUseEmulator        bool
+	portableSFTPEndpoint         string
+	portableSFTPUsername         string
+	portableSFTPPassword         string
+	portableSFTPPrivateKeyPath   string
+	portableSFTPFingerprints     []string
+	portableSFTPAcceptAnyHostKey bool
+	portableSFTPPrefix           string
 	portableCmd                  = &cobra.Command{
 		Use:   "portable",
 		Short: "Serve a single directory",
@@ -80,6 +99,15 @@ Please take a look at the usage below to customize the serving parameters`,
 				portableGCSCredentials = base64.StdEncoding.EncodeToString(creds)
 				portableGCSAutoCredentials = 0
 			}
+			portableSFTPPrivateKey := ""
+			if portableFsProvider == 4 && len(portableSFTPPrivateKeyPath) > 0 {
+				key, err := ioutil.ReadFile(portableSFTPPrivateKeyPath)
+				if err != nil {
+					fmt.Printf("Unable to read SFTP private key file: %v\n", err)
+					return
+				}
+				portableSFTPPrivateKey = string(key)
+			}
 			service := service.Service{
 				ConfigDir:     filepath.Clean(defaultConfigDir),
 				ConfigFile:    defaultConfigName,
@@ -116,9 +144,31 @@ Please take a look at the usage below to customize the serving parameters`,
 							StorageClass:         portableGCSStorageClass,
 							KeyPrefix:            portableGCSKeyPrefix,
 						},
+						AzBlobConfig: vfs.AzBlobFsConfig{
+							Container:         portableAzContainer,
+							AccountName:       portableAzAccountName,
+							AccountKey:        portableAzAccountKey,
+							Endpoint:          portableAzEndpoint,
+							AccessTier:        portableAzAccessTier,
+							SASURL:            portableAzSASURL,
+							KeyPrefix:         portableAzKeyPrefix,
+							UseEmulator:       portableAzUseEmulator,
+							UploadPartSize:    int64(portableAzULPartSize),
+							UploadConcurrency: portableAzULConcurrency,
+						},
+						SFTPConfig: vfs.SFTPFsConfig{
+							Endpoint:         portableSFTPEndpoint,
+							Username:         portableSFTPUsername,
+							Password:         portableSFTPPassword,
+							PrivateKey:       portableSFTPPrivateKey,
+							Fingerprints:     portableSFTPFingerprints,
+							AcceptAnyHostKey: portableSFTPAcceptAnyHostKey,
+							Prefix:           portableSFTPPrefix,
+						},
 					},
 					Filters: dataprovider.UserFilters{
 						FileExtensions: parseFileExtensionsFilters(),
+						FilePatterns:   parseFilePatternsFilters(),
 					},
 				},
 			}
@@ -134,8 +184,8 @@ func init() {
 	portableCmd.Flags().StringVarP(&directoryToServe, "directory", "d", ".",
 		"Path to the directory to serve. This can be an absolute path or a path relative to the current directory")
 	portableCmd.Flags().IntVarP(&portableSFTPDPort, "sftpd-port", "s", 0, "0 means a random non privileged port")
-	portableCmd.Flags().StringSliceVarP(&portableSSHCommands, "ssh-commands", "c", sftpd.GetDefaultSSHCommands(),
-		"SSH commands to enable. \"*\" means any supported SSH command including scp")
+	portableCmd.Flags().StringSliceVarP(&portableSSHCommands, "ssh-commands", "c", append(sftpd.GetDefaultSSHCommands(), "scp"),
+		"SSH commands to enable. \"*\" means any supported SSH command")
 	portableCmd.Flags().StringVarP(&portableUsername, "username", "u", "", "Leave empty to use an auto generated value")
 	portableCmd.Flags().StringVarP(&portablePassword, "password", "p", "", "Leave empty to use an auto generated value")
 	portableCmd.Flags().StringVarP(&portableLogFile, logFilePathFlag, "l", "", "Leave empty to disable logging")
@@ -146,12 +196,16 @@ func init() {
 		"Allowed file extensions case insensitive. The format is /dir::ext1,ext2. For example: \"/somedir::.jpg,.png\"")
 	portableCmd.Flags().StringArrayVar(&portableDeniedExtensions, "denied-extensions", []string{},
 		"Denied file extensions case insensitive. The format is /dir::ext1,ext2. For example: \"/somedir::.jpg,.png\"")
+	portableCmd.Flags().StringArrayVar(&portableAllowedPatterns, "allowed-patterns", []string{},
+		"Allowed file patterns case insensitive. The format is /dir::pattern1,pattern2. For example: \"/somedir::*.jpg,a*b?.png\"")
+	portableCmd.Flags().StringArrayVar(&portableDeniedPatterns, "denied-patterns", []string{},
+		"Denied file patterns case insensitive. The format is /dir::pattern1,pattern2. For example: \"/somedir::*.jpg,a*b?.png\"")
 	portableCmd.Flags().BoolVarP(&portableAdvertiseService, "advertise-service", "S", true,
 		"Advertise SFTP service using multicast DNS")
 	portableCmd.Flags().BoolVarP(&portableAdvertiseCredentials, "advertise-credentials", "C", false,
 		"If the SFTP service is advertised via multicast DNS, this flag allows to put username/password inside the advertised TXT record")
 	portableCmd.Flags().IntVarP(&portableFsProvider, "fs-provider", "f", 0, "0 means local filesystem, 1 Amazon S3 compatible, "+
-		"2 Google Cloud Storage")
+		"2 Google Cloud Storage, 3 Azure Blob Storage, 4 SFTP")
 	portableCmd.Flags().StringVar(&portableS3Bucket, "s3-bucket", "", "")
 	portableCmd.Flags().StringVar(&portableS3Region, "s3-region", "", "")
 	portableCmd.Flags().StringVar(&portableS3AccessKey, "s3-access-key", "", "")
@@ -167,6 +221,33 @@ func init() {
 	portableCmd.Flags().StringVar(&portableGCSCredentialsFile, "gcs-credentials-file", "", "Google Cloud Storage JSON credentials file")
 	portableCmd.Flags().IntVar(&portableGCSAutoCredentials, "gcs-automatic-credentials", 1, "0 means explicit credentials using a JSON "+
 		"credentials file, 1 automatic")
+	portableCmd.Flags().StringVar(&portableAzContainer, "az-container", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountName, "az-account-name", "", "")
+	portableCmd.Flags().StringVar(&portableAzAccountKey, "az-account-key", "", "")
+	portableCmd.Flags().StringVar(&portableAzSASURL, "az-sas-url", "", "Shared access signature URL")
+	portableCmd.Flags().StringVar(&portableAzEndpoint, "az-endpoint", "", "Leave empty to use the default: "+
+		"\"blob.core.windows.net\"")
+	portableCmd.Flags().StringVar(&portableAzAccessTier, "az-access-tier", "", "Leave empty to use the default "+
+		"container setting")
+	portableCmd.Flags().StringVar(&portableAzKeyPrefix, "az-key-prefix", "", "Allows to restrict access to the "+
+		"virtual folder identified by this prefix and its contents")
+	portableCmd.Flags().IntVar(&portableAzULPartSize, "az-upload-part-size", 4, "The buffer size for multipart "+
+		"uploads (MB)")
+	portableCmd.Flags().IntVar(&portableAzULConcurrency, "az-upload-concurrency", 2, "How many parts are uploaded in "+
+		"parallel")
+	portableCmd.Flags().BoolVar(&portableAzUseEmulator, "az-use-emulator", false, "")
+	portableCmd.Flags().StringVar(&portableSFTPEndpoint, "sftp-endpoint", "", "SFTP endpoint as host:port")
+	portableCmd.Flags().StringVar(&portableSFTPUsername, "sftp-username", "", "SFTP user for the remote server")
+	portableCmd.Flags().StringVar(&portableSFTPPassword, "sftp-password", "", "SFTP password for the remote server")
+	portableCmd.Flags().StringVar(&portableSFTPPrivateKeyPath, "sftp-key-path", "", "SFTP private key path for the "+
+		"remote server")
+	portableCmd.Flags().StringSliceVar(&portableSFTPFingerprints, "sftp-fingerprints", []string{}, "SFTP fingerprints "+
+		"to verify remote host key. You can specify this flag multiple times. At least one fingerprint is required "+
+		"unless --sftp-accept-any-host-key is set")
+	portableCmd.Flags().BoolVar(&portableSFTPAcceptAnyHostKey, "sftp-accept-any-host-key", false, "Disable the "+
+		"remote host key verification if no fingerprint is provided. This is insecure")
+	portableCmd.Flags().StringVar(&portableSFTPPrefix, "sftp-prefix", "", "SFTP remote directory to serve, it must "+
+		"be an absolute path. Leave empty to serve the remote root directory")
 	rootCmd.AddCommand(portableCmd)
 }
 
@@ -205,6 +286,41 @@ func parseFileExtensionsFilters() []dataprovider.ExtensionsFilter {
 	return extensions
 }
 
+func parseFilePatternsFilters() []dataprovider.PatternsFilter {
+	var patterns []dataprovider.PatternsFilter
+	for _, val := range portableAllowedPatterns {
+		p, exts := getExtensionsFilterValues(strings.TrimSpace(val))
+		if len(p) > 0 {
+			patterns = append(patterns, dataprovider.PatternsFilter{
+				Path:            path.Clean(p),
+				AllowedPatterns: exts,
+				DeniedPatterns:  []string{},
+			})
+		}
+	}
+	for _, val := range portableDeniedPatterns {
+		p, exts := getExtensionsFilterValues(strings.TrimSpace(val))
+		if len(p) > 0 {
+			found := false
+			for index, e := range patterns {
+				if path.Clean(e.Path) == path.Clean(p) {
+					patterns[index].DeniedPatterns = append(patterns[index].DeniedPatterns, exts...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				patterns = append(patterns, dataprovider.PatternsFilter{
+					Path:            path.Clean(p),
+					AllowedPatterns: []string{},
+					DeniedPatterns:  exts,
+				})
+			}
+		}
+	}
+	return patterns
+}
+
 func getExtensionsFilterValues(value string) (string, []string) {
 	if strings.Contains(value, "::") {
 		dirExts := strings.Split(value, "::")
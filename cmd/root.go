@@ -7,6 +7,7 @@ import (
 	"strconv"
 
 	"github.com/drakkan/sftpgo/config"
+	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -30,6 +31,14 @@ const (
 	logCompressKey      = "log_compress"
 	logVerboseFlag      = "log-verbose"
 	logVerboseKey       = "log_verbose"
+	logSyslogFlag       = "log-syslog"
+	logSyslogKey        = "log_syslog"
+	logSyslogLevelFlag  = "log-syslog-level"
+	logSyslogLevelKey   = "log_syslog_level"
+	logJournaldFlag     = "log-journald"
+	logJournaldKey      = "log_journald"
+	logJournaldLvlFlag  = "log-journald-level"
+	logJournaldLvlKey   = "log_journald_level"
 	defaultConfigDir    = "."
 	defaultConfigName   = config.DefaultConfigName
 	defaultLogFile      = "sftpgo.log"
@@ -38,6 +47,9 @@ const (
 	defaultLogMaxAge    = 28
 	defaultLogCompress  = false
 	defaultLogVerbose   = true
+	defaultLogSyslog    = ""
+	defaultLogSinkLevel = "info"
+	defaultLogJournald  = false
 )
 
 var (
@@ -49,6 +61,7 @@ var (
 	logMaxAge     int
 	logCompress   bool
 	logVerbose    bool
+	logSinks      logger.SinksConfig
 
 	rootCmd = &cobra.Command{
 		Use:   "sftpgo",
@@ -135,6 +148,33 @@ func addServeFlags(cmd *cobra.Command) {
 	cmd.Flags().BoolVarP(&logVerbose, logVerboseFlag, "v", viper.GetBool(logVerboseKey), "Enable verbose logs. "+
 		"This flag can be set using SFTPGO_LOG_VERBOSE env var too.")
 	viper.BindPFlag(logVerboseKey, cmd.Flags().Lookup(logVerboseFlag))
+
+	viper.SetDefault(logSyslogKey, defaultLogSyslog)
+	viper.BindEnv(logSyslogKey, "SFTPGO_LOG_SYSLOG")
+	cmd.Flags().StringVar(&logSinks.Syslog, logSyslogFlag, viper.GetString(logSyslogKey), "Send the logs to syslog too. "+
+		"Set \"local\" for the local syslog daemon or \"udp://host:port\", \"tcp://host:port\" for a remote RFC5424 "+
+		"syslog server. Leave empty to disable. This flag can be set using SFTPGO_LOG_SYSLOG env var too.")
+	viper.BindPFlag(logSyslogKey, cmd.Flags().Lookup(logSyslogFlag))
+
+	viper.SetDefault(logSyslogLevelKey, defaultLogSinkLevel)
+	viper.BindEnv(logSyslogLevelKey, "SFTPGO_LOG_SYSLOG_LEVEL")
+	cmd.Flags().StringVar(&logSinks.SyslogLevel, logSyslogLevelFlag, viper.GetString(logSyslogLevelKey), "Minimum "+
+		"level for the logs sent to syslog: debug, info, warn, error. This flag can be set using SFTPGO_LOG_SYSLOG_LEVEL "+
+		"env var too. It is unused if log-syslog is empty.")
+	viper.BindPFlag(logSyslogLevelKey, cmd.Flags().Lookup(logSyslogLevelFlag))
+
+	viper.SetDefault(logJournaldKey, defaultLogJournald)
+	viper.BindEnv(logJournaldKey, "SFTPGO_LOG_JOURNALD")
+	cmd.Flags().BoolVar(&logSinks.Journald, logJournaldFlag, viper.GetBool(logJournaldKey), "Send the logs to the "+
+		"systemd journal too. This flag can be set using SFTPGO_LOG_JOURNALD env var too.")
+	viper.BindPFlag(logJournaldKey, cmd.Flags().Lookup(logJournaldFlag))
+
+	viper.SetDefault(logJournaldLvlKey, defaultLogSinkLevel)
+	viper.BindEnv(logJournaldLvlKey, "SFTPGO_LOG_JOURNALD_LEVEL")
+	cmd.Flags().StringVar(&logSinks.JournaldLevel, logJournaldLvlFlag, viper.GetString(logJournaldLvlKey), "Minimum "+
+		"level for the logs sent to the systemd journal: debug, info, warn, error. This flag can be set using "+
+		"SFTPGO_LOG_JOURNALD_LEVEL env var too. It is unused if log-journald is false.")
+	viper.BindPFlag(logJournaldLvlKey, cmd.Flags().Lookup(logJournaldLvlFlag))
 }
 
 func getCustomServeFlags() []string {
@@ -170,5 +210,20 @@ func getCustomServeFlags() []string {
 	if logCompress != defaultLogCompress {
 		result = append(result, "--"+logCompressFlag+"=true")
 	}
+	if logSinks.Syslog != defaultLogSyslog {
+		result = append(result, "--"+logSyslogFlag)
+		result = append(result, logSinks.Syslog)
+	}
+	if logSinks.SyslogLevel != defaultLogSinkLevel {
+		result = append(result, "--"+logSyslogLevelFlag)
+		result = append(result, logSinks.SyslogLevel)
+	}
+	if logSinks.Journald != defaultLogJournald {
+		result = append(result, "--"+logJournaldFlag+"=true")
+	}
+	if logSinks.JournaldLevel != defaultLogSinkLevel {
+		result = append(result, "--"+logJournaldLvlFlag)
+		result = append(result, logSinks.JournaldLevel)
+	}
 	return result
 }
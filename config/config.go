@@ -9,11 +9,24 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/drakkan/sftpgo/acme"
+	"github.com/drakkan/sftpgo/antivirus"
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/ftpd"
+	"github.com/drakkan/sftpgo/geoip"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/ldap"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/plugin"
+	"github.com/drakkan/sftpgo/ratelimiter"
 	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/telemetry"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/webdavd"
 	"github.com/spf13/viper"
 )
 
@@ -33,41 +46,75 @@ var (
 )
 
 type globalConfig struct {
-	SFTPD        sftpd.Configuration `json:"sftpd" mapstructure:"sftpd"`
-	ProviderConf dataprovider.Config `json:"data_provider" mapstructure:"data_provider"`
-	HTTPDConfig  httpd.Conf          `json:"httpd" mapstructure:"httpd"`
+	SFTPD        sftpd.Configuration   `json:"sftpd" mapstructure:"sftpd"`
+	ProviderConf dataprovider.Config   `json:"data_provider" mapstructure:"data_provider"`
+	HTTPDConfig  httpd.Conf            `json:"httpd" mapstructure:"httpd"`
+	FTPD         ftpd.Configuration    `json:"ftpd" mapstructure:"ftpd"`
+	WebDAVD      webdavd.Configuration `json:"webdavd" mapstructure:"webdavd"`
+	Defender     defender.Config       `json:"defender" mapstructure:"defender"`
+	RateLimiter  ratelimiter.Config    `json:"rate_limiter" mapstructure:"rate_limiter"`
+	Bandwidth    bandwidth.Config      `json:"bandwidth" mapstructure:"bandwidth"`
+	Audit        audit.Config          `json:"audit" mapstructure:"audit"`
+	ACME         acme.Config           `json:"acme" mapstructure:"acme"`
+	GeoIP        geoip.Config          `json:"geoip" mapstructure:"geoip"`
+	Antivirus    antivirus.Config      `json:"antivirus" mapstructure:"antivirus"`
+	Telemetry    telemetry.Conf        `json:"telemetry" mapstructure:"telemetry"`
+	Plugins      []plugin.Config       `json:"plugins" mapstructure:"plugins"`
+	KMS          kms.Config            `json:"kms" mapstructure:"kms"`
 }
 
 func init() {
 	// create a default configuration to use if no config file is provided
 	globalConf = globalConfig{
 		SFTPD: sftpd.Configuration{
-			Banner:       defaultBanner,
-			BindPort:     2022,
-			BindAddress:  "",
+			Banner: defaultBanner,
+			Bindings: []sftpd.Binding{
+				{
+					Address:          "",
+					Port:             2022,
+					ApplyProxyConfig: true,
+				},
+			},
 			IdleTimeout:  15,
 			MaxAuthTries: 0,
 			Umask:        "0022",
 			UploadMode:   0,
 			Actions: sftpd.Actions{
-				ExecuteOn:           []string{},
-				Command:             "",
-				HTTPNotificationURL: "",
+				ExecuteOn:               []string{},
+				Command:                 "",
+				HTTPNotificationURL:     "",
+				HTTPNotificationMethod:  "GET",
+				HTTPNotificationTimeout: 15,
+				HTTPNotificationRetries: 0,
+				UploadPipeline:          []sftpd.PipelineStep{},
 			},
-			Keys:                       []sftpd.Key{},
-			IsSCPEnabled:               false,
-			KexAlgorithms:              []string{},
-			Ciphers:                    []string{},
-			MACs:                       []string{},
-			LoginBannerFile:            "",
-			EnabledSSHCommands:         sftpd.GetDefaultSSHCommands(),
-			KeyboardInteractiveProgram: "",
-			ProxyProtocol:              0,
-			ProxyAllowed:               []string{},
+			Keys:                    []sftpd.Key{},
+			TrustedUserCAKeys:       []string{},
+			RevokedKeysFile:         "",
+			AllowedClientVersions:   []string{},
+			DeniedClientVersions:    []string{},
+			IsSCPEnabled:            false,
+			KexAlgorithms:           []string{},
+			Ciphers:                 []string{},
+			MACs:                    []string{},
+			LoginBannerFile:         "",
+			UploadChecksums:         false,
+			EnabledSSHCommands:      sftpd.GetDefaultSSHCommands(),
+			KeyboardInteractiveHook: "",
+			ProxyProtocol:           0,
+			ProxyAllowed:            []string{},
+			GraceTime:               0,
+			MaxTotalConnections:     0,
+			MaxPerHostConnections:   0,
+			MaxConcurrentHandshakes: 0,
+			HandshakeTimeout:        120,
+			KeepAliveInterval:       0,
+			KeepAliveCountMax:       3,
 		},
 		ProviderConf: dataprovider.Config{
 			Driver:           "sqlite",
 			Name:             "sftpgo.db",
+			PersistInterval:  0,
 			Host:             "",
 			Port:             5432,
 			Username:         "",
@@ -76,6 +123,9 @@ func init() {
 			UsersTable:       "users",
 			ManageUsers:      1,
 			SSLMode:          0,
+			RootCert:         "",
+			ClientCert:       "",
+			ClientKey:        "",
 			TrackQuota:       1,
 			PoolSize:         0,
 			UsersBaseDir:     "",
@@ -84,10 +134,43 @@ func init() {
 				Command:             "",
 				HTTPNotificationURL: "",
 			},
-			ExternalAuthProgram: "",
-			ExternalAuthScope:   0,
-			CredentialsPath:     "credentials",
-			PreLoginProgram:     "",
+			ExternalAuthHook:  "",
+			ExternalAuthScope: 0,
+			LDAP: ldap.Config{
+				URL:             "",
+				StartTLS:        false,
+				SkipTLSVerify:   false,
+				BindDN:          "",
+				BindPassword:    "",
+				UserDNTemplate:  "",
+				BaseDN:          "",
+				UserFilter:      "",
+				GroupAttribute:  "memberOf",
+				UIDAttribute:    "",
+				GIDAttribute:    "",
+				HomeDirTemplate: "",
+				PageSize:        0,
+				Timeout:         10,
+			},
+			PAM: dataprovider.PAMConfig{
+				Service:         "",
+				AutoCreate:      false,
+				HomeDirTemplate: "",
+			},
+			PasswordHashing: dataprovider.PasswordHashing{
+				Argon2Options: dataprovider.Argon2Options{
+					Memory:      65536,
+					Iterations:  1,
+					Parallelism: 2,
+				},
+			},
+			PasswordExpiration: 0,
+			CredentialsPath:    "credentials",
+			PreLoginHook:       "",
+			PostLoginHook:      "",
+			PostLoginScope:     0,
+			SharedSessions:     false,
+			DelayedQuotaUpdate: 0,
 		},
 		HTTPDConfig: httpd.Conf{
 			BindPort:           8080,
@@ -98,6 +181,118 @@ func init() {
 			AuthUserFile:       "",
 			CertificateFile:    "",
 			CertificateKeyFile: "",
+			SigningPassphrase:  "",
+		},
+		FTPD: ftpd.Configuration{
+			BindPort:       0,
+			BindAddress:    "",
+			Banner:         defaultBanner,
+			ForcePassiveIP: "",
+			PassivePortRange: ftpd.PortRange{
+				Start: 50000,
+				End:   50100,
+			},
+			CertificateFile:    "",
+			CertificateKeyFile: "",
+			TLSMode:            0,
+		},
+		WebDAVD: webdavd.Configuration{
+			BindPort:           0,
+			BindAddress:        "",
+			CertificateFile:    "",
+			CertificateKeyFile: "",
+		},
+		Defender: defender.Config{
+			Enabled:          false,
+			Driver:           defender.DriverMemory,
+			BanTime:          30,
+			BanTimeIncrement: 50,
+			Threshold:        15,
+			ScoreInvalid:     2,
+			ScoreValid:       1,
+			ScoreNoAuth:      0,
+			ObservationTime:  30,
+			EntriesSoftLimit: 100,
+			EntriesHardLimit: 150,
+			SafeList:         []string{},
+			BlockList:        []string{},
+		},
+		RateLimiter: ratelimiter.Config{
+			Connections:       ratelimiter.Limit{Average: 0, Burst: 0},
+			ConnectionsPerIP:  ratelimiter.Limit{Average: 0, Burst: 0},
+			AuthAttempts:      ratelimiter.Limit{Average: 0, Burst: 0},
+			AuthAttemptsPerIP: ratelimiter.Limit{Average: 0, Burst: 0},
+			EntriesSoftLimit:  100,
+			EntriesHardLimit:  150,
+			LoginDelay: ratelimiter.LoginDelay{
+				Initial:   0,
+				Max:       0,
+				ResetTime: 0,
+			},
+		},
+		Bandwidth: bandwidth.Config{
+			Limits: []bandwidth.Limit{},
+		},
+		Audit: audit.Config{
+			LogFilePath:   "",
+			LogMaxSize:    10,
+			LogMaxBackups: 5,
+			LogMaxAge:     28,
+			LogCompress:   false,
+			RemoteAddress: "",
+			RemoteNetwork: "udp",
+		},
+		ACME: acme.Config{
+			Domains:            []string{},
+			Email:              "",
+			CAEndpoint:         "",
+			CertsPath:          "certs",
+			RenewDays:          30,
+			Protocols:          []string{acme.ProtocolHTTP},
+			HTTP01Challenge:    acme.HTTP01Challenge{Port: 80},
+			TLSALPN01Challenge: acme.TLSALPN01Challenge{Port: 0},
+		},
+		GeoIP: geoip.Config{
+			DatabasePath:     "",
+			AllowedCountries: []string{},
+			DeniedCountries:  []string{},
+		},
+		Antivirus: antivirus.Config{
+			Engine:         "",
+			Address:        "",
+			Timeout:        60,
+			InfectedAction: antivirus.ActionDelete,
+			QuarantinePath: "",
+			MaxSize:        0,
+		},
+		Telemetry: telemetry.Conf{
+			BindPort:       0,
+			BindAddress:    "127.0.0.1",
+			EnableProfiler: false,
+		},
+		Plugins: []plugin.Config{},
+		KMS: kms.Config{
+			Provider: "",
+			Local: kms.LocalConfig{
+				MasterKeyPath: "",
+			},
+			AWS: kms.AWSConfig{
+				Region:       "",
+				KeyID:        "",
+				AccessKey:    "",
+				AccessSecret: "",
+				Endpoint:     "",
+			},
+			GCP: kms.GCPConfig{
+				KeyName:         "",
+				CredentialsFile: "",
+			},
+			Vault: kms.VaultConfig{
+				URL:       "",
+				Token:     "",
+				MountPath: "transit",
+				KeyName:   "",
+			},
 		},
 	}
 
@@ -129,6 +324,116 @@ func SetHTTPDConfig(config httpd.Conf) {
 	globalConf.HTTPDConfig = config
 }
 
+// GetFTPDConfig returns the configuration for the FTP server
+func GetFTPDConfig() ftpd.Configuration {
+	return globalConf.FTPD
+}
+
+// SetFTPDConfig sets the configuration for the FTP server
+func SetFTPDConfig(config ftpd.Configuration) {
+	globalConf.FTPD = config
+}
+
+// GetWebDAVDConfig returns the configuration for the WebDAV server
+func GetWebDAVDConfig() webdavd.Configuration {
+	return globalConf.WebDAVD
+}
+
+// SetWebDAVDConfig sets the configuration for the WebDAV server
+func SetWebDAVDConfig(config webdavd.Configuration) {
+	globalConf.WebDAVD = config
+}
+
+// GetDefenderConfig returns the defender configuration
+func GetDefenderConfig() defender.Config {
+	return globalConf.Defender
+}
+
+// SetDefenderConfig sets the defender configuration
+func SetDefenderConfig(config defender.Config) {
+	globalConf.Defender = config
+}
+
+// GetRateLimiterConfig returns the rate limiters configuration
+func GetRateLimiterConfig() ratelimiter.Config {
+	return globalConf.RateLimiter
+}
+
+// SetRateLimiterConfig sets the rate limiters configuration
+func SetRateLimiterConfig(config ratelimiter.Config) {
+	globalConf.RateLimiter = config
+}
+
+// GetBandwidthConfig returns the server level bandwidth limits configuration
+func GetBandwidthConfig() bandwidth.Config {
+	return globalConf.Bandwidth
+}
+
+// SetBandwidthConfig sets the server level bandwidth limits configuration
+func SetBandwidthConfig(config bandwidth.Config) {
+	globalConf.Bandwidth = config
+}
+
+// GetAuditConfig returns the audit log configuration
+func GetAuditConfig() audit.Config {
+	return globalConf.Audit
+}
+
+// SetAuditConfig sets the audit log configuration
+func SetAuditConfig(config audit.Config) {
+	globalConf.Audit = config
+}
+
+// GetACMEConfig returns the ACME configuration
+func GetACMEConfig() acme.Config {
+	return globalConf.ACME
+}
+
+// SetACMEConfig sets the ACME configuration
+func SetACMEConfig(config acme.Config) {
+	globalConf.ACME = config
+}
+
+// GetGeoIPConfig returns the GeoIP configuration
+func GetGeoIPConfig() geoip.Config {
+	return globalConf.GeoIP
+}
+
+// SetGeoIPConfig sets the GeoIP configuration
+func SetGeoIPConfig(config geoip.Config) {
+	globalConf.GeoIP = config
+}
+
+// GetAntivirusConfig returns the antivirus configuration
+func GetAntivirusConfig() antivirus.Config {
+	return globalConf.Antivirus
+}
+
+// SetAntivirusConfig sets the antivirus configuration
+func SetAntivirusConfig(config antivirus.Config) {
+	globalConf.Antivirus = config
+}
+
+// GetTelemetryConfig returns the telemetry server configuration
+func GetTelemetryConfig() telemetry.Conf {
+	return globalConf.Telemetry
+}
+
+// SetTelemetryConfig sets the telemetry server configuration
+func SetTelemetryConfig(config telemetry.Conf) {
+	globalConf.Telemetry = config
+}
+
+// GetPluginsConfig returns the plugins configuration
+func GetPluginsConfig() []plugin.Config {
+	return globalConf.Plugins
+}
+
+// GetKMSConfig returns the KMS configuration
+func GetKMSConfig() kms.Config {
+	return globalConf.KMS
+}
+
 //GetProviderConf returns the configuration for the data provider
 func GetProviderConf() dataprovider.Config {
 	return globalConf.ProviderConf
@@ -142,6 +447,7 @@ func SetProviderConf(config dataprovider.Config) {
 func getRedactedGlobalConf() globalConfig {
 	conf := globalConf
 	conf.ProviderConf.Password = "[redacted]"
+	conf.ProviderConf.LDAP.BindPassword = "[redacted]"
 	return conf
 }
 
@@ -172,6 +478,9 @@ func LoadConfig(configDir, configName string) error {
 	if strings.TrimSpace(globalConf.SFTPD.Banner) == "" {
 		globalConf.SFTPD.Banner = defaultBanner
 	}
+	if strings.TrimSpace(globalConf.FTPD.Banner) == "" {
+		globalConf.FTPD.Banner = defaultBanner
+	}
 	if len(globalConf.ProviderConf.UsersBaseDir) > 0 && !utils.IsFileInputValid(globalConf.ProviderConf.UsersBaseDir) {
 		err = fmt.Errorf("invalid users base dir %#v will be ignored", globalConf.ProviderConf.UsersBaseDir)
 		globalConf.ProviderConf.UsersBaseDir = ""
@@ -192,12 +501,32 @@ func LoadConfig(configDir, configName string) error {
 		logger.Warn(logSender, "", "Configuration error: %v", err)
 		logger.WarnToConsole("Configuration error: %v", err)
 	}
+	checkSFTPDBindingsCompatibility()
+	if globalConf.FTPD.TLSMode < 0 || globalConf.FTPD.TLSMode > 2 {
+		err = fmt.Errorf("invalid ftpd tls_mode 0, 1 and 2 are supported, configured: %v reset tls_mode to 0",
+			globalConf.FTPD.TLSMode)
+		globalConf.FTPD.TLSMode = 0
+		logger.Warn(logSender, "", "Configuration error: %v", err)
+		logger.WarnToConsole("Configuration error: %v", err)
+	}
 	if globalConf.ProviderConf.ExternalAuthScope < 0 || globalConf.ProviderConf.ExternalAuthScope > 7 {
 		err = fmt.Errorf("invalid external_auth_scope: %v reset to 0", globalConf.ProviderConf.ExternalAuthScope)
 		globalConf.ProviderConf.ExternalAuthScope = 0
 		logger.Warn(logSender, "", "Configuration error: %v", err)
 		logger.WarnToConsole("Configuration error: %v", err)
 	}
+	if globalConf.ProviderConf.PostLoginScope < 0 || globalConf.ProviderConf.PostLoginScope > 2 {
+		err = fmt.Errorf("invalid post_login_scope: %v reset to 0", globalConf.ProviderConf.PostLoginScope)
+		globalConf.ProviderConf.PostLoginScope = 0
+		logger.Warn(logSender, "", "Configuration error: %v", err)
+		logger.WarnToConsole("Configuration error: %v", err)
+	}
+	if globalConf.ProviderConf.SSLMode < 0 || globalConf.ProviderConf.SSLMode > 3 {
+		err = fmt.Errorf("invalid sslmode: %v reset to 0", globalConf.ProviderConf.SSLMode)
+		globalConf.ProviderConf.SSLMode = 0
+		logger.Warn(logSender, "", "Configuration error: %v", err)
+		logger.WarnToConsole("Configuration error: %v", err)
+	}
 	if len(globalConf.ProviderConf.CredentialsPath) == 0 {
 		err = fmt.Errorf("invalid credentials path, reset to \"credentials\"")
 		globalConf.ProviderConf.CredentialsPath = "credentials"
@@ -207,3 +536,28 @@ func LoadConfig(configDir, configName string) error {
 	logger.Debug(logSender, "", "config file used: '%#v', config loaded: %+v", viper.ConfigFileUsed(), getRedactedGlobalConf())
 	return err
 }
+
+// checkSFTPDBindingsCompatibility converts the deprecated bind_address and bind_port
+// settings to a binding. They are used only if the bindings are not customized
+func checkSFTPDBindingsCompatibility() {
+	if globalConf.SFTPD.BindPort == 0 {
+		return
+	}
+	logger.Warn(logSender, "", "bind_address and bind_port are deprecated, please use bindings")
+	logger.WarnToConsole("bind_address and bind_port are deprecated, please use bindings")
+	bindings := globalConf.SFTPD.Bindings
+	if len(bindings) > 1 || (len(bindings) == 1 && (bindings[0].Port != 2022 || bindings[0].Address != "")) {
+		return
+	}
+	applyProxyConfig := true
+	if len(bindings) == 1 {
+		applyProxyConfig = bindings[0].ApplyProxyConfig
+	}
+	globalConf.SFTPD.Bindings = []sftpd.Binding{
+		{
+			Address:          globalConf.SFTPD.BindAddress,
+			Port:             globalConf.SFTPD.BindPort,
+			ApplyProxyConfig: applyProxyConfig,
+		},
+	}
+}
@@ -8,8 +8,10 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/drakkan/sftpgo/bandwidth"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/ftpd"
 	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/sftpd"
 )
@@ -33,7 +35,7 @@ func TestLoadConfigTest(t *testing.T) {
 		t.Errorf("error loading provider conf")
 	}
 	emptySFTPDConf := sftpd.Configuration{}
-	if config.GetSFTPDConfig().BindPort == emptySFTPDConf.BindPort {
+	if len(config.GetSFTPDConfig().Bindings) == len(emptySFTPDConf.Bindings) {
 		t.Errorf("error loading SFTPD conf")
 	}
 	confName := tempConfigName + ".json"
@@ -98,6 +100,54 @@ func TestInvalidUploadMode(t *testing.T) {
 	os.Remove(configFilePath)
 }
 
+func TestInvalidFTPDTLSMode(t *testing.T) {
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	config.LoadConfig(configDir, "")
+	ftpdConf := config.GetFTPDConfig()
+	ftpdConf.TLSMode = 10
+	c := make(map[string]ftpd.Configuration)
+	c["ftpd"] = ftpdConf
+	jsonConf, _ := json.Marshal(c)
+	err := ioutil.WriteFile(configFilePath, jsonConf, 0666)
+	if err != nil {
+		t.Errorf("error saving temporary configuration")
+	}
+	err = config.LoadConfig(configDir, tempConfigName)
+	if err == nil {
+		t.Errorf("Loading configuration with invalid tls_mode must fail")
+	}
+	if config.GetFTPDConfig().TLSMode != 0 {
+		t.Errorf("invalid tls_mode must be reset to 0")
+	}
+	os.Remove(configFilePath)
+}
+
+func TestInvalidPostLoginScope(t *testing.T) {
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.PostLoginScope = 3
+	c := make(map[string]dataprovider.Config)
+	c["data_provider"] = providerConf
+	jsonConf, _ := json.Marshal(c)
+	err := ioutil.WriteFile(configFilePath, jsonConf, 0666)
+	if err != nil {
+		t.Errorf("error saving temporary configuration")
+	}
+	err = config.LoadConfig(configDir, tempConfigName)
+	if err == nil {
+		t.Errorf("Loading configuration with invalid post_login_scope must fail")
+	}
+	if config.GetProviderConf().PostLoginScope != 0 {
+		t.Errorf("invalid post_login_scope must be reset to 0")
+	}
+	os.Remove(configFilePath)
+}
+
 func TestInvalidExternalAuthScope(t *testing.T) {
 	configDir := ".."
 	confName := tempConfigName + ".json"
@@ -119,6 +169,32 @@ func TestInvalidExternalAuthScope(t *testing.T) {
 	os.Remove(configFilePath)
 }
 
+func TestInvalidSSLMode(t *testing.T) {
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	for _, sslMode := range []int{-1, 4} {
+		providerConf.SSLMode = sslMode
+		c := make(map[string]dataprovider.Config)
+		c["data_provider"] = providerConf
+		jsonConf, _ := json.Marshal(c)
+		err := ioutil.WriteFile(configFilePath, jsonConf, 0666)
+		if err != nil {
+			t.Errorf("error saving temporary configuration")
+		}
+		err = config.LoadConfig(configDir, tempConfigName)
+		if err == nil {
+			t.Errorf("Loading configuration with invalid sslmode %v must fail", sslMode)
+		}
+		if config.GetProviderConf().SSLMode != 0 {
+			t.Errorf("invalid sslmode must be reset to 0")
+		}
+	}
+	os.Remove(configFilePath)
+}
+
 func TestInvalidCredentialsPath(t *testing.T) {
 	configDir := ".."
 	confName := tempConfigName + ".json"
@@ -161,6 +237,55 @@ func TestInvalidProxyProtocol(t *testing.T) {
 	os.Remove(configFilePath)
 }
 
+func TestSFTPDBindingsCompatibility(t *testing.T) {
+	configDir := ".."
+	confName := tempConfigName + ".json"
+	configFilePath := filepath.Join(configDir, confName)
+	config.LoadConfig(configDir, "")
+	sftpdConf := config.GetSFTPDConfig()
+	if len(sftpdConf.Bindings) != 1 || sftpdConf.Bindings[0].Port != 2022 || !sftpdConf.Bindings[0].ApplyProxyConfig {
+		t.Errorf("unexpected default bindings: %+v", sftpdConf.Bindings)
+	}
+	defer config.SetSFTPDConfig(sftpdConf)
+	c := make(map[string]map[string]interface{})
+	c["sftpd"] = map[string]interface{}{
+		"bind_port":    9022,
+		"bind_address": "127.0.0.1",
+	}
+	jsonConf, _ := json.Marshal(c)
+	err := ioutil.WriteFile(configFilePath, jsonConf, 0666)
+	if err != nil {
+		t.Errorf("error saving temporary configuration")
+	}
+	err = config.LoadConfig(configDir, tempConfigName)
+	if err != nil {
+		t.Errorf("error loading configuration with deprecated bind settings: %v", err)
+	}
+	bindings := config.GetSFTPDConfig().Bindings
+	if len(bindings) != 1 || bindings[0].GetAddress() != "127.0.0.1:9022" || !bindings[0].ApplyProxyConfig {
+		t.Errorf("deprecated bind settings not converted: %+v", bindings)
+	}
+	// customized bindings are not replaced
+	c["sftpd"]["bindings"] = []sftpd.Binding{
+		{Port: 2022},
+		{Address: "::1", Port: 2023},
+	}
+	jsonConf, _ = json.Marshal(c)
+	err = ioutil.WriteFile(configFilePath, jsonConf, 0666)
+	if err != nil {
+		t.Errorf("error saving temporary configuration")
+	}
+	err = config.LoadConfig(configDir, tempConfigName)
+	if err != nil {
+		t.Errorf("error loading configuration with bindings: %v", err)
+	}
+	bindings = config.GetSFTPDConfig().Bindings
+	if len(bindings) != 2 || bindings[1].GetAddress() != "[::1]:2023" || bindings[0].ApplyProxyConfig {
+		t.Errorf("unexpected bindings: %+v", bindings)
+	}
+	os.Remove(configFilePath)
+}
+
 func TestInvalidUsersBaseDir(t *testing.T) {
 	configDir := ".."
 	confName := tempConfigName + ".json"
@@ -201,4 +326,63 @@ func TestSetGetConfig(t *testing.T) {
 	if config.GetHTTPDConfig().BindAddress != httpdConf.BindAddress {
 		t.Errorf("set httpd conf failed")
 	}
+	ftpdConf := config.GetFTPDConfig()
+	ftpdConf.BindPort = 2121
+	config.SetFTPDConfig(ftpdConf)
+	if config.GetFTPDConfig().BindPort != ftpdConf.BindPort {
+		t.Errorf("set ftpd conf failed")
+	}
+	webdavdConf := config.GetWebDAVDConfig()
+	webdavdConf.BindPort = 8090
+	config.SetWebDAVDConfig(webdavdConf)
+	if config.GetWebDAVDConfig().BindPort != webdavdConf.BindPort {
+		t.Errorf("set webdavd conf failed")
+	}
+	defenderConf := config.GetDefenderConfig()
+	defenderConf.Enabled = true
+	config.SetDefenderConfig(defenderConf)
+	if !config.GetDefenderConfig().Enabled {
+		t.Errorf("set defender conf failed")
+	}
+	rateLimiterConf := config.GetRateLimiterConfig()
+	rateLimiterConf.ConnectionsPerIP.Average = 5
+	config.SetRateLimiterConfig(rateLimiterConf)
+	if config.GetRateLimiterConfig().ConnectionsPerIP.Average != 5 {
+		t.Errorf("set rate limiter conf failed")
+	}
+	bandwidthConf := config.GetBandwidthConfig()
+	bandwidthConf.Limits = append(bandwidthConf.Limits, bandwidth.Limit{Sources: []string{"127.0.0.1"}})
+	config.SetBandwidthConfig(bandwidthConf)
+	if len(config.GetBandwidthConfig().Limits) != 1 {
+		t.Errorf("set bandwidth conf failed")
+	}
+	providerConf := config.GetProviderConf()
+	if providerConf.LDAP.GroupAttribute != "memberOf" || providerConf.LDAP.Timeout != 10 || providerConf.LDAP.IsEnabled() {
+		t.Errorf("unexpected default LDAP config: %+v", providerConf.LDAP)
+	}
+	auditConf := config.GetAuditConfig()
+	auditConf.LogFilePath = "audit.log"
+	config.SetAuditConfig(auditConf)
+	if config.GetAuditConfig().LogFilePath != "audit.log" {
+		t.Errorf("set audit conf failed")
+	}
+	acmeConf := config.GetACMEConfig()
+	if acmeConf.IsEnabled() || acmeConf.HTTP01Challenge.Port != 80 || acmeConf.RenewDays != 30 {
+		t.Errorf("unexpected default ACME config: %+v", acmeConf)
+	}
+	acmeConf.Domains = []string{"sftpgo.example.com"}
+	config.SetACMEConfig(acmeConf)
+	acmeConf = config.GetACMEConfig()
+	if !acmeConf.IsEnabled() {
+		t.Errorf("set ACME conf failed")
+	}
+	geoIPConf := config.GetGeoIPConfig()
+	if len(geoIPConf.DatabasePath) > 0 || len(geoIPConf.AllowedCountries) > 0 {
+		t.Errorf("unexpected default GeoIP config: %+v", geoIPConf)
+	}
+	geoIPConf.DatabasePath = "GeoLite2-Country.mmdb"
+	config.SetGeoIPConfig(geoIPConf)
+	if config.GetGeoIPConfig().DatabasePath != "GeoLite2-Country.mmdb" {
+		t.Errorf("set GeoIP conf failed")
+	}
 }
@@ -0,0 +1,303 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// number of recovery codes generated when an admin enables the second factor authentication
+	adminRecoveryCodesNumber = 10
+	adminRecoveryCodeSize    = 6
+)
+
+// Available permissions for the admins of the REST API and the web admin interface
+const (
+	// All permissions are granted
+	PermAdminAny = "*"
+	// List and get users and groups
+	PermAdminViewUsers = "view_users"
+	// Add, update and delete users and groups
+	PermAdminManageUsers = "manage_users"
+	// Add users, it is implied by PermAdminManageUsers and it is useful to restrict API keys
+	PermAdminAddUsers = "add_users"
+	// View the active connections
+	PermAdminViewConnections = "view_conns"
+	// Close the active connections
+	PermAdminCloseConnections = "close_conns"
+	// View and start quota scans
+	PermAdminQuotaScans = "quota_scans"
+	// View the banned hosts, the hosts scores and the defender lists
+	PermAdminViewDefender = "view_defender"
+	// Unban hosts and manage the defender lists
+	PermAdminManageDefender = "manage_defender"
+	// Backup and restore the data
+	PermAdminManageSystem = "manage_system"
+	// Add, update and delete admins
+	PermAdminManageAdmins = "manage_admins"
+	// View and start data retention checks
+	PermAdminRetentionChecks = "retention_checks"
+)
+
+var (
+	// ValidAdminPerms defines all the valid permissions for an admin
+	ValidAdminPerms = []string{PermAdminAny, PermAdminViewUsers, PermAdminManageUsers, PermAdminAddUsers,
+		PermAdminViewConnections, PermAdminCloseConnections, PermAdminQuotaScans, PermAdminViewDefender,
+		PermAdminManageDefender, PermAdminManageSystem, PermAdminManageAdmins, PermAdminRetentionChecks}
+	adminUsernameRegex      = regexp.MustCompile("^[a-zA-Z0-9-_.~]+$")
+	errAdminTOTPRequired    = errors.New("a TOTP authentication code is required for this admin")
+	errAdminInvalidTOTPCode = errors.New("invalid TOTP authentication code or recovery code")
+)
+
+// AdminRecoveryCode defines a single use code that an admin can provide instead of a TOTP
+// code, for example if the authenticator device is lost
+type AdminRecoveryCode struct {
+	// SHA256 hash of the code
+	Hash string `json:"hash"`
+	Used bool   `json:"used"`
+}
+
+// AdminFilters defines the second factor authentication settings for an admin.
+// They are set using the dedicated APIs and cannot be modified updating the admin
+type AdminFilters struct {
+	// If set the admin must provide a TOTP code, or a recovery code, to login.
+	// The secret is stored encrypted
+	TOTPSecret    string              `json:"totp_secret,omitempty"`
+	RecoveryCodes []AdminRecoveryCode `json:"recovery_codes,omitempty"`
+	// Time step of the last accepted TOTP code, the codes for this step and the
+	// previous ones are rejected so a code cannot be used more than once
+	TOTPLastStep int64 `json:"totp_last_step,omitempty"`
+}
+
+// Admin defines an administrator of the REST API and of the web admin interface
+type Admin struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// 1 enabled, 0 disabled (login is not allowed)
+	Status int `json:"status"`
+	// Username
+	Username string `json:"username"`
+	// Password, it is stored hashed
+	Password string `json:"password,omitempty"`
+	// Granted permissions
+	Permissions []string `json:"permissions"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// Second factor authentication settings
+	Filters AdminFilters `json:"filters"`
+}
+
+// GetPermissionsAsJSON returns the permissions as json byte array
+func (a *Admin) GetPermissionsAsJSON() ([]byte, error) {
+	return json.Marshal(a.Permissions)
+}
+
+// HasPermission returns true if the admin has the specified permission
+func (a *Admin) HasPermission(perm string) bool {
+	if utils.IsStringInSlice(PermAdminAny, a.Permissions) {
+		return true
+	}
+	if perm == PermAdminAddUsers && utils.IsStringInSlice(PermAdminManageUsers, a.Permissions) {
+		return true
+	}
+	return utils.IsStringInSlice(perm, a.Permissions)
+}
+
+// GetPermissionsAsString returns the permissions as comma separated string
+func (a Admin) GetPermissionsAsString() string {
+	return strings.Join(a.Permissions, ",")
+}
+
+// GetFiltersAsJSON returns the filters as json byte array
+func (a *Admin) GetFiltersAsJSON() ([]byte, error) {
+	return json.Marshal(a.Filters)
+}
+
+// HasTOTPSecret returns true if a second authentication factor, based on TOTP, is required
+func (a *Admin) HasTOTPSecret() bool {
+	return len(a.Filters.TOTPSecret) > 0
+}
+
+// GetUnusedRecoveryCodes returns the number of recovery codes not yet used
+func (a *Admin) GetUnusedRecoveryCodes() int {
+	unused := 0
+	for _, code := range a.Filters.RecoveryCodes {
+		if !code.Used {
+			unused++
+		}
+	}
+	return unused
+}
+
+// HideConfidentialData hides the admin password, the TOTP secret and the recovery codes
+func (a *Admin) HideConfidentialData() {
+	a.Password = ""
+	if a.HasTOTPSecret() {
+		a.Filters.TOTPSecret = utils.RemoveDecryptionKey(a.Filters.TOTPSecret)
+	}
+	a.Filters.RecoveryCodes = nil
+}
+
+func (a *Admin) getACopy() Admin {
+	permissions := make([]string, len(a.Permissions))
+	copy(permissions, a.Permissions)
+	recoveryCodes := make([]AdminRecoveryCode, len(a.Filters.RecoveryCodes))
+	copy(recoveryCodes, a.Filters.RecoveryCodes)
+	admin := *a
+	admin.Permissions = permissions
+	admin.Filters.RecoveryCodes = recoveryCodes
+	return admin
+}
+
+// generateAdminRecoveryCodes returns the plain recovery codes and their hashes
+func generateAdminRecoveryCodes() ([]string, []AdminRecoveryCode, error) {
+	var codes []string
+	var hashes []AdminRecoveryCode
+	for i := 0; i < adminRecoveryCodesNumber; i++ {
+		b := make([]byte, adminRecoveryCodeSize)
+		if _, err := rand.Read(b); err != nil {
+			return codes, hashes, err
+		}
+		code := hex.EncodeToString(b)
+		codes = append(codes, code)
+		hashes = append(hashes, AdminRecoveryCode{
+			Hash: hashAdminRecoveryCode(code),
+		})
+	}
+	return codes, hashes, nil
+}
+
+func hashAdminRecoveryCode(code string) string {
+	h := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(h[:])
+}
+
+func validateAdminFilters(admin *Admin) error {
+	if len(admin.Filters.TOTPSecret) == 0 {
+		admin.Filters.RecoveryCodes = nil
+		admin.Filters.TOTPLastStep = 0
+		return nil
+	}
+	if !kms.IsEncrypted(admin.Filters.TOTPSecret) {
+		if _, err := utils.DecodeTOTPSecret(admin.Filters.TOTPSecret); err != nil {
+			return &ValidationError{err: "invalid TOTP secret, it must be base32 encoded and at least 80 bits long"}
+		}
+	}
+	if err := encryptFsSecret(&admin.Filters.TOTPSecret); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt TOTP secret: %v", err)}
+	}
+	for _, code := range admin.Filters.RecoveryCodes {
+		if len(code.Hash) != 2*sha256.Size {
+			return &ValidationError{err: "invalid recovery code hash"}
+		}
+	}
+	return nil
+}
+
+func validateAdmin(admin *Admin) error {
+	if len(admin.Username) == 0 || len(admin.Password) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if !adminUsernameRegex.MatchString(admin.Username) {
+		return &ValidationError{err: fmt.Sprintf("username %#v is not valid, the following characters are allowed: a-zA-Z0-9-_.~",
+			admin.Username)}
+	}
+	if admin.Status < 0 || admin.Status > 1 {
+		return &ValidationError{err: fmt.Sprintf("invalid admin status: %v", admin.Status)}
+	}
+	if len(admin.Permissions) == 0 {
+		return &ValidationError{err: "please grant some permissions to this admin"}
+	}
+	var permissions []string
+	for _, perm := range admin.Permissions {
+		if !utils.IsStringInSlice(perm, ValidAdminPerms) {
+			return &ValidationError{err: fmt.Sprintf("invalid permission: %#v", perm)}
+		}
+		if !utils.IsStringInSlice(perm, permissions) {
+			permissions = append(permissions, perm)
+		}
+	}
+	if utils.IsStringInSlice(PermAdminAny, permissions) {
+		permissions = []string{PermAdminAny}
+	}
+	admin.Permissions = permissions
+	if err := validateAdminFilters(admin); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(admin.Password, argonPwdPrefix) && !strings.HasPrefix(admin.Password, bcryptPwdPrefix) {
+		pwd, err := hashPassword(admin.Password)
+		if err != nil {
+			return err
+		}
+		admin.Password = pwd
+	}
+	return nil
+}
+
+func checkAdminAndPass(admin Admin, password string) (Admin, error) {
+	if admin.Status != 1 {
+		return admin, fmt.Errorf("admin %#v is disabled", admin.Username)
+	}
+	if len(password) == 0 || len(admin.Password) == 0 {
+		return admin, errors.New("Credentials cannot be null or empty")
+	}
+	match := false
+	var err error
+	if strings.HasPrefix(admin.Password, argonPwdPrefix) {
+		match, err = argon2id.ComparePasswordAndHash(password, admin.Password)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error comparing password with argon hash: %v", err)
+			return admin, err
+		}
+	} else if strings.HasPrefix(admin.Password, bcryptPwdPrefix) {
+		if err = bcrypt.CompareHashAndPassword([]byte(admin.Password), []byte(password)); err != nil {
+			return admin, errors.New("Invalid credentials")
+		}
+		match = true
+	}
+	if !match {
+		return admin, errors.New("Invalid credentials")
+	}
+	return admin, nil
+}
+
+// checkAdminSecondFactor validates the given TOTP code or recovery code. The time step for
+// an accepted TOTP code is stored inside the given admin, a used recovery code is marked as
+// used. It returns true if a recovery code was used
+func checkAdminSecondFactor(admin *Admin, code string) (bool, error) {
+	if len(code) == 0 {
+		return false, errAdminTOTPRequired
+	}
+	secret, err := kms.Decrypt(admin.Filters.TOTPSecret)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to decrypt TOTP secret for admin %#v: %v", admin.Username, err)
+		return false, err
+	}
+	if step, ok := utils.ValidateTOTPCodeAfterStep(secret, code, admin.Filters.TOTPLastStep); ok {
+		admin.Filters.TOTPLastStep = step
+		return false, nil
+	}
+	hash := hashAdminRecoveryCode(code)
+	for idx, recoveryCode := range admin.Filters.RecoveryCodes {
+		if !recoveryCode.Used && subtle.ConstantTimeCompare([]byte(recoveryCode.Hash), []byte(hash)) == 1 {
+			admin.Filters.RecoveryCodes[idx].Used = true
+			return true, nil
+		}
+	}
+	providerLog(logger.LevelInfo, "invalid TOTP code or recovery code for admin %#v", admin.Username)
+	return false, errAdminInvalidTOTPCode
+}
@@ -0,0 +1,160 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	apiKeyHashPrefix = "$sha256$"
+	apiKeySecretSize = 32
+)
+
+// APIKey defines a long-lived and revocable key for the REST API.
+// A key belongs to an admin and it allows a subset of the admin permissions,
+// the plain key is "<key_id>.<secret>" and only the secret hash is stored
+type APIKey struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique public identifier, it is generated on creation
+	KeyID string `json:"key_id"`
+	// The plain key is returned only on creation, then the secret is stored hashed and never returned
+	Key string `json:"key,omitempty"`
+	// Name used to identify the key
+	Name string `json:"name"`
+	// Username of the admin that owns this key
+	Admin string `json:"admin"`
+	// Allowed permissions, they are limited to the ones granted to the admin when the key is used
+	Scopes []string `json:"scopes"`
+	// creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// expiration time as unix timestamp in milliseconds, 0 means no expiration
+	ExpiresAt int64 `json:"expires_at"`
+	// last use time as unix timestamp in milliseconds
+	LastUseAt int64 `json:"last_use_at"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+}
+
+// GetScopesAsJSON returns the scopes as json byte array
+func (k *APIKey) GetScopesAsJSON() ([]byte, error) {
+	return json.Marshal(k.Scopes)
+}
+
+// HideConfidentialData hides the key secret
+func (k *APIKey) HideConfidentialData() {
+	k.Key = ""
+}
+
+// IsExpired returns true if the key is expired
+func (k *APIKey) IsExpired() bool {
+	return k.ExpiresAt > 0 && k.ExpiresAt < utils.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// GetAllowedPermissions returns the key scopes allowed for the given admin
+func (k *APIKey) GetAllowedPermissions(admin *Admin) []string {
+	if utils.IsStringInSlice(PermAdminAny, k.Scopes) {
+		return admin.Permissions
+	}
+	var permissions []string
+	for _, scope := range k.Scopes {
+		if admin.HasPermission(scope) {
+			permissions = append(permissions, scope)
+		}
+	}
+	return permissions
+}
+
+func (k *APIKey) getACopy() APIKey {
+	scopes := make([]string, len(k.Scopes))
+	copy(scopes, k.Scopes)
+	key := *k
+	key.Scopes = scopes
+	return key
+}
+
+// GenerateAPIKey returns a new random key with the given name and scopes for the given admin.
+// The key secret is in plain text and it must be returned to the client before adding the key
+func GenerateAPIKey(admin Admin, name string, scopes []string) (APIKey, error) {
+	secret := make([]byte, apiKeySecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return APIKey{}, err
+	}
+	return APIKey{
+		KeyID:     xid.New().String(),
+		Key:       base64.RawURLEncoding.EncodeToString(secret),
+		Name:      name,
+		Admin:     admin.Username,
+		Scopes:    scopes,
+		CreatedAt: utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}, nil
+}
+
+func hashAPIKeySecret(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return apiKeyHashPrefix + hex.EncodeToString(hash[:])
+}
+
+func validateAPIKey(p Provider, key *APIKey) error {
+	if len(key.KeyID) == 0 || len(key.Key) == 0 || len(key.Name) == 0 || len(key.Admin) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if strings.Contains(key.KeyID, ".") {
+		return &ValidationError{err: fmt.Sprintf("invalid key id %#v", key.KeyID)}
+	}
+	if key.ExpiresAt < 0 {
+		return &ValidationError{err: "invalid expiration date"}
+	}
+	if len(key.Scopes) == 0 {
+		return &ValidationError{err: "please allow some scopes for this key"}
+	}
+	admin, err := p.adminExists(key.Admin)
+	if err != nil {
+		if _, ok := err.(*RecordNotFoundError); ok {
+			return &ValidationError{err: fmt.Sprintf("admin %#v does not exist", key.Admin)}
+		}
+		return err
+	}
+	var scopes []string
+	for _, scope := range key.Scopes {
+		if !utils.IsStringInSlice(scope, ValidAdminPerms) {
+			return &ValidationError{err: fmt.Sprintf("invalid scope: %#v", scope)}
+		}
+		if !admin.HasPermission(scope) {
+			return &ValidationError{err: fmt.Sprintf("scope %#v is not allowed for admin %#v", scope, admin.Username)}
+		}
+		if !utils.IsStringInSlice(scope, scopes) {
+			scopes = append(scopes, scope)
+		}
+	}
+	if utils.IsStringInSlice(PermAdminAny, scopes) {
+		scopes = []string{PermAdminAny}
+	}
+	key.Scopes = scopes
+	if !strings.HasPrefix(key.Key, apiKeyHashPrefix) {
+		key.Key = hashAPIKeySecret(key.Key)
+	}
+	return nil
+}
+
+func checkAPIKey(key APIKey, secret string) (APIKey, error) {
+	if key.IsExpired() {
+		return key, fmt.Errorf("API key %#v is expired", key.KeyID)
+	}
+	if len(secret) == 0 || subtle.ConstantTimeCompare([]byte(hashAPIKeySecret(secret)), []byte(key.Key)) != 1 {
+		return key, errors.New("Invalid API key")
+	}
+	return key, nil
+}
@@ -18,10 +18,22 @@ const (
 )
 
 var (
-	usersBucket      = []byte("users")
-	usersIDIdxBucket = []byte("users_id_idx")
-	dbVersionBucket  = []byte("db_version")
-	dbVersionKey     = []byte("version")
+	usersBucket              = []byte("users")
+	usersIDIdxBucket         = []byte("users_id_idx")
+	groupsBucket             = []byte("groups")
+	groupsIDIdxBucket        = []byte("groups_id_idx")
+	adminsBucket             = []byte("admins")
+	adminsIDIdxBucket        = []byte("admins_id_idx")
+	apiKeysBucket            = []byte("api_keys")
+	sharesBucket             = []byte("shares")
+	eventRulesBucket         = []byte("event_rules")
+	eventRulesIDIdxBucket    = []byte("event_rules_id_idx")
+	userTemplatesBucket      = []byte("user_templates")
+	userTemplatesIDIdxBucket = []byte("user_templates_id_idx")
+	defenderHostsBucket      = []byte("defender_hosts")
+	activeSessionsBucket     = []byte("active_sessions")
+	dbVersionBucket          = []byte("db_version")
+	dbVersionKey             = []byte("version")
 )
 
 // BoltProvider auth provider for bolt key/value store
@@ -83,6 +95,86 @@ func initializeBoltProvider(basePath string) error {
 			providerLog(logger.LevelWarn, "error creating username idx bucket: %v", err)
 			return err
 		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(groupsBucket)
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists(groupsIDIdxBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating groups buckets: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(adminsBucket)
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists(adminsIDIdxBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating admins buckets: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(apiKeysBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating API keys bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(sharesBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating shares bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(eventRulesBucket)
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists(eventRulesIDIdxBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating event rules buckets: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(userTemplatesBucket)
+			if e != nil {
+				return e
+			}
+			_, e = tx.CreateBucketIfNotExists(userTemplatesIDIdxBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating user templates buckets: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(defenderHostsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating defender hosts bucket: %v", err)
+			return err
+		}
+		err = dbHandle.Update(func(tx *bolt.Tx) error {
+			_, e := tx.CreateBucketIfNotExists(activeSessionsBucket)
+			return e
+		})
+		if err != nil {
+			providerLog(logger.LevelWarn, "error creating active sessions bucket: %v", err)
+			return err
+		}
 		err = dbHandle.Update(func(tx *bolt.Tx) error {
 			_, e := tx.CreateBucketIfNotExists(dbVersionBucket)
 			return e
@@ -175,6 +267,54 @@ func (p BoltProvider) updateLastLogin(username string) error {
 	})
 }
 
+func (p BoltProvider) updateUserPassword(username, password string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update password", username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		user.Password = password
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
+func (p BoltProvider) updateAdminPassword(username, password string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var a []byte
+		if a = bucket.Get([]byte(username)); a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %#v does not exist, unable to update password", username)}
+		}
+		var admin Admin
+		err = json.Unmarshal(a, &admin)
+		if err != nil {
+			return err
+		}
+		admin.Password = password
+		buf, err := json.Marshal(admin)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
 func (p BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	return p.dbHandle.Update(func(tx *bolt.Tx) error {
 		bucket, _, err := getBuckets(tx)
@@ -206,6 +346,46 @@ func (p BoltProvider) updateQuota(username string, filesAdd int, sizeAdd int64,
 	})
 }
 
+func (p BoltProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getBuckets(tx)
+		if err != nil {
+			return err
+		}
+		var u []byte
+		if u = bucket.Get([]byte(username)); u == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("username %#v does not exist, unable to update data transfer", username)}
+		}
+		var user User
+		err = json.Unmarshal(u, &user)
+		if err != nil {
+			return err
+		}
+		if reset {
+			user.UsedUploadDataTransfer = uploadAdd
+			user.UsedDownloadDataTransfer = downloadAdd
+			user.LastDataTransferReset = utils.GetTimeAsMsSinceEpoch(time.Now())
+		} else {
+			user.UsedUploadDataTransfer += uploadAdd
+			user.UsedDownloadDataTransfer += downloadAdd
+		}
+		buf, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(username), buf)
+	})
+}
+
+func (p BoltProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get data transfer for user %v error: %v", username, err)
+		return 0, 0, 0, err
+	}
+	return user.UsedUploadDataTransfer, user.UsedDownloadDataTransfer, user.LastDataTransferReset, err
+}
+
 func (p BoltProvider) getUsedQuota(username string) (int, int64, error) {
 	user, err := p.userExists(username)
 	if err != nil {
@@ -272,9 +452,19 @@ func (p BoltProvider) updateUser(user User) error {
 		if err != nil {
 			return err
 		}
-		if u := bucket.Get([]byte(user.Username)); u == nil {
+		var u []byte
+		if u = bucket.Get([]byte(user.Username)); u == nil {
 			return &RecordNotFoundError{err: fmt.Sprintf("username %v does not exist", user.Username)}
 		}
+		var oldUser User
+		err = json.Unmarshal(u, &oldUser)
+		if err != nil {
+			return err
+		}
+		// the used data transfer can only be changed using updateDataTransfer
+		user.UsedUploadDataTransfer = oldUser.UsedUploadDataTransfer
+		user.UsedDownloadDataTransfer = oldUser.UsedDownloadDataTransfer
+		user.LastDataTransferReset = oldUser.LastDataTransferReset
 		buf, err := json.Marshal(user)
 		if err != nil {
 			return err
@@ -386,56 +576,1401 @@ func (p BoltProvider) getUsers(limit int, offset int, order string, username str
 	return users, err
 }
 
-func (p BoltProvider) close() error {
-	return p.dbHandle.Close()
+func (p BoltProvider) groupExists(name string) (Group, error) {
+	var group Group
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		g := bucket.Get([]byte(name))
+		if g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", name)}
+		}
+		return json.Unmarshal(g, &group)
+	})
+	return group, err
 }
 
-func (p BoltProvider) reloadConfig() error {
-	return nil
+func (p BoltProvider) getGroupByID(ID int64) (Group, error) {
+	var group Group
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		name := idxBucket.Get(itob(ID))
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group with ID %v does not exist", ID)}
+		}
+		g := bucket.Get(name)
+		if g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %#v and ID: %v does not exist", string(name), ID)}
+		}
+		return json.Unmarshal(g, &group)
+	})
+	return group, err
 }
 
-// initializeDatabase does nothing, no initilization is needed for bolt provider
-func (p BoltProvider) initializeDatabase() error {
-	return errNoInitRequired
+func (p BoltProvider) addGroup(group Group) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if g := bucket.Get([]byte(group.Name)); g != nil {
+			return fmt.Errorf("group %v already exists", group.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		group.ID = int64(id)
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(group.Name), buf)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(itob(group.ID), []byte(group.Name))
+	})
 }
 
-func (p BoltProvider) migrateDatabase() error {
-	dbVersion, err := getBoltDatabaseVersion(p.dbHandle)
+func (p BoltProvider) updateGroup(group Group) error {
+	err := validateGroup(&group)
 	if err != nil {
 		return err
 	}
-	if dbVersion.Version == boltDatabaseVersion {
-		providerLog(logger.LevelDebug, "bolt database is updated, current version: %v", dbVersion.Version)
-		return nil
-	}
-	if dbVersion.Version == 1 {
-		err = updateDatabaseFrom1To2(p.dbHandle)
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getGroupBuckets(tx)
 		if err != nil {
 			return err
 		}
-		return updateDatabaseFrom2To3(p.dbHandle)
-	} else if dbVersion.Version == 2 {
-		return updateDatabaseFrom2To3(p.dbHandle)
-	}
+		if g := bucket.Get([]byte(group.Name)); g == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", group.Name)}
+		}
+		buf, err := json.Marshal(group)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(group.Name), buf)
+	})
+}
 
-	return nil
+func (p BoltProvider) deleteGroup(group Group) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		groupIDAsBytes := itob(group.ID)
+		name := idxBucket.Get(groupIDAsBytes)
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("group with id %v does not exist", group.ID)}
+		}
+		err = bucket.Delete(name)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Delete(groupIDAsBytes)
+	})
 }
 
-// itob returns an 8-byte big endian representation of v.
-func itob(v int64) []byte {
-	b := make([]byte, 8)
-	binary.BigEndian.PutUint64(b, uint64(v))
-	return b
+func (p BoltProvider) dumpGroups() ([]Group, error) {
+	groups := []Group{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var group Group
+			err = json.Unmarshal(v, &group)
+			if err != nil {
+				return err
+			}
+			groups = append(groups, group)
+		}
+		return err
+	})
+	return groups, err
 }
 
-func getBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+func (p BoltProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	groups := []Group{}
 	var err error
-	bucket := tx.Bucket(usersBucket)
-	idxBucket := tx.Bucket(usersIDIdxBucket)
-	if bucket == nil || idxBucket == nil {
-		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	if limit <= 0 {
+		return groups, err
 	}
-	return bucket, idxBucket, err
+	if len(name) > 0 {
+		if offset == 0 {
+			group, err := p.groupExists(name)
+			if err == nil {
+				groups = append(groups, HideGroupSensitiveData(&group))
+			}
+		}
+		return groups, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getGroupBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var group Group
+			err = json.Unmarshal(v, &group)
+			if err == nil {
+				groups = append(groups, HideGroupSensitiveData(&group))
+			}
+			if len(groups) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return groups, err
+}
+
+func (p BoltProvider) eventRuleExists(name string) (EventRule, error) {
+	var rule EventRule
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		r := bucket.Get([]byte(name))
+		if r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("event rule %v does not exist", name)}
+		}
+		return json.Unmarshal(r, &rule)
+	})
+	return rule, err
+}
+
+func (p BoltProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	var rule EventRule
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		name := idxBucket.Get(itob(ID))
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("event rule with ID %v does not exist", ID)}
+		}
+		r := bucket.Get(name)
+		if r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("event rule %#v and ID: %v does not exist", string(name), ID)}
+		}
+		return json.Unmarshal(r, &rule)
+	})
+	return rule, err
+}
+
+func (p BoltProvider) addEventRule(rule EventRule) error {
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if r := bucket.Get([]byte(rule.Name)); r != nil {
+			return fmt.Errorf("event rule %v already exists", rule.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		rule.ID = int64(id)
+		buf, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(rule.Name), buf)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(itob(rule.ID), []byte(rule.Name))
+	})
+}
+
+func (p BoltProvider) updateEventRule(rule EventRule) error {
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if r := bucket.Get([]byte(rule.Name)); r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("event rule %v does not exist", rule.Name)}
+		}
+		buf, err := json.Marshal(rule)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(rule.Name), buf)
+	})
+}
+
+func (p BoltProvider) deleteEventRule(rule EventRule) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		ruleIDAsBytes := itob(rule.ID)
+		name := idxBucket.Get(ruleIDAsBytes)
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("event rule with id %v does not exist", rule.ID)}
+		}
+		err = bucket.Delete(name)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Delete(ruleIDAsBytes)
+	})
+}
+
+func (p BoltProvider) dumpEventRules() ([]EventRule, error) {
+	rules := []EventRule{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var rule EventRule
+			err = json.Unmarshal(v, &rule)
+			if err != nil {
+				return err
+			}
+			rules = append(rules, rule)
+		}
+		return err
+	})
+	return rules, err
+}
+
+func (p BoltProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	rules := []EventRule{}
+	var err error
+	if limit <= 0 {
+		return rules, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			rule, err := p.eventRuleExists(name)
+			if err == nil {
+				rules = append(rules, rule)
+			}
+		}
+		return rules, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getEventRuleBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var rule EventRule
+			err = json.Unmarshal(v, &rule)
+			if err == nil {
+				rules = append(rules, rule)
+			}
+			if len(rules) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return rules, err
+}
+
+func (p BoltProvider) userTemplateExists(name string) (UserTemplate, error) {
+	var template UserTemplate
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		r := bucket.Get([]byte(name))
+		if r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user template %v does not exist", name)}
+		}
+		return json.Unmarshal(r, &template)
+	})
+	return template, err
+}
+
+func (p BoltProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	var template UserTemplate
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		name := idxBucket.Get(itob(ID))
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user template with ID %v does not exist", ID)}
+		}
+		r := bucket.Get(name)
+		if r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user template %#v and ID: %v does not exist", string(name), ID)}
+		}
+		return json.Unmarshal(r, &template)
+	})
+	return template, err
+}
+
+func (p BoltProvider) addUserTemplate(template UserTemplate) error {
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if r := bucket.Get([]byte(template.Name)); r != nil {
+			return fmt.Errorf("user template %v already exists", template.Name)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		template.ID = int64(id)
+		buf, err := json.Marshal(template)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(template.Name), buf)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(itob(template.ID), []byte(template.Name))
+	})
+}
+
+func (p BoltProvider) updateUserTemplate(template UserTemplate) error {
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if r := bucket.Get([]byte(template.Name)); r == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user template %v does not exist", template.Name)}
+		}
+		buf, err := json.Marshal(template)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(template.Name), buf)
+	})
+}
+
+func (p BoltProvider) deleteUserTemplate(template UserTemplate) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		templateIDAsBytes := itob(template.ID)
+		name := idxBucket.Get(templateIDAsBytes)
+		if name == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("user template with id %v does not exist", template.ID)}
+		}
+		err = bucket.Delete(name)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Delete(templateIDAsBytes)
+	})
+}
+
+func (p BoltProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var template UserTemplate
+			err = json.Unmarshal(v, &template)
+			if err != nil {
+				return err
+			}
+			templates = append(templates, template)
+		}
+		return err
+	})
+	return templates, err
+}
+
+func (p BoltProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	var err error
+	if limit <= 0 {
+		return templates, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			template, err := p.userTemplateExists(name)
+			if err == nil {
+				templates = append(templates, template)
+			}
+		}
+		return templates, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getUserTemplateBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var template UserTemplate
+			err = json.Unmarshal(v, &template)
+			if err == nil {
+				templates = append(templates, template)
+			}
+			if len(templates) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return templates, err
+}
+
+func (p BoltProvider) addDefenderEvent(ip string, score int) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, _, err := getDefenderHostFromBucket(bucket, ip)
+		if err != nil {
+			return err
+		}
+		host.IP = ip
+		host.Events = append(host.Events, defenderEvent{
+			DateTime: utils.GetTimeAsMsSinceEpoch(time.Now()),
+			Score:    score,
+		})
+		return putDefenderHostInBucket(bucket, host)
+	})
+}
+
+func (p BoltProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	var entry DefenderEntry
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, _, err := getDefenderHostFromBucket(bucket, ip)
+		if err != nil {
+			return err
+		}
+		entry = host.getEntry(0)
+		if !entry.IsBanned() {
+			return &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (p BoltProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	var entry DefenderEntry
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, _, err := getDefenderHostFromBucket(bucket, ip)
+		if err != nil {
+			return err
+		}
+		entry = host.getEntry(from)
+		if !entry.isTracked() {
+			return &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+		}
+		return nil
+	})
+	return entry, err
+}
+
+func (p BoltProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	entries := []DefenderEntry{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var host defenderHost
+			err = json.Unmarshal(v, &host)
+			if err != nil {
+				return err
+			}
+			entry := host.getEntry(from)
+			if entry.isTracked() {
+				entries = append(entries, entry)
+			}
+		}
+		return nil
+	})
+	return sortDefenderEntries(entries, limit), err
+}
+
+func (p BoltProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		return putDefenderHostInBucket(bucket, defenderHost{
+			IP:      ip,
+			BanTime: banTime,
+		})
+	})
+}
+
+func (p BoltProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		host, found, err := getDefenderHostFromBucket(bucket, ip)
+		if err != nil {
+			return err
+		}
+		if !found || host.BanTime <= utils.GetTimeAsMsSinceEpoch(time.Now()) {
+			return &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+		}
+		host.BanTime += int64(minutes) * 60 * 1000
+		return putDefenderHostInBucket(bucket, host)
+	})
+}
+
+func (p BoltProvider) deleteDefenderHost(ip string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		if bucket.Get([]byte(ip)) == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+		}
+		return bucket.Delete([]byte(ip))
+	})
+}
+
+func (p BoltProvider) cleanupDefender(from int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getDefenderHostsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var hosts []defenderHost
+		var expired [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var host defenderHost
+			err = json.Unmarshal(v, &host)
+			if err != nil {
+				return err
+			}
+			if host.cleanup(from) {
+				hosts = append(hosts, host)
+			} else {
+				expired = append(expired, []byte(host.IP))
+			}
+		}
+		// the bucket cannot be modified while iterating
+		for _, ip := range expired {
+			if err = bucket.Delete(ip); err != nil {
+				return err
+			}
+		}
+		for _, host := range hosts {
+			if err = putDefenderHostInBucket(bucket, host); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p BoltProvider) addActiveSession(session ActiveSession) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getActiveSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		session.UpdatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(session)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(session.getKey()), buf)
+	})
+}
+
+func (p BoltProvider) deleteActiveSession(nodeID, connectionID string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getActiveSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		key := []byte(getActiveSessionKey(nodeID, connectionID))
+		if bucket.Get(key) == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("session %v does not exist", string(key))}
+		}
+		return bucket.Delete(key)
+	})
+}
+
+func (p BoltProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getActiveSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var sessions []ActiveSession
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var session ActiveSession
+			if err = json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if session.NodeID == nodeID {
+				sessions = append(sessions, session)
+			}
+		}
+		now := utils.GetTimeAsMsSinceEpoch(time.Now())
+		for _, session := range sessions {
+			session.UpdatedAt = now
+			buf, err := json.Marshal(session)
+			if err != nil {
+				return err
+			}
+			if err = bucket.Put([]byte(session.getKey()), buf); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p BoltProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	count := 0
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getActiveSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var session ActiveSession
+			if err = json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if session.Username == username && session.UpdatedAt > from {
+				count++
+			}
+		}
+		return nil
+	})
+	return count, err
+}
+
+func (p BoltProvider) cleanupActiveSessions(before int64) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getActiveSessionsBucket(tx)
+		if err != nil {
+			return err
+		}
+		var expired [][]byte
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var session ActiveSession
+			if err = json.Unmarshal(v, &session); err != nil {
+				return err
+			}
+			if session.UpdatedAt < before {
+				expired = append(expired, []byte(session.getKey()))
+			}
+		}
+		// the bucket cannot be modified while iterating
+		for _, key := range expired {
+			if err = bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (p BoltProvider) adminExists(username string) (Admin, error) {
+	var admin Admin
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		a := bucket.Get([]byte(username))
+		if a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", username)}
+		}
+		return json.Unmarshal(a, &admin)
+	})
+	return admin, err
+}
+
+func (p BoltProvider) getAdminByID(ID int64) (Admin, error) {
+	var admin Admin
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		username := idxBucket.Get(itob(ID))
+		if username == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin with ID %v does not exist", ID)}
+		}
+		a := bucket.Get(username)
+		if a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %#v and ID: %v does not exist", string(username), ID)}
+		}
+		return json.Unmarshal(a, &admin)
+	})
+	return admin, err
+}
+
+func (p BoltProvider) addAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if a := bucket.Get([]byte(admin.Username)); a != nil {
+			return fmt.Errorf("admin %v already exists", admin.Username)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		admin.ID = int64(id)
+		buf, err := json.Marshal(admin)
+		if err != nil {
+			return err
+		}
+		err = bucket.Put([]byte(admin.Username), buf)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Put(itob(admin.ID), []byte(admin.Username))
+	})
+}
+
+func (p BoltProvider) updateAdmin(admin Admin) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, _, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		if a := bucket.Get([]byte(admin.Username)); a == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", admin.Username)}
+		}
+		buf, err := json.Marshal(admin)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(admin.Username), buf)
+	})
+}
+
+func (p BoltProvider) deleteAdmin(admin Admin) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, idxBucket, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		adminIDAsBytes := itob(admin.ID)
+		username := idxBucket.Get(adminIDAsBytes)
+		if username == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("admin with id %v does not exist", admin.ID)}
+		}
+		err = bucket.Delete(username)
+		if err != nil {
+			return err
+		}
+		return idxBucket.Delete(adminIDAsBytes)
+	})
+}
+
+func (p BoltProvider) dumpAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var admin Admin
+			err = json.Unmarshal(v, &admin)
+			if err != nil {
+				return err
+			}
+			admins = append(admins, admin)
+		}
+		return err
+	})
+	return admins, err
+}
+
+func (p BoltProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	admins := []Admin{}
+	var err error
+	if limit <= 0 {
+		return admins, err
+	}
+	if len(username) > 0 {
+		if offset == 0 {
+			admin, err := p.adminExists(username)
+			if err == nil {
+				admin.HideConfidentialData()
+				admins = append(admins, admin)
+			}
+		}
+		return admins, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, _, err := getAdminBuckets(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			var admin Admin
+			err = json.Unmarshal(v, &admin)
+			if err == nil {
+				admin.HideConfidentialData()
+				admins = append(admins, admin)
+			}
+			if len(admins) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return admins, err
+}
+
+func (p BoltProvider) apiKeyExists(keyID string) (APIKey, error) {
+	var key APIKey
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		k := bucket.Get([]byte(keyID))
+		if k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+		}
+		return json.Unmarshal(k, &key)
+	})
+	return key, err
+}
+
+func (p BoltProvider) addAPIKey(key APIKey) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		if k := bucket.Get([]byte(key.KeyID)); k != nil {
+			return fmt.Errorf("API key %v already exists", key.KeyID)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		key.ID = int64(id)
+		key.LastUseAt = 0
+		buf, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key.KeyID), buf)
+	})
+}
+
+func (p BoltProvider) updateAPIKeyLastUse(keyID string) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		var key APIKey
+		k := bucket.Get([]byte(keyID))
+		if k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+		}
+		err = json.Unmarshal(k, &key)
+		if err != nil {
+			return err
+		}
+		key.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(keyID), buf)
+	})
+}
+
+func (p BoltProvider) deleteAPIKey(key APIKey) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		if k := bucket.Get([]byte(key.KeyID)); k == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", key.KeyID)}
+		}
+		return bucket.Delete([]byte(key.KeyID))
+	})
+}
+
+func (p BoltProvider) dumpAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var key APIKey
+			err = json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, key)
+		}
+		return err
+	})
+	return keys, err
+}
+
+func (p BoltProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	keys := []APIKey{}
+	var err error
+	if limit <= 0 {
+		return keys, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getAPIKeysBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			var key APIKey
+			err = json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+			if len(admin) > 0 && key.Admin != admin {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			key.HideConfidentialData()
+			keys = append(keys, key)
+			if len(keys) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return keys, err
+}
+
+func (p BoltProvider) shareExists(shareID string) (Share, error) {
+	var share Share
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		s := bucket.Get([]byte(shareID))
+		if s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+		}
+		return json.Unmarshal(s, &share)
+	})
+	return share, err
+}
+
+func (p BoltProvider) addShare(share Share) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if s := bucket.Get([]byte(share.ShareID)); s != nil {
+			return fmt.Errorf("share %v already exists", share.ShareID)
+		}
+		id, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		share.ID = int64(id)
+		buf, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(share.ShareID), buf)
+	})
+}
+
+func (p BoltProvider) updateShareUsage(shareID string, numTokens int) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		var share Share
+		s := bucket.Get([]byte(shareID))
+		if s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+		}
+		err = json.Unmarshal(s, &share)
+		if err != nil {
+			return err
+		}
+		share.UsedTokens += numTokens
+		share.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+		buf, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(shareID), buf)
+	})
+}
+
+func (p BoltProvider) deleteShare(share Share) error {
+	return p.dbHandle.Update(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		if s := bucket.Get([]byte(share.ShareID)); s == nil {
+			return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+		}
+		return bucket.Delete([]byte(share.ShareID))
+	})
+}
+
+func (p BoltProvider) dumpShares() ([]Share, error) {
+	shares := []Share{}
+	err := p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			var share Share
+			err = json.Unmarshal(v, &share)
+			if err != nil {
+				return err
+			}
+			shares = append(shares, share)
+		}
+		return err
+	})
+	return shares, err
+}
+
+func (p BoltProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	shares := []Share{}
+	var err error
+	if limit <= 0 {
+		return shares, err
+	}
+	err = p.dbHandle.View(func(tx *bolt.Tx) error {
+		bucket, err := getSharesBucket(tx)
+		if err != nil {
+			return err
+		}
+		cursor := bucket.Cursor()
+		itNum := 0
+		k, v := cursor.First()
+		next := cursor.Next
+		if order != "ASC" {
+			k, v = cursor.Last()
+			next = cursor.Prev
+		}
+		for ; k != nil; k, v = next() {
+			var share Share
+			err = json.Unmarshal(v, &share)
+			if err != nil {
+				return err
+			}
+			if len(username) > 0 && share.Username != username {
+				continue
+			}
+			itNum++
+			if itNum <= offset {
+				continue
+			}
+			share.HideConfidentialData()
+			shares = append(shares, share)
+			if len(shares) >= limit {
+				break
+			}
+		}
+		return err
+	})
+	return shares, err
+}
+
+func (p BoltProvider) close() error {
+	return p.dbHandle.Close()
+}
+
+func (p BoltProvider) reloadConfig() error {
+	return nil
+}
+
+// initializeDatabase does nothing, no initilization is needed for bolt provider
+func (p BoltProvider) initializeDatabase() error {
+	return errNoInitRequired
+}
+
+func (p BoltProvider) migrateDatabase() error {
+	dbVersion, err := getBoltDatabaseVersion(p.dbHandle)
+	if err != nil {
+		return err
+	}
+	if dbVersion.Version == boltDatabaseVersion {
+		providerLog(logger.LevelDebug, "bolt database is updated, current version: %v", dbVersion.Version)
+		return nil
+	}
+	if dbVersion.Version == 1 {
+		err = updateDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateDatabaseFrom2To3(p.dbHandle)
+	} else if dbVersion.Version == 2 {
+		return updateDatabaseFrom2To3(p.dbHandle)
+	}
+
+	return nil
+}
+
+// itob returns an 8-byte big endian representation of v.
+func itob(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func getBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(usersBucket)
+	idxBucket := tx.Bucket(usersIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find required buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getGroupBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(groupsBucket)
+	idxBucket := tx.Bucket(groupsIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find groups buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getEventRuleBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(eventRulesBucket)
+	idxBucket := tx.Bucket(eventRulesIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find event rules buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getUserTemplateBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(userTemplatesBucket)
+	idxBucket := tx.Bucket(userTemplatesIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find user templates buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getAdminBuckets(tx *bolt.Tx) (*bolt.Bucket, *bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(adminsBucket)
+	idxBucket := tx.Bucket(adminsIDIdxBucket)
+	if bucket == nil || idxBucket == nil {
+		err = fmt.Errorf("unable to find admins buckets, bolt database structure not correcly defined")
+	}
+	return bucket, idxBucket, err
+}
+
+func getDefenderHostsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(defenderHostsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find defender hosts bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getActiveSessionsBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(activeSessionsBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find active sessions bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getDefenderHostFromBucket(bucket *bolt.Bucket, ip string) (defenderHost, bool, error) {
+	var host defenderHost
+	h := bucket.Get([]byte(ip))
+	if h == nil {
+		return host, false, nil
+	}
+	err := json.Unmarshal(h, &host)
+	return host, true, err
+}
+
+func putDefenderHostInBucket(bucket *bolt.Bucket, host defenderHost) error {
+	buf, err := json.Marshal(host)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(host.IP), buf)
+}
+
+func getAPIKeysBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(apiKeysBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find API keys bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
+}
+
+func getSharesBucket(tx *bolt.Tx) (*bolt.Bucket, error) {
+	var err error
+	bucket := tx.Bucket(sharesBucket)
+	if bucket == nil {
+		err = fmt.Errorf("unable to find shares bucket, bolt database structure not correcly defined")
+	}
+	return bucket, err
 }
 
 func updateDatabaseFrom1To2(dbHandle *bolt.DB) error {
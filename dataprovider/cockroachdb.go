@@ -0,0 +1,854 @@
+package dataprovider
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	cockroachUsersTableSQL = `CREATE TABLE "{{users}}" ("id" serial NOT NULL PRIMARY KEY, "username" varchar(255) NOT NULL UNIQUE,
+"password" varchar(255) NULL, "public_keys" text NULL, "home_dir" varchar(255) NOT NULL, "uid" integer NOT NULL,
+"gid" integer NOT NULL, "max_sessions" integer NOT NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL,
+"permissions" text NOT NULL, "used_quota_size" bigint NOT NULL, "used_quota_files" integer NOT NULL,
+"last_quota_update" bigint NOT NULL, "upload_bandwidth" integer NOT NULL, "download_bandwidth" integer NOT NULL,
+"expiration_date" bigint NOT NULL, "last_login" bigint NOT NULL, "status" integer NOT NULL, "filters" text NULL,
+"filesystem" text NULL, "virtual_folders" text NULL, "upload_data_transfer" bigint DEFAULT 0 NOT NULL,
+"download_data_transfer" bigint DEFAULT 0 NOT NULL, "used_upload_data_transfer" bigint DEFAULT 0 NOT NULL,
+"used_download_data_transfer" bigint DEFAULT 0 NOT NULL, "data_transfer_reset" integer DEFAULT 0 NOT NULL,
+"last_data_transfer_reset" bigint DEFAULT 0 NOT NULL, "group_names" text NULL, "activation_date" bigint DEFAULT 0 NOT NULL,
+"last_password_change" bigint DEFAULT 0 NOT NULL);`
+	cockroachSchemaTableSQL = `CREATE TABLE "schema_version" ("id" serial NOT NULL PRIMARY KEY, "version" integer NOT NULL);`
+	// SQLSTATE returned by CockroachDB when a transaction must be retried
+	cockroachRetryErrorCode = "40001"
+	// max number of retries for the transactions aborted by CockroachDB because of conflicts
+	cockroachMaxRetries = 10
+)
+
+// CockroachDBProvider auth provider for CockroachDB database.
+// CockroachDB uses the PostgreSQL wire protocol and it is mostly compatible with the
+// PostgreSQL SQL dialect, but it runs all the transactions with serializable isolation,
+// so concurrent updates, for example the quota ones, can fail and must be retried
+type CockroachDBProvider struct {
+	dbHandle *sql.DB
+}
+
+func initializeCockroachDBProvider() error {
+	var err error
+	logSender = CockroachDataProviderName
+	dbHandle, err := sql.Open("postgres", getPGSQLConnectionString(false))
+	if err == nil {
+		providerLog(logger.LevelDebug, "cockroachdb database handle created, connection string: %#v, pool size: %v",
+			getPGSQLConnectionString(true), config.PoolSize)
+		dbHandle.SetMaxOpenConns(config.PoolSize)
+		provider = CockroachDBProvider{dbHandle: dbHandle}
+	} else {
+		providerLog(logger.LevelWarn, "error creating cockroachdb database handler, connection string: %#v, error: %v",
+			getPGSQLConnectionString(true), err)
+	}
+	return err
+}
+
+// isCockroachRetryError returns true if the given error is a serialization failure
+// and so the operation can be retried
+func isCockroachRetryError(err error) bool {
+	if pqErr, ok := err.(*pq.Error); ok {
+		return pqErr.Code == cockroachRetryErrorCode
+	}
+	return false
+}
+
+// cockroachRetry executes the given operation and retries it, with a randomized
+// increasing delay, if it fails because of a transaction conflict
+func cockroachRetry(operation string, fn func() error) error {
+	var err error
+	for retry := 0; retry <= cockroachMaxRetries; retry++ {
+		if retry > 0 {
+			delay := time.Duration(retry*20+rand.Intn(20)) * time.Millisecond
+			providerLog(logger.LevelDebug, "retrying %v after a transaction conflict, retry: %v delay: %v",
+				operation, retry, delay)
+			time.Sleep(delay)
+		}
+		err = fn()
+		if !isCockroachRetryError(err) {
+			return err
+		}
+	}
+	providerLog(logger.LevelWarn, "unable to complete %v after %v retries: %v", operation, cockroachMaxRetries, err)
+	return err
+}
+
+func (p CockroachDBProvider) checkAvailability() error {
+	return sqlCommonCheckAvailability(p.dbHandle)
+}
+
+func (p CockroachDBProvider) validateUserAndPass(username string, password string) (User, error) {
+	return sqlCommonValidateUserAndPass(username, password, p.dbHandle)
+}
+
+func (p CockroachDBProvider) validateUserAndPubKey(username string, publicKey string) (User, string, error) {
+	return sqlCommonValidateUserAndPubKey(username, publicKey, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getUserByID(ID int64) (User, error) {
+	return sqlCommonGetUserByID(ID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
+	return cockroachRetry("quota update", func() error {
+		return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	return cockroachRetry("data transfer update", func() error {
+		return sqlCommonUpdateDataTransfer(username, uploadAdd, downloadAdd, reset, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedDataTransfer(username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) updateLastLogin(username string) error {
+	return cockroachRetry("last login update", func() error {
+		return sqlCommonUpdateLastLogin(username, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateUserPassword(username, password string) error {
+	return cockroachRetry("user password update", func() error {
+		return sqlCommonUpdateUserPassword(username, password, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) getUsedQuota(username string) (int, int64, error) {
+	return sqlCommonGetUsedQuota(username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) userExists(username string) (User, error) {
+	return sqlCommonCheckUserExists(username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addUser(user User) error {
+	return cockroachRetry("user add", func() error {
+		return sqlCommonAddUser(user, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateUser(user User) error {
+	return cockroachRetry("user update", func() error {
+		return sqlCommonUpdateUser(user, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteUser(user User) error {
+	return cockroachRetry("user delete", func() error {
+		return sqlCommonDeleteUser(user, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpUsers() ([]User, error) {
+	return sqlCommonDumpUsers(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getUsers(limit int, offset int, order string, username string) ([]User, error) {
+	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addGroup(group Group) error {
+	return cockroachRetry("group add", func() error {
+		return sqlCommonAddGroup(group, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateGroup(group Group) error {
+	return cockroachRetry("group update", func() error {
+		return sqlCommonUpdateGroup(group, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteGroup(group Group) error {
+	return cockroachRetry("group delete", func() error {
+		return sqlCommonDeleteGroup(group, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) eventRuleExists(name string) (EventRule, error) {
+	return sqlCommonCheckEventRuleExists(name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addEventRule(rule EventRule) error {
+	return cockroachRetry("event rule add", func() error {
+		return sqlCommonAddEventRule(rule, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateEventRule(rule EventRule) error {
+	return cockroachRetry("event rule update", func() error {
+		return sqlCommonUpdateEventRule(rule, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteEventRule(rule EventRule) error {
+	return cockroachRetry("event rule delete", func() error {
+		return sqlCommonDeleteEventRule(rule, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpEventRules() ([]EventRule, error) {
+	return sqlCommonDumpEventRules(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	return sqlCommonGetEventRuleByID(ID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) userTemplateExists(name string) (UserTemplate, error) {
+	return sqlCommonCheckUserTemplateExists(name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addUserTemplate(template UserTemplate) error {
+	return cockroachRetry("user template add", func() error {
+		return sqlCommonAddUserTemplate(template, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateUserTemplate(template UserTemplate) error {
+	return cockroachRetry("user template update", func() error {
+		return sqlCommonUpdateUserTemplate(template, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteUserTemplate(template UserTemplate) error {
+	return cockroachRetry("user template delete", func() error {
+		return sqlCommonDeleteUserTemplate(template, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	return sqlCommonDumpUserTemplates(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	return sqlCommonGetUserTemplates(limit, offset, order, name, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	return sqlCommonGetUserTemplateByID(ID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addDefenderEvent(ip string, score int) error {
+	return cockroachRetry("defender event add", func() error {
+		return sqlCommonAddDefenderEvent(ip, score, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p CockroachDBProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return cockroachRetry("defender ban time set", func() error {
+		return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return cockroachRetry("defender ban time update", func() error {
+		return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteDefenderHost(ip string) error {
+	return cockroachRetry("defender host delete", func() error {
+		return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) cleanupDefender(from int64) error {
+	return cockroachRetry("defender cleanup", func() error {
+		return sqlCommonCleanupDefender(from, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) addActiveSession(session ActiveSession) error {
+	return cockroachRetry("active session add", func() error {
+		return sqlCommonAddActiveSession(session, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteActiveSession(nodeID, connectionID string) error {
+	return cockroachRetry("active session delete", func() error {
+		return sqlCommonDeleteActiveSession(nodeID, connectionID, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	return cockroachRetry("active sessions heartbeat", func() error {
+		return sqlCommonUpdateActiveSessionsHeartbeat(nodeID, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	return sqlCommonGetActiveSessionsCount(username, from, p.dbHandle)
+}
+
+func (p CockroachDBProvider) cleanupActiveSessions(before int64) error {
+	return cockroachRetry("active sessions cleanup", func() error {
+		return sqlCommonCleanupActiveSessions(before, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonCheckAdminExists(username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addAdmin(admin Admin) error {
+	return cockroachRetry("admin add", func() error {
+		return sqlCommonAddAdmin(admin, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateAdmin(admin Admin) error {
+	return cockroachRetry("admin update", func() error {
+		return sqlCommonUpdateAdmin(admin, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateAdminPassword(username, password string) error {
+	return cockroachRetry("admin password update", func() error {
+		return sqlCommonUpdateAdminPassword(username, password, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteAdmin(admin Admin) error {
+	return cockroachRetry("admin delete", func() error {
+		return sqlCommonDeleteAdmin(admin, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) getAdminByID(ID int64) (Admin, error) {
+	return sqlCommonGetAdminByID(ID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonCheckAPIKeyExists(keyID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addAPIKey(key APIKey) error {
+	return cockroachRetry("API key add", func() error {
+		return sqlCommonAddAPIKey(key, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateAPIKeyLastUse(keyID string) error {
+	return cockroachRetry("API key last use update", func() error {
+		return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteAPIKey(key APIKey) error {
+	return cockroachRetry("API key delete", func() error {
+		return sqlCommonDeleteAPIKey(key, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpAPIKeys() ([]APIKey, error) {
+	return sqlCommonDumpAPIKeys(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p CockroachDBProvider) shareExists(shareID string) (Share, error) {
+	return sqlCommonCheckShareExists(shareID, p.dbHandle)
+}
+
+func (p CockroachDBProvider) addShare(share Share) error {
+	return cockroachRetry("share add", func() error {
+		return sqlCommonAddShare(share, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) updateShareUsage(shareID string, numTokens int) error {
+	return cockroachRetry("share usage update", func() error {
+		return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) deleteShare(share Share) error {
+	return cockroachRetry("share delete", func() error {
+		return sqlCommonDeleteShare(share, p.dbHandle)
+	})
+}
+
+func (p CockroachDBProvider) dumpShares() ([]Share, error) {
+	return sqlCommonDumpShares(p.dbHandle)
+}
+
+func (p CockroachDBProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
+func (p CockroachDBProvider) close() error {
+	return p.dbHandle.Close()
+}
+
+func (p CockroachDBProvider) reloadConfig() error {
+	return nil
+}
+
+// initializeDatabase creates the database structure, CockroachDB support was added
+// after the schema version 3 so there is nothing to migrate from versions before 3
+func (p CockroachDBProvider) initializeDatabase() error {
+	sqlUsers := strings.Replace(cockroachUsersTableSQL, "{{users}}", config.UsersTable, 1)
+	sqlGroups := strings.Replace(pgsqlGroupsV4SQL, "{{groups}}", sqlGroupsTable, 1)
+	sqlAdmins := strings.Replace(pgsqlAdminsV5SQL, "{{admins}}", sqlAdminsTable, 1)
+	sqlAPIKeys := strings.Replace(pgsqlAPIKeysV6SQL, "{{api_keys}}", sqlAPIKeysTable, 1)
+	sqlShares := strings.Replace(pgsqlSharesV7SQL, "{{shares}}", sqlSharesTable, 1)
+	sqlEventsRules := strings.Replace(pgsqlEventsRulesV10SQL, "{{events_rules}}", sqlEventsRulesTable, 1)
+	sqlUserTemplates := strings.Replace(pgsqlUserTemplatesV11SQL, "{{user_templates}}", sqlUserTemplatesTable, 1)
+	return cockroachRetry("database initialization", func() error {
+		tx, err := p.dbHandle.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(sqlUsers)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlGroups)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlAdmins)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlAPIKeys)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlShares)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlEventsRules)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(sqlUserTemplates)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		statements := getDefenderV12Statements(pgsqlDefenderHostsV12SQL, pgsqlDefenderEventsV12SQL)
+		statements = append(statements, getActiveSessionsV13Statements(pgsqlActiveSessionsV13SQL)...)
+		statements = append(statements, strings.Replace(pgsqlAdminsV14SQL, "{{admins}}", sqlAdminsTable, 1))
+		for _, statement := range statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		_, err = tx.Exec(cockroachSchemaTableSQL)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = tx.Exec(fmt.Sprintf("INSERT INTO schema_version (version) VALUES (%v);", sqlDatabaseVersion))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		return tx.Commit()
+	})
+}
+
+func (p CockroachDBProvider) migrateDatabase() error {
+	dbVersion, err := sqlCommonGetDatabaseVersion(p.dbHandle)
+	if err != nil {
+		return err
+	}
+	if dbVersion.Version == sqlDatabaseVersion {
+		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
+		return nil
+	}
+	switch dbVersion.Version {
+	case 3:
+		err = p.updateDatabaseFrom3To4()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom4To5()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom5To6()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom6To7()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom7To8()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 4:
+		err = p.updateDatabaseFrom4To5()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom5To6()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom6To7()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom7To8()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 5:
+		err = p.updateDatabaseFrom5To6()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom6To7()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom7To8()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 6:
+		err = p.updateDatabaseFrom6To7()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom7To8()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 7:
+		err = p.updateDatabaseFrom7To8()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 8:
+		err = p.updateDatabaseFrom8To9()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 9:
+		err = p.updateDatabaseFrom9To10()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 10:
+		err = p.updateDatabaseFrom10To11()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 11:
+		err = p.updateDatabaseFrom11To12()
+		if err != nil {
+			return err
+		}
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 12:
+		err = p.updateDatabaseFrom12To13()
+		if err != nil {
+			return err
+		}
+		return p.updateDatabaseFrom13To14()
+	case 13:
+		return p.updateDatabaseFrom13To14()
+	}
+	return fmt.Errorf("unsupported database version: %v", dbVersion.Version)
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom3To4() error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 4, strings.Replace(pgsqlUsersV4SQL, "{{users}}", config.UsersTable, 1),
+			strings.Replace(pgsqlGroupsV4SQL, "{{groups}}", sqlGroupsTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom4To5() error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 5, strings.Replace(pgsqlAdminsV5SQL, "{{admins}}", sqlAdminsTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom5To6() error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 6, strings.Replace(pgsqlAPIKeysV6SQL, "{{api_keys}}", sqlAPIKeysTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom6To7() error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 7, strings.Replace(pgsqlSharesV7SQL, "{{shares}}", sqlSharesTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom7To8() error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 8, strings.Replace(pgsqlUsersV8SQL, "{{users}}", config.UsersTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom8To9() error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 9, strings.Replace(pgsqlUsersV9SQL, "{{users}}", config.UsersTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom9To10() error {
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 10, strings.Replace(pgsqlEventsRulesV10SQL, "{{events_rules}}",
+			sqlEventsRulesTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom10To11() error {
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 11, strings.Replace(pgsqlUserTemplatesV11SQL, "{{user_templates}}",
+			sqlUserTemplatesTable, 1))
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom11To12() error {
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 12, getDefenderV12Statements(pgsqlDefenderHostsV12SQL,
+			pgsqlDefenderEventsV12SQL)...)
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom12To13() error {
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 13, getActiveSessionsV13Statements(pgsqlActiveSessionsV13SQL)...)
+	})
+}
+
+func (p CockroachDBProvider) updateDatabaseFrom13To14() error {
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	return cockroachRetry("database migration", func() error {
+		return sqlCommonExecMigrationWithTX(p.dbHandle, 14, strings.Replace(pgsqlAdminsV14SQL, "{{admins}}", sqlAdminsTable, 1))
+	})
+}
@@ -32,12 +32,17 @@ import (
 	"time"
 
 	"github.com/alexedwards/argon2id"
+	"github.com/rs/xid"
 	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/ssh"
 
+	"github.com/drakkan/sftpgo/geoip"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/ldap"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/plugin"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 	unixcrypt "github.com/nathanaelle/password"
@@ -48,6 +53,8 @@ const (
 	SQLiteDataProviderName = "sqlite"
 	// PGSQLDataProviderName name for PostgreSQL database provider
 	PGSQLDataProviderName = "postgresql"
+	// CockroachDataProviderName name for CockroachDB database provider
+	CockroachDataProviderName = "cockroachdb"
 	// MySQLDataProviderName name for MySQL database provider
 	MySQLDataProviderName = "mysql"
 	// BoltDataProviderName name for bbolt key/value store provider
@@ -62,6 +69,7 @@ const (
 	pbkdf2SHA512Prefix       = "$pbkdf2-sha512$"
 	md5cryptPwdPrefix        = "$1$"
 	md5cryptApr1PwdPrefix    = "$apr1$"
+	sha256cryptPwdPrefix     = "$5$"
 	sha512cryptPwdPrefix     = "$6$"
 	manageUsersDisabledError = "please set manage_users to 1 in your configuration to enable this method"
 	trackQuotaDisabledError  = "please enable track_quota in your configuration to use this method"
@@ -70,28 +78,46 @@ const (
 	operationDelete          = "delete"
 )
 
+// Supported restore modes
+const (
+	// RestoreModeAddAndUpdate adds the new objects and updates the existing ones
+	RestoreModeAddAndUpdate = iota
+	// RestoreModeAddOnly adds the new objects, the existing ones are not modified
+	RestoreModeAddOnly
+)
+
 var (
 	// SupportedProviders data provider configured in the sftpgo.conf file must match of these strings
 	SupportedProviders = []string{SQLiteDataProviderName, PGSQLDataProviderName, MySQLDataProviderName,
-		BoltDataProviderName, MemoryDataProviderName}
+		BoltDataProviderName, MemoryDataProviderName, CockroachDataProviderName}
 	// ValidPerms list that contains all the valid permissions for an user
 	ValidPerms = []string{PermAny, PermListItems, PermDownload, PermUpload, PermOverwrite, PermRename, PermDelete,
 		PermCreateDirs, PermCreateSymlinks, PermChmod, PermChown, PermChtimes}
 	// ValidSSHLoginMethods list that contains all the valid SSH login methods
-	ValidSSHLoginMethods = []string{SSHLoginMethodPublicKey, SSHLoginMethodPassword, SSHLoginMethodKeyboardInteractive}
-	config               Config
-	provider             Provider
-	sqlPlaceholders      []string
-	hashPwdPrefixes      = []string{argonPwdPrefix, bcryptPwdPrefix, pbkdf2SHA1Prefix, pbkdf2SHA256Prefix,
-		pbkdf2SHA512Prefix, md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha512cryptPwdPrefix}
-	pbkdfPwdPrefixes       = []string{pbkdf2SHA1Prefix, pbkdf2SHA256Prefix, pbkdf2SHA512Prefix}
-	unixPwdPrefixes        = []string{md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha512cryptPwdPrefix}
+	ValidSSHLoginMethods = []string{SSHLoginMethodPublicKey, SSHLoginMethodPassword, SSHLoginMethodKeyboardInteractive,
+		SSHLoginMethodKeyAndPassword, SSHLoginMethodKeyAndKeyboardInt}
+	// SSHMultiStepsLoginMethods list that contains the SSH login methods requiring multiple authentication steps
+	SSHMultiStepsLoginMethods = []string{SSHLoginMethodKeyAndPassword, SSHLoginMethodKeyAndKeyboardInt}
+	config                    Config
+	provider                  Provider
+	sqlPlaceholders           []string
+	hashPwdPrefixes           = []string{argonPwdPrefix, bcryptPwdPrefix, "$2b$", "$2y$", pbkdf2SHA1Prefix,
+		pbkdf2SHA256Prefix, pbkdf2SHA512Prefix, md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha256cryptPwdPrefix,
+		sha512cryptPwdPrefix, pamPwdPrefix}
+	bcryptPwdPrefixes = []string{bcryptPwdPrefix, "$2b$", "$2y$"}
+	pbkdfPwdPrefixes  = []string{pbkdf2SHA1Prefix, pbkdf2SHA256Prefix, pbkdf2SHA512Prefix}
+	unixPwdPrefixes   = []string{md5cryptPwdPrefix, md5cryptApr1PwdPrefix, sha256cryptPwdPrefix,
+		sha512cryptPwdPrefix}
 	logSender              = "dataProvider"
 	availabilityTicker     *time.Ticker
 	availabilityTickerDone chan bool
 	errWrongPassword       = errors.New("password does not match")
 	errNoInitRequired      = errors.New("initialization is not required for this data provider")
+	errTOTPRequired        = errors.New("a TOTP authentication code is required, password only authentication is not allowed")
+	errInvalidTOTPCode     = errors.New("invalid TOTP authentication code")
 	credentialsDirPath     string
+	// serializes the checks and the updates of the admins second factor, a code cannot be used twice
+	adminSecondFactorLock sync.Mutex
 )
 
 type schemaVersion struct {
@@ -119,6 +145,10 @@ type Config struct {
 	// Database name. For driver sqlite this can be the database name relative to the config dir
 	// or the absolute path to the SQLite database.
 	Name string `json:"name" mapstructure:"name"`
+	// Interval, in seconds, for saving the data of the memory provider to the file defined by Name.
+	// The data are saved only if they changed and on shutdown. 0 means the file is only loaded,
+	// it is never modified
+	PersistInterval int `json:"persist_interval" mapstructure:"persist_interval"`
 	// Database host
 	Host string `json:"host" mapstructure:"host"`
 	// Database port
@@ -133,6 +163,16 @@ type Config struct {
 	// 2 set ssl mode to verify-ca for driver postgresql and skip-verify for driver mysql.
 	// 3 set ssl mode to verify-full for driver postgresql and preferred for driver mysql.
 	SSLMode int `json:"sslmode" mapstructure:"sslmode"`
+	// Path to the CA certificates bundle used to verify the database server certificate.
+	// Used for drivers mysql, postgresql and cockroachdb if SSL/TLS connections are enabled.
+	// The path can be absolute or relative to the config dir. Leave empty to use the system
+	// CA certificates
+	RootCert string `json:"root_cert" mapstructure:"root_cert"`
+	// Path to the client certificate and the matching private key, both PEM encoded, used for the
+	// TLS client authentication. The paths can be absolute or relative to the config dir.
+	// Leave empty to disable client certificate authentication
+	ClientCert string `json:"client_cert" mapstructure:"client_cert"`
+	ClientKey  string `json:"client_key" mapstructure:"client_key"`
 	// Custom database connection string.
 	// If not empty this connection string will be used instead of build one using the previous parameters
 	ConnectionString string `json:"connection_string" mapstructure:"connection_string"`
@@ -147,6 +187,12 @@ type Config struct {
 	//    With this configuration the "quota scan" REST API can still be used to periodically update space usage
 	//    for users without quota restrictions
 	TrackQuota int `json:"track_quota" mapstructure:"track_quota"`
+	// Interval, in seconds, for writing the quota changes to the data provider. The changes are
+	// aggregated in memory and written using a single update for each user, this reduces the provider
+	// writes for servers handling many small files. The pending changes are included when the quota
+	// is checked, they are lost if the process is killed, a quota scan will fix the used quota.
+	// 0 means that the quota is updated after each upload or delete
+	DelayedQuotaUpdate int `json:"delayed_quota_update" mapstructure:"delayed_quota_update"`
 	// Sets the maximum number of open connections for mysql and postgresql driver.
 	// Default 0 (unlimited)
 	PoolSize int `json:"pool_size" mapstructure:"pool_size"`
@@ -158,31 +204,41 @@ type Config struct {
 	// Actions to execute on user add, update, delete.
 	// Update action will not be fired for internal updates such as the last login or the user quota fields.
 	Actions Actions `json:"actions" mapstructure:"actions"`
-	// Absolute path to an external program to use for users authentication. Leave empty to use builtin
-	// authentication.
+	// Deprecated: please use ExternalAuthHook
+	ExternalAuthProgram string `json:"external_auth_program" mapstructure:"external_auth_program"`
+	// Absolute path to an external program or an HTTP URL to use for users authentication.
+	// Leave empty to use builtin authentication.
 	// The external program can read the following environment variables to get info about the user trying
 	// to authenticate:
 	//
 	// - SFTPGO_AUTHD_USERNAME
+	// - SFTPGO_AUTHD_IP
 	// - SFTPGO_AUTHD_PASSWORD, not empty for password authentication
 	// - SFTPGO_AUTHD_PUBLIC_KEY, not empty for public key authentication
+	// - SFTPGO_AUTHD_KEYBOARD_INTERACTIVE, not empty for keyboard interactive authentication
 	//
 	// The content of these variables is _not_ quoted. They may contain special characters. They are under the
 	// control of a possibly malicious remote user.
 	//
 	// The program must respond on the standard output with a valid SFTPGo user serialized as JSON if the
 	// authentication succeed or an user with an empty username if the authentication fails.
+	//
+	// If the hook is an HTTP URL, it will be invoked as HTTP POST. The request body will contain a JSON
+	// serialized struct with the following fields: "username", "ip", "password", "public_key" and
+	// "keyboard_interactive". A 200 response code is expected with the same response body of the
+	// external program.
+	//
 	// If the authentication succeed the user will be automatically added/updated inside the defined data provider.
 	// Actions defined for user added/updated will not be executed in this case.
-	// The external program should check authentication only, if there are login restrictions such as user
+	// The external hook should check authentication only, if there are login restrictions such as user
 	// disabled, expired, login allowed only from specific IP addresses it is enough to populate the matching user
 	// fields and these conditions will be checked in the same way as for builtin users.
-	// The external auth program must finish within 60 seconds.
+	// The external auth hook must respond within 60 seconds.
 	// This method is slower than built-in authentication methods, but it's very flexible as anyone can
-	// easily write his own authentication programs.
-	ExternalAuthProgram string `json:"external_auth_program" mapstructure:"external_auth_program"`
-	// ExternalAuthScope defines the scope for the external authentication program.
-	// - 0 means all supported authetication scopes, the external program will be used for password,
+	// easily write his own authentication hooks.
+	ExternalAuthHook string `json:"external_auth_hook" mapstructure:"external_auth_hook"`
+	// ExternalAuthScope defines the scope for the external authentication hook.
+	// - 0 means all supported authetication scopes, the external hook will be used for password,
 	//     public key and keyboard interactive authentication
 	// - 1 means passwords only
 	// - 2 means public keys only
@@ -190,19 +246,36 @@ type Config struct {
 	// you can combine the scopes, for example 3 means password and public key, 5 password and keyboard
 	// interactive and so on
 	ExternalAuthScope int `json:"external_auth_scope" mapstructure:"external_auth_scope"`
+	// LDAP defines the built-in LDAP authentication. If enabled, the passwords are verified against the
+	// LDAP server and the resolved users are automatically added/updated inside the defined data provider,
+	// as for the external authentication. The external auth hook, if defined for passwords, has precedence
+	LDAP ldap.Config `json:"ldap" mapstructure:"ldap"`
+	// PAM defines the PAM authentication for passwords, it is supported on Linux only.
+	// The passwords of the PAM users are not stored inside the data provider
+	PAM PAMConfig `json:"pam" mapstructure:"pam"`
+	// PasswordHashing defines the parameters for the password hashing
+	PasswordHashing PasswordHashing `json:"password_hashing" mapstructure:"password_hashing"`
+	// PasswordExpiration defines the maximum password age as number of days. After this time the
+	// password logins are rejected until the password is changed. The users can override this value
+	// using the password expiration filter. 0 means no expiration
+	PasswordExpiration int `json:"password_expiration" mapstructure:"password_expiration"`
 	// CredentialsPath defines the directory for storing user provided credential files such as
 	// Google Cloud Storage credentials. It can be a path relative to the config dir or an
 	// absolute path
 	CredentialsPath string `json:"credentials_path" mapstructure:"credentials_path"`
-	// Absolute path to an external program to start just before the user login.
-	// This program will be started before an existing user try to login and allows to
-	// modify the user.
+	// Deprecated: please use PreLoginHook
+	PreLoginProgram string `json:"pre_login_program" mapstructure:"pre_login_program"`
+	// Absolute path to an external program or an HTTP URL to invoke just before the user login.
+	// This hook will be invoked before the credentials check and allows to create or modify
+	// the user.
 	// It is useful if you have users with dynamic fields that need to the updated just
-	// before the login.
+	// before the login or if you want to create the users on the fly.
 	// The external program can read the following environment variables:
 	//
-	// - SFTPGO_LOGIND_USER, it contains the user trying to login serialized as JSON
+	// - SFTPGO_LOGIND_USER, it contains the user trying to login serialized as JSON. The user has
+	//   only the username and an ID equal to 0 if it does not exist inside the data provider
 	// - SFTPGO_LOGIND_METHOD, possible values are: "password", "publickey" and "keyboard-interactive"
+	// - SFTPGO_LOGIND_IP, the client IP address
 	//
 	// The program must respond on the standard output with an empty string if no user
 	// update is needed or with a valid SFTPGo user serialized as JSON.
@@ -212,17 +285,57 @@ type Config struct {
 	//
 	// {"status":0}
 	//
-	// The external program must finish within 60 seconds.
+	// If the hook is an HTTP URL, it will be invoked as HTTP POST. The login method and the
+	// IP address are added to the query string as "login_method" and "ip", the request body
+	// is the user serialized as JSON. A 200 HTTP status code is expected, with the same response
+	// body of the external program, or 204 if no user update is needed.
 	//
-	// If an error happens while executing the "PreLoginProgram" then login will be denied.
-	// PreLoginProgram and ExternalAuthProgram are mutally exclusive.
+	// The external hook must respond within 60 seconds.
+	//
+	// If an error happens while executing the "PreLoginHook" then login will be denied.
+	// PreLoginHook and ExternalAuthHook are mutally exclusive.
 	// Leave empty to disable.
-	PreLoginProgram string `json:"pre_login_program" mapstructure:"pre_login_program"`
+	PreLoginHook string `json:"pre_login_hook" mapstructure:"pre_login_hook"`
+	// Absolute path to an external program or an HTTP URL to invoke after the user login.
+	// The hook is executed asynchronously and its result is ignored, it is useful to notify
+	// external systems, for example a SIEM, about the login attempts.
+	// The external program can read the following environment variables:
+	//
+	// - SFTPGO_LOGIND_USERNAME
+	// - SFTPGO_LOGIND_IP, the client IP address
+	// - SFTPGO_LOGIND_METHOD, possible values are: "password", "publickey", "keyboard-interactive",
+	//   "publickey+password" and "publickey+keyboard-interactive"
+	// - SFTPGO_LOGIND_PROTOCOL, possible values are: "SSH", "FTP", "DAV" and "HTTP"
+	// - SFTPGO_LOGIND_STATUS, 1 means successful login, 0 failed login
+	//
+	// If the hook is an HTTP URL, it will be invoked as HTTP POST, the request body will contain
+	// a JSON serialized struct with the following fields: "username", "ip", "login_method",
+	// "protocol" and "status".
+	//
+	// The external program must finish within 20 seconds.
+	// Leave empty to disable.
+	PostLoginHook string `json:"post_login_hook" mapstructure:"post_login_hook"`
+	// PostLoginScope defines the scope for the post login hook.
+	// - 0 means notify both failed and successful logins
+	// - 1 means notify failed logins
+	// - 2 means notify successful logins
+	PostLoginScope int `json:"post_login_scope" mapstructure:"post_login_scope"`
+	// Set to true to register the active sessions inside the data provider, so the max sessions
+	// limit is enforced for all the instances sharing the same data provider. Each instance
+	// periodically updates the heartbeat for its sessions, the sessions without a recent
+	// heartbeat are considered stale and removed
+	SharedSessions bool `json:"shared_sessions" mapstructure:"shared_sessions"`
 }
 
 // BackupData defines the structure for the backup/restore files
 type BackupData struct {
-	Users []User `json:"users"`
+	Users         []User         `json:"users"`
+	Groups        []Group        `json:"groups"`
+	Admins        []Admin        `json:"admins"`
+	APIKeys       []APIKey       `json:"api_keys"`
+	Shares        []Share        `json:"shares"`
+	EventRules    []EventRule    `json:"event_rules"`
+	UserTemplates []UserTemplate `json:"user_templates"`
 }
 
 type keyboardAuthProgramResponse struct {
@@ -233,6 +346,31 @@ type keyboardAuthProgramResponse struct {
 	CheckPwd    int      `json:"check_password"`
 }
 
+type keyboardAuthHookRequest struct {
+	RequestID string   `json:"request_id"`
+	Username  string   `json:"username,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	Password  string   `json:"password,omitempty"`
+	Answers   []string `json:"answers,omitempty"`
+	Questions []string `json:"questions,omitempty"`
+}
+
+type postLoginNotification struct {
+	Username    string `json:"username"`
+	IP          string `json:"ip"`
+	LoginMethod string `json:"login_method"`
+	Protocol    string `json:"protocol"`
+	Status      int    `json:"status"`
+}
+
+type externalAuthRequest struct {
+	Username            string `json:"username"`
+	IP                  string `json:"ip"`
+	Password            string `json:"password,omitempty"`
+	PublicKey           string `json:"public_key,omitempty"`
+	KeyboardInteractive string `json:"keyboard_interactive,omitempty"`
+}
+
 // ValidationError raised if input data is not valid
 type ValidationError struct {
 	err string
@@ -274,12 +412,19 @@ func GetQuotaTracking() int {
 	return config.TrackQuota
 }
 
+// IsSharedSessionsEnabled returns true if the active sessions must be registered inside the data provider
+func IsSharedSessionsEnabled() bool {
+	return config.SharedSessions
+}
+
 // Provider interface that data providers must implement.
 type Provider interface {
 	validateUserAndPass(username string, password string) (User, error)
 	validateUserAndPubKey(username string, pubKey string) (User, string, error)
 	updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error
 	getUsedQuota(username string) (int, int64, error)
+	updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error
+	getUsedDataTransfer(username string) (int64, int64, int64, error)
 	userExists(username string) (User, error)
 	addUser(user User) error
 	updateUser(user User) error
@@ -288,6 +433,61 @@ type Provider interface {
 	dumpUsers() ([]User, error)
 	getUserByID(ID int64) (User, error)
 	updateLastLogin(username string) error
+	updateUserPassword(username, password string) error
+	groupExists(name string) (Group, error)
+	addGroup(group Group) error
+	updateGroup(group Group) error
+	deleteGroup(group Group) error
+	getGroups(limit int, offset int, order string, name string) ([]Group, error)
+	dumpGroups() ([]Group, error)
+	getGroupByID(ID int64) (Group, error)
+	adminExists(username string) (Admin, error)
+	addAdmin(admin Admin) error
+	updateAdmin(admin Admin) error
+	updateAdminPassword(username, password string) error
+	deleteAdmin(admin Admin) error
+	getAdmins(limit int, offset int, order string, username string) ([]Admin, error)
+	dumpAdmins() ([]Admin, error)
+	getAdminByID(ID int64) (Admin, error)
+	apiKeyExists(keyID string) (APIKey, error)
+	addAPIKey(key APIKey) error
+	updateAPIKeyLastUse(keyID string) error
+	deleteAPIKey(key APIKey) error
+	getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error)
+	dumpAPIKeys() ([]APIKey, error)
+	shareExists(shareID string) (Share, error)
+	addShare(share Share) error
+	updateShareUsage(shareID string, numTokens int) error
+	deleteShare(share Share) error
+	getShares(limit int, offset int, order string, username string) ([]Share, error)
+	dumpShares() ([]Share, error)
+	eventRuleExists(name string) (EventRule, error)
+	addEventRule(rule EventRule) error
+	updateEventRule(rule EventRule) error
+	deleteEventRule(rule EventRule) error
+	getEventRules(limit int, offset int, order string, name string) ([]EventRule, error)
+	dumpEventRules() ([]EventRule, error)
+	getEventRuleByID(ID int64) (EventRule, error)
+	userTemplateExists(name string) (UserTemplate, error)
+	addUserTemplate(template UserTemplate) error
+	updateUserTemplate(template UserTemplate) error
+	deleteUserTemplate(template UserTemplate) error
+	getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error)
+	dumpUserTemplates() ([]UserTemplate, error)
+	getUserTemplateByID(ID int64) (UserTemplate, error)
+	addDefenderEvent(ip string, score int) error
+	isDefenderHostBanned(ip string) (DefenderEntry, error)
+	getDefenderHostByIP(ip string, from int64) (DefenderEntry, error)
+	getDefenderHosts(from int64, limit int) ([]DefenderEntry, error)
+	setDefenderBanTime(ip string, banTime int64) error
+	updateDefenderBanTime(ip string, minutes int) error
+	deleteDefenderHost(ip string) error
+	cleanupDefender(from int64) error
+	addActiveSession(session ActiveSession) error
+	deleteActiveSession(nodeID, connectionID string) error
+	updateActiveSessionsHeartbeat(nodeID string) error
+	getActiveSessionsCount(username string, from int64) (int, error)
+	cleanupActiveSessions(before int64) error
 	checkAvailability() error
 	close() error
 	reloadConfig() error
@@ -306,26 +506,78 @@ func Initialize(cnf Config, basePath string) error {
 	config = cnf
 	sqlPlaceholders = getSQLPlaceholders()
 
-	if len(config.ExternalAuthProgram) > 0 {
-		if !filepath.IsAbs(config.ExternalAuthProgram) {
-			return fmt.Errorf("invalid external auth program: %#v must be an absolute path", config.ExternalAuthProgram)
+	if len(config.ExternalAuthHook) == 0 && len(config.ExternalAuthProgram) > 0 {
+		providerLog(logger.LevelWarn, "external_auth_program is deprecated, please use external_auth_hook")
+		config.ExternalAuthHook = config.ExternalAuthProgram
+	}
+	if len(config.ExternalAuthHook) > 0 {
+		if strings.HasPrefix(config.ExternalAuthHook, "http") {
+			if err := validateHookURL(config.ExternalAuthHook); err != nil {
+				return fmt.Errorf("invalid external auth hook: %v", err)
+			}
+		} else {
+			if !filepath.IsAbs(config.ExternalAuthHook) {
+				return fmt.Errorf("invalid external auth hook: %#v must be an absolute path", config.ExternalAuthHook)
+			}
+			_, err := os.Stat(config.ExternalAuthHook)
+			if err != nil {
+				providerLog(logger.LevelWarn, "invalid external auth hook: %v", err)
+				return err
+			}
 		}
-		_, err := os.Stat(config.ExternalAuthProgram)
-		if err != nil {
-			providerLog(logger.LevelWarn, "invalid external auth program: %v", err)
-			return err
+	}
+	if config.LDAP.IsEnabled() {
+		if err := config.LDAP.Validate(); err != nil {
+			return fmt.Errorf("invalid LDAP configuration: %v", err)
 		}
 	}
-	if len(config.PreLoginProgram) > 0 {
-		if !filepath.IsAbs(config.PreLoginProgram) {
-			return fmt.Errorf("invalid pre login program: %#v must be an absolute path", config.PreLoginProgram)
+	if err := initializePasswordHashing(config.PasswordHashing); err != nil {
+		return fmt.Errorf("invalid password hashing configuration: %v", err)
+	}
+	if config.PAM.IsEnabled() {
+		if err := config.PAM.validate(); err != nil {
+			return fmt.Errorf("invalid PAM configuration: %v", err)
 		}
-		_, err := os.Stat(config.PreLoginProgram)
-		if err != nil {
-			providerLog(logger.LevelWarn, "invalid pre login program: %v", err)
-			return err
+	}
+	if len(config.PreLoginHook) == 0 && len(config.PreLoginProgram) > 0 {
+		providerLog(logger.LevelWarn, "pre_login_program is deprecated, please use pre_login_hook")
+		config.PreLoginHook = config.PreLoginProgram
+	}
+	if len(config.PreLoginHook) > 0 {
+		if strings.HasPrefix(config.PreLoginHook, "http") {
+			if err := validateHookURL(config.PreLoginHook); err != nil {
+				return fmt.Errorf("invalid pre login hook: %v", err)
+			}
+		} else {
+			if !filepath.IsAbs(config.PreLoginHook) {
+				return fmt.Errorf("invalid pre login hook: %#v must be an absolute path", config.PreLoginHook)
+			}
+			_, err := os.Stat(config.PreLoginHook)
+			if err != nil {
+				providerLog(logger.LevelWarn, "invalid pre login hook: %v", err)
+				return err
+			}
+		}
+	}
+	if len(config.PostLoginHook) > 0 {
+		if strings.HasPrefix(config.PostLoginHook, "http") {
+			if err := validateHookURL(config.PostLoginHook); err != nil {
+				return fmt.Errorf("invalid post login hook: %v", err)
+			}
+		} else {
+			if !filepath.IsAbs(config.PostLoginHook) {
+				return fmt.Errorf("invalid post login hook: %#v must be an absolute path", config.PostLoginHook)
+			}
+			_, err := os.Stat(config.PostLoginHook)
+			if err != nil {
+				providerLog(logger.LevelWarn, "invalid post login hook: %v", err)
+				return err
+			}
 		}
 	}
+	if config.DelayedQuotaUpdate < 0 {
+		return fmt.Errorf("invalid delayed_quota_update: %v", config.DelayedQuotaUpdate)
+	}
 	if err = validateCredentialsDir(basePath); err != nil {
 		return err
 	}
@@ -339,6 +591,9 @@ func Initialize(cnf Config, basePath string) error {
 		return err
 	}
 	startAvailabilityTimer()
+	if config.DelayedQuotaUpdate > 0 && config.TrackQuota > 0 {
+		delayedQuota.start(time.Duration(config.DelayedQuotaUpdate) * time.Second)
+	}
 	return nil
 }
 
@@ -357,60 +612,133 @@ func InitializeDatabase(cnf Config, basePath string) error {
 	return provider.initializeDatabase()
 }
 
-// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error
-func CheckUserAndPass(p Provider, username string, password string) (User, error) {
-	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
-		user, err := doExternalAuth(username, password, "", "")
-		if err != nil {
-			return user, err
+// CheckUserAndPass retrieves the SFTP user with the given username and password if a match is found or an error.
+// ip is the client IP address, it is passed to the external authentication hook, if any
+// Users with a TOTP secret cannot authenticate using only the password
+func CheckUserAndPass(p Provider, username, password, ip string) (User, error) {
+	var user User
+	var err error
+	if plugin.Handler.HasAuthScope(plugin.AuthScopePassword) {
+		user, err = doPluginAuth(username, password, "", ip, plugin.AuthScopePassword)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
 		}
-		return checkUserAndPass(user, password)
-	}
-	if len(config.PreLoginProgram) > 0 {
-		user, err := executePreLoginProgram(username, SSHLoginMethodPassword)
-		if err != nil {
-			return user, err
+	} else if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&1 != 0) {
+		user, err = doExternalAuth(username, password, "", "", ip)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
+		}
+	} else if config.LDAP.IsEnabled() {
+		user, err = doLDAPAuth(username, password)
+		if err == nil {
+			user, err = checkUserAndPass(user, password)
+		}
+	} else if len(config.PreLoginHook) > 0 {
+		user, err = executePreLoginHook(username, SSHLoginMethodPassword, ip)
+		if err == nil {
+			user, err = checkUserAndPassOrPAM(user, password, ip)
 		}
-		return checkUserAndPass(user, password)
+	} else if config.PAM.IsEnabled() {
+		user, err = doPAMAuth(username, password, ip)
+	} else {
+		user, err = p.validateUserAndPass(username, password)
+	}
+	if err == nil && user.HasTOTPSecret() {
+		providerLog(logger.LevelInfo, "password only authentication denied for user %#v, a TOTP code is required",
+			username)
+		return user, errTOTPRequired
+	}
+	if err != nil {
+		return user, err
 	}
-	return p.validateUserAndPass(username, password)
+	upgradeUserPasswordHash(&user, password)
+	return applyUserGroupsAndSession(p, user)
 }
 
-// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error
-func CheckUserAndPubKey(p Provider, username string, pubKey string) (User, string, error) {
-	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&2 != 0) {
-		user, err := doExternalAuth(username, "", pubKey, "")
-		if err != nil {
-			return user, "", err
+// CheckUserAndPubKey retrieves the SFTP user with the given username and public key if a match is found or an error.
+// ip is the client IP address, it is passed to the external authentication hook, if any
+func CheckUserAndPubKey(p Provider, username, pubKey, ip string) (User, string, error) {
+	var user User
+	var keyID string
+	var err error
+	if plugin.Handler.HasAuthScope(plugin.AuthScopePublicKey) {
+		user, err = doPluginAuth(username, "", pubKey, ip, plugin.AuthScopePublicKey)
+		if err == nil {
+			user, keyID, err = checkUserAndPubKey(user, pubKey)
 		}
-		return checkUserAndPubKey(user, pubKey)
-	}
-	if len(config.PreLoginProgram) > 0 {
-		user, err := executePreLoginProgram(username, SSHLoginMethodPublicKey)
-		if err != nil {
-			return user, "", err
+	} else if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&2 != 0) {
+		user, err = doExternalAuth(username, "", pubKey, "", ip)
+		if err == nil {
+			user, keyID, err = checkUserAndPubKey(user, pubKey)
+		}
+	} else if len(config.PreLoginHook) > 0 {
+		user, err = executePreLoginHook(username, SSHLoginMethodPublicKey, ip)
+		if err == nil {
+			user, keyID, err = checkUserAndPubKey(user, pubKey)
 		}
-		return checkUserAndPubKey(user, pubKey)
+	} else {
+		user, keyID, err = p.validateUserAndPubKey(username, pubKey)
+	}
+	if err != nil {
+		return user, "", err
+	}
+	user, err = applyUserGroupsAndSession(p, user)
+	return user, keyID, err
+}
+
+// CheckUserAndCert retrieves the SFTP user with the given username for a login with an SSH user
+// certificate, the certificate must be already validated against the trusted CA keys.
+// The public keys configured for the user are not checked
+func CheckUserAndCert(p Provider, username string, cert *ssh.Certificate, ip string) (User, string, error) {
+	var user User
+	var err error
+	if len(config.PreLoginHook) > 0 {
+		user, err = executePreLoginHook(username, SSHLoginMethodPublicKey, ip)
+	} else {
+		user, err = p.userExists(username)
+	}
+	if err != nil {
+		return user, "", err
+	}
+	if err = checkLoginConditions(user); err != nil {
+		return user, "", err
 	}
-	return p.validateUserAndPubKey(username, pubKey)
+	certID := fmt.Sprintf("%v: ID: %#v, serial: %v, CA: %v", ssh.FingerprintSHA256(cert.Key), cert.KeyId,
+		cert.Serial, ssh.FingerprintSHA256(cert.SignatureKey))
+	user.sessionOverrides.add(getSessionOverridesFromCert(cert))
+	user, err = applyUserGroupsAndSession(p, user)
+	return user, certID, err
 }
 
 // CheckKeyboardInteractiveAuth checks the keyboard interactive authentication and returns
 // the authenticated user or an error
-func CheckKeyboardInteractiveAuth(p Provider, username, authProgram string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+func CheckKeyboardInteractiveAuth(p Provider, username, authHook string, client ssh.KeyboardInteractiveChallenge,
+	ip string) (User, error) {
 	var user User
 	var err error
-	if len(config.ExternalAuthProgram) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&4 != 0) {
-		user, err = doExternalAuth(username, "", "", "1")
-	} else if len(config.PreLoginProgram) > 0 {
-		user, err = executePreLoginProgram(username, SSHLoginMethodKeyboardInteractive)
+	if plugin.Handler.HasAuthScope(plugin.AuthScopeKeyboardInteractive) {
+		user, err = doPluginAuth(username, "", "", ip, plugin.AuthScopeKeyboardInteractive)
+	} else if len(config.ExternalAuthHook) > 0 && (config.ExternalAuthScope == 0 || config.ExternalAuthScope&4 != 0) {
+		user, err = doExternalAuth(username, "", "", "1", ip)
+	} else if len(config.PreLoginHook) > 0 {
+		user, err = executePreLoginHook(username, SSHLoginMethodKeyboardInteractive, ip)
 	} else {
 		user, err = p.userExists(username)
 	}
 	if err != nil {
 		return user, err
 	}
-	return doKeyboardInteractiveAuth(user, authProgram, client)
+	if user.HasTOTPSecret() {
+		user, err = doTOTPKeyboardInteractiveAuth(user, client)
+	} else if len(authHook) == 0 {
+		return user, errors.New("keyboard interactive authentication is not available for this user")
+	} else {
+		user, err = doKeyboardInteractiveAuth(user, authHook, client, ip)
+	}
+	if err != nil {
+		return user, err
+	}
+	return applyUserGroupsAndSession(p, user)
 }
 
 // UpdateLastLogin updates the last login fields for the given SFTP user
@@ -432,16 +760,107 @@ func UpdateUserQuota(p Provider, user User, filesAdd int, sizeAdd int64, reset b
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if config.DelayedQuotaUpdate > 0 {
+		if !reset {
+			delayedQuota.add(user.Username, filesAdd, sizeAdd)
+			return nil
+		}
+		return delayedQuota.setQuota(p, user.Username, filesAdd, sizeAdd)
+	}
 	return p.updateQuota(user.Username, filesAdd, sizeAdd, reset)
 }
 
-// GetUsedQuota returns the used quota for the given SFTP user.
-// TrackQuota must be >=1 to enable this method
+// UpdateUserQuotaForRename updates the quota for the given SFTP user after renaming a file
+// of the given size. The quota changes only if the file is moved from or to a virtual folder
+// excluded from the user quota. sourcePath and targetPath are filesystem paths
+func UpdateUserQuotaForRename(p Provider, user User, sourcePath, targetPath string, size int64) error {
+	sourceExcluded := user.IsFileExcludedFromQuota(sourcePath)
+	targetExcluded := user.IsFileExcludedFromQuota(targetPath)
+	if sourceExcluded == targetExcluded {
+		return nil
+	}
+	if sourceExcluded {
+		return UpdateUserQuota(p, user, 1, size, false)
+	}
+	return UpdateUserQuota(p, user, -1, -size, false)
+}
+
+// GetUsedQuota returns the used quota for the given SFTP user, including the delayed changes
+// not yet written to the data provider. TrackQuota must be >=1 to enable this method
 func GetUsedQuota(p Provider, username string) (int, int64, error) {
 	if config.TrackQuota == 0 {
 		return 0, 0, &MethodDisabledError{err: trackQuotaDisabledError}
 	}
-	return p.getUsedQuota(username)
+	numFiles, size, err := p.getUsedQuota(username)
+	if err != nil || config.DelayedQuotaUpdate == 0 {
+		return numFiles, size, err
+	}
+	pendingFiles, pendingSize := delayedQuota.get(username)
+	return numFiles + pendingFiles, size + pendingSize, nil
+}
+
+// GetUsedDataTransfer returns the data transfer, as bytes, uploaded and downloaded by the given SFTP user.
+// If the data transfer must be reset monthly and the last reset is before the start of the current month
+// the used data transfer is reset
+func GetUsedDataTransfer(p Provider, user User) (int64, int64, error) {
+	uploaded, downloaded, lastReset, err := p.getUsedDataTransfer(user.Username)
+	if err != nil {
+		return 0, 0, err
+	}
+	if user.DataTransferReset == DataTransferResetMonthly {
+		now := time.Now().UTC()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		if lastReset < utils.GetTimeAsMsSinceEpoch(monthStart) {
+			if config.ManageUsers == 0 {
+				return 0, 0, &MethodDisabledError{err: manageUsersDisabledError}
+			}
+			providerLog(logger.LevelDebug, "monthly data transfer reset for user %#v, uploaded: %v downloaded: %v",
+				user.Username, uploaded, downloaded)
+			return 0, 0, p.updateDataTransfer(user.Username, 0, 0, true)
+		}
+	}
+	return uploaded, downloaded, nil
+}
+
+// GetRemainingDataTransfer returns the data transfer, as bytes, still allowed for uploads or downloads
+// for the given SFTP user. -1 means no limit, 0 means that the data transfer quota is exceeded
+func GetRemainingDataTransfer(p Provider, user User, isUpload bool) (int64, error) {
+	limit := user.DownloadDataTransfer
+	if isUpload {
+		limit = user.UploadDataTransfer
+	}
+	if limit <= 0 {
+		return -1, nil
+	}
+	uploaded, downloaded, err := GetUsedDataTransfer(p, user)
+	if err != nil {
+		return 0, err
+	}
+	used := downloaded
+	if isUpload {
+		used = uploaded
+	}
+	remaining := limit*1048576 - used
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, nil
+}
+
+// UpdateUserDataTransfer adds uploadAdd and downloadAdd bytes to the data transfer used by the given SFTP user.
+// The data transfer is tracked only for users with data transfer restrictions
+func UpdateUserDataTransfer(p Provider, user User, uploadAdd, downloadAdd int64) error {
+	if !user.HasDataTransferRestrictions() || (uploadAdd == 0 && downloadAdd == 0) {
+		return nil
+	}
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	// reset the data transfer, if needed, before adding the new values
+	if _, _, err := GetUsedDataTransfer(p, user); err != nil {
+		return err
+	}
+	return p.updateDataTransfer(user.Username, uploadAdd, downloadAdd, false)
 }
 
 // UserExists checks if the given SFTP username exists, returns an error if no match is found
@@ -449,12 +868,26 @@ func UserExists(p Provider, username string) (User, error) {
 	return p.userExists(username)
 }
 
+// GetUserWithGroupSettings returns the user with the given username and the settings
+// inherited from its groups applied
+func GetUserWithGroupSettings(p Provider, username string) (User, error) {
+	user, err := p.userExists(username)
+	if err != nil {
+		return user, err
+	}
+	return applyUserGroups(p, user)
+}
+
 // AddUser adds a new SFTP user.
 // ManageUsers configuration must be set to 1 to enable this method
 func AddUser(p Provider, user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if err := validateUserGroups(p, &user); err != nil {
+		return err
+	}
+	setLastPasswordChange(&user, nil)
 	err := p.addUser(user)
 	if err == nil {
 		go executeAction(operationAdd, user)
@@ -468,6 +901,12 @@ func UpdateUser(p Provider, user User) error {
 	if config.ManageUsers == 0 {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
+	if err := validateUserGroups(p, &user); err != nil {
+		return err
+	}
+	if u, err := p.userExists(user.Username); err == nil {
+		setLastPasswordChange(&user, &u)
+	}
 	err := p.updateUser(user)
 	if err == nil {
 		go executeAction(operationUpdate, user)
@@ -482,10 +921,23 @@ func DeleteUser(p Provider, user User) error {
 		return &MethodDisabledError{err: manageUsersDisabledError}
 	}
 	err := p.deleteUser(user)
-	if err == nil {
-		go executeAction(operationDelete, user)
+	if err != nil {
+		return err
 	}
-	return err
+	delayedQuota.reset(user.Username)
+	go executeAction(operationDelete, user)
+	shares, err := p.dumpShares()
+	if err != nil {
+		return err
+	}
+	for _, share := range shares {
+		if share.Username == user.Username {
+			if err = p.deleteShare(share); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 // DumpUsers returns an array with all users including their hashed password
@@ -493,111 +945,835 @@ func DumpUsers(p Provider) ([]User, error) {
 	return p.dumpUsers()
 }
 
-// ReloadConfig reloads provider configuration.
-// Currently only implemented for memory provider, allows to reload the users
-// from the configured file, if defined
-func ReloadConfig() error {
-	return provider.reloadConfig()
+// GroupExists returns the group with the given name, returns an error if no match is found
+func GroupExists(p Provider, name string) (Group, error) {
+	return p.groupExists(name)
 }
 
-// GetUsers returns an array of users respecting limit and offset and filtered by username exact match if not empty
-func GetUsers(p Provider, limit int, offset int, order string, username string) ([]User, error) {
-	return p.getUsers(limit, offset, order, username)
+// AddGroup adds a new group.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.addGroup(group)
 }
 
-// GetUserByID returns the user with the given database ID if a match is found or an error
-func GetUserByID(p Provider, ID int64) (User, error) {
-	return p.getUserByID(ID)
+// UpdateGroup updates an existing group, the new settings apply to the next logins of its members.
+// ManageUsers configuration must be set to 1 to enable this method
+func UpdateGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	return p.updateGroup(group)
 }
 
-// GetProviderStatus returns an error if the provider is not available
-func GetProviderStatus(p Provider) error {
-	return p.checkAvailability()
+// DeleteGroup deletes an existing group, a group cannot be deleted while users belong to it.
+// ManageUsers configuration must be set to 1 to enable this method
+func DeleteGroup(p Provider, group Group) error {
+	if config.ManageUsers == 0 {
+		return &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	users, err := p.dumpUsers()
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if utils.IsStringInSlice(group.Name, user.Groups) {
+			return &ValidationError{err: fmt.Sprintf("group %#v is in use by user %#v", group.Name, user.Username)}
+		}
+	}
+	return p.deleteGroup(group)
 }
 
-// Close releases all provider resources.
-// This method is used in test cases.
-// Closing an uninitialized provider is not supported
-func Close(p Provider) error {
-	availabilityTicker.Stop()
-	availabilityTickerDone <- true
-	return p.close()
+// DumpGroups returns an array with all groups
+func DumpGroups(p Provider) ([]Group, error) {
+	return p.dumpGroups()
 }
 
-func createProvider(basePath string) error {
-	var err error
-	if config.Driver == SQLiteDataProviderName {
-		err = initializeSQLiteProvider(basePath)
-	} else if config.Driver == PGSQLDataProviderName {
-		err = initializePGSQLProvider()
-	} else if config.Driver == MySQLDataProviderName {
-		err = initializeMySQLProvider()
-	} else if config.Driver == BoltDataProviderName {
-		err = initializeBoltProvider(basePath)
-	} else if config.Driver == MemoryDataProviderName {
-		err = initializeMemoryProvider(basePath)
-	} else {
-		err = fmt.Errorf("unsupported data provider: %v", config.Driver)
-	}
-	return err
+// GetGroups returns an array of groups respecting limit and offset and filtered by name exact match if not empty
+func GetGroups(p Provider, limit int, offset int, order string, name string) ([]Group, error) {
+	return p.getGroups(limit, offset, order, name)
 }
 
-func buildUserHomeDir(user *User) {
-	if len(user.HomeDir) == 0 {
-		if len(config.UsersBaseDir) > 0 {
-			user.HomeDir = filepath.Join(config.UsersBaseDir, user.Username)
-		}
-	}
+// GetGroupByID returns the group with the given database ID if a match is found or an error
+func GetGroupByID(p Provider, ID int64) (Group, error) {
+	return p.getGroupByID(ID)
 }
 
-func isVirtualDirOverlapped(dir1, dir2 string) bool {
-	if dir1 == dir2 {
-		return true
-	}
-	if len(dir1) > len(dir2) {
-		if strings.HasPrefix(dir1, dir2+"/") {
-			return true
-		}
-	}
-	if len(dir2) > len(dir1) {
-		if strings.HasPrefix(dir2, dir1+"/") {
-			return true
-		}
-	}
-	return false
+// EventRuleExists returns the event rule with the given name, returns an error if no match is found
+func EventRuleExists(p Provider, name string) (EventRule, error) {
+	return p.eventRuleExists(name)
 }
 
-func isMappedDirOverlapped(dir1, dir2 string) bool {
-	if dir1 == dir2 {
-		return true
-	}
-	if len(dir1) > len(dir2) {
-		if strings.HasPrefix(dir1, dir2+string(os.PathSeparator)) {
-			return true
-		}
-	}
-	if len(dir2) > len(dir1) {
-		if strings.HasPrefix(dir2, dir1+string(os.PathSeparator)) {
-			return true
-		}
-	}
-	return false
+// AddEventRule adds a new event rule
+func AddEventRule(p Provider, rule EventRule) error {
+	return p.addEventRule(rule)
 }
 
-func validateVirtualFolders(user *User) error {
-	if len(user.VirtualFolders) == 0 || user.FsConfig.Provider != 0 {
-		user.VirtualFolders = []vfs.VirtualFolder{}
-		return nil
-	}
-	var virtualFolders []vfs.VirtualFolder
-	mappedPaths := make(map[string]string)
-	for _, v := range user.VirtualFolders {
-		cleanedVPath := filepath.ToSlash(path.Clean(v.VirtualPath))
-		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
-			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v", v.VirtualPath)}
-		}
-		cleanedMPath := filepath.Clean(v.MappedPath)
-		if !filepath.IsAbs(cleanedMPath) {
+// UpdateEventRule updates an existing event rule
+func UpdateEventRule(p Provider, rule EventRule) error {
+	return p.updateEventRule(rule)
+}
+
+// DeleteEventRule deletes an existing event rule
+func DeleteEventRule(p Provider, rule EventRule) error {
+	return p.deleteEventRule(rule)
+}
+
+// DumpEventRules returns an array with all event rules
+func DumpEventRules(p Provider) ([]EventRule, error) {
+	return p.dumpEventRules()
+}
+
+// GetEventRules returns an array of event rules respecting limit and offset and filtered by name exact match if not empty
+func GetEventRules(p Provider, limit int, offset int, order string, name string) ([]EventRule, error) {
+	return p.getEventRules(limit, offset, order, name)
+}
+
+// GetEventRuleByID returns the event rule with the given database ID if a match is found or an error
+func GetEventRuleByID(p Provider, ID int64) (EventRule, error) {
+	return p.getEventRuleByID(ID)
+}
+
+// UserTemplateExists returns the user template with the given name, returns an error if no match is found
+func UserTemplateExists(p Provider, name string) (UserTemplate, error) {
+	return p.userTemplateExists(name)
+}
+
+// AddUserTemplate adds a new user template
+func AddUserTemplate(p Provider, template UserTemplate) error {
+	return p.addUserTemplate(template)
+}
+
+// UpdateUserTemplate updates an existing user template
+func UpdateUserTemplate(p Provider, template UserTemplate) error {
+	return p.updateUserTemplate(template)
+}
+
+// DeleteUserTemplate deletes an existing user template, the users created from it are not affected
+func DeleteUserTemplate(p Provider, template UserTemplate) error {
+	return p.deleteUserTemplate(template)
+}
+
+// DumpUserTemplates returns an array with all user templates
+func DumpUserTemplates(p Provider) ([]UserTemplate, error) {
+	return p.dumpUserTemplates()
+}
+
+// GetUserTemplates returns an array of user templates respecting limit and offset and filtered by name exact match if not empty
+func GetUserTemplates(p Provider, limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	return p.getUserTemplates(limit, offset, order, name)
+}
+
+// GetUserTemplateByID returns the user template with the given database ID if a match is found or an error
+func GetUserTemplateByID(p Provider, ID int64) (UserTemplate, error) {
+	return p.getUserTemplateByID(ID)
+}
+
+// AddUsersFromTemplate adds a user for each of the given entries using the template with the given name.
+// All the users are validated before adding any of them, so an invalid entry or an existing username
+// does not add any user. The added users are returned, also on error.
+// ManageUsers configuration must be set to 1 to enable this method
+func AddUsersFromTemplate(p Provider, templateName string, entries []UserTemplateEntry) ([]User, error) {
+	var added []User
+	if config.ManageUsers == 0 {
+		return added, &MethodDisabledError{err: manageUsersDisabledError}
+	}
+	if err := validateUserTemplateEntries(entries); err != nil {
+		return added, err
+	}
+	template, err := p.userTemplateExists(templateName)
+	if err != nil {
+		return added, err
+	}
+	users := make([]User, 0, len(entries))
+	for _, entry := range entries {
+		user := template.GetUser(entry)
+		if _, err := p.userExists(user.Username); err == nil {
+			return added, &ValidationError{err: fmt.Sprintf("username %#v already exists", user.Username)}
+		}
+		// the validated user has the hashed password, so the password is hashed only once
+		if err := validateUser(&user); err != nil {
+			if _, ok := err.(*ValidationError); ok {
+				return added, &ValidationError{err: fmt.Sprintf("invalid user %#v: %v", user.Username, err)}
+			}
+			return added, err
+		}
+		if err := validateUserGroups(p, &user); err != nil {
+			return added, err
+		}
+		users = append(users, user)
+	}
+	for _, user := range users {
+		if err := AddUser(p, user); err != nil {
+			providerLog(logger.LevelWarn, "unable to add user %#v from template %#v: %v", user.Username, templateName, err)
+			return added, err
+		}
+		added = append(added, user)
+	}
+	providerLog(logger.LevelDebug, "users added from template %#v: %v", templateName, len(added))
+	return added, nil
+}
+
+// AddDefenderEvent adds a scored event for the given IP
+func AddDefenderEvent(p Provider, ip string, score int) error {
+	return p.addDefenderEvent(ip, score)
+}
+
+// IsDefenderHostBanned returns the defender entry for the given IP if it is banned,
+// a RecordNotFoundError is returned if the IP is not banned
+func IsDefenderHostBanned(p Provider, ip string) (DefenderEntry, error) {
+	return p.isDefenderHostBanned(ip)
+}
+
+// GetDefenderHostByIP returns the defender entry for the given IP, only the events after
+// from, unix timestamp in milliseconds, are scored. A RecordNotFoundError is returned if
+// the IP is not banned and it has no score
+func GetDefenderHostByIP(p Provider, ip string, from int64) (DefenderEntry, error) {
+	return p.getDefenderHostByIP(ip, from)
+}
+
+// GetDefenderHosts returns the banned hosts and the hosts with a score after from,
+// ordered by IP and limited to the given number of entries
+func GetDefenderHosts(p Provider, from int64, limit int) ([]DefenderEntry, error) {
+	return p.getDefenderHosts(from, limit)
+}
+
+// SetDefenderBanTime bans the given IP until banTime, unix timestamp in milliseconds,
+// the scored events for the IP are removed
+func SetDefenderBanTime(p Provider, ip string, banTime int64) error {
+	return p.setDefenderBanTime(ip, banTime)
+}
+
+// UpdateDefenderBanTime increases the ban time for the given IP, if it is banned
+func UpdateDefenderBanTime(p Provider, ip string, minutes int) error {
+	return p.updateDefenderBanTime(ip, minutes)
+}
+
+// DeleteDefenderHost removes the ban and the events for the given IP
+func DeleteDefenderHost(p Provider, ip string) error {
+	return p.deleteDefenderHost(ip)
+}
+
+// CleanupDefender removes the events before from, unix timestamp in milliseconds,
+// and the bans expired before from
+func CleanupDefender(p Provider, from int64) error {
+	return p.cleanupDefender(from)
+}
+
+// AddActiveSession registers the given session, the heartbeat is set to the current time
+func AddActiveSession(p Provider, session ActiveSession) error {
+	return p.addActiveSession(session)
+}
+
+// DeleteActiveSession removes the session with the given node and connection identifiers
+func DeleteActiveSession(p Provider, nodeID, connectionID string) error {
+	return p.deleteActiveSession(nodeID, connectionID)
+}
+
+// UpdateActiveSessionsHeartbeat sets the heartbeat for all the sessions of the given node to the current time
+func UpdateActiveSessionsHeartbeat(p Provider, nodeID string) error {
+	return p.updateActiveSessionsHeartbeat(nodeID)
+}
+
+// GetActiveSessionsCount returns the number of sessions for the given username with a heartbeat
+// after from, unix timestamp in milliseconds
+func GetActiveSessionsCount(p Provider, username string, from int64) (int, error) {
+	return p.getActiveSessionsCount(username, from)
+}
+
+// CleanupActiveSessions removes the sessions with a heartbeat before the given unix timestamp
+// in milliseconds, they belong to nodes no longer running
+func CleanupActiveSessions(p Provider, before int64) error {
+	return p.cleanupActiveSessions(before)
+}
+
+// CheckAdminAndPass validates the given admin credentials.
+// Admins with a TOTP secret cannot authenticate using only the password
+func CheckAdminAndPass(p Provider, username, password string) (Admin, error) {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return admin, err
+	}
+	admin, err = checkAdminAndPass(admin, password)
+	if err != nil {
+		return admin, err
+	}
+	if admin.HasTOTPSecret() {
+		return admin, errAdminTOTPRequired
+	}
+	upgradeAdminPasswordHash(&admin, password)
+	return admin, nil
+}
+
+// CheckAdminAndPassAndCode validates the given admin credentials and, if the admin has a
+// TOTP secret, the given TOTP code or recovery code
+func CheckAdminAndPassAndCode(p Provider, username, password, code string) (Admin, error) {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return admin, err
+	}
+	admin, err = checkAdminAndPass(admin, password)
+	if err != nil {
+		return admin, err
+	}
+	if admin.HasTOTPSecret() {
+		adminSecondFactorLock.Lock()
+		defer adminSecondFactorLock.Unlock()
+
+		// reload the second factor settings, a concurrent login could have used the same code
+		current, err := p.adminExists(username)
+		if err != nil {
+			return admin, err
+		}
+		admin.Filters = current.Filters
+		recoveryCodeUsed, err := checkAdminSecondFactor(&admin, code)
+		if err != nil {
+			return admin, err
+		}
+		if recoveryCodeUsed {
+			providerLog(logger.LevelInfo, "recovery code used for admin %#v, unused codes: %v", admin.Username,
+				admin.GetUnusedRecoveryCodes())
+		}
+		if err = p.updateAdmin(admin); err != nil {
+			providerLog(logger.LevelWarn, "unable to save the used second factor for admin %#v: %v", admin.Username, err)
+			return admin, err
+		}
+	}
+	upgradeAdminPasswordHash(&admin, password)
+	return admin, nil
+}
+
+// EnableAdminTOTP enables the second factor authentication for the given admin.
+// The code must be valid for the given secret, this way we know that the authenticator
+// is correctly configured. The generated recovery codes are returned, they are stored hashed
+func EnableAdminTOTP(p Provider, username, secret, code string) ([]string, error) {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = utils.DecodeTOTPSecret(secret); err != nil {
+		return nil, &ValidationError{err: "invalid TOTP secret, it must be base32 encoded and at least 80 bits long"}
+	}
+	step, ok := utils.ValidateTOTPCodeAfterStep(secret, code, 0)
+	if !ok {
+		return nil, &ValidationError{err: errInvalidTOTPCode.Error()}
+	}
+	codes, hashes, err := generateAdminRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	admin.Filters.TOTPSecret = secret
+	admin.Filters.RecoveryCodes = hashes
+	// the confirmation code cannot be used to login
+	admin.Filters.TOTPLastStep = step
+	if err = p.updateAdmin(admin); err != nil {
+		return nil, err
+	}
+	providerLog(logger.LevelInfo, "second factor authentication enabled for admin %#v", username)
+	return codes, nil
+}
+
+// DisableAdminTOTP disables the second factor authentication for the given admin
+func DisableAdminTOTP(p Provider, username string) error {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return err
+	}
+	admin.Filters = AdminFilters{}
+	if err = p.updateAdmin(admin); err != nil {
+		return err
+	}
+	providerLog(logger.LevelInfo, "second factor authentication disabled for admin %#v", username)
+	return nil
+}
+
+// RegenerateAdminRecoveryCodes replaces the recovery codes for the given admin,
+// the second factor authentication must be enabled
+func RegenerateAdminRecoveryCodes(p Provider, username string) ([]string, error) {
+	admin, err := p.adminExists(username)
+	if err != nil {
+		return nil, err
+	}
+	if !admin.HasTOTPSecret() {
+		return nil, &ValidationError{err: "the second factor authentication is not enabled"}
+	}
+	codes, hashes, err := generateAdminRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	admin.Filters.RecoveryCodes = hashes
+	if err = p.updateAdmin(admin); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// AdminExists returns the admin with the given username, returns an error if no match is found
+func AdminExists(p Provider, username string) (Admin, error) {
+	return p.adminExists(username)
+}
+
+// HasAdmins returns true if at least an admin is defined
+func HasAdmins(p Provider) (bool, error) {
+	admins, err := p.getAdmins(1, 0, "ASC", "")
+	return len(admins) > 0, err
+}
+
+// AddAdmin adds a new admin
+func AddAdmin(p Provider, admin Admin) error {
+	return p.addAdmin(admin)
+}
+
+// UpdateAdmin updates an existing admin
+func UpdateAdmin(p Provider, admin Admin) error {
+	return p.updateAdmin(admin)
+}
+
+// DeleteAdmin deletes an existing admin and its API keys
+func DeleteAdmin(p Provider, admin Admin) error {
+	err := p.deleteAdmin(admin)
+	if err != nil {
+		return err
+	}
+	keys, err := p.dumpAPIKeys()
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if key.Admin == admin.Username {
+			if err = p.deleteAPIKey(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DumpAdmins returns an array with all admins
+func DumpAdmins(p Provider) ([]Admin, error) {
+	return p.dumpAdmins()
+}
+
+// GetAdmins returns an array of admins respecting limit and offset and filtered by username exact match if not empty.
+// The passwords are not returned
+func GetAdmins(p Provider, limit int, offset int, order string, username string) ([]Admin, error) {
+	return p.getAdmins(limit, offset, order, username)
+}
+
+// GetAdminByID returns the admin with the given database ID if a match is found or an error
+func GetAdminByID(p Provider, ID int64) (Admin, error) {
+	return p.getAdminByID(ID)
+}
+
+// CheckAPIKey validates the given plain API key and returns the key and its admin.
+// The admin permissions are restricted to the ones allowed for the key
+func CheckAPIKey(p Provider, plainKey string) (APIKey, Admin, error) {
+	var admin Admin
+	keyID, secret := plainKey, ""
+	if idx := strings.Index(plainKey, "."); idx > 0 {
+		keyID, secret = plainKey[:idx], plainKey[idx+1:]
+	}
+	key, err := p.apiKeyExists(keyID)
+	if err != nil {
+		return key, admin, err
+	}
+	key, err = checkAPIKey(key, secret)
+	if err != nil {
+		return key, admin, err
+	}
+	admin, err = p.adminExists(key.Admin)
+	if err != nil {
+		return key, admin, err
+	}
+	if admin.Status != 1 {
+		return key, admin, fmt.Errorf("admin %#v is disabled", admin.Username)
+	}
+	admin.Permissions = key.GetAllowedPermissions(&admin)
+	if len(admin.Permissions) == 0 {
+		return key, admin, fmt.Errorf("API key %#v has no allowed permissions", key.KeyID)
+	}
+	if err = p.updateAPIKeyLastUse(key.KeyID); err != nil {
+		providerLog(logger.LevelWarn, "unable to update last use for API key %#v: %v", key.KeyID, err)
+	}
+	return key, admin, nil
+}
+
+// APIKeyExists returns the API key with the given key id, returns an error if no match is found
+func APIKeyExists(p Provider, keyID string) (APIKey, error) {
+	return p.apiKeyExists(keyID)
+}
+
+// AddAPIKey adds a new API key, the plain secret is replaced with its hash
+func AddAPIKey(p Provider, key APIKey) error {
+	if err := validateAPIKey(p, &key); err != nil {
+		return err
+	}
+	return p.addAPIKey(key)
+}
+
+// DeleteAPIKey deletes an existing API key, it cannot be used anymore
+func DeleteAPIKey(p Provider, key APIKey) error {
+	return p.deleteAPIKey(key)
+}
+
+// DumpAPIKeys returns an array with all API keys
+func DumpAPIKeys(p Provider) ([]APIKey, error) {
+	return p.dumpAPIKeys()
+}
+
+// GetAPIKeys returns an array of API keys respecting limit and offset and filtered by admin if not empty.
+// The hashed secrets are not returned
+func GetAPIKeys(p Provider, limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return p.getAPIKeys(limit, offset, order, admin)
+}
+
+// CheckShareAndPass validates the given share id and optional password and returns the share and its user.
+// The share must not be expired and its user must be able to login
+func CheckShareAndPass(p Provider, shareID, password string) (Share, User, error) {
+	var user User
+	share, err := p.shareExists(shareID)
+	if err != nil {
+		return share, user, err
+	}
+	share, err = checkShareAndPass(share, password)
+	if err != nil {
+		return share, user, err
+	}
+	user, err = p.userExists(share.Username)
+	if err != nil {
+		return share, user, err
+	}
+	user, err = applyUserGroups(p, user)
+	if err != nil {
+		return share, user, err
+	}
+	return share, user, checkLoginConditions(user)
+}
+
+// ShareExists returns the share with the given share id, returns an error if no match is found
+func ShareExists(p Provider, shareID string) (Share, error) {
+	return p.shareExists(shareID)
+}
+
+// AddShare adds a new share, the optional plain password is replaced with its hash
+func AddShare(p Provider, share Share) error {
+	if err := validateShare(p, &share); err != nil {
+		return err
+	}
+	return p.addShare(share)
+}
+
+// UpdateShareUsage increases the used tokens for the given share and updates its last use
+func UpdateShareUsage(p Provider, shareID string, numTokens int) error {
+	return p.updateShareUsage(shareID, numTokens)
+}
+
+// DeleteShare deletes an existing share, its link cannot be used anymore
+func DeleteShare(p Provider, share Share) error {
+	return p.deleteShare(share)
+}
+
+// DumpShares returns an array with all shares
+func DumpShares(p Provider) ([]Share, error) {
+	return p.dumpShares()
+}
+
+// GetShares returns an array of shares respecting limit and offset and filtered by username if not empty.
+// The hashed passwords are not returned
+func GetShares(p Provider, limit int, offset int, order string, username string) ([]Share, error) {
+	return p.getShares(limit, offset, order, username)
+}
+
+// DumpData returns a backup with all the users, groups, admins, API keys, shares, event rules and user templates
+func DumpData(p Provider) (BackupData, error) {
+	var data BackupData
+	users, err := p.dumpUsers()
+	if err != nil {
+		return data, err
+	}
+	groups, err := p.dumpGroups()
+	if err != nil {
+		return data, err
+	}
+	admins, err := p.dumpAdmins()
+	if err != nil {
+		return data, err
+	}
+	apiKeys, err := p.dumpAPIKeys()
+	if err != nil {
+		return data, err
+	}
+	shares, err := p.dumpShares()
+	if err != nil {
+		return data, err
+	}
+	rules, err := p.dumpEventRules()
+	if err != nil {
+		return data, err
+	}
+	templates, err := p.dumpUserTemplates()
+	if err != nil {
+		return data, err
+	}
+	data.Users = users
+	data.Groups = groups
+	data.Admins = admins
+	data.APIKeys = apiKeys
+	data.Shares = shares
+	data.EventRules = rules
+	data.UserTemplates = templates
+	return data, nil
+}
+
+// RestoreData restores the given backup using the specified restore mode.
+// The objects are restored one by one and the restore is stopped at the first error,
+// so a partial restore could happen. The restored users are returned, also on error
+func RestoreData(p Provider, dump BackupData, mode int) ([]User, error) {
+	var restoredUsers []User
+	if mode != RestoreModeAddAndUpdate && mode != RestoreModeAddOnly {
+		return restoredUsers, &ValidationError{err: fmt.Sprintf("invalid restore mode: %v", mode)}
+	}
+	// the groups must be restored before the users that belong to them
+	for _, group := range dump.Groups {
+		g, err := p.groupExists(group.Name)
+		if err == nil {
+			if mode == RestoreModeAddOnly {
+				providerLog(logger.LevelDebug, "restore mode add only, existing group %#v not updated", g.Name)
+				continue
+			}
+			group.ID = g.ID
+			err = UpdateGroup(p, group)
+			providerLog(logger.LevelDebug, "restoring existing group: %#v, error: %v", group.Name, err)
+		} else {
+			err = AddGroup(p, group)
+			providerLog(logger.LevelDebug, "adding new group: %#v, error: %v", group.Name, err)
+		}
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	for _, admin := range dump.Admins {
+		a, err := p.adminExists(admin.Username)
+		if err == nil {
+			if mode == RestoreModeAddOnly {
+				providerLog(logger.LevelDebug, "restore mode add only, existing admin %#v not updated", a.Username)
+				continue
+			}
+			admin.ID = a.ID
+			err = UpdateAdmin(p, admin)
+			providerLog(logger.LevelDebug, "restoring existing admin: %#v, error: %v", admin.Username, err)
+		} else {
+			err = AddAdmin(p, admin)
+			providerLog(logger.LevelDebug, "adding new admin: %#v, error: %v", admin.Username, err)
+		}
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	// the API keys are restored after their admins, the existing keys are never updated
+	for _, key := range dump.APIKeys {
+		if _, err := p.apiKeyExists(key.KeyID); err == nil {
+			providerLog(logger.LevelDebug, "existing API key %#v not updated", key.KeyID)
+			continue
+		}
+		err := AddAPIKey(p, key)
+		providerLog(logger.LevelDebug, "adding new API key: %#v, error: %v", key.KeyID, err)
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	for _, user := range dump.Users {
+		u, err := p.userExists(user.Username)
+		if err == nil {
+			if mode == RestoreModeAddOnly {
+				providerLog(logger.LevelDebug, "restore mode add only, existing user %#v not updated", u.Username)
+				continue
+			}
+			user.ID = u.ID
+			user.LastLogin = u.LastLogin
+			user.UsedQuotaSize = u.UsedQuotaSize
+			user.UsedQuotaFiles = u.UsedQuotaFiles
+			err = UpdateUser(p, user)
+			providerLog(logger.LevelDebug, "restoring existing user: %#v, error: %v", user.Username, err)
+		} else {
+			user.LastLogin = 0
+			user.UsedQuotaSize = 0
+			user.UsedQuotaFiles = 0
+			err = AddUser(p, user)
+			providerLog(logger.LevelDebug, "adding new user: %#v, error: %v", user.Username, err)
+		}
+		if err != nil {
+			return restoredUsers, err
+		}
+		restoredUsers = append(restoredUsers, user)
+	}
+	// the shares are restored after their users, the existing shares are never updated
+	for _, share := range dump.Shares {
+		if _, err := p.shareExists(share.ShareID); err == nil {
+			providerLog(logger.LevelDebug, "existing share %#v not updated", share.ShareID)
+			continue
+		}
+		err := AddShare(p, share)
+		providerLog(logger.LevelDebug, "adding new share: %#v, error: %v", share.ShareID, err)
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	for _, rule := range dump.EventRules {
+		r, err := p.eventRuleExists(rule.Name)
+		if err == nil {
+			if mode == RestoreModeAddOnly {
+				providerLog(logger.LevelDebug, "restore mode add only, existing event rule %#v not updated", r.Name)
+				continue
+			}
+			rule.ID = r.ID
+			err = UpdateEventRule(p, rule)
+			providerLog(logger.LevelDebug, "restoring existing event rule: %#v, error: %v", rule.Name, err)
+		} else {
+			err = AddEventRule(p, rule)
+			providerLog(logger.LevelDebug, "adding new event rule: %#v, error: %v", rule.Name, err)
+		}
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	for _, template := range dump.UserTemplates {
+		t, err := p.userTemplateExists(template.Name)
+		if err == nil {
+			if mode == RestoreModeAddOnly {
+				providerLog(logger.LevelDebug, "restore mode add only, existing user template %#v not updated", t.Name)
+				continue
+			}
+			template.ID = t.ID
+			err = UpdateUserTemplate(p, template)
+			providerLog(logger.LevelDebug, "restoring existing user template: %#v, error: %v", template.Name, err)
+		} else {
+			err = AddUserTemplate(p, template)
+			providerLog(logger.LevelDebug, "adding new user template: %#v, error: %v", template.Name, err)
+		}
+		if err != nil {
+			return restoredUsers, err
+		}
+	}
+	providerLog(logger.LevelDebug, "backup restored, users: %v, groups: %v, admins: %v, API keys: %v, shares: %v, "+
+		"event rules: %v, user templates: %v", len(dump.Users), len(dump.Groups), len(dump.Admins), len(dump.APIKeys),
+		len(dump.Shares), len(dump.EventRules), len(dump.UserTemplates))
+	return restoredUsers, nil
+}
+
+// ReloadConfig reloads provider configuration.
+// Currently only implemented for memory provider, allows to reload the users
+// from the configured file, if defined
+func ReloadConfig() error {
+	return provider.reloadConfig()
+}
+
+// GetUsers returns an array of users respecting limit and offset and filtered by username exact match if not empty
+func GetUsers(p Provider, limit int, offset int, order string, username string) ([]User, error) {
+	return p.getUsers(limit, offset, order, username)
+}
+
+// GetUserByID returns the user with the given database ID if a match is found or an error
+func GetUserByID(p Provider, ID int64) (User, error) {
+	return p.getUserByID(ID)
+}
+
+// GetProviderStatus returns an error if the provider is not available
+func GetProviderStatus(p Provider) error {
+	return p.checkAvailability()
+}
+
+// Close releases all provider resources.
+// This method is used in test cases and by the commands that access the data provider directly.
+// Closing an uninitialized provider is not supported
+func Close(p Provider) error {
+	availabilityTicker.Stop()
+	availabilityTickerDone <- true
+	delayedQuota.stop(p)
+	return p.close()
+}
+
+func createProvider(basePath string) error {
+	var err error
+	if err = validateSQLTLSConfig(basePath); err != nil {
+		return err
+	}
+	if config.Driver == SQLiteDataProviderName {
+		err = initializeSQLiteProvider(basePath)
+	} else if config.Driver == PGSQLDataProviderName {
+		err = initializePGSQLProvider()
+	} else if config.Driver == MySQLDataProviderName {
+		err = initializeMySQLProvider()
+	} else if config.Driver == BoltDataProviderName {
+		err = initializeBoltProvider(basePath)
+	} else if config.Driver == MemoryDataProviderName {
+		err = initializeMemoryProvider(basePath)
+	} else if config.Driver == CockroachDataProviderName {
+		err = initializeCockroachDBProvider()
+	} else {
+		err = fmt.Errorf("unsupported data provider: %v", config.Driver)
+	}
+	return err
+}
+
+func buildUserHomeDir(user *User) {
+	if len(user.HomeDir) == 0 {
+		if len(config.UsersBaseDir) > 0 {
+			user.HomeDir = filepath.Join(config.UsersBaseDir, user.Username)
+		}
+	}
+}
+
+func isVirtualDirOverlapped(dir1, dir2 string) bool {
+	if dir1 == dir2 {
+		return true
+	}
+	if len(dir1) > len(dir2) {
+		if strings.HasPrefix(dir1, dir2+"/") {
+			return true
+		}
+	}
+	if len(dir2) > len(dir1) {
+		if strings.HasPrefix(dir2, dir1+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func isMappedDirOverlapped(dir1, dir2 string) bool {
+	if dir1 == dir2 {
+		return true
+	}
+	if len(dir1) > len(dir2) {
+		if strings.HasPrefix(dir1, dir2+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	if len(dir2) > len(dir1) {
+		if strings.HasPrefix(dir2, dir1+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateVirtualFolders(user *User) error {
+	if len(user.VirtualFolders) == 0 || user.FsConfig.Provider != 0 {
+		user.VirtualFolders = []vfs.VirtualFolder{}
+		return nil
+	}
+	var virtualFolders []vfs.VirtualFolder
+	mappedPaths := make(map[string]string)
+	for _, v := range user.VirtualFolders {
+		cleanedVPath := filepath.ToSlash(path.Clean(v.VirtualPath))
+		if !path.IsAbs(cleanedVPath) || cleanedVPath == "/" {
+			return &ValidationError{err: fmt.Sprintf("invalid virtual folder %#v", v.VirtualPath)}
+		}
+		cleanedMPath := filepath.Clean(v.MappedPath)
+		if !filepath.IsAbs(cleanedMPath) {
 			return &ValidationError{err: fmt.Sprintf("invalid mapped folder %#v", v.MappedPath)}
 		}
 		if isMappedDirOverlapped(cleanedMPath, user.GetHomeDir()) {
@@ -605,8 +1781,9 @@ func validateVirtualFolders(user *User) error {
 				v.MappedPath, user.GetHomeDir())}
 		}
 		virtualFolders = append(virtualFolders, vfs.VirtualFolder{
-			VirtualPath: cleanedVPath,
-			MappedPath:  cleanedMPath,
+			VirtualPath:      cleanedVPath,
+			MappedPath:       cleanedMPath,
+			ExcludeFromQuota: v.ExcludeFromQuota,
 		})
 		for k, virtual := range mappedPaths {
 			if isMappedDirOverlapped(k, cleanedMPath) {
@@ -624,24 +1801,39 @@ func validateVirtualFolders(user *User) error {
 	return nil
 }
 
+// validatePermissions validates the user permissions, the permissions for the root dir
+// can be omitted for the users that belong to groups, they can be inherited
 func validatePermissions(user *User) error {
 	if len(user.Permissions) == 0 {
+		if len(user.Groups) > 0 {
+			user.Permissions = make(map[string][]string)
+			return nil
+		}
 		return &ValidationError{err: "please grant some permissions to this user"}
 	}
-	permissions := make(map[string][]string)
-	if _, ok := user.Permissions["/"]; !ok {
+	if _, ok := user.Permissions["/"]; !ok && len(user.Groups) == 0 {
 		return &ValidationError{err: fmt.Sprintf("permissions for the root dir \"/\" must be set")}
 	}
-	for dir, perms := range user.Permissions {
+	permissions, err := getCleanedPermissions(user.Permissions)
+	if err != nil {
+		return err
+	}
+	user.Permissions = permissions
+	return nil
+}
+
+func getCleanedPermissions(dirsPermissions map[string][]string) (map[string][]string, error) {
+	permissions := make(map[string][]string)
+	for dir, perms := range dirsPermissions {
 		if len(perms) == 0 && dir == "/" {
-			return &ValidationError{err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("no permissions granted for the directory: %#v", dir)}
 		}
 		if len(perms) > len(ValidPerms) {
-			return &ValidationError{err: "invalid permissions"}
+			return nil, &ValidationError{err: "invalid permissions"}
 		}
 		for _, p := range perms {
 			if !utils.IsStringInSlice(p, ValidPerms) {
-				return &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
+				return nil, &ValidationError{err: fmt.Sprintf("invalid permission: %#v", p)}
 			}
 		}
 		cleanedDir := filepath.ToSlash(path.Clean(dir))
@@ -649,10 +1841,10 @@ func validatePermissions(user *User) error {
 			cleanedDir = strings.TrimSuffix(cleanedDir, "/")
 		}
 		if !path.IsAbs(cleanedDir) {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("cannot set permissions for non absolute path: %#v", dir)}
 		}
 		if dir != cleanedDir && cleanedDir == "/" {
-			return &ValidationError{err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
+			return nil, &ValidationError{err: fmt.Sprintf("cannot set permissions for invalid subdirectory: %#v is an alias for \"/\"", dir)}
 		}
 		if utils.IsStringInSlice(PermAny, perms) {
 			permissions[cleanedDir] = []string{PermAny}
@@ -660,8 +1852,7 @@ func validatePermissions(user *User) error {
 			permissions[cleanedDir] = perms
 		}
 	}
-	user.Permissions = permissions
-	return nil
+	return permissions, nil
 }
 
 func validatePublicKeys(user *User) error {
@@ -703,7 +1894,121 @@ func validateFiltersFileExtensions(user *User) error {
 	return nil
 }
 
+func validateFiltersFilePatterns(user *User) error {
+	if len(user.Filters.FilePatterns) == 0 {
+		user.Filters.FilePatterns = []PatternsFilter{}
+		return nil
+	}
+	filteredPaths := []string{}
+	var filters []PatternsFilter
+	for _, f := range user.Filters.FilePatterns {
+		cleanedPath := filepath.ToSlash(path.Clean(f.Path))
+		if !path.IsAbs(cleanedPath) {
+			return &ValidationError{err: fmt.Sprintf("invalid path %#v for file patterns filter", f.Path)}
+		}
+		if utils.IsStringInSlice(cleanedPath, filteredPaths) {
+			return &ValidationError{err: fmt.Sprintf("duplicate file patterns filter for path %#v", f.Path)}
+		}
+		allowed, err := getCleanedPatterns(f.AllowedPatterns)
+		if err != nil {
+			return err
+		}
+		denied, err := getCleanedPatterns(f.DeniedPatterns)
+		if err != nil {
+			return err
+		}
+		if len(allowed) == 0 && len(denied) == 0 {
+			return &ValidationError{err: fmt.Sprintf("empty file patterns filter for path %#v", f.Path)}
+		}
+		f.Path = cleanedPath
+		f.AllowedPatterns = allowed
+		f.DeniedPatterns = denied
+		filters = append(filters, f)
+		filteredPaths = append(filteredPaths, cleanedPath)
+	}
+	user.Filters.FilePatterns = filters
+	return nil
+}
+
+// validateFiltersRevokedPublicKeys accepts SHA256 fingerprints or public keys in
+// authorized_keys format, the latter are converted to fingerprints
+func validateFiltersRevokedPublicKeys(user *User) error {
+	var revoked []string
+	for _, k := range user.Filters.RevokedPublicKeys {
+		k = strings.TrimSpace(k)
+		if len(k) == 0 {
+			continue
+		}
+		if strings.HasPrefix(k, "SHA256:") {
+			hash, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(k, "SHA256:"))
+			if err != nil || len(hash) != sha256.Size {
+				return &ValidationError{err: fmt.Sprintf("invalid revoked public key fingerprint %#v", k)}
+			}
+		} else {
+			pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k))
+			if err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not parse revoked public key %#v: %v", k, err)}
+			}
+			k = ssh.FingerprintSHA256(pubKey)
+		}
+		if !utils.IsStringInSlice(k, revoked) {
+			revoked = append(revoked, k)
+		}
+	}
+	user.Filters.RevokedPublicKeys = revoked
+	return nil
+}
+
+func getCleanedPatterns(patterns []string) ([]string, error) {
+	var result []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(strings.ToLower(pattern))
+		if len(pattern) == 0 {
+			continue
+		}
+		if _, err := path.Match(pattern, "abc"); err != nil {
+			return nil, &ValidationError{err: fmt.Sprintf("invalid file pattern filter %#v", pattern)}
+		}
+		result = append(result, pattern)
+	}
+	return result, nil
+}
+
+func validateTOTPSecret(user *User) error {
+	if len(user.Filters.TOTPSecret) == 0 {
+		return nil
+	}
+	if kms.IsEncrypted(user.Filters.TOTPSecret) {
+		if err := encryptFsSecret(&user.Filters.TOTPSecret); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt TOTP secret: %v", err)}
+		}
+		return nil
+	}
+	key, err := utils.DecodeTOTPSecret(user.Filters.TOTPSecret)
+	if err != nil || len(key) < 10 {
+		return &ValidationError{err: "invalid TOTP secret, it must be base32 encoded and at least 80 bits long"}
+	}
+	if err = encryptFsSecret(&user.Filters.TOTPSecret); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt TOTP secret: %v", err)}
+	}
+	return nil
+}
+
 func validateFilters(user *User) error {
+	if user.Filters.MaxUploadFileSize < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid max upload file size: %v", user.Filters.MaxUploadFileSize)}
+	}
+	if user.Filters.PasswordExpiration < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid password expiration: %v", user.Filters.PasswordExpiration)}
+	}
+	if user.Filters.UploadMode != "" && !utils.IsStringInSlice(user.Filters.UploadMode,
+		[]string{UploadModeStandard, UploadModeAtomic, UploadModeAtomicWithResume}) {
+		return &ValidationError{err: fmt.Sprintf("invalid upload mode: %#v", user.Filters.UploadMode)}
+	}
+	if user.Filters.SetstatMode != "" && user.Filters.SetstatMode != SetstatModeNormal &&
+		user.Filters.SetstatMode != SetstatModeIgnore {
+		return &ValidationError{err: fmt.Sprintf("invalid setstat mode: %#v", user.Filters.SetstatMode)}
+	}
 	if len(user.Filters.AllowedIP) == 0 {
 		user.Filters.AllowedIP = []string{}
 	}
@@ -725,6 +2030,16 @@ func validateFilters(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("could not parse allowed IP/Mask %#v : %v", IPMask, err)}
 		}
 	}
+	countries, err := geoip.NormalizeCountryCodes(user.Filters.AllowedCountries)
+	if err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate allowed countries: %v", err)}
+	}
+	user.Filters.AllowedCountries = countries
+	countries, err = geoip.NormalizeCountryCodes(user.Filters.DeniedCountries)
+	if err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not validate denied countries: %v", err)}
+	}
+	user.Filters.DeniedCountries = countries
 	if len(user.Filters.DeniedLoginMethods) >= len(ValidSSHLoginMethods) {
 		return &ValidationError{err: "invalid denied_login_methods"}
 	}
@@ -733,9 +2048,36 @@ func validateFilters(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("invalid login method: %#v", loginMethod)}
 		}
 	}
+	if err := validateFiltersLoginMethodRules(user); err != nil {
+		return err
+	}
 	if err := validateFiltersFileExtensions(user); err != nil {
 		return err
 	}
+	if err := validateFiltersFilePatterns(user); err != nil {
+		return err
+	}
+	if err := validateFiltersRevokedPublicKeys(user); err != nil {
+		return err
+	}
+	return validateTOTPSecret(user)
+}
+
+func validateFiltersLoginMethodRules(user *User) error {
+	for idx, rule := range user.Filters.LoginMethodRules {
+		for _, IPMask := range rule.Sources {
+			if _, _, err := net.ParseCIDR(IPMask); err != nil {
+				return &ValidationError{err: fmt.Sprintf("could not parse IP/Mask %#v for login method rule %v: %v",
+					IPMask, idx+1, err)}
+			}
+		}
+		for _, loginMethod := range append(rule.AllowedLoginMethods, rule.DeniedLoginMethods...) {
+			if !utils.IsStringInSlice(loginMethod, ValidSSHLoginMethods) {
+				return &ValidationError{err: fmt.Sprintf("invalid login method %#v for login method rule %v",
+					loginMethod, idx+1)}
+			}
+		}
+	}
 	return nil
 }
 
@@ -750,6 +2092,15 @@ func saveGCSCredentials(user *User) error {
 	if err != nil {
 		return &ValidationError{err: fmt.Sprintf("could not validate GCS credentials: %v", err)}
 	}
+	// the credentials are stored encrypted only if a KMS provider is configured,
+	// they are kept as is if already encrypted, for example when restoring a backup
+	if kms.IsEnabled() && !kms.IsEncrypted(string(decoded)) {
+		encrypted, err := kms.Encrypt(string(decoded))
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt GCS credentials: %v", err)}
+		}
+		decoded = []byte(encrypted)
+	}
 	err = ioutil.WriteFile(user.getGCSCredentialsFilePath(), decoded, 0600)
 	if err != nil {
 		return &ValidationError{err: fmt.Sprintf("could not save GCS credentials: %v", err)}
@@ -764,15 +2115,8 @@ func validateFilesystemConfig(user *User) error {
 		if err != nil {
 			return &ValidationError{err: fmt.Sprintf("could not validate s3config: %v", err)}
 		}
-		if len(user.FsConfig.S3Config.AccessSecret) > 0 {
-			vals := strings.Split(user.FsConfig.S3Config.AccessSecret, "$")
-			if !strings.HasPrefix(user.FsConfig.S3Config.AccessSecret, "$aes$") || len(vals) != 4 {
-				accessSecret, err := utils.EncryptData(user.FsConfig.S3Config.AccessSecret)
-				if err != nil {
-					return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
-				}
-				user.FsConfig.S3Config.AccessSecret = accessSecret
-			}
+		if err = encryptFsSecret(&user.FsConfig.S3Config.AccessSecret); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt s3 access secret: %v", err)}
 		}
 		return nil
 	} else if user.FsConfig.Provider == 2 {
@@ -781,10 +2125,74 @@ func validateFilesystemConfig(user *User) error {
 			return &ValidationError{err: fmt.Sprintf("could not validate GCS config: %v", err)}
 		}
 		return nil
+	} else if user.FsConfig.Provider == 3 {
+		err := vfs.ValidateAzBlobFsConfig(&user.FsConfig.AzBlobConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate Azure Blob config: %v", err)}
+		}
+		if err = encryptFsSecret(&user.FsConfig.AzBlobConfig.AccountKey); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob account key: %v", err)}
+		}
+		if err = encryptFsSecret(&user.FsConfig.AzBlobConfig.SASURL); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt Azure blob SAS URL: %v", err)}
+		}
+		return nil
+	} else if user.FsConfig.Provider == 4 {
+		err := vfs.ValidateSFTPFsConfig(&user.FsConfig.SFTPConfig)
+		if err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not validate SFTP config: %v", err)}
+		}
+		if err = encryptFsSecret(&user.FsConfig.SFTPConfig.Password); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP password: %v", err)}
+		}
+		if err = encryptFsSecret(&user.FsConfig.SFTPConfig.PrivateKey); err != nil {
+			return &ValidationError{err: fmt.Sprintf("could not encrypt SFTP private key: %v", err)}
+		}
+		return nil
 	}
 	user.FsConfig.Provider = 0
 	user.FsConfig.S3Config = vfs.S3FsConfig{}
 	user.FsConfig.GCSConfig = vfs.GCSFsConfig{}
+	user.FsConfig.AzBlobConfig = vfs.AzBlobFsConfig{}
+	user.FsConfig.SFTPConfig = vfs.SFTPFsConfig{}
+	return nil
+}
+
+func validateCryptConfig(user *User) error {
+	if len(user.FsConfig.CryptConfig.Passphrase) == 0 {
+		return nil
+	}
+	if len(user.VirtualFolders) > 0 {
+		return &ValidationError{err: "virtual folders are not supported for encrypted filesystems"}
+	}
+	if err := encryptFsSecret(&user.FsConfig.CryptConfig.Passphrase); err != nil {
+		return &ValidationError{err: fmt.Sprintf("could not encrypt the crypt passphrase: %v", err)}
+	}
+	return nil
+}
+
+// encryptFsSecret encrypts the given secret in place if it is not empty and not already
+// encrypted. Secrets encrypted with a different KMS provider are encrypted again using
+// the configured one. It is used for the TOTP secrets too
+func encryptFsSecret(secret *string) error {
+	if len(*secret) == 0 {
+		return nil
+	}
+	if kms.IsEncrypted(*secret) {
+		if !kms.NeedsReencryption(*secret) {
+			return nil
+		}
+		plaintext, err := kms.Decrypt(*secret)
+		if err != nil {
+			return err
+		}
+		*secret = plaintext
+	}
+	encrypted, err := kms.Encrypt(*secret)
+	if err != nil {
+		return err
+	}
+	*secret = encrypted
 	return nil
 }
 
@@ -795,8 +2203,19 @@ func validateBaseParams(user *User) error {
 	if len(user.Password) == 0 && len(user.PublicKeys) == 0 {
 		return &ValidationError{err: "please set a password or at least a public_key"}
 	}
-	if !filepath.IsAbs(user.HomeDir) {
-		return &ValidationError{err: fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir)}
+	if !filepath.IsAbs(user.HomeDir) {
+		return &ValidationError{err: fmt.Sprintf("home_dir must be an absolute path, actual value: %v", user.HomeDir)}
+	}
+	return nil
+}
+
+func validateDataTransfer(user *User) error {
+	if user.UploadDataTransfer < 0 || user.DownloadDataTransfer < 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid data transfer limits, upload: %v download: %v",
+			user.UploadDataTransfer, user.DownloadDataTransfer)}
+	}
+	if user.DataTransferReset != DataTransferResetNever && user.DataTransferReset != DataTransferResetMonthly {
+		return &ValidationError{err: fmt.Sprintf("invalid data transfer reset: %v", user.DataTransferReset)}
 	}
 	return nil
 }
@@ -812,14 +2231,29 @@ func validateUser(user *User) error {
 	if err := validateFilesystemConfig(user); err != nil {
 		return err
 	}
+	if err := validateCryptConfig(user); err != nil {
+		return err
+	}
 	if err := validateVirtualFolders(user); err != nil {
 		return err
 	}
 	if user.Status < 0 || user.Status > 1 {
 		return &ValidationError{err: fmt.Sprintf("invalid user status: %v", user.Status)}
 	}
-	if len(user.Password) > 0 && !utils.IsStringPrefixInSlice(user.Password, hashPwdPrefixes) {
-		pwd, err := argon2id.CreateHash(user.Password, argon2id.DefaultParams)
+	if user.ActivationDate < 0 || user.ExpirationDate < 0 {
+		return &ValidationError{err: "activation and expiration dates cannot be negative"}
+	}
+	if user.ActivationDate > 0 && user.ExpirationDate > 0 && user.ActivationDate >= user.ExpirationDate {
+		return &ValidationError{err: fmt.Sprintf("activation date %v must be before the expiration date %v",
+			user.ActivationDate, user.ExpirationDate)}
+	}
+	if err := validateDataTransfer(user); err != nil {
+		return err
+	}
+	// DES crypt hashes have no prefix, they are detected by their format
+	if len(user.Password) > 0 && !utils.IsStringPrefixInSlice(user.Password, hashPwdPrefixes) &&
+		!isDESCryptHash(user.Password) {
+		pwd, err := hashPassword(user.Password)
 		if err != nil {
 			return err
 		}
@@ -837,6 +2271,22 @@ func validateUser(user *User) error {
 	return nil
 }
 
+// setLastPasswordChange sets the last password change for a new user or if the password
+// is different from the stored one, otherwise the stored value is preserved
+func setLastPasswordChange(user *User, storedUser *User) {
+	if storedUser == nil {
+		if user.LastPasswordChange == 0 && len(user.Password) > 0 {
+			user.LastPasswordChange = utils.GetTimeAsMsSinceEpoch(time.Now())
+		}
+		return
+	}
+	if user.Password != storedUser.Password && len(user.Password) > 0 {
+		user.LastPasswordChange = utils.GetTimeAsMsSinceEpoch(time.Now())
+		return
+	}
+	user.LastPasswordChange = storedUser.LastPasswordChange
+}
+
 func checkLoginConditions(user User) error {
 	if user.Status < 1 {
 		return fmt.Errorf("user %#v is disabled", user.Username)
@@ -845,6 +2295,10 @@ func checkLoginConditions(user User) error {
 		return fmt.Errorf("user %#v is expired, expiration timestamp: %v current timestamp: %v", user.Username,
 			user.ExpirationDate, utils.GetTimeAsMsSinceEpoch(time.Now()))
 	}
+	if user.ActivationDate > 0 && user.ActivationDate > utils.GetTimeAsMsSinceEpoch(time.Now()) {
+		return fmt.Errorf("user %#v is not active yet, activation timestamp: %v current timestamp: %v", user.Username,
+			user.ActivationDate, utils.GetTimeAsMsSinceEpoch(time.Now()))
+	}
 	return nil
 }
 
@@ -863,7 +2317,7 @@ func checkUserAndPass(user User, password string) (User, error) {
 			providerLog(logger.LevelWarn, "error comparing password with argon hash: %v", err)
 			return user, err
 		}
-	} else if strings.HasPrefix(user.Password, bcryptPwdPrefix) {
+	} else if utils.IsStringPrefixInSlice(user.Password, bcryptPwdPrefixes) {
 		if err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
 			providerLog(logger.LevelWarn, "error comparing password with bcrypt hash: %v", err)
 			return user, err
@@ -874,14 +2328,20 @@ func checkUserAndPass(user User, password string) (User, error) {
 		if err != nil {
 			return user, err
 		}
-	} else if utils.IsStringPrefixInSlice(user.Password, unixPwdPrefixes) {
+	} else if utils.IsStringPrefixInSlice(user.Password, unixPwdPrefixes) || isDESCryptHash(user.Password) {
 		match, err = compareUnixPasswordAndHash(user, password)
 		if err != nil {
 			return user, err
 		}
 	}
 	if !match {
-		err = errors.New("Invalid credentials")
+		return user, errors.New("Invalid credentials")
+	}
+	if user.IsPasswordExpired() {
+		return user, fmt.Errorf("password for user %#v is expired, it was changed %v days ago, the maximum age is %v days, "+
+			"please ask your administrator to change it", user.Username,
+			int(time.Since(utils.GetTimeFromMsecSinceEpoch(user.LastPasswordChange))/(24*time.Hour)),
+			user.GetPasswordExpiration())
 	}
 	return user, err
 }
@@ -911,7 +2371,27 @@ func checkUserAndPubKey(user User, pubKey string) (User, string, error) {
 func compareUnixPasswordAndHash(user User, password string) (bool, error) {
 	match := false
 	var err error
-	if strings.HasPrefix(user.Password, sha512cryptPwdPrefix) {
+	if isDESCryptHash(user.Password) {
+		match, err = compareDESCryptPasswordAndHash(password, user.Password)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error comparing password with DES crypt hash: %v", err)
+			return match, err
+		}
+		if !match {
+			return match, errWrongPassword
+		}
+	} else if strings.HasPrefix(user.Password, sha256cryptPwdPrefix) {
+		crypter, ok := unixcrypt.SHA256.CrypterFound(user.Password)
+		if !ok {
+			err = errors.New("cannot found matching SHA256 crypter")
+			providerLog(logger.LevelWarn, "error comparing password with SHA256 crypt hash: %v", err)
+			return match, err
+		}
+		if !crypter.Verify([]byte(password)) {
+			return match, errWrongPassword
+		}
+		match = true
+	} else if strings.HasPrefix(user.Password, sha512cryptPwdPrefix) {
 		crypter, ok := unixcrypt.SHA512.CrypterFound(user.Password)
 		if !ok {
 			err = errors.New("cannot found matching SHA512 crypter")
@@ -973,10 +2453,18 @@ func comparePbkdf2PasswordAndHash(password, hashedPassword string) (bool, error)
 // HideUserSensitiveData hides user sensitive data
 func HideUserSensitiveData(user *User) User {
 	user.Password = ""
+	user.Filters.TOTPSecret = utils.RemoveDecryptionKey(user.Filters.TOTPSecret)
+	user.FsConfig.CryptConfig.Passphrase = utils.RemoveDecryptionKey(user.FsConfig.CryptConfig.Passphrase)
 	if user.FsConfig.Provider == 1 {
 		user.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(user.FsConfig.S3Config.AccessSecret)
 	} else if user.FsConfig.Provider == 2 {
 		user.FsConfig.GCSConfig.Credentials = ""
+	} else if user.FsConfig.Provider == 3 {
+		user.FsConfig.AzBlobConfig.AccountKey = utils.RemoveDecryptionKey(user.FsConfig.AzBlobConfig.AccountKey)
+		user.FsConfig.AzBlobConfig.SASURL = utils.RemoveDecryptionKey(user.FsConfig.AzBlobConfig.SASURL)
+	} else if user.FsConfig.Provider == 4 {
+		user.FsConfig.SFTPConfig.Password = utils.RemoveDecryptionKey(user.FsConfig.SFTPConfig.Password)
+		user.FsConfig.SFTPConfig.PrivateKey = utils.RemoveDecryptionKey(user.FsConfig.SFTPConfig.PrivateKey)
 	}
 	return *user
 }
@@ -996,8 +2484,44 @@ func addCredentialsToUser(user *User) error {
 	return nil
 }
 
+// getConfigFilePath returns the absolute path for the given file name,
+// relative paths are resolved against the config dir
+func getConfigFilePath(name, basePath string) string {
+	if len(name) == 0 || filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(basePath, name)
+}
+
+// validateSQLTLSConfig checks the ssl mode and resolves the paths for the CA bundle and the client
+// certificate. The files must be readable if SSL/TLS is enabled for a driver using them
+func validateSQLTLSConfig(basePath string) error {
+	if config.SSLMode < 0 || config.SSLMode > 3 {
+		return fmt.Errorf("invalid sslmode %v, supported values: 0, 1, 2, 3", config.SSLMode)
+	}
+	config.RootCert = getConfigFilePath(config.RootCert, basePath)
+	config.ClientCert = getConfigFilePath(config.ClientCert, basePath)
+	config.ClientKey = getConfigFilePath(config.ClientKey, basePath)
+	if (len(config.ClientCert) == 0) != (len(config.ClientKey) == 0) {
+		return errors.New("the client certificate and the client key must be both set or both empty")
+	}
+	if config.SSLMode == 0 || !utils.IsStringInSlice(config.Driver, []string{PGSQLDataProviderName,
+		MySQLDataProviderName, CockroachDataProviderName}) {
+		return nil
+	}
+	for _, name := range []string{config.RootCert, config.ClientCert, config.ClientKey} {
+		if len(name) == 0 {
+			continue
+		}
+		if _, err := ioutil.ReadFile(name); err != nil {
+			return fmt.Errorf("unable to read the SSL/TLS file %#v: %v", name, err)
+		}
+	}
+	return nil
+}
+
 func getSSLMode() string {
-	if config.Driver == PGSQLDataProviderName {
+	if config.Driver == PGSQLDataProviderName || config.Driver == CockroachDataProviderName {
 		if config.SSLMode == 0 {
 			return "disable"
 		} else if config.SSLMode == 1 {
@@ -1071,28 +2595,54 @@ func terminateInteractiveAuthProgram(cmd *exec.Cmd, isFinished bool) {
 	cmd.Process.Kill()
 }
 
-func handleInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
-	user User, stdin io.WriteCloser) error {
+func validateKeyboardAuthResponse(response keyboardAuthProgramResponse) error {
+	if len(response.Questions) == 0 {
+		err := errors.New("interactive auth error: response does not contain questions")
+		providerLog(logger.LevelInfo, "%v", err)
+		return err
+	}
+	if len(response.Questions) != len(response.Echos) {
+		err := fmt.Errorf("interactive auth error, response questions don't match echos: %v %v",
+			len(response.Questions), len(response.Echos))
+		providerLog(logger.LevelInfo, "%v", err)
+		return err
+	}
+	return nil
+}
+
+// getKeyboardInteractiveAnswers asks the questions to the client and returns its answers.
+// If the password check is requested, the user password is verified and the answer is replaced with "OK"
+func getKeyboardInteractiveAnswers(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
+	user User) ([]string, error) {
 	questions := response.Questions
 	answers, err := client(user.Username, response.Instruction, questions, response.Echos)
 	if err != nil {
 		providerLog(logger.LevelInfo, "error getting interactive auth client response: %v", err)
-		return err
+		return answers, err
 	}
 	if len(answers) != len(questions) {
 		err = fmt.Errorf("client answers does not match questions, expected: %v actual: %v", questions, answers)
 		providerLog(logger.LevelInfo, "keyboard interactive auth error: %v", err)
-		return err
+		return answers, err
 	}
 	if len(answers) == 1 && response.CheckPwd > 0 {
 		_, err = checkUserAndPass(user, answers[0])
-		providerLog(logger.LevelInfo, "interactive auth program requested password validation for user %#v, validation error: %v",
+		providerLog(logger.LevelInfo, "interactive auth hook requested password validation for user %#v, validation error: %v",
 			user.Username, err)
 		if err != nil {
-			return err
+			return answers, err
 		}
 		answers[0] = "OK"
 	}
+	return answers, nil
+}
+
+func handleProgramInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, response keyboardAuthProgramResponse,
+	user User, stdin io.WriteCloser) error {
+	answers, err := getKeyboardInteractiveAnswers(client, response, user)
+	if err != nil {
+		return err
+	}
 	for _, answer := range answers {
 		if runtime.GOOS == "windows" {
 			answer += "\r"
@@ -1107,7 +2657,98 @@ func handleInteractiveQuestions(client ssh.KeyboardInteractiveChallenge, respons
 	return nil
 }
 
-func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.KeyboardInteractiveChallenge) (User, error) {
+// doTOTPKeyboardInteractiveAuth asks for the password and then for the TOTP authentication code
+func doTOTPKeyboardInteractiveAuth(user User, client ssh.KeyboardInteractiveChallenge) (User, error) {
+	answers, err := client(user.Username, "", []string{"Password: "}, []bool{false})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, fmt.Errorf("unexpected number of client answers for the password challenge: %v", len(answers))
+	}
+	user, err = checkUserAndPass(user, answers[0])
+	if err != nil {
+		return user, err
+	}
+	upgradeUserPasswordHash(&user, answers[0])
+	answers, err = client(user.Username, "", []string{"Authentication code: "}, []bool{false})
+	if err != nil {
+		return user, err
+	}
+	if len(answers) != 1 {
+		return user, fmt.Errorf("unexpected number of client answers for the TOTP challenge: %v", len(answers))
+	}
+	return user, checkTOTPCode(user, answers[0])
+}
+
+func checkTOTPCode(user User, code string) error {
+	secret, err := kms.Decrypt(user.Filters.TOTPSecret)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to decrypt TOTP secret for user %#v: %v", user.Username, err)
+		return err
+	}
+	if !utils.ValidateTOTPCode(secret, code) {
+		providerLog(logger.LevelInfo, "invalid TOTP code for user %#v", user.Username)
+		return errInvalidTOTPCode
+	}
+	return nil
+}
+
+func executeKeyboardInteractiveHTTPHook(user User, authHook string, client ssh.KeyboardInteractiveChallenge,
+	ip string) (int, error) {
+	authResult := 0
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	req := keyboardAuthHookRequest{
+		RequestID: xid.New().String(),
+		Username:  user.Username,
+		IP:        ip,
+		Password:  user.Password,
+	}
+	httpClient := &http.Client{}
+	for {
+		reqAsJSON, err := json.Marshal(req)
+		if err != nil {
+			return authResult, err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, authHook, bytes.NewBuffer(reqAsJSON))
+		if err != nil {
+			return authResult, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		resp, err := httpClient.Do(httpReq)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error getting keyboard interactive auth hook HTTP response: %v", err)
+			return authResult, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return authResult, fmt.Errorf("wrong keyboard interactive auth hook HTTP status code: %v", resp.StatusCode)
+		}
+		var response keyboardAuthProgramResponse
+		err = json.NewDecoder(resp.Body).Decode(&response)
+		resp.Body.Close()
+		if err != nil {
+			providerLog(logger.LevelInfo, "interactive auth error parsing HTTP response: %v", err)
+			return authResult, err
+		}
+		if response.AuthResult != 0 {
+			return response.AuthResult, nil
+		}
+		if err = validateKeyboardAuthResponse(response); err != nil {
+			return authResult, err
+		}
+		answers, err := getKeyboardInteractiveAnswers(client, response, user)
+		if err != nil {
+			return authResult, err
+		}
+		req.Answers = answers
+		req.Questions = response.Questions
+	}
+}
+
+func executeKeyboardInteractiveProgram(user User, authProgram string, client ssh.KeyboardInteractiveChallenge) (int, error) {
+	authResult := 0
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 	cmd := exec.CommandContext(ctx, authProgram)
@@ -1116,19 +2757,18 @@ func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.Keyboar
 		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", user.Password))
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return user, err
+		return authResult, err
 	}
 	stdin, err := cmd.StdinPipe()
 	if err != nil {
-		return user, err
+		return authResult, err
 	}
 	err = cmd.Start()
 	if err != nil {
-		return user, err
+		return authResult, err
 	}
 	var once sync.Once
 	scanner := bufio.NewScanner(stdout)
-	authResult := 0
 	for scanner.Scan() {
 		var response keyboardAuthProgramResponse
 		err := json.Unmarshal(scanner.Bytes(), &response)
@@ -1141,19 +2781,12 @@ func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.Keyboar
 			authResult = response.AuthResult
 			break
 		}
-		if len(response.Questions) == 0 {
-			providerLog(logger.LevelInfo, "interactive auth error: program response does not contain questions")
-			once.Do(func() { terminateInteractiveAuthProgram(cmd, false) })
-			break
-		}
-		if len(response.Questions) != len(response.Echos) {
-			providerLog(logger.LevelInfo, "interactive auth error, program response questions don't match echos: %v %v",
-				len(response.Questions), len(response.Echos))
+		if err = validateKeyboardAuthResponse(response); err != nil {
 			once.Do(func() { terminateInteractiveAuthProgram(cmd, false) })
 			break
 		}
 		go func() {
-			err := handleInteractiveQuestions(client, response, user, stdin)
+			err := handleProgramInteractiveQuestions(client, response, user, stdin)
 			if err != nil {
 				once.Do(func() { terminateInteractiveAuthProgram(cmd, false) })
 			}
@@ -1162,6 +2795,20 @@ func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.Keyboar
 	stdin.Close()
 	once.Do(func() { terminateInteractiveAuthProgram(cmd, true) })
 	go cmd.Process.Wait()
+	return authResult, nil
+}
+
+func doKeyboardInteractiveAuth(user User, authHook string, client ssh.KeyboardInteractiveChallenge, ip string) (User, error) {
+	var authResult int
+	var err error
+	if strings.HasPrefix(authHook, "http") {
+		authResult, err = executeKeyboardInteractiveHTTPHook(user, authHook, client, ip)
+	} else {
+		authResult, err = executeKeyboardInteractiveProgram(user, authHook, client)
+	}
+	if err != nil {
+		return user, err
+	}
 	if authResult != 1 {
 		return user, fmt.Errorf("keyboard interactive auth failed, result: %v", authResult)
 	}
@@ -1172,28 +2819,69 @@ func doKeyboardInteractiveAuth(user User, authProgram string, client ssh.Keyboar
 	return user, nil
 }
 
-func executePreLoginProgram(username, loginMethod string) (User, error) {
-	u, err := provider.userExists(username)
-	if err != nil {
-		return u, err
-	}
-	userAsJSON, err := json.Marshal(u)
-	if err != nil {
-		return u, err
+func getPreLoginHookResponse(loginMethod, ip string, userAsJSON []byte) ([]byte, error) {
+	if strings.HasPrefix(config.PreLoginHook, "http") {
+		var result []byte
+		url, err := url.Parse(config.PreLoginHook)
+		if err != nil {
+			return result, fmt.Errorf("Invalid pre-login hook %#v: %v", config.PreLoginHook, err)
+		}
+		q := url.Query()
+		q.Add("login_method", loginMethod)
+		q.Add("ip", ip)
+		url.RawQuery = q.Encode()
+		httpClient := &http.Client{
+			Timeout: 60 * time.Second,
+		}
+		resp, err := httpClient.Post(url.String(), "application/json", bytes.NewBuffer(userAsJSON))
+		if err != nil {
+			providerLog(logger.LevelWarn, "error getting pre-login hook HTTP response: %v", err)
+			return result, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNoContent {
+			return result, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return result, fmt.Errorf("wrong pre-login hook HTTP status code: %v", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
 	}
-
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
-	cmd := exec.CommandContext(ctx, config.PreLoginProgram)
+	cmd := exec.CommandContext(ctx, config.PreLoginHook)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("SFTPGO_LOGIND_USER=%v", string(userAsJSON)),
-		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%v", loginMethod))
-	out, err := cmd.Output()
+		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%v", loginMethod),
+		fmt.Sprintf("SFTPGO_LOGIND_IP=%v", ip))
+	return cmd.Output()
+}
+
+func executePreLoginHook(username, loginMethod, ip string) (User, error) {
+	u, userErr := provider.userExists(username)
+	if userErr != nil {
+		if _, ok := userErr.(*RecordNotFoundError); !ok {
+			return u, userErr
+		}
+		// the hook can create the user
+		u = User{
+			ID:       0,
+			Username: username,
+		}
+	}
+	userAsJSON, err := json.Marshal(u)
+	if err != nil {
+		return u, err
+	}
+	out, err := getPreLoginHookResponse(loginMethod, ip, userAsJSON)
 	if err != nil {
-		return u, fmt.Errorf("Before login program error: %v", err)
+		return u, fmt.Errorf("Pre-login hook error: %v", err)
 	}
 	if len(strings.TrimSpace(string(out))) == 0 {
-		providerLog(logger.LevelDebug, "empty response from before login program, no modification needed for user %#v", username)
+		providerLog(logger.LevelDebug, "empty response from pre-login hook, no modification needed for user %#v", username)
+		if u.ID == 0 {
+			return u, userErr
+		}
 		return u, nil
 	}
 
@@ -1201,47 +2889,199 @@ func executePreLoginProgram(username, loginMethod string) (User, error) {
 	userUsedQuotaSize := u.UsedQuotaSize
 	userUsedQuotaFiles := u.UsedQuotaFiles
 	userLastQuotaUpdate := u.LastQuotaUpdate
+	userUsedUploadDataTransfer := u.UsedUploadDataTransfer
+	userUsedDownloadDataTransfer := u.UsedDownloadDataTransfer
+	userLastDataTransferReset := u.LastDataTransferReset
 	userLastLogin := u.LastLogin
 	err = json.Unmarshal(out, &u)
 	if err != nil {
-		return u, fmt.Errorf("Invalid before login program response %#v, error: %v", string(out), err)
+		return u, fmt.Errorf("Invalid pre-login hook response %#v, error: %v", string(out), err)
 	}
 	u.ID = userID
 	u.UsedQuotaSize = userUsedQuotaSize
 	u.UsedQuotaFiles = userUsedQuotaFiles
 	u.LastQuotaUpdate = userLastQuotaUpdate
+	u.UsedUploadDataTransfer = userUsedUploadDataTransfer
+	u.UsedDownloadDataTransfer = userUsedDownloadDataTransfer
+	u.LastDataTransferReset = userLastDataTransferReset
 	u.LastLogin = userLastLogin
-	err = provider.updateUser(u)
+	if userID == 0 {
+		err = provider.addUser(u)
+	} else {
+		err = provider.updateUser(u)
+	}
 	if err != nil {
 		return u, err
 	}
-	providerLog(logger.LevelDebug, "user %#v updated from before login program response", username)
-	return provider.userExists(username)
+	providerLog(logger.LevelDebug, "user %#v added/updated from pre-login hook response, id: %v", username, userID)
+	u, err = provider.userExists(username)
+	u.sessionOverrides = getSessionOverridesFromHookResponse(out)
+	return u, err
 }
 
-func doExternalAuth(username, password, pubKey, keyboardInteractive string) (User, error) {
-	var user User
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+// ExecutePostLoginHook executes the post login hook, if defined, in a goroutine.
+// loginErr is the login result, nil means successful login
+func ExecutePostLoginHook(username, loginMethod, ip, protocol string, loginErr error) {
+	if len(config.PostLoginHook) == 0 {
+		return
+	}
+	if config.PostLoginScope == 1 && loginErr == nil {
+		return
+	}
+	if config.PostLoginScope == 2 && loginErr != nil {
+		return
+	}
+	notification := postLoginNotification{
+		Username:    username,
+		IP:          ip,
+		LoginMethod: loginMethod,
+		Protocol:    protocol,
+		Status:      1,
+	}
+	if loginErr != nil {
+		notification.Status = 0
+	}
+	go executePostLoginHook(notification)
+}
+
+func executePostLoginHook(notification postLoginNotification) {
+	startTime := time.Now()
+	if strings.HasPrefix(config.PostLoginHook, "http") {
+		notificationAsJSON, err := json.Marshal(notification)
+		if err != nil {
+			return
+		}
+		httpClient := &http.Client{
+			Timeout: 20 * time.Second,
+		}
+		resp, err := httpClient.Post(config.PostLoginHook, "application/json", bytes.NewBuffer(notificationAsJSON))
+		respCode := 0
+		if err == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
+		}
+		providerLog(logger.LevelDebug, "post login hook executed for user %#v, ip: %v, protocol: %v, status code: %v, elapsed: %v err: %v",
+			notification.Username, notification.IP, notification.Protocol, respCode, time.Since(startTime), err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
 	defer cancel()
-	pkey := ""
-	if len(pubKey) > 0 {
-		k, err := ssh.ParsePublicKey([]byte(pubKey))
+	cmd := exec.CommandContext(ctx, config.PostLoginHook)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("SFTPGO_LOGIND_USERNAME=%v", notification.Username),
+		fmt.Sprintf("SFTPGO_LOGIND_IP=%v", notification.IP),
+		fmt.Sprintf("SFTPGO_LOGIND_METHOD=%v", notification.LoginMethod),
+		fmt.Sprintf("SFTPGO_LOGIND_PROTOCOL=%v", notification.Protocol),
+		fmt.Sprintf("SFTPGO_LOGIND_STATUS=%v", notification.Status))
+	err := cmd.Run()
+	providerLog(logger.LevelDebug, "post login hook executed for user %#v, ip: %v, protocol: %v, elapsed: %v err: %v",
+		notification.Username, notification.IP, notification.Protocol, time.Since(startTime), err)
+}
+
+func validateHookURL(hookURL string) error {
+	u, err := url.Parse(hookURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%#v is not an HTTP/HTTPS URL", hookURL)
+	}
+	if len(u.Host) == 0 {
+		return fmt.Errorf("%#v has no host", hookURL)
+	}
+	return nil
+}
+
+func getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip string) ([]byte, error) {
+	if strings.HasPrefix(config.ExternalAuthHook, "http") {
+		var result []byte
+		authRequest := externalAuthRequest{
+			Username:            username,
+			IP:                  ip,
+			Password:            password,
+			PublicKey:           pkey,
+			KeyboardInteractive: keyboardInteractive,
+		}
+		authRequestAsJSON, err := json.Marshal(authRequest)
 		if err != nil {
-			return user, err
+			return result, fmt.Errorf("External auth error: %v", err)
 		}
-		pkey = string(ssh.MarshalAuthorizedKey(k))
+		httpClient := &http.Client{
+			Timeout: 60 * time.Second,
+		}
+		resp, err := httpClient.Post(config.ExternalAuthHook, "application/json", bytes.NewBuffer(authRequestAsJSON))
+		if err != nil {
+			providerLog(logger.LevelWarn, "error getting external auth hook HTTP response: %v", err)
+			return result, fmt.Errorf("External auth error: %v", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return result, fmt.Errorf("External auth error, wrong HTTP status code: %v", resp.StatusCode)
+		}
+		return ioutil.ReadAll(resp.Body)
 	}
-	cmd := exec.CommandContext(ctx, config.ExternalAuthProgram)
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.ExternalAuthHook)
 	cmd.Env = append(os.Environ(),
 		fmt.Sprintf("SFTPGO_AUTHD_USERNAME=%v", username),
+		fmt.Sprintf("SFTPGO_AUTHD_IP=%v", ip),
 		fmt.Sprintf("SFTPGO_AUTHD_PASSWORD=%v", password),
 		fmt.Sprintf("SFTPGO_AUTHD_PUBLIC_KEY=%v", pkey),
 		fmt.Sprintf("SFTPGO_AUTHD_KEYBOARD_INTERACTIVE=%v", keyboardInteractive))
 	out, err := cmd.Output()
 	if err != nil {
-		return user, fmt.Errorf("External auth error: %v", err)
+		return out, fmt.Errorf("External auth error: %v", err)
+	}
+	return out, nil
+}
+
+func doExternalAuth(username, password, pubKey, keyboardInteractive, ip string) (User, error) {
+	var user User
+	pkey := ""
+	if len(pubKey) > 0 {
+		k, err := ssh.ParsePublicKey([]byte(pubKey))
+		if err != nil {
+			return user, err
+		}
+		pkey = string(ssh.MarshalAuthorizedKey(k))
+	}
+	out, err := getExternalAuthResponse(username, password, pkey, keyboardInteractive, ip)
+	if err != nil {
+		return user, err
+	}
+	return saveExternallyAuthenticatedUser(username, password, pkey, out)
+}
+
+// doPluginAuth authenticates the user using the auth plugins for the given scope
+func doPluginAuth(username, password, pubKey, ip string, scope int) (User, error) {
+	var user User
+	pkey := ""
+	if len(pubKey) > 0 {
+		k, err := ssh.ParsePublicKey([]byte(pubKey))
+		if err != nil {
+			return user, err
+		}
+		pkey = string(ssh.MarshalAuthorizedKey(k))
+	}
+	out, err := plugin.Handler.Authenticate(scope, plugin.AuthRequest{
+		Username:            username,
+		IP:                  ip,
+		Password:            password,
+		PublicKey:           pkey,
+		KeyboardInteractive: scope == plugin.AuthScopeKeyboardInteractive,
+	})
+	if err != nil {
+		return user, err
 	}
-	err = json.Unmarshal(out, &user)
+	return saveExternallyAuthenticatedUser(username, password, pkey, out)
+}
+
+// saveExternallyAuthenticatedUser adds or updates the user returned, as JSON, by the
+// external auth hook or by an auth plugin. The quota and login details are preserved
+func saveExternallyAuthenticatedUser(username, password, pkey string, out []byte) (User, error) {
+	var user User
+	err := json.Unmarshal(out, &user)
 	if err != nil {
 		return user, fmt.Errorf("Invalid external auth response: %v", err)
 	}
@@ -1260,6 +3100,9 @@ func doExternalAuth(username, password, pubKey, keyboardInteractive string) (Use
 		user.UsedQuotaSize = u.UsedQuotaSize
 		user.UsedQuotaFiles = u.UsedQuotaFiles
 		user.LastQuotaUpdate = u.LastQuotaUpdate
+		user.UsedUploadDataTransfer = u.UsedUploadDataTransfer
+		user.UsedDownloadDataTransfer = u.UsedDownloadDataTransfer
+		user.LastDataTransferReset = u.LastDataTransferReset
 		user.LastLogin = u.LastLogin
 		err = provider.updateUser(user)
 	} else {
@@ -1268,6 +3111,52 @@ func doExternalAuth(username, password, pubKey, keyboardInteractive string) (Use
 	if err != nil {
 		return user, err
 	}
+	user, err = provider.userExists(username)
+	user.sessionOverrides = getSessionOverridesFromHookResponse(out)
+	return user, err
+}
+
+// doLDAPAuth verifies the credentials against the LDAP server and adds or updates the user.
+// The permissions and the groups are always replaced with the LDAP mapped ones, the other
+// settings of an existing user are preserved, so they can be managed as for any other user
+func doLDAPAuth(username, password string) (User, error) {
+	ldapUser, err := config.LDAP.Authenticate(username, password)
+	if err != nil {
+		if err != ldap.ErrInvalidCredentials {
+			providerLog(logger.LevelWarn, "LDAP authentication error for user %#v: %v", username, err)
+		}
+		return User{}, err
+	}
+	providerLog(logger.LevelDebug, "user %#v authenticated as LDAP user %#v, permissions: %+v, groups: %+v",
+		username, ldapUser.DN, ldapUser.Permissions, ldapUser.Groups)
+	user, err := provider.userExists(username)
+	if err != nil {
+		user = User{
+			Username: username,
+			Status:   1,
+		}
+	}
+	user.Password = password
+	user.Permissions = ldapUser.Permissions
+	user.Groups = ldapUser.Groups
+	if len(config.LDAP.HomeDirTemplate) > 0 {
+		user.HomeDir = ldapUser.HomeDir
+	}
+	if len(config.LDAP.UIDAttribute) > 0 {
+		user.UID = ldapUser.UID
+	}
+	if len(config.LDAP.GIDAttribute) > 0 {
+		user.GID = ldapUser.GID
+	}
+	if user.ID > 0 {
+		err = provider.updateUser(user)
+	} else {
+		err = provider.addUser(user)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to save the LDAP user %#v: %v", username, err)
+		return user, err
+	}
 	return provider.userExists(username)
 }
 
@@ -1290,7 +3179,9 @@ func executeNotificationCommand(operation string, user User) error {
 
 // executed in a goroutine
 func executeAction(operation string, user User) {
-	if !utils.IsStringInSlice(operation, config.Actions.ExecuteOn) {
+	executeOn := utils.IsStringInSlice(operation, config.Actions.ExecuteOn)
+	notifyPlugins := plugin.Handler.HasUserEventNotifier(operation)
+	if !executeOn && !notifyPlugins {
 		return
 	}
 	if operation != operationDelete {
@@ -1301,6 +3192,16 @@ func executeAction(operation string, user User) {
 			return
 		}
 	}
+	if notifyPlugins {
+		pluginUser := user
+		HideUserSensitiveData(&pluginUser)
+		if userAsJSON, err := json.Marshal(pluginUser); err == nil {
+			plugin.Handler.NotifyUserEvent(operation, user.Username, userAsJSON)
+		}
+	}
+	if !executeOn {
+		return
+	}
 	if len(config.Actions.Command) > 0 && filepath.IsAbs(config.Actions.Command) {
 		// we are in a goroutine but if we have to send an HTTP notification we don't want to wait for the
 		// end of the command
@@ -0,0 +1,80 @@
+package dataprovider
+
+import (
+	"sort"
+	"time"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// DefenderEntry defines a host tracked by the defender when its state is shared using the data provider
+type DefenderEntry struct {
+	IP string `json:"ip"`
+	// Score within the requested observation window, it is 0 for banned hosts
+	Score int `json:"score"`
+	// Ban expiration as unix timestamp in milliseconds, 0 if the host is not banned
+	BanTime int64 `json:"ban_time"`
+}
+
+// IsBanned returns true if the ban for the host is not expired
+func (e *DefenderEntry) IsBanned() bool {
+	return e.BanTime > utils.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// isTracked returns true if the given entry is banned or has a score
+func (e *DefenderEntry) isTracked() bool {
+	return e.BanTime > 0 || e.Score > 0
+}
+
+// defenderEvent is a scored event, it is used by the memory and bolt providers
+type defenderEvent struct {
+	DateTime int64 `json:"date_time"`
+	Score    int   `json:"score"`
+}
+
+// defenderHost defines the state for a host, it is used by the memory and bolt providers
+type defenderHost struct {
+	IP      string          `json:"ip"`
+	BanTime int64           `json:"ban_time"`
+	Events  []defenderEvent `json:"events,omitempty"`
+}
+
+// getEntry returns the defender entry considering only the events after from
+func (h *defenderHost) getEntry(from int64) DefenderEntry {
+	entry := DefenderEntry{
+		IP: h.IP,
+	}
+	if h.BanTime > utils.GetTimeAsMsSinceEpoch(time.Now()) {
+		entry.BanTime = h.BanTime
+		return entry
+	}
+	for _, ev := range h.Events {
+		if ev.DateTime > from {
+			entry.Score += ev.Score
+		}
+	}
+	return entry
+}
+
+// cleanup removes the events before from and returns false if the host
+// has no events and its ban expired before from, so it can be removed
+func (h *defenderHost) cleanup(from int64) bool {
+	var events []defenderEvent
+	for _, ev := range h.Events {
+		if ev.DateTime > from {
+			events = append(events, ev)
+		}
+	}
+	h.Events = events
+	return len(h.Events) > 0 || h.BanTime >= from
+}
+
+func sortDefenderEntries(entries []DefenderEntry, limit int) []DefenderEntry {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].IP < entries[j].IP
+	})
+	if limit > 0 && len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
@@ -0,0 +1,216 @@
+package dataprovider
+
+import (
+	"crypto/subtle"
+	"errors"
+	"strings"
+)
+
+// traditional DES based crypt(3) hashes have no identifier, they are 13 chars long:
+// the 2 chars salt and 11 chars encoding the 64 bits hash, for example "abJnggxhB/yWI"
+const descryptHashLen = 13
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// DES tables as defined in FIPS 46-3, the bit positions start from 1 for the most significant bit
+var (
+	desInitialPermutation = []byte{
+		58, 50, 42, 34, 26, 18, 10, 2, 60, 52, 44, 36, 28, 20, 12, 4,
+		62, 54, 46, 38, 30, 22, 14, 6, 64, 56, 48, 40, 32, 24, 16, 8,
+		57, 49, 41, 33, 25, 17, 9, 1, 59, 51, 43, 35, 27, 19, 11, 3,
+		61, 53, 45, 37, 29, 21, 13, 5, 63, 55, 47, 39, 31, 23, 15, 7,
+	}
+	desFinalPermutation = []byte{
+		40, 8, 48, 16, 56, 24, 64, 32, 39, 7, 47, 15, 55, 23, 63, 31,
+		38, 6, 46, 14, 54, 22, 62, 30, 37, 5, 45, 13, 53, 21, 61, 29,
+		36, 4, 44, 12, 52, 20, 60, 28, 35, 3, 43, 11, 51, 19, 59, 27,
+		34, 2, 42, 10, 50, 18, 58, 26, 33, 1, 41, 9, 49, 17, 57, 25,
+	}
+	desExpansion = []byte{
+		32, 1, 2, 3, 4, 5, 4, 5, 6, 7, 8, 9,
+		8, 9, 10, 11, 12, 13, 12, 13, 14, 15, 16, 17,
+		16, 17, 18, 19, 20, 21, 20, 21, 22, 23, 24, 25,
+		24, 25, 26, 27, 28, 29, 28, 29, 30, 31, 32, 1,
+	}
+	desPermutation = []byte{
+		16, 7, 20, 21, 29, 12, 28, 17, 1, 15, 23, 26, 5, 18, 31, 10,
+		2, 8, 24, 14, 32, 27, 3, 9, 19, 13, 30, 6, 22, 11, 4, 25,
+	}
+	desPermutedChoice1 = []byte{
+		57, 49, 41, 33, 25, 17, 9, 1, 58, 50, 42, 34, 26, 18,
+		10, 2, 59, 51, 43, 35, 27, 19, 11, 3, 60, 52, 44, 36,
+		63, 55, 47, 39, 31, 23, 15, 7, 62, 54, 46, 38, 30, 22,
+		14, 6, 61, 53, 45, 37, 29, 21, 13, 5, 28, 20, 12, 4,
+	}
+	desPermutedChoice2 = []byte{
+		14, 17, 11, 24, 1, 5, 3, 28, 15, 6, 21, 10,
+		23, 19, 12, 4, 26, 8, 16, 7, 27, 20, 13, 2,
+		41, 52, 31, 37, 47, 55, 30, 40, 51, 45, 33, 48,
+		44, 49, 39, 56, 34, 53, 46, 42, 50, 36, 29, 32,
+	}
+	desKeyShifts = []uint{1, 1, 2, 2, 2, 2, 2, 2, 1, 2, 2, 2, 2, 2, 2, 1}
+	desSBoxes    = [8][64]byte{
+		{
+			14, 4, 13, 1, 2, 15, 11, 8, 3, 10, 6, 12, 5, 9, 0, 7,
+			0, 15, 7, 4, 14, 2, 13, 1, 10, 6, 12, 11, 9, 5, 3, 8,
+			4, 1, 14, 8, 13, 6, 2, 11, 15, 12, 9, 7, 3, 10, 5, 0,
+			15, 12, 8, 2, 4, 9, 1, 7, 5, 11, 3, 14, 10, 0, 6, 13,
+		},
+		{
+			15, 1, 8, 14, 6, 11, 3, 4, 9, 7, 2, 13, 12, 0, 5, 10,
+			3, 13, 4, 7, 15, 2, 8, 14, 12, 0, 1, 10, 6, 9, 11, 5,
+			0, 14, 7, 11, 10, 4, 13, 1, 5, 8, 12, 6, 9, 3, 2, 15,
+			13, 8, 10, 1, 3, 15, 4, 2, 11, 6, 7, 12, 0, 5, 14, 9,
+		},
+		{
+			10, 0, 9, 14, 6, 3, 15, 5, 1, 13, 12, 7, 11, 4, 2, 8,
+			13, 7, 0, 9, 3, 4, 6, 10, 2, 8, 5, 14, 12, 11, 15, 1,
+			13, 6, 4, 9, 8, 15, 3, 0, 11, 1, 2, 12, 5, 10, 14, 7,
+			1, 10, 13, 0, 6, 9, 8, 7, 4, 15, 14, 3, 11, 5, 2, 12,
+		},
+		{
+			7, 13, 14, 3, 0, 6, 9, 10, 1, 2, 8, 5, 11, 12, 4, 15,
+			13, 8, 11, 5, 6, 15, 0, 3, 4, 7, 2, 12, 1, 10, 14, 9,
+			10, 6, 9, 0, 12, 11, 7, 13, 15, 1, 3, 14, 5, 2, 8, 4,
+			3, 15, 0, 6, 10, 1, 13, 8, 9, 4, 5, 11, 12, 7, 2, 14,
+		},
+		{
+			2, 12, 4, 1, 7, 10, 11, 6, 8, 5, 3, 15, 13, 0, 14, 9,
+			14, 11, 2, 12, 4, 7, 13, 1, 5, 0, 15, 10, 3, 9, 8, 6,
+			4, 2, 1, 11, 10, 13, 7, 8, 15, 9, 12, 5, 6, 3, 0, 14,
+			11, 8, 12, 7, 1, 14, 2, 13, 6, 15, 0, 9, 10, 4, 5, 3,
+		},
+		{
+			12, 1, 10, 15, 9, 2, 6, 8, 0, 13, 3, 4, 14, 7, 5, 11,
+			10, 15, 4, 2, 7, 12, 9, 5, 6, 1, 13, 14, 0, 11, 3, 8,
+			9, 14, 15, 5, 2, 8, 12, 3, 7, 0, 4, 10, 1, 13, 11, 6,
+			4, 3, 2, 12, 9, 5, 15, 10, 11, 14, 1, 7, 6, 0, 8, 13,
+		},
+		{
+			4, 11, 2, 14, 15, 0, 8, 13, 3, 12, 9, 7, 5, 10, 6, 1,
+			13, 0, 11, 7, 4, 9, 1, 10, 14, 3, 5, 12, 2, 15, 8, 6,
+			1, 4, 11, 13, 12, 3, 7, 14, 10, 15, 6, 8, 0, 5, 9, 2,
+			6, 11, 13, 8, 1, 4, 10, 7, 9, 5, 0, 15, 14, 2, 3, 12,
+		},
+		{
+			13, 2, 8, 4, 6, 15, 11, 1, 10, 9, 3, 14, 5, 0, 12, 7,
+			1, 15, 13, 8, 10, 3, 7, 4, 12, 5, 6, 11, 0, 14, 9, 2,
+			7, 11, 4, 1, 9, 12, 14, 2, 0, 6, 10, 13, 15, 3, 5, 8,
+			2, 1, 14, 7, 4, 10, 8, 13, 15, 12, 9, 0, 3, 5, 6, 11,
+		},
+	}
+)
+
+// permuteBits returns the bits of the given inBits wide value in the order defined by table
+func permuteBits(value uint64, inBits uint, table []byte) uint64 {
+	var result uint64
+	for _, pos := range table {
+		result = result<<1 | (value>>(inBits-uint(pos)))&1
+	}
+	return result
+}
+
+// desSubkeys returns the 16 round keys for the given 64 bits key
+func desSubkeys(key uint64) [16]uint64 {
+	var subkeys [16]uint64
+	cd := permuteBits(key, 64, desPermutedChoice1)
+	c := cd >> 28
+	d := cd & 0x0fffffff
+	for i, shift := range desKeyShifts {
+		c = (c<<shift | c>>(28-shift)) & 0x0fffffff
+		d = (d<<shift | d>>(28-shift)) & 0x0fffffff
+		subkeys[i] = permuteBits(c<<28|d, 56, desPermutedChoice2)
+	}
+	return subkeys
+}
+
+// desEncrypt encrypts a block using the given expansion table, crypt(3) modifies it based on the salt
+func desEncrypt(block uint64, subkeys *[16]uint64, expansion []byte) uint64 {
+	block = permuteBits(block, 64, desInitialPermutation)
+	left := block >> 32
+	right := block & 0xffffffff
+	for _, subkey := range subkeys {
+		expanded := permuteBits(right, 32, expansion) ^ subkey
+		var substituted uint64
+		for i := 0; i < 8; i++ {
+			chunk := (expanded >> uint(42-6*i)) & 0x3f
+			row := (chunk&0x20)>>4 | chunk&1
+			col := (chunk >> 1) & 0x0f
+			substituted = substituted<<4 | uint64(desSBoxes[i][row*16+col])
+		}
+		left, right = right, left^permuteBits(substituted, 32, desPermutation)
+	}
+	return permuteBits(right<<32|left, 64, desFinalPermutation)
+}
+
+// desCrypt computes the traditional crypt(3) hash for the given password using the two chars salt.
+// Only the first 8 chars of the password are used
+func desCrypt(password, salt string) (string, error) {
+	if len(salt) != 2 {
+		return "", errors.New("descrypt: invalid salt")
+	}
+	expansion := make([]byte, len(desExpansion))
+	copy(expansion, desExpansion)
+	for i := 0; i < 2; i++ {
+		value := strings.IndexByte(cryptAlphabet, salt[i])
+		if value < 0 {
+			return "", errors.New("descrypt: invalid salt")
+		}
+		for j := 0; j < 6; j++ {
+			if (value>>uint(j))&1 == 1 {
+				pos := 6*i + j
+				expansion[pos], expansion[pos+24] = expansion[pos+24], expansion[pos]
+			}
+		}
+	}
+	var key uint64
+	for i := 0; i < 8; i++ {
+		key <<= 8
+		if i < len(password) {
+			key |= uint64(password[i]<<1) & 0xff
+		}
+	}
+	subkeys := desSubkeys(key)
+	var block uint64
+	for i := 0; i < 25; i++ {
+		block = desEncrypt(block, &subkeys, expansion)
+	}
+	var sb strings.Builder
+	sb.WriteString(salt)
+	// 64 bits are encoded using 11 chars, the last one has only 4 significant bits
+	for i := 0; i < 11; i++ {
+		var value uint64
+		if i < 10 {
+			value = (block >> uint(58-6*i)) & 0x3f
+		} else {
+			value = (block & 0x0f) << 2
+		}
+		sb.WriteByte(cryptAlphabet[value])
+	}
+	return sb.String(), nil
+}
+
+// isDESCryptHash returns true if the given string has the format of a traditional crypt(3) hash
+// as stored in /etc/shadow: 13 chars from the crypt alphabet, the last one encodes only 4 bits
+func isDESCryptHash(hashedPassword string) bool {
+	if len(hashedPassword) != descryptHashLen {
+		return false
+	}
+	for i := 0; i < descryptHashLen; i++ {
+		if strings.IndexByte(cryptAlphabet, hashedPassword[i]) < 0 {
+			return false
+		}
+	}
+	return strings.IndexByte(cryptAlphabet, hashedPassword[descryptHashLen-1])&0x03 == 0
+}
+
+func compareDESCryptPasswordAndHash(password, hashed string) (bool, error) {
+	if len(hashed) != descryptHashLen {
+		return false, errors.New("descrypt: hash is not in the correct format")
+	}
+	computed, err := desCrypt(password, hashed[:2])
+	if err != nil {
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1, nil
+}
@@ -0,0 +1,280 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported event rule triggers
+const (
+	// EventTriggerSchedule runs the rule action when the cron schedule matches
+	EventTriggerSchedule = iota + 1
+	// EventTriggerFsEvent runs the rule action for the matching filesystem events
+	EventTriggerFsEvent
+)
+
+// Supported event rule actions
+const (
+	// EventActionCommand executes an external command
+	EventActionCommand = iota + 1
+	// EventActionHTTP sends a POST HTTP notification
+	EventActionHTTP
+	// EventActionQuotaScan starts a quota scan for the users with a quota
+	EventActionQuotaScan
+	// EventActionUserExpirationCheck disables the active users whose account is expired
+	EventActionUserExpirationCheck
+	// EventActionFolderCleanup removes the files older than the configured retention
+	EventActionFolderCleanup
+	// EventActionBackup dumps the data provider to the configured backup path
+	EventActionBackup
+	// EventActionDataRetention applies the configured data retention policies to the users
+	EventActionDataRetention
+)
+
+// SupportedFsEvents defines the filesystem events that can be used for the event rules
+var SupportedFsEvents = []string{"download", "upload", "delete", "rename", "ssh_cmd", "virus"}
+
+// EventConditions defines the conditions for an event rule
+type EventConditions struct {
+	// cron expression with five fields, for example "0 2 * * *".
+	// Required for schedule triggered rules
+	Schedule string `json:"schedule,omitempty"`
+	// filesystem events that run the rule: download, upload, delete, rename, ssh_cmd.
+	// Required for filesystem triggered rules
+	FsEvents []string `json:"fs_events,omitempty"`
+	// shell like patterns, for example "*.zip", matched against the file name.
+	// Empty means any file
+	Patterns []string `json:"patterns,omitempty"`
+	// the rule applies only to these users, empty means any user.
+	// For schedule triggered rules this restricts the users affected by the quota scans
+	Usernames []string `json:"usernames,omitempty"`
+}
+
+// EventAction defines the action executed for an event rule
+type EventAction struct {
+	Type int `json:"type"`
+	// absolute path to the command to execute for EventActionCommand
+	Command string `json:"command,omitempty"`
+	// URL to notify for EventActionHTTP
+	HTTPURL string `json:"http_url,omitempty"`
+	// timeout in seconds for commands and HTTP notifications, 0 means 30 seconds
+	Timeout int `json:"timeout,omitempty"`
+	// absolute paths to clean for EventActionFolderCleanup
+	Paths []string `json:"paths,omitempty"`
+	// files older than this number of hours are removed by EventActionFolderCleanup
+	RetentionHours int `json:"retention_hours,omitempty"`
+	// absolute path to the directory where EventActionBackup saves the dumps
+	BackupPath string `json:"backup_path,omitempty"`
+	// data retention policies for EventActionDataRetention, the report is notified to
+	// HTTPURL, if set
+	Retention []FolderRetention `json:"retention,omitempty"`
+}
+
+// FolderRetention defines the data retention policy for a user folder
+type FolderRetention struct {
+	// virtual path, the retention applies to the files inside the folder and its sub directories,
+	// unless a sub directory has its own policy
+	Path string `json:"path"`
+	// files older than this number of hours are deleted, 0 means the folder is excluded from the check
+	Retention int `json:"retention"`
+	// if true the empty sub directories are removed too
+	DeleteEmptyDirs bool `json:"delete_empty_dirs,omitempty"`
+}
+
+// RetentionCheck defines the data retention policies to apply to a user
+type RetentionCheck struct {
+	Folders []FolderRetention `json:"folders"`
+	// optional URL to notify the report to
+	HTTPURL string `json:"http_url,omitempty"`
+}
+
+// Validate returns an error if the retention check is not valid.
+// The folder paths are cleaned
+func (c *RetentionCheck) Validate() error {
+	if len(c.Folders) == 0 {
+		return &ValidationError{err: "at least one folder retention is required"}
+	}
+	paths := make(map[string]bool)
+	hasRetention := false
+	for idx := range c.Folders {
+		f := &c.Folders[idx]
+		if len(f.Path) == 0 {
+			return &ValidationError{err: "the folder path is required"}
+		}
+		if f.Retention < 0 {
+			return &ValidationError{err: fmt.Sprintf("invalid retention %v for folder %#v", f.Retention, f.Path)}
+		}
+		f.Path = utils.CleanSFTPPath(f.Path)
+		if paths[f.Path] {
+			return &ValidationError{err: fmt.Sprintf("duplicated folder %#v", f.Path)}
+		}
+		paths[f.Path] = true
+		if f.Retention > 0 {
+			hasRetention = true
+		}
+	}
+	if !hasRetention {
+		return &ValidationError{err: "at least one folder must have a retention greater than 0"}
+	}
+	if len(c.HTTPURL) > 0 {
+		return validateHTTPURL(c.HTTPURL)
+	}
+	return nil
+}
+
+// EventRule defines an action to execute on a schedule or when a filesystem event happens
+type EventRule struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique name, it cannot be changed
+	Name string `json:"name"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// 1 enabled, 0 disabled
+	Status int `json:"status"`
+	// EventTriggerSchedule or EventTriggerFsEvent
+	Trigger int `json:"trigger"`
+	// Conditions for the trigger
+	Conditions EventConditions `json:"conditions"`
+	// Action to execute
+	Action EventAction `json:"action"`
+}
+
+// GetConditionsAsJSON returns the conditions as json byte array
+func (r *EventRule) GetConditionsAsJSON() ([]byte, error) {
+	return json.Marshal(r.Conditions)
+}
+
+// GetActionAsJSON returns the action as json byte array
+func (r *EventRule) GetActionAsJSON() ([]byte, error) {
+	return json.Marshal(r.Action)
+}
+
+// MatchesFsEvent returns true if the rule is enabled and applies to the given filesystem event
+func (r *EventRule) MatchesFsEvent(operation, username, filePath string) bool {
+	if r.Status != 1 || r.Trigger != EventTriggerFsEvent {
+		return false
+	}
+	if !utils.IsStringInSlice(operation, r.Conditions.FsEvents) {
+		return false
+	}
+	if len(r.Conditions.Usernames) > 0 && !utils.IsStringInSlice(username, r.Conditions.Usernames) {
+		return false
+	}
+	if len(r.Conditions.Patterns) == 0 {
+		return true
+	}
+	name := path.Base(filePath)
+	for _, pattern := range r.Conditions.Patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *EventRule) getACopy() EventRule {
+	rule := *r
+	rule.Conditions.FsEvents = make([]string, len(r.Conditions.FsEvents))
+	copy(rule.Conditions.FsEvents, r.Conditions.FsEvents)
+	rule.Conditions.Patterns = make([]string, len(r.Conditions.Patterns))
+	copy(rule.Conditions.Patterns, r.Conditions.Patterns)
+	rule.Conditions.Usernames = make([]string, len(r.Conditions.Usernames))
+	copy(rule.Conditions.Usernames, r.Conditions.Usernames)
+	rule.Action.Paths = make([]string, len(r.Action.Paths))
+	copy(rule.Action.Paths, r.Action.Paths)
+	rule.Action.Retention = make([]FolderRetention, len(r.Action.Retention))
+	copy(rule.Action.Retention, r.Action.Retention)
+	return rule
+}
+
+func validateEventRule(rule *EventRule) error {
+	if len(rule.Name) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if rule.Status != 0 && rule.Status != 1 {
+		return &ValidationError{err: fmt.Sprintf("invalid status: %v", rule.Status)}
+	}
+	switch rule.Trigger {
+	case EventTriggerSchedule:
+		if _, err := utils.ParseCronSchedule(rule.Conditions.Schedule); err != nil {
+			return &ValidationError{err: err.Error()}
+		}
+		rule.Conditions.FsEvents = nil
+		rule.Conditions.Patterns = nil
+	case EventTriggerFsEvent:
+		if len(rule.Conditions.FsEvents) == 0 {
+			return &ValidationError{err: "at least one filesystem event is required"}
+		}
+		for _, event := range rule.Conditions.FsEvents {
+			if !utils.IsStringInSlice(event, SupportedFsEvents) {
+				return &ValidationError{err: fmt.Sprintf("invalid filesystem event: %#v", event)}
+			}
+		}
+		for _, pattern := range rule.Conditions.Patterns {
+			if _, err := path.Match(pattern, "abc"); err != nil {
+				return &ValidationError{err: fmt.Sprintf("invalid pattern: %#v", pattern)}
+			}
+		}
+		if rule.Action.Type != EventActionCommand && rule.Action.Type != EventActionHTTP {
+			return &ValidationError{err: "filesystem events support only command and HTTP actions"}
+		}
+		rule.Conditions.Schedule = ""
+	default:
+		return &ValidationError{err: fmt.Sprintf("invalid trigger: %v", rule.Trigger)}
+	}
+	return validateEventAction(&rule.Action)
+}
+
+func validateEventAction(action *EventAction) error {
+	if action.Timeout < 0 {
+		return &ValidationError{err: "the action timeout cannot be negative"}
+	}
+	switch action.Type {
+	case EventActionCommand:
+		if !filepath.IsAbs(action.Command) {
+			return &ValidationError{err: "the command must be an absolute path"}
+		}
+	case EventActionHTTP:
+		return validateHTTPURL(action.HTTPURL)
+	case EventActionQuotaScan, EventActionUserExpirationCheck:
+	case EventActionFolderCleanup:
+		if len(action.Paths) == 0 {
+			return &ValidationError{err: "at least one path to clean is required"}
+		}
+		for _, p := range action.Paths {
+			if !filepath.IsAbs(p) {
+				return &ValidationError{err: fmt.Sprintf("the path to clean %#v must be absolute", p)}
+			}
+		}
+		if action.RetentionHours <= 0 {
+			return &ValidationError{err: "the retention must be greater than 0"}
+		}
+	case EventActionBackup:
+		if !filepath.IsAbs(action.BackupPath) {
+			return &ValidationError{err: "the backup path must be absolute"}
+		}
+	case EventActionDataRetention:
+		check := RetentionCheck{
+			Folders: action.Retention,
+			HTTPURL: action.HTTPURL,
+		}
+		return check.Validate()
+	default:
+		return &ValidationError{err: fmt.Sprintf("invalid action type: %v", action.Type)}
+	}
+	return nil
+}
+
+func validateHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return &ValidationError{err: fmt.Sprintf("invalid HTTP URL: %#v", rawURL)}
+	}
+	return nil
+}
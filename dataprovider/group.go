@@ -0,0 +1,255 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Group defines a set of settings shared by the users that belong to it.
+// The users inherit the group settings they do not define, so each user can override
+// any of them. A user can belong to multiple groups, the groups are evaluated in the
+// order they are defined for the user and the first group that defines a setting wins
+type Group struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique name, it cannot be changed
+	Name string `json:"name"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// Maximum concurrent sessions, used for the members without a limit. 0 means unlimited
+	MaxSessions int `json:"max_sessions"`
+	// Maximum size allowed as bytes, used for the members without a size quota. 0 means unlimited
+	QuotaSize int64 `json:"quota_size"`
+	// Maximum number of files allowed, used for the members without a files quota. 0 means unlimited
+	QuotaFiles int `json:"quota_files"`
+	// Permissions granted for the directories without permissions defined at the user level
+	Permissions map[string][]string `json:"permissions,omitempty"`
+	// Maximum upload bandwidth as KB/s, used for the members without a limit. 0 means unlimited
+	UploadBandwidth int64 `json:"upload_bandwidth"`
+	// Maximum download bandwidth as KB/s, used for the members without a limit. 0 means unlimited
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+	// Additional restrictions, each filter is used for the members that do not define it.
+	// The file extensions and patterns filters are inherited for the paths without filters
+	// at the user level. TOTP secrets are not supported for groups
+	Filters UserFilters `json:"filters"`
+	// Filesystem configuration, used for the members with the local filesystem and no encryption.
+	// The virtual folders are not supported if the members inherit a cloud or encrypted filesystem
+	FsConfig Filesystem `json:"filesystem"`
+}
+
+// GetPermissionsAsJSON returns the permissions as json byte array
+func (g *Group) GetPermissionsAsJSON() ([]byte, error) {
+	return json.Marshal(g.Permissions)
+}
+
+// GetFiltersAsJSON returns the filters as json byte array
+func (g *Group) GetFiltersAsJSON() ([]byte, error) {
+	return json.Marshal(g.Filters)
+}
+
+// GetFsConfigAsJSON returns the filesystem config as json byte array
+func (g *Group) GetFsConfigAsJSON() ([]byte, error) {
+	return json.Marshal(g.FsConfig)
+}
+
+// getValidationUser returns a user with the group settings, it is used to reuse the user validation
+func (g *Group) getValidationUser() User {
+	return User{
+		Username:    g.Name,
+		Permissions: g.Permissions,
+		Filters:     g.Filters,
+		FsConfig:    g.FsConfig,
+	}
+}
+
+func (g *Group) getACopy() Group {
+	user := g.getValidationUser()
+	userCopy := user.getACopy()
+	group := *g
+	group.Permissions = userCopy.Permissions
+	group.Filters = userCopy.Filters
+	group.FsConfig = userCopy.FsConfig
+	return group
+}
+
+// applyGroupSettings sets the settings not defined for the user to the ones defined in the given groups
+func (u *User) applyGroupSettings(groups []Group) {
+	for _, g := range groups {
+		if u.MaxSessions == 0 {
+			u.MaxSessions = g.MaxSessions
+		}
+		if u.QuotaSize == 0 {
+			u.QuotaSize = g.QuotaSize
+		}
+		if u.QuotaFiles == 0 {
+			u.QuotaFiles = g.QuotaFiles
+		}
+		if u.UploadBandwidth == 0 {
+			u.UploadBandwidth = g.UploadBandwidth
+		}
+		if u.DownloadBandwidth == 0 {
+			u.DownloadBandwidth = g.DownloadBandwidth
+		}
+		if len(g.Permissions) > 0 && u.Permissions == nil {
+			u.Permissions = make(map[string][]string)
+		}
+		for dir, perms := range g.Permissions {
+			if _, ok := u.Permissions[dir]; !ok {
+				u.Permissions[dir] = perms
+			}
+		}
+		u.applyGroupFilters(g.Filters)
+		if u.FsConfig.Provider == 0 && len(u.FsConfig.CryptConfig.Passphrase) == 0 {
+			if g.FsConfig.Provider != 0 || len(g.FsConfig.CryptConfig.Passphrase) > 0 {
+				u.FsConfig = g.FsConfig
+				u.VirtualFolders = nil
+			}
+		}
+	}
+}
+
+func (u *User) applyGroupFilters(filters UserFilters) {
+	if len(u.Filters.AllowedIP) == 0 {
+		u.Filters.AllowedIP = filters.AllowedIP
+	}
+	if len(u.Filters.DeniedIP) == 0 {
+		u.Filters.DeniedIP = filters.DeniedIP
+	}
+	if len(u.Filters.AllowedCountries) == 0 {
+		u.Filters.AllowedCountries = filters.AllowedCountries
+	}
+	if len(u.Filters.DeniedCountries) == 0 {
+		u.Filters.DeniedCountries = filters.DeniedCountries
+	}
+	if len(u.Filters.DeniedLoginMethods) == 0 {
+		u.Filters.DeniedLoginMethods = filters.DeniedLoginMethods
+	}
+	if len(u.Filters.LoginMethodRules) == 0 {
+		u.Filters.LoginMethodRules = filters.LoginMethodRules
+	}
+	if len(u.Filters.UploadMode) == 0 {
+		u.Filters.UploadMode = filters.UploadMode
+	}
+	if len(u.Filters.SetstatMode) == 0 {
+		u.Filters.SetstatMode = filters.SetstatMode
+	}
+	if u.Filters.MaxUploadFileSize == 0 {
+		u.Filters.MaxUploadFileSize = filters.MaxUploadFileSize
+	}
+	for _, k := range filters.RevokedPublicKeys {
+		if !utils.IsStringInSlice(k, u.Filters.RevokedPublicKeys) {
+			u.Filters.RevokedPublicKeys = append(u.Filters.RevokedPublicKeys, k)
+		}
+	}
+	var paths []string
+	for _, f := range u.Filters.FileExtensions {
+		paths = append(paths, f.Path)
+	}
+	for _, f := range filters.FileExtensions {
+		if !utils.IsStringInSlice(f.Path, paths) {
+			u.Filters.FileExtensions = append(u.Filters.FileExtensions, f)
+		}
+	}
+	paths = nil
+	for _, f := range u.Filters.FilePatterns {
+		paths = append(paths, f.Path)
+	}
+	for _, f := range filters.FilePatterns {
+		if !utils.IsStringInSlice(f.Path, paths) {
+			u.Filters.FilePatterns = append(u.Filters.FilePatterns, f)
+		}
+	}
+}
+
+func validateGroup(group *Group) error {
+	if len(group.Name) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if group.MaxSessions < 0 || group.QuotaSize < 0 || group.QuotaFiles < 0 || group.UploadBandwidth < 0 ||
+		group.DownloadBandwidth < 0 {
+		return &ValidationError{err: "the limits cannot be negative"}
+	}
+	if len(group.Filters.TOTPSecret) > 0 {
+		return &ValidationError{err: "TOTP secrets are not supported for groups"}
+	}
+	if group.FsConfig.Provider == 2 && group.FsConfig.GCSConfig.AutomaticCredentials == 0 {
+		return &ValidationError{err: "only automatic credentials are supported for GCS filesystems defined in groups"}
+	}
+	user := group.getValidationUser()
+	if len(user.Permissions) > 0 {
+		permissions, err := getCleanedPermissions(user.Permissions)
+		if err != nil {
+			return err
+		}
+		user.Permissions = permissions
+	}
+	if err := validateFilesystemConfig(&user); err != nil {
+		return err
+	}
+	if err := validateCryptConfig(&user); err != nil {
+		return err
+	}
+	if err := validateFilters(&user); err != nil {
+		return err
+	}
+	group.Permissions = user.Permissions
+	group.Filters = user.Filters
+	group.FsConfig = user.FsConfig
+	return nil
+}
+
+// validateUserGroups checks that the groups for the given user exist
+func validateUserGroups(p Provider, user *User) error {
+	var groups []string
+	for _, name := range user.Groups {
+		if utils.IsStringInSlice(name, groups) {
+			return &ValidationError{err: fmt.Sprintf("duplicate group %#v", name)}
+		}
+		if _, err := p.groupExists(name); err != nil {
+			if _, ok := err.(*RecordNotFoundError); ok {
+				return &ValidationError{err: fmt.Sprintf("group %#v does not exist", name)}
+			}
+			return err
+		}
+		groups = append(groups, name)
+	}
+	return nil
+}
+
+// applyUserGroups applies the settings of the groups the given user belongs to.
+// An error is returned if a group cannot be loaded, the user must not login with
+// partial settings in this case
+func applyUserGroups(p Provider, user User) (User, error) {
+	if len(user.Groups) == 0 {
+		return user, nil
+	}
+	var groups []Group
+	for _, name := range user.Groups {
+		group, err := p.groupExists(name)
+		if err != nil {
+			providerLog(logger.LevelWarn, "unable to get group %#v for user %#v: %v", name, user.Username, err)
+			return user, fmt.Errorf("unable to get group %#v for user %#v: %v", name, user.Username, err)
+		}
+		groups = append(groups, group)
+	}
+	user.applyGroupSettings(groups)
+	return user, nil
+}
+
+// HideGroupSensitiveData hides group sensitive data
+func HideGroupSensitiveData(group *Group) Group {
+	if group.FsConfig.Provider == 1 {
+		group.FsConfig.S3Config.AccessSecret = utils.RemoveDecryptionKey(group.FsConfig.S3Config.AccessSecret)
+	} else if group.FsConfig.Provider == 3 {
+		group.FsConfig.AzBlobConfig.AccountKey = utils.RemoveDecryptionKey(group.FsConfig.AzBlobConfig.AccountKey)
+		group.FsConfig.AzBlobConfig.SASURL = utils.RemoveDecryptionKey(group.FsConfig.AzBlobConfig.SASURL)
+	} else if group.FsConfig.Provider == 4 {
+		group.FsConfig.SFTPConfig.Password = utils.RemoveDecryptionKey(group.FsConfig.SFTPConfig.Password)
+		group.FsConfig.SFTPConfig.PrivateKey = utils.RemoveDecryptionKey(group.FsConfig.SFTPConfig.PrivateKey)
+	}
+	group.FsConfig.CryptConfig.Passphrase = utils.RemoveDecryptionKey(group.FsConfig.CryptConfig.Passphrase)
+	return *group
+}
@@ -0,0 +1,117 @@
+package dataprovider
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/alexedwards/argon2id"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// Argon2Options defines the parameters for the argon2id password hashing.
+// The zero values are replaced with the defaults
+type Argon2Options struct {
+	// Memory as KiB, default 65536
+	Memory uint32 `json:"memory" mapstructure:"memory"`
+	// Number of iterations, default 1
+	Iterations uint32 `json:"iterations" mapstructure:"iterations"`
+	// Degree of parallelism, default 2
+	Parallelism uint8 `json:"parallelism" mapstructure:"parallelism"`
+}
+
+// PasswordHashing defines the configuration for the password hashing.
+// The new and updated passwords are hashed using argon2id. The passwords hashed
+// using other algorithms, or using argon2id with different parameters, are
+// transparently upgraded after a successful login
+type PasswordHashing struct {
+	Argon2Options Argon2Options `json:"argon2_options" mapstructure:"argon2_options"`
+}
+
+var argon2Params = getArgon2Params(Argon2Options{})
+
+func getArgon2Params(options Argon2Options) *argon2id.Params {
+	params := *argon2id.DefaultParams
+	if options.Memory > 0 {
+		params.Memory = options.Memory
+	}
+	if options.Iterations > 0 {
+		params.Iterations = options.Iterations
+	}
+	if options.Parallelism > 0 {
+		params.Parallelism = options.Parallelism
+	}
+	return &params
+}
+
+func initializePasswordHashing(hashing PasswordHashing) error {
+	params := getArgon2Params(hashing.Argon2Options)
+	// argon2 requires at least 8 KiB of memory for each thread
+	if params.Memory < 8*uint32(params.Parallelism) {
+		return fmt.Errorf("argon2 memory must be at least %v KiB for parallelism %v", 8*uint32(params.Parallelism),
+			params.Parallelism)
+	}
+	argon2Params = params
+	return nil
+}
+
+func hashPassword(password string) (string, error) {
+	return argon2id.CreateHash(password, argon2Params)
+}
+
+// isPasswordHashOutdated returns true if the given hash is not an argon2id hash with the configured parameters
+func isPasswordHashOutdated(hash string) bool {
+	if hash == pamPwdPrefix || len(hash) == 0 {
+		return false
+	}
+	if !strings.HasPrefix(hash, argonPwdPrefix) {
+		return true
+	}
+	// $argon2id$v=19$m=65536,t=1,p=2$salt$key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var memory, iterations uint32
+	var parallelism uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &iterations, &parallelism); err != nil {
+		return false
+	}
+	return memory != argon2Params.Memory || iterations != argon2Params.Iterations ||
+		parallelism != argon2Params.Parallelism
+}
+
+// upgradeUserPasswordHash hashes the given, already verified, password using the configured
+// argon2id parameters if the stored hash is outdated. Errors are logged and ignored
+func upgradeUserPasswordHash(user *User, password string) {
+	if !isPasswordHashOutdated(user.Password) {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = provider.updateUserPassword(user.Username, hash)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to upgrade the password hash for user %#v: %v", user.Username, err)
+		return
+	}
+	providerLog(logger.LevelInfo, "password hash upgraded for user %#v", user.Username)
+	user.Password = hash
+}
+
+// upgradeAdminPasswordHash is like upgradeUserPasswordHash but for admins
+func upgradeAdminPasswordHash(admin *Admin, password string) {
+	if !isPasswordHashOutdated(admin.Password) {
+		return
+	}
+	hash, err := hashPassword(password)
+	if err == nil {
+		err = provider.updateAdminPassword(admin.Username, hash)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to upgrade the password hash for admin %#v: %v", admin.Username, err)
+		return
+	}
+	providerLog(logger.LevelInfo, "password hash upgraded for admin %#v", admin.Username)
+	admin.Password = hash
+}
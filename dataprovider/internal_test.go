@@ -0,0 +1,281 @@
+package dataprovider
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const retryTestDriverName = "sftpgo_retry_test"
+
+// retryTestDriver is a database/sql driver whose statements fail with a
+// CockroachDB retry error for the configured number of executions
+type retryTestDriver struct {
+	sync.Mutex
+	failures   int
+	executions int
+}
+
+var testDriver = &retryTestDriver{}
+
+func init() {
+	sql.Register(retryTestDriverName, testDriver)
+}
+
+func (d *retryTestDriver) reset(failures int) {
+	d.Lock()
+	defer d.Unlock()
+	d.failures = failures
+	d.executions = 0
+}
+
+func (d *retryTestDriver) getExecutions() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.executions
+}
+
+func (d *retryTestDriver) Open(name string) (driver.Conn, error) {
+	return &retryTestConn{driver: d}, nil
+}
+
+type retryTestConn struct {
+	driver *retryTestDriver
+}
+
+func (c *retryTestConn) Prepare(query string) (driver.Stmt, error) {
+	return &retryTestStmt{driver: c.driver}, nil
+}
+
+func (c *retryTestConn) Close() error {
+	return nil
+}
+
+func (c *retryTestConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+type retryTestStmt struct {
+	driver *retryTestDriver
+}
+
+func (s *retryTestStmt) Close() error {
+	return nil
+}
+
+func (s *retryTestStmt) NumInput() int {
+	return -1
+}
+
+func (s *retryTestStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.driver.Lock()
+	defer s.driver.Unlock()
+	s.driver.executions++
+	if s.driver.executions <= s.driver.failures {
+		return nil, &pq.Error{Code: cockroachRetryErrorCode, Message: "restart transaction"}
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *retryTestStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, errors.New("queries are not supported")
+}
+
+func TestCockroachDBRetry(t *testing.T) {
+	dbHandle, err := sql.Open(retryTestDriverName, "")
+	if err != nil {
+		t.Fatalf("unable to open the test database: %v", err)
+	}
+	defer dbHandle.Close()
+	config.Driver = CockroachDataProviderName
+	config.UsersTable = "users"
+	sqlPlaceholders = getSQLPlaceholders()
+	p := CockroachDBProvider{dbHandle: dbHandle}
+	// the quota update is retried until it succeeds
+	testDriver.reset(3)
+	err = p.updateQuota("user", 1, 100, false)
+	if err != nil {
+		t.Errorf("the quota update must succeed after the retries: %v", err)
+	}
+	if testDriver.getExecutions() != 4 {
+		t.Errorf("unexpected number of executions: %v", testDriver.getExecutions())
+	}
+	// the retries are not unlimited
+	testDriver.reset(cockroachMaxRetries + 5)
+	err = p.updateQuota("user", 1, 100, false)
+	if !isCockroachRetryError(err) {
+		t.Errorf("the quota update must fail with a retry error, got: %v", err)
+	}
+	if testDriver.getExecutions() != cockroachMaxRetries+1 {
+		t.Errorf("unexpected number of executions: %v", testDriver.getExecutions())
+	}
+	// the other errors are not retried
+	if isCockroachRetryError(errors.New("40001")) || isCockroachRetryError(&pq.Error{Code: "23505"}) {
+		t.Error("only the serialization failures must be retried")
+	}
+	testDriver.reset(0)
+	err = p.updateQuota("user", 1, 100, true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if testDriver.getExecutions() != 1 {
+		t.Errorf("unexpected number of executions: %v", testDriver.getExecutions())
+	}
+}
+
+func TestSQLTLSConfigValidation(t *testing.T) {
+	savedConfig := config
+	defer func() {
+		config = savedConfig
+	}()
+	basePath, err := ioutil.TempDir("", "sftpgo_tls")
+	if err != nil {
+		t.Fatalf("unable to create a temporary dir: %v", err)
+	}
+	defer os.RemoveAll(basePath)
+	err = ioutil.WriteFile(filepath.Join(basePath, "ca.pem"), []byte("CA bundle"), 0644)
+	if err != nil {
+		t.Fatalf("unable to write the CA bundle: %v", err)
+	}
+	config = Config{Driver: PGSQLDataProviderName, SSLMode: 4}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("an invalid sslmode must fail")
+	}
+	config = Config{Driver: PGSQLDataProviderName, SSLMode: -1}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("an invalid sslmode must fail")
+	}
+	// the relative paths are resolved against the config dir
+	config = Config{Driver: PGSQLDataProviderName, SSLMode: 3, RootCert: "ca.pem"}
+	if err = validateSQLTLSConfig(basePath); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if config.RootCert != filepath.Join(basePath, "ca.pem") {
+		t.Errorf("unexpected CA bundle path: %#v", config.RootCert)
+	}
+	config = Config{Driver: PGSQLDataProviderName, SSLMode: 1, RootCert: "missing_ca.pem"}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("an unreadable CA bundle must fail")
+	}
+	// the file is checked before opening the database handle
+	if err = createProvider(basePath); err == nil {
+		t.Error("creating a provider with an unreadable CA bundle must fail")
+	}
+	config = Config{Driver: MySQLDataProviderName, SSLMode: 2, ClientCert: "ca.pem"}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("a client certificate without a key must fail")
+	}
+	config = Config{Driver: MySQLDataProviderName, SSLMode: 2, ClientCert: "missing_cert.pem",
+		ClientKey: "missing_key.pem"}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("an unreadable client certificate must fail")
+	}
+	config = Config{Driver: CockroachDataProviderName, SSLMode: 3, ClientCert: "ca.pem",
+		ClientKey: filepath.Join(basePath, "missing_key.pem")}
+	if err = validateSQLTLSConfig(basePath); err == nil {
+		t.Error("an unreadable client key must fail")
+	}
+	// the files are not used if SSL/TLS is disabled or for the other drivers
+	config = Config{Driver: PGSQLDataProviderName, SSLMode: 0, RootCert: "missing_ca.pem"}
+	if err = validateSQLTLSConfig(basePath); err != nil {
+		t.Errorf("unexpected error with SSL/TLS disabled: %v", err)
+	}
+	config = Config{Driver: SQLiteDataProviderName, SSLMode: 1, RootCert: "missing_ca.pem"}
+	if err = validateSQLTLSConfig(basePath); err != nil {
+		t.Errorf("unexpected error for the sqlite driver: %v", err)
+	}
+}
+
+func TestDESCryptHashFormat(t *testing.T) {
+	for _, hash := range []string{"Xy2PtsPf0839Y", "abJnggxhB/yWI"} {
+		if !isDESCryptHash(hash) {
+			t.Errorf("%#v must be detected as a DES crypt hash", hash)
+		}
+	}
+	// the last char encodes only 4 bits
+	for _, hash := range []string{"Xy2PtsPf0839Z", "Xy2PtsPf0839", "Xy2PtsPf0839Y1", "Xy2Pts$f0839Y", "$1$b5caebda$"} {
+		if isDESCryptHash(hash) {
+			t.Errorf("%#v must not be detected as a DES crypt hash", hash)
+		}
+	}
+	match, err := compareDESCryptPasswordAndHash("password", "Xy2PtsPf0839Y")
+	if err != nil || !match {
+		t.Errorf("the password must match, err: %v", err)
+	}
+	match, err = compareDESCryptPasswordAndHash("wrong", "Xy2PtsPf0839Y")
+	if err != nil || match {
+		t.Errorf("the password must not match, err: %v", err)
+	}
+}
+
+// quotaTestProvider records the quota updates, the other Provider methods are not implemented
+type quotaTestProvider struct {
+	Provider
+	sync.Mutex
+	files   int
+	size    int64
+	started chan bool
+	release chan bool
+}
+
+func (p *quotaTestProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
+	if !reset {
+		p.started <- true
+		<-p.release
+	}
+	p.Lock()
+	defer p.Unlock()
+	if reset {
+		p.files = filesAdd
+		p.size = sizeAdd
+	} else {
+		p.files += filesAdd
+		p.size += sizeAdd
+	}
+	return nil
+}
+
+func TestDelayedQuotaResetDuringFlush(t *testing.T) {
+	p := &quotaTestProvider{
+		started: make(chan bool),
+		release: make(chan bool),
+	}
+	q := newDelayedQuotaUpdater()
+	q.add("user", 2, 200)
+	flushDone := make(chan bool)
+	go func() {
+		q.flush(p)
+		flushDone <- true
+	}()
+	<-p.started
+	// the scan results already include the delta being written
+	resetDone := make(chan error)
+	go func() {
+		resetDone <- q.setQuota(p, "user", 5, 500)
+	}()
+	select {
+	case <-resetDone:
+		t.Fatal("the quota reset must wait for the running flush")
+	case <-time.After(100 * time.Millisecond):
+	}
+	p.release <- true
+	<-flushDone
+	if err := <-resetDone; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if p.files != 5 || p.size != 500 {
+		t.Errorf("the delta must not be added after the reset, files: %v size: %v", p.files, p.size)
+	}
+	files, size := q.get("user")
+	if files != 0 || size != 0 {
+		t.Errorf("no pending changes expected, files: %v size: %v", files, size)
+	}
+}
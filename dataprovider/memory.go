@@ -1,6 +1,7 @@
 package dataprovider
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,9 +28,50 @@ type memoryProviderHandle struct {
 	usersIdx map[int64]string
 	// map for users, username is the key
 	users map[string]User
+	// slice with ordered group names
+	groupnames []string
+	// mapping between ID and group name
+	groupsIdx map[int64]string
+	// map for groups, group name is the key
+	groups map[string]Group
+	// slice with ordered admin usernames
+	adminUsernames []string
+	// mapping between ID and admin username
+	adminsIdx map[int64]string
+	// map for admins, username is the key
+	admins map[string]Admin
+	// slice with ordered API key ids
+	apiKeyIDs []string
+	// map for API keys, key id is the key
+	apiKeys map[string]APIKey
+	// slice with ordered share ids
+	shareIDs []string
+	// map for shares, share id is the key
+	shares map[string]Share
+	// slice with ordered event rule names
+	eventRuleNames []string
+	// mapping between ID and event rule name
+	eventRulesIdx map[int64]string
+	// map for event rules, rule name is the key
+	eventRules map[string]EventRule
+	// slice with ordered user template names
+	userTemplateNames []string
+	// mapping between ID and user template name
+	userTemplatesIdx map[int64]string
+	// map for user templates, template name is the key
+	userTemplates map[string]UserTemplate
+	// map for the defender hosts, IP is the key. They are not persisted to the configuration file
+	defenderHosts map[string]defenderHost
+	// map for the active sessions, the session key is the key. They are not persisted to the configuration file
+	activeSessions map[string]ActiveSession
 	// configuration file to use for loading users
 	configFile string
-	lock       *sync.Mutex
+	// interval for saving the data to the configuration file, 0 means the file is never modified
+	persistInterval time.Duration
+	// the last saved content, used to skip the saves if nothing changed
+	persistedContent []byte
+	persistLock      *sync.Mutex
+	lock             *sync.Mutex
 }
 
 // MemoryProvider auth provider for a memory store
@@ -45,17 +87,100 @@ func initializeMemoryProvider(basePath string) error {
 			configFile = filepath.Join(basePath, configFile)
 		}
 	}
-	provider = MemoryProvider{
+	if config.PersistInterval < 0 {
+		return fmt.Errorf("invalid persist_interval: %v", config.PersistInterval)
+	}
+	if config.PersistInterval > 0 && len(configFile) == 0 {
+		return errors.New("persist_interval requires a valid file name for the memory provider")
+	}
+	p := MemoryProvider{
 		dbHandle: &memoryProviderHandle{
-			isClosed:   false,
-			usernames:  []string{},
-			usersIdx:   make(map[int64]string),
-			users:      make(map[string]User),
-			configFile: configFile,
-			lock:       new(sync.Mutex),
+			isClosed:          false,
+			usernames:         []string{},
+			usersIdx:          make(map[int64]string),
+			users:             make(map[string]User),
+			groupnames:        []string{},
+			groupsIdx:         make(map[int64]string),
+			groups:            make(map[string]Group),
+			adminUsernames:    []string{},
+			adminsIdx:         make(map[int64]string),
+			admins:            make(map[string]Admin),
+			apiKeyIDs:         []string{},
+			apiKeys:           make(map[string]APIKey),
+			shareIDs:          []string{},
+			shares:            make(map[string]Share),
+			eventRuleNames:    []string{},
+			eventRulesIdx:     make(map[int64]string),
+			eventRules:        make(map[string]EventRule),
+			userTemplateNames: []string{},
+			userTemplatesIdx:  make(map[int64]string),
+			userTemplates:     make(map[string]UserTemplate),
+			defenderHosts:     make(map[string]defenderHost),
+			activeSessions:    make(map[string]ActiveSession),
+			configFile:        configFile,
+			persistInterval:   time.Duration(config.PersistInterval) * time.Second,
+			persistLock:       new(sync.Mutex),
+			lock:              new(sync.Mutex),
 		},
 	}
-	return provider.reloadConfig()
+	provider = p
+	if err := p.reloadConfig(); err != nil {
+		return err
+	}
+	p.startPersistence()
+	return nil
+}
+
+// startPersistence periodically saves the data to the configuration file, if enabled.
+// The save loop ends when the provider is closed
+func (p MemoryProvider) startPersistence() {
+	if p.dbHandle.persistInterval <= 0 {
+		return
+	}
+	providerLog(logger.LevelDebug, "data will be saved to file %#v every %v", p.dbHandle.configFile,
+		p.dbHandle.persistInterval)
+	ticker := time.NewTicker(p.dbHandle.persistInterval)
+	go func() {
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := p.persist(); err == errMemoryProviderClosed {
+				return
+			}
+		}
+	}()
+}
+
+// persist saves the data to the configuration file, in the same format used for the
+// dumps, if they changed since the last save
+func (p MemoryProvider) persist() error {
+	p.dbHandle.persistLock.Lock()
+	defer p.dbHandle.persistLock.Unlock()
+	dump, err := DumpData(p)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(dump)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to serialize the data to save: %v", err)
+		return err
+	}
+	if bytes.Equal(content, p.dbHandle.persistedContent) {
+		return nil
+	}
+	// write to a temporary file and rename it, so an interrupted save cannot corrupt the file
+	tmpFile := p.dbHandle.configFile + ".tmp"
+	err = ioutil.WriteFile(tmpFile, content, 0600)
+	if err == nil {
+		err = os.Rename(tmpFile, p.dbHandle.configFile)
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to save the data to file %#v: %v", p.dbHandle.configFile, err)
+		os.Remove(tmpFile)
+		return err
+	}
+	p.dbHandle.persistedContent = content
+	providerLog(logger.LevelDebug, "data saved to file %#v", p.dbHandle.configFile)
+	return nil
 }
 
 func (p MemoryProvider) checkAvailability() error {
@@ -68,6 +193,9 @@ func (p MemoryProvider) checkAvailability() error {
 }
 
 func (p MemoryProvider) close() error {
+	if p.dbHandle.persistInterval > 0 {
+		p.persist()
+	}
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
 	if p.dbHandle.isClosed {
@@ -130,6 +258,36 @@ func (p MemoryProvider) updateLastLogin(username string) error {
 	return nil
 }
 
+func (p MemoryProvider) updateUserPassword(username, password string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		return err
+	}
+	user.Password = password
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
+func (p MemoryProvider) updateAdminPassword(username, password string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	admin, err := p.adminExistsInternal(username)
+	if err != nil {
+		return err
+	}
+	admin.Password = password
+	p.dbHandle.admins[admin.Username] = admin
+	return nil
+}
+
 func (p MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64, reset bool) error {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
@@ -153,6 +311,43 @@ func (p MemoryProvider) updateQuota(username string, filesAdd int, sizeAdd int64
 	return nil
 }
 
+func (p MemoryProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to update data transfer for user %v error: %v", username, err)
+		return err
+	}
+	if reset {
+		user.UsedUploadDataTransfer = uploadAdd
+		user.UsedDownloadDataTransfer = downloadAdd
+		user.LastDataTransferReset = utils.GetTimeAsMsSinceEpoch(time.Now())
+	} else {
+		user.UsedUploadDataTransfer += uploadAdd
+		user.UsedDownloadDataTransfer += downloadAdd
+	}
+	p.dbHandle.users[user.Username] = user
+	return nil
+}
+
+func (p MemoryProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, 0, 0, errMemoryProviderClosed
+	}
+	user, err := p.userExistsInternal(username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "unable to get data transfer for user %v error: %v", username, err)
+		return 0, 0, 0, err
+	}
+	return user.UsedUploadDataTransfer, user.UsedDownloadDataTransfer, user.LastDataTransferReset, err
+}
+
 func (p MemoryProvider) getUsedQuota(username string) (int, int64, error) {
 	p.dbHandle.lock.Lock()
 	defer p.dbHandle.lock.Unlock()
@@ -199,10 +394,14 @@ func (p MemoryProvider) updateUser(user User) error {
 	if err != nil {
 		return err
 	}
-	_, err = p.userExistsInternal(user.Username)
+	oldUser, err := p.userExistsInternal(user.Username)
 	if err != nil {
 		return err
 	}
+	// the used data transfer can only be changed using updateDataTransfer
+	user.UsedUploadDataTransfer = oldUser.UsedUploadDataTransfer
+	user.UsedDownloadDataTransfer = oldUser.UsedDownloadDataTransfer
+	user.LastDataTransferReset = oldUser.LastDataTransferReset
 	p.dbHandle.users[user.Username] = user
 	return nil
 }
@@ -329,57 +528,1145 @@ func (p MemoryProvider) clearUsers() {
 	p.dbHandle.usernames = []string{}
 	p.dbHandle.usersIdx = make(map[int64]string)
 	p.dbHandle.users = make(map[string]User)
+	p.dbHandle.groupnames = []string{}
+	p.dbHandle.groupsIdx = make(map[int64]string)
+	p.dbHandle.groups = make(map[string]Group)
+	p.dbHandle.adminUsernames = []string{}
+	p.dbHandle.adminsIdx = make(map[int64]string)
+	p.dbHandle.admins = make(map[string]Admin)
+	p.dbHandle.apiKeyIDs = []string{}
+	p.dbHandle.apiKeys = make(map[string]APIKey)
+	p.dbHandle.shareIDs = []string{}
+	p.dbHandle.shares = make(map[string]Share)
+	p.dbHandle.eventRuleNames = []string{}
+	p.dbHandle.eventRulesIdx = make(map[int64]string)
+	p.dbHandle.eventRules = make(map[string]EventRule)
+	p.dbHandle.userTemplateNames = []string{}
+	p.dbHandle.userTemplatesIdx = make(map[int64]string)
+	p.dbHandle.userTemplates = make(map[string]UserTemplate)
 }
 
-func (p MemoryProvider) reloadConfig() error {
-	if len(p.dbHandle.configFile) == 0 {
-		providerLog(logger.LevelDebug, "no users configuration file defined")
-		return nil
+func (p MemoryProvider) groupExists(name string) (Group, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Group{}, errMemoryProviderClosed
 	}
-	providerLog(logger.LevelDebug, "loading users from file: %#v", p.dbHandle.configFile)
-	fi, err := os.Stat(p.dbHandle.configFile)
+	return p.groupExistsInternal(name)
+}
+
+func (p MemoryProvider) groupExistsInternal(name string) (Group, error) {
+	if val, ok := p.dbHandle.groups[name]; ok {
+		return val.getACopy(), nil
+	}
+	return Group{}, &RecordNotFoundError{err: fmt.Sprintf("group %v does not exist", name)}
+}
+
+func (p MemoryProvider) getGroupByID(ID int64) (Group, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Group{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.groupsIdx[ID]; ok {
+		return p.groupExistsInternal(val)
+	}
+	return Group{}, &RecordNotFoundError{err: fmt.Sprintf("group with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) addGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
 	if err != nil {
-		providerLog(logger.LevelWarn, "error loading users: %v", err)
 		return err
 	}
-	if fi.Size() == 0 {
-		err = errors.New("users configuration file is invalid, its size must be > 0")
-		providerLog(logger.LevelWarn, "error loading users: %v", err)
+	_, err = p.groupExistsInternal(group.Name)
+	if err == nil {
+		return fmt.Errorf("group %v already exists", group.Name)
+	}
+	group.ID = p.getNextGroupID()
+	p.dbHandle.groups[group.Name] = group
+	p.dbHandle.groupsIdx[group.ID] = group.Name
+	p.dbHandle.groupnames = append(p.dbHandle.groupnames, group.Name)
+	sort.Strings(p.dbHandle.groupnames)
+	return nil
+}
+
+func (p MemoryProvider) updateGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateGroup(&group)
+	if err != nil {
 		return err
 	}
-	if fi.Size() > 10485760 {
-		err = errors.New("users configuration file is invalid, its size must be <= 10485760 bytes")
-		providerLog(logger.LevelWarn, "error loading users: %v", err)
+	_, err = p.groupExistsInternal(group.Name)
+	if err != nil {
 		return err
 	}
-	content, err := ioutil.ReadFile(p.dbHandle.configFile)
+	p.dbHandle.groups[group.Name] = group
+	return nil
+}
+
+func (p MemoryProvider) deleteGroup(group Group) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.groupExistsInternal(group.Name)
 	if err != nil {
-		providerLog(logger.LevelWarn, "error loading users: %v", err)
 		return err
 	}
-	var dump BackupData
-	err = json.Unmarshal(content, &dump)
+	delete(p.dbHandle.groups, group.Name)
+	delete(p.dbHandle.groupsIdx, group.ID)
+	p.dbHandle.groupnames = []string{}
+	for name := range p.dbHandle.groups {
+		p.dbHandle.groupnames = append(p.dbHandle.groupnames, name)
+	}
+	sort.Strings(p.dbHandle.groupnames)
+	return nil
+}
+
+func (p MemoryProvider) dumpGroups() ([]Group, error) {
+	groups := []Group{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.groupnames {
+		group := p.dbHandle.groups[name]
+		groups = append(groups, group.getACopy())
+	}
+	return groups, nil
+}
+
+func (p MemoryProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	groups := []Group{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return groups, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return groups, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			group, err := p.groupExistsInternal(name)
+			if err == nil {
+				groups = append(groups, HideGroupSensitiveData(&group))
+			}
+		}
+		return groups, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.groupnames {
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.groupnames) - 1 - i
+		}
+		group := p.dbHandle.groups[p.dbHandle.groupnames[idx]]
+		group = group.getACopy()
+		groups = append(groups, HideGroupSensitiveData(&group))
+		if len(groups) >= limit {
+			break
+		}
+	}
+	return groups, err
+}
+
+func (p MemoryProvider) getNextGroupID() int64 {
+	nextID := int64(1)
+	for id := range p.dbHandle.groupsIdx {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) adminExists(username string) (Admin, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Admin{}, errMemoryProviderClosed
+	}
+	return p.adminExistsInternal(username)
+}
+
+func (p MemoryProvider) adminExistsInternal(username string) (Admin, error) {
+	if val, ok := p.dbHandle.admins[username]; ok {
+		return val.getACopy(), nil
+	}
+	return Admin{}, &RecordNotFoundError{err: fmt.Sprintf("admin %v does not exist", username)}
+}
+
+func (p MemoryProvider) getAdminByID(ID int64) (Admin, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Admin{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.adminsIdx[ID]; ok {
+		return p.adminExistsInternal(val)
+	}
+	return Admin{}, &RecordNotFoundError{err: fmt.Sprintf("admin with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) addAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateAdmin(&admin)
 	if err != nil {
-		providerLog(logger.LevelWarn, "error loading users: %v", err)
 		return err
 	}
-	p.clearUsers()
-	for _, user := range dump.Users {
-		u, err := p.userExists(user.Username)
-		if err == nil {
-			user.ID = u.ID
-			user.LastLogin = u.LastLogin
-			user.UsedQuotaSize = u.UsedQuotaSize
-			user.UsedQuotaFiles = u.UsedQuotaFiles
-			err = p.updateUser(user)
-			if err != nil {
-				providerLog(logger.LevelWarn, "error updating user %#v: %v", user.Username, err)
-				return err
+	_, err = p.adminExistsInternal(admin.Username)
+	if err == nil {
+		return fmt.Errorf("admin %v already exists", admin.Username)
+	}
+	admin.ID = p.getNextAdminID()
+	p.dbHandle.admins[admin.Username] = admin.getACopy()
+	p.dbHandle.adminsIdx[admin.ID] = admin.Username
+	p.dbHandle.adminUsernames = append(p.dbHandle.adminUsernames, admin.Username)
+	sort.Strings(p.dbHandle.adminUsernames)
+	return nil
+}
+
+func (p MemoryProvider) updateAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	_, err = p.adminExistsInternal(admin.Username)
+	if err != nil {
+		return err
+	}
+	p.dbHandle.admins[admin.Username] = admin.getACopy()
+	return nil
+}
+
+func (p MemoryProvider) deleteAdmin(admin Admin) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.adminExistsInternal(admin.Username)
+	if err != nil {
+		return err
+	}
+	delete(p.dbHandle.admins, admin.Username)
+	delete(p.dbHandle.adminsIdx, admin.ID)
+	p.dbHandle.adminUsernames = []string{}
+	for username := range p.dbHandle.admins {
+		p.dbHandle.adminUsernames = append(p.dbHandle.adminUsernames, username)
+	}
+	sort.Strings(p.dbHandle.adminUsernames)
+	return nil
+}
+
+func (p MemoryProvider) dumpAdmins() ([]Admin, error) {
+	admins := []Admin{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return admins, errMemoryProviderClosed
+	}
+	for _, username := range p.dbHandle.adminUsernames {
+		admin := p.dbHandle.admins[username]
+		admins = append(admins, admin.getACopy())
+	}
+	return admins, nil
+}
+
+func (p MemoryProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	admins := []Admin{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return admins, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return admins, err
+	}
+	if len(username) > 0 {
+		if offset == 0 {
+			admin, err := p.adminExistsInternal(username)
+			if err == nil {
+				admin.HideConfidentialData()
+				admins = append(admins, admin)
 			}
+		}
+		return admins, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.adminUsernames {
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.adminUsernames) - 1 - i
+		}
+		admin := p.dbHandle.admins[p.dbHandle.adminUsernames[idx]]
+		admin = admin.getACopy()
+		admin.HideConfidentialData()
+		admins = append(admins, admin)
+		if len(admins) >= limit {
+			break
+		}
+	}
+	return admins, err
+}
+
+func (p MemoryProvider) getNextAdminID() int64 {
+	nextID := int64(1)
+	for id := range p.dbHandle.adminsIdx {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) apiKeyExists(keyID string) (APIKey, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return APIKey{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.apiKeys[keyID]; ok {
+		return val.getACopy(), nil
+	}
+	return APIKey{}, &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+}
+
+func (p MemoryProvider) addAPIKey(key APIKey) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.apiKeys[key.KeyID]; ok {
+		return fmt.Errorf("API key %v already exists", key.KeyID)
+	}
+	key.ID = p.getNextAPIKeyID()
+	key.LastUseAt = 0
+	p.dbHandle.apiKeys[key.KeyID] = key.getACopy()
+	p.dbHandle.apiKeyIDs = append(p.dbHandle.apiKeyIDs, key.KeyID)
+	sort.Strings(p.dbHandle.apiKeyIDs)
+	return nil
+}
+
+func (p MemoryProvider) updateAPIKeyLastUse(keyID string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	key, ok := p.dbHandle.apiKeys[keyID]
+	if !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", keyID)}
+	}
+	key.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.apiKeys[keyID] = key
+	return nil
+}
+
+func (p MemoryProvider) deleteAPIKey(key APIKey) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.apiKeys[key.KeyID]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("API key %v does not exist", key.KeyID)}
+	}
+	delete(p.dbHandle.apiKeys, key.KeyID)
+	p.dbHandle.apiKeyIDs = []string{}
+	for keyID := range p.dbHandle.apiKeys {
+		p.dbHandle.apiKeyIDs = append(p.dbHandle.apiKeyIDs, keyID)
+	}
+	sort.Strings(p.dbHandle.apiKeyIDs)
+	return nil
+}
+
+func (p MemoryProvider) dumpAPIKeys() ([]APIKey, error) {
+	keys := []APIKey{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return keys, errMemoryProviderClosed
+	}
+	for _, keyID := range p.dbHandle.apiKeyIDs {
+		key := p.dbHandle.apiKeys[keyID]
+		keys = append(keys, key.getACopy())
+	}
+	return keys, nil
+}
+
+func (p MemoryProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	keys := []APIKey{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return keys, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return keys, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.apiKeyIDs {
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.apiKeyIDs) - 1 - i
+		}
+		key := p.dbHandle.apiKeys[p.dbHandle.apiKeyIDs[idx]]
+		if len(admin) > 0 && key.Admin != admin {
+			continue
+		}
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		key = key.getACopy()
+		key.HideConfidentialData()
+		keys = append(keys, key)
+		if len(keys) >= limit {
+			break
+		}
+	}
+	return keys, err
+}
+
+func (p MemoryProvider) getNextAPIKeyID() int64 {
+	nextID := int64(1)
+	for _, key := range p.dbHandle.apiKeys {
+		if key.ID >= nextID {
+			nextID = key.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) shareExists(shareID string) (Share, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return Share{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.shares[shareID]; ok {
+		return val, nil
+	}
+	return Share{}, &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+}
+
+func (p MemoryProvider) addShare(share Share) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.shares[share.ShareID]; ok {
+		return fmt.Errorf("share %v already exists", share.ShareID)
+	}
+	share.ID = p.getNextShareID()
+	p.dbHandle.shares[share.ShareID] = share
+	p.dbHandle.shareIDs = append(p.dbHandle.shareIDs, share.ShareID)
+	sort.Strings(p.dbHandle.shareIDs)
+	return nil
+}
+
+func (p MemoryProvider) updateShareUsage(shareID string, numTokens int) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	share, ok := p.dbHandle.shares[shareID]
+	if !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", shareID)}
+	}
+	share.UsedTokens += numTokens
+	share.LastUseAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.shares[shareID] = share
+	return nil
+}
+
+func (p MemoryProvider) deleteShare(share Share) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.shares[share.ShareID]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("share %v does not exist", share.ShareID)}
+	}
+	delete(p.dbHandle.shares, share.ShareID)
+	p.dbHandle.shareIDs = []string{}
+	for shareID := range p.dbHandle.shares {
+		p.dbHandle.shareIDs = append(p.dbHandle.shareIDs, shareID)
+	}
+	sort.Strings(p.dbHandle.shareIDs)
+	return nil
+}
+
+func (p MemoryProvider) dumpShares() ([]Share, error) {
+	shares := []Share{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return shares, errMemoryProviderClosed
+	}
+	for _, shareID := range p.dbHandle.shareIDs {
+		shares = append(shares, p.dbHandle.shares[shareID])
+	}
+	return shares, nil
+}
+
+func (p MemoryProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	shares := []Share{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return shares, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return shares, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.shareIDs {
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.shareIDs) - 1 - i
+		}
+		share := p.dbHandle.shares[p.dbHandle.shareIDs[idx]]
+		if len(username) > 0 && share.Username != username {
+			continue
+		}
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		share.HideConfidentialData()
+		shares = append(shares, share)
+		if len(shares) >= limit {
+			break
+		}
+	}
+	return shares, err
+}
+
+func (p MemoryProvider) getNextShareID() int64 {
+	nextID := int64(1)
+	for _, share := range p.dbHandle.shares {
+		if share.ID >= nextID {
+			nextID = share.ID + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) eventRuleExists(name string) (EventRule, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return EventRule{}, errMemoryProviderClosed
+	}
+	return p.eventRuleExistsInternal(name)
+}
+
+func (p MemoryProvider) eventRuleExistsInternal(name string) (EventRule, error) {
+	if val, ok := p.dbHandle.eventRules[name]; ok {
+		return val.getACopy(), nil
+	}
+	return EventRule{}, &RecordNotFoundError{err: fmt.Sprintf("event rule %v does not exist", name)}
+}
+
+func (p MemoryProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return EventRule{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.eventRulesIdx[ID]; ok {
+		return p.eventRuleExistsInternal(val)
+	}
+	return EventRule{}, &RecordNotFoundError{err: fmt.Sprintf("event rule with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) addEventRule(rule EventRule) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	_, err = p.eventRuleExistsInternal(rule.Name)
+	if err == nil {
+		return fmt.Errorf("event rule %v already exists", rule.Name)
+	}
+	rule.ID = p.getNextEventRuleID()
+	p.dbHandle.eventRules[rule.Name] = rule
+	p.dbHandle.eventRulesIdx[rule.ID] = rule.Name
+	p.dbHandle.eventRuleNames = append(p.dbHandle.eventRuleNames, rule.Name)
+	sort.Strings(p.dbHandle.eventRuleNames)
+	return nil
+}
+
+func (p MemoryProvider) updateEventRule(rule EventRule) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	_, err = p.eventRuleExistsInternal(rule.Name)
+	if err != nil {
+		return err
+	}
+	p.dbHandle.eventRules[rule.Name] = rule
+	return nil
+}
+
+func (p MemoryProvider) deleteEventRule(rule EventRule) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.eventRuleExistsInternal(rule.Name)
+	if err != nil {
+		return err
+	}
+	delete(p.dbHandle.eventRules, rule.Name)
+	delete(p.dbHandle.eventRulesIdx, rule.ID)
+	p.dbHandle.eventRuleNames = []string{}
+	for name := range p.dbHandle.eventRules {
+		p.dbHandle.eventRuleNames = append(p.dbHandle.eventRuleNames, name)
+	}
+	sort.Strings(p.dbHandle.eventRuleNames)
+	return nil
+}
+
+func (p MemoryProvider) dumpEventRules() ([]EventRule, error) {
+	rules := []EventRule{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return rules, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.eventRuleNames {
+		rule := p.dbHandle.eventRules[name]
+		rules = append(rules, rule.getACopy())
+	}
+	return rules, nil
+}
+
+func (p MemoryProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	rules := []EventRule{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return rules, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return rules, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			rule, err := p.eventRuleExistsInternal(name)
+			if err == nil {
+				rules = append(rules, rule)
+			}
+		}
+		return rules, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.eventRuleNames {
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.eventRuleNames) - 1 - i
+		}
+		rule := p.dbHandle.eventRules[p.dbHandle.eventRuleNames[idx]]
+		rules = append(rules, rule.getACopy())
+		if len(rules) >= limit {
+			break
+		}
+	}
+	return rules, err
+}
+
+func (p MemoryProvider) getNextEventRuleID() int64 {
+	nextID := int64(1)
+	for id := range p.dbHandle.eventRulesIdx {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) userTemplateExists(name string) (UserTemplate, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return UserTemplate{}, errMemoryProviderClosed
+	}
+	return p.userTemplateExistsInternal(name)
+}
+
+func (p MemoryProvider) userTemplateExistsInternal(name string) (UserTemplate, error) {
+	if val, ok := p.dbHandle.userTemplates[name]; ok {
+		return val.getACopy(), nil
+	}
+	return UserTemplate{}, &RecordNotFoundError{err: fmt.Sprintf("user template %v does not exist", name)}
+}
+
+func (p MemoryProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return UserTemplate{}, errMemoryProviderClosed
+	}
+	if val, ok := p.dbHandle.userTemplatesIdx[ID]; ok {
+		return p.userTemplateExistsInternal(val)
+	}
+	return UserTemplate{}, &RecordNotFoundError{err: fmt.Sprintf("user template with ID %v does not exist", ID)}
+}
+
+func (p MemoryProvider) addUserTemplate(template UserTemplate) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	_, err = p.userTemplateExistsInternal(template.Name)
+	if err == nil {
+		return fmt.Errorf("user template %v already exists", template.Name)
+	}
+	template.ID = p.getNextUserTemplateID()
+	p.dbHandle.userTemplates[template.Name] = template
+	p.dbHandle.userTemplatesIdx[template.ID] = template.Name
+	p.dbHandle.userTemplateNames = append(p.dbHandle.userTemplateNames, template.Name)
+	sort.Strings(p.dbHandle.userTemplateNames)
+	return nil
+}
+
+func (p MemoryProvider) updateUserTemplate(template UserTemplate) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	_, err = p.userTemplateExistsInternal(template.Name)
+	if err != nil {
+		return err
+	}
+	p.dbHandle.userTemplates[template.Name] = template
+	return nil
+}
+
+func (p MemoryProvider) deleteUserTemplate(template UserTemplate) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	_, err := p.userTemplateExistsInternal(template.Name)
+	if err != nil {
+		return err
+	}
+	delete(p.dbHandle.userTemplates, template.Name)
+	delete(p.dbHandle.userTemplatesIdx, template.ID)
+	p.dbHandle.userTemplateNames = []string{}
+	for name := range p.dbHandle.userTemplates {
+		p.dbHandle.userTemplateNames = append(p.dbHandle.userTemplateNames, name)
+	}
+	sort.Strings(p.dbHandle.userTemplateNames)
+	return nil
+}
+
+func (p MemoryProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return templates, errMemoryProviderClosed
+	}
+	for _, name := range p.dbHandle.userTemplateNames {
+		template := p.dbHandle.userTemplates[name]
+		templates = append(templates, template.getACopy())
+	}
+	return templates, nil
+}
+
+func (p MemoryProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	var err error
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return templates, errMemoryProviderClosed
+	}
+	if limit <= 0 {
+		return templates, err
+	}
+	if len(name) > 0 {
+		if offset == 0 {
+			template, err := p.userTemplateExistsInternal(name)
+			if err == nil {
+				templates = append(templates, template)
+			}
+		}
+		return templates, err
+	}
+	itNum := 0
+	for i := range p.dbHandle.userTemplateNames {
+		itNum++
+		if itNum <= offset {
+			continue
+		}
+		idx := i
+		if order != "ASC" {
+			idx = len(p.dbHandle.userTemplateNames) - 1 - i
+		}
+		template := p.dbHandle.userTemplates[p.dbHandle.userTemplateNames[idx]]
+		templates = append(templates, template.getACopy())
+		if len(templates) >= limit {
+			break
+		}
+	}
+	return templates, err
+}
+
+func (p MemoryProvider) getNextUserTemplateID() int64 {
+	nextID := int64(1)
+	for id := range p.dbHandle.userTemplatesIdx {
+		if id >= nextID {
+			nextID = id + 1
+		}
+	}
+	return nextID
+}
+
+func (p MemoryProvider) addDefenderEvent(ip string, score int) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	host := p.dbHandle.defenderHosts[ip]
+	host.IP = ip
+	host.Events = append(host.Events, defenderEvent{
+		DateTime: utils.GetTimeAsMsSinceEpoch(time.Now()),
+		Score:    score,
+	})
+	p.dbHandle.defenderHosts[ip] = host
+	return nil
+}
+
+func (p MemoryProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return DefenderEntry{}, errMemoryProviderClosed
+	}
+	if host, ok := p.dbHandle.defenderHosts[ip]; ok {
+		entry := host.getEntry(0)
+		if entry.IsBanned() {
+			return entry, nil
+		}
+	}
+	return DefenderEntry{}, &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+}
+
+func (p MemoryProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return DefenderEntry{}, errMemoryProviderClosed
+	}
+	if host, ok := p.dbHandle.defenderHosts[ip]; ok {
+		entry := host.getEntry(from)
+		if entry.isTracked() {
+			return entry, nil
+		}
+	}
+	return DefenderEntry{}, &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+}
+
+func (p MemoryProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	entries := []DefenderEntry{}
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return entries, errMemoryProviderClosed
+	}
+	for _, host := range p.dbHandle.defenderHosts {
+		entry := host.getEntry(from)
+		if entry.isTracked() {
+			entries = append(entries, entry)
+		}
+	}
+	return sortDefenderEntries(entries, limit), nil
+}
+
+func (p MemoryProvider) setDefenderBanTime(ip string, banTime int64) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	p.dbHandle.defenderHosts[ip] = defenderHost{
+		IP:      ip,
+		BanTime: banTime,
+	}
+	return nil
+}
+
+func (p MemoryProvider) updateDefenderBanTime(ip string, minutes int) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	host, ok := p.dbHandle.defenderHosts[ip]
+	if !ok || host.BanTime <= utils.GetTimeAsMsSinceEpoch(time.Now()) {
+		return &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+	}
+	host.BanTime += int64(minutes) * 60 * 1000
+	p.dbHandle.defenderHosts[ip] = host
+	return nil
+}
+
+func (p MemoryProvider) deleteDefenderHost(ip string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	if _, ok := p.dbHandle.defenderHosts[ip]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+	}
+	delete(p.dbHandle.defenderHosts, ip)
+	return nil
+}
+
+func (p MemoryProvider) cleanupDefender(from int64) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for ip, host := range p.dbHandle.defenderHosts {
+		if host.cleanup(from) {
+			p.dbHandle.defenderHosts[ip] = host
 		} else {
-			user.LastLogin = 0
-			user.UsedQuotaSize = 0
-			user.UsedQuotaFiles = 0
+			delete(p.dbHandle.defenderHosts, ip)
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) addActiveSession(session ActiveSession) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	session.UpdatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	p.dbHandle.activeSessions[session.getKey()] = session
+	return nil
+}
+
+func (p MemoryProvider) deleteActiveSession(nodeID, connectionID string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	key := getActiveSessionKey(nodeID, connectionID)
+	if _, ok := p.dbHandle.activeSessions[key]; !ok {
+		return &RecordNotFoundError{err: fmt.Sprintf("session %v does not exist", key)}
+	}
+	delete(p.dbHandle.activeSessions, key)
+	return nil
+}
+
+func (p MemoryProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	for key, session := range p.dbHandle.activeSessions {
+		if session.NodeID == nodeID {
+			session.UpdatedAt = now
+			p.dbHandle.activeSessions[key] = session
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return 0, errMemoryProviderClosed
+	}
+	count := 0
+	for _, session := range p.dbHandle.activeSessions {
+		if session.Username == username && session.UpdatedAt > from {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (p MemoryProvider) cleanupActiveSessions(before int64) error {
+	p.dbHandle.lock.Lock()
+	defer p.dbHandle.lock.Unlock()
+	if p.dbHandle.isClosed {
+		return errMemoryProviderClosed
+	}
+	for key, session := range p.dbHandle.activeSessions {
+		if session.UpdatedAt < before {
+			delete(p.dbHandle.activeSessions, key)
+		}
+	}
+	return nil
+}
+
+func (p MemoryProvider) reloadConfig() error {
+	if len(p.dbHandle.configFile) == 0 {
+		providerLog(logger.LevelDebug, "no users configuration file defined")
+		return nil
+	}
+	providerLog(logger.LevelDebug, "loading users from file: %#v", p.dbHandle.configFile)
+	fi, err := os.Stat(p.dbHandle.configFile)
+	if err != nil && os.IsNotExist(err) && p.dbHandle.persistInterval > 0 {
+		providerLog(logger.LevelDebug, "users configuration file %#v does not exist yet, it will be created",
+			p.dbHandle.configFile)
+		return nil
+	}
+	if err != nil {
+		providerLog(logger.LevelWarn, "error loading users: %v", err)
+		return err
+	}
+	if fi.Size() == 0 {
+		err = errors.New("users configuration file is invalid, its size must be > 0")
+		providerLog(logger.LevelWarn, "error loading users: %v", err)
+		return err
+	}
+	if fi.Size() > 10485760 {
+		err = errors.New("users configuration file is invalid, its size must be <= 10485760 bytes")
+		providerLog(logger.LevelWarn, "error loading users: %v", err)
+		return err
+	}
+	content, err := ioutil.ReadFile(p.dbHandle.configFile)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error loading users: %v", err)
+		return err
+	}
+	var dump BackupData
+	err = json.Unmarshal(content, &dump)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error loading users: %v", err)
+		return err
+	}
+	p.clearUsers()
+	for _, group := range dump.Groups {
+		group.ID = 0
+		err = p.addGroup(group)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding group %#v: %v", group.Name, err)
+			return err
+		}
+	}
+	for _, admin := range dump.Admins {
+		admin.ID = 0
+		err = p.addAdmin(admin)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding admin %#v: %v", admin.Username, err)
+			return err
+		}
+	}
+	for _, key := range dump.APIKeys {
+		key.ID = 0
+		err = validateAPIKey(p, &key)
+		if err == nil {
+			err = p.addAPIKey(key)
+		}
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding API key %#v: %v", key.KeyID, err)
+			return err
+		}
+	}
+	for _, user := range dump.Users {
+		u, err := p.userExists(user.Username)
+		if err == nil {
+			user.ID = u.ID
+			user.LastLogin = u.LastLogin
+			user.UsedQuotaSize = u.UsedQuotaSize
+			user.UsedQuotaFiles = u.UsedQuotaFiles
+			err = p.updateUser(user)
+			if err != nil {
+				providerLog(logger.LevelWarn, "error updating user %#v: %v", user.Username, err)
+				return err
+			}
+		} else {
+			// the saved quota usage and last login are restored only if the file is written by us
+			if p.dbHandle.persistInterval <= 0 {
+				user.LastLogin = 0
+				user.UsedQuotaSize = 0
+				user.UsedQuotaFiles = 0
+			}
 			err = p.addUser(user)
 			if err != nil {
 				providerLog(logger.LevelWarn, "error adding user %#v: %v", user.Username, err)
@@ -387,6 +1674,33 @@ func (p MemoryProvider) reloadConfig() error {
 			}
 		}
 	}
+	for _, share := range dump.Shares {
+		share.ID = 0
+		err = validateShare(p, &share)
+		if err == nil {
+			err = p.addShare(share)
+		}
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding share %#v: %v", share.ShareID, err)
+			return err
+		}
+	}
+	for _, rule := range dump.EventRules {
+		rule.ID = 0
+		err = p.addEventRule(rule)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding event rule %#v: %v", rule.Name, err)
+			return err
+		}
+	}
+	for _, template := range dump.UserTemplates {
+		template.ID = 0
+		err = p.addUserTemplate(template)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error adding user template %#v: %v", template.Name, err)
+			return err
+		}
+	}
 	providerLog(logger.LevelDebug, "users loaded from file: %#v", p.dbHandle.configFile)
 	return nil
 }
@@ -1,11 +1,17 @@
 package dataprovider
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"strings"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
+
 	"github.com/drakkan/sftpgo/logger"
 )
 
@@ -20,6 +26,47 @@ const (
 		"`filesystem` longtext DEFAULT NULL);"
 	mysqlSchemaTableSQL = "CREATE TABLE `schema_version` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, `version` integer NOT NULL);"
 	mysqlUsersV2SQL     = "ALTER TABLE `{{users}}` ADD COLUMN `virtual_folders` longtext NULL;"
+	mysqlUsersV3SQL     = "ALTER TABLE `{{users}}` ADD COLUMN `upload_data_transfer` bigint DEFAULT 0 NOT NULL, " +
+		"ADD COLUMN `download_data_transfer` bigint DEFAULT 0 NOT NULL, " +
+		"ADD COLUMN `used_upload_data_transfer` bigint DEFAULT 0 NOT NULL, " +
+		"ADD COLUMN `used_download_data_transfer` bigint DEFAULT 0 NOT NULL, " +
+		"ADD COLUMN `data_transfer_reset` integer DEFAULT 0 NOT NULL, " +
+		"ADD COLUMN `last_data_transfer_reset` bigint DEFAULT 0 NOT NULL;"
+	mysqlUsersV4SQL  = "ALTER TABLE `{{users}}` ADD COLUMN `group_names` longtext NULL;"
+	mysqlGroupsV4SQL = "CREATE TABLE `{{groups}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`name` varchar(255) NOT NULL UNIQUE, `description` varchar(512) NULL, `max_sessions` integer NOT NULL, " +
+		"`quota_size` bigint NOT NULL, `quota_files` integer NOT NULL, `permissions` longtext NULL, " +
+		"`upload_bandwidth` integer NOT NULL, `download_bandwidth` integer NOT NULL, `filters` longtext NULL, " +
+		"`filesystem` longtext NULL);"
+	mysqlAdminsV5SQL = "CREATE TABLE `{{admins}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`username` varchar(255) NOT NULL UNIQUE, `password` varchar(255) NOT NULL, `status` integer NOT NULL, " +
+		"`permissions` longtext NOT NULL, `description` varchar(512) NULL);"
+	mysqlAPIKeysV6SQL = "CREATE TABLE `{{api_keys}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`key_id` varchar(50) NOT NULL UNIQUE, `key_hash` varchar(255) NOT NULL, `name` varchar(255) NOT NULL, " +
+		"`admin` varchar(255) NOT NULL, `scopes` longtext NOT NULL, `created_at` bigint NOT NULL, " +
+		"`expires_at` bigint NOT NULL, `last_use_at` bigint NOT NULL, `description` varchar(512) NULL);"
+	mysqlSharesV7SQL = "CREATE TABLE `{{shares}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`share_id` varchar(60) NOT NULL UNIQUE, `name` varchar(255) NOT NULL, `description` varchar(512) NULL, " +
+		"`scope` integer NOT NULL, `path` longtext NOT NULL, `username` varchar(255) NOT NULL, " +
+		"`created_at` bigint NOT NULL, `expires_at` bigint NOT NULL, `last_use_at` bigint NOT NULL, " +
+		"`password` varchar(255) NULL, `max_tokens` integer NOT NULL, `used_tokens` integer NOT NULL);"
+	mysqlUsersV8SQL        = "ALTER TABLE `{{users}}` ADD COLUMN `activation_date` bigint DEFAULT 0 NOT NULL;"
+	mysqlUsersV9SQL        = "ALTER TABLE `{{users}}` ADD COLUMN `last_password_change` bigint DEFAULT 0 NOT NULL;"
+	mysqlEventsRulesV10SQL = "CREATE TABLE `{{events_rules}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`name` varchar(255) NOT NULL UNIQUE, `description` varchar(512) NULL, `status` integer NOT NULL, " +
+		"`trigger_type` integer NOT NULL, `conditions` longtext NOT NULL, `action_config` longtext NOT NULL);"
+	mysqlUserTemplatesV11SQL = "CREATE TABLE `{{user_templates}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`name` varchar(255) NOT NULL UNIQUE, `description` varchar(512) NULL, `user_settings` longtext NOT NULL);"
+	mysqlDefenderHostsV12SQL = "CREATE TABLE `{{defender_hosts}}` (`id` integer AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`ip` varchar(50) NOT NULL UNIQUE, `ban_time` bigint NOT NULL);"
+	mysqlDefenderEventsV12SQL = "CREATE TABLE `{{defender_events}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`ip` varchar(50) NOT NULL, `date_time` bigint NOT NULL, `score` integer NOT NULL);"
+	mysqlActiveSessionsV13SQL = "CREATE TABLE `{{active_sessions}}` (`id` bigint AUTO_INCREMENT NOT NULL PRIMARY KEY, " +
+		"`connection_id` varchar(100) NOT NULL, `node_id` varchar(50) NOT NULL, `username` varchar(255) NOT NULL, " +
+		"`protocol` varchar(30) NOT NULL, `updated_at` bigint NOT NULL);"
+	mysqlAdminsV14SQL = "ALTER TABLE `{{admins}}` ADD COLUMN `filters` longtext NULL;"
+	// name for the TLS configuration registered if a CA bundle or a client certificate is configured
+	mysqlCustomTLSConfigName = "sftpgo"
 )
 
 // MySQLProvider auth provider for MySQL/MariaDB database
@@ -30,6 +77,12 @@ type MySQLProvider struct {
 func initializeMySQLProvider() error {
 	var err error
 	logSender = MySQLDataProviderName
+	if hasMySQLCustomTLSConfig() {
+		if err = registerMySQLCustomTLSConfig(); err != nil {
+			providerLog(logger.LevelWarn, "unable to register the mysql TLS configuration: %v", err)
+			return err
+		}
+	}
 	dbHandle, err := sql.Open("mysql", getMySQLConnectionString(false))
 	if err == nil {
 		providerLog(logger.LevelDebug, "mysql database handle created, connection string: %#v, pool size: %v",
@@ -50,14 +103,55 @@ func getMySQLConnectionString(redactedPwd bool) string {
 		if redactedPwd {
 			password = "[redacted]"
 		}
+		sslMode := getSSLMode()
+		if hasMySQLCustomTLSConfig() {
+			sslMode = mysqlCustomTLSConfigName
+		}
 		connectionString = fmt.Sprintf("%v:%v@tcp([%v]:%v)/%v?charset=utf8&interpolateParams=true&timeout=10s&tls=%v&writeTimeout=10s&readTimeout=10s",
-			config.Username, password, config.Host, config.Port, config.Name, getSSLMode())
+			config.Username, password, config.Host, config.Port, config.Name, sslMode)
 	} else {
 		connectionString = config.ConnectionString
 	}
 	return connectionString
 }
 
+// hasMySQLCustomTLSConfig returns true if TLS is enabled and a CA bundle or a client
+// certificate is configured, the builtin TLS modes cannot be used in this case
+func hasMySQLCustomTLSConfig() bool {
+	return config.SSLMode != 0 && (len(config.RootCert) > 0 || len(config.ClientCert) > 0)
+}
+
+// registerMySQLCustomTLSConfig registers the TLS configuration built using the configured
+// CA bundle and client certificate. The server certificate verification is skipped for
+// ssl mode 2, as for the builtin skip-verify mode, otherwise the certificate is verified
+func registerMySQLCustomTLSConfig() error {
+	tlsConfig := &tls.Config{}
+	if len(config.RootCert) > 0 {
+		rootCerts, err := ioutil.ReadFile(config.RootCert)
+		if err != nil {
+			return err
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(rootCerts) {
+			return errors.New("unable to parse the CA certificates")
+		}
+		tlsConfig.RootCAs = rootCAs
+	}
+	if len(config.ClientCert) > 0 {
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.SSLMode == 2 {
+		tlsConfig.InsecureSkipVerify = true
+	} else {
+		tlsConfig.ServerName = config.Host
+	}
+	return mysql.RegisterTLSConfig(mysqlCustomTLSConfigName, tlsConfig)
+}
+
 func (p MySQLProvider) checkAvailability() error {
 	return sqlCommonCheckAvailability(p.dbHandle)
 }
@@ -78,10 +172,22 @@ func (p MySQLProvider) updateQuota(username string, filesAdd int, sizeAdd int64,
 	return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p MySQLProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	return sqlCommonUpdateDataTransfer(username, uploadAdd, downloadAdd, reset, p.dbHandle)
+}
+
+func (p MySQLProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedDataTransfer(username, p.dbHandle)
+}
+
 func (p MySQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p MySQLProvider) updateUserPassword(username, password string) error {
+	return sqlCommonUpdateUserPassword(username, password, p.dbHandle)
+}
+
 func (p MySQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
@@ -110,6 +216,222 @@ func (p MySQLProvider) getUsers(limit int, offset int, order string, username st
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p MySQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p MySQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p MySQLProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.dbHandle)
+}
+
+func (p MySQLProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.dbHandle)
+}
+
+func (p MySQLProvider) eventRuleExists(name string) (EventRule, error) {
+	return sqlCommonCheckEventRuleExists(name, p.dbHandle)
+}
+
+func (p MySQLProvider) addEventRule(rule EventRule) error {
+	return sqlCommonAddEventRule(rule, p.dbHandle)
+}
+
+func (p MySQLProvider) updateEventRule(rule EventRule) error {
+	return sqlCommonUpdateEventRule(rule, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteEventRule(rule EventRule) error {
+	return sqlCommonDeleteEventRule(rule, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpEventRules() ([]EventRule, error) {
+	return sqlCommonDumpEventRules(p.dbHandle)
+}
+
+func (p MySQLProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, name, p.dbHandle)
+}
+
+func (p MySQLProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	return sqlCommonGetEventRuleByID(ID, p.dbHandle)
+}
+
+func (p MySQLProvider) userTemplateExists(name string) (UserTemplate, error) {
+	return sqlCommonCheckUserTemplateExists(name, p.dbHandle)
+}
+
+func (p MySQLProvider) addUserTemplate(template UserTemplate) error {
+	return sqlCommonAddUserTemplate(template, p.dbHandle)
+}
+
+func (p MySQLProvider) updateUserTemplate(template UserTemplate) error {
+	return sqlCommonUpdateUserTemplate(template, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteUserTemplate(template UserTemplate) error {
+	return sqlCommonDeleteUserTemplate(template, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	return sqlCommonDumpUserTemplates(p.dbHandle)
+}
+
+func (p MySQLProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	return sqlCommonGetUserTemplates(limit, offset, order, name, p.dbHandle)
+}
+
+func (p MySQLProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	return sqlCommonGetUserTemplateByID(ID, p.dbHandle)
+}
+
+func (p MySQLProvider) addDefenderEvent(ip string, score int) error {
+	return sqlCommonAddDefenderEvent(ip, score, p.dbHandle)
+}
+
+func (p MySQLProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p MySQLProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p MySQLProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p MySQLProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+}
+
+func (p MySQLProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteDefenderHost(ip string) error {
+	return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+}
+
+func (p MySQLProvider) cleanupDefender(from int64) error {
+	return sqlCommonCleanupDefender(from, p.dbHandle)
+}
+
+func (p MySQLProvider) addActiveSession(session ActiveSession) error {
+	return sqlCommonAddActiveSession(session, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteActiveSession(nodeID, connectionID string) error {
+	return sqlCommonDeleteActiveSession(nodeID, connectionID, p.dbHandle)
+}
+
+func (p MySQLProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	return sqlCommonUpdateActiveSessionsHeartbeat(nodeID, p.dbHandle)
+}
+
+func (p MySQLProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	return sqlCommonGetActiveSessionsCount(username, from, p.dbHandle)
+}
+
+func (p MySQLProvider) cleanupActiveSessions(before int64) error {
+	return sqlCommonCleanupActiveSessions(before, p.dbHandle)
+}
+
+func (p MySQLProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonCheckAdminExists(username, p.dbHandle)
+}
+
+func (p MySQLProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) updateAdminPassword(username, password string) error {
+	return sqlCommonUpdateAdminPassword(username, password, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p MySQLProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, username, p.dbHandle)
+}
+
+func (p MySQLProvider) getAdminByID(ID int64) (Admin, error) {
+	return sqlCommonGetAdminByID(ID, p.dbHandle)
+}
+
+func (p MySQLProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonCheckAPIKeyExists(keyID, p.dbHandle)
+}
+
+func (p MySQLProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p MySQLProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpAPIKeys() ([]APIKey, error) {
+	return sqlCommonDumpAPIKeys(p.dbHandle)
+}
+
+func (p MySQLProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p MySQLProvider) shareExists(shareID string) (Share, error) {
+	return sqlCommonCheckShareExists(shareID, p.dbHandle)
+}
+
+func (p MySQLProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p MySQLProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p MySQLProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p MySQLProvider) dumpShares() ([]Share, error) {
+	return sqlCommonDumpShares(p.dbHandle)
+}
+
+func (p MySQLProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
 func (p MySQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -152,8 +474,345 @@ func (p MySQLProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updateMySQLDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updateMySQLDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 2:
+		err = updateMySQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 3:
+		err = updateMySQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 4:
+		err = updateMySQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 5:
+		err = updateMySQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 6:
+		err = updateMySQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 7:
+		err = updateMySQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 8:
+		err = updateMySQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 9:
+		err = updateMySQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 10:
+		err = updateMySQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 11:
+		err = updateMySQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 12:
+		err = updateMySQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
+	case 13:
+		return updateMySQLDatabaseFrom13To14(p.dbHandle)
 	}
 	return nil
 }
@@ -177,3 +836,82 @@ func updateMySQLDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return tx.Commit()
 }
+
+func updateMySQLDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	sql := strings.Replace(mysqlUsersV3SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 3)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updateMySQLDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	return sqlCommonExecMigrationWithTX(dbHandle, 4, strings.Replace(mysqlUsersV4SQL, "{{users}}", config.UsersTable, 1),
+		strings.Replace(mysqlGroupsV4SQL, "{{groups}}", sqlGroupsTable, 1))
+}
+
+func updateMySQLDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	return sqlCommonExecMigrationWithTX(dbHandle, 5, strings.Replace(mysqlAdminsV5SQL, "{{admins}}", sqlAdminsTable, 1))
+}
+
+func updateMySQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	return sqlCommonExecMigrationWithTX(dbHandle, 6, strings.Replace(mysqlAPIKeysV6SQL, "{{api_keys}}", sqlAPIKeysTable, 1))
+}
+
+func updateMySQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	return sqlCommonExecMigrationWithTX(dbHandle, 7, strings.Replace(mysqlSharesV7SQL, "{{shares}}", sqlSharesTable, 1))
+}
+
+func updateMySQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	return sqlCommonExecMigrationWithTX(dbHandle, 8, strings.Replace(mysqlUsersV8SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updateMySQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	return sqlCommonExecMigrationWithTX(dbHandle, 9, strings.Replace(mysqlUsersV9SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updateMySQLDatabaseFrom9To10(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	return sqlCommonExecMigrationWithTX(dbHandle, 10, strings.Replace(mysqlEventsRulesV10SQL, "{{events_rules}}",
+		sqlEventsRulesTable, 1))
+}
+
+func updateMySQLDatabaseFrom10To11(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	return sqlCommonExecMigrationWithTX(dbHandle, 11, strings.Replace(mysqlUserTemplatesV11SQL, "{{user_templates}}",
+		sqlUserTemplatesTable, 1))
+}
+
+func updateMySQLDatabaseFrom11To12(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	return sqlCommonExecMigrationWithTX(dbHandle, 12, getDefenderV12Statements(mysqlDefenderHostsV12SQL,
+		mysqlDefenderEventsV12SQL)...)
+}
+
+func updateMySQLDatabaseFrom12To13(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	return sqlCommonExecMigrationWithTX(dbHandle, 13, getActiveSessionsV13Statements(mysqlActiveSessionsV13SQL)...)
+}
+
+func updateMySQLDatabaseFrom13To14(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	return sqlCommonExecMigrationWithTX(dbHandle, 14, strings.Replace(mysqlAdminsV14SQL, "{{admins}}", sqlAdminsTable, 1))
+}
@@ -0,0 +1,99 @@
+package dataprovider
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// the users with this password are authenticated using PAM
+	pamPwdPrefix           = "$pam$"
+	pamUsernamePlaceholder = "{{username}}"
+)
+
+// PAMConfig defines the PAM authentication for passwords, it is supported on Linux only
+type PAMConfig struct {
+	// PAM service name, for example "sftpgo" to use the rules defined in /etc/pam.d/sftpgo.
+	// Leave empty to disable the PAM authentication
+	Service string `json:"service" mapstructure:"service"`
+	// Set to true to automatically add the users not defined inside the data provider after a
+	// successful PAM authentication. If false, only the users with the password set to "$pam$"
+	// are authenticated using PAM
+	AutoCreate bool `json:"auto_create" mapstructure:"auto_create"`
+	// Template for the home directory of the automatically added users, for example
+	// "/srv/sftpgo/{{username}}". Empty means the users base dir
+	HomeDirTemplate string `json:"home_dir_template" mapstructure:"home_dir_template"`
+	// Permissions for the automatically added users
+	DefaultPermissions map[string][]string `json:"default_permissions" mapstructure:"default_permissions"`
+}
+
+// IsEnabled returns true if the PAM authentication is configured
+func (c *PAMConfig) IsEnabled() bool {
+	return len(c.Service) > 0
+}
+
+func (c *PAMConfig) validate() error {
+	if !isPAMSupported() {
+		return errors.New("PAM authentication is not supported on this platform")
+	}
+	if c.AutoCreate && len(c.DefaultPermissions["/"]) == 0 {
+		return errors.New("default permissions for the root directory are required to automatically add the PAM users")
+	}
+	return nil
+}
+
+// checkUserAndPassOrPAM checks the given password using PAM if the PAM authentication
+// is enabled and the user password is "$pam$". The other users are checked as usual
+func checkUserAndPassOrPAM(user User, password, ip string) (User, error) {
+	if user.Password != pamPwdPrefix || !config.PAM.IsEnabled() {
+		return checkUserAndPass(user, password)
+	}
+	if err := checkLoginConditions(user); err != nil {
+		return user, err
+	}
+	if len(password) == 0 {
+		return user, errors.New("Credentials cannot be null or empty")
+	}
+	return user, pamAuthenticate(config.PAM.Service, user.Username, password, ip)
+}
+
+// doPAMAuth authenticates the given user. The users defined inside the data provider are authenticated
+// as usual, PAM is used if their password is "$pam$". The missing users are added, if enabled, after a
+// successful PAM authentication. The passwords are never stored inside the data provider
+func doPAMAuth(username, password, ip string) (User, error) {
+	user, err := provider.userExists(username)
+	if err == nil {
+		return checkUserAndPassOrPAM(user, password, ip)
+	}
+	if _, ok := err.(*RecordNotFoundError); !ok || !config.PAM.AutoCreate {
+		return user, err
+	}
+	if len(password) == 0 {
+		return user, errors.New("Credentials cannot be null or empty")
+	}
+	if err = pamAuthenticate(config.PAM.Service, username, password, ip); err != nil {
+		return user, err
+	}
+	user = User{
+		Username:    username,
+		Password:    pamPwdPrefix,
+		Status:      1,
+		HomeDir:     strings.Replace(config.PAM.HomeDirTemplate, pamUsernamePlaceholder, username, -1),
+		Permissions: make(map[string][]string),
+	}
+	for dir, perms := range config.PAM.DefaultPermissions {
+		user.Permissions[dir] = append([]string(nil), perms...)
+	}
+	if err = provider.addUser(user); err != nil {
+		providerLog(logger.LevelWarn, "unable to add the PAM user %#v: %v", username, err)
+		return user, err
+	}
+	providerLog(logger.LevelInfo, "PAM user %#v added", username)
+	user, err = provider.userExists(username)
+	if err != nil {
+		return user, err
+	}
+	return user, checkLoginConditions(user)
+}
@@ -0,0 +1,183 @@
+// +build cgo
+
+package dataprovider
+
+/*
+#cgo LDFLAGS: -ldl
+
+#include <dlfcn.h>
+#include <stdio.h>
+#include <stdlib.h>
+#include <string.h>
+
+// libpam is loaded at runtime, so neither the PAM headers nor the library are required to build SFTPGo.
+// These definitions are stable and match the ones in security/pam_appl.h and security/_pam_types.h
+
+#define SFTPGO_PAM_SUCCESS 0
+#define SFTPGO_PAM_BUF_ERR 5
+#define SFTPGO_PAM_CONV_ERR 19
+#define SFTPGO_PAM_PROMPT_ECHO_OFF 1
+#define SFTPGO_PAM_ERROR_MSG 3
+#define SFTPGO_PAM_TEXT_INFO 4
+#define SFTPGO_PAM_SILENT 0x8000
+#define SFTPGO_PAM_RHOST 4
+// returned if libpam cannot be loaded
+#define SFTPGO_PAM_UNAVAILABLE -1
+
+struct sftpgo_pam_message {
+	int msg_style;
+	const char *msg;
+};
+
+struct sftpgo_pam_response {
+	char *resp;
+	int resp_retcode;
+};
+
+struct sftpgo_pam_conv {
+	int (*conv)(int, const struct sftpgo_pam_message **, struct sftpgo_pam_response **, void *);
+	void *appdata_ptr;
+};
+
+typedef int (*pam_start_fn)(const char *, const char *, const struct sftpgo_pam_conv *, void **);
+typedef int (*pam_set_item_fn)(void *, int, const void *);
+typedef int (*pam_authenticate_fn)(void *, int);
+typedef int (*pam_acct_mgmt_fn)(void *, int);
+typedef int (*pam_end_fn)(void *, int);
+typedef const char *(*pam_strerror_fn)(void *, int);
+
+// sftpgo_pam_conv_func answers the password prompts with the password passed as appdata_ptr
+static int sftpgo_pam_conv_func(int num_msg, const struct sftpgo_pam_message **msg,
+	struct sftpgo_pam_response **resp, void *appdata_ptr) {
+	struct sftpgo_pam_response *responses;
+	int i;
+
+	if (num_msg <= 0) {
+		return SFTPGO_PAM_CONV_ERR;
+	}
+	responses = calloc(num_msg, sizeof(struct sftpgo_pam_response));
+	if (responses == NULL) {
+		return SFTPGO_PAM_BUF_ERR;
+	}
+	for (i = 0; i < num_msg; i++) {
+		switch (msg[i]->msg_style) {
+		case SFTPGO_PAM_PROMPT_ECHO_OFF:
+			responses[i].resp = strdup((const char *)appdata_ptr);
+			if (responses[i].resp == NULL) {
+				goto fail;
+			}
+			break;
+		case SFTPGO_PAM_ERROR_MSG:
+		case SFTPGO_PAM_TEXT_INFO:
+			break;
+		default:
+			// other questions, for example one time passwords, cannot be answered
+			goto fail;
+		}
+	}
+	*resp = responses;
+	return SFTPGO_PAM_SUCCESS;
+
+fail:
+	for (i = 0; i < num_msg; i++) {
+		if (responses[i].resp != NULL) {
+			memset(responses[i].resp, 0, strlen(responses[i].resp));
+			free(responses[i].resp);
+		}
+	}
+	free(responses);
+	return SFTPGO_PAM_CONV_ERR;
+}
+
+static int sftpgo_pam_authenticate(const char *service, const char *username, const char *password,
+	const char *rhost, char *errbuf, size_t errbuf_size) {
+	void *lib, *handle = NULL;
+	pam_start_fn pam_start;
+	pam_set_item_fn pam_set_item;
+	pam_authenticate_fn pam_authenticate;
+	pam_acct_mgmt_fn pam_acct_mgmt;
+	pam_end_fn pam_end;
+	pam_strerror_fn pam_strerror;
+	struct sftpgo_pam_conv conv;
+	int ret;
+
+	lib = dlopen("libpam.so.0", RTLD_NOW | RTLD_GLOBAL);
+	if (lib == NULL) {
+		snprintf(errbuf, errbuf_size, "%s", dlerror());
+		return SFTPGO_PAM_UNAVAILABLE;
+	}
+	pam_start = (pam_start_fn)dlsym(lib, "pam_start");
+	pam_set_item = (pam_set_item_fn)dlsym(lib, "pam_set_item");
+	pam_authenticate = (pam_authenticate_fn)dlsym(lib, "pam_authenticate");
+	pam_acct_mgmt = (pam_acct_mgmt_fn)dlsym(lib, "pam_acct_mgmt");
+	pam_end = (pam_end_fn)dlsym(lib, "pam_end");
+	pam_strerror = (pam_strerror_fn)dlsym(lib, "pam_strerror");
+	if (!pam_start || !pam_set_item || !pam_authenticate || !pam_acct_mgmt || !pam_end || !pam_strerror) {
+		snprintf(errbuf, errbuf_size, "unable to find the PAM functions");
+		return SFTPGO_PAM_UNAVAILABLE;
+	}
+	conv.conv = sftpgo_pam_conv_func;
+	conv.appdata_ptr = (void *)password;
+	ret = pam_start(service, username, &conv, &handle);
+	if (ret != SFTPGO_PAM_SUCCESS) {
+		snprintf(errbuf, errbuf_size, "%s", pam_strerror(handle, ret));
+		return ret;
+	}
+	ret = pam_set_item(handle, SFTPGO_PAM_RHOST, rhost);
+	if (ret == SFTPGO_PAM_SUCCESS) {
+		ret = pam_authenticate(handle, SFTPGO_PAM_SILENT);
+	}
+	// check the account validity too, for example expired or locked accounts
+	if (ret == SFTPGO_PAM_SUCCESS) {
+		ret = pam_acct_mgmt(handle, SFTPGO_PAM_SILENT);
+	}
+	if (ret != SFTPGO_PAM_SUCCESS) {
+		snprintf(errbuf, errbuf_size, "%s", pam_strerror(handle, ret));
+	}
+	pam_end(handle, ret);
+	return ret;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const pamErrorBufferSize = 256
+
+func isPAMSupported() bool {
+	return true
+}
+
+// pamAuthenticate verifies the given credentials using the configured PAM service
+func pamAuthenticate(service, username, password, ip string) error {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
+	cUsername := C.CString(username)
+	defer C.free(unsafe.Pointer(cUsername))
+	cPassword := C.CString(password)
+	defer func() {
+		C.memset(unsafe.Pointer(cPassword), 0, C.size_t(len(password)))
+		C.free(unsafe.Pointer(cPassword))
+	}()
+	cIP := C.CString(ip)
+	defer C.free(unsafe.Pointer(cIP))
+	errBuf := (*C.char)(C.calloc(pamErrorBufferSize, 1))
+	defer C.free(unsafe.Pointer(errBuf))
+
+	ret := C.sftpgo_pam_authenticate(cService, cUsername, cPassword, cIP, errBuf, pamErrorBufferSize)
+	if ret == C.SFTPGO_PAM_SUCCESS {
+		return nil
+	}
+	if ret == C.SFTPGO_PAM_UNAVAILABLE {
+		return fmt.Errorf("unable to load the PAM library: %v", C.GoString(errBuf))
+	}
+	providerLog(logger.LevelDebug, "PAM authentication failed for user %#v, service %#v: %v", username, service,
+		C.GoString(errBuf))
+	return errors.New("Invalid credentials")
+}
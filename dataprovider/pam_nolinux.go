@@ -0,0 +1,13 @@
+// +build !linux !cgo
+
+package dataprovider
+
+import "errors"
+
+func isPAMSupported() bool {
+	return false
+}
+
+func pamAuthenticate(service, username, password, ip string) error {
+	return errors.New("PAM authentication is not supported on this platform")
+}
@@ -0,0 +1,126 @@
+package dataprovider
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Filter types reported by a permission check
+const (
+	PermCheckFilterPatterns   = "patterns"
+	PermCheckFilterExtensions = "extensions"
+)
+
+// operations checked against the file filters too
+var permCheckFileOperations = []string{PermDownload, PermUpload, PermOverwrite, PermRename, PermDelete}
+
+// PermissionCheck defines the result of a dry-run permission check, it reports if an
+// operation on a virtual path would be allowed for a user and why
+type PermissionCheck struct {
+	Username string `json:"username"`
+	// the checked operation, it is one of the user permissions, for example "download"
+	Operation string `json:"operation"`
+	// the checked virtual path
+	Path    string `json:"path"`
+	Allowed bool   `json:"allowed"`
+	// human readable explanation of the result
+	Reason string `json:"reason"`
+	// the directory the permissions are checked for, this is the parent directory
+	// for all the operations except "list"
+	PermissionsPath string `json:"permissions_path"`
+	// the directory the matching permissions are defined for, empty if no permission matches
+	MatchedPermissionsPath string `json:"matched_permissions_path,omitempty"`
+	// the permissions granted for PermissionsPath
+	Permissions []string `json:"permissions"`
+	// "patterns" or "extensions" if a file filter was applied
+	FilterType string `json:"filter_type,omitempty"`
+	// the directory the applied file filter is defined for
+	FilterPath string `json:"filter_path,omitempty"`
+	// the allowed or denied pattern/extension matching the file name, if any
+	MatchedRule string `json:"matched_rule,omitempty"`
+}
+
+// CheckUserPermission reports if the given operation on the given virtual path would be allowed
+// for the specified user, no filesystem access is done. The group settings are applied.
+// The operation is one of the permissions, except "*": the "list" permission is checked for the
+// path itself, the other permissions for its parent directory as for a real session.
+// The file filters are checked too for download, upload, overwrite, rename and delete
+func CheckUserPermission(p Provider, username, operation, virtualPath string) (PermissionCheck, error) {
+	result := PermissionCheck{
+		Username:  username,
+		Operation: operation,
+		Path:      utils.CleanSFTPPath(virtualPath),
+	}
+	if operation == PermAny || !utils.IsStringInSlice(operation, ValidPerms) {
+		return result, &ValidationError{err: fmt.Sprintf("invalid operation: %#v", operation)}
+	}
+	user, err := GetUserWithGroupSettings(p, username)
+	if err != nil {
+		return result, err
+	}
+	user.checkPermission(&result)
+	return result, nil
+}
+
+func (u *User) checkPermission(result *PermissionCheck) {
+	result.PermissionsPath = result.Path
+	if result.Operation != PermListItems {
+		result.PermissionsPath = path.Dir(result.Path)
+	}
+	result.Permissions, result.MatchedPermissionsPath = u.getPermissionsForPath(result.PermissionsPath)
+	if result.Path == "/" && utils.IsStringInSlice(result.Operation, []string{PermRename, PermDelete, PermCreateSymlinks}) {
+		result.Reason = "the operation is not allowed on the root directory"
+		return
+	}
+	if (result.Operation == PermRename || result.Operation == PermDelete) && u.IsVirtualFolder(result.Path) {
+		result.Reason = "the operation is not allowed on a virtual folder"
+		return
+	}
+	if !utils.IsStringInSlice(PermAny, result.Permissions) && !utils.IsStringInSlice(result.Operation, result.Permissions) {
+		if result.MatchedPermissionsPath == "" {
+			result.Reason = fmt.Sprintf("no permissions defined for %#v", result.PermissionsPath)
+		} else {
+			result.Reason = fmt.Sprintf("permission %#v not granted by the permissions defined for %#v",
+				result.Operation, result.MatchedPermissionsPath)
+		}
+		return
+	}
+	reason := fmt.Sprintf("permission %#v granted by the permissions defined for %#v", result.Operation,
+		result.MatchedPermissionsPath)
+	if utils.IsStringInSlice(result.Operation, permCheckFileOperations) {
+		// the patterns are checked first, as in IsFileAllowed
+		allowed, filterPath, rule := u.checkFilePatterns(result.Path)
+		if filterPath != "" {
+			result.FilterType, result.FilterPath, result.MatchedRule = PermCheckFilterPatterns, filterPath, rule
+		}
+		if allowed {
+			allowed, filterPath, rule = u.checkFileExtensions(result.Path)
+			if filterPath != "" {
+				result.FilterType, result.FilterPath, result.MatchedRule = PermCheckFilterExtensions, filterPath, rule
+			}
+		}
+		if !allowed {
+			if result.MatchedRule != "" {
+				result.Reason = fmt.Sprintf("denied %v %#v defined for %#v", result.FilterType, result.MatchedRule,
+					result.FilterPath)
+			} else {
+				result.Reason = fmt.Sprintf("no allowed %v defined for %#v matches the file name", result.FilterType,
+					result.FilterPath)
+			}
+			return
+		}
+		if result.FilterPath != "" {
+			if result.MatchedRule != "" {
+				reason += fmt.Sprintf(", allowed %v %#v defined for %#v", result.FilterType, result.MatchedRule,
+					result.FilterPath)
+			} else {
+				reason += fmt.Sprintf(", no denied %v defined for %#v matches the file name", result.FilterType,
+					result.FilterPath)
+			}
+		}
+	}
+	result.Allowed = true
+	result.Reason = reason
+}
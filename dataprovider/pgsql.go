@@ -18,6 +18,39 @@ const (
 "filesystem" text NULL);`
 	pgsqlSchemaTableSQL = `CREATE TABLE "schema_version" ("id" serial NOT NULL PRIMARY KEY, "version" integer NOT NULL);`
 	pgsqlUsersV2SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "virtual_folders" text NULL;`
+	pgsqlUsersV3SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "upload_data_transfer" bigint DEFAULT 0 NOT NULL,
+ADD COLUMN "download_data_transfer" bigint DEFAULT 0 NOT NULL, ADD COLUMN "used_upload_data_transfer" bigint DEFAULT 0 NOT NULL,
+ADD COLUMN "used_download_data_transfer" bigint DEFAULT 0 NOT NULL, ADD COLUMN "data_transfer_reset" integer DEFAULT 0 NOT NULL,
+ADD COLUMN "last_data_transfer_reset" bigint DEFAULT 0 NOT NULL;`
+	pgsqlUsersV4SQL  = `ALTER TABLE "{{users}}" ADD COLUMN "group_names" text NULL;`
+	pgsqlGroupsV4SQL = `CREATE TABLE "{{groups}}" ("id" serial NOT NULL PRIMARY KEY, "name" varchar(255) NOT NULL UNIQUE,
+"description" varchar(512) NULL, "max_sessions" integer NOT NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL,
+"permissions" text NULL, "upload_bandwidth" integer NOT NULL, "download_bandwidth" integer NOT NULL, "filters" text NULL,
+"filesystem" text NULL);`
+	pgsqlAdminsV5SQL = `CREATE TABLE "{{admins}}" ("id" serial NOT NULL PRIMARY KEY, "username" varchar(255) NOT NULL UNIQUE,
+"password" varchar(255) NOT NULL, "status" integer NOT NULL, "permissions" text NOT NULL, "description" varchar(512) NULL);`
+	pgsqlAPIKeysV6SQL = `CREATE TABLE "{{api_keys}}" ("id" serial NOT NULL PRIMARY KEY, "key_id" varchar(50) NOT NULL UNIQUE,
+"key_hash" varchar(255) NOT NULL, "name" varchar(255) NOT NULL, "admin" varchar(255) NOT NULL, "scopes" text NOT NULL,
+"created_at" bigint NOT NULL, "expires_at" bigint NOT NULL, "last_use_at" bigint NOT NULL, "description" varchar(512) NULL);`
+	pgsqlSharesV7SQL = `CREATE TABLE "{{shares}}" ("id" serial NOT NULL PRIMARY KEY, "share_id" varchar(60) NOT NULL UNIQUE,
+"name" varchar(255) NOT NULL, "description" varchar(512) NULL, "scope" integer NOT NULL, "path" text NOT NULL,
+"username" varchar(255) NOT NULL, "created_at" bigint NOT NULL, "expires_at" bigint NOT NULL, "last_use_at" bigint NOT NULL,
+"password" varchar(255) NULL, "max_tokens" integer NOT NULL, "used_tokens" integer NOT NULL);`
+	pgsqlUsersV8SQL        = `ALTER TABLE "{{users}}" ADD COLUMN "activation_date" bigint DEFAULT 0 NOT NULL;`
+	pgsqlUsersV9SQL        = `ALTER TABLE "{{users}}" ADD COLUMN "last_password_change" bigint DEFAULT 0 NOT NULL;`
+	pgsqlEventsRulesV10SQL = `CREATE TABLE "{{events_rules}}" ("id" serial NOT NULL PRIMARY KEY,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "status" integer NOT NULL,
+"trigger_type" integer NOT NULL, "conditions" text NOT NULL, "action_config" text NOT NULL);`
+	pgsqlUserTemplatesV11SQL = `CREATE TABLE "{{user_templates}}" ("id" serial NOT NULL PRIMARY KEY,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "user_settings" text NOT NULL);`
+	pgsqlDefenderHostsV12SQL = `CREATE TABLE "{{defender_hosts}}" ("id" serial NOT NULL PRIMARY KEY,
+"ip" varchar(50) NOT NULL UNIQUE, "ban_time" bigint NOT NULL);`
+	pgsqlDefenderEventsV12SQL = `CREATE TABLE "{{defender_events}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"ip" varchar(50) NOT NULL, "date_time" bigint NOT NULL, "score" integer NOT NULL);`
+	pgsqlActiveSessionsV13SQL = `CREATE TABLE "{{active_sessions}}" ("id" bigserial NOT NULL PRIMARY KEY,
+"connection_id" varchar(100) NOT NULL, "node_id" varchar(50) NOT NULL, "username" varchar(255) NOT NULL,
+"protocol" varchar(30) NOT NULL, "updated_at" bigint NOT NULL);`
+	pgsqlAdminsV14SQL = `ALTER TABLE "{{admins}}" ADD COLUMN "filters" text NULL;`
 )
 
 // PGSQLProvider auth provider for PostgreSQL database
@@ -50,6 +83,14 @@ func getPGSQLConnectionString(redactedPwd bool) string {
 		}
 		connectionString = fmt.Sprintf("host='%v' port=%v dbname='%v' user='%v' password='%v' sslmode=%v connect_timeout=10",
 			config.Host, config.Port, config.Name, config.Username, password, getSSLMode())
+		if config.SSLMode != 0 {
+			if len(config.RootCert) > 0 {
+				connectionString += fmt.Sprintf(" sslrootcert='%v'", config.RootCert)
+			}
+			if len(config.ClientCert) > 0 {
+				connectionString += fmt.Sprintf(" sslcert='%v' sslkey='%v'", config.ClientCert, config.ClientKey)
+			}
+		}
 	} else {
 		connectionString = config.ConnectionString
 	}
@@ -76,10 +117,22 @@ func (p PGSQLProvider) updateQuota(username string, filesAdd int, sizeAdd int64,
 	return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	return sqlCommonUpdateDataTransfer(username, uploadAdd, downloadAdd, reset, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedDataTransfer(username, p.dbHandle)
+}
+
 func (p PGSQLProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p PGSQLProvider) updateUserPassword(username, password string) error {
+	return sqlCommonUpdateUserPassword(username, password, p.dbHandle)
+}
+
 func (p PGSQLProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
@@ -108,6 +161,222 @@ func (p PGSQLProvider) getUsers(limit int, offset int, order string, username st
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p PGSQLProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p PGSQLProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.dbHandle)
+}
+
+func (p PGSQLProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.dbHandle)
+}
+
+func (p PGSQLProvider) eventRuleExists(name string) (EventRule, error) {
+	return sqlCommonCheckEventRuleExists(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) addEventRule(rule EventRule) error {
+	return sqlCommonAddEventRule(rule, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateEventRule(rule EventRule) error {
+	return sqlCommonUpdateEventRule(rule, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteEventRule(rule EventRule) error {
+	return sqlCommonDeleteEventRule(rule, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpEventRules() ([]EventRule, error) {
+	return sqlCommonDumpEventRules(p.dbHandle)
+}
+
+func (p PGSQLProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, name, p.dbHandle)
+}
+
+func (p PGSQLProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	return sqlCommonGetEventRuleByID(ID, p.dbHandle)
+}
+
+func (p PGSQLProvider) userTemplateExists(name string) (UserTemplate, error) {
+	return sqlCommonCheckUserTemplateExists(name, p.dbHandle)
+}
+
+func (p PGSQLProvider) addUserTemplate(template UserTemplate) error {
+	return sqlCommonAddUserTemplate(template, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateUserTemplate(template UserTemplate) error {
+	return sqlCommonUpdateUserTemplate(template, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteUserTemplate(template UserTemplate) error {
+	return sqlCommonDeleteUserTemplate(template, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	return sqlCommonDumpUserTemplates(p.dbHandle)
+}
+
+func (p PGSQLProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	return sqlCommonGetUserTemplates(limit, offset, order, name, p.dbHandle)
+}
+
+func (p PGSQLProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	return sqlCommonGetUserTemplateByID(ID, p.dbHandle)
+}
+
+func (p PGSQLProvider) addDefenderEvent(ip string, score int) error {
+	return sqlCommonAddDefenderEvent(ip, score, p.dbHandle)
+}
+
+func (p PGSQLProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p PGSQLProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p PGSQLProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p PGSQLProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteDefenderHost(ip string) error {
+	return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+}
+
+func (p PGSQLProvider) cleanupDefender(from int64) error {
+	return sqlCommonCleanupDefender(from, p.dbHandle)
+}
+
+func (p PGSQLProvider) addActiveSession(session ActiveSession) error {
+	return sqlCommonAddActiveSession(session, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteActiveSession(nodeID, connectionID string) error {
+	return sqlCommonDeleteActiveSession(nodeID, connectionID, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	return sqlCommonUpdateActiveSessionsHeartbeat(nodeID, p.dbHandle)
+}
+
+func (p PGSQLProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	return sqlCommonGetActiveSessionsCount(username, from, p.dbHandle)
+}
+
+func (p PGSQLProvider) cleanupActiveSessions(before int64) error {
+	return sqlCommonCleanupActiveSessions(before, p.dbHandle)
+}
+
+func (p PGSQLProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonCheckAdminExists(username, p.dbHandle)
+}
+
+func (p PGSQLProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateAdminPassword(username, password string) error {
+	return sqlCommonUpdateAdminPassword(username, password, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p PGSQLProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, username, p.dbHandle)
+}
+
+func (p PGSQLProvider) getAdminByID(ID int64) (Admin, error) {
+	return sqlCommonGetAdminByID(ID, p.dbHandle)
+}
+
+func (p PGSQLProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonCheckAPIKeyExists(keyID, p.dbHandle)
+}
+
+func (p PGSQLProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpAPIKeys() ([]APIKey, error) {
+	return sqlCommonDumpAPIKeys(p.dbHandle)
+}
+
+func (p PGSQLProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p PGSQLProvider) shareExists(shareID string) (Share, error) {
+	return sqlCommonCheckShareExists(shareID, p.dbHandle)
+}
+
+func (p PGSQLProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p PGSQLProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p PGSQLProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p PGSQLProvider) dumpShares() ([]Share, error) {
+	return sqlCommonDumpShares(p.dbHandle)
+}
+
+func (p PGSQLProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
 func (p PGSQLProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -150,8 +419,345 @@ func (p PGSQLProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updatePGSQLDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updatePGSQLDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 2:
+		err = updatePGSQLDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 3:
+		err = updatePGSQLDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 4:
+		err = updatePGSQLDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 5:
+		err = updatePGSQLDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 6:
+		err = updatePGSQLDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 7:
+		err = updatePGSQLDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 8:
+		err = updatePGSQLDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 9:
+		err = updatePGSQLDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 10:
+		err = updatePGSQLDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 11:
+		err = updatePGSQLDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 12:
+		err = updatePGSQLDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
+	case 13:
+		return updatePGSQLDatabaseFrom13To14(p.dbHandle)
 	}
 	return nil
 }
@@ -175,3 +781,82 @@ func updatePGSQLDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return tx.Commit()
 }
+
+func updatePGSQLDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	sql := strings.Replace(pgsqlUsersV3SQL, "{{users}}", config.UsersTable, 1)
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(sql)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, 3)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func updatePGSQLDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	return sqlCommonExecMigrationWithTX(dbHandle, 4, strings.Replace(pgsqlUsersV4SQL, "{{users}}", config.UsersTable, 1),
+		strings.Replace(pgsqlGroupsV4SQL, "{{groups}}", sqlGroupsTable, 1))
+}
+
+func updatePGSQLDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	return sqlCommonExecMigrationWithTX(dbHandle, 5, strings.Replace(pgsqlAdminsV5SQL, "{{admins}}", sqlAdminsTable, 1))
+}
+
+func updatePGSQLDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	return sqlCommonExecMigrationWithTX(dbHandle, 6, strings.Replace(pgsqlAPIKeysV6SQL, "{{api_keys}}", sqlAPIKeysTable, 1))
+}
+
+func updatePGSQLDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	return sqlCommonExecMigrationWithTX(dbHandle, 7, strings.Replace(pgsqlSharesV7SQL, "{{shares}}", sqlSharesTable, 1))
+}
+
+func updatePGSQLDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	return sqlCommonExecMigrationWithTX(dbHandle, 8, strings.Replace(pgsqlUsersV8SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updatePGSQLDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	return sqlCommonExecMigrationWithTX(dbHandle, 9, strings.Replace(pgsqlUsersV9SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updatePGSQLDatabaseFrom9To10(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	return sqlCommonExecMigrationWithTX(dbHandle, 10, strings.Replace(pgsqlEventsRulesV10SQL, "{{events_rules}}",
+		sqlEventsRulesTable, 1))
+}
+
+func updatePGSQLDatabaseFrom10To11(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	return sqlCommonExecMigrationWithTX(dbHandle, 11, strings.Replace(pgsqlUserTemplatesV11SQL, "{{user_templates}}",
+		sqlUserTemplatesTable, 1))
+}
+
+func updatePGSQLDatabaseFrom11To12(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	return sqlCommonExecMigrationWithTX(dbHandle, 12, getDefenderV12Statements(pgsqlDefenderHostsV12SQL,
+		pgsqlDefenderEventsV12SQL)...)
+}
+
+func updatePGSQLDatabaseFrom12To13(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	return sqlCommonExecMigrationWithTX(dbHandle, 13, getActiveSessionsV13Statements(pgsqlActiveSessionsV13SQL)...)
+}
+
+func updatePGSQLDatabaseFrom13To14(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	return sqlCommonExecMigrationWithTX(dbHandle, 14, strings.Replace(pgsqlAdminsV14SQL, "{{admins}}", sqlAdminsTable, 1))
+}
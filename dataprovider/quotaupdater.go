@@ -0,0 +1,155 @@
+package dataprovider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+var delayedQuota = newDelayedQuotaUpdater()
+
+type quotaDelta struct {
+	files int
+	size  int64
+}
+
+// delayedQuotaUpdater aggregates the quota changes in memory and periodically
+// writes them to the data provider, one update for each user
+type delayedQuotaUpdater struct {
+	sync.RWMutex
+	pending map[string]quotaDelta
+	// changes being written, they are still included in the used quota
+	flushing map[string]quotaDelta
+	ticker   *time.Ticker
+	done     chan bool
+	// serializes the flushes
+	flushLock sync.Mutex
+}
+
+func newDelayedQuotaUpdater() *delayedQuotaUpdater {
+	return &delayedQuotaUpdater{
+		pending:  make(map[string]quotaDelta),
+		flushing: make(map[string]quotaDelta),
+	}
+}
+
+func (q *delayedQuotaUpdater) start(interval time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.ticker != nil {
+		return
+	}
+	q.ticker = time.NewTicker(interval)
+	q.done = make(chan bool)
+	ticker := q.ticker
+	done := q.done
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				q.flush(provider)
+			}
+		}
+	}()
+}
+
+// stop stops the periodic updates and writes the pending changes
+func (q *delayedQuotaUpdater) stop(p Provider) {
+	q.Lock()
+	if q.ticker != nil {
+		q.ticker.Stop()
+		close(q.done)
+		q.ticker = nil
+	}
+	q.Unlock()
+	q.flush(p)
+}
+
+func (q *delayedQuotaUpdater) add(username string, filesAdd int, sizeAdd int64) {
+	q.Lock()
+	defer q.Unlock()
+
+	delta := q.pending[username]
+	delta.files += filesAdd
+	delta.size += sizeAdd
+	q.pending[username] = delta
+}
+
+func (q *delayedQuotaUpdater) get(username string) (int, int64) {
+	q.RLock()
+	defer q.RUnlock()
+
+	delta := q.pending[username]
+	flushing := q.flushing[username]
+	return delta.files + flushing.files, delta.size + flushing.size
+}
+
+// reset discards the pending changes for the given user
+func (q *delayedQuotaUpdater) reset(username string) {
+	q.Lock()
+	defer q.Unlock()
+
+	delete(q.pending, username)
+	delete(q.flushing, username)
+}
+
+// setQuota discards the pending changes for the given user and sets the used quota after a scan.
+// It waits for the running flush, if any, so a delta taken before the reset cannot be written
+// after the scan results and counted twice
+func (q *delayedQuotaUpdater) setQuota(p Provider, username string, files int, size int64) error {
+	q.flushLock.Lock()
+	defer q.flushLock.Unlock()
+
+	q.reset(username)
+	return p.updateQuota(username, files, size, true)
+}
+
+func (q *delayedQuotaUpdater) flush(p Provider) {
+	q.flushLock.Lock()
+	defer q.flushLock.Unlock()
+
+	q.Lock()
+	pending := q.pending
+	q.pending = make(map[string]quotaDelta)
+	q.flushing = make(map[string]quotaDelta, len(pending))
+	for username, delta := range pending {
+		q.flushing[username] = delta
+	}
+	q.Unlock()
+
+	for username, delta := range pending {
+		var err error
+		if delta.files != 0 || delta.size != 0 {
+			err = p.updateQuota(username, delta.files, delta.size, false)
+		}
+		q.Lock()
+		// a quota scan or a user deletion while writing removes the changes
+		if _, ok := q.flushing[username]; ok {
+			delete(q.flushing, username)
+			if err != nil {
+				if _, ok := err.(*RecordNotFoundError); !ok {
+					providerLog(logger.LevelWarn, "unable to write the delayed quota update for user %#v, files: %v, "+
+						"size: %v: %v", username, delta.files, delta.size, err)
+					// retry on the next flush
+					retry := q.pending[username]
+					retry.files += delta.files
+					retry.size += delta.size
+					q.pending[username] = retry
+				}
+			}
+		}
+		q.Unlock()
+	}
+}
+
+// FlushDelayedQuotaUpdates writes the quota changes not yet saved to the data provider.
+// It is a no-op if the delayed quota updates are disabled
+func FlushDelayedQuotaUpdates() {
+	if config.DelayedQuotaUpdate > 0 {
+		delayedQuota.flush(provider)
+	}
+}
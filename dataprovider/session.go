@@ -0,0 +1,26 @@
+package dataprovider
+
+import "fmt"
+
+// ActiveSession defines a session registered inside the data provider. The sessions are
+// shared between the instances using the same data provider, so the max sessions limit
+// holds for all of them
+type ActiveSession struct {
+	// Connection identifier, it is unique for a node
+	ConnectionID string `json:"connection_id"`
+	// Identifier for the instance handling the connection
+	NodeID   string `json:"node_id"`
+	Username string `json:"username"`
+	Protocol string `json:"protocol"`
+	// Last heartbeat as unix timestamp in milliseconds
+	UpdatedAt int64 `json:"updated_at"`
+}
+
+// getKey returns the key for the session, it is used by the memory and bolt providers
+func (s *ActiveSession) getKey() string {
+	return getActiveSessionKey(s.NodeID, s.ConnectionID)
+}
+
+func getActiveSessionKey(nodeID, connectionID string) string {
+	return fmt.Sprintf("%v|%v", nodeID, connectionID)
+}
@@ -0,0 +1,209 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH user certificate critical options to restrict the sessions started using the certificate,
+// for example: ssh-keygen -s ca -I id -n user -O critical:root@sftpgo.com=/outbound -O critical:read-only@sftpgo.com
+const (
+	CertOptionRoot     = "root@sftpgo.com"
+	CertOptionReadOnly = "read-only@sftpgo.com"
+)
+
+// SessionOverrides defines restrictions applied to a single session, they are never saved.
+// The external auth hook, the pre-login hook and the auth plugins can return them inside the
+// "session" object of the returned user, the SSH user certificates using critical options
+type SessionOverrides struct {
+	// the session is confined inside this directory, it becomes the root directory "/"
+	// for the client. Empty or "/" means no restriction
+	Root string `json:"root,omitempty"`
+	// if true only the list and download permissions are preserved
+	ReadOnly bool `json:"read_only,omitempty"`
+	// true if the root is inside a virtual folder excluded from the quota, it is set
+	// when the overrides are applied and ignored in the hook responses
+	RootExcludedFromQuota bool `json:"root_excluded_from_quota,omitempty"`
+}
+
+// add combines the given overrides with the existing ones, the roots are nested
+func (s *SessionOverrides) add(o SessionOverrides) {
+	s.Root = path.Join("/", s.Root, o.Root)
+	s.ReadOnly = s.ReadOnly || o.ReadOnly
+}
+
+func getSessionOverridesFromHookResponse(out []byte) SessionOverrides {
+	var resp struct {
+		Session SessionOverrides `json:"session"`
+	}
+	// the response is already validated when it is parsed as user
+	json.Unmarshal(out, &resp) //nolint:errcheck
+	resp.Session.RootExcludedFromQuota = false
+	return resp.Session
+}
+
+func getSessionOverridesFromCert(cert *ssh.Certificate) SessionOverrides {
+	_, readOnly := cert.CriticalOptions[CertOptionReadOnly]
+	return SessionOverrides{
+		Root:     cert.CriticalOptions[CertOptionRoot],
+		ReadOnly: readOnly,
+	}
+}
+
+// applyUserGroupsAndSession applies the settings inherited from the groups and then
+// the session overrides, if any. The returned user must not be saved
+func applyUserGroupsAndSession(p Provider, user User) (User, error) {
+	user, err := applyUserGroups(p, user)
+	if err != nil {
+		return user, err
+	}
+	user.applySessionOverrides()
+	return user, nil
+}
+
+// applySessionOverrides removes the write permissions for read only sessions and
+// confines the user inside the session root, if any. The permissions, the virtual
+// folders and the file filters outside the root are removed, the other ones are
+// moved relative to the root
+func (u *User) applySessionOverrides() {
+	root := path.Join("/", u.sessionOverrides.Root)
+	if root == "/" && !u.sessionOverrides.ReadOnly {
+		return
+	}
+	providerLog(logger.LevelDebug, "applying session overrides for user %#v, root: %#v read only: %v",
+		u.Username, root, u.sessionOverrides.ReadOnly)
+	if u.sessionOverrides.ReadOnly {
+		u.Permissions = getReadOnlyPermissions(u.Permissions)
+	}
+	if root == "/" {
+		return
+	}
+	permissions := make(map[string][]string)
+	permissions["/"] = u.GetPermissionsForPath(root)
+	for dir, perms := range u.Permissions {
+		if p, ok := getPathInsideRoot(root, dir); ok {
+			permissions[p] = perms
+		}
+	}
+	u.Permissions = permissions
+	u.Filters.FileExtensions = getExtensionsFiltersInsideRoot(u.Filters.FileExtensions, root)
+	u.Filters.FilePatterns = getPatternsFiltersInsideRoot(u.Filters.FilePatterns, root)
+
+	var folders []vfs.VirtualFolder
+	mappedRoot := ""
+	for _, folder := range u.VirtualFolders {
+		if p, ok := getPathInsideRoot(root, folder.VirtualPath); ok && p != "/" {
+			folder.VirtualPath = p
+			folders = append(folders, folder)
+		} else if p, ok := getPathInsideRoot(folder.VirtualPath, root); ok {
+			// the root is inside a virtual folder, the uploaded files are accounted as for the folder
+			mappedRoot = filepath.Join(folder.MappedPath, filepath.FromSlash(p))
+			u.sessionOverrides.RootExcludedFromQuota = folder.ExcludeFromQuota
+		}
+	}
+	u.VirtualFolders = folders
+	if mappedRoot != "" {
+		u.HomeDir = mappedRoot
+		return
+	}
+	switch u.FsConfig.Provider {
+	case 1:
+		u.FsConfig.S3Config.KeyPrefix = getKeyPrefixInsideRoot(u.FsConfig.S3Config.KeyPrefix, root)
+	case 2:
+		u.FsConfig.GCSConfig.KeyPrefix = getKeyPrefixInsideRoot(u.FsConfig.GCSConfig.KeyPrefix, root)
+	case 3:
+		u.FsConfig.AzBlobConfig.KeyPrefix = getKeyPrefixInsideRoot(u.FsConfig.AzBlobConfig.KeyPrefix, root)
+	case 4:
+		u.FsConfig.SFTPConfig.Prefix = path.Join("/", u.FsConfig.SFTPConfig.Prefix, root)
+	default:
+		u.HomeDir = filepath.Join(u.HomeDir, filepath.FromSlash(root))
+	}
+}
+
+func getReadOnlyPermissions(permissions map[string][]string) map[string][]string {
+	result := make(map[string][]string)
+	for dir, perms := range permissions {
+		readOnly := []string{}
+		if utils.IsStringInSlice(PermAny, perms) {
+			readOnly = append(readOnly, PermListItems, PermDownload)
+		} else {
+			for _, p := range perms {
+				if p == PermListItems || p == PermDownload {
+					readOnly = append(readOnly, p)
+				}
+			}
+		}
+		result[dir] = readOnly
+	}
+	return result
+}
+
+// getPathInsideRoot returns the given virtual path relative to root and true if it is inside root
+func getPathInsideRoot(root, p string) (string, bool) {
+	if p == root {
+		return "/", true
+	}
+	if root == "/" {
+		return p, true
+	}
+	if strings.HasPrefix(p, root+"/") {
+		return strings.TrimPrefix(p, root), true
+	}
+	return "", false
+}
+
+func getKeyPrefixInsideRoot(keyPrefix, root string) string {
+	return strings.TrimPrefix(path.Join(keyPrefix, root), "/") + "/"
+}
+
+func getExtensionsFiltersInsideRoot(filters []ExtensionsFilter, root string) []ExtensionsFilter {
+	var result []ExtensionsFilter
+	for _, f := range filters {
+		if p, ok := getPathInsideRoot(root, f.Path); ok {
+			f.Path = p
+			result = append(result, f)
+		}
+	}
+	// the filter applied to the root, if inherited from a parent directory, is now the one for "/"
+	for _, dir := range utils.GetDirsForSFTPPath(root) {
+		for _, f := range filters {
+			if f.Path == dir {
+				if dir != root {
+					f.Path = "/"
+					result = append(result, f)
+				}
+				return result
+			}
+		}
+	}
+	return result
+}
+
+func getPatternsFiltersInsideRoot(filters []PatternsFilter, root string) []PatternsFilter {
+	var result []PatternsFilter
+	for _, f := range filters {
+		if p, ok := getPathInsideRoot(root, f.Path); ok {
+			f.Path = p
+			result = append(result, f)
+		}
+	}
+	for _, dir := range utils.GetDirsForSFTPPath(root) {
+		for _, f := range filters {
+			if f.Path == dir {
+				if dir != root {
+					f.Path = "/"
+					result = append(result, f)
+				}
+				return result
+			}
+		}
+	}
+	return result
+}
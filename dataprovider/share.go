@@ -0,0 +1,148 @@
+package dataprovider
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/alexedwards/argon2id"
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported share scopes
+const (
+	// the shared file can be downloaded, the files inside a shared directory can be listed and downloaded
+	ShareScopeRead = 1
+	// files can be uploaded inside the shared directory
+	ShareScopeWrite = 2
+)
+
+const shareIDSize = 24
+
+// Share defines a public link to a file or a directory of a user.
+// The link can be used without the SFTPGo credentials, the share id is the secret
+// part of the link so it is randomly generated
+type Share struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique public identifier, it is generated on creation
+	ShareID string `json:"share_id"`
+	// Name used to identify the share
+	Name string `json:"name"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// ShareScopeRead or ShareScopeWrite
+	Scope int `json:"scope"`
+	// Shared path, it must be a directory for the write scope
+	Path string `json:"path"`
+	// Username of the user that owns this share
+	Username string `json:"username"`
+	// creation time as unix timestamp in milliseconds
+	CreatedAt int64 `json:"created_at"`
+	// expiration time as unix timestamp in milliseconds, 0 means no expiration
+	ExpiresAt int64 `json:"expires_at"`
+	// last use time as unix timestamp in milliseconds
+	LastUseAt int64 `json:"last_use_at"`
+	// Optional password to protect the share, it is stored hashed
+	Password string `json:"password,omitempty"`
+	// Maximum number of downloads or uploads allowed, 0 means no limit
+	MaxTokens int `json:"max_tokens"`
+	// Number of downloads or uploads already done
+	UsedTokens int `json:"used_tokens"`
+}
+
+// HideConfidentialData hides the share password
+func (s *Share) HideConfidentialData() {
+	s.Password = ""
+}
+
+// IsExpired returns true if the share is expired
+func (s *Share) IsExpired() bool {
+	return s.ExpiresAt > 0 && s.ExpiresAt < utils.GetTimeAsMsSinceEpoch(time.Now())
+}
+
+// HasTokens returns true if the share can still be used for a download or an upload
+func (s *Share) HasTokens() bool {
+	return s.MaxTokens == 0 || s.UsedTokens < s.MaxTokens
+}
+
+// IsPasswordProtected returns true if a password is required to use the share
+func (s *Share) IsPasswordProtected() bool {
+	return len(s.Password) > 0
+}
+
+// GenerateShareID returns a new random share identifier
+func GenerateShareID() (string, error) {
+	id := make([]byte, shareIDSize)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(id), nil
+}
+
+func validateShare(p Provider, share *Share) error {
+	if len(share.ShareID) == 0 || len(share.Name) == 0 || len(share.Path) == 0 || len(share.Username) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	if share.Scope != ShareScopeRead && share.Scope != ShareScopeWrite {
+		return &ValidationError{err: fmt.Sprintf("invalid scope: %v", share.Scope)}
+	}
+	if share.ExpiresAt < 0 {
+		return &ValidationError{err: "invalid expiration date"}
+	}
+	if share.MaxTokens < 0 || share.UsedTokens < 0 {
+		return &ValidationError{err: "invalid max tokens"}
+	}
+	share.Path = utils.CleanSFTPPath(share.Path)
+	if share.CreatedAt == 0 {
+		share.CreatedAt = utils.GetTimeAsMsSinceEpoch(time.Now())
+	}
+	if _, err := p.userExists(share.Username); err != nil {
+		if _, ok := err.(*RecordNotFoundError); ok {
+			return &ValidationError{err: fmt.Sprintf("user %#v does not exist", share.Username)}
+		}
+		return err
+	}
+	if share.IsPasswordProtected() && !strings.HasPrefix(share.Password, argonPwdPrefix) &&
+		!strings.HasPrefix(share.Password, bcryptPwdPrefix) {
+		pwd, err := hashPassword(share.Password)
+		if err != nil {
+			return err
+		}
+		share.Password = pwd
+	}
+	return nil
+}
+
+func checkShareAndPass(share Share, password string) (Share, error) {
+	if share.IsExpired() {
+		return share, fmt.Errorf("share %#v is expired", share.ShareID)
+	}
+	if !share.IsPasswordProtected() {
+		return share, nil
+	}
+	if len(password) == 0 {
+		return share, errors.New("Invalid credentials")
+	}
+	match := false
+	var err error
+	if strings.HasPrefix(share.Password, argonPwdPrefix) {
+		match, err = argon2id.ComparePasswordAndHash(password, share.Password)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error comparing share password with argon hash: %v", err)
+			return share, err
+		}
+	} else if strings.HasPrefix(share.Password, bcryptPwdPrefix) {
+		match = bcrypt.CompareHashAndPassword([]byte(share.Password), []byte(password)) == nil
+	}
+	if !match {
+		return share, errors.New("Invalid credentials")
+	}
+	return share, nil
+}
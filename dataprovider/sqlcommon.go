@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/drakkan/sftpgo/logger"
@@ -13,7 +14,7 @@ import (
 )
 
 const (
-	sqlDatabaseVersion  = 2
+	sqlDatabaseVersion  = 14
 	initialDBVersionSQL = "INSERT INTO schema_version (version) VALUES (1);"
 )
 
@@ -95,6 +96,46 @@ func sqlCommonUpdateQuota(username string, filesAdd int, sizeAdd int64, reset bo
 	return err
 }
 
+func sqlCommonUpdateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool, dbHandle *sql.DB) error {
+	q := getUpdateDataTransferQuery(reset)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	if reset {
+		_, err = stmt.Exec(uploadAdd, downloadAdd, utils.GetTimeAsMsSinceEpoch(time.Now()), username)
+	} else {
+		_, err = stmt.Exec(uploadAdd, downloadAdd, username)
+	}
+	if err == nil {
+		providerLog(logger.LevelDebug, "data transfer updated for user %#v, upload increment: %v download increment: %v is reset? %v",
+			username, uploadAdd, downloadAdd, reset)
+	} else {
+		providerLog(logger.LevelWarn, "error updating data transfer for user %#v: %v", username, err)
+	}
+	return err
+}
+
+func sqlCommonGetUsedDataTransfer(username string, dbHandle *sql.DB) (int64, int64, int64, error) {
+	q := getDataTransferQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return 0, 0, 0, err
+	}
+	defer stmt.Close()
+
+	var uploaded, downloaded, lastReset int64
+	err = stmt.QueryRow(username).Scan(&uploaded, &downloaded, &lastReset)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error getting data transfer for user: %v, error: %v", username, err)
+		return 0, 0, 0, err
+	}
+	return uploaded, downloaded, lastReset, err
+}
+
 func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	q := getUpdateLastLoginQuery()
 	stmt, err := dbHandle.Prepare(q)
@@ -112,6 +153,36 @@ func sqlCommonUpdateLastLogin(username string, dbHandle *sql.DB) error {
 	return err
 }
 
+func sqlCommonUpdateUserPassword(username, password string, dbHandle *sql.DB) error {
+	q := getUpdateUserPasswordQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(password, username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating password for user %#v: %v", username, err)
+	}
+	return err
+}
+
+func sqlCommonUpdateAdminPassword(username, password string, dbHandle *sql.DB) error {
+	q := getUpdateAdminPasswordQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(password, username)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error updating password for admin %#v: %v", username, err)
+	}
+	return err
+}
+
 func sqlCommonGetUsedQuota(username string, dbHandle *sql.DB) (int, int64, error) {
 	q := getQuotaQuery()
 	stmt, err := dbHandle.Prepare(q)
@@ -176,9 +247,14 @@ func sqlCommonAddUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	groups, err := user.GetGroupsAsJSON()
+	if err != nil {
+		return err
+	}
 	_, err = stmt.Exec(user.Username, user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate, string(filters),
-		string(fsConfig), string(virtualFolders))
+		string(fsConfig), string(virtualFolders), user.UploadDataTransfer, user.DownloadDataTransfer, user.DataTransferReset,
+		string(groups), user.ActivationDate, user.LastPasswordChange)
 	return err
 }
 
@@ -214,9 +290,14 @@ func sqlCommonUpdateUser(user User, dbHandle *sql.DB) error {
 	if err != nil {
 		return err
 	}
+	groups, err := user.GetGroupsAsJSON()
+	if err != nil {
+		return err
+	}
 	_, err = stmt.Exec(user.Password, string(publicKeys), user.HomeDir, user.UID, user.GID, user.MaxSessions, user.QuotaSize,
 		user.QuotaFiles, string(permissions), user.UploadBandwidth, user.DownloadBandwidth, user.Status, user.ExpirationDate,
-		string(filters), string(fsConfig), string(virtualFolders), user.ID)
+		string(filters), string(fsConfig), string(virtualFolders), user.UploadDataTransfer, user.DownloadDataTransfer,
+		user.DataTransferReset, string(groups), user.ActivationDate, user.LastPasswordChange, user.ID)
 	return err
 }
 
@@ -317,18 +398,23 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 	var filters sql.NullString
 	var fsConfig sql.NullString
 	var virtualFolders sql.NullString
+	var groups sql.NullString
 	var err error
 	if row != nil {
 		err = row.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
 			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
-			&virtualFolders)
+			&virtualFolders, &user.UploadDataTransfer, &user.DownloadDataTransfer, &user.UsedUploadDataTransfer,
+			&user.UsedDownloadDataTransfer, &user.DataTransferReset, &user.LastDataTransferReset, &groups, &user.ActivationDate,
+			&user.LastPasswordChange)
 
 	} else {
 		err = rows.Scan(&user.ID, &user.Username, &password, &publicKey, &user.HomeDir, &user.UID, &user.GID, &user.MaxSessions,
 			&user.QuotaSize, &user.QuotaFiles, &permissions, &user.UsedQuotaSize, &user.UsedQuotaFiles, &user.LastQuotaUpdate,
 			&user.UploadBandwidth, &user.DownloadBandwidth, &user.ExpirationDate, &user.LastLogin, &user.Status, &filters, &fsConfig,
-			&virtualFolders)
+			&virtualFolders, &user.UploadDataTransfer, &user.DownloadDataTransfer, &user.UsedUploadDataTransfer,
+			&user.UsedDownloadDataTransfer, &user.DataTransferReset, &user.LastDataTransferReset, &groups, &user.ActivationDate,
+			&user.LastPasswordChange)
 	}
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -376,43 +462,1322 @@ func getUserFromDbRow(row *sql.Row, rows *sql.Rows) (User, error) {
 			user.VirtualFolders = list
 		}
 	}
+	if groups.Valid {
+		var list []string
+		err = json.Unmarshal([]byte(groups.String), &list)
+		if err == nil {
+			user.Groups = list
+		}
+	}
 	return user, err
 }
 
-func sqlCommonGetDatabaseVersion(dbHandle *sql.DB) (schemaVersion, error) {
-	var result schemaVersion
-	q := getDatabaseVersionQuery()
+func sqlCommonCheckGroupExists(name string, dbHandle *sql.DB) (Group, error) {
+	var group Group
+	q := getGroupByNameQuery()
 	stmt, err := dbHandle.Prepare(q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
-		return result, err
+		return group, err
 	}
 	defer stmt.Close()
-	row := stmt.QueryRow()
-	err = row.Scan(&result.Version)
-	return result, err
+	row := stmt.QueryRow(name)
+	return getGroupFromDbRow(row, nil)
 }
 
-func sqlCommonUpdateDatabaseVersion(dbHandle *sql.DB, version int) error {
-	q := getUpdateDBVersionQuery()
+func sqlCommonGetGroupByID(ID int64, dbHandle *sql.DB) (Group, error) {
+	var group Group
+	q := getGroupByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return group, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ID)
+	return getGroupFromDbRow(row, nil)
+}
+
+func sqlCommonAddGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	q := getAddGroupQuery()
 	stmt, err := dbHandle.Prepare(q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(version)
+	permissions, err := group.GetPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := group.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	fsConfig, err := group.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(group.Name, group.Description, group.MaxSessions, group.QuotaSize, group.QuotaFiles, string(permissions),
+		group.UploadBandwidth, group.DownloadBandwidth, string(filters), string(fsConfig))
 	return err
 }
 
-func sqlCommonUpdateDatabaseVersionWithTX(tx *sql.Tx, version int) error {
-	q := getUpdateDBVersionQuery()
-	stmt, err := tx.Prepare(q)
+func sqlCommonUpdateGroup(group Group, dbHandle *sql.DB) error {
+	err := validateGroup(&group)
+	if err != nil {
+		return err
+	}
+	q := getUpdateGroupQuery()
+	stmt, err := dbHandle.Prepare(q)
 	if err != nil {
 		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(version)
+	permissions, err := group.GetPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := group.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	fsConfig, err := group.GetFsConfigAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(group.Description, group.MaxSessions, group.QuotaSize, group.QuotaFiles, string(permissions),
+		group.UploadBandwidth, group.DownloadBandwidth, string(filters), string(fsConfig), group.ID)
+	return err
+}
+
+func sqlCommonDeleteGroup(group Group, dbHandle *sql.DB) error {
+	q := getDeleteGroupQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(group.ID)
+	return err
+}
+
+func sqlCommonDumpGroups(dbHandle *sql.DB) ([]Group, error) {
+	groups := []Group{}
+	q := getDumpGroupsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			g, err := getGroupFromDbRow(nil, rows)
+			if err != nil {
+				return groups, err
+			}
+			groups = append(groups, g)
+		}
+	}
+
+	return groups, err
+}
+
+func sqlCommonGetGroups(limit int, offset int, order string, name string, dbHandle *sql.DB) ([]Group, error) {
+	groups := []Group{}
+	q := getGroupsQuery(order, name)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(name) > 0 {
+		rows, err = stmt.Query(name, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			g, err := getGroupFromDbRow(nil, rows)
+			if err == nil {
+				groups = append(groups, HideGroupSensitiveData(&g))
+			} else {
+				break
+			}
+		}
+	}
+
+	return groups, err
+}
+
+func sqlCommonCheckEventRuleExists(name string, dbHandle *sql.DB) (EventRule, error) {
+	var rule EventRule
+	q := getEventRuleByNameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return rule, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(name)
+	return getEventRuleFromDbRow(row, nil)
+}
+
+func sqlCommonGetEventRuleByID(ID int64, dbHandle *sql.DB) (EventRule, error) {
+	var rule EventRule
+	q := getEventRuleByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return rule, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ID)
+	return getEventRuleFromDbRow(row, nil)
+}
+
+func sqlCommonAddEventRule(rule EventRule, dbHandle *sql.DB) error {
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	q := getAddEventRuleQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	conditions, err := rule.GetConditionsAsJSON()
+	if err != nil {
+		return err
+	}
+	action, err := rule.GetActionAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(rule.Name, rule.Description, rule.Status, rule.Trigger, string(conditions), string(action))
+	return err
+}
+
+func sqlCommonUpdateEventRule(rule EventRule, dbHandle *sql.DB) error {
+	err := validateEventRule(&rule)
+	if err != nil {
+		return err
+	}
+	q := getUpdateEventRuleQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	conditions, err := rule.GetConditionsAsJSON()
+	if err != nil {
+		return err
+	}
+	action, err := rule.GetActionAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(rule.Description, rule.Status, rule.Trigger, string(conditions), string(action), rule.ID)
+	return err
+}
+
+func sqlCommonDeleteEventRule(rule EventRule, dbHandle *sql.DB) error {
+	q := getDeleteEventRuleQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(rule.ID)
 	return err
 }
+
+func sqlCommonDumpEventRules(dbHandle *sql.DB) ([]EventRule, error) {
+	rules := []EventRule{}
+	q := getDumpEventRulesQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			rule, err := getEventRuleFromDbRow(nil, rows)
+			if err != nil {
+				return rules, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules, err
+}
+
+func sqlCommonGetEventRules(limit int, offset int, order string, name string, dbHandle *sql.DB) ([]EventRule, error) {
+	rules := []EventRule{}
+	q := getEventRulesQuery(order, name)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(name) > 0 {
+		rows, err = stmt.Query(name, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			rule, err := getEventRuleFromDbRow(nil, rows)
+			if err == nil {
+				rules = append(rules, rule)
+			} else {
+				break
+			}
+		}
+	}
+
+	return rules, err
+}
+
+func getEventRuleFromDbRow(row *sql.Row, rows *sql.Rows) (EventRule, error) {
+	var rule EventRule
+	var description sql.NullString
+	var conditions sql.NullString
+	var action sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&rule.ID, &rule.Name, &description, &rule.Status, &rule.Trigger, &conditions, &action)
+	} else {
+		err = rows.Scan(&rule.ID, &rule.Name, &description, &rule.Status, &rule.Trigger, &conditions, &action)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return rule, &RecordNotFoundError{err: err.Error()}
+		}
+		return rule, err
+	}
+	if description.Valid {
+		rule.Description = description.String
+	}
+	if conditions.Valid {
+		var ruleConditions EventConditions
+		err = json.Unmarshal([]byte(conditions.String), &ruleConditions)
+		if err == nil {
+			rule.Conditions = ruleConditions
+		}
+	}
+	if action.Valid {
+		var ruleAction EventAction
+		err = json.Unmarshal([]byte(action.String), &ruleAction)
+		if err == nil {
+			rule.Action = ruleAction
+		}
+	}
+	return rule, nil
+}
+
+func sqlCommonCheckUserTemplateExists(name string, dbHandle *sql.DB) (UserTemplate, error) {
+	var template UserTemplate
+	q := getUserTemplateByNameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return template, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(name)
+	return getUserTemplateFromDbRow(row, nil)
+}
+
+func sqlCommonGetUserTemplateByID(ID int64, dbHandle *sql.DB) (UserTemplate, error) {
+	var template UserTemplate
+	q := getUserTemplateByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return template, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ID)
+	return getUserTemplateFromDbRow(row, nil)
+}
+
+func sqlCommonAddUserTemplate(template UserTemplate, dbHandle *sql.DB) error {
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	q := getAddUserTemplateQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	settings, err := template.GetUserAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(template.Name, template.Description, string(settings))
+	return err
+}
+
+func sqlCommonUpdateUserTemplate(template UserTemplate, dbHandle *sql.DB) error {
+	err := validateUserTemplate(&template)
+	if err != nil {
+		return err
+	}
+	q := getUpdateUserTemplateQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	settings, err := template.GetUserAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(template.Description, string(settings), template.ID)
+	return err
+}
+
+func sqlCommonDeleteUserTemplate(template UserTemplate, dbHandle *sql.DB) error {
+	q := getDeleteUserTemplateQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(template.ID)
+	return err
+}
+
+func sqlCommonDumpUserTemplates(dbHandle *sql.DB) ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	q := getDumpUserTemplatesQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			template, err := getUserTemplateFromDbRow(nil, rows)
+			if err != nil {
+				return templates, err
+			}
+			templates = append(templates, template)
+		}
+	}
+
+	return templates, err
+}
+
+func sqlCommonGetUserTemplates(limit int, offset int, order string, name string, dbHandle *sql.DB) ([]UserTemplate, error) {
+	templates := []UserTemplate{}
+	q := getUserTemplatesQuery(order, name)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(name) > 0 {
+		rows, err = stmt.Query(name, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			template, err := getUserTemplateFromDbRow(nil, rows)
+			if err == nil {
+				templates = append(templates, template)
+			} else {
+				break
+			}
+		}
+	}
+
+	return templates, err
+}
+
+func sqlCommonAddDefenderEvent(ip string, score int, dbHandle *sql.DB) error {
+	q := getAddDefenderEventQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(ip, utils.GetTimeAsMsSinceEpoch(time.Now()), score)
+	return err
+}
+
+func sqlCommonIsDefenderHostBanned(ip string, dbHandle *sql.DB) (DefenderEntry, error) {
+	entry := DefenderEntry{
+		IP: ip,
+	}
+	q := getDefenderHostBanTimeQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return entry, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(ip, utils.GetTimeAsMsSinceEpoch(time.Now())).Scan(&entry.BanTime)
+	if err == sql.ErrNoRows {
+		return entry, &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+	}
+	return entry, err
+}
+
+func sqlCommonGetDefenderHostByIP(ip string, from int64, dbHandle *sql.DB) (DefenderEntry, error) {
+	entry, err := sqlCommonIsDefenderHostBanned(ip, dbHandle)
+	if err == nil {
+		return entry, nil
+	}
+	if _, ok := err.(*RecordNotFoundError); !ok {
+		return entry, err
+	}
+	q := getDefenderHostScoreQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return entry, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(ip, from).Scan(&entry.Score)
+	if err != nil {
+		return entry, err
+	}
+	if entry.Score <= 0 {
+		return entry, &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+	}
+	return entry, nil
+}
+
+func sqlCommonGetDefenderHosts(from int64, limit int, dbHandle *sql.DB) ([]DefenderEntry, error) {
+	entries := []DefenderEntry{}
+	banned := make(map[string]bool)
+	q := getDefenderBannedHostsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query(utils.GetTimeAsMsSinceEpoch(time.Now()), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var entry DefenderEntry
+		if err = rows.Scan(&entry.IP, &entry.BanTime); err != nil {
+			return nil, err
+		}
+		banned[entry.IP] = true
+		entries = append(entries, entry)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	q = getDefenderScoredHostsQuery()
+	scoreStmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer scoreStmt.Close()
+	scoreRows, err := scoreStmt.Query(from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer scoreRows.Close()
+	for scoreRows.Next() {
+		var entry DefenderEntry
+		if err = scoreRows.Scan(&entry.IP, &entry.Score); err != nil {
+			return nil, err
+		}
+		// the banned hosts have no score
+		if !banned[entry.IP] && entry.Score > 0 {
+			entries = append(entries, entry)
+		}
+	}
+	if err = scoreRows.Err(); err != nil {
+		return nil, err
+	}
+	return sortDefenderEntries(entries, limit), nil
+}
+
+// sqlCommonSetDefenderBanTime bans the given IP and removes its events inside a transaction
+func sqlCommonSetDefenderBanTime(ip string, banTime int64, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(getDeleteDefenderEventsQuery(), ip)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	res, err := tx.Exec(getSetDefenderBanTimeQuery(), banTime, ip)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		_, err = tx.Exec(getAddDefenderHostQuery(), ip, banTime)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func sqlCommonUpdateDefenderBanTime(ip string, minutes int, dbHandle *sql.DB) error {
+	q := getIncreaseDefenderBanTimeQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(int64(minutes)*60*1000, ip, utils.GetTimeAsMsSinceEpoch(time.Now()))
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("host %v is not banned", ip)}
+	}
+	return nil
+}
+
+// sqlCommonDeleteDefenderHost removes the ban and the events for the given IP inside a transaction
+func sqlCommonDeleteDefenderHost(ip string, dbHandle *sql.DB) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	var affected int64
+	for _, q := range []string{getDeleteDefenderEventsQuery(), getDeleteDefenderHostQuery()} {
+		res, err := tx.Exec(q, ip)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil {
+			affected += n
+		}
+	}
+	if affected == 0 {
+		tx.Rollback()
+		return &RecordNotFoundError{err: fmt.Sprintf("host %v does not exist", ip)}
+	}
+	return tx.Commit()
+}
+
+func sqlCommonCleanupDefender(from int64, dbHandle *sql.DB) error {
+	for _, q := range []string{getCleanupDefenderEventsQuery(), getCleanupDefenderHostsQuery()} {
+		stmt, err := dbHandle.Prepare(q)
+		if err != nil {
+			providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+			return err
+		}
+		_, err = stmt.Exec(from)
+		stmt.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sqlCommonAddActiveSession(session ActiveSession, dbHandle *sql.DB) error {
+	q := getAddActiveSessionQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(session.ConnectionID, session.NodeID, session.Username, session.Protocol,
+		utils.GetTimeAsMsSinceEpoch(time.Now()))
+	return err
+}
+
+func sqlCommonDeleteActiveSession(nodeID, connectionID string, dbHandle *sql.DB) error {
+	q := getDeleteActiveSessionQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	res, err := stmt.Exec(nodeID, connectionID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err == nil && affected == 0 {
+		return &RecordNotFoundError{err: fmt.Sprintf("session %v does not exist", getActiveSessionKey(nodeID, connectionID))}
+	}
+	return nil
+}
+
+func sqlCommonUpdateActiveSessionsHeartbeat(nodeID string, dbHandle *sql.DB) error {
+	q := getUpdateActiveSessionsHeartbeatQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(utils.GetTimeAsMsSinceEpoch(time.Now()), nodeID)
+	return err
+}
+
+func sqlCommonGetActiveSessionsCount(username string, from int64, dbHandle *sql.DB) (int, error) {
+	var count int
+	q := getActiveSessionsCountQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return count, err
+	}
+	defer stmt.Close()
+	err = stmt.QueryRow(username, from).Scan(&count)
+	return count, err
+}
+
+func sqlCommonCleanupActiveSessions(before int64, dbHandle *sql.DB) error {
+	q := getCleanupActiveSessionsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(before)
+	return err
+}
+
+func getUserTemplateFromDbRow(row *sql.Row, rows *sql.Rows) (UserTemplate, error) {
+	var template UserTemplate
+	var description sql.NullString
+	var settings sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&template.ID, &template.Name, &description, &settings)
+	} else {
+		err = rows.Scan(&template.ID, &template.Name, &description, &settings)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return template, &RecordNotFoundError{err: err.Error()}
+		}
+		return template, err
+	}
+	if description.Valid {
+		template.Description = description.String
+	}
+	if settings.Valid {
+		var user User
+		err = json.Unmarshal([]byte(settings.String), &user)
+		if err == nil {
+			template.User = user
+		}
+	}
+	return template, nil
+}
+
+func getGroupFromDbRow(row *sql.Row, rows *sql.Rows) (Group, error) {
+	var group Group
+	var description sql.NullString
+	var permissions sql.NullString
+	var filters sql.NullString
+	var fsConfig sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&group.ID, &group.Name, &description, &group.MaxSessions, &group.QuotaSize, &group.QuotaFiles,
+			&permissions, &group.UploadBandwidth, &group.DownloadBandwidth, &filters, &fsConfig)
+	} else {
+		err = rows.Scan(&group.ID, &group.Name, &description, &group.MaxSessions, &group.QuotaSize, &group.QuotaFiles,
+			&permissions, &group.UploadBandwidth, &group.DownloadBandwidth, &filters, &fsConfig)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return group, &RecordNotFoundError{err: err.Error()}
+		}
+		return group, err
+	}
+	if description.Valid {
+		group.Description = description.String
+	}
+	if permissions.Valid {
+		perms := make(map[string][]string)
+		err = json.Unmarshal([]byte(permissions.String), &perms)
+		if err == nil && len(perms) > 0 {
+			group.Permissions = perms
+		}
+	}
+	if filters.Valid {
+		var groupFilters UserFilters
+		err = json.Unmarshal([]byte(filters.String), &groupFilters)
+		if err == nil {
+			group.Filters = groupFilters
+		}
+	}
+	if fsConfig.Valid {
+		var fs Filesystem
+		err = json.Unmarshal([]byte(fsConfig.String), &fs)
+		if err == nil {
+			group.FsConfig = fs
+		}
+	}
+	return group, nil
+}
+
+func sqlCommonGetDatabaseVersion(dbHandle *sql.DB) (schemaVersion, error) {
+	var result schemaVersion
+	q := getDatabaseVersionQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return result, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow()
+	err = row.Scan(&result.Version)
+	return result, err
+}
+
+func sqlCommonUpdateDatabaseVersion(dbHandle *sql.DB, version int) error {
+	q := getUpdateDBVersionQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(version)
+	return err
+}
+
+func sqlCommonUpdateDatabaseVersionWithTX(tx *sql.Tx, version int) error {
+	q := getUpdateDBVersionQuery()
+	stmt, err := tx.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(version)
+	return err
+}
+
+func sqlCommonCheckAdminExists(username string, dbHandle *sql.DB) (Admin, error) {
+	var admin Admin
+	q := getAdminByUsernameQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return admin, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(username)
+	return getAdminFromDbRow(row, nil)
+}
+
+func sqlCommonGetAdminByID(ID int64, dbHandle *sql.DB) (Admin, error) {
+	var admin Admin
+	q := getAdminByIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return admin, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(ID)
+	return getAdminFromDbRow(row, nil)
+}
+
+func sqlCommonAddAdmin(admin Admin, dbHandle *sql.DB) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	q := getAddAdminQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := admin.GetPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := admin.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(admin.Username, admin.Password, admin.Status, string(permissions), admin.Description,
+		string(filters))
+	return err
+}
+
+func sqlCommonUpdateAdmin(admin Admin, dbHandle *sql.DB) error {
+	err := validateAdmin(&admin)
+	if err != nil {
+		return err
+	}
+	q := getUpdateAdminQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	permissions, err := admin.GetPermissionsAsJSON()
+	if err != nil {
+		return err
+	}
+	filters, err := admin.GetFiltersAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(admin.Password, admin.Status, string(permissions), admin.Description, string(filters), admin.ID)
+	return err
+}
+
+func sqlCommonDeleteAdmin(admin Admin, dbHandle *sql.DB) error {
+	q := getDeleteAdminQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(admin.ID)
+	return err
+}
+
+func sqlCommonDumpAdmins(dbHandle *sql.DB) ([]Admin, error) {
+	admins := []Admin{}
+	q := getDumpAdminsQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			a, err := getAdminFromDbRow(nil, rows)
+			if err != nil {
+				return admins, err
+			}
+			admins = append(admins, a)
+		}
+	}
+
+	return admins, err
+}
+
+func sqlCommonGetAdmins(limit int, offset int, order string, username string, dbHandle *sql.DB) ([]Admin, error) {
+	admins := []Admin{}
+	q := getAdminsQuery(order, username)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(username) > 0 {
+		rows, err = stmt.Query(username, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			a, err := getAdminFromDbRow(nil, rows)
+			if err == nil {
+				a.HideConfidentialData()
+				admins = append(admins, a)
+			} else {
+				break
+			}
+		}
+	}
+
+	return admins, err
+}
+
+func getAdminFromDbRow(row *sql.Row, rows *sql.Rows) (Admin, error) {
+	var admin Admin
+	var permissions sql.NullString
+	var description sql.NullString
+	var filters sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&admin.ID, &admin.Username, &admin.Password, &admin.Status, &permissions, &description, &filters)
+	} else {
+		err = rows.Scan(&admin.ID, &admin.Username, &admin.Password, &admin.Status, &permissions, &description, &filters)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return admin, &RecordNotFoundError{err: err.Error()}
+		}
+		return admin, err
+	}
+	if permissions.Valid {
+		var perms []string
+		err = json.Unmarshal([]byte(permissions.String), &perms)
+		if err != nil {
+			return admin, err
+		}
+		admin.Permissions = perms
+	}
+	if description.Valid {
+		admin.Description = description.String
+	}
+	if filters.Valid {
+		var adminFilters AdminFilters
+		err = json.Unmarshal([]byte(filters.String), &adminFilters)
+		if err == nil {
+			admin.Filters = adminFilters
+		}
+	}
+	return admin, nil
+}
+
+func sqlCommonCheckAPIKeyExists(keyID string, dbHandle *sql.DB) (APIKey, error) {
+	var key APIKey
+	q := getAPIKeyByKeyIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return key, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(keyID)
+	return getAPIKeyFromDbRow(row, nil)
+}
+
+func sqlCommonAddAPIKey(key APIKey, dbHandle *sql.DB) error {
+	q := getAddAPIKeyQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	scopes, err := key.GetScopesAsJSON()
+	if err != nil {
+		return err
+	}
+	_, err = stmt.Exec(key.KeyID, key.Key, key.Name, key.Admin, string(scopes), key.CreatedAt, key.ExpiresAt,
+		key.Description)
+	return err
+}
+
+func sqlCommonUpdateAPIKeyLastUse(keyID string, dbHandle *sql.DB) error {
+	q := getUpdateAPIKeyLastUseQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(utils.GetTimeAsMsSinceEpoch(time.Now()), keyID)
+	return err
+}
+
+func sqlCommonDeleteAPIKey(key APIKey, dbHandle *sql.DB) error {
+	q := getDeleteAPIKeyQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(key.KeyID)
+	return err
+}
+
+func sqlCommonDumpAPIKeys(dbHandle *sql.DB) ([]APIKey, error) {
+	keys := []APIKey{}
+	q := getDumpAPIKeysQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			k, err := getAPIKeyFromDbRow(nil, rows)
+			if err != nil {
+				return keys, err
+			}
+			keys = append(keys, k)
+		}
+	}
+
+	return keys, err
+}
+
+func sqlCommonGetAPIKeys(limit int, offset int, order string, admin string, dbHandle *sql.DB) ([]APIKey, error) {
+	keys := []APIKey{}
+	q := getAPIKeysQuery(order, admin)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(admin) > 0 {
+		rows, err = stmt.Query(admin, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			k, err := getAPIKeyFromDbRow(nil, rows)
+			if err == nil {
+				k.HideConfidentialData()
+				keys = append(keys, k)
+			} else {
+				break
+			}
+		}
+	}
+
+	return keys, err
+}
+
+func getAPIKeyFromDbRow(row *sql.Row, rows *sql.Rows) (APIKey, error) {
+	var key APIKey
+	var scopes sql.NullString
+	var description sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&key.ID, &key.KeyID, &key.Key, &key.Name, &key.Admin, &scopes, &key.CreatedAt, &key.ExpiresAt,
+			&key.LastUseAt, &description)
+	} else {
+		err = rows.Scan(&key.ID, &key.KeyID, &key.Key, &key.Name, &key.Admin, &scopes, &key.CreatedAt, &key.ExpiresAt,
+			&key.LastUseAt, &description)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return key, &RecordNotFoundError{err: err.Error()}
+		}
+		return key, err
+	}
+	if scopes.Valid {
+		var s []string
+		err = json.Unmarshal([]byte(scopes.String), &s)
+		if err != nil {
+			return key, err
+		}
+		key.Scopes = s
+	}
+	if description.Valid {
+		key.Description = description.String
+	}
+	return key, nil
+}
+
+func sqlCommonCheckShareExists(shareID string, dbHandle *sql.DB) (Share, error) {
+	var share Share
+	q := getShareByShareIDQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return share, err
+	}
+	defer stmt.Close()
+	row := stmt.QueryRow(shareID)
+	return getShareFromDbRow(row, nil)
+}
+
+func sqlCommonAddShare(share Share, dbHandle *sql.DB) error {
+	q := getAddShareQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(share.ShareID, share.Name, share.Description, share.Scope, share.Path, share.Username,
+		share.CreatedAt, share.ExpiresAt, share.LastUseAt, share.Password, share.MaxTokens, share.UsedTokens)
+	return err
+}
+
+func sqlCommonUpdateShareUsage(shareID string, numTokens int, dbHandle *sql.DB) error {
+	q := getUpdateShareUsageQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(numTokens, utils.GetTimeAsMsSinceEpoch(time.Now()), shareID)
+	return err
+}
+
+func sqlCommonDeleteShare(share Share, dbHandle *sql.DB) error {
+	q := getDeleteShareQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return err
+	}
+	defer stmt.Close()
+	_, err = stmt.Exec(share.ShareID)
+	return err
+}
+
+func sqlCommonDumpShares(dbHandle *sql.DB) ([]Share, error) {
+	shares := []Share{}
+	q := getDumpSharesQuery()
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	rows, err := stmt.Query()
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			s, err := getShareFromDbRow(nil, rows)
+			if err != nil {
+				return shares, err
+			}
+			shares = append(shares, s)
+		}
+	}
+
+	return shares, err
+}
+
+func sqlCommonGetShares(limit int, offset int, order string, username string, dbHandle *sql.DB) ([]Share, error) {
+	shares := []Share{}
+	q := getSharesQuery(order, username)
+	stmt, err := dbHandle.Prepare(q)
+	if err != nil {
+		providerLog(logger.LevelWarn, "error preparing database query %#v: %v", q, err)
+		return nil, err
+	}
+	defer stmt.Close()
+	var rows *sql.Rows
+	if len(username) > 0 {
+		rows, err = stmt.Query(username, limit, offset)
+	} else {
+		rows, err = stmt.Query(limit, offset)
+	}
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			s, err := getShareFromDbRow(nil, rows)
+			if err == nil {
+				s.HideConfidentialData()
+				shares = append(shares, s)
+			} else {
+				break
+			}
+		}
+	}
+
+	return shares, err
+}
+
+func getShareFromDbRow(row *sql.Row, rows *sql.Rows) (Share, error) {
+	var share Share
+	var description sql.NullString
+	var password sql.NullString
+	var err error
+	if row != nil {
+		err = row.Scan(&share.ID, &share.ShareID, &share.Name, &description, &share.Scope, &share.Path, &share.Username,
+			&share.CreatedAt, &share.ExpiresAt, &share.LastUseAt, &password, &share.MaxTokens, &share.UsedTokens)
+	} else {
+		err = rows.Scan(&share.ID, &share.ShareID, &share.Name, &description, &share.Scope, &share.Path, &share.Username,
+			&share.CreatedAt, &share.ExpiresAt, &share.LastUseAt, &password, &share.MaxTokens, &share.UsedTokens)
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return share, &RecordNotFoundError{err: err.Error()}
+		}
+		return share, err
+	}
+	if description.Valid {
+		share.Description = description.String
+	}
+	if password.Valid {
+		share.Password = password.String
+	}
+	return share, nil
+}
+
+// sqlCommonExecMigrationWithTX executes the given statements and sets the given database version
+// inside a transaction. The statements are executed one by one, some drivers do not support
+// multiple statements in a single call
+func sqlCommonExecMigrationWithTX(dbHandle *sql.DB, version int, statements ...string) error {
+	tx, err := dbHandle.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	err = sqlCommonUpdateDatabaseVersionWithTX(tx, version)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
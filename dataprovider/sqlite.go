@@ -20,6 +20,41 @@ NOT NULL UNIQUE, "password" varchar(255) NULL, "public_keys" text NULL, "home_di
 "filesystem" text NULL);`
 	sqliteSchemaTableSQL = `CREATE TABLE "schema_version" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "version" integer NOT NULL);`
 	sqliteUsersV2SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "virtual_folders" text NULL;`
+	sqliteUsersV3SQL     = `ALTER TABLE "{{users}}" ADD COLUMN "upload_data_transfer" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "download_data_transfer" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "used_upload_data_transfer" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "used_download_data_transfer" bigint DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "data_transfer_reset" integer DEFAULT 0 NOT NULL;
+ALTER TABLE "{{users}}" ADD COLUMN "last_data_transfer_reset" bigint DEFAULT 0 NOT NULL;`
+	sqliteUsersV4SQL = `ALTER TABLE "{{users}}" ADD COLUMN "group_names" text NULL;
+CREATE TABLE "{{groups}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "name" varchar(255) NOT NULL UNIQUE,
+"description" varchar(512) NULL, "max_sessions" integer NOT NULL, "quota_size" bigint NOT NULL, "quota_files" integer NOT NULL,
+"permissions" text NULL, "upload_bandwidth" integer NOT NULL, "download_bandwidth" integer NOT NULL, "filters" text NULL,
+"filesystem" text NULL);`
+	sqliteAdminsV5SQL = `CREATE TABLE "{{admins}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "username" varchar(255) NOT NULL UNIQUE,
+"password" varchar(255) NOT NULL, "status" integer NOT NULL, "permissions" text NOT NULL, "description" varchar(512) NULL);`
+	sqliteAPIKeysV6SQL = `CREATE TABLE "{{api_keys}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "key_id" varchar(50) NOT NULL UNIQUE,
+"key_hash" varchar(255) NOT NULL, "name" varchar(255) NOT NULL, "admin" varchar(255) NOT NULL, "scopes" text NOT NULL,
+"created_at" bigint NOT NULL, "expires_at" bigint NOT NULL, "last_use_at" bigint NOT NULL, "description" varchar(512) NULL);`
+	sqliteSharesV7SQL = `CREATE TABLE "{{shares}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT, "share_id" varchar(60) NOT NULL UNIQUE,
+"name" varchar(255) NOT NULL, "description" varchar(512) NULL, "scope" integer NOT NULL, "path" text NOT NULL,
+"username" varchar(255) NOT NULL, "created_at" bigint NOT NULL, "expires_at" bigint NOT NULL, "last_use_at" bigint NOT NULL,
+"password" varchar(255) NULL, "max_tokens" integer NOT NULL, "used_tokens" integer NOT NULL);`
+	sqliteUsersV8SQL        = `ALTER TABLE "{{users}}" ADD COLUMN "activation_date" bigint DEFAULT 0 NOT NULL;`
+	sqliteUsersV9SQL        = `ALTER TABLE "{{users}}" ADD COLUMN "last_password_change" bigint DEFAULT 0 NOT NULL;`
+	sqliteEventsRulesV10SQL = `CREATE TABLE "{{events_rules}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "status" integer NOT NULL,
+"trigger_type" integer NOT NULL, "conditions" text NOT NULL, "action_config" text NOT NULL);`
+	sqliteUserTemplatesV11SQL = `CREATE TABLE "{{user_templates}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"name" varchar(255) NOT NULL UNIQUE, "description" varchar(512) NULL, "user_settings" text NOT NULL);`
+	sqliteDefenderHostsV12SQL = `CREATE TABLE "{{defender_hosts}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"ip" varchar(50) NOT NULL UNIQUE, "ban_time" bigint NOT NULL);`
+	sqliteDefenderEventsV12SQL = `CREATE TABLE "{{defender_events}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"ip" varchar(50) NOT NULL, "date_time" bigint NOT NULL, "score" integer NOT NULL);`
+	sqliteActiveSessionsV13SQL = `CREATE TABLE "{{active_sessions}}" ("id" integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+"connection_id" varchar(100) NOT NULL, "node_id" varchar(50) NOT NULL, "username" varchar(255) NOT NULL,
+"protocol" varchar(30) NOT NULL, "updated_at" bigint NOT NULL);`
+	sqliteAdminsV14SQL = `ALTER TABLE "{{admins}}" ADD COLUMN "filters" text NULL;`
 )
 
 // SQLiteProvider auth provider for SQLite database
@@ -75,10 +110,22 @@ func (p SQLiteProvider) updateQuota(username string, filesAdd int, sizeAdd int64
 	return sqlCommonUpdateQuota(username, filesAdd, sizeAdd, reset, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateDataTransfer(username string, uploadAdd, downloadAdd int64, reset bool) error {
+	return sqlCommonUpdateDataTransfer(username, uploadAdd, downloadAdd, reset, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUsedDataTransfer(username string) (int64, int64, int64, error) {
+	return sqlCommonGetUsedDataTransfer(username, p.dbHandle)
+}
+
 func (p SQLiteProvider) updateLastLogin(username string) error {
 	return sqlCommonUpdateLastLogin(username, p.dbHandle)
 }
 
+func (p SQLiteProvider) updateUserPassword(username, password string) error {
+	return sqlCommonUpdateUserPassword(username, password, p.dbHandle)
+}
+
 func (p SQLiteProvider) getUsedQuota(username string) (int, int64, error) {
 	return sqlCommonGetUsedQuota(username, p.dbHandle)
 }
@@ -107,6 +154,222 @@ func (p SQLiteProvider) getUsers(limit int, offset int, order string, username s
 	return sqlCommonGetUsers(limit, offset, order, username, p.dbHandle)
 }
 
+func (p SQLiteProvider) groupExists(name string) (Group, error) {
+	return sqlCommonCheckGroupExists(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) addGroup(group Group) error {
+	return sqlCommonAddGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateGroup(group Group) error {
+	return sqlCommonUpdateGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteGroup(group Group) error {
+	return sqlCommonDeleteGroup(group, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpGroups() ([]Group, error) {
+	return sqlCommonDumpGroups(p.dbHandle)
+}
+
+func (p SQLiteProvider) getGroups(limit int, offset int, order string, name string) ([]Group, error) {
+	return sqlCommonGetGroups(limit, offset, order, name, p.dbHandle)
+}
+
+func (p SQLiteProvider) getGroupByID(ID int64) (Group, error) {
+	return sqlCommonGetGroupByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) eventRuleExists(name string) (EventRule, error) {
+	return sqlCommonCheckEventRuleExists(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) addEventRule(rule EventRule) error {
+	return sqlCommonAddEventRule(rule, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateEventRule(rule EventRule) error {
+	return sqlCommonUpdateEventRule(rule, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteEventRule(rule EventRule) error {
+	return sqlCommonDeleteEventRule(rule, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpEventRules() ([]EventRule, error) {
+	return sqlCommonDumpEventRules(p.dbHandle)
+}
+
+func (p SQLiteProvider) getEventRules(limit int, offset int, order string, name string) ([]EventRule, error) {
+	return sqlCommonGetEventRules(limit, offset, order, name, p.dbHandle)
+}
+
+func (p SQLiteProvider) getEventRuleByID(ID int64) (EventRule, error) {
+	return sqlCommonGetEventRuleByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) userTemplateExists(name string) (UserTemplate, error) {
+	return sqlCommonCheckUserTemplateExists(name, p.dbHandle)
+}
+
+func (p SQLiteProvider) addUserTemplate(template UserTemplate) error {
+	return sqlCommonAddUserTemplate(template, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateUserTemplate(template UserTemplate) error {
+	return sqlCommonUpdateUserTemplate(template, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteUserTemplate(template UserTemplate) error {
+	return sqlCommonDeleteUserTemplate(template, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpUserTemplates() ([]UserTemplate, error) {
+	return sqlCommonDumpUserTemplates(p.dbHandle)
+}
+
+func (p SQLiteProvider) getUserTemplates(limit int, offset int, order string, name string) ([]UserTemplate, error) {
+	return sqlCommonGetUserTemplates(limit, offset, order, name, p.dbHandle)
+}
+
+func (p SQLiteProvider) getUserTemplateByID(ID int64) (UserTemplate, error) {
+	return sqlCommonGetUserTemplateByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) addDefenderEvent(ip string, score int) error {
+	return sqlCommonAddDefenderEvent(ip, score, p.dbHandle)
+}
+
+func (p SQLiteProvider) isDefenderHostBanned(ip string) (DefenderEntry, error) {
+	return sqlCommonIsDefenderHostBanned(ip, p.dbHandle)
+}
+
+func (p SQLiteProvider) getDefenderHostByIP(ip string, from int64) (DefenderEntry, error) {
+	return sqlCommonGetDefenderHostByIP(ip, from, p.dbHandle)
+}
+
+func (p SQLiteProvider) getDefenderHosts(from int64, limit int) ([]DefenderEntry, error) {
+	return sqlCommonGetDefenderHosts(from, limit, p.dbHandle)
+}
+
+func (p SQLiteProvider) setDefenderBanTime(ip string, banTime int64) error {
+	return sqlCommonSetDefenderBanTime(ip, banTime, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateDefenderBanTime(ip string, minutes int) error {
+	return sqlCommonUpdateDefenderBanTime(ip, minutes, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteDefenderHost(ip string) error {
+	return sqlCommonDeleteDefenderHost(ip, p.dbHandle)
+}
+
+func (p SQLiteProvider) cleanupDefender(from int64) error {
+	return sqlCommonCleanupDefender(from, p.dbHandle)
+}
+
+func (p SQLiteProvider) addActiveSession(session ActiveSession) error {
+	return sqlCommonAddActiveSession(session, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteActiveSession(nodeID, connectionID string) error {
+	return sqlCommonDeleteActiveSession(nodeID, connectionID, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateActiveSessionsHeartbeat(nodeID string) error {
+	return sqlCommonUpdateActiveSessionsHeartbeat(nodeID, p.dbHandle)
+}
+
+func (p SQLiteProvider) getActiveSessionsCount(username string, from int64) (int, error) {
+	return sqlCommonGetActiveSessionsCount(username, from, p.dbHandle)
+}
+
+func (p SQLiteProvider) cleanupActiveSessions(before int64) error {
+	return sqlCommonCleanupActiveSessions(before, p.dbHandle)
+}
+
+func (p SQLiteProvider) adminExists(username string) (Admin, error) {
+	return sqlCommonCheckAdminExists(username, p.dbHandle)
+}
+
+func (p SQLiteProvider) addAdmin(admin Admin) error {
+	return sqlCommonAddAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateAdmin(admin Admin) error {
+	return sqlCommonUpdateAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateAdminPassword(username, password string) error {
+	return sqlCommonUpdateAdminPassword(username, password, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteAdmin(admin Admin) error {
+	return sqlCommonDeleteAdmin(admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpAdmins() ([]Admin, error) {
+	return sqlCommonDumpAdmins(p.dbHandle)
+}
+
+func (p SQLiteProvider) getAdmins(limit int, offset int, order string, username string) ([]Admin, error) {
+	return sqlCommonGetAdmins(limit, offset, order, username, p.dbHandle)
+}
+
+func (p SQLiteProvider) getAdminByID(ID int64) (Admin, error) {
+	return sqlCommonGetAdminByID(ID, p.dbHandle)
+}
+
+func (p SQLiteProvider) apiKeyExists(keyID string) (APIKey, error) {
+	return sqlCommonCheckAPIKeyExists(keyID, p.dbHandle)
+}
+
+func (p SQLiteProvider) addAPIKey(key APIKey) error {
+	return sqlCommonAddAPIKey(key, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateAPIKeyLastUse(keyID string) error {
+	return sqlCommonUpdateAPIKeyLastUse(keyID, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteAPIKey(key APIKey) error {
+	return sqlCommonDeleteAPIKey(key, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpAPIKeys() ([]APIKey, error) {
+	return sqlCommonDumpAPIKeys(p.dbHandle)
+}
+
+func (p SQLiteProvider) getAPIKeys(limit int, offset int, order string, admin string) ([]APIKey, error) {
+	return sqlCommonGetAPIKeys(limit, offset, order, admin, p.dbHandle)
+}
+
+func (p SQLiteProvider) shareExists(shareID string) (Share, error) {
+	return sqlCommonCheckShareExists(shareID, p.dbHandle)
+}
+
+func (p SQLiteProvider) addShare(share Share) error {
+	return sqlCommonAddShare(share, p.dbHandle)
+}
+
+func (p SQLiteProvider) updateShareUsage(shareID string, numTokens int) error {
+	return sqlCommonUpdateShareUsage(shareID, numTokens, p.dbHandle)
+}
+
+func (p SQLiteProvider) deleteShare(share Share) error {
+	return sqlCommonDeleteShare(share, p.dbHandle)
+}
+
+func (p SQLiteProvider) dumpShares() ([]Share, error) {
+	return sqlCommonDumpShares(p.dbHandle)
+}
+
+func (p SQLiteProvider) getShares(limit int, offset int, order string, username string) ([]Share, error) {
+	return sqlCommonGetShares(limit, offset, order, username, p.dbHandle)
+}
+
 func (p SQLiteProvider) close() error {
 	return p.dbHandle.Close()
 }
@@ -132,8 +395,345 @@ func (p SQLiteProvider) migrateDatabase() error {
 		providerLog(logger.LevelDebug, "sql database is updated, current version: %v", dbVersion.Version)
 		return nil
 	}
-	if dbVersion.Version == 1 {
-		return updateSQLiteDatabaseFrom1To2(p.dbHandle)
+	switch dbVersion.Version {
+	case 1:
+		err = updateSQLiteDatabaseFrom1To2(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 2:
+		err = updateSQLiteDatabaseFrom2To3(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 3:
+		err = updateSQLiteDatabaseFrom3To4(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 4:
+		err = updateSQLiteDatabaseFrom4To5(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 5:
+		err = updateSQLiteDatabaseFrom5To6(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 6:
+		err = updateSQLiteDatabaseFrom6To7(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 7:
+		err = updateSQLiteDatabaseFrom7To8(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 8:
+		err = updateSQLiteDatabaseFrom8To9(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 9:
+		err = updateSQLiteDatabaseFrom9To10(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 10:
+		err = updateSQLiteDatabaseFrom10To11(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 11:
+		err = updateSQLiteDatabaseFrom11To12(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 12:
+		err = updateSQLiteDatabaseFrom12To13(p.dbHandle)
+		if err != nil {
+			return err
+		}
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
+	case 13:
+		return updateSQLiteDatabaseFrom13To14(p.dbHandle)
 	}
 	return nil
 }
@@ -147,3 +747,92 @@ func updateSQLiteDatabaseFrom1To2(dbHandle *sql.DB) error {
 	}
 	return sqlCommonUpdateDatabaseVersion(dbHandle, 2)
 }
+
+func updateSQLiteDatabaseFrom2To3(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 2 -> 3")
+	sql := strings.Replace(sqliteUsersV3SQL, "{{users}}", config.UsersTable, -1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 3)
+}
+
+func updateSQLiteDatabaseFrom3To4(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 3 -> 4")
+	sql := strings.Replace(sqliteUsersV4SQL, "{{users}}", config.UsersTable, 1)
+	sql = strings.Replace(sql, "{{groups}}", sqlGroupsTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 4)
+}
+
+func updateSQLiteDatabaseFrom4To5(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 4 -> 5")
+	sql := strings.Replace(sqliteAdminsV5SQL, "{{admins}}", sqlAdminsTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 5)
+}
+
+func updateSQLiteDatabaseFrom5To6(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 5 -> 6")
+	sql := strings.Replace(sqliteAPIKeysV6SQL, "{{api_keys}}", sqlAPIKeysTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 6)
+}
+
+func updateSQLiteDatabaseFrom6To7(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 6 -> 7")
+	sql := strings.Replace(sqliteSharesV7SQL, "{{shares}}", sqlSharesTable, 1)
+	_, err := dbHandle.Exec(sql)
+	if err != nil {
+		return err
+	}
+	return sqlCommonUpdateDatabaseVersion(dbHandle, 7)
+}
+
+func updateSQLiteDatabaseFrom7To8(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 7 -> 8")
+	return sqlCommonExecMigrationWithTX(dbHandle, 8, strings.Replace(sqliteUsersV8SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updateSQLiteDatabaseFrom8To9(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 8 -> 9")
+	return sqlCommonExecMigrationWithTX(dbHandle, 9, strings.Replace(sqliteUsersV9SQL, "{{users}}", config.UsersTable, 1))
+}
+
+func updateSQLiteDatabaseFrom9To10(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 9 -> 10")
+	return sqlCommonExecMigrationWithTX(dbHandle, 10, strings.Replace(sqliteEventsRulesV10SQL, "{{events_rules}}",
+		sqlEventsRulesTable, 1))
+}
+
+func updateSQLiteDatabaseFrom10To11(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 10 -> 11")
+	return sqlCommonExecMigrationWithTX(dbHandle, 11, strings.Replace(sqliteUserTemplatesV11SQL, "{{user_templates}}",
+		sqlUserTemplatesTable, 1))
+}
+
+func updateSQLiteDatabaseFrom11To12(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 11 -> 12")
+	return sqlCommonExecMigrationWithTX(dbHandle, 12, getDefenderV12Statements(sqliteDefenderHostsV12SQL,
+		sqliteDefenderEventsV12SQL)...)
+}
+
+func updateSQLiteDatabaseFrom12To13(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 12 -> 13")
+	return sqlCommonExecMigrationWithTX(dbHandle, 13, getActiveSessionsV13Statements(sqliteActiveSessionsV13SQL)...)
+}
+
+func updateSQLiteDatabaseFrom13To14(dbHandle *sql.DB) error {
+	providerLog(logger.LevelInfo, "updating database version: 13 -> 14")
+	return sqlCommonExecMigrationWithTX(dbHandle, 14, strings.Replace(sqliteAdminsV14SQL, "{{admins}}", sqlAdminsTable, 1))
+}
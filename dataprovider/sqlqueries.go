@@ -1,17 +1,39 @@
 package dataprovider
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 const (
 	selectUserFields = "id,username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,used_quota_size," +
 		"used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,expiration_date,last_login,status,filters,filesystem," +
-		"virtual_folders"
+		"virtual_folders,upload_data_transfer,download_data_transfer,used_upload_data_transfer,used_download_data_transfer," +
+		"data_transfer_reset,last_data_transfer_reset,group_names,activation_date,last_password_change"
+	selectGroupFields = "id,name,description,max_sessions,quota_size,quota_files,permissions,upload_bandwidth,download_bandwidth," +
+		"filters,filesystem"
+	selectAdminFields  = "id,username,password,status,permissions,description,filters"
+	selectAPIKeyFields = "id,key_id,key_hash,name,admin,scopes,created_at,expires_at,last_use_at,description"
+	selectShareFields  = "id,share_id,name,description,scope,path,username,created_at,expires_at,last_use_at,password," +
+		"max_tokens,used_tokens"
+	selectEventRuleFields    = "id,name,description,status,trigger_type,conditions,action_config"
+	selectUserTemplateFields = "id,name,description,user_settings"
+	// the groups table name is fixed, "groups" is a reserved word for some databases
+	sqlGroupsTable         = "sftpgo_groups"
+	sqlAdminsTable         = "sftpgo_admins"
+	sqlAPIKeysTable        = "sftpgo_api_keys"
+	sqlSharesTable         = "sftpgo_shares"
+	sqlEventsRulesTable    = "sftpgo_events_rules"
+	sqlUserTemplatesTable  = "sftpgo_user_templates"
+	sqlDefenderHostsTable  = "sftpgo_defender_hosts"
+	sqlDefenderEventsTable = "sftpgo_defender_events"
+	sqlActiveSessionsTable = "sftpgo_active_sessions"
 )
 
 func getSQLPlaceholders() []string {
 	var placeholders []string
-	for i := 1; i <= 20; i++ {
-		if config.Driver == PGSQLDataProviderName {
+	for i := 1; i <= 30; i++ {
+		if config.Driver == PGSQLDataProviderName || config.Driver == CockroachDataProviderName {
 			placeholders = append(placeholders, fmt.Sprintf("$%v", i))
 		} else {
 			placeholders = append(placeholders, "?")
@@ -50,38 +72,350 @@ func getUpdateQuotaQuery(reset bool) string {
 		WHERE username = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
 }
 
+func getUpdateDataTransferQuery(reset bool) string {
+	if reset {
+		return fmt.Sprintf(`UPDATE %v SET used_upload_data_transfer = %v,used_download_data_transfer = %v,last_data_transfer_reset = %v
+			WHERE username = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3])
+	}
+	return fmt.Sprintf(`UPDATE %v SET used_upload_data_transfer = used_upload_data_transfer + %v,
+		used_download_data_transfer = used_download_data_transfer + %v WHERE username = %v`, config.UsersTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
 func getUpdateLastLoginQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET last_login = %v WHERE username = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1])
 }
 
+func getUpdateUserPasswordQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET password = %v WHERE username = %v`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getUpdateAdminPasswordQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET password = %v WHERE username = %v`, sqlAdminsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
 func getQuotaQuery() string {
 	return fmt.Sprintf(`SELECT used_quota_size,used_quota_files FROM %v WHERE username = %v`, config.UsersTable,
 		sqlPlaceholders[0])
 }
 
+func getDataTransferQuery() string {
+	return fmt.Sprintf(`SELECT used_upload_data_transfer,used_download_data_transfer,last_data_transfer_reset FROM %v WHERE username = %v`,
+		config.UsersTable, sqlPlaceholders[0])
+}
+
 func getAddUserQuery() string {
 	return fmt.Sprintf(`INSERT INTO %v (username,password,public_keys,home_dir,uid,gid,max_sessions,quota_size,quota_files,permissions,
 		used_quota_size,used_quota_files,last_quota_update,upload_bandwidth,download_bandwidth,status,last_login,expiration_date,filters,
-		filesystem,virtual_folders)
-		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v)`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1],
-		sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7],
-		sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13],
-		sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16])
+		filesystem,virtual_folders,upload_data_transfer,download_data_transfer,used_upload_data_transfer,used_download_data_transfer,
+		data_transfer_reset,last_data_transfer_reset,group_names,activation_date,last_password_change)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,0,0,0,%v,%v,%v,0,%v,%v,%v,%v,%v,%v,0,0,%v,0,%v,%v,%v)`, config.UsersTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9], sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12],
+		sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15], sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18],
+		sqlPlaceholders[19], sqlPlaceholders[20], sqlPlaceholders[21], sqlPlaceholders[22])
 }
 
 func getUpdateUserQuery() string {
 	return fmt.Sprintf(`UPDATE %v SET password=%v,public_keys=%v,home_dir=%v,uid=%v,gid=%v,max_sessions=%v,quota_size=%v,
 		quota_files=%v,permissions=%v,upload_bandwidth=%v,download_bandwidth=%v,status=%v,expiration_date=%v,filters=%v,filesystem=%v,
-		virtual_folders=%v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		virtual_folders=%v,upload_data_transfer=%v,download_data_transfer=%v,data_transfer_reset=%v,group_names=%v,activation_date=%v,
+		last_password_change=%v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
 		sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
 		sqlPlaceholders[10], sqlPlaceholders[11], sqlPlaceholders[12], sqlPlaceholders[13], sqlPlaceholders[14], sqlPlaceholders[15],
-		sqlPlaceholders[16])
+		sqlPlaceholders[16], sqlPlaceholders[17], sqlPlaceholders[18], sqlPlaceholders[19], sqlPlaceholders[20], sqlPlaceholders[21],
+		sqlPlaceholders[22])
 }
 
 func getDeleteUserQuery() string {
 	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, config.UsersTable, sqlPlaceholders[0])
 }
 
+func getGroupByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectGroupFields, sqlGroupsTable, sqlPlaceholders[0])
+}
+
+func getGroupByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectGroupFields, sqlGroupsTable, sqlPlaceholders[0])
+}
+
+func getGroupsQuery(order string, name string) string {
+	if len(name) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v ORDER BY name %v LIMIT %v OFFSET %v`,
+			selectGroupFields, sqlGroupsTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectGroupFields, sqlGroupsTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpGroupsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectGroupFields, sqlGroupsTable)
+}
+
+func getAddGroupQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,description,max_sessions,quota_size,quota_files,permissions,upload_bandwidth,
+		download_bandwidth,filters,filesystem) VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v)`, sqlGroupsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9])
+}
+
+func getUpdateGroupQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,max_sessions=%v,quota_size=%v,quota_files=%v,permissions=%v,
+		upload_bandwidth=%v,download_bandwidth=%v,filters=%v,filesystem=%v WHERE id = %v`, sqlGroupsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6],
+		sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9])
+}
+
+func getDeleteGroupQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlGroupsTable, sqlPlaceholders[0])
+}
+
+func getEventRuleByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectEventRuleFields, sqlEventsRulesTable, sqlPlaceholders[0])
+}
+
+func getEventRuleByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectEventRuleFields, sqlEventsRulesTable, sqlPlaceholders[0])
+}
+
+func getEventRulesQuery(order string, name string) string {
+	if len(name) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v ORDER BY name %v LIMIT %v OFFSET %v`,
+			selectEventRuleFields, sqlEventsRulesTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectEventRuleFields, sqlEventsRulesTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpEventRulesQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectEventRuleFields, sqlEventsRulesTable)
+}
+
+func getAddEventRuleQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,description,status,trigger_type,conditions,action_config) VALUES (%v,%v,%v,%v,%v,%v)`,
+		sqlEventsRulesTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5])
+}
+
+func getUpdateEventRuleQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,status=%v,trigger_type=%v,conditions=%v,action_config=%v WHERE id = %v`,
+		sqlEventsRulesTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5])
+}
+
+func getDeleteEventRuleQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlEventsRulesTable, sqlPlaceholders[0])
+}
+
+func getUserTemplateByNameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v`, selectUserTemplateFields, sqlUserTemplatesTable, sqlPlaceholders[0])
+}
+
+func getUserTemplateByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectUserTemplateFields, sqlUserTemplatesTable, sqlPlaceholders[0])
+}
+
+func getUserTemplatesQuery(order string, name string) string {
+	if len(name) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE name = %v ORDER BY name %v LIMIT %v OFFSET %v`,
+			selectUserTemplateFields, sqlUserTemplatesTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY name %v LIMIT %v OFFSET %v`, selectUserTemplateFields, sqlUserTemplatesTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpUserTemplatesQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectUserTemplateFields, sqlUserTemplatesTable)
+}
+
+func getAddUserTemplateQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (name,description,user_settings) VALUES (%v,%v,%v)`, sqlUserTemplatesTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getUpdateUserTemplateQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET description=%v,user_settings=%v WHERE id = %v`, sqlUserTemplatesTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteUserTemplateQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlUserTemplatesTable, sqlPlaceholders[0])
+}
+
+// getDefenderV12Statements returns the statements to create the defender tables and their indexes
+func getDefenderV12Statements(hostsSQL, eventsSQL string) []string {
+	return []string{
+		strings.Replace(hostsSQL, "{{defender_hosts}}", sqlDefenderHostsTable, 1),
+		strings.Replace(eventsSQL, "{{defender_events}}", sqlDefenderEventsTable, 1),
+		fmt.Sprintf(`CREATE INDEX %v_ban_time_idx ON %v (ban_time);`, sqlDefenderHostsTable, sqlDefenderHostsTable),
+		fmt.Sprintf(`CREATE INDEX %v_ip_idx ON %v (ip);`, sqlDefenderEventsTable, sqlDefenderEventsTable),
+		fmt.Sprintf(`CREATE INDEX %v_date_time_idx ON %v (date_time);`, sqlDefenderEventsTable, sqlDefenderEventsTable),
+	}
+}
+
+func getAddDefenderEventQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (ip,date_time,score) VALUES (%v,%v,%v)`, sqlDefenderEventsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDefenderHostBanTimeQuery() string {
+	return fmt.Sprintf(`SELECT ban_time FROM %v WHERE ip = %v AND ban_time > %v`, sqlDefenderHostsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDefenderHostScoreQuery() string {
+	return fmt.Sprintf(`SELECT COALESCE(SUM(score),0) FROM %v WHERE ip = %v AND date_time > %v`, sqlDefenderEventsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDefenderBannedHostsQuery() string {
+	return fmt.Sprintf(`SELECT ip,ban_time FROM %v WHERE ban_time > %v ORDER BY ip LIMIT %v`, sqlDefenderHostsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDefenderScoredHostsQuery() string {
+	return fmt.Sprintf(`SELECT ip,SUM(score) FROM %v WHERE date_time > %v GROUP BY ip ORDER BY ip LIMIT %v`,
+		sqlDefenderEventsTable, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getAddDefenderHostQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (ip,ban_time) VALUES (%v,%v)`, sqlDefenderHostsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getSetDefenderBanTimeQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET ban_time = %v WHERE ip = %v`, sqlDefenderHostsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getIncreaseDefenderBanTimeQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET ban_time = ban_time + %v WHERE ip = %v AND ban_time > %v`, sqlDefenderHostsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteDefenderHostQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE ip = %v`, sqlDefenderHostsTable, sqlPlaceholders[0])
+}
+
+func getDeleteDefenderEventsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE ip = %v`, sqlDefenderEventsTable, sqlPlaceholders[0])
+}
+
+func getCleanupDefenderHostsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE ban_time < %v`, sqlDefenderHostsTable, sqlPlaceholders[0])
+}
+
+func getCleanupDefenderEventsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE date_time <= %v`, sqlDefenderEventsTable, sqlPlaceholders[0])
+}
+
+// getActiveSessionsV13Statements returns the statements to create the active sessions table and its indexes
+func getActiveSessionsV13Statements(tableSQL string) []string {
+	return []string{
+		strings.Replace(tableSQL, "{{active_sessions}}", sqlActiveSessionsTable, 1),
+		fmt.Sprintf(`CREATE UNIQUE INDEX %v_node_connection_idx ON %v (node_id,connection_id);`, sqlActiveSessionsTable,
+			sqlActiveSessionsTable),
+		fmt.Sprintf(`CREATE INDEX %v_username_idx ON %v (username);`, sqlActiveSessionsTable, sqlActiveSessionsTable),
+		fmt.Sprintf(`CREATE INDEX %v_updated_at_idx ON %v (updated_at);`, sqlActiveSessionsTable, sqlActiveSessionsTable),
+	}
+}
+
+func getAddActiveSessionQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (connection_id,node_id,username,protocol,updated_at) VALUES (%v,%v,%v,%v,%v)`,
+		sqlActiveSessionsTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3],
+		sqlPlaceholders[4])
+}
+
+func getDeleteActiveSessionQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE node_id = %v AND connection_id = %v`, sqlActiveSessionsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getUpdateActiveSessionsHeartbeatQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET updated_at = %v WHERE node_id = %v`, sqlActiveSessionsTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getActiveSessionsCountQuery() string {
+	return fmt.Sprintf(`SELECT COUNT(*) FROM %v WHERE username = %v AND updated_at > %v`, sqlActiveSessionsTable,
+		sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getCleanupActiveSessionsQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE updated_at < %v`, sqlActiveSessionsTable, sqlPlaceholders[0])
+}
+
+func getAdminByUsernameQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v`, selectAdminFields, sqlAdminsTable, sqlPlaceholders[0])
+}
+
+func getAdminByIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE id = %v`, selectAdminFields, sqlAdminsTable, sqlPlaceholders[0])
+}
+
+func getAdminsQuery(order string, username string) string {
+	if len(username) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v ORDER BY username %v LIMIT %v OFFSET %v`,
+			selectAdminFields, sqlAdminsTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY username %v LIMIT %v OFFSET %v`, selectAdminFields, sqlAdminsTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpAdminsQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectAdminFields, sqlAdminsTable)
+}
+
+func getAddAdminQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (username,password,status,permissions,description,filters) VALUES (%v,%v,%v,%v,%v,%v)`,
+		sqlAdminsTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5])
+}
+
+func getUpdateAdminQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET password=%v,status=%v,permissions=%v,description=%v,filters=%v WHERE id = %v`,
+		sqlAdminsTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5])
+}
+
+func getDeleteAdminQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE id = %v`, sqlAdminsTable, sqlPlaceholders[0])
+}
+
+func getAPIKeyByKeyIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE key_id = %v`, selectAPIKeyFields, sqlAPIKeysTable, sqlPlaceholders[0])
+}
+
+func getAPIKeysQuery(order string, admin string) string {
+	if len(admin) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE admin = %v ORDER BY key_id %v LIMIT %v OFFSET %v`,
+			selectAPIKeyFields, sqlAPIKeysTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY key_id %v LIMIT %v OFFSET %v`, selectAPIKeyFields, sqlAPIKeysTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpAPIKeysQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectAPIKeyFields, sqlAPIKeysTable)
+}
+
+func getAddAPIKeyQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (key_id,key_hash,name,admin,scopes,created_at,expires_at,last_use_at,description)
+		VALUES (%v,%v,%v,%v,%v,%v,%v,0,%v)`, sqlAPIKeysTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2],
+		sqlPlaceholders[3], sqlPlaceholders[4], sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7])
+}
+
+func getUpdateAPIKeyLastUseQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET last_use_at = %v WHERE key_id = %v`, sqlAPIKeysTable, sqlPlaceholders[0],
+		sqlPlaceholders[1])
+}
+
+func getDeleteAPIKeyQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE key_id = %v`, sqlAPIKeysTable, sqlPlaceholders[0])
+}
+
 func getDatabaseVersionQuery() string {
 	return "SELECT version from schema_version LIMIT 1"
 }
@@ -89,3 +423,37 @@ func getDatabaseVersionQuery() string {
 func getUpdateDBVersionQuery() string {
 	return fmt.Sprintf(`UPDATE schema_version SET version=%v`, sqlPlaceholders[0])
 }
+
+func getShareByShareIDQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v WHERE share_id = %v`, selectShareFields, sqlSharesTable, sqlPlaceholders[0])
+}
+
+func getSharesQuery(order string, username string) string {
+	if len(username) > 0 {
+		return fmt.Sprintf(`SELECT %v FROM %v WHERE username = %v ORDER BY share_id %v LIMIT %v OFFSET %v`,
+			selectShareFields, sqlSharesTable, sqlPlaceholders[0], order, sqlPlaceholders[1], sqlPlaceholders[2])
+	}
+	return fmt.Sprintf(`SELECT %v FROM %v ORDER BY share_id %v LIMIT %v OFFSET %v`, selectShareFields, sqlSharesTable,
+		order, sqlPlaceholders[0], sqlPlaceholders[1])
+}
+
+func getDumpSharesQuery() string {
+	return fmt.Sprintf(`SELECT %v FROM %v`, selectShareFields, sqlSharesTable)
+}
+
+func getAddShareQuery() string {
+	return fmt.Sprintf(`INSERT INTO %v (share_id,name,description,scope,path,username,created_at,expires_at,last_use_at,
+		password,max_tokens,used_tokens) VALUES (%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v,%v)`, sqlSharesTable,
+		sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2], sqlPlaceholders[3], sqlPlaceholders[4],
+		sqlPlaceholders[5], sqlPlaceholders[6], sqlPlaceholders[7], sqlPlaceholders[8], sqlPlaceholders[9],
+		sqlPlaceholders[10], sqlPlaceholders[11])
+}
+
+func getUpdateShareUsageQuery() string {
+	return fmt.Sprintf(`UPDATE %v SET used_tokens = used_tokens + %v, last_use_at = %v WHERE share_id = %v`,
+		sqlSharesTable, sqlPlaceholders[0], sqlPlaceholders[1], sqlPlaceholders[2])
+}
+
+func getDeleteShareQuery() string {
+	return fmt.Sprintf(`DELETE FROM %v WHERE share_id = %v`, sqlSharesTable, sqlPlaceholders[0])
+}
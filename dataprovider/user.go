@@ -11,9 +11,11 @@ import (
 	"strings"
 	"time"
 
+	"github.com/drakkan/sftpgo/geoip"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
+	"golang.org/x/crypto/ssh"
 )
 
 // Available permissions for SFTP users
@@ -50,8 +52,78 @@ const (
 	SSHLoginMethodPublicKey           = "publickey"
 	SSHLoginMethodPassword            = "password"
 	SSHLoginMethodKeyboardInteractive = "keyboard-interactive"
+	SSHLoginMethodKeyAndPassword      = "publickey+password"
+	SSHLoginMethodKeyAndKeyboardInt   = "publickey+keyboard-interactive"
 )
 
+// Supported upload modes for the user filters, empty means the global upload mode
+const (
+	// the files are uploaded directly to the requested path
+	UploadModeStandard = "standard"
+	// the files are uploaded to a temporary path and renamed to the requested path when the upload ends
+	UploadModeAtomic = "atomic"
+	// same as atomic but the temporary file is renamed to the requested path on upload errors too
+	UploadModeAtomicWithResume = "atomic_resume"
+)
+
+// Supported setstat modes for the user filters, empty means the global setstat mode
+const (
+	// the setstat requests change the file attributes
+	SetstatModeNormal = "normal"
+	// the setstat requests are silently ignored
+	SetstatModeIgnore = "ignore"
+)
+
+// Supported data transfer reset modes
+const (
+	// the used data transfer is never reset
+	DataTransferResetNever = iota
+	// the used data transfer is reset at the start of each month
+	DataTransferResetMonthly
+)
+
+// LoginMethodRule defines the login methods allowed or denied for the clients connecting
+// from the given networks. The rules are evaluated in order and only the first one matching
+// the client address is applied. The denied login methods filter applies regardless of the rules
+type LoginMethodRule struct {
+	// IP/Mask in CIDR notation, for example "192.168.1.0/24". Empty means any address
+	Sources []string `json:"sources,omitempty"`
+	// if not empty only these login methods are allowed
+	AllowedLoginMethods []string `json:"allowed_login_methods,omitempty"`
+	// these login methods are not allowed, they are evaluated before the allowed ones
+	DeniedLoginMethods []string `json:"denied_login_methods,omitempty"`
+}
+
+// GetAsString returns the rule formatted as sources::allowed methods::denied methods,
+// the format used in the web admin interface
+func (r *LoginMethodRule) GetAsString() string {
+	return fmt.Sprintf("%v::%v::%v", strings.Join(r.Sources, ","), strings.Join(r.AllowedLoginMethods, ","),
+		strings.Join(r.DeniedLoginMethods, ","))
+}
+
+func (r *LoginMethodRule) matches(remoteIP net.IP) bool {
+	if len(r.Sources) == 0 {
+		return true
+	}
+	if remoteIP == nil {
+		return false
+	}
+	for _, IPMask := range r.Sources {
+		_, IPNet, err := net.ParseCIDR(IPMask)
+		if err == nil && IPNet.Contains(remoteIP) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *LoginMethodRule) isLoginMethodAllowed(loginMethod string) bool {
+	if utils.IsStringInSlice(loginMethod, r.DeniedLoginMethods) {
+		return false
+	}
+	return len(r.AllowedLoginMethods) == 0 || utils.IsStringInSlice(loginMethod, r.AllowedLoginMethods)
+}
+
 // ExtensionsFilter defines filters based on file extensions.
 // These restrictions do not apply to files listing for performance reasons, so
 // a denied file cannot be downloaded/overwritten/renamed but will still be
@@ -75,6 +147,29 @@ type ExtensionsFilter struct {
 	DeniedExtensions []string `json:"denied_extensions,omitempty"`
 }
 
+// PatternsFilter defines filters based on shell like patterns.
+// These restrictions do not apply to files listing for performance reasons, so
+// a denied file cannot be downloaded/overwritten/renamed but it will still be
+// listed in the list of files.
+// System commands such as Git and rsync interacts with the filesystem directly
+// and they are not aware about these restrictions so rsync is not allowed if
+// patterns filters are defined and Git is not allowed inside a path with
+// patterns filters
+type PatternsFilter struct {
+	// SFTP/SCP path, if no other specific filter is defined, the filter apply for
+	// sub directories too.
+	// For example if filters are defined for the paths "/" and "/sub" then the
+	// filters for "/" are applied for any file outside the "/sub" directory
+	Path string `json:"path"`
+	// files with these, case insensitive, patterns are allowed.
+	// The patterns are matched against the file name, for example "*.xml" or "invoice_*.pdf".
+	// See path.Match for the supported syntax
+	AllowedPatterns []string `json:"allowed_patterns,omitempty"`
+	// files with these, case insensitive, patterns are not allowed.
+	// Denied file patterns are evaluated before the allowed ones
+	DeniedPatterns []string `json:"denied_patterns,omitempty"`
+}
+
 // UserFilters defines additional restrictions for a user
 type UserFilters struct {
 	// only clients connecting from these IP/Mask are allowed.
@@ -84,20 +179,59 @@ type UserFilters struct {
 	// clients connecting from these IP/Mask are not allowed.
 	// Denied rules will be evaluated before allowed ones
 	DeniedIP []string `json:"denied_ip,omitempty"`
+	// only clients connecting from these countries are allowed, 2 letter ISO 3166 codes.
+	// The country is resolved using the configured GeoIP database
+	AllowedCountries []string `json:"allowed_countries,omitempty"`
+	// clients connecting from these countries are not allowed.
+	// Denied countries will be evaluated before allowed ones
+	DeniedCountries []string `json:"denied_countries,omitempty"`
 	// these login methods are not allowed.
 	// If null or empty any available login method is allowed
 	DeniedLoginMethods []string `json:"denied_login_methods,omitempty"`
+	// login methods allowed or denied based on the client address, for example to require
+	// a public key from the external networks and to allow passwords from the LAN.
+	// The first rule matching the client address is applied, if no rule matches only
+	// the denied login methods are checked
+	LoginMethodRules []LoginMethodRule `json:"login_method_rules,omitempty"`
 	// filters based on file extensions.
 	// Please note that these restrictions can be easily bypassed.
 	FileExtensions []ExtensionsFilter `json:"file_extensions,omitempty"`
+	// filters based on shell like file patterns.
+	// These restrictions do not apply to the files listing too.
+	FilePatterns []PatternsFilter `json:"file_patterns,omitempty"`
+	// base32 encoded secret for time-based one-time passwords, it is stored encrypted.
+	// If set the user must provide a TOTP code, after the password, using the SSH
+	// keyboard interactive authentication, password only logins are denied
+	TOTPSecret string `json:"totp_secret,omitempty"`
+	// maximum password age as number of days, after this time the password logins are rejected.
+	// 0 means the global password expiration, if any, is used
+	PasswordExpiration int `json:"password_expiration,omitempty"`
+	// upload mode: standard, atomic or atomic_resume.
+	// Empty means the global upload mode is used
+	UploadMode string `json:"upload_mode,omitempty"`
+	// setstat mode: normal or ignore.
+	// Empty means the global setstat mode is used
+	SetstatMode string `json:"setstat_mode,omitempty"`
+	// SHA256 fingerprints of the public keys and certificates, or of the signing CA keys, that
+	// are not allowed to login as this user, even if they are still listed in the public keys
+	RevokedPublicKeys []string `json:"revoked_public_keys,omitempty"`
+	// maximum size, as bytes, allowed for a single uploaded file. Uploads exceeding this size
+	// are aborted, 0 means no limit
+	MaxUploadFileSize int64 `json:"max_upload_file_size,omitempty"`
 }
 
 // Filesystem defines cloud storage filesystem details
 type Filesystem struct {
-	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage
-	Provider  int             `json:"provider"`
-	S3Config  vfs.S3FsConfig  `json:"s3config,omitempty"`
-	GCSConfig vfs.GCSFsConfig `json:"gcsconfig,omitempty"`
+	// 0 local filesystem, 1 Amazon S3 compatible, 2 Google Cloud Storage, 3 Azure Blob Storage,
+	// 4 remote SFTP server
+	Provider     int                `json:"provider"`
+	S3Config     vfs.S3FsConfig     `json:"s3config,omitempty"`
+	GCSConfig    vfs.GCSFsConfig    `json:"gcsconfig,omitempty"`
+	AzBlobConfig vfs.AzBlobFsConfig `json:"azblobconfig,omitempty"`
+	SFTPConfig   vfs.SFTPFsConfig   `json:"sftpconfig,omitempty"`
+	// if a passphrase is set the file contents are encrypted before
+	// storing them using the configured provider
+	CryptConfig vfs.CryptFsConfig `json:"cryptconfig,omitempty"`
 }
 
 // User defines an SFTP user
@@ -111,6 +245,9 @@ type User struct {
 	// Account expiration date as unix timestamp in milliseconds. An expired account cannot login.
 	// 0 means no expiration
 	ExpirationDate int64 `json:"expiration_date"`
+	// Account activation date as unix timestamp in milliseconds. The account cannot login before this date,
+	// together with the expiration date it defines an activation window. 0 means active immediately
+	ActivationDate int64 `json:"activation_date"`
 	// Password used for password authentication.
 	// For users created using SFTPGo REST API the password is be stored using argon2id hashing algo.
 	// Checking passwords stored with bcrypt, pbkdf2, md5crypt and sha512crypt is supported too.
@@ -143,22 +280,55 @@ type User struct {
 	UploadBandwidth int64 `json:"upload_bandwidth"`
 	// Maximum download bandwidth as KB/s, 0 means unlimited
 	DownloadBandwidth int64 `json:"download_bandwidth"`
+	// Maximum data transfer allowed for uploads as MB, 0 means unlimited
+	UploadDataTransfer int64 `json:"upload_data_transfer"`
+	// Maximum data transfer allowed for downloads as MB, 0 means unlimited
+	DownloadDataTransfer int64 `json:"download_data_transfer"`
+	// Uploaded data as bytes since the last data transfer reset
+	UsedUploadDataTransfer int64 `json:"used_upload_data_transfer"`
+	// Downloaded data as bytes since the last data transfer reset
+	UsedDownloadDataTransfer int64 `json:"used_download_data_transfer"`
+	// 0 means that the used data transfer is never reset, 1 means that it is reset each month
+	DataTransferReset int `json:"data_transfer_reset"`
+	// Last data transfer reset as unix timestamp in milliseconds
+	LastDataTransferReset int64 `json:"last_data_transfer_reset"`
 	// Last login as unix timestamp in milliseconds
 	LastLogin int64 `json:"last_login"`
+	// Last password change as unix timestamp in milliseconds, it is automatically updated
+	// when the password changes. 0 means unknown, for example the password was set before
+	// the change tracking was added
+	LastPasswordChange int64 `json:"last_password_change"`
 	// Additional restrictions
 	Filters UserFilters `json:"filters"`
 	// Filesystem configuration details
 	FsConfig Filesystem `json:"filesystem"`
+	// Names of the groups the user belongs to, the settings not defined for the user are
+	// inherited from the groups, see Group for details
+	Groups []string `json:"groups,omitempty"`
+	// restrictions for the current session only, they are set during the login
+	sessionOverrides SessionOverrides
 }
 
 // GetFilesystem returns the filesystem for this user
 func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
+	fs, err := u.getProviderFilesystem(connectionID)
+	if err != nil || len(u.FsConfig.CryptConfig.Passphrase) == 0 {
+		return fs, err
+	}
+	return vfs.NewCryptFs(fs, u.GetHomeDir(), u.FsConfig.CryptConfig)
+}
+
+func (u *User) getProviderFilesystem(connectionID string) (vfs.Fs, error) {
 	if u.FsConfig.Provider == 1 {
 		return vfs.NewS3Fs(connectionID, u.GetHomeDir(), u.FsConfig.S3Config)
 	} else if u.FsConfig.Provider == 2 {
 		config := u.FsConfig.GCSConfig
 		config.CredentialFile = u.getGCSCredentialsFilePath()
 		return vfs.NewGCSFs(connectionID, u.GetHomeDir(), config)
+	} else if u.FsConfig.Provider == 3 {
+		return vfs.NewAzBlobFs(connectionID, u.GetHomeDir(), u.FsConfig.AzBlobConfig)
+	} else if u.FsConfig.Provider == 4 {
+		return vfs.NewSFTPFs(connectionID, u.GetHomeDir(), u.FsConfig.SFTPConfig)
 	}
 	return vfs.NewOsFs(connectionID, u.GetHomeDir(), u.VirtualFolders), nil
 }
@@ -166,14 +336,23 @@ func (u *User) GetFilesystem(connectionID string) (vfs.Fs, error) {
 // GetPermissionsForPath returns the permissions for the given path.
 // The path must be an SFTP path
 func (u *User) GetPermissionsForPath(p string) []string {
+	permissions, _ := u.getPermissionsForPath(p)
+	return permissions
+}
+
+// getPermissionsForPath returns the permissions for the given path and the
+// directory they are defined for, the directory is empty if no permission matches
+func (u *User) getPermissionsForPath(p string) ([]string, string) {
 	permissions := []string{}
+	permissionsPath := ""
 	if perms, ok := u.Permissions["/"]; ok {
 		// if only root permissions are defined returns them unconditionally
 		if len(u.Permissions) == 1 {
-			return perms
+			return perms, "/"
 		}
 		// fallback permissions
 		permissions = perms
+		permissionsPath = "/"
 	}
 	dirsForPath := utils.GetDirsForSFTPPath(p)
 	// dirsForPath contains all the dirs for a given path in reverse order
@@ -183,10 +362,11 @@ func (u *User) GetPermissionsForPath(p string) []string {
 	for _, val := range dirsForPath {
 		if perms, ok := u.Permissions[val]; ok {
 			permissions = perms
+			permissionsPath = val
 			break
 		}
 	}
-	return permissions
+	return permissions, permissionsPath
 }
 
 // AddVirtualDirs adds virtual folders, if defined, to the given files list
@@ -223,6 +403,26 @@ func (u *User) IsVirtualFolder(sftpPath string) bool {
 	return false
 }
 
+// IsFileExcludedFromQuota returns true if the file with the specified filesystem path
+// is inside a virtual folder excluded from the user quota
+func (u *User) IsFileExcludedFromQuota(fsPath string) bool {
+	if u.sessionOverrides.RootExcludedFromQuota {
+		home := u.GetHomeDir()
+		if fsPath == home || strings.HasPrefix(fsPath, home+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	for _, v := range u.VirtualFolders {
+		if !v.ExcludeFromQuota {
+			continue
+		}
+		if fsPath == v.MappedPath || strings.HasPrefix(fsPath, v.MappedPath+string(os.PathSeparator)) {
+			return true
+		}
+	}
+	return false
+}
+
 // HasPerm returns true if the user has the given permission or any permission
 func (u *User) HasPerm(permission, path string) bool {
 	perms := u.GetPermissionsForPath(path)
@@ -247,20 +447,86 @@ func (u *User) HasPerms(permissions []string, path string) bool {
 }
 
 // IsLoginMethodAllowed returns true if the specified login method is allowed for the user
-func (u *User) IsLoginMethodAllowed(loginMetod string) bool {
-	if len(u.Filters.DeniedLoginMethods) == 0 {
-		return true
-	}
+// connecting from the specified remoteAddr
+func (u *User) IsLoginMethodAllowed(loginMetod, remoteAddr string) bool {
 	if utils.IsStringInSlice(loginMetod, u.Filters.DeniedLoginMethods) {
 		return false
 	}
+	if rule := u.getLoginMethodRule(remoteAddr); rule != nil {
+		return rule.isLoginMethodAllowed(loginMetod)
+	}
 	return true
 }
 
+// getLoginMethodRule returns the first login method rule matching remoteAddr, if any
+func (u *User) getLoginMethodRule(remoteAddr string) *LoginMethodRule {
+	if len(u.Filters.LoginMethodRules) == 0 {
+		return nil
+	}
+	// an invalid remote IP matches only the rules without sources
+	remoteIP := net.ParseIP(utils.GetIPFromRemoteAddress(remoteAddr))
+	for idx := range u.Filters.LoginMethodRules {
+		if u.Filters.LoginMethodRules[idx].matches(remoteIP) {
+			return &u.Filters.LoginMethodRules[idx]
+		}
+	}
+	return nil
+}
+
+// GetAllowedLoginMethods returns the allowed SSH login methods for the specified remoteAddr
+func (u *User) GetAllowedLoginMethods(remoteAddr string) []string {
+	var allowedMethods []string
+	for _, method := range ValidSSHLoginMethods {
+		if u.IsLoginMethodAllowed(method, remoteAddr) {
+			allowedMethods = append(allowedMethods, method)
+		}
+	}
+	return allowedMethods
+}
+
+// GetNextAuthMethods returns the SSH login methods required to complete a multi-step
+// authentication after a successful authentication using the specified login method.
+// We support publickey+password and publickey+keyboard-interactive, so only the public
+// key can be the first step, and the next steps are required only if all the login
+// methods allowed for the specified remoteAddr are multi-step ones.
+// An empty result means that no further steps are required
+func (u *User) GetNextAuthMethods(loginMethod, remoteAddr string) []string {
+	if loginMethod != SSHLoginMethodPublicKey {
+		return nil
+	}
+	allowedMethods := u.GetAllowedLoginMethods(remoteAddr)
+	for _, method := range allowedMethods {
+		if !utils.IsStringInSlice(method, SSHMultiStepsLoginMethods) {
+			return nil
+		}
+	}
+	var nextMethods []string
+	for _, method := range allowedMethods {
+		switch method {
+		case SSHLoginMethodKeyAndPassword:
+			nextMethods = append(nextMethods, SSHLoginMethodPassword)
+		case SSHLoginMethodKeyAndKeyboardInt:
+			nextMethods = append(nextMethods, SSHLoginMethodKeyboardInteractive)
+		}
+	}
+	return nextMethods
+}
+
 // IsFileAllowed returns true if the specified file is allowed by the file restrictions filters
 func (u *User) IsFileAllowed(sftpPath string) bool {
+	return u.isFilePatternAllowed(sftpPath) && u.isFileExtensionAllowed(sftpPath)
+}
+
+func (u *User) isFileExtensionAllowed(sftpPath string) bool {
+	allowed, _, _ := u.checkFileExtensions(sftpPath)
+	return allowed
+}
+
+// checkFileExtensions returns true if the specified file is allowed by the extensions filters,
+// the path of the applied filter and the matching extension, if any
+func (u *User) checkFileExtensions(sftpPath string) (bool, string, string) {
 	if len(u.Filters.FileExtensions) == 0 {
-		return true
+		return true, "", ""
 	}
 	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(sftpPath))
 	var filter ExtensionsFilter
@@ -279,17 +545,58 @@ func (u *User) IsFileAllowed(sftpPath string) bool {
 		toMatch := strings.ToLower(sftpPath)
 		for _, denied := range filter.DeniedExtensions {
 			if strings.HasSuffix(toMatch, denied) {
-				return false
+				return false, filter.Path, denied
 			}
 		}
 		for _, allowed := range filter.AllowedExtensions {
 			if strings.HasSuffix(toMatch, allowed) {
-				return true
+				return true, filter.Path, allowed
 			}
 		}
-		return len(filter.AllowedExtensions) == 0
+		return len(filter.AllowedExtensions) == 0, filter.Path, ""
 	}
-	return true
+	return true, "", ""
+}
+
+func (u *User) isFilePatternAllowed(sftpPath string) bool {
+	allowed, _, _ := u.checkFilePatterns(sftpPath)
+	return allowed
+}
+
+// checkFilePatterns returns true if the specified file is allowed by the patterns filters,
+// the path of the applied filter and the matching pattern, if any
+func (u *User) checkFilePatterns(sftpPath string) (bool, string, string) {
+	if len(u.Filters.FilePatterns) == 0 {
+		return true, "", ""
+	}
+	dirsForPath := utils.GetDirsForSFTPPath(path.Dir(sftpPath))
+	var filter PatternsFilter
+	for _, dir := range dirsForPath {
+		for _, f := range u.Filters.FilePatterns {
+			if f.Path == dir {
+				filter = f
+				break
+			}
+		}
+		if len(filter.Path) > 0 {
+			break
+		}
+	}
+	if len(filter.Path) > 0 {
+		toMatch := strings.ToLower(path.Base(sftpPath))
+		for _, denied := range filter.DeniedPatterns {
+			if matched, err := path.Match(denied, toMatch); err == nil && matched {
+				return false, filter.Path, denied
+			}
+		}
+		for _, allowed := range filter.AllowedPatterns {
+			if matched, err := path.Match(allowed, toMatch); err == nil && matched {
+				return true, filter.Path, allowed
+			}
+		}
+		return len(filter.AllowedPatterns) == 0, filter.Path, ""
+	}
+	return true, "", ""
 }
 
 // IsLoginFromAddrAllowed returns true if the login is allowed from the specified remoteAddr.
@@ -327,6 +634,20 @@ func (u *User) IsLoginFromAddrAllowed(remoteAddr string) bool {
 	return len(u.Filters.AllowedIP) == 0
 }
 
+// IsLoginFromCountryAllowed returns true if the login is allowed from the country of the
+// specified remoteAddr. The global GeoIP restrictions are evaluated before the user ones.
+// The detected country is returned too, it is empty if there are no country restrictions
+func (u *User) IsLoginFromCountryAllowed(remoteAddr string) (bool, string) {
+	if !geoip.HasRestrictions(u.Filters.AllowedCountries, u.Filters.DeniedCountries) {
+		return true, ""
+	}
+	allowed, country := geoip.IsLoginAllowed(utils.GetIPFromRemoteAddress(remoteAddr), u.Filters.AllowedCountries,
+		u.Filters.DeniedCountries)
+	logger.Debug(logSender, "", "GeoIP country for user %#v, remote address %v: %#v, login allowed: %v", u.Username,
+		remoteAddr, country, allowed)
+	return allowed, country
+}
+
 // GetPermissionsAsJSON returns the permissions as json byte array
 func (u *User) GetPermissionsAsJSON() ([]byte, error) {
 	return json.Marshal(u.Permissions)
@@ -347,6 +668,11 @@ func (u *User) GetFsConfigAsJSON() ([]byte, error) {
 	return json.Marshal(u.FsConfig)
 }
 
+// GetGroupsAsJSON returns the group names as json byte array
+func (u *User) GetGroupsAsJSON() ([]byte, error) {
+	return json.Marshal(u.Groups)
+}
+
 // GetVirtualFoldersAsJSON returns the virtual folders as json byte array
 func (u *User) GetVirtualFoldersAsJSON() ([]byte, error) {
 	return json.Marshal(u.VirtualFolders)
@@ -373,11 +699,38 @@ func (u *User) GetHomeDir() string {
 	return filepath.Clean(u.HomeDir)
 }
 
+// HasSessionRoot returns true if the current session is confined inside a directory,
+// the home directory is then the session root and not the real one
+func (u *User) HasSessionRoot() bool {
+	return path.Join("/", u.sessionOverrides.Root) != "/"
+}
+
+// GetSessionOverrides returns the restrictions applied to the current session
+func (u *User) GetSessionOverrides() SessionOverrides {
+	return u.sessionOverrides
+}
+
+// SetSessionOverrides sets the restrictions for the current session, they must be already applied.
+// It restores them for a user serialized after the login, they are never serialized with the user
+func (u *User) SetSessionOverrides(s SessionOverrides) {
+	u.sessionOverrides = s
+}
+
 // HasQuotaRestrictions returns true if there is a quota restriction on number of files or size or both
 func (u *User) HasQuotaRestrictions() bool {
 	return u.QuotaFiles > 0 || u.QuotaSize > 0
 }
 
+// HasDataTransferRestrictions returns true if there is a data transfer limit for uploads or downloads
+func (u *User) HasDataTransferRestrictions() bool {
+	return u.UploadDataTransfer > 0 || u.DownloadDataTransfer > 0
+}
+
+// HasTOTPSecret returns true if a second authentication factor, based on TOTP, is required
+func (u *User) HasTOTPSecret() bool {
+	return len(u.Filters.TOTPSecret) > 0
+}
+
 // GetQuotaSummary returns used quota and limits if defined
 func (u *User) GetQuotaSummary() string {
 	var result string
@@ -391,6 +744,14 @@ func (u *User) GetQuotaSummary() string {
 			result += "/" + utils.ByteCountSI(u.QuotaSize)
 		}
 	}
+	if u.UploadDataTransfer > 0 {
+		result += ". UL: " + utils.ByteCountSI(u.UsedUploadDataTransfer) + "/" +
+			utils.ByteCountSI(u.UploadDataTransfer*1048576)
+	}
+	if u.DownloadDataTransfer > 0 {
+		result += ". DL: " + utils.ByteCountSI(u.UsedDownloadDataTransfer) + "/" +
+			utils.ByteCountSI(u.DownloadDataTransfer*1048576)
+	}
 	return result
 }
 
@@ -452,6 +813,10 @@ func (u *User) GetInfoString() string {
 		result += fmt.Sprintf("Storage: S3 ")
 	} else if u.FsConfig.Provider == 2 {
 		result += fmt.Sprintf("Storage: GCS ")
+	} else if u.FsConfig.Provider == 3 {
+		result += fmt.Sprintf("Storage: Azure ")
+	} else if u.FsConfig.Provider == 4 {
+		result += fmt.Sprintf("Storage: SFTP ")
 	}
 	if len(u.PublicKeys) > 0 {
 		result += fmt.Sprintf("Public keys: %v ", len(u.PublicKeys))
@@ -483,6 +848,35 @@ func (u *User) GetExpirationDateAsString() string {
 	return ""
 }
 
+// GetActivationDateAsString returns activation date formatted as YYYY-MM-DD
+func (u *User) GetActivationDateAsString() string {
+	if u.ActivationDate > 0 {
+		t := utils.GetTimeFromMsecSinceEpoch(u.ActivationDate)
+		return t.Format("2006-01-02")
+	}
+	return ""
+}
+
+// GetPasswordExpiration returns the maximum password age as number of days,
+// the user filter has precedence over the global setting. 0 means no expiration
+func (u *User) GetPasswordExpiration() int {
+	if u.Filters.PasswordExpiration > 0 {
+		return u.Filters.PasswordExpiration
+	}
+	return config.PasswordExpiration
+}
+
+// IsPasswordExpired returns true if the user password is older than the maximum password age.
+// Passwords without a known last change are never considered expired
+func (u *User) IsPasswordExpired() bool {
+	days := u.GetPasswordExpiration()
+	if days <= 0 || u.LastPasswordChange <= 0 {
+		return false
+	}
+	expiration := utils.GetTimeFromMsecSinceEpoch(u.LastPasswordChange).Add(time.Duration(days) * 24 * time.Hour)
+	return time.Now().After(expiration)
+}
+
 // GetAllowedIPAsString returns the allowed IP as comma separated string
 func (u User) GetAllowedIPAsString() string {
 	result := ""
@@ -495,6 +889,45 @@ func (u User) GetAllowedIPAsString() string {
 	return result
 }
 
+// GetAllowedCountriesAsString returns the allowed countries as comma separated string
+func (u User) GetAllowedCountriesAsString() string {
+	return strings.Join(u.Filters.AllowedCountries, ",")
+}
+
+// GetDeniedCountriesAsString returns the denied countries as comma separated string
+func (u User) GetDeniedCountriesAsString() string {
+	return strings.Join(u.Filters.DeniedCountries, ",")
+}
+
+// IsUploadSizeAllowed returns false if a file with the given size exceeds
+// the maximum upload file size allowed for this user
+func (u *User) IsUploadSizeAllowed(size int64) bool {
+	return u.Filters.MaxUploadFileSize <= 0 || size <= u.Filters.MaxUploadFileSize
+}
+
+// IsPublicKeyRevoked returns true if the given public key has been revoked for this user.
+// For certificates the certified key and the signing CA key are checked
+func (u *User) IsPublicKeyRevoked(key ssh.PublicKey) bool {
+	if len(u.Filters.RevokedPublicKeys) == 0 {
+		return false
+	}
+	keys := []ssh.PublicKey{key}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		keys = append(keys, cert.Key, cert.SignatureKey)
+	}
+	for _, k := range keys {
+		if utils.IsStringInSlice(ssh.FingerprintSHA256(k), u.Filters.RevokedPublicKeys) {
+			return true
+		}
+	}
+	return false
+}
+
+// GetGroupsAsString returns the group names as comma separated string
+func (u User) GetGroupsAsString() string {
+	return strings.Join(u.Groups, ",")
+}
+
 // GetDeniedIPAsString returns the denied IP as comma separated string
 func (u User) GetDeniedIPAsString() string {
 	result := ""
@@ -523,10 +956,35 @@ func (u *User) getACopy() User {
 	copy(filters.AllowedIP, u.Filters.AllowedIP)
 	filters.DeniedIP = make([]string, len(u.Filters.DeniedIP))
 	copy(filters.DeniedIP, u.Filters.DeniedIP)
+	filters.AllowedCountries = make([]string, len(u.Filters.AllowedCountries))
+	copy(filters.AllowedCountries, u.Filters.AllowedCountries)
+	filters.DeniedCountries = make([]string, len(u.Filters.DeniedCountries))
+	copy(filters.DeniedCountries, u.Filters.DeniedCountries)
 	filters.DeniedLoginMethods = make([]string, len(u.Filters.DeniedLoginMethods))
 	copy(filters.DeniedLoginMethods, u.Filters.DeniedLoginMethods)
+	filters.LoginMethodRules = make([]LoginMethodRule, 0, len(u.Filters.LoginMethodRules))
+	for _, rule := range u.Filters.LoginMethodRules {
+		filters.LoginMethodRules = append(filters.LoginMethodRules, LoginMethodRule{
+			Sources:             append([]string{}, rule.Sources...),
+			AllowedLoginMethods: append([]string{}, rule.AllowedLoginMethods...),
+			DeniedLoginMethods:  append([]string{}, rule.DeniedLoginMethods...),
+		})
+	}
 	filters.FileExtensions = make([]ExtensionsFilter, len(u.Filters.FileExtensions))
 	copy(filters.FileExtensions, u.Filters.FileExtensions)
+	filters.FilePatterns = make([]PatternsFilter, len(u.Filters.FilePatterns))
+	copy(filters.FilePatterns, u.Filters.FilePatterns)
+	filters.TOTPSecret = u.Filters.TOTPSecret
+	filters.PasswordExpiration = u.Filters.PasswordExpiration
+	filters.UploadMode = u.Filters.UploadMode
+	filters.SetstatMode = u.Filters.SetstatMode
+	filters.MaxUploadFileSize = u.Filters.MaxUploadFileSize
+	filters.RevokedPublicKeys = make([]string, len(u.Filters.RevokedPublicKeys))
+	copy(filters.RevokedPublicKeys, u.Filters.RevokedPublicKeys)
+	groups := make([]string, len(u.Groups))
+	copy(groups, u.Groups)
+	fingerprints := make([]string, len(u.FsConfig.SFTPConfig.Fingerprints))
+	copy(fingerprints, u.FsConfig.SFTPConfig.Fingerprints)
 	fsConfig := Filesystem{
 		Provider: u.FsConfig.Provider,
 		S3Config: vfs.S3FsConfig{
@@ -539,6 +997,7 @@ func (u *User) getACopy() User {
 			KeyPrefix:         u.FsConfig.S3Config.KeyPrefix,
 			UploadPartSize:    u.FsConfig.S3Config.UploadPartSize,
 			UploadConcurrency: u.FsConfig.S3Config.UploadConcurrency,
+			ResumableUploads:  u.FsConfig.S3Config.ResumableUploads,
 		},
 		GCSConfig: vfs.GCSFsConfig{
 			Bucket:               u.FsConfig.GCSConfig.Bucket,
@@ -547,31 +1006,64 @@ func (u *User) getACopy() User {
 			StorageClass:         u.FsConfig.GCSConfig.StorageClass,
 			KeyPrefix:            u.FsConfig.GCSConfig.KeyPrefix,
 		},
+		AzBlobConfig: vfs.AzBlobFsConfig{
+			Container:         u.FsConfig.AzBlobConfig.Container,
+			AccountName:       u.FsConfig.AzBlobConfig.AccountName,
+			AccountKey:        u.FsConfig.AzBlobConfig.AccountKey,
+			Endpoint:          u.FsConfig.AzBlobConfig.Endpoint,
+			SASURL:            u.FsConfig.AzBlobConfig.SASURL,
+			KeyPrefix:         u.FsConfig.AzBlobConfig.KeyPrefix,
+			UploadPartSize:    u.FsConfig.AzBlobConfig.UploadPartSize,
+			UploadConcurrency: u.FsConfig.AzBlobConfig.UploadConcurrency,
+			UseEmulator:       u.FsConfig.AzBlobConfig.UseEmulator,
+			AccessTier:        u.FsConfig.AzBlobConfig.AccessTier,
+		},
+		SFTPConfig: vfs.SFTPFsConfig{
+			Endpoint:         u.FsConfig.SFTPConfig.Endpoint,
+			Username:         u.FsConfig.SFTPConfig.Username,
+			Password:         u.FsConfig.SFTPConfig.Password,
+			PrivateKey:       u.FsConfig.SFTPConfig.PrivateKey,
+			Fingerprints:     fingerprints,
+			AcceptAnyHostKey: u.FsConfig.SFTPConfig.AcceptAnyHostKey,
+			Prefix:           u.FsConfig.SFTPConfig.Prefix,
+		},
+		CryptConfig: vfs.CryptFsConfig{
+			Passphrase: u.FsConfig.CryptConfig.Passphrase,
+		},
 	}
 
 	return User{
-		ID:                u.ID,
-		Username:          u.Username,
-		Password:          u.Password,
-		PublicKeys:        pubKeys,
-		HomeDir:           u.HomeDir,
-		VirtualFolders:    virtualFolders,
-		UID:               u.UID,
-		GID:               u.GID,
-		MaxSessions:       u.MaxSessions,
-		QuotaSize:         u.QuotaSize,
-		QuotaFiles:        u.QuotaFiles,
-		Permissions:       permissions,
-		UsedQuotaSize:     u.UsedQuotaSize,
-		UsedQuotaFiles:    u.UsedQuotaFiles,
-		LastQuotaUpdate:   u.LastQuotaUpdate,
-		UploadBandwidth:   u.UploadBandwidth,
-		DownloadBandwidth: u.DownloadBandwidth,
-		Status:            u.Status,
-		ExpirationDate:    u.ExpirationDate,
-		LastLogin:         u.LastLogin,
-		Filters:           filters,
-		FsConfig:          fsConfig,
+		ID:                       u.ID,
+		Username:                 u.Username,
+		Password:                 u.Password,
+		PublicKeys:               pubKeys,
+		HomeDir:                  u.HomeDir,
+		VirtualFolders:           virtualFolders,
+		UID:                      u.UID,
+		GID:                      u.GID,
+		MaxSessions:              u.MaxSessions,
+		QuotaSize:                u.QuotaSize,
+		QuotaFiles:               u.QuotaFiles,
+		Permissions:              permissions,
+		UsedQuotaSize:            u.UsedQuotaSize,
+		UsedQuotaFiles:           u.UsedQuotaFiles,
+		LastQuotaUpdate:          u.LastQuotaUpdate,
+		UploadBandwidth:          u.UploadBandwidth,
+		DownloadBandwidth:        u.DownloadBandwidth,
+		UploadDataTransfer:       u.UploadDataTransfer,
+		DownloadDataTransfer:     u.DownloadDataTransfer,
+		UsedUploadDataTransfer:   u.UsedUploadDataTransfer,
+		UsedDownloadDataTransfer: u.UsedDownloadDataTransfer,
+		DataTransferReset:        u.DataTransferReset,
+		LastDataTransferReset:    u.LastDataTransferReset,
+		Status:                   u.Status,
+		ExpirationDate:           u.ExpirationDate,
+		ActivationDate:           u.ActivationDate,
+		LastLogin:                u.LastLogin,
+		LastPasswordChange:       u.LastPasswordChange,
+		Filters:                  filters,
+		FsConfig:                 fsConfig,
+		Groups:                   groups,
 	}
 }
 
@@ -593,6 +1085,7 @@ func (u *User) getNotificationFieldsAsEnvVars(action string) []string {
 		fmt.Sprintf("SFTPGO_USER_ID=%v", u.ID),
 		fmt.Sprintf("SFTPGO_USER_STATUS=%v", u.Status),
 		fmt.Sprintf("SFTPGO_USER_EXPIRATION_DATE=%v", u.ExpirationDate),
+		fmt.Sprintf("SFTPGO_USER_ACTIVATION_DATE=%v", u.ActivationDate),
 		fmt.Sprintf("SFTPGO_USER_HOME_DIR=%v", u.HomeDir),
 		fmt.Sprintf("SFTPGO_USER_UID=%v", u.UID),
 		fmt.Sprintf("SFTPGO_USER_GID=%v", u.GID),
@@ -0,0 +1,136 @@
+package dataprovider
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// UserTemplatePlaceholder is replaced with the username of each user created from a template
+const UserTemplatePlaceholder = "%username%"
+
+// the username used to validate the templates
+const userTemplateValidationUsername = "template_user"
+
+// UserTemplate defines the settings used to create new users.
+// The UserTemplatePlaceholder is replaced with the username in the home directory, in the
+// permissions and virtual folders paths, in the virtual folders mapped paths and in the key
+// prefix of the cloud filesystems
+type UserTemplate struct {
+	// Database unique identifier
+	ID int64 `json:"id"`
+	// Unique name, it cannot be changed
+	Name string `json:"name"`
+	// Optional description
+	Description string `json:"description,omitempty"`
+	// Settings for the new users, the username and the password are ignored, they are
+	// defined for each user to create
+	User User `json:"user"`
+}
+
+// UserTemplateEntry defines the username and the credentials for a user to create from a template
+type UserTemplateEntry struct {
+	Username   string   `json:"username"`
+	Password   string   `json:"password,omitempty"`
+	PublicKeys []string `json:"public_keys,omitempty"`
+}
+
+// GetUserAsJSON returns the user settings as json byte array
+func (t *UserTemplate) GetUserAsJSON() ([]byte, error) {
+	return json.Marshal(t.User)
+}
+
+// GetUser returns a user with the template settings and the given username and credentials
+func (t *UserTemplate) GetUser(entry UserTemplateEntry) User {
+	user := t.User.getACopy()
+	user.ID = 0
+	user.Username = entry.Username
+	user.Password = entry.Password
+	if len(entry.PublicKeys) > 0 {
+		user.PublicKeys = entry.PublicKeys
+	}
+	user.UsedQuotaSize = 0
+	user.UsedQuotaFiles = 0
+	user.LastQuotaUpdate = 0
+	user.UsedUploadDataTransfer = 0
+	user.UsedDownloadDataTransfer = 0
+	user.LastDataTransferReset = 0
+	user.LastLogin = 0
+	user.LastPasswordChange = 0
+	replacer := strings.NewReplacer(UserTemplatePlaceholder, entry.Username)
+	user.HomeDir = replacer.Replace(user.HomeDir)
+	permissions := make(map[string][]string)
+	for dir, perms := range user.Permissions {
+		permissions[replacer.Replace(dir)] = perms
+	}
+	user.Permissions = permissions
+	for idx := range user.VirtualFolders {
+		user.VirtualFolders[idx].VirtualPath = replacer.Replace(user.VirtualFolders[idx].VirtualPath)
+		user.VirtualFolders[idx].MappedPath = replacer.Replace(user.VirtualFolders[idx].MappedPath)
+	}
+	user.FsConfig.S3Config.KeyPrefix = replacer.Replace(user.FsConfig.S3Config.KeyPrefix)
+	user.FsConfig.GCSConfig.KeyPrefix = replacer.Replace(user.FsConfig.GCSConfig.KeyPrefix)
+	user.FsConfig.AzBlobConfig.KeyPrefix = replacer.Replace(user.FsConfig.AzBlobConfig.KeyPrefix)
+	user.FsConfig.SFTPConfig.Prefix = replacer.Replace(user.FsConfig.SFTPConfig.Prefix)
+	return user
+}
+
+func (t *UserTemplate) getACopy() UserTemplate {
+	template := *t
+	template.User = t.User.getACopy()
+	return template
+}
+
+func validateUserTemplate(template *UserTemplate) error {
+	if len(template.Name) == 0 {
+		return &ValidationError{err: "mandatory parameters missing"}
+	}
+	template.User.ID = 0
+	template.User.Username = ""
+	template.User.Password = ""
+	if len(template.User.Filters.TOTPSecret) > 0 {
+		return &ValidationError{err: "TOTP secrets are not supported for user templates"}
+	}
+	// the template is validated as a user with a sample username, the validation user is discarded
+	// except for the secrets, so they are stored encrypted
+	user := template.GetUser(UserTemplateEntry{
+		Username: userTemplateValidationUsername,
+		Password: userTemplateValidationUsername,
+	})
+	if err := validateUser(&user); err != nil {
+		return err
+	}
+	template.User.FsConfig.S3Config.AccessSecret = user.FsConfig.S3Config.AccessSecret
+	template.User.FsConfig.AzBlobConfig.AccountKey = user.FsConfig.AzBlobConfig.AccountKey
+	template.User.FsConfig.AzBlobConfig.SASURL = user.FsConfig.AzBlobConfig.SASURL
+	template.User.FsConfig.SFTPConfig.Password = user.FsConfig.SFTPConfig.Password
+	template.User.FsConfig.SFTPConfig.PrivateKey = user.FsConfig.SFTPConfig.PrivateKey
+	template.User.FsConfig.CryptConfig.Passphrase = user.FsConfig.CryptConfig.Passphrase
+	return nil
+}
+
+// HideUserTemplateSensitiveData hides user template sensitive data
+func HideUserTemplateSensitiveData(template *UserTemplate) UserTemplate {
+	template.User = HideUserSensitiveData(&template.User)
+	return *template
+}
+
+// validateUserTemplateEntries checks the users to create from a template, the usernames must be unique
+func validateUserTemplateEntries(entries []UserTemplateEntry) error {
+	if len(entries) == 0 {
+		return &ValidationError{err: "at least one user is required"}
+	}
+	var usernames []string
+	for _, entry := range entries {
+		if len(entry.Username) == 0 {
+			return &ValidationError{err: "the username is mandatory"}
+		}
+		if utils.IsStringInSlice(entry.Username, usernames) {
+			return &ValidationError{err: fmt.Sprintf("duplicate username %#v", entry.Username)}
+		}
+		usernames = append(usernames, entry.Username)
+	}
+	return nil
+}
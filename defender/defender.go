@@ -0,0 +1,721 @@
+// Package defender implements a brute force protection.
+// Failed authentications are scored per client IP and the IPs that exceed
+// a threshold within the observation window are temporarily banned
+package defender
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const logSender = "defender"
+
+// HostEvent is the event type to score
+type HostEvent int
+
+// Supported host events
+const (
+	// HostEventLoginFailed is a failed login for an existing user
+	HostEventLoginFailed HostEvent = iota
+	// HostEventUserNotFound is a failed login for a non existent user
+	HostEventUserNotFound
+	// HostEventNoLoginTried is a client that disconnects without trying to authenticate
+	HostEventNoLoginTried
+)
+
+// Supported drivers
+const (
+	// DriverMemory stores the hosts scores and the banned hosts in memory
+	DriverMemory = "memory"
+	// DriverProvider stores the hosts scores and the banned hosts in the data provider,
+	// so they are shared between multiple SFTPGo instances using the same data provider
+	DriverProvider = "provider"
+)
+
+// Supported IP lists
+const (
+	// ListSafe is the list of the IP addresses or CIDR networks that are never banned
+	ListSafe = "safe"
+	// ListBlock is the list of the IP addresses or CIDR networks that are always rejected
+	ListBlock = "block"
+)
+
+var (
+	defender hostsDefender
+	// ErrNotEnabled is returned by the methods that require an enabled defender
+	ErrNotEnabled = errors.New("the defender is not enabled")
+	// ErrNotFound is returned if the requested host or list entry does not exist
+	ErrNotFound = errors.New("not found")
+)
+
+// Host defines a host tracked by the defender, it has a score or it is banned
+type Host struct {
+	IP string `json:"ip"`
+	// Score within the observation window, it is 0 for banned hosts
+	Score int `json:"score"`
+	// Ban expiration as RFC3339 UTC string, empty if the host is not banned
+	BanTime string `json:"ban_time,omitempty"`
+}
+
+// Lists defines the safe and block lists.
+// The entries from the configuration file cannot be removed at runtime
+type Lists struct {
+	ConfigSafeList   []string `json:"config_safe_list"`
+	ConfigBlockList  []string `json:"config_block_list"`
+	RuntimeSafeList  []string `json:"runtime_safe_list"`
+	RuntimeBlockList []string `json:"runtime_block_list"`
+}
+
+// Config defines the defender configuration
+type Config struct {
+	// Set to true to enable the defender
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Defines where the hosts scores and the banned hosts are stored, "memory" or "provider".
+	// Use "provider" to share them between multiple instances using the same data provider
+	Driver string `json:"driver" mapstructure:"driver"`
+	// BanTime is the number of minutes that a host is banned
+	BanTime int `json:"ban_time" mapstructure:"ban_time"`
+	// Percentage increase of the ban time if a banned host tries to connect again
+	BanTimeIncrement int `json:"ban_time_increment" mapstructure:"ban_time_increment"`
+	// Threshold value for banning a client
+	Threshold int `json:"threshold" mapstructure:"threshold"`
+	// Score for invalid login attempts, eg. non-existent user accounts
+	ScoreInvalid int `json:"score_invalid" mapstructure:"score_invalid"`
+	// Score for valid login attempts, eg. user accounts that exist but the credentials are wrong
+	ScoreValid int `json:"score_valid" mapstructure:"score_valid"`
+	// Score for clients that disconnect without trying to authenticate
+	ScoreNoAuth int `json:"score_no_auth" mapstructure:"score_no_auth"`
+	// Defines the time window, in minutes, for tracking client errors.
+	// A host is banned if it has exceeded the defined threshold during
+	// the last observation time minutes
+	ObservationTime int `json:"observation_time" mapstructure:"observation_time"`
+	// The number of banned IPs and host scores kept in memory will vary between the
+	// soft and hard limit. For the provider driver the hard limit is the maximum number
+	// of hosts returned when listing them
+	EntriesSoftLimit int `json:"entries_soft_limit" mapstructure:"entries_soft_limit"`
+	EntriesHardLimit int `json:"entries_hard_limit" mapstructure:"entries_hard_limit"`
+	// IP addresses or CIDR networks that are never banned
+	SafeList []string `json:"safe_list" mapstructure:"safe_list"`
+	// IP addresses or CIDR networks that are always rejected
+	BlockList []string `json:"block_list" mapstructure:"block_list"`
+}
+
+// hostsDefender is implemented by the defender drivers
+type hostsDefender interface {
+	isBanned(ip string) bool
+	addEvent(ip string, event HostEvent)
+	getBanTime(ip string) *time.Time
+	getScore(ip string) int
+	getHosts() ([]Host, error)
+	getHost(ip string) (Host, error)
+	unban(ip string) error
+	getLists() Lists
+	addListEntry(list, entry string) error
+	removeListEntry(list, entry string) error
+	reloadLists(config Config, safeList, blockList []*net.IPNet)
+}
+
+type hostEvent struct {
+	dateTime time.Time
+	score    int
+}
+
+type hostScore struct {
+	TotalScore int
+	Events     []hostEvent
+}
+
+type memoryDefender struct {
+	config    Config
+	safeList  []*net.IPNet
+	blockList []*net.IPNet
+	// entries added at runtime, they are kept on lists reload and lost on restart
+	runtimeSafeList  []string
+	runtimeBlockList []string
+	sync.RWMutex
+	// IP addresses of the clients with failed authentications are stored inside hosts,
+	// they are moved to banned once the threshold is reached.
+	// A violation from a banned host will increase the ban time
+	// based on the configured BanTimeIncrement
+	hosts  map[string]hostScore
+	banned map[string]time.Time
+}
+
+func (c *Config) validate() error {
+	if c.Driver == "" {
+		c.Driver = DriverMemory
+	}
+	if c.Driver != DriverMemory && c.Driver != DriverProvider {
+		return fmt.Errorf("unsupported driver %#v", c.Driver)
+	}
+	if c.ScoreInvalid >= c.Threshold {
+		return fmt.Errorf("score_invalid %v must be lower than the threshold %v", c.ScoreInvalid, c.Threshold)
+	}
+	if c.ScoreValid >= c.Threshold {
+		return fmt.Errorf("score_valid %v must be lower than the threshold %v", c.ScoreValid, c.Threshold)
+	}
+	if c.ScoreNoAuth >= c.Threshold {
+		return fmt.Errorf("score_no_auth %v must be lower than the threshold %v", c.ScoreNoAuth, c.Threshold)
+	}
+	if c.BanTime <= 0 {
+		return fmt.Errorf("invalid ban_time %v", c.BanTime)
+	}
+	if c.BanTimeIncrement <= 0 {
+		return fmt.Errorf("invalid ban_time_increment %v", c.BanTimeIncrement)
+	}
+	if c.ObservationTime <= 0 {
+		return fmt.Errorf("invalid observation_time %v", c.ObservationTime)
+	}
+	if c.EntriesSoftLimit <= 0 {
+		return fmt.Errorf("invalid entries_soft_limit %v", c.EntriesSoftLimit)
+	}
+	if c.EntriesHardLimit <= c.EntriesSoftLimit {
+		return fmt.Errorf("invalid entries_hard_limit %v must be > %v", c.EntriesHardLimit, c.EntriesSoftLimit)
+	}
+	return nil
+}
+
+// Initialize configures the defender, it does nothing if the defender is not enabled
+func Initialize(config Config) error {
+	if !config.Enabled {
+		defender = nil
+		return nil
+	}
+	if err := config.validate(); err != nil {
+		return err
+	}
+	safeList, err := parseIPList(config.SafeList)
+	if err != nil {
+		return fmt.Errorf("invalid safe_list: %v", err)
+	}
+	blockList, err := parseIPList(config.BlockList)
+	if err != nil {
+		return fmt.Errorf("invalid block_list: %v", err)
+	}
+	memDefender := &memoryDefender{
+		config:    config,
+		safeList:  safeList,
+		blockList: blockList,
+		hosts:     make(map[string]hostScore),
+		banned:    make(map[string]time.Time),
+	}
+	if config.Driver == DriverProvider {
+		defender = &providerDefender{
+			memoryDefender: memDefender,
+		}
+	} else {
+		defender = memDefender
+	}
+	logger.Debug(logSender, "", "defender initialized with config %+v", config)
+	return nil
+}
+
+// ReloadLists replaces the safe and block lists with the ones from the given configuration,
+// the other settings, the banned hosts, the scores and the runtime list entries are unchanged.
+// The current lists are kept if the new ones are not valid
+func ReloadLists(config Config) error {
+	if defender == nil {
+		return nil
+	}
+	safeList, err := parseIPList(config.SafeList)
+	if err != nil {
+		return fmt.Errorf("invalid safe_list: %v", err)
+	}
+	blockList, err := parseIPList(config.BlockList)
+	if err != nil {
+		return fmt.Errorf("invalid block_list: %v", err)
+	}
+	defender.reloadLists(config, safeList, blockList)
+	logger.Debug(logSender, "", "defender lists reloaded, safe list: %v, block list: %v", config.SafeList, config.BlockList)
+	return nil
+}
+
+// IsBanned returns true if the specified IP is banned or it is inside the block list.
+// A client that tries to connect while banned increases its ban time
+func IsBanned(ip string) bool {
+	if defender == nil {
+		return false
+	}
+	return defender.isBanned(ip)
+}
+
+// AddEvent adds an event for the given IP.
+// This method must be called for clients not yet banned
+func AddEvent(ip string, event HostEvent) {
+	if defender != nil {
+		defender.addEvent(ip, event)
+	}
+}
+
+// GetBanTime returns the ban time for the given IP or nil if the IP is not banned
+func GetBanTime(ip string) *time.Time {
+	if defender == nil {
+		return nil
+	}
+	return defender.getBanTime(ip)
+}
+
+// GetScore returns the score for the given IP
+func GetScore(ip string) int {
+	if defender == nil {
+		return 0
+	}
+	return defender.getScore(ip)
+}
+
+// IsEnabled returns true if the defender is enabled
+func IsEnabled() bool {
+	return defender != nil
+}
+
+// GetHosts returns the banned hosts and the hosts with a score
+func GetHosts() ([]Host, error) {
+	if defender == nil {
+		return nil, ErrNotEnabled
+	}
+	return defender.getHosts()
+}
+
+// GetHost returns the defender status for the given IP
+func GetHost(ip string) (Host, error) {
+	if defender == nil {
+		return Host{}, ErrNotEnabled
+	}
+	return defender.getHost(ip)
+}
+
+// Unban removes the ban and the score for the given IP.
+// The IPs inside the block list are still rejected
+func Unban(ip string) error {
+	if defender == nil {
+		return ErrNotEnabled
+	}
+	return defender.unban(ip)
+}
+
+// GetLists returns the safe and block lists
+func GetLists() (Lists, error) {
+	if defender == nil {
+		return Lists{}, ErrNotEnabled
+	}
+	return defender.getLists(), nil
+}
+
+// AddListEntry adds an IP address or a CIDR network to the specified list.
+// Adding an entry to the safe list removes the bans and the scores for the matching hosts
+func AddListEntry(list, entry string) error {
+	if defender == nil {
+		return ErrNotEnabled
+	}
+	return defender.addListEntry(list, entry)
+}
+
+// RemoveListEntry removes an entry added at runtime from the specified list
+func RemoveListEntry(list, entry string) error {
+	if defender == nil {
+		return ErrNotEnabled
+	}
+	return defender.removeListEntry(list, entry)
+}
+
+// reloadLists replaces the lists from the configuration, the runtime entries are preserved
+func (d *memoryDefender) reloadLists(config Config, safeList, blockList []*net.IPNet) {
+	d.Lock()
+	defer d.Unlock()
+	runtimeSafeList, _ := parseIPList(d.runtimeSafeList)
+	runtimeBlockList, _ := parseIPList(d.runtimeBlockList)
+	d.config.SafeList = config.SafeList
+	d.config.BlockList = config.BlockList
+	d.safeList = append(safeList, runtimeSafeList...)
+	d.blockList = append(blockList, runtimeBlockList...)
+}
+
+func (d *memoryDefender) isBanned(ip string) bool {
+	parsedIP := net.ParseIP(ip)
+	d.RLock()
+	if isIPInList(parsedIP, d.blockList) {
+		d.RUnlock()
+		return true
+	}
+	if banTime, ok := d.banned[ip]; ok {
+		if banTime.After(time.Now()) {
+			increment := d.config.BanTime * d.config.BanTimeIncrement / 100
+			if increment == 0 {
+				increment++
+			}
+			d.RUnlock()
+			// concurrent updates could lose an increment, this is not a problem.
+			// This method is called for each new connection so we hold the read
+			// lock for the common case and the write lock only for banned hosts
+			d.Lock()
+			d.banned[ip] = banTime.Add(time.Duration(increment) * time.Minute)
+			d.Unlock()
+			return true
+		}
+	}
+	d.RUnlock()
+	return false
+}
+
+// getEventScore returns the score for the given event, it is 0 for the hosts inside the safe list
+func (d *memoryDefender) getEventScore(ip string, event HostEvent) int {
+	d.RLock()
+	isSafe := isIPInList(net.ParseIP(ip), d.safeList)
+	d.RUnlock()
+	if isSafe {
+		return 0
+	}
+	switch event {
+	case HostEventLoginFailed:
+		return d.config.ScoreValid
+	case HostEventUserNotFound:
+		return d.config.ScoreInvalid
+	case HostEventNoLoginTried:
+		return d.config.ScoreNoAuth
+	}
+	return 0
+}
+
+// isBlocked returns true if the given IP is inside the block list
+func (d *memoryDefender) isBlocked(ip string) bool {
+	d.RLock()
+	defer d.RUnlock()
+	return isIPInList(net.ParseIP(ip), d.blockList)
+}
+
+func (d *memoryDefender) addEvent(ip string, event HostEvent) {
+	score := d.getEventScore(ip, event)
+	if score <= 0 {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	ev := hostEvent{
+		dateTime: time.Now(),
+		score:    score,
+	}
+	if hs, ok := d.hosts[ip]; ok {
+		hs.Events = append(hs.Events, ev)
+		hs.TotalScore = 0
+		idx := 0
+		for _, event := range hs.Events {
+			if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
+				hs.Events[idx] = event
+				hs.TotalScore += event.score
+				idx++
+			}
+		}
+		hs.Events = hs.Events[:idx]
+		if hs.TotalScore >= d.config.Threshold {
+			logger.Info(logSender, "", "host %#v banned, score %v, threshold %v", ip, hs.TotalScore, d.config.Threshold)
+			d.banned[ip] = time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
+			delete(d.hosts, ip)
+			d.cleanupBanned()
+		} else {
+			d.hosts[ip] = hs
+		}
+	} else {
+		d.hosts[ip] = hostScore{
+			TotalScore: ev.score,
+			Events:     []hostEvent{ev},
+		}
+		d.cleanupHosts()
+	}
+}
+
+func (d *memoryDefender) getBanTime(ip string) *time.Time {
+	d.RLock()
+	defer d.RUnlock()
+	if banTime, ok := d.banned[ip]; ok && banTime.After(time.Now()) {
+		return &banTime
+	}
+	return nil
+}
+
+func (d *memoryDefender) getScore(ip string) int {
+	d.RLock()
+	defer d.RUnlock()
+	return d.getHostScore(ip)
+}
+
+func (d *memoryDefender) getHosts() ([]Host, error) {
+	d.RLock()
+	defer d.RUnlock()
+	result := make([]Host, 0, len(d.banned)+len(d.hosts))
+	for ip, banTime := range d.banned {
+		if banTime.After(time.Now()) {
+			result = append(result, Host{
+				IP:      ip,
+				BanTime: banTime.UTC().Format(time.RFC3339),
+			})
+		}
+	}
+	for ip := range d.hosts {
+		if score := d.getHostScore(ip); score > 0 {
+			result = append(result, Host{
+				IP:    ip,
+				Score: score,
+			})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].IP < result[j].IP
+	})
+	return result, nil
+}
+
+func (d *memoryDefender) getHost(ip string) (Host, error) {
+	d.RLock()
+	defer d.RUnlock()
+	if banTime, ok := d.banned[ip]; ok && banTime.After(time.Now()) {
+		return Host{
+			IP:      ip,
+			BanTime: banTime.UTC().Format(time.RFC3339),
+		}, nil
+	}
+	if score := d.getHostScore(ip); score > 0 {
+		return Host{
+			IP:    ip,
+			Score: score,
+		}, nil
+	}
+	return Host{}, ErrNotFound
+}
+
+func (d *memoryDefender) unban(ip string) error {
+	d.Lock()
+	defer d.Unlock()
+	_, isBanned := d.banned[ip]
+	_, hasScore := d.hosts[ip]
+	if !isBanned && !hasScore {
+		return ErrNotFound
+	}
+	delete(d.banned, ip)
+	delete(d.hosts, ip)
+	logger.Info(logSender, "", "host %#v unbanned", ip)
+	return nil
+}
+
+func (d *memoryDefender) getLists() Lists {
+	d.RLock()
+	defer d.RUnlock()
+	return Lists{
+		ConfigSafeList:   copyList(d.config.SafeList),
+		ConfigBlockList:  copyList(d.config.BlockList),
+		RuntimeSafeList:  copyList(d.runtimeSafeList),
+		RuntimeBlockList: copyList(d.runtimeBlockList),
+	}
+}
+
+func (d *memoryDefender) addListEntry(list, entry string) error {
+	if list != ListSafe && list != ListBlock {
+		return fmt.Errorf("invalid list %#v", list)
+	}
+	entry = strings.TrimSpace(entry)
+	parsed, err := parseIPList([]string{entry})
+	if err != nil || len(parsed) == 0 {
+		return fmt.Errorf("invalid list entry %#v", entry)
+	}
+	d.Lock()
+	defer d.Unlock()
+	if list == ListSafe {
+		if utils.IsStringInSlice(entry, d.runtimeSafeList) {
+			return nil
+		}
+		d.runtimeSafeList = append(d.runtimeSafeList, entry)
+		d.safeList = append(d.safeList, parsed[0])
+		for ip := range d.banned {
+			if parsed[0].Contains(net.ParseIP(ip)) {
+				delete(d.banned, ip)
+			}
+		}
+		for ip := range d.hosts {
+			if parsed[0].Contains(net.ParseIP(ip)) {
+				delete(d.hosts, ip)
+			}
+		}
+	} else {
+		if utils.IsStringInSlice(entry, d.runtimeBlockList) {
+			return nil
+		}
+		d.runtimeBlockList = append(d.runtimeBlockList, entry)
+		d.blockList = append(d.blockList, parsed[0])
+	}
+	logger.Info(logSender, "", "entry %#v added to the %v list", entry, list)
+	return nil
+}
+
+func (d *memoryDefender) removeListEntry(list, entry string) error {
+	if list != ListSafe && list != ListBlock {
+		return fmt.Errorf("invalid list %#v", list)
+	}
+	entry = strings.TrimSpace(entry)
+	d.Lock()
+	defer d.Unlock()
+	var runtimeList []string
+	if list == ListSafe {
+		runtimeList = d.runtimeSafeList
+	} else {
+		runtimeList = d.runtimeBlockList
+	}
+	if !utils.IsStringInSlice(entry, runtimeList) {
+		return ErrNotFound
+	}
+	var entries []string
+	for _, e := range runtimeList {
+		if e != entry {
+			entries = append(entries, e)
+		}
+	}
+	configList := d.config.SafeList
+	if list == ListBlock {
+		configList = d.config.BlockList
+	}
+	// the config entries are already validated
+	parsed, _ := parseIPList(append(copyList(configList), entries...))
+	if list == ListSafe {
+		d.runtimeSafeList = entries
+		d.safeList = parsed
+	} else {
+		d.runtimeBlockList = entries
+		d.blockList = parsed
+	}
+	logger.Info(logSender, "", "entry %#v removed from the %v list", entry, list)
+	return nil
+}
+
+// getHostScore returns the score within the observation window.
+// The caller must hold the lock
+func (d *memoryDefender) getHostScore(ip string) int {
+	score := 0
+	if hs, ok := d.hosts[ip]; ok {
+		for _, event := range hs.Events {
+			if event.dateTime.Add(time.Duration(d.config.ObservationTime) * time.Minute).After(time.Now()) {
+				score += event.score
+			}
+		}
+	}
+	return score
+}
+
+// cleanupBanned removes the expired bans and, if the hard limit is exceeded,
+// the bans that will expire sooner. The caller must hold the write lock
+func (d *memoryDefender) cleanupBanned() {
+	if len(d.banned) <= d.config.EntriesHardLimit {
+		return
+	}
+	kvList := make(kvList, 0, len(d.banned))
+	for k, v := range d.banned {
+		if v.Before(time.Now()) {
+			delete(d.banned, k)
+		} else {
+			kvList = append(kvList, kv{Key: k, Value: v.UnixNano()})
+		}
+	}
+	// we removed expired ip addresses, if any, above, this could be enough
+	numToRemove := len(d.banned) - d.config.EntriesSoftLimit
+	if numToRemove <= 0 {
+		return
+	}
+	sort.Sort(kvList)
+	for idx, kv := range kvList {
+		if idx >= numToRemove {
+			break
+		}
+		delete(d.banned, kv.Key)
+	}
+}
+
+// cleanupHosts removes the hosts without any event in the observation window and,
+// if the hard limit is exceeded, the hosts with the oldest events.
+// The caller must hold the write lock
+func (d *memoryDefender) cleanupHosts() {
+	if len(d.hosts) <= d.config.EntriesHardLimit {
+		return
+	}
+	kvList := make(kvList, 0, len(d.hosts))
+	for k, v := range d.hosts {
+		value := int64(0)
+		if len(v.Events) > 0 {
+			value = v.Events[len(v.Events)-1].dateTime.UnixNano()
+		}
+		if time.Unix(0, value).Add(time.Duration(d.config.ObservationTime) * time.Minute).Before(time.Now()) {
+			delete(d.hosts, k)
+		} else {
+			kvList = append(kvList, kv{Key: k, Value: value})
+		}
+	}
+	numToRemove := len(d.hosts) - d.config.EntriesSoftLimit
+	if numToRemove <= 0 {
+		return
+	}
+	sort.Sort(kvList)
+	for idx, kv := range kvList {
+		if idx >= numToRemove {
+			break
+		}
+		delete(d.hosts, kv.Key)
+	}
+}
+
+func parseIPList(list []string) ([]*net.IPNet, error) {
+	var result []*net.IPNet
+	for _, item := range list {
+		item = strings.TrimSpace(item)
+		if len(item) == 0 {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			if strings.Contains(item, ":") {
+				item += "/128"
+			} else {
+				item += "/32"
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, ipNet)
+	}
+	return result, nil
+}
+
+func isIPInList(ip net.IP, list []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range list {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyList(list []string) []string {
+	result := make([]string, len(list))
+	copy(result, list)
+	return result
+}
+
+type kv struct {
+	Key   string
+	Value int64
+}
+
+type kvList []kv
+
+func (p kvList) Len() int           { return len(p) }
+func (p kvList) Less(i, j int) bool { return p[i].Value < p[j].Value }
+func (p kvList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,414 @@
+package defender
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+func getTestConfig() Config {
+	return Config{
+		Enabled:          true,
+		BanTime:          10,
+		BanTimeIncrement: 50,
+		Threshold:        5,
+		ScoreInvalid:     2,
+		ScoreValid:       1,
+		ScoreNoAuth:      2,
+		ObservationTime:  15,
+		EntriesSoftLimit: 1,
+		EntriesHardLimit: 2,
+		SafeList:         []string{"192.168.1.1", "10.8.0.0/24"},
+		BlockList:        []string{"172.16.1.1/32", "::ffff:ac10:102"},
+	}
+}
+
+func TestInvalidConfig(t *testing.T) {
+	config := getTestConfig()
+	config.ScoreInvalid = config.Threshold
+	if err := Initialize(config); err == nil {
+		t.Error("score_invalid >= threshold must fail")
+	}
+	config = getTestConfig()
+	config.ScoreValid = config.Threshold + 1
+	if err := Initialize(config); err == nil {
+		t.Error("score_valid >= threshold must fail")
+	}
+	config = getTestConfig()
+	config.ScoreNoAuth = config.Threshold
+	if err := Initialize(config); err == nil {
+		t.Error("score_no_auth >= threshold must fail")
+	}
+	config = getTestConfig()
+	config.BanTime = 0
+	if err := Initialize(config); err == nil {
+		t.Error("invalid ban_time must fail")
+	}
+	config = getTestConfig()
+	config.BanTimeIncrement = 0
+	if err := Initialize(config); err == nil {
+		t.Error("invalid ban_time_increment must fail")
+	}
+	config = getTestConfig()
+	config.ObservationTime = 0
+	if err := Initialize(config); err == nil {
+		t.Error("invalid observation_time must fail")
+	}
+	config = getTestConfig()
+	config.EntriesSoftLimit = 0
+	if err := Initialize(config); err == nil {
+		t.Error("invalid entries_soft_limit must fail")
+	}
+	config = getTestConfig()
+	config.EntriesHardLimit = config.EntriesSoftLimit
+	if err := Initialize(config); err == nil {
+		t.Error("invalid entries_hard_limit must fail")
+	}
+	config = getTestConfig()
+	config.Driver = "unknown"
+	if err := Initialize(config); err == nil {
+		t.Error("invalid driver must fail")
+	}
+	config = getTestConfig()
+	config.SafeList = []string{"invalid ip"}
+	if err := Initialize(config); err == nil {
+		t.Error("invalid safe_list must fail")
+	}
+	config = getTestConfig()
+	config.BlockList = []string{"192.168.1.1/33"}
+	if err := Initialize(config); err == nil {
+		t.Error("invalid block_list must fail")
+	}
+	config.Enabled = false
+	if err := Initialize(config); err != nil {
+		t.Errorf("a disabled defender must not validate the config: %v", err)
+	}
+	if IsBanned("172.16.1.1") {
+		t.Error("a disabled defender must not ban")
+	}
+	AddEvent("127.0.0.1", HostEventLoginFailed)
+	if GetScore("127.0.0.1") != 0 || GetBanTime("127.0.0.1") != nil {
+		t.Error("a disabled defender must not track hosts")
+	}
+}
+
+func TestBanAndLists(t *testing.T) {
+	if err := Initialize(getTestConfig()); err != nil {
+		t.Fatalf("unable to initialize defender: %v", err)
+	}
+	defer Initialize(Config{})
+
+	if !IsBanned("172.16.1.1") || !IsBanned("172.16.1.2") {
+		t.Error("IP addresses inside the block list must be banned")
+	}
+	for i := 0; i < 10; i++ {
+		AddEvent("192.168.1.1", HostEventUserNotFound)
+		AddEvent("10.8.0.3", HostEventUserNotFound)
+	}
+	if IsBanned("192.168.1.1") || IsBanned("10.8.0.3") {
+		t.Error("IP addresses inside the safe list must not be banned")
+	}
+	ip := "127.0.0.1"
+	AddEvent(ip, HostEventLoginFailed)
+	AddEvent(ip, HostEventUserNotFound)
+	if GetScore(ip) != 3 {
+		t.Errorf("unexpected score: %v", GetScore(ip))
+	}
+	if IsBanned(ip) || GetBanTime(ip) != nil {
+		t.Error("the threshold is not reached, the IP must not be banned")
+	}
+	AddEvent(ip, HostEventNoLoginTried)
+	if !IsBanned(ip) {
+		t.Error("the threshold is reached, the IP must be banned")
+	}
+	if GetScore(ip) != 0 {
+		t.Errorf("a banned host must not have a score: %v", GetScore(ip))
+	}
+	banTime := GetBanTime(ip)
+	if banTime == nil {
+		t.Fatal("ban time must not be nil")
+	}
+	if !IsBanned(ip) {
+		t.Error("the IP must be still banned")
+	}
+	newBanTime := GetBanTime(ip)
+	if newBanTime == nil || newBanTime.Sub(*banTime) != 5*time.Minute {
+		t.Errorf("the ban time must be increased, old: %v new: %v", banTime, newBanTime)
+	}
+}
+
+func TestReloadLists(t *testing.T) {
+	config := getTestConfig()
+	if err := ReloadLists(config); err != nil {
+		t.Errorf("reloading the lists with the defender disabled must do nothing: %v", err)
+	}
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize defender: %v", err)
+	}
+	defer Initialize(Config{})
+
+	ip := "127.0.0.1"
+	AddEvent(ip, HostEventLoginFailed)
+	config.SafeList = []string{"127.0.0.0/8"}
+	config.BlockList = []string{"192.168.1.1"}
+	if err := ReloadLists(config); err != nil {
+		t.Errorf("unable to reload the lists: %v", err)
+	}
+	if GetScore(ip) != 1 {
+		t.Errorf("the scores must be preserved, current score: %v", GetScore(ip))
+	}
+	AddEvent(ip, HostEventUserNotFound)
+	if GetScore(ip) != 1 {
+		t.Errorf("the IP is inside the reloaded safe list, unexpected score: %v", GetScore(ip))
+	}
+	if IsBanned("172.16.1.1") || !IsBanned("192.168.1.1") {
+		t.Error("the reloaded block list must be used")
+	}
+	config.BlockList = []string{"invalid ip"}
+	if err := ReloadLists(config); err == nil {
+		t.Error("reloading an invalid block list must fail")
+	}
+	if !IsBanned("192.168.1.1") {
+		t.Error("the current lists must be kept if the new ones are invalid")
+	}
+	config.SafeList = []string{"invalid ip"}
+	if err := ReloadLists(config); err == nil {
+		t.Error("reloading an invalid safe list must fail")
+	}
+}
+
+func TestHostsAndRuntimeLists(t *testing.T) {
+	if _, err := GetHosts(); err != ErrNotEnabled {
+		t.Errorf("unexpected error with the defender disabled: %v", err)
+	}
+	if err := AddListEntry(ListBlock, "10.1.1.1"); err != ErrNotEnabled {
+		t.Errorf("unexpected error with the defender disabled: %v", err)
+	}
+	config := getTestConfig()
+	config.EntriesSoftLimit = 10
+	config.EntriesHardLimit = 20
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize defender: %v", err)
+	}
+	defer Initialize(Config{})
+
+	AddEvent("127.0.0.1", HostEventLoginFailed)
+	for i := 0; i < 3; i++ {
+		AddEvent("127.0.0.2", HostEventUserNotFound)
+	}
+	hosts, err := GetHosts()
+	if err != nil {
+		t.Fatalf("unable to get hosts: %v", err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("unexpected hosts: %+v", hosts)
+	}
+	if hosts[0].IP != "127.0.0.1" || hosts[0].Score != 1 || len(hosts[0].BanTime) > 0 {
+		t.Errorf("unexpected host: %+v", hosts[0])
+	}
+	if hosts[1].IP != "127.0.0.2" || hosts[1].Score != 0 || len(hosts[1].BanTime) == 0 {
+		t.Errorf("unexpected banned host: %+v", hosts[1])
+	}
+	host, err := GetHost("127.0.0.2")
+	if err != nil || len(host.BanTime) == 0 {
+		t.Errorf("unexpected host: %+v, error: %v", host, err)
+	}
+	if _, err = GetHost("127.0.0.3"); err != ErrNotFound {
+		t.Errorf("unexpected error for a missing host: %v", err)
+	}
+	if err = Unban("127.0.0.2"); err != nil {
+		t.Errorf("unable to unban host: %v", err)
+	}
+	if IsBanned("127.0.0.2") {
+		t.Error("the host must be unbanned")
+	}
+	if err = Unban("127.0.0.2"); err != ErrNotFound {
+		t.Errorf("unexpected error for a missing host: %v", err)
+	}
+	// adding an entry to the safe list removes the matching scores
+	if err = AddListEntry(ListSafe, "127.0.0.0/24"); err != nil {
+		t.Errorf("unable to add safe list entry: %v", err)
+	}
+	if GetScore("127.0.0.1") != 0 {
+		t.Errorf("the score must be removed, current score: %v", GetScore("127.0.0.1"))
+	}
+	if err = AddListEntry(ListBlock, "10.1.1.1"); err != nil {
+		t.Errorf("unable to add block list entry: %v", err)
+	}
+	if err = AddListEntry(ListBlock, "10.1.1.1"); err != nil {
+		t.Errorf("adding an existing entry must not fail: %v", err)
+	}
+	if err = AddListEntry(ListBlock, "invalid ip"); err == nil {
+		t.Error("adding an invalid entry must fail")
+	}
+	if err = AddListEntry("invalid", "10.1.1.2"); err == nil {
+		t.Error("adding an entry to an invalid list must fail")
+	}
+	if !IsBanned("10.1.1.1") {
+		t.Error("the IP inside the runtime block list must be banned")
+	}
+	// the runtime entries are preserved on reload
+	if err = ReloadLists(config); err != nil {
+		t.Errorf("unable to reload the lists: %v", err)
+	}
+	if !IsBanned("10.1.1.1") {
+		t.Error("the runtime block list must be preserved on reload")
+	}
+	lists, err := GetLists()
+	if err != nil {
+		t.Fatalf("unable to get lists: %v", err)
+	}
+	if len(lists.ConfigBlockList) != 2 || len(lists.RuntimeBlockList) != 1 || len(lists.RuntimeSafeList) != 1 {
+		t.Errorf("unexpected lists: %+v", lists)
+	}
+	if err = RemoveListEntry(ListBlock, "172.16.1.1/32"); err != ErrNotFound {
+		t.Errorf("the config entries cannot be removed: %v", err)
+	}
+	if err = RemoveListEntry(ListBlock, "10.1.1.1"); err != nil {
+		t.Errorf("unable to remove block list entry: %v", err)
+	}
+	if IsBanned("10.1.1.1") || !IsBanned("172.16.1.1") {
+		t.Error("only the removed entry must be unbanned")
+	}
+	if err = RemoveListEntry(ListSafe, "127.0.0.0/24"); err != nil {
+		t.Errorf("unable to remove safe list entry: %v", err)
+	}
+	AddEvent("127.0.0.1", HostEventLoginFailed)
+	AddEvent("10.8.0.3", HostEventLoginFailed)
+	if GetScore("127.0.0.1") != 1 || GetScore("10.8.0.3") != 0 {
+		t.Error("the safe list must be restored to the config entries")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	if err := Initialize(getTestConfig()); err != nil {
+		t.Fatalf("unable to initialize defender: %v", err)
+	}
+	defer Initialize(Config{})
+
+	defender := defender.(*memoryDefender)
+	for i := 1; i <= 3; i++ {
+		AddEvent(fmt.Sprintf("127.0.0.%v", i), HostEventLoginFailed)
+	}
+	if len(defender.hosts) != 1 {
+		t.Errorf("unexpected number of hosts: %v", len(defender.hosts))
+	}
+	if GetScore("127.0.0.3") != 1 {
+		t.Error("the newest host must be kept")
+	}
+	for i := 1; i <= 3; i++ {
+		ip := fmt.Sprintf("127.0.1.%v", i)
+		for j := 0; j < 3; j++ {
+			AddEvent(ip, HostEventUserNotFound)
+		}
+	}
+	if len(defender.banned) != 1 {
+		t.Errorf("unexpected number of banned hosts: %v", len(defender.banned))
+	}
+	if !IsBanned("127.0.1.3") {
+		t.Error("the latest ban must be kept")
+	}
+	// expired events and bans are removed
+	defender.Lock()
+	defender.banned["127.0.2.1"] = time.Now().Add(-1 * time.Minute)
+	defender.banned["127.0.2.2"] = time.Now().Add(-1 * time.Minute)
+	defender.cleanupBanned()
+	defender.Unlock()
+	if len(defender.banned) != 1 {
+		t.Errorf("unexpected number of banned hosts: %v", len(defender.banned))
+	}
+	if IsBanned("127.0.2.1") {
+		t.Error("an expired ban must be ignored")
+	}
+}
+
+func TestProviderDriver(t *testing.T) {
+	err := dataprovider.Initialize(dataprovider.Config{
+		Driver:          dataprovider.MemoryDataProviderName,
+		CredentialsPath: os.TempDir(),
+	}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the data provider: %v", err)
+	}
+	defer dataprovider.Close(dataprovider.GetProvider())
+
+	config := getTestConfig()
+	config.Driver = DriverProvider
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize defender: %v", err)
+	}
+	defer Initialize(Config{})
+
+	AddEvent("192.168.1.1", HostEventUserNotFound)
+	if GetScore("192.168.1.1") != 0 {
+		t.Error("a host inside the safe list must not be scored")
+	}
+	if !IsBanned("172.16.1.1") {
+		t.Error("a host inside the block list must be banned")
+	}
+	AddEvent("127.0.0.1", HostEventLoginFailed)
+	if GetScore("127.0.0.1") != 1 {
+		t.Errorf("unexpected score: %v", GetScore("127.0.0.1"))
+	}
+	host, err := GetHost("127.0.0.1")
+	if err != nil || host.Score != 1 || len(host.BanTime) > 0 {
+		t.Errorf("unexpected host: %+v, err: %v", host, err)
+	}
+	AddEvent("127.0.0.1", HostEventUserNotFound)
+	AddEvent("127.0.0.1", HostEventUserNotFound)
+	if GetBanTime("127.0.0.1") == nil || GetScore("127.0.0.1") != 0 {
+		t.Error("the host must be banned once the threshold is reached")
+	}
+	banTime := GetBanTime("127.0.0.1")
+	if !IsBanned("127.0.0.1") {
+		t.Error("the host must be banned")
+	}
+	if !GetBanTime("127.0.0.1").After(*banTime) {
+		t.Error("the ban time must be increased for a banned host trying to connect")
+	}
+	AddEvent("127.0.0.2", HostEventLoginFailed)
+	hosts, err := GetHosts()
+	if err != nil || len(hosts) != 2 {
+		t.Fatalf("unexpected hosts: %+v, err: %v", hosts, err)
+	}
+	if hosts[0].IP != "127.0.0.1" || len(hosts[0].BanTime) == 0 || hosts[1].IP != "127.0.0.2" || hosts[1].Score != 1 {
+		t.Errorf("unexpected hosts: %+v", hosts)
+	}
+	if err := Unban("127.0.0.1"); err != nil {
+		t.Errorf("unable to unban: %v", err)
+	}
+	if err := Unban("127.0.0.1"); err != ErrNotFound {
+		t.Errorf("unexpected unban error: %v", err)
+	}
+	if IsBanned("127.0.0.1") {
+		t.Error("the host must be unbanned")
+	}
+	if _, err := GetHost("127.0.0.1"); err != ErrNotFound {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// adding a safe list entry removes the matching hosts
+	if err := AddListEntry(ListSafe, "127.0.0.2"); err != nil {
+		t.Errorf("unable to add a safe list entry: %v", err)
+	}
+	if _, err := GetHost("127.0.0.2"); err != ErrNotFound {
+		t.Errorf("the host inside the safe list must be removed, err: %v", err)
+	}
+	// the expired bans are removed on cleanup
+	expired := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-time.Duration(config.ObservationTime+1) * time.Minute))
+	if err := dataprovider.SetDefenderBanTime(dataprovider.GetProvider(), "127.0.0.3", expired); err != nil {
+		t.Fatalf("unable to set the ban time: %v", err)
+	}
+	// the first event already triggered a cleanup
+	defender.(*providerDefender).lastCleanup = 0
+	AddEvent("127.0.0.4", HostEventLoginFailed)
+	if err := dataprovider.DeleteDefenderHost(dataprovider.GetProvider(), "127.0.0.3"); err == nil {
+		t.Error("the expired ban must be removed on cleanup")
+	}
+	if GetScore("127.0.0.4") != 1 {
+		t.Error("the hosts within the observation window must be kept on cleanup")
+	}
+}
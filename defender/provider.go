@@ -0,0 +1,176 @@
+package defender
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// providerDefender stores the hosts scores and the banned hosts in the data provider so
+// they are shared between multiple instances. The safe and block lists are handled in
+// memory by the embedded memoryDefender, its hosts and banned maps are not used
+type providerDefender struct {
+	*memoryDefender
+	// unix timestamp in nanoseconds, it must be accessed atomically
+	lastCleanup int64
+}
+
+func (d *providerDefender) isBanned(ip string) bool {
+	if d.isBlocked(ip) {
+		return true
+	}
+	_, err := dataprovider.IsDefenderHostBanned(dataprovider.GetProvider(), ip)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); !ok {
+			logger.Warn(logSender, "", "unable to check the ban for host %#v: %v", ip, err)
+		}
+		return false
+	}
+	increment := d.config.BanTime * d.config.BanTimeIncrement / 100
+	if increment == 0 {
+		increment++
+	}
+	if err = dataprovider.UpdateDefenderBanTime(dataprovider.GetProvider(), ip, increment); err != nil {
+		logger.Warn(logSender, "", "unable to increase the ban time for host %#v: %v", ip, err)
+	}
+	return true
+}
+
+func (d *providerDefender) addEvent(ip string, event HostEvent) {
+	score := d.getEventScore(ip, event)
+	if score <= 0 {
+		return
+	}
+	provider := dataprovider.GetProvider()
+	if err := dataprovider.AddDefenderEvent(provider, ip, score); err != nil {
+		logger.Warn(logSender, "", "unable to add an event for host %#v: %v", ip, err)
+		return
+	}
+	host, err := dataprovider.GetDefenderHostByIP(provider, ip, d.getObservationStart())
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the score for host %#v: %v", ip, err)
+		return
+	}
+	if host.Score >= d.config.Threshold {
+		logger.Info(logSender, "", "host %#v banned, score %v, threshold %v", ip, host.Score, d.config.Threshold)
+		banTime := time.Now().Add(time.Duration(d.config.BanTime) * time.Minute)
+		if err := dataprovider.SetDefenderBanTime(provider, ip, utils.GetTimeAsMsSinceEpoch(banTime)); err != nil {
+			logger.Warn(logSender, "", "unable to ban host %#v: %v", ip, err)
+		}
+	}
+	d.cleanup()
+}
+
+func (d *providerDefender) getBanTime(ip string) *time.Time {
+	host, err := dataprovider.IsDefenderHostBanned(dataprovider.GetProvider(), ip)
+	if err != nil {
+		return nil
+	}
+	banTime := utils.GetTimeFromMsecSinceEpoch(host.BanTime)
+	return &banTime
+}
+
+func (d *providerDefender) getScore(ip string) int {
+	host, err := dataprovider.GetDefenderHostByIP(dataprovider.GetProvider(), ip, d.getObservationStart())
+	if err != nil {
+		return 0
+	}
+	return host.Score
+}
+
+func (d *providerDefender) getHosts() ([]Host, error) {
+	entries, err := dataprovider.GetDefenderHosts(dataprovider.GetProvider(), d.getObservationStart(),
+		d.config.EntriesHardLimit)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Host, 0, len(entries))
+	for _, entry := range entries {
+		result = append(result, getHostFromEntry(entry))
+	}
+	return result, nil
+}
+
+func (d *providerDefender) getHost(ip string) (Host, error) {
+	entry, err := dataprovider.GetDefenderHostByIP(dataprovider.GetProvider(), ip, d.getObservationStart())
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			return Host{}, ErrNotFound
+		}
+		return Host{}, err
+	}
+	return getHostFromEntry(entry), nil
+}
+
+func (d *providerDefender) unban(ip string) error {
+	err := dataprovider.DeleteDefenderHost(dataprovider.GetProvider(), ip)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			return ErrNotFound
+		}
+		return err
+	}
+	logger.Info(logSender, "", "host %#v unbanned", ip)
+	return nil
+}
+
+func (d *providerDefender) addListEntry(list, entry string) error {
+	if err := d.memoryDefender.addListEntry(list, entry); err != nil {
+		return err
+	}
+	if list != ListSafe {
+		return nil
+	}
+	// the entry is already validated
+	parsed, _ := parseIPList([]string{entry})
+	hosts, err := d.getHosts()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to remove the hosts inside the safe list entry %#v: %v", entry, err)
+		return nil
+	}
+	for _, host := range hosts {
+		if parsed[0].Contains(net.ParseIP(host.IP)) {
+			if err := dataprovider.DeleteDefenderHost(dataprovider.GetProvider(), host.IP); err != nil {
+				logger.Warn(logSender, "", "unable to remove host %#v inside the safe list: %v", host.IP, err)
+			}
+		}
+	}
+	return nil
+}
+
+// getObservationStart returns the start of the observation window as unix timestamp in milliseconds
+func (d *providerDefender) getObservationStart() int64 {
+	return utils.GetTimeAsMsSinceEpoch(time.Now().Add(-time.Duration(d.config.ObservationTime) * time.Minute))
+}
+
+// cleanup removes the expired events and bans from the data provider, at most once per
+// observation time. Cleanups from different instances are harmless
+func (d *providerDefender) cleanup() {
+	lastCleanup := atomic.LoadInt64(&d.lastCleanup)
+	if time.Since(time.Unix(0, lastCleanup)) < time.Duration(d.config.ObservationTime)*time.Minute {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&d.lastCleanup, lastCleanup, time.Now().UnixNano()) {
+		return
+	}
+	from := d.getObservationStart()
+	err := dataprovider.CleanupDefender(dataprovider.GetProvider(), from)
+	logger.Debug(logSender, "", "defender entries before %v removed, err: %v", utils.GetTimeFromMsecSinceEpoch(from), err)
+}
+
+func getHostFromEntry(entry dataprovider.DefenderEntry) Host {
+	if entry.IsBanned() {
+		return Host{
+			IP:      entry.IP,
+			BanTime: utils.GetTimeFromMsecSinceEpoch(entry.BanTime).UTC().Format(time.RFC3339),
+		}
+	}
+	return Host{
+		IP:    entry.IP,
+		Score: entry.Score,
+	}
+}
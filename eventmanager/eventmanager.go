@@ -0,0 +1,409 @@
+// Package eventmanager runs the event rules defined inside the data provider.
+// The rules can be triggered on a cron like schedule, for example to run quota scans,
+// user expiration checks, folder cleanups and backups, or by filesystem events,
+// for example to execute a command when a "*.zip" file is uploaded
+package eventmanager
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender        = "eventmanager"
+	triggerSchedule  = "schedule"
+	triggerFsEvent   = "fs_event"
+	defaultTimeout   = 30 * time.Second
+	backupFilePrefix = "backup_"
+	maxRulesToLoad   = 500
+	backupTimeLayout = "20060102T150405"
+)
+
+var (
+	mutex         sync.RWMutex
+	dataProvider  dataprovider.Provider
+	scheduleRules []scheduledRule
+	fsRules       []dataprovider.EventRule
+	// names of the rules with a scheduled action in progress
+	runningRules  map[string]bool
+	schedulerOnce sync.Once
+)
+
+type scheduledRule struct {
+	rule     dataprovider.EventRule
+	schedule *utils.CronSchedule
+}
+
+// eventParams defines the details of the event that triggered a rule.
+// They are sent as JSON for the HTTP actions and as environment variables for the commands
+type eventParams struct {
+	Rule       string `json:"rule"`
+	Trigger    string `json:"trigger"`
+	Action     string `json:"action,omitempty"`
+	Username   string `json:"username,omitempty"`
+	Path       string `json:"path,omitempty"`
+	TargetPath string `json:"target_path,omitempty"`
+	SSHCmd     string `json:"ssh_cmd,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	Timestamp  int64  `json:"timestamp"`
+}
+
+func (p *eventParams) getEnvironment() []string {
+	return []string{
+		fmt.Sprintf("SFTPGO_EVENT_RULE=%v", p.Rule),
+		fmt.Sprintf("SFTPGO_EVENT_TRIGGER=%v", p.Trigger),
+		fmt.Sprintf("SFTPGO_EVENT_ACTION=%v", p.Action),
+		fmt.Sprintf("SFTPGO_EVENT_USERNAME=%v", p.Username),
+		fmt.Sprintf("SFTPGO_EVENT_PATH=%v", p.Path),
+		fmt.Sprintf("SFTPGO_EVENT_TARGET=%v", p.TargetPath),
+		fmt.Sprintf("SFTPGO_EVENT_SSH_CMD=%v", p.SSHCmd),
+		fmt.Sprintf("SFTPGO_EVENT_FILE_SIZE=%v", p.FileSize),
+	}
+}
+
+// Initialize loads the event rules from the given provider, starts the scheduler
+// and registers the handler for the filesystem events
+func Initialize(p dataprovider.Provider) error {
+	mutex.Lock()
+	dataProvider = p
+	if runningRules == nil {
+		runningRules = make(map[string]bool)
+	}
+	mutex.Unlock()
+	if err := ReloadRules(); err != nil {
+		return err
+	}
+	sftpd.SetFsEventHandler(handleFsEvent)
+	schedulerOnce.Do(func() {
+		go startScheduler()
+	})
+	return nil
+}
+
+// ReloadRules loads the enabled event rules from the data provider.
+// It must be called after adding, updating or deleting a rule
+func ReloadRules() error {
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	if p == nil {
+		return nil
+	}
+	var scheduled []scheduledRule
+	var fsTriggered []dataprovider.EventRule
+	offset := 0
+	for {
+		rules, err := dataprovider.GetEventRules(p, maxRulesToLoad, offset, "ASC", "")
+		if err != nil {
+			logger.Warn(logSender, "", "unable to load event rules: %v", err)
+			return err
+		}
+		for _, rule := range rules {
+			if rule.Status != 1 {
+				continue
+			}
+			switch rule.Trigger {
+			case dataprovider.EventTriggerSchedule:
+				schedule, err := utils.ParseCronSchedule(rule.Conditions.Schedule)
+				if err != nil {
+					logger.Warn(logSender, "", "unable to parse the schedule for rule %#v: %v", rule.Name, err)
+					continue
+				}
+				scheduled = append(scheduled, scheduledRule{rule: rule, schedule: schedule})
+			case dataprovider.EventTriggerFsEvent:
+				fsTriggered = append(fsTriggered, rule)
+			}
+		}
+		if len(rules) < maxRulesToLoad {
+			break
+		}
+		offset += len(rules)
+	}
+	mutex.Lock()
+	scheduleRules = scheduled
+	fsRules = fsTriggered
+	mutex.Unlock()
+	logger.Debug(logSender, "", "event rules loaded, scheduled: %v, filesystem events: %v", len(scheduled),
+		len(fsTriggered))
+	return nil
+}
+
+func startScheduler() {
+	for {
+		now := time.Now()
+		next := now.Truncate(time.Minute).Add(time.Minute)
+		time.Sleep(next.Sub(now))
+		// the rules are reloaded to pick up the changes made by other instances sharing the data provider
+		ReloadRules()
+		checkScheduledRules(next)
+	}
+}
+
+func checkScheduledRules(t time.Time) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, r := range scheduleRules {
+		if r.schedule.Matches(t) {
+			go runScheduledRule(r.rule, t)
+		}
+	}
+}
+
+func runScheduledRule(rule dataprovider.EventRule, t time.Time) {
+	mutex.Lock()
+	if runningRules[rule.Name] {
+		mutex.Unlock()
+		logger.Info(logSender, "", "rule %#v not executed, the previous run is still in progress", rule.Name)
+		return
+	}
+	runningRules[rule.Name] = true
+	mutex.Unlock()
+
+	defer func() {
+		mutex.Lock()
+		delete(runningRules, rule.Name)
+		mutex.Unlock()
+	}()
+
+	params := eventParams{
+		Rule:      rule.Name,
+		Trigger:   triggerSchedule,
+		Timestamp: utils.GetTimeAsMsSinceEpoch(t),
+	}
+	startTime := time.Now()
+	err := executeRuleAction(rule, params)
+	logger.Debug(logSender, "", "scheduled rule %#v executed, action type: %v, elapsed: %v, error: %v", rule.Name,
+		rule.Action.Type, time.Since(startTime), err)
+}
+
+func handleFsEvent(operation, username, path, target, sshCmd string, fileSize int64) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, rule := range fsRules {
+		if rule.MatchesFsEvent(operation, username, path) {
+			params := eventParams{
+				Rule:       rule.Name,
+				Trigger:    triggerFsEvent,
+				Action:     operation,
+				Username:   username,
+				Path:       path,
+				TargetPath: target,
+				SSHCmd:     sshCmd,
+				FileSize:   fileSize,
+				Timestamp:  utils.GetTimeAsMsSinceEpoch(time.Now()),
+			}
+			go func(rule dataprovider.EventRule) {
+				err := executeRuleAction(rule, params)
+				logger.Debug(logSender, "", "rule %#v executed for operation %#v, user %#v, path %#v, error: %v",
+					rule.Name, operation, username, path, err)
+			}(rule)
+		}
+	}
+}
+
+func executeRuleAction(rule dataprovider.EventRule, params eventParams) error {
+	switch rule.Action.Type {
+	case dataprovider.EventActionCommand:
+		return executeCommand(rule.Action, params)
+	case dataprovider.EventActionHTTP:
+		return executeHTTPNotification(rule.Action, params)
+	case dataprovider.EventActionQuotaScan:
+		return executeQuotaScans(rule.Conditions.Usernames)
+	case dataprovider.EventActionUserExpirationCheck:
+		return executeUserExpirationCheck(rule.Conditions.Usernames)
+	case dataprovider.EventActionFolderCleanup:
+		return executeFolderCleanup(rule.Action)
+	case dataprovider.EventActionBackup:
+		return executeBackup(rule)
+	case dataprovider.EventActionDataRetention:
+		return executeDataRetention(rule.Conditions.Usernames, rule.Action)
+	}
+	return fmt.Errorf("unsupported action type: %v", rule.Action.Type)
+}
+
+func getActionTimeout(action dataprovider.EventAction) time.Duration {
+	if action.Timeout > 0 {
+		return time.Duration(action.Timeout) * time.Second
+	}
+	return defaultTimeout
+}
+
+func executeCommand(action dataprovider.EventAction, params eventParams) error {
+	ctx, cancel := context.WithTimeout(context.Background(), getActionTimeout(action))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, action.Command)
+	cmd.Env = append(os.Environ(), params.getEnvironment()...)
+	startTime := time.Now()
+	err := cmd.Run()
+	logger.Debug(logSender, "", "executed command %#v for rule %#v, elapsed: %v, error: %v", action.Command,
+		params.Rule, time.Since(startTime), err)
+	return err
+}
+
+func executeHTTPNotification(action dataprovider.EventAction, params eventParams) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{
+		Timeout: getActionTimeout(action),
+	}
+	startTime := time.Now()
+	resp, err := httpClient.Post(action.HTTPURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		logger.Warn(logSender, "", "unable to notify rule %#v to URL %v: %v", params.Rule, action.HTTPURL, err)
+		return err
+	}
+	defer resp.Body.Close()
+	logger.Debug(logSender, "", "notified rule %#v to URL %v, status code: %v, elapsed: %v", params.Rule,
+		action.HTTPURL, resp.StatusCode, time.Since(startTime))
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+// getRuleUsers returns the users with the given usernames or all the users if no usernames are given
+func getRuleUsers(usernames []string) ([]dataprovider.User, error) {
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	if len(usernames) == 0 {
+		return dataprovider.DumpUsers(p)
+	}
+	var users []dataprovider.User
+	for _, username := range usernames {
+		user, err := dataprovider.UserExists(p, username)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get user %#v: %v", username, err)
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+// executeQuotaScans scans the given users, if no user is given all the users with a quota are scanned
+func executeQuotaScans(usernames []string) error {
+	users, err := getRuleUsers(usernames)
+	if err != nil {
+		return err
+	}
+	for _, user := range users {
+		if len(usernames) == 0 && user.QuotaSize == 0 && user.QuotaFiles == 0 {
+			continue
+		}
+		if !sftpd.AddQuotaScan(user.Username) {
+			logger.Info(logSender, "", "another quota scan is already in progress for user %#v", user.Username)
+			continue
+		}
+		if err = doQuotaScan(user); err != nil {
+			logger.Warn(logSender, "", "quota scan failed for user %#v: %v", user.Username, err)
+		}
+	}
+	return nil
+}
+
+func doQuotaScan(user dataprovider.User) error {
+	defer sftpd.RemoveQuotaScan(user.Username)
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		return err
+	}
+	defer fs.Close()
+	numFiles, size, err := fs.ScanRootDirContents()
+	if err != nil {
+		return err
+	}
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	return dataprovider.UpdateUserQuota(p, user, numFiles, size, true)
+}
+
+// executeUserExpirationCheck disables the active users whose account is expired
+func executeUserExpirationCheck(usernames []string) error {
+	users, err := getRuleUsers(usernames)
+	if err != nil {
+		return err
+	}
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	now := utils.GetTimeAsMsSinceEpoch(time.Now())
+	for _, user := range users {
+		if user.Status != 1 || user.ExpirationDate == 0 || user.ExpirationDate > now {
+			continue
+		}
+		user.Status = 0
+		err = dataprovider.UpdateUser(p, user)
+		logger.Info(logSender, "", "expired user %#v disabled, error: %v", user.Username, err)
+	}
+	return nil
+}
+
+// executeFolderCleanup removes the files older than the configured retention, the directories are preserved
+func executeFolderCleanup(action dataprovider.EventAction) error {
+	limit := time.Now().Add(-time.Duration(action.RetentionHours) * time.Hour)
+	var lastErr error
+	for _, dirPath := range action.Paths {
+		numRemoved := 0
+		err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || !info.ModTime().Before(limit) {
+				return nil
+			}
+			if err := os.Remove(path); err != nil {
+				logger.Warn(logSender, "", "unable to remove %#v: %v", path, err)
+				return nil
+			}
+			numRemoved++
+			return nil
+		})
+		logger.Debug(logSender, "", "folder %#v cleaned, removed files: %v, error: %v", dirPath, numRemoved, err)
+		if err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// executeBackup dumps the data provider inside the configured backup path.
+// The rule ID is used inside the file name, the rule names could contain path separators
+func executeBackup(rule dataprovider.EventRule) error {
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	backup, err := dataprovider.DumpData(p)
+	if err != nil {
+		return err
+	}
+	dump, err := json.Marshal(backup)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(rule.Action.BackupPath, 0700); err != nil {
+		return err
+	}
+	outputFile := filepath.Join(rule.Action.BackupPath, fmt.Sprintf("%v%v_%v.json", backupFilePrefix, rule.ID,
+		time.Now().Format(backupTimeLayout)))
+	err = ioutil.WriteFile(outputFile, dump, 0600)
+	logger.Debug(logSender, "", "backup saved to %#v, error: %v", outputFile, err)
+	return err
+}
@@ -0,0 +1,422 @@
+package eventmanager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+func TestCronSchedule(t *testing.T) {
+	invalidSpecs := []string{"", "* * * *", "* * * * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "* * * 13 *",
+		"* * * * 8", "*/0 * * * *", "5-1 * * * *", "a * * * *", "1-a * * * *", "*/a * * * *"}
+	for _, spec := range invalidSpecs {
+		if _, err := utils.ParseCronSchedule(spec); err == nil {
+			t.Errorf("cron expression %#v must be invalid", spec)
+		}
+	}
+	// Monday 2 March 2020 03:30
+	monday := time.Date(2020, time.March, 2, 3, 30, 0, 0, time.UTC)
+	sunday := time.Date(2020, time.March, 1, 3, 30, 0, 0, time.UTC)
+	testCases := []struct {
+		spec    string
+		t       time.Time
+		matches bool
+	}{
+		{"* * * * *", monday, true},
+		{"30 3 * * *", monday, true},
+		{"31 3 * * *", monday, false},
+		{"*/15 * * * *", monday, true},
+		{"*/20 * * * *", monday, false},
+		{"10/20 * * * *", monday, true},
+		{"0,30 1-3 * * *", monday, true},
+		{"30 3 * * 1-5", monday, true},
+		{"30 3 * * 1-5", sunday, false},
+		{"30 3 * * 0", sunday, true},
+		{"30 3 * * 7", sunday, true},
+		{"30 3 * 2 *", monday, false},
+		{"30 3 2 3 *", monday, true},
+		// the day of month and the day of week are in OR if both are restricted
+		{"30 3 15 * 1", monday, true},
+		{"30 3 15 * 2", monday, false},
+	}
+	for _, tc := range testCases {
+		schedule, err := utils.ParseCronSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("unable to parse cron expression %#v: %v", tc.spec, err)
+			continue
+		}
+		if schedule.Matches(tc.t) != tc.matches {
+			t.Errorf("unexpected match result for %#v and %v, expected: %v", tc.spec, tc.t, tc.matches)
+		}
+	}
+}
+
+func TestFsRuleMatching(t *testing.T) {
+	rule := dataprovider.EventRule{
+		Name:    "rule",
+		Status:  1,
+		Trigger: dataprovider.EventTriggerFsEvent,
+		Conditions: dataprovider.EventConditions{
+			FsEvents:  []string{"upload", "rename"},
+			Patterns:  []string{"*.zip", "*.tar.gz"},
+			Usernames: []string{"user1"},
+		},
+	}
+	if !rule.MatchesFsEvent("upload", "user1", "/dir/file.zip") {
+		t.Error("the upload must match")
+	}
+	if !rule.MatchesFsEvent("rename", "user1", "/dir/file.tar.gz") {
+		t.Error("the rename must match")
+	}
+	if rule.MatchesFsEvent("download", "user1", "/dir/file.zip") {
+		t.Error("the download must not match")
+	}
+	if rule.MatchesFsEvent("upload", "user2", "/dir/file.zip") {
+		t.Error("the upload for a different user must not match")
+	}
+	if rule.MatchesFsEvent("upload", "user1", "/dir.zip/file.txt") {
+		t.Error("the patterns must be matched against the file name")
+	}
+	rule.Conditions.Patterns = nil
+	rule.Conditions.Usernames = nil
+	if !rule.MatchesFsEvent("upload", "user2", "/file.txt") {
+		t.Error("the upload must match without patterns and usernames")
+	}
+	rule.Status = 0
+	if rule.MatchesFsEvent("upload", "user2", "/file.txt") {
+		t.Error("a disabled rule must not match")
+	}
+}
+
+func TestFolderCleanup(t *testing.T) {
+	dirPath := filepath.Join(os.TempDir(), "eventmanager_cleanup")
+	os.RemoveAll(dirPath)
+	subDir := filepath.Join(dirPath, "sub")
+	if err := os.MkdirAll(subDir, 0700); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	defer os.RemoveAll(dirPath)
+	oldFile := filepath.Join(subDir, "old.txt")
+	newFile := filepath.Join(dirPath, "new.txt")
+	for _, f := range []string{oldFile, newFile} {
+		if err := ioutil.WriteFile(f, []byte("data"), 0600); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	oldTime := time.Now().Add(-3 * time.Hour)
+	if err := os.Chtimes(oldFile, oldTime, oldTime); err != nil {
+		t.Fatalf("unable to change file times: %v", err)
+	}
+	err := executeFolderCleanup(dataprovider.EventAction{
+		Type:           dataprovider.EventActionFolderCleanup,
+		Paths:          []string{dirPath},
+		RetentionHours: 2,
+	})
+	if err != nil {
+		t.Errorf("unexpected cleanup error: %v", err)
+	}
+	if _, err = os.Stat(oldFile); !os.IsNotExist(err) {
+		t.Error("the old file must be removed")
+	}
+	if _, err = os.Stat(newFile); err != nil {
+		t.Errorf("the new file must be preserved: %v", err)
+	}
+	if _, err = os.Stat(subDir); err != nil {
+		t.Errorf("the directories must be preserved: %v", err)
+	}
+	err = executeFolderCleanup(dataprovider.EventAction{
+		Type:           dataprovider.EventActionFolderCleanup,
+		Paths:          []string{filepath.Join(dirPath, "missing")},
+		RetentionHours: 2,
+	})
+	if err == nil {
+		t.Error("cleaning a missing folder must fail")
+	}
+}
+
+func TestCommandAction(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	outputFile := filepath.Join(os.TempDir(), "eventmanager_cmd_output")
+	scriptPath := filepath.Join(os.TempDir(), "eventmanager_cmd.sh")
+	os.Remove(outputFile)
+	script := "#!/bin/sh\n\necho \"$SFTPGO_EVENT_RULE $SFTPGO_EVENT_TRIGGER $SFTPGO_EVENT_ACTION " +
+		"$SFTPGO_EVENT_USERNAME $SFTPGO_EVENT_PATH\" > " + outputFile + "\n"
+	if err := ioutil.WriteFile(scriptPath, []byte(script), 0755); err != nil {
+		t.Fatalf("unable to write script: %v", err)
+	}
+	defer os.Remove(scriptPath)
+	defer os.Remove(outputFile)
+
+	mutex.Lock()
+	fsRules = []dataprovider.EventRule{
+		{
+			Name:    "zip_upload",
+			Status:  1,
+			Trigger: dataprovider.EventTriggerFsEvent,
+			Conditions: dataprovider.EventConditions{
+				FsEvents: []string{"upload"},
+				Patterns: []string{"*.zip"},
+			},
+			Action: dataprovider.EventAction{
+				Type:    dataprovider.EventActionCommand,
+				Command: scriptPath,
+			},
+		},
+	}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		fsRules = nil
+		mutex.Unlock()
+	}()
+
+	handleFsEvent("upload", "user", "/file.txt", "", "", 10)
+	handleFsEvent("upload", "user", "/dir/file.zip", "", "", 10)
+	expected := "zip_upload fs_event upload user /dir/file.zip"
+	for i := 0; i < 50; i++ {
+		content, err := ioutil.ReadFile(outputFile)
+		if err == nil && strings.TrimSpace(string(content)) == expected {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Errorf("the command was not executed as expected")
+}
+
+func TestHTTPAction(t *testing.T) {
+	received := make(chan eventParams, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params eventParams
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if params.Rule == "fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- params
+	}))
+	defer server.Close()
+
+	action := dataprovider.EventAction{
+		Type:    dataprovider.EventActionHTTP,
+		HTTPURL: server.URL,
+		Timeout: 5,
+	}
+	err := executeHTTPNotification(action, eventParams{Rule: "rule", Trigger: triggerSchedule})
+	if err != nil {
+		t.Errorf("unexpected notification error: %v", err)
+	}
+	select {
+	case params := <-received:
+		if params.Rule != "rule" || params.Trigger != triggerSchedule {
+			t.Errorf("unexpected notification: %+v", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("notification not received")
+	}
+	err = executeHTTPNotification(action, eventParams{Rule: "fail", Trigger: triggerSchedule})
+	if err == nil {
+		t.Error("an unexpected status code must fail")
+	}
+	server.Close()
+	err = executeHTTPNotification(action, eventParams{Rule: "rule", Trigger: triggerSchedule})
+	if err == nil {
+		t.Error("notifying a closed server must fail")
+	}
+}
+
+func TestScheduledRules(t *testing.T) {
+	received := make(chan eventParams, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var params eventParams
+		json.NewDecoder(r.Body).Decode(&params)
+		received <- params
+	}))
+	defer server.Close()
+
+	hourly, err := utils.ParseCronSchedule("0 * * * *")
+	if err != nil {
+		t.Fatalf("unable to parse cron expression: %v", err)
+	}
+	daily, err := utils.ParseCronSchedule("0 3 * * *")
+	if err != nil {
+		t.Fatalf("unable to parse cron expression: %v", err)
+	}
+	action := dataprovider.EventAction{
+		Type:    dataprovider.EventActionHTTP,
+		HTTPURL: server.URL,
+	}
+	mutex.Lock()
+	if runningRules == nil {
+		runningRules = make(map[string]bool)
+	}
+	scheduleRules = []scheduledRule{
+		{rule: dataprovider.EventRule{Name: "hourly", Action: action}, schedule: hourly},
+		{rule: dataprovider.EventRule{Name: "daily", Action: action}, schedule: daily},
+	}
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		scheduleRules = nil
+		mutex.Unlock()
+	}()
+
+	checkScheduledRules(time.Date(2020, time.March, 2, 10, 0, 0, 0, time.Local))
+	select {
+	case params := <-received:
+		if params.Rule != "hourly" || params.Trigger != triggerSchedule {
+			t.Errorf("unexpected notification: %+v", params)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("notification not received")
+	}
+	select {
+	case params := <-received:
+		t.Errorf("unexpected notification: %+v", params)
+	case <-time.After(200 * time.Millisecond):
+	}
+	// a rule still in progress is not executed again
+	mutex.Lock()
+	runningRules["hourly"] = true
+	mutex.Unlock()
+	checkScheduledRules(time.Date(2020, time.March, 2, 10, 0, 0, 0, time.Local))
+	select {
+	case params := <-received:
+		t.Errorf("unexpected notification: %+v", params)
+	case <-time.After(200 * time.Millisecond):
+	}
+	mutex.Lock()
+	delete(runningRules, "hourly")
+	mutex.Unlock()
+}
+
+func TestRetentionCheckValidation(t *testing.T) {
+	invalidChecks := []dataprovider.RetentionCheck{
+		{},
+		{Folders: []dataprovider.FolderRetention{{Path: "", Retention: 1}}},
+		{Folders: []dataprovider.FolderRetention{{Path: "/", Retention: -1}}},
+		{Folders: []dataprovider.FolderRetention{{Path: "/", Retention: 0}}},
+		{Folders: []dataprovider.FolderRetention{{Path: "/dir", Retention: 1}, {Path: "dir/", Retention: 2}}},
+		{Folders: []dataprovider.FolderRetention{{Path: "/", Retention: 1}}, HTTPURL: "ftp://127.0.0.1"},
+	}
+	for _, check := range invalidChecks {
+		if err := check.Validate(); err == nil {
+			t.Errorf("retention check %+v must be invalid", check)
+		}
+	}
+	check := dataprovider.RetentionCheck{
+		Folders: []dataprovider.FolderRetention{{Path: "dir/sub/", Retention: 1}, {Path: "/dir", Retention: 0}},
+	}
+	if err := check.Validate(); err != nil {
+		t.Errorf("unexpected validation error: %v", err)
+	}
+	if check.Folders[0].Path != "/dir/sub" {
+		t.Errorf("the folder path must be cleaned, actual: %#v", check.Folders[0].Path)
+	}
+}
+
+func TestRetentionCheck(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "eventmanager_retention")
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	for _, dir := range []string{"keep", filepath.Join("sub", "empty"), "new"} {
+		if err := os.MkdirAll(filepath.Join(homeDir, dir), 0700); err != nil {
+			t.Fatalf("unable to create dir: %v", err)
+		}
+	}
+	oldTime := time.Now().Add(-3 * time.Hour)
+	oldFiles := []string{"old.txt", filepath.Join("sub", "old.txt"), filepath.Join("keep", "old.txt")}
+	for _, f := range append(oldFiles, filepath.Join("new", "new.txt")) {
+		p := filepath.Join(homeDir, f)
+		if err := ioutil.WriteFile(p, []byte("data"), 0600); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+		if utils.IsStringInSlice(f, oldFiles) {
+			if err := os.Chtimes(p, oldTime, oldTime); err != nil {
+				t.Fatalf("unable to change file times: %v", err)
+			}
+		}
+	}
+	received := make(chan RetentionReport, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var report RetentionReport
+		json.NewDecoder(r.Body).Decode(&report)
+		received <- report
+	}))
+	defer server.Close()
+
+	user := dataprovider.User{
+		Username: "retention_user",
+		HomeDir:  homeDir,
+	}
+	check := dataprovider.RetentionCheck{
+		Folders: []dataprovider.FolderRetention{
+			{Path: "/", Retention: 2, DeleteEmptyDirs: true},
+			{Path: "/keep", Retention: 0},
+		},
+		HTTPURL: server.URL,
+	}
+	report := doRetentionCheck(user, check)
+	if len(report.Folders) != 1 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	folderReport := report.Folders[0]
+	if folderReport.DeletedFiles != 2 || folderReport.DeletedSize != 8 || folderReport.DeletedDirs != 2 ||
+		len(folderReport.Error) > 0 {
+		t.Errorf("unexpected folder report: %+v", folderReport)
+	}
+	for _, p := range []string{"old.txt", "sub"} {
+		if _, err := os.Stat(filepath.Join(homeDir, p)); !os.IsNotExist(err) {
+			t.Errorf("%#v must be removed", p)
+		}
+	}
+	for _, p := range []string{filepath.Join("keep", "old.txt"), filepath.Join("new", "new.txt")} {
+		if _, err := os.Stat(filepath.Join(homeDir, p)); err != nil {
+			t.Errorf("%#v must be preserved: %v", p, err)
+		}
+	}
+	select {
+	case notified := <-received:
+		if notified.Username != user.Username || len(notified.Folders) != 1 ||
+			notified.Folders[0].DeletedFiles != 2 {
+			t.Errorf("unexpected notified report: %+v", notified)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("report not notified")
+	}
+	// a missing folder is not an error
+	check = dataprovider.RetentionCheck{
+		Folders: []dataprovider.FolderRetention{{Path: "/missing", Retention: 2}},
+	}
+	report = doRetentionCheck(user, check)
+	if len(report.Folders) != 1 || len(report.Folders[0].Error) > 0 {
+		t.Errorf("unexpected report: %+v", report)
+	}
+	if !addRetentionCheck(user.Username) {
+		t.Error("unable to add the retention check")
+	}
+	if addRetentionCheck(user.Username) {
+		t.Error("a duplicate retention check must fail")
+	}
+	if len(GetRetentionChecks()) != 1 {
+		t.Errorf("unexpected retention checks: %+v", GetRetentionChecks())
+	}
+	removeRetentionCheck(user.Username)
+	if len(GetRetentionChecks()) != 0 {
+		t.Errorf("unexpected retention checks: %+v", GetRetentionChecks())
+	}
+}
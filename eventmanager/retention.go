@@ -0,0 +1,280 @@
+package eventmanager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var (
+	// ErrRetentionCheckInProgress is returned if a data retention check is already running for a user
+	ErrRetentionCheckInProgress = errors.New("another retention check is already in progress")
+	// usernames with a data retention check in progress
+	retentionChecks = make(map[string]ActiveRetentionCheck)
+)
+
+// ActiveRetentionCheck defines a data retention check in progress
+type ActiveRetentionCheck struct {
+	Username string `json:"username"`
+	// check start time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+}
+
+// FolderRetentionReport defines what was deleted inside a folder
+type FolderRetentionReport struct {
+	Path         string `json:"path"`
+	Retention    int    `json:"retention"`
+	DeletedFiles int    `json:"deleted_files"`
+	DeletedSize  int64  `json:"deleted_size"`
+	DeletedDirs  int    `json:"deleted_dirs"`
+	Error        string `json:"error,omitempty"`
+}
+
+// RetentionReport defines the result of a data retention check
+type RetentionReport struct {
+	Username string `json:"username"`
+	// check start time as unix timestamp in milliseconds
+	StartTime int64 `json:"start_time"`
+	// elapsed time in milliseconds
+	Elapsed int64                   `json:"elapsed"`
+	Folders []FolderRetentionReport `json:"folders"`
+}
+
+// GetRetentionChecks returns the data retention checks in progress
+func GetRetentionChecks() []ActiveRetentionCheck {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	checks := make([]ActiveRetentionCheck, 0, len(retentionChecks))
+	for _, c := range retentionChecks {
+		checks = append(checks, c)
+	}
+	return checks
+}
+
+// StartRetentionCheck validates the given check and starts it in background for the given user.
+// The report is notified to the check URL, if any
+func StartRetentionCheck(username string, check dataprovider.RetentionCheck) error {
+	if err := check.Validate(); err != nil {
+		return err
+	}
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	user, err := dataprovider.GetUserWithGroupSettings(p, username)
+	if err != nil {
+		return err
+	}
+	if !addRetentionCheck(user.Username) {
+		return ErrRetentionCheckInProgress
+	}
+	go func() {
+		defer removeRetentionCheck(user.Username)
+		doRetentionCheck(user, check)
+	}()
+	return nil
+}
+
+func addRetentionCheck(username string) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := retentionChecks[username]; ok {
+		return false
+	}
+	retentionChecks[username] = ActiveRetentionCheck{
+		Username:  username,
+		StartTime: utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	return true
+}
+
+func removeRetentionCheck(username string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(retentionChecks, username)
+}
+
+// executeDataRetention applies the rule data retention policies to the given users,
+// if no user is given the policies are applied to all the users
+func executeDataRetention(usernames []string, action dataprovider.EventAction) error {
+	mutex.RLock()
+	p := dataProvider
+	mutex.RUnlock()
+	users, err := getRuleUsers(usernames)
+	if err != nil {
+		return err
+	}
+	check := dataprovider.RetentionCheck{
+		Folders: action.Retention,
+		HTTPURL: action.HTTPURL,
+	}
+	for _, u := range users {
+		user, err := dataprovider.GetUserWithGroupSettings(p, u.Username)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to get user %#v for the retention check: %v", u.Username, err)
+			continue
+		}
+		if !addRetentionCheck(user.Username) {
+			logger.Info(logSender, "", "another retention check is already in progress for user %#v", user.Username)
+			continue
+		}
+		doRetentionCheck(user, check)
+		removeRetentionCheck(user.Username)
+	}
+	return nil
+}
+
+func doRetentionCheck(user dataprovider.User, check dataprovider.RetentionCheck) RetentionReport {
+	startTime := time.Now()
+	report := RetentionReport{
+		Username:  user.Username,
+		StartTime: utils.GetTimeAsMsSinceEpoch(startTime),
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		logger.Warn(logSender, "", "unable to get the filesystem for the retention check, user %#v: %v",
+			user.Username, err)
+		for _, folder := range check.Folders {
+			report.Folders = append(report.Folders, FolderRetentionReport{
+				Path:      folder.Path,
+				Retention: folder.Retention,
+				Error:     err.Error(),
+			})
+		}
+	} else {
+		mutex.RLock()
+		p := dataProvider
+		mutex.RUnlock()
+		checker := retentionChecker{
+			p:       p,
+			user:    user,
+			fs:      fs,
+			folders: check.Folders,
+		}
+		for _, folder := range check.Folders {
+			if folder.Retention == 0 {
+				continue
+			}
+			report.Folders = append(report.Folders, checker.checkFolder(folder))
+		}
+		fs.Close()
+	}
+	report.Elapsed = time.Since(startTime).Nanoseconds() / 1000000
+	logger.Info(logSender, "", "retention check completed for user %#v, elapsed: %v ms", user.Username, report.Elapsed)
+	if len(check.HTTPURL) > 0 {
+		notifyRetentionReport(check.HTTPURL, report)
+	}
+	return report
+}
+
+func notifyRetentionReport(notificationURL string, report RetentionReport) {
+	body, err := json.Marshal(report)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to serialize the retention report for user %#v: %v", report.Username, err)
+		return
+	}
+	httpClient := &http.Client{
+		Timeout: defaultTimeout,
+	}
+	resp, err := httpClient.Post(notificationURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		logger.Warn(logSender, "", "unable to notify the retention report for user %#v to URL %v: %v",
+			report.Username, notificationURL, err)
+		return
+	}
+	defer resp.Body.Close()
+	logger.Debug(logSender, "", "retention report for user %#v notified to URL %v, status code: %v", report.Username,
+		notificationURL, resp.StatusCode)
+}
+
+type retentionChecker struct {
+	p       dataprovider.Provider
+	user    dataprovider.User
+	fs      vfs.Fs
+	folders []dataprovider.FolderRetention
+}
+
+// hasOwnPolicy returns true if the given virtual path has a policy different from the folder being checked
+func (c *retentionChecker) hasOwnPolicy(virtualPath, folderPath string) bool {
+	for _, f := range c.folders {
+		if f.Path == virtualPath && f.Path != folderPath {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *retentionChecker) checkFolder(folder dataprovider.FolderRetention) FolderRetentionReport {
+	report := FolderRetentionReport{
+		Path:      folder.Path,
+		Retention: folder.Retention,
+	}
+	fsPath, err := c.fs.ResolvePath(folder.Path)
+	if err == nil {
+		limit := time.Now().Add(-time.Duration(folder.Retention) * time.Hour)
+		err = c.cleanDir(folder, folder.Path, fsPath, limit, &report)
+	}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	if report.DeletedFiles > 0 && !c.user.IsFileExcludedFromQuota(fsPath) {
+		dataprovider.UpdateUserQuota(c.p, c.user, -report.DeletedFiles, -report.DeletedSize, false)
+	}
+	logger.Debug(logSender, "", "retention check for user %#v, folder %#v, deleted files: %v, size: %v, dirs: %v, "+
+		"error: %v", c.user.Username, folder.Path, report.DeletedFiles, report.DeletedSize, report.DeletedDirs, err)
+	return report
+}
+
+func (c *retentionChecker) cleanDir(folder dataprovider.FolderRetention, virtualPath, fsPath string, limit time.Time,
+	report *FolderRetentionReport) error {
+	contents, err := c.fs.ReadDir(fsPath)
+	if err != nil {
+		if c.fs.IsNotExist(err) && virtualPath == folder.Path {
+			return nil
+		}
+		return err
+	}
+	for _, info := range contents {
+		childVirtualPath := path.Join(virtualPath, info.Name())
+		childFsPath := c.fs.Join(fsPath, info.Name())
+		if info.IsDir() {
+			if c.hasOwnPolicy(childVirtualPath, folder.Path) || c.user.IsVirtualFolder(childVirtualPath) {
+				continue
+			}
+			if err = c.cleanDir(folder, childVirtualPath, childFsPath, limit, report); err != nil {
+				return err
+			}
+			if folder.DeleteEmptyDirs && c.isDirEmpty(childFsPath) {
+				if err = c.fs.Remove(childFsPath, true); err != nil {
+					logger.Warn(logSender, "", "unable to remove empty dir %#v: %v", childFsPath, err)
+				} else {
+					report.DeletedDirs++
+				}
+			}
+			continue
+		}
+		if info.Mode()&os.ModeSymlink == os.ModeSymlink || !info.ModTime().Before(limit) {
+			continue
+		}
+		if err = c.fs.Remove(childFsPath, false); err != nil {
+			logger.Warn(logSender, "", "unable to remove file %#v: %v", childFsPath, err)
+			continue
+		}
+		report.DeletedFiles++
+		report.DeletedSize += info.Size()
+	}
+	return nil
+}
+
+func (c *retentionChecker) isDirEmpty(fsPath string) bool {
+	contents, err := c.fs.ReadDir(fsPath)
+	return err == nil && len(contents) == 0
+}
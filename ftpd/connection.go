@@ -0,0 +1,621 @@
+package ftpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/ratelimiter"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	maxCommandLength = 4096
+)
+
+var (
+	errCommandTooLong = errors.New("command line too long")
+	// commands allowed before a successful login
+	unauthenticatedCommands = []string{"USER", "PASS", "AUTH", "PBSZ", "PROT", "FEAT", "SYST", "NOOP", "QUIT",
+		"OPTS", "HELP", "CLNT"}
+	dataChannelCommands = []string{"PASV", "EPSV", "PORT", "EPRT", "TYPE"}
+)
+
+// Connection details for an FTP connection
+type Connection struct {
+	// Unique identifier for the connection
+	ID string
+	// logged in user's details
+	User dataprovider.User
+	// client's version string, it is only available if the client sends the CLNT command
+	ClientVersion string
+	// Remote address for this connection
+	RemoteAddr net.Addr
+	// start time for this connection
+	StartTime    time.Time
+	lastActivity time.Time
+	config       *Configuration
+	tlsConfig    *tls.Config
+	// the underlying network connection
+	rawConn net.Conn
+	// the control connection, it differs from rawConn after a TLS upgrade
+	controlConn     net.Conn
+	reader          *bufio.Reader
+	fs              vfs.Fs
+	isLoggedIn      bool
+	loginAttempts   int
+	pendingUsername string
+	cwd             string
+	isTLS           bool
+	protectData     bool
+	restartOffset   int64
+	renameFrom      string
+	passiveListener net.Listener
+	activeAddr      string
+	dataConn        net.Conn
+	transfer        *transfer
+	lock            *sync.Mutex
+}
+
+func newConnection(connectionID string, conn net.Conn, config *Configuration, tlsConfig *tls.Config) *Connection {
+	_, isTLS := conn.(*tls.Conn)
+	return &Connection{
+		ID:           connectionID,
+		RemoteAddr:   conn.RemoteAddr(),
+		StartTime:    time.Now(),
+		lastActivity: time.Now(),
+		config:       config,
+		tlsConfig:    tlsConfig,
+		rawConn:      conn,
+		controlConn:  conn,
+		reader:       bufio.NewReaderSize(conn, maxCommandLength),
+		cwd:          "/",
+		isTLS:        isTLS,
+		lock:         new(sync.Mutex),
+	}
+}
+
+// Log outputs a log entry to the configured logger
+func (c *Connection) Log(level logger.LogLevel, sender string, format string, v ...interface{}) {
+	logger.Log(level, sender, c.ID, format, v...)
+}
+
+func (c *Connection) getRemoteIP() string {
+	if c.RemoteAddr == nil {
+		return ""
+	}
+	return utils.GetIPFromRemoteAddress(c.RemoteAddr.String())
+}
+
+// GetID returns the connection identifier
+func (c *Connection) GetID() string {
+	return c.ID
+}
+
+// GetUsername returns the logged in username
+func (c *Connection) GetUsername() string {
+	return c.User.Username
+}
+
+// GetClientVersion returns the client version, if known
+func (c *Connection) GetClientVersion() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ClientVersion
+}
+
+// GetRemoteAddress returns the remote address for this connection
+func (c *Connection) GetRemoteAddress() net.Addr {
+	return c.RemoteAddr
+}
+
+// GetProtocol returns the protocol for this connection
+func (c *Connection) GetProtocol() string {
+	return protocolFTP
+}
+
+// GetConnectionTime returns the connection start time
+func (c *Connection) GetConnectionTime() time.Time {
+	return c.StartTime
+}
+
+// GetLastActivity returns the last activity for this connection,
+// the activity on the active transfer, if any, is considered too
+func (c *Connection) GetLastActivity() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lastActivity := c.lastActivity
+	if c.transfer != nil {
+		if stats := c.transfer.getStats(); stats.LastActivity > utils.GetTimeAsMsSinceEpoch(lastActivity) {
+			lastActivity = utils.GetTimeFromMsecSinceEpoch(stats.LastActivity)
+		}
+	}
+	return lastActivity
+}
+
+// GetUploadBandwidth returns the upload bandwidth limit, as KB/s, for this connection
+func (c *Connection) GetUploadBandwidth() int64 {
+	return c.User.UploadBandwidth
+}
+
+// GetDownloadBandwidth returns the download bandwidth limit, as KB/s, for this connection
+func (c *Connection) GetDownloadBandwidth() int64 {
+	return c.User.DownloadBandwidth
+}
+
+// GetTransfers returns the active transfers
+func (c *Connection) GetTransfers() []sftpd.ConnectionTransfer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	transfers := []sftpd.ConnectionTransfer{}
+	if c.transfer != nil {
+		stats := c.transfer.getStats()
+		stats.Path = c.fs.GetRelativePath(c.transfer.path)
+		transfers = append(transfers, stats)
+	}
+	return transfers
+}
+
+// Disconnect closes the underlying network connection and the data connection, if any
+func (c *Connection) Disconnect() error {
+	c.lock.Lock()
+	if c.dataConn != nil {
+		c.dataConn.Close()
+	}
+	if c.passiveListener != nil {
+		c.passiveListener.Close()
+	}
+	c.lock.Unlock()
+	return c.rawConn.Close()
+}
+
+func (c *Connection) serve() {
+	defer c.close()
+	// the login must be completed within loginTimeout, after a successful login
+	// the deadline is removed and the idle timeout configured for SFTP is used
+	c.rawConn.SetDeadline(time.Now().Add(loginTimeout))
+	c.Log(logger.LevelDebug, logSender, "new connection from %#v", c.RemoteAddr.String())
+	c.writeReply(220, c.config.Banner)
+	for {
+		line, err := c.readCommand()
+		if err == errCommandTooLong {
+			c.writeReply(500, "Command line too long")
+			continue
+		}
+		if err != nil {
+			c.Log(logger.LevelDebug, logSender, "unable to read command: %v", err)
+			return
+		}
+		c.updateActivity()
+		command, arg := parseCommand(line)
+		if len(command) == 0 {
+			continue
+		}
+		if c.handleCommand(command, arg) {
+			return
+		}
+	}
+}
+
+// handleCommand executes the given command, it returns true if the connection must be closed
+func (c *Connection) handleCommand(command, arg string) bool {
+	if command == "PASS" {
+		c.Log(logger.LevelDebug, logSender, "received command: PASS ****")
+	} else {
+		c.Log(logger.LevelDebug, logSender, "received command: %v %#v", command, arg)
+	}
+	if !c.isLoggedIn && !utils.IsStringInSlice(command, unauthenticatedCommands) {
+		c.writeReply(530, "Please login with USER and PASS")
+		return false
+	}
+	// a restart offset must be followed by a transfer command and the rename source must
+	// be followed by the rename target, commands setting up the data channel are allowed
+	// between a restart offset and the transfer
+	restartOffset := c.restartOffset
+	if !utils.IsStringInSlice(command, dataChannelCommands) {
+		c.restartOffset = 0
+	}
+	renameFrom := c.renameFrom
+	c.renameFrom = ""
+
+	switch command {
+	case "USER":
+		c.handleUSER(arg)
+	case "PASS":
+		return c.handlePASS(arg)
+	case "AUTH":
+		return c.handleAUTH(arg)
+	case "PBSZ":
+		c.handlePBSZ(arg)
+	case "PROT":
+		c.handlePROT(arg)
+	case "FEAT":
+		c.handleFEAT()
+	case "SYST":
+		c.writeReply(215, "UNIX Type: L8")
+	case "NOOP":
+		c.writeReply(200, "NOOP ok")
+	case "QUIT":
+		c.writeReply(221, "Goodbye")
+		return true
+	case "OPTS":
+		c.handleOPTS(arg)
+	case "HELP":
+		c.writeReply(214, "Help is not available, please refer to RFC 959")
+	case "CLNT":
+		c.lock.Lock()
+		c.ClientVersion = arg
+		c.lock.Unlock()
+		c.writeReply(200, "Noted")
+	case "PWD", "XPWD":
+		c.writeReply(257, fmt.Sprintf("%v is the current directory", quotePath(c.cwd)))
+	case "CWD", "XCWD":
+		c.handleCWD(arg)
+	case "CDUP", "XCUP":
+		c.handleCWD("..")
+	case "TYPE":
+		c.handleTYPE(arg)
+	case "MODE":
+		c.handleMODE(arg)
+	case "STRU":
+		c.handleSTRU(arg)
+	case "ALLO":
+		c.writeReply(202, "No storage allocation necessary")
+	case "PASV":
+		c.handlePASV(false)
+	case "EPSV":
+		c.handleEPSV(arg)
+	case "PORT":
+		c.handlePORT(arg)
+	case "EPRT":
+		c.handleEPRT(arg)
+	case "REST":
+		c.handleREST(arg)
+	case "LIST", "NLST", "MLSD":
+		c.handleList(command, arg)
+	case "MLST":
+		c.handleMLST(arg)
+	case "RETR":
+		c.handleRETR(arg, restartOffset)
+	case "STOR":
+		c.handleSTOR(arg, restartOffset, false)
+	case "APPE":
+		c.handleSTOR(arg, restartOffset, true)
+	case "DELE":
+		c.handleDELE(arg)
+	case "MKD", "XMKD":
+		c.handleMKD(arg)
+	case "RMD", "XRMD":
+		c.handleRMD(arg)
+	case "RNFR":
+		c.handleRNFR(arg)
+	case "RNTO":
+		c.handleRNTO(arg, renameFrom)
+	case "SIZE":
+		c.handleSIZE(arg)
+	case "MDTM":
+		c.handleMDTM(arg)
+	case "ABOR":
+		c.writeReply(225, "No transfer to abort")
+	default:
+		c.writeReply(502, fmt.Sprintf("Command %#v not implemented", command))
+	}
+	return false
+}
+
+func (c *Connection) readCommand() (string, error) {
+	line, isPrefix, err := c.reader.ReadLine()
+	if err != nil {
+		return "", err
+	}
+	if isPrefix {
+		// discard the remaining part of the line
+		for isPrefix && err == nil {
+			_, isPrefix, err = c.reader.ReadLine()
+		}
+		if err != nil {
+			return "", err
+		}
+		return "", errCommandTooLong
+	}
+	return string(line), nil
+}
+
+func (c *Connection) writeReply(code int, message string) error {
+	_, err := fmt.Fprintf(c.controlConn, "%d %s\r\n", code, message)
+	return err
+}
+
+func (c *Connection) writeMultilineReply(code int, first string, lines []string, last string) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d-%s\r\n", code, first)
+	for _, line := range lines {
+		fmt.Fprintf(&b, " %s\r\n", line)
+	}
+	fmt.Fprintf(&b, "%d %s\r\n", code, last)
+	_, err := c.controlConn.Write([]byte(b.String()))
+	return err
+}
+
+func (c *Connection) updateActivity() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastActivity = time.Now()
+}
+
+func (c *Connection) setTransfer(t *transfer, dataConn net.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transfer = t
+	c.dataConn = dataConn
+}
+
+func (c *Connection) handleUSER(username string) {
+	if c.isLoggedIn {
+		c.writeReply(530, "Cannot change user")
+		return
+	}
+	if c.config.TLSMode == tlsModeExplicitRequired && !c.isTLS {
+		c.writeReply(530, "TLS is required, please use AUTH TLS")
+		return
+	}
+	if len(username) == 0 {
+		c.writeReply(501, "Username required")
+		return
+	}
+	c.pendingUsername = username
+	c.writeReply(331, "Username ok, send password")
+}
+
+func (c *Connection) handlePASS(password string) bool {
+	if c.isLoggedIn {
+		c.writeReply(503, "Already logged in")
+		return false
+	}
+	if len(c.pendingUsername) == 0 {
+		c.writeReply(503, "Login with USER first")
+		return false
+	}
+	username := c.pendingUsername
+	c.pendingUsername = ""
+	if err := c.login(username, password); err != nil {
+		c.loginAttempts++
+		c.writeReply(530, "Authentication failed")
+		if c.loginAttempts >= maxLoginAttempts {
+			c.Log(logger.LevelDebug, logSender, "too many login attempts, closing connection")
+			return true
+		}
+		return false
+	}
+	c.writeReply(230, "Login successful")
+	return false
+}
+
+func (c *Connection) login(username, password string) error {
+	var err error
+	var user dataprovider.User
+
+	method := dataprovider.SSHLoginMethodPassword
+	remoteAddr := c.RemoteAddr.String()
+	if !ratelimiter.AllowAuthAttempt(utils.GetIPFromRemoteAddress(remoteAddr)) {
+		return errAuthRateLimited
+	}
+	metrics.AddLoginAttempt(method)
+	if user, err = dataprovider.CheckUserAndPass(dataProvider, username, password, utils.GetIPFromRemoteAddress(remoteAddr)); err == nil {
+		err = checkLoginConditions(user, method, remoteAddr)
+	}
+	if err != nil {
+		ipAddr := utils.GetIPFromRemoteAddress(remoteAddr)
+		logger.ConnectionFailedLog(username, ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: username, Protocol: protocolFTP, RemoteIP: ipAddr,
+			LoginMethod: method, Error: err.Error()})
+		addDefenderEvent(ipAddr, err)
+		ratelimiter.DelayLoginFailure(ipAddr, username)
+		metrics.AddLoginResult(method, err)
+		dataprovider.ExecutePostLoginHook(username, method, ipAddr, protocolFTP, err)
+		return err
+	}
+	ratelimiter.ResetLoginFailures(username)
+	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(username, method, utils.GetIPFromRemoteAddress(remoteAddr), protocolFTP, err)
+	fs, err := user.GetFilesystem(c.ID)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "could create filesystem for user %#v err: %v", user.Username, err)
+		return err
+	}
+	c.User = user
+	c.fs = fs
+	c.isLoggedIn = true
+	c.fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+	// login completed so remove the deadline, we'll use IdleTimeout configuration from now on
+	c.rawConn.SetDeadline(time.Time{})
+	c.Log(logger.LevelInfo, logSender, "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
+		user.ID, method, user.Username, user.HomeDir, remoteAddr)
+	dataprovider.UpdateLastLogin(dataProvider, user)
+	sftpd.AddActiveConnection(c)
+	return nil
+}
+
+func checkLoginConditions(user dataprovider.User, loginMethod, remoteAddr string) error {
+	if !filepath.IsAbs(user.HomeDir) {
+		logger.Warn(logSender, "", "user %#v has an invalid home dir: %#v. Home dir must be an absolute path, login not allowed",
+			user.Username, user.HomeDir)
+		return fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
+	}
+	if user.MaxSessions > 0 {
+		activeSessions := sftpd.GetActiveSessions(user.Username)
+		if activeSessions >= user.MaxSessions {
+			logger.Debug(logSender, "", "authentication refused for user: %#v, too many open sessions: %v/%v", user.Username,
+				activeSessions, user.MaxSessions)
+			return fmt.Errorf("too many open sessions: %v", activeSessions)
+		}
+	}
+	if !user.IsLoginMethodAllowed(loginMethod, remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, login method %#v is not allowed", user.Username, loginMethod)
+		return fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
+	}
+	if !user.IsLoginFromAddrAllowed(remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
+	}
+	if allowed, country := user.IsLoginFromCountryAllowed(remoteAddr); !allowed {
+		logger.Debug(logSender, "", "cannot login user %#v, country %#v is not allowed: %v", user.Username, country, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from country %#v", user.Username, country)
+	}
+	return nil
+}
+
+func (c *Connection) handleAUTH(arg string) bool {
+	mechanism := strings.ToUpper(arg)
+	if mechanism != "TLS" && mechanism != "SSL" && mechanism != "TLS-C" {
+		c.writeReply(504, fmt.Sprintf("AUTH %v is not supported", arg))
+		return false
+	}
+	if c.tlsConfig == nil {
+		c.writeReply(534, errNoTLSSupport.Error())
+		return false
+	}
+	if c.isTLS {
+		c.writeReply(503, "TLS is already enabled")
+		return false
+	}
+	c.writeReply(234, fmt.Sprintf("AUTH %v successful", mechanism))
+	tlsConn := tls.Server(c.rawConn, c.tlsConfig)
+	if err := tlsConn.Handshake(); err != nil {
+		c.Log(logger.LevelWarn, logSender, "TLS handshake error: %v", err)
+		return true
+	}
+	c.controlConn = tlsConn
+	c.reader = bufio.NewReaderSize(tlsConn, maxCommandLength)
+	c.isTLS = true
+	c.pendingUsername = ""
+	return false
+}
+
+func (c *Connection) handlePBSZ(arg string) {
+	if !c.isTLS {
+		c.writeReply(503, "PBSZ requires a TLS connection")
+		return
+	}
+	c.writeReply(200, "PBSZ=0")
+}
+
+func (c *Connection) handlePROT(arg string) {
+	if !c.isTLS {
+		c.writeReply(503, "PROT requires a TLS connection")
+		return
+	}
+	switch strings.ToUpper(arg) {
+	case "P":
+		c.protectData = true
+		c.writeReply(200, "PROT P ok")
+	case "C":
+		if c.config.TLSMode == tlsModeExplicitRequired {
+			c.writeReply(534, "Data connections must be encrypted")
+			return
+		}
+		c.protectData = false
+		c.writeReply(200, "PROT C ok")
+	default:
+		c.writeReply(504, fmt.Sprintf("PROT %v is not supported", arg))
+	}
+}
+
+func (c *Connection) handleFEAT() {
+	features := []string{"UTF8", "SIZE", "MDTM", "REST STREAM", "PASV", "EPSV", "EPRT", "CLNT",
+		"MLST type*;size*;modify*;"}
+	if c.tlsConfig != nil {
+		features = append(features, "AUTH TLS", "PBSZ", "PROT")
+	}
+	c.writeMultilineReply(211, "Features:", features, "End")
+}
+
+func (c *Connection) handleOPTS(arg string) {
+	fields := strings.Fields(strings.ToUpper(arg))
+	if len(fields) > 0 && fields[0] == "UTF8" {
+		if len(fields) == 1 || fields[1] == "ON" {
+			c.writeReply(200, "UTF8 mode enabled")
+		} else {
+			c.writeReply(504, "UTF8 mode cannot be disabled")
+		}
+		return
+	}
+	if len(fields) > 0 && fields[0] == "MLST" {
+		c.writeReply(200, "MLST OPTS type;size;modify;")
+		return
+	}
+	c.writeReply(501, fmt.Sprintf("Unsupported option %#v", arg))
+}
+
+func (c *Connection) handleTYPE(arg string) {
+	// we always transfer data in binary mode, ASCII type is accepted for compatibility
+	// with clients that require it
+	switch strings.ToUpper(strings.Join(strings.Fields(arg), " ")) {
+	case "A", "A N", "I", "L 8":
+		c.writeReply(200, fmt.Sprintf("Type set to %v", arg))
+	default:
+		c.writeReply(504, fmt.Sprintf("Unsupported type %#v", arg))
+	}
+}
+
+func (c *Connection) handleMODE(arg string) {
+	if strings.ToUpper(arg) == "S" {
+		c.writeReply(200, "Mode set to S")
+		return
+	}
+	c.writeReply(504, fmt.Sprintf("Unsupported mode %#v", arg))
+}
+
+func (c *Connection) handleSTRU(arg string) {
+	if strings.ToUpper(arg) == "F" {
+		c.writeReply(200, "Structure set to F")
+		return
+	}
+	c.writeReply(504, fmt.Sprintf("Unsupported structure %#v", arg))
+}
+
+func (c *Connection) close() {
+	c.lock.Lock()
+	if c.passiveListener != nil {
+		c.passiveListener.Close()
+		c.passiveListener = nil
+	}
+	c.lock.Unlock()
+	if c.isLoggedIn {
+		sftpd.RemoveActiveConnection(c)
+		c.fs.Close()
+	}
+	err := c.rawConn.Close()
+	c.Log(logger.LevelDebug, logSender, "connection closed, close err: %v", err)
+}
+
+func parseCommand(line string) (string, string) {
+	line = strings.TrimRight(line, "\r\n")
+	fields := strings.SplitN(line, " ", 2)
+	command := strings.ToUpper(strings.TrimSpace(fields[0]))
+	if len(fields) < 2 {
+		return command, ""
+	}
+	return command, fields[1]
+}
+
+func addDefenderEvent(ipAddr string, err error) {
+	event := defender.HostEventLoginFailed
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		event = defender.HostEventUserNotFound
+	}
+	defender.AddEvent(ipAddr, event)
+}
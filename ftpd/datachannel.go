@@ -0,0 +1,236 @@
+package ftpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	errNoDataConnection      = errors.New("use PORT or PASV first")
+	errUnprotectedDataConn   = errors.New("data connections must be encrypted")
+	errDataConnAddrMismatch  = errors.New("data connection from an unexpected address")
+	errInvalidActiveAddress  = errors.New("invalid address")
+	errThirdPartyDataAddress = errors.New("data connections to a third party address are not allowed")
+)
+
+func (c *Connection) handlePASV(extended bool) {
+	c.resetDataChannel()
+	localIP := utils.GetIPFromRemoteAddress(c.rawConn.LocalAddr().String())
+	var passiveIP net.IP
+	if !extended {
+		if len(c.config.ForcePassiveIP) > 0 {
+			passiveIP = net.ParseIP(c.config.ForcePassiveIP).To4()
+		} else {
+			passiveIP = net.ParseIP(localIP).To4()
+		}
+		if passiveIP == nil {
+			c.writeReply(425, "PASV is not supported for IPv6 connections, please use EPSV")
+			return
+		}
+	}
+	listener, err := c.listenPassive(localIP)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to start a passive listener: %v", err)
+		c.writeReply(425, "Unable to open a passive connection")
+		return
+	}
+	c.lock.Lock()
+	c.passiveListener = listener
+	c.lock.Unlock()
+	port := listener.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.writeReply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", port))
+		return
+	}
+	c.writeReply(227, fmt.Sprintf("Entering Passive Mode (%d,%d,%d,%d,%d,%d)", passiveIP[0], passiveIP[1],
+		passiveIP[2], passiveIP[3], port>>8, port&0xFF))
+}
+
+func (c *Connection) handleEPSV(arg string) {
+	if strings.ToUpper(arg) == "ALL" {
+		c.writeReply(200, "EPSV ALL ok")
+		return
+	}
+	c.handlePASV(true)
+}
+
+func (c *Connection) handlePORT(arg string) {
+	c.resetDataChannel()
+	fields := strings.Split(arg, ",")
+	if len(fields) != 6 {
+		c.writeReply(501, "Syntax error in parameters")
+		return
+	}
+	var values []int
+	for _, f := range fields {
+		v, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil || v < 0 || v > 255 {
+			c.writeReply(501, "Syntax error in parameters")
+			return
+		}
+		values = append(values, v)
+	}
+	ip := fmt.Sprintf("%d.%d.%d.%d", values[0], values[1], values[2], values[3])
+	port := values[4]<<8 + values[5]
+	c.setActiveAddress(ip, port)
+}
+
+func (c *Connection) handleEPRT(arg string) {
+	c.resetDataChannel()
+	if len(arg) < 2 {
+		c.writeReply(501, "Syntax error in parameters")
+		return
+	}
+	delimiter := arg[0:1]
+	fields := strings.Split(arg, delimiter)
+	if len(fields) != 5 {
+		c.writeReply(501, "Syntax error in parameters")
+		return
+	}
+	if fields[1] != "1" && fields[1] != "2" {
+		c.writeReply(522, "Network protocol not supported, use (1,2)")
+		return
+	}
+	port, err := strconv.Atoi(fields[3])
+	if err != nil || port <= 0 || port > 65535 {
+		c.writeReply(501, "Syntax error in parameters")
+		return
+	}
+	c.setActiveAddress(fields[2], port)
+}
+
+func (c *Connection) setActiveAddress(ip string, port int) {
+	if err := c.checkActiveAddress(ip, port); err != nil {
+		c.Log(logger.LevelWarn, logSender, "active data connection to %v:%v refused: %v", ip, port, err)
+		c.writeReply(501, fmt.Sprintf("Rejected data connection: %v", err))
+		return
+	}
+	c.activeAddr = net.JoinHostPort(ip, strconv.Itoa(port))
+	c.writeReply(200, "Command okay")
+}
+
+// checkActiveAddress restricts active data connections to the client address.
+// This way the server cannot be used for FTP bounce attacks
+func (c *Connection) checkActiveAddress(ip string, port int) error {
+	activeIP := net.ParseIP(ip)
+	if activeIP == nil {
+		return errInvalidActiveAddress
+	}
+	if port < 1024 {
+		return fmt.Errorf("port %v is not allowed", port)
+	}
+	remoteIP := net.ParseIP(utils.GetIPFromRemoteAddress(c.RemoteAddr.String()))
+	if !activeIP.Equal(remoteIP) {
+		return errThirdPartyDataAddress
+	}
+	return nil
+}
+
+func (c *Connection) listenPassive(localIP string) (net.Listener, error) {
+	var err error
+	var listener net.Listener
+	numPorts := c.config.PassivePortRange.End - c.config.PassivePortRange.Start + 1
+	offset := rand.Intn(numPorts)
+	for i := 0; i < numPorts; i++ {
+		port := c.config.PassivePortRange.Start + (offset+i)%numPorts
+		listener, err = net.Listen("tcp", net.JoinHostPort(localIP, strconv.Itoa(port)))
+		if err == nil {
+			return listener, nil
+		}
+	}
+	return nil, fmt.Errorf("no available port in range %v-%v, last error: %v", c.config.PassivePortRange.Start,
+		c.config.PassivePortRange.End, err)
+}
+
+func (c *Connection) hasDataChannel() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.passiveListener != nil || len(c.activeAddr) > 0
+}
+
+func (c *Connection) resetDataChannel() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.passiveListener != nil {
+		c.passiveListener.Close()
+		c.passiveListener = nil
+	}
+	c.activeAddr = ""
+}
+
+// checkDataChannel returns an error and replies to the client if a data
+// connection cannot be opened
+func (c *Connection) checkDataChannel() error {
+	if c.config.TLSMode == tlsModeExplicitRequired && !c.protectData {
+		c.writeReply(521, "Data connections must be encrypted, please use PROT P")
+		return errUnprotectedDataConn
+	}
+	if !c.hasDataChannel() {
+		c.writeReply(425, "Use PORT or PASV first")
+		return errNoDataConnection
+	}
+	return nil
+}
+
+// getDataConnection opens the data connection configured using PORT/EPRT or PASV/EPSV.
+// The data channel is reset after each call, a new one must be configured for each transfer
+func (c *Connection) getDataConnection() (net.Conn, error) {
+	c.lock.Lock()
+	listener := c.passiveListener
+	activeAddr := c.activeAddr
+	c.passiveListener = nil
+	c.activeAddr = ""
+	c.lock.Unlock()
+
+	var conn net.Conn
+	var err error
+	if listener != nil {
+		conn, err = c.acceptPassiveConnection(listener)
+	} else if len(activeAddr) > 0 {
+		conn, err = net.DialTimeout("tcp", activeAddr, dataConnTimeout)
+	} else {
+		err = errNoDataConnection
+	}
+	if err != nil {
+		return nil, err
+	}
+	if c.protectData {
+		tlsConn := tls.Server(conn, c.tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(dataConnTimeout))
+		if err = tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+		conn = tlsConn
+	}
+	return conn, nil
+}
+
+func (c *Connection) acceptPassiveConnection(listener net.Listener) (net.Conn, error) {
+	defer listener.Close()
+	if tcpListener, ok := listener.(*net.TCPListener); ok {
+		tcpListener.SetDeadline(time.Now().Add(dataConnTimeout))
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	// the data connection must come from the same IP as the control connection
+	dataIP := net.ParseIP(utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+	remoteIP := net.ParseIP(utils.GetIPFromRemoteAddress(c.RemoteAddr.String()))
+	if !dataIP.Equal(remoteIP) {
+		conn.Close()
+		return nil, errDataConnAddrMismatch
+	}
+	return conn, nil
+}
@@ -0,0 +1,173 @@
+// Package ftpd implements the File Transfer Protocol as described in RFC 959.
+// FTPS, explicit (RFC 4217) and implicit, is supported too.
+// The users, permissions, quota and upload modes are the same used for SFTP.
+package ftpd
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"time"
+
+	"github.com/drakkan/sftpgo/acme"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/ratelimiter"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/rs/xid"
+)
+
+const (
+	logSender         = "ftpd"
+	uploadLogSender   = "Upload"
+	downloadLogSender = "Download"
+	renameLogSender   = "Rename"
+	rmdirLogSender    = "Rmdir"
+	mkdirLogSender    = "Mkdir"
+	removeLogSender   = "Remove"
+	operationDownload = "download"
+	operationUpload   = "upload"
+	operationDelete   = "delete"
+	operationRename   = "rename"
+	protocolFTP       = "FTP"
+	loginTimeout      = 2 * time.Minute
+	dataConnTimeout   = 30 * time.Second
+	maxLoginAttempts  = 3
+)
+
+const (
+	tlsModeExplicit = iota
+	tlsModeExplicitRequired
+	tlsModeImplicit
+)
+
+var (
+	dataProvider       dataprovider.Provider
+	certMgr            *utils.CertManager
+	errNotLoggedIn     = errors.New("not logged in")
+	errNoTLSSupport    = errors.New("TLS is not configured")
+	errAuthRateLimited = errors.New("authentication rate limit exceeded")
+)
+
+// PortRange defines a port range
+type PortRange struct {
+	// Range start
+	Start int `json:"start" mapstructure:"start"`
+	// Range end
+	End int `json:"end" mapstructure:"end"`
+}
+
+// Configuration for the FTP server
+type Configuration struct {
+	// The port used for serving FTP requests. 0 disable the FTP server. Default: 0
+	BindPort int `json:"bind_port" mapstructure:"bind_port"`
+	// The address to listen on. A blank value means listen on all available network interfaces.
+	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
+	// Greeting banner displayed when a connection first comes in
+	Banner string `json:"banner" mapstructure:"banner"`
+	// External IP address to expose for passive connections.
+	// If empty the local address of the control connection is used
+	ForcePassiveIP string `json:"force_passive_ip" mapstructure:"force_passive_ip"`
+	// Port range for passive data connections. Default: 50000-50100
+	PassivePortRange PortRange `json:"passive_port_range" mapstructure:"passive_port_range"`
+	// If files containing a certificate and matching private key for the server are provided
+	// FTPS will be available.
+	// Certificate and key files can be reloaded on demand sending a "SIGHUP" signal on Unix based systems and a
+	// "paramchange" request to the running service on Windows.
+	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// TLSMode 0 means explicit TLS: clients can upgrade the connection using the "AUTH TLS" command,
+	// plain FTP is allowed too.
+	// 1 means explicit TLS required: both the control and the data connections must be encrypted.
+	// 2 means implicit TLS: the TLS handshake is done as soon as the client connects.
+	// TLSMode is ignored if no certificate is configured
+	TLSMode int `json:"tls_mode" mapstructure:"tls_mode"`
+}
+
+// SetDataProvider sets the data provider to use to authenticate users and to get/update their disk quota
+func SetDataProvider(provider dataprovider.Provider) {
+	dataProvider = provider
+}
+
+// Initialize the FTP server and add a persistent listener to handle inbound FTP connections.
+func (c Configuration) Initialize(configDir string) error {
+	if c.PassivePortRange.Start <= 0 || c.PassivePortRange.End < c.PassivePortRange.Start ||
+		c.PassivePortRange.End > 65535 {
+		return fmt.Errorf("invalid passive port range %v-%v", c.PassivePortRange.Start, c.PassivePortRange.End)
+	}
+	if len(c.ForcePassiveIP) > 0 && net.ParseIP(c.ForcePassiveIP).To4() == nil {
+		return fmt.Errorf("invalid force_passive_ip %#v, it must be a valid IPv4 address", c.ForcePassiveIP)
+	}
+	var tlsConfig *tls.Config
+	certificateFile := getConfigPath(c.CertificateFile, configDir)
+	certificateKeyFile := getConfigPath(c.CertificateKeyFile, configDir)
+	if len(certificateFile) > 0 && len(certificateKeyFile) > 0 {
+		var err error
+		certMgr, err = utils.NewCertManager(certificateFile, certificateKeyFile, logSender)
+		if err != nil {
+			return err
+		}
+		tlsConfig = &tls.Config{
+			GetCertificate: certMgr.GetCertificateFunc(),
+			MinVersion:     tls.VersionTLS12,
+		}
+	} else if acme.IsEnabledForProtocol(acme.ProtocolFTP) {
+		tlsConfig = acme.GetTLSConfig()
+	} else if c.TLSMode != tlsModeExplicit {
+		return fmt.Errorf("tls_mode %v requires a certificate and a private key", c.TLSMode)
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
+	if err != nil {
+		logger.Warn(logSender, "", "error starting listener on address %s:%d: %v", c.BindAddress, c.BindPort, err)
+		return err
+	}
+	if c.TLSMode == tlsModeImplicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	logger.Info(logSender, "", "server listener registered address: %v, TLS mode: %v", listener.Addr().String(),
+		c.TLSMode)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				logger.Warn(logSender, "", "temporary accept error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+		if defender.IsBanned(ipAddr) {
+			logger.Debug(logSender, "", "connection refused, ip %#v is banned", ipAddr)
+			conn.Close()
+			continue
+		}
+		if !ratelimiter.AllowConnection(ipAddr) {
+			conn.Close()
+			continue
+		}
+		connection := newConnection(xid.New().String(), conn, &c, tlsConfig)
+		go connection.serve()
+	}
+}
+
+// ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
+func ReloadTLSCertificate() {
+	if certMgr != nil {
+		certMgr.LoadCertificate()
+	}
+}
+
+func getConfigPath(name, configDir string) string {
+	if !utils.IsFileInputValid(name) {
+		return ""
+	}
+	if len(name) > 0 && !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}
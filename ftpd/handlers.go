@@ -0,0 +1,767 @@
+package ftpd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// getFTPPath returns the absolute FTP path for the given argument,
+// relative paths are resolved against the current working directory
+func (c *Connection) getFTPPath(arg string) string {
+	if len(arg) == 0 {
+		return c.cwd
+	}
+	if !path.IsAbs(arg) {
+		arg = path.Join(c.cwd, arg)
+	}
+	return utils.CleanSFTPPath(arg)
+}
+
+func (c *Connection) writeFsErrorReply(err error) {
+	if c.fs.IsNotExist(err) {
+		c.writeReply(550, "No such file or directory")
+	} else if c.fs.IsPermission(err) {
+		c.writeReply(550, "Permission denied")
+	} else {
+		c.writeReply(550, "Requested action not taken")
+	}
+}
+
+// writePermissionDenied sends the permission denied reply and emits the related audit event
+func (c *Connection) writePermissionDenied(command, ftpPath string) {
+	c.writeReply(550, "Permission denied")
+	audit.Log(audit.Event{
+		Event:        audit.EventPermissionDenied,
+		Username:     c.User.Username,
+		Protocol:     protocolFTP,
+		ConnectionID: c.ID,
+		RemoteIP:     c.getRemoteIP(),
+		Path:         ftpPath,
+		Operation:    command,
+	})
+}
+
+func (c *Connection) handleCWD(arg string) {
+	ftpPath := c.getFTPPath(arg)
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "unable to change directory to %#v: %v", ftpPath, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	if !fi.IsDir() {
+		c.writeReply(550, fmt.Sprintf("%v is not a directory", quotePath(ftpPath)))
+		return
+	}
+	c.cwd = ftpPath
+	c.writeReply(250, fmt.Sprintf("Directory changed to %v", quotePath(ftpPath)))
+}
+
+func (c *Connection) handleREST(arg string) {
+	offset, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || offset < 0 {
+		c.writeReply(501, fmt.Sprintf("Invalid restart offset %#v", arg))
+		return
+	}
+	c.restartOffset = offset
+	c.writeReply(350, fmt.Sprintf("Restarting at %v, send STOR, APPE or RETR to initiate transfer", offset))
+}
+
+func (c *Connection) handleSIZE(arg string) {
+	fi, ftpPath, ok := c.statForInfo(arg)
+	if !ok {
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		c.writeReply(550, fmt.Sprintf("%v is not a regular file", quotePath(ftpPath)))
+		return
+	}
+	c.writeReply(213, strconv.FormatInt(fi.Size(), 10))
+}
+
+func (c *Connection) handleMDTM(arg string) {
+	fi, _, ok := c.statForInfo(arg)
+	if !ok {
+		return
+	}
+	c.writeReply(213, fi.ModTime().UTC().Format(mlstTimeFormat))
+}
+
+func (c *Connection) handleMLST(arg string) {
+	fi, ftpPath, ok := c.statForInfo(arg)
+	if !ok {
+		return
+	}
+	fact := getMLSTFact(fi)
+	c.writeMultilineReply(250, fmt.Sprintf("Listing %v", ftpPath), []string{fact + ftpPath}, "End")
+}
+
+// statForInfo checks the list permission and returns the stat result for the given path.
+// In case of errors it replies to the client and returns false
+func (c *Connection) statForInfo(arg string) (os.FileInfo, string, bool) {
+	ftpPath := c.getFTPPath(arg)
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(ftpPath)) {
+		c.writePermissionDenied("STAT", ftpPath)
+		return nil, ftpPath, false
+	}
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return nil, ftpPath, false
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "error running stat on path %#v: %v", p, err)
+		c.writeFsErrorReply(err)
+		return nil, ftpPath, false
+	}
+	return fi, ftpPath, true
+}
+
+func (c *Connection) handleList(command, arg string) {
+	// some clients send "ls" options, for example "LIST -la", we ignore them
+	args := strings.Fields(arg)
+	target := ""
+	for _, a := range args {
+		if !strings.HasPrefix(a, "-") {
+			target = a
+			break
+		}
+	}
+	ftpPath := c.getFTPPath(target)
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "error running stat on path %#v: %v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	var files []os.FileInfo
+	if fi.IsDir() {
+		if !c.User.HasPerm(dataprovider.PermListItems, ftpPath) {
+			c.writePermissionDenied(command, ftpPath)
+			return
+		}
+		c.Log(logger.LevelDebug, logSender, "requested list file for dir: %#v", p)
+		files, err = c.fs.ReadDir(p)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "error listing directory: %+v", err)
+			c.writeFsErrorReply(err)
+			return
+		}
+		files = c.User.AddVirtualDirs(files, ftpPath)
+	} else {
+		if command == "MLSD" {
+			c.writeReply(501, fmt.Sprintf("%v is not a directory", quotePath(ftpPath)))
+			return
+		}
+		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(ftpPath)) {
+			c.writePermissionDenied(command, ftpPath)
+			return
+		}
+		files = []os.FileInfo{fi}
+	}
+	if c.checkDataChannel() != nil {
+		return
+	}
+	c.writeReply(150, "Opening data connection for directory listing")
+	dataConn, err := c.getDataConnection()
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to open data connection: %v", err)
+		c.writeReply(425, "Unable to open data connection")
+		return
+	}
+	c.setTransfer(nil, dataConn)
+	_, err = io.WriteString(dataConn, formatListing(command, files))
+	c.closeDataConnection(dataConn)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error sending directory listing: %v", err)
+		c.writeReply(426, "Connection closed, transfer aborted")
+		return
+	}
+	c.writeReply(226, "Transfer complete")
+}
+
+func (c *Connection) handleRETR(arg string, offset int64) {
+	ftpPath := c.getFTPPath(arg)
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(ftpPath)) {
+		c.writePermissionDenied("RETR", ftpPath)
+		return
+	}
+	if !c.User.IsFileAllowed(ftpPath) {
+		c.Log(logger.LevelWarn, logSender, "reading file %#v is not allowed", ftpPath)
+		c.writePermissionDenied("RETR", ftpPath)
+		return
+	}
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	if !fi.Mode().IsRegular() {
+		c.writeReply(550, fmt.Sprintf("%v is not a regular file", quotePath(ftpPath)))
+		return
+	}
+	if offset > fi.Size() {
+		c.writeReply(554, fmt.Sprintf("Invalid restart offset %v, file size: %v", offset, fi.Size()))
+		return
+	}
+	maxDataTransfer, ok := c.getMaxDataTransfer(false)
+	if !ok {
+		return
+	}
+	if c.checkDataChannel() != nil {
+		return
+	}
+	c.writeReply(150, fmt.Sprintf("Opening data connection for %v", quotePath(ftpPath)))
+	dataConn, err := c.getDataConnection()
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to open data connection: %v", err)
+		c.writeReply(425, "Unable to open data connection")
+		return
+	}
+	file, r, cancelFn, err := c.fs.Open(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "could not open file %#v for reading: %+v", p, err)
+		c.closeDataConnection(dataConn)
+		c.writeFsErrorReply(err)
+		return
+	}
+	c.Log(logger.LevelDebug, logSender, "fileread requested for path: %#v, offset: %v", p, offset)
+	t := &transfer{
+		file:            file,
+		readerAt:        r,
+		cancelFn:        cancelFn,
+		path:            p,
+		start:           time.Now(),
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        utils.GetIPFromRemoteAddress(c.RemoteAddr.String()),
+		transferType:    transferDownload,
+		lastActivity:    time.Now(),
+		offset:          offset,
+		maxDataTransfer: maxDataTransfer,
+		lock:            new(sync.Mutex),
+	}
+	c.transferData(t, dataConn)
+}
+
+func (c *Connection) handleSTOR(arg string, offset int64, isAppend bool) {
+	ftpPath := c.getFTPPath(arg)
+	if !c.User.IsFileAllowed(ftpPath) {
+		c.Log(logger.LevelWarn, logSender, "writing file %#v is not allowed", ftpPath)
+		c.writePermissionDenied("STOR", ftpPath)
+		return
+	}
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	filePath := p
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		filePath = c.fs.GetAtomicUploadPath(p)
+	}
+	stat, statErr := c.fs.Stat(p)
+	if c.fs.IsNotExist(statErr) {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(ftpPath)) {
+			c.writePermissionDenied("STOR", ftpPath)
+			return
+		}
+		if offset > 0 {
+			c.writeReply(554, fmt.Sprintf("Invalid restart offset %v, the file does not exist", offset))
+			return
+		}
+		c.handleUploadToNewFile(p, filePath)
+		return
+	}
+	if statErr != nil {
+		c.Log(logger.LevelError, logSender, "error performing file stat %#v: %+v", p, statErr)
+		c.writeFsErrorReply(statErr)
+		return
+	}
+	if stat.IsDir() {
+		c.Log(logger.LevelWarn, logSender, "attempted to open a directory for writing to: %#v", p)
+		c.writeReply(550, fmt.Sprintf("%v is a directory", quotePath(ftpPath)))
+		return
+	}
+	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(ftpPath)) {
+		c.writePermissionDenied("STOR", ftpPath)
+		return
+	}
+	if isAppend {
+		offset = stat.Size()
+	}
+	c.handleUploadToExistingFile(p, filePath, stat.Size(), offset)
+}
+
+func (c *Connection) handleUploadToNewFile(requestPath, filePath string) {
+	if !c.hasSpace(true, requestPath) {
+		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
+		c.writeReply(552, "Exceeded storage allocation")
+		return
+	}
+	maxDataTransfer, ok := c.getMaxDataTransfer(true)
+	if !ok {
+		return
+	}
+	if c.checkDataChannel() != nil {
+		return
+	}
+	c.writeReply(150, "Opening data connection for file upload")
+	dataConn, err := c.getDataConnection()
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to open data connection: %v", err)
+		c.writeReply(425, "Unable to open data connection")
+		return
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, 0)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %+v", requestPath, err)
+		c.closeDataConnection(dataConn)
+		c.writeFsErrorReply(err)
+		return
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	t := &transfer{
+		file:            file,
+		writerAt:        w,
+		cancelFn:        cancelFn,
+		path:            requestPath,
+		start:           time.Now(),
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        utils.GetIPFromRemoteAddress(c.RemoteAddr.String()),
+		transferType:    transferUpload,
+		lastActivity:    time.Now(),
+		isNewFile:       true,
+		maxDataTransfer: maxDataTransfer,
+		fs:              c.fs,
+		checksum:        sftpd.NewUploadChecksum(),
+		lock:            new(sync.Mutex),
+	}
+	c.transferData(t, dataConn)
+}
+
+func (c *Connection) handleUploadToExistingFile(requestPath, filePath string, fileSize, offset int64) {
+	var err error
+	if !c.hasSpace(false, requestPath) {
+		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
+		c.writeReply(552, "Exceeded storage allocation")
+		return
+	}
+	maxDataTransfer, ok := c.getMaxDataTransfer(true)
+	if !ok {
+		return
+	}
+	isResume := offset > 0
+	if isResume && !c.fs.IsUploadResumeSupported() {
+		c.Log(logger.LevelInfo, logSender, "upload resume requested for path: %#v but not supported in fs implementation",
+			requestPath)
+		c.writeReply(550, "Upload resume is not supported for this filesystem")
+		return
+	}
+	if offset > fileSize {
+		c.writeReply(554, fmt.Sprintf("Invalid restart offset %v, file size: %v", offset, fileSize))
+		return
+	}
+	if isResume && offset != fileSize && !vfs.IsLocalOsFs(c.fs) {
+		c.writeReply(554, fmt.Sprintf("Invalid restart offset %v, uploads can only be resumed from the file size: %v",
+			offset, fileSize))
+		return
+	}
+	if c.checkDataChannel() != nil {
+		return
+	}
+	c.writeReply(150, "Opening data connection for file upload")
+	dataConn, err := c.getDataConnection()
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "unable to open data connection: %v", err)
+		c.writeReply(425, "Unable to open data connection")
+		return
+	}
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		err = c.fs.Rename(requestPath, filePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %+v",
+				requestPath, filePath, err)
+			c.closeDataConnection(dataConn)
+			c.writeFsErrorReply(err)
+			return
+		}
+	}
+	osFlags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if isResume {
+		osFlags = os.O_WRONLY
+		if !vfs.IsLocalOsFs(c.fs) {
+			osFlags |= os.O_APPEND
+		}
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, osFlags)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error opening existing file, flags: %v, source: %#v, err: %+v", osFlags,
+			filePath, err)
+		c.closeDataConnection(dataConn)
+		c.writeFsErrorReply(err)
+		return
+	}
+	initialSize := int64(0)
+	if isResume {
+		c.Log(logger.LevelDebug, logSender, "upload resume requested, file path: %#v, file size: %v, offset: %v",
+			filePath, fileSize, offset)
+		if offset < fileSize && file != nil {
+			// the data after the restart offset will be overwritten
+			if err = file.Truncate(offset); err == nil && !c.User.IsFileExcludedFromQuota(requestPath) {
+				dataprovider.UpdateUserQuota(dataProvider, c.User, 0, offset-fileSize, false)
+			}
+		}
+	} else {
+		if vfs.IsLocalOsFs(c.fs) {
+			if !c.User.IsFileExcludedFromQuota(requestPath) {
+				dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+			}
+		} else {
+			initialSize = fileSize
+		}
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	t := &transfer{
+		file:            file,
+		writerAt:        w,
+		cancelFn:        cancelFn,
+		path:            requestPath,
+		start:           time.Now(),
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        utils.GetIPFromRemoteAddress(c.RemoteAddr.String()),
+		transferType:    transferUpload,
+		lastActivity:    time.Now(),
+		offset:          offset,
+		initialSize:     initialSize,
+		maxDataTransfer: maxDataTransfer,
+		fs:              c.fs,
+		checksum:        sftpd.NewUploadChecksum(),
+		lock:            new(sync.Mutex),
+	}
+	c.transferData(t, dataConn)
+}
+
+// transferData copies data between the given transfer and the data connection,
+// then closes both and replies to the client
+func (c *Connection) transferData(t *transfer, dataConn net.Conn) {
+	c.setTransfer(t, dataConn)
+	var err error
+	if t.transferType == transferUpload {
+		_, err = io.Copy(t, dataConn)
+	} else {
+		_, err = io.Copy(dataConn, t)
+	}
+	if err != nil {
+		t.TransferError(err)
+	}
+	c.closeDataConnection(dataConn)
+	if errClose := t.Close(); errClose != nil && err == nil {
+		err = errClose
+	}
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "transfer error, path: %#v, err: %v", t.path, err)
+		if err == errDataTransferQuotaExceeded {
+			c.writeReply(552, "Data transfer quota exceeded, transfer aborted")
+			return
+		}
+		if err == errUploadFileSizeExceeded {
+			c.writeReply(552, "Maximum upload file size exceeded, transfer aborted")
+			return
+		}
+		c.writeReply(426, "Connection closed, transfer aborted")
+		return
+	}
+	c.writeReply(226, "Transfer complete")
+}
+
+func (c *Connection) closeDataConnection(dataConn net.Conn) {
+	err := dataConn.Close()
+	c.setTransfer(nil, nil)
+	c.Log(logger.LevelDebug, logSender, "data connection closed, err: %v", err)
+}
+
+func (c *Connection) handleDELE(arg string) {
+	ftpPath := c.getFTPPath(arg)
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(ftpPath)) {
+		c.writePermissionDenied("DELE", ftpPath)
+		return
+	}
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = c.fs.Lstat(p); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove a file %#v: stat error: %+v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a file/symlink", p)
+		c.writeReply(550, fmt.Sprintf("%v is a directory", quotePath(ftpPath)))
+		return
+	}
+	if !c.User.IsFileAllowed(ftpPath) {
+		c.Log(logger.LevelDebug, logSender, "removing file %#v is not allowed", p)
+		c.writePermissionDenied("DELE", ftpPath)
+		return
+	}
+	if err = c.fs.Remove(p, false); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove a file/symlink %#v: %+v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	logger.CommandLog(removeLogSender, p, "", c.User.Username, "", c.ID, protocolFTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolFTP, c.ID, c.getRemoteIP(), p, "")
+	if fi.Mode()&os.ModeSymlink != os.ModeSymlink && !c.User.IsFileExcludedFromQuota(p) {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -fi.Size(), false)
+	}
+	go sftpd.ExecuteAction(operationDelete, c.User.Username, p, "", fi.Size(), vfs.IsLocalOsFs(c.fs))
+	c.writeReply(250, "File removed")
+}
+
+func (c *Connection) handleMKD(arg string) {
+	ftpPath := c.getFTPPath(arg)
+	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(ftpPath)) {
+		c.writePermissionDenied("MKD", ftpPath)
+		return
+	}
+	if c.User.IsVirtualFolder(ftpPath) {
+		c.Log(logger.LevelWarn, logSender, "mkdir not allowed %#v is virtual folder is not allowed", ftpPath)
+		c.writePermissionDenied("MKD", ftpPath)
+		return
+	}
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	if err = c.fs.Mkdir(p); err != nil {
+		c.Log(logger.LevelWarn, logSender, "error creating missing dir: %#v error: %+v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	vfs.SetPathPermissions(c.fs, p, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog(mkdirLogSender, p, "", c.User.Username, "", c.ID, protocolFTP, -1, -1, "", "", "")
+	c.writeReply(257, fmt.Sprintf("%v created", quotePath(ftpPath)))
+}
+
+func (c *Connection) handleRMD(arg string) {
+	ftpPath := c.getFTPPath(arg)
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	if c.fs.GetRelativePath(p) == "/" {
+		c.Log(logger.LevelWarn, logSender, "removing root dir is not allowed")
+		c.writePermissionDenied("RMD", ftpPath)
+		return
+	}
+	if c.User.IsVirtualFolder(ftpPath) {
+		c.Log(logger.LevelWarn, logSender, "removing a virtual folder is not allowed: %#v", ftpPath)
+		c.writePermissionDenied("RMD", ftpPath)
+		return
+	}
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(ftpPath)) {
+		c.writePermissionDenied("RMD", ftpPath)
+		return
+	}
+	var fi os.FileInfo
+	if fi, err = c.fs.Lstat(p); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove a dir %#v: stat error: %+v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	if !fi.IsDir() || fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		c.Log(logger.LevelDebug, logSender, "cannot remove %#v is not a directory", p)
+		c.writeReply(550, fmt.Sprintf("%v is not a directory", quotePath(ftpPath)))
+		return
+	}
+	if err = c.fs.Remove(p, true); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove directory %#v: %+v", p, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	logger.CommandLog(rmdirLogSender, p, "", c.User.Username, "", c.ID, protocolFTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolFTP, c.ID, c.getRemoteIP(), p, "")
+	c.writeReply(250, "Directory removed")
+}
+
+func (c *Connection) handleRNFR(arg string) {
+	ftpPath := c.getFTPPath(arg)
+	p, err := c.fs.ResolvePath(ftpPath)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	if _, err = c.fs.Lstat(p); err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	c.renameFrom = ftpPath
+	c.writeReply(350, "File exists, ready for destination name")
+}
+
+func (c *Connection) handleRNTO(arg, renameFrom string) {
+	if len(renameFrom) == 0 {
+		c.writeReply(503, "Bad sequence of commands, send RNFR first")
+		return
+	}
+	ftpTarget := c.getFTPPath(arg)
+	sourcePath, err := c.fs.ResolvePath(renameFrom)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	targetPath, err := c.fs.ResolvePath(ftpTarget)
+	if err != nil {
+		c.writeFsErrorReply(err)
+		return
+	}
+	if c.fs.GetRelativePath(sourcePath) == "/" {
+		c.Log(logger.LevelWarn, logSender, "renaming root dir is not allowed")
+		c.writePermissionDenied("RNTO", renameFrom)
+		return
+	}
+	if c.User.IsVirtualFolder(renameFrom) || c.User.IsVirtualFolder(ftpTarget) {
+		c.Log(logger.LevelWarn, logSender, "renaming a virtual folder is not allowed")
+		c.writePermissionDenied("RNTO", renameFrom)
+		return
+	}
+	if !c.User.IsFileAllowed(renameFrom) || !c.User.IsFileAllowed(ftpTarget) {
+		if fi, err := c.fs.Lstat(sourcePath); err == nil && fi.Mode().IsRegular() {
+			c.Log(logger.LevelDebug, logSender, "renaming file is not allowed, source: %#v target: %#v", renameFrom,
+				ftpTarget)
+			c.writePermissionDenied("RNTO", renameFrom)
+			return
+		}
+	}
+	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(ftpTarget)) {
+		c.writePermissionDenied("RNTO", renameFrom)
+		return
+	}
+	// renaming a file from or to a virtual folder excluded from the quota changes the used quota
+	var quotaFileInfo os.FileInfo
+	if c.User.IsFileExcludedFromQuota(sourcePath) != c.User.IsFileExcludedFromQuota(targetPath) {
+		fi, err := c.fs.Lstat(sourcePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "failed to rename %#v: stat error: %+v", sourcePath, err)
+			c.writeFsErrorReply(err)
+			return
+		}
+		if fi.IsDir() {
+			c.Log(logger.LevelDebug, logSender, "renaming a directory between folders with different quota settings is not allowed, "+
+				"source: %#v target: %#v", renameFrom, ftpTarget)
+			c.writePermissionDenied("RNTO", renameFrom)
+			return
+		}
+		quotaFileInfo = fi
+	}
+	if err = c.fs.Rename(sourcePath, targetPath); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to rename file, source: %#v target: %#v: %+v", sourcePath, targetPath, err)
+		c.writeFsErrorReply(err)
+		return
+	}
+	vfs.SetPathPermissions(c.fs, targetPath, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog(renameLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, protocolFTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventRename, c.User.Username, protocolFTP, c.ID, c.getRemoteIP(), sourcePath, targetPath)
+	if quotaFileInfo != nil && quotaFileInfo.Mode().IsRegular() {
+		dataprovider.UpdateUserQuotaForRename(dataProvider, c.User, sourcePath, targetPath, quotaFileInfo.Size())
+	}
+	go sftpd.ExecuteAction(operationRename, c.User.Username, sourcePath, targetPath, 0, vfs.IsLocalOsFs(c.fs))
+	c.writeReply(250, "Rename successful")
+}
+
+func (c *Connection) hasSpace(checkFiles bool, fsPath string) bool {
+	if c.User.IsFileExcludedFromQuota(fsPath) {
+		return true
+	}
+	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
+		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for user %#v: %v", c.User.Username, err)
+				return true
+			}
+			c.Log(logger.LevelWarn, logSender, "error getting used quota for %#v: %v", c.User.Username, err)
+			return false
+		}
+		if (checkFiles && c.User.QuotaFiles > 0 && numFile >= c.User.QuotaFiles) ||
+			(c.User.QuotaSize > 0 && size >= c.User.QuotaSize) {
+			c.Log(logger.LevelDebug, logSender, "quota exceed for user %#v, num files: %v/%v, size: %v/%v check files: %v",
+				c.User.Username, numFile, c.User.QuotaFiles, size, c.User.QuotaSize, checkFiles)
+			return false
+		}
+	}
+	return true
+}
+
+// getMaxDataTransfer returns the data transfer, as bytes, still allowed for a new upload or download,
+// 0 means no limit. If the transfer is not allowed an error reply is sent and false is returned
+func (c *Connection) getMaxDataTransfer(isUpload bool) (int64, bool) {
+	if !c.User.HasDataTransferRestrictions() {
+		return 0, true
+	}
+	remaining, err := dataprovider.GetRemainingDataTransfer(dataProvider, c.User, isUpload)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, logSender, "data transfer quota enforcement not possible for user %#v: %v",
+				c.User.Username, err)
+			return 0, true
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used data transfer for %#v: %v", c.User.Username, err)
+		c.writeReply(451, "Unable to check the data transfer quota")
+		return 0, false
+	}
+	if remaining == 0 {
+		c.Log(logger.LevelInfo, logSender, "data transfer quota exceeded for user %#v, is upload? %v", c.User.Username,
+			isUpload)
+		c.writeReply(552, "Data transfer quota exceeded")
+		return 0, false
+	}
+	if remaining < 0 {
+		return 0, true
+	}
+	return remaining, true
+}
+
+// quotePath returns the given path quoted as described in RFC 959,
+// embedded double quotes are doubled
+func quotePath(p string) string {
+	return "\"" + strings.Replace(p, "\"", "\"\"", -1) + "\""
+}
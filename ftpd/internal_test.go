@@ -0,0 +1,98 @@
+package ftpd
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+type mockAddr struct {
+	addr string
+}
+
+func (a *mockAddr) Network() string {
+	return "tcp"
+}
+
+func (a *mockAddr) String() string {
+	return a.addr
+}
+
+func TestParseCommand(t *testing.T) {
+	command, arg := parseCommand("stor file name.txt\r\n")
+	if command != "STOR" || arg != "file name.txt" {
+		t.Errorf("unexpected command: %#v, arg: %#v", command, arg)
+	}
+	command, arg = parseCommand("PWD")
+	if command != "PWD" || arg != "" {
+		t.Errorf("unexpected command: %#v, arg: %#v", command, arg)
+	}
+}
+
+func TestQuotePath(t *testing.T) {
+	if quotePath("/dir") != "\"/dir\"" {
+		t.Errorf("unexpected quoted path: %v", quotePath("/dir"))
+	}
+	if quotePath("/a\"b") != "\"/a\"\"b\"" {
+		t.Errorf("embedded quotes must be doubled: %v", quotePath("/a\"b"))
+	}
+}
+
+func TestGetFTPPath(t *testing.T) {
+	c := Connection{cwd: "/dir"}
+	if c.getFTPPath("") != "/dir" {
+		t.Errorf("unexpected path: %v", c.getFTPPath(""))
+	}
+	if c.getFTPPath("sub/file") != "/dir/sub/file" {
+		t.Errorf("unexpected path: %v", c.getFTPPath("sub/file"))
+	}
+	if c.getFTPPath("../../..") != "/" {
+		t.Errorf("unexpected path: %v", c.getFTPPath("../../.."))
+	}
+	if c.getFTPPath("/abs") != "/abs" {
+		t.Errorf("unexpected path: %v", c.getFTPPath("/abs"))
+	}
+}
+
+func TestListingFormat(t *testing.T) {
+	if getModeString(os.ModeDir|0755) != "drwxr-xr-x" {
+		t.Errorf("unexpected mode string: %v", getModeString(os.ModeDir|0755))
+	}
+	if getModeString(os.ModeSymlink|0777) != "lrwxrwxrwx" {
+		t.Errorf("unexpected mode string: %v", getModeString(os.ModeSymlink|0777))
+	}
+	if getModeString(0644) != "-rw-r--r--" {
+		t.Errorf("unexpected mode string: %v", getModeString(0644))
+	}
+	modTime := time.Date(2010, 3, 4, 5, 6, 7, 0, time.UTC)
+	files := []os.FileInfo{vfs.NewFileInfo("file.txt", false, 123, modTime)}
+	if formatListing("NLST", files) != "file.txt\r\n" {
+		t.Errorf("unexpected nlst output: %#v", formatListing("NLST", files))
+	}
+	if formatListing("MLSD", files) != "type=file;size=123;modify=20100304050607; file.txt\r\n" {
+		t.Errorf("unexpected mlsd output: %#v", formatListing("MLSD", files))
+	}
+	list := formatListing("LIST", files)
+	if !strings.Contains(list, "2010 file.txt") {
+		t.Errorf("unexpected list output: %#v", list)
+	}
+}
+
+func TestCheckActiveAddress(t *testing.T) {
+	c := Connection{RemoteAddr: &mockAddr{addr: "127.0.0.1:4567"}}
+	if err := c.checkActiveAddress("127.0.0.1", 2000); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.checkActiveAddress("127.0.0.1", 21); err == nil {
+		t.Error("privileged ports must be refused")
+	}
+	if err := c.checkActiveAddress("192.168.1.1", 2000); err != errThirdPartyDataAddress {
+		t.Errorf("third party addresses must be refused: %v", err)
+	}
+	if err := c.checkActiveAddress("invalid", 2000); err != errInvalidActiveAddress {
+		t.Errorf("invalid addresses must be refused: %v", err)
+	}
+}
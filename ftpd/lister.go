@@ -0,0 +1,64 @@
+package ftpd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	mlstTimeFormat = "20060102150405"
+)
+
+// formatListing returns the directory listing for the given command:
+// LIST returns an "ls -l" like output, NLST only the names and MLSD
+// the machine readable format described in RFC 3659
+func formatListing(command string, files []os.FileInfo) string {
+	var b strings.Builder
+	for _, fi := range files {
+		switch command {
+		case "NLST":
+			b.WriteString(fi.Name())
+		case "MLSD":
+			b.WriteString(getMLSTFact(fi))
+			b.WriteString(fi.Name())
+		default:
+			b.WriteString(getListLine(fi))
+		}
+		b.WriteString("\r\n")
+	}
+	return b.String()
+}
+
+func getListLine(fi os.FileInfo) string {
+	modTime := fi.ModTime()
+	var timeString string
+	if time.Since(modTime) < 180*24*time.Hour {
+		timeString = modTime.Format("Jan _2 15:04")
+	} else {
+		timeString = modTime.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%v 1 ftp ftp %12d %v %v", getModeString(fi.Mode()), fi.Size(), timeString, fi.Name())
+}
+
+// getModeString returns the mode as expected by FTP clients,
+// for example "drwxr-xr-x"
+func getModeString(mode os.FileMode) string {
+	fileType := "-"
+	if mode.IsDir() {
+		fileType = "d"
+	} else if mode&os.ModeSymlink != 0 {
+		fileType = "l"
+	}
+	perms := mode.Perm().String()
+	return fileType + perms[1:]
+}
+
+func getMLSTFact(fi os.FileInfo) string {
+	fileType := "file"
+	if fi.IsDir() {
+		fileType = "dir"
+	}
+	return fmt.Sprintf("type=%v;size=%v;modify=%v; ", fileType, fi.Size(), fi.ModTime().UTC().Format(mlstTimeFormat))
+}
@@ -0,0 +1,306 @@
+package ftpd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+	"github.com/eikenb/pipeat"
+)
+
+const (
+	transferUpload = iota
+	transferDownload
+)
+
+const (
+	// same values as the SFTP upload modes
+	uploadModeAtomicWithResume = 2
+)
+
+var (
+	errTransferClosed            = errors.New("transfer already closed")
+	errDataTransferQuotaExceeded = errors.New("denying transfer due to data transfer quota limit")
+	errUploadFileSizeExceeded    = errors.New("denying write due to maximum upload file size limit")
+)
+
+// transfer contains the details for an FTP upload or download.
+// It implements the io Reader and Writer interfaces so the data connection
+// can be directly copied to/from it
+type transfer struct {
+	file          *os.File
+	writerAt      vfs.PipeWriter
+	readerAt      *pipeat.PipeReaderAt
+	cancelFn      func()
+	path          string
+	start         time.Time
+	bytesSent     int64
+	bytesReceived int64
+	user          dataprovider.User
+	connectionID  string
+	remoteIP      string
+	transferType  int
+	lastActivity  time.Time
+	isNewFile     bool
+	transferError error
+	isFinished    bool
+	// restart offset, for uploads this is the minimum write offset
+	offset      int64
+	initialSize int64
+	// data transfer, as bytes, allowed for this transfer, 0 means no limit
+	maxDataTransfer int64
+	// filesystem and checksum for the uploads, the checksum is nil if disabled
+	fs       vfs.Fs
+	checksum *sftpd.UploadChecksum
+	lock     *sync.Mutex
+}
+
+// Read reads the file to download starting from the restart offset, if any.
+// It handles download bandwidth throttling too
+func (t *transfer) Read(p []byte) (int, error) {
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	off := t.offset + t.bytesSent
+	remaining := t.maxDataTransfer - t.bytesSent
+	t.lock.Unlock()
+	if t.maxDataTransfer > 0 {
+		if remaining <= 0 {
+			t.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	var n int
+	var err error
+	if t.readerAt != nil {
+		n, err = t.readerAt.ReadAt(p, off)
+	} else {
+		n, err = t.file.ReadAt(p, off)
+	}
+	t.lock.Lock()
+	t.bytesSent += int64(n)
+	t.lock.Unlock()
+	if err != nil && err != io.EOF {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, err
+}
+
+// Write writes the received data to the uploaded file starting from the restart offset, if any.
+// It handles upload bandwidth throttling too
+func (t *transfer) Write(p []byte) (int, error) {
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	off := t.offset + t.bytesReceived
+	exceeded := t.maxDataTransfer > 0 && t.bytesReceived+int64(len(p)) > t.maxDataTransfer
+	t.lock.Unlock()
+	if exceeded {
+		t.TransferError(errDataTransferQuotaExceeded)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if !t.user.IsUploadSizeAllowed(off + int64(len(p))) {
+		t.TransferError(errUploadFileSizeExceeded)
+		return 0, errUploadFileSizeExceeded
+	}
+	var n int
+	var err error
+	if t.writerAt != nil {
+		// for resumed uploads the pipe starts at the restart offset
+		n, err = t.writerAt.WriteAt(p, off-t.offset)
+	} else {
+		n, err = t.file.WriteAt(p, off)
+	}
+	t.lock.Lock()
+	t.bytesReceived += int64(n)
+	t.lock.Unlock()
+	t.checksum.Update(p[:n], off)
+	if err != nil {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, err
+}
+
+// TransferError is called if there is an unexpected error.
+// For example network or client issues
+func (t *transfer) TransferError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.transferError != nil {
+		return
+	}
+	t.transferError = err
+	if t.cancelFn != nil {
+		t.cancelFn()
+	}
+	elapsed := time.Since(t.start).Nanoseconds() / 1000000
+	logger.Warn(logSender, t.connectionID, "Unexpected error for transfer, path: %#v, error: \"%v\" bytes sent: %v, "+
+		"bytes received: %v transfer running since %v ms", t.path, t.transferError, t.bytesSent, t.bytesReceived, elapsed)
+}
+
+// Close it is called when the transfer is completed.
+// It closes the underlying file, logs the transfer info, updates the user quota (for uploads)
+// and the used data transfer and executes any defined action.
+// If there is an error no action will be executed and, in atomic mode, we try to delete
+// the temporary file
+func (t *transfer) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isFinished {
+		return errTransferClosed
+	}
+	err := t.closeIO()
+	t.isFinished = true
+	numFiles := 0
+	if t.isNewFile {
+		numFiles = 1
+	}
+	metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, protocolFTP, time.Since(t.start), t.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, t.user, t.bytesReceived, t.bytesSent)
+	var scanErr error
+	if t.transferType == transferUpload && t.file != nil && t.transferError == nil {
+		scanErr = sftpd.ScanUpload(t.file.Name(), t.path, t.user.Username, t.connectionID, t.bytesReceived)
+		if scanErr != nil {
+			t.transferError = scanErr
+			numFiles--
+			t.bytesReceived = 0
+		}
+	}
+	if t.transferType == transferUpload && t.file != nil && t.file.Name() != t.path && scanErr == nil {
+		if t.transferError == nil || sftpd.GetUserUploadMode(t.user) == uploadModeAtomicWithResume {
+			err = os.Rename(t.file.Name(), t.path)
+			logger.Debug(logSender, t.connectionID, "atomic upload completed, rename: %#v -> %#v, error: %v",
+				t.file.Name(), t.path, err)
+		} else {
+			err = os.Remove(t.file.Name())
+			logger.Warn(logSender, t.connectionID, "atomic upload completed with error: \"%v\", delete temporary file: %#v, "+
+				"deletion error: %v", t.transferError, t.file.Name(), err)
+			if err == nil {
+				numFiles--
+				t.bytesReceived = 0
+			}
+		}
+	}
+	if t.transferError == nil {
+		elapsed := time.Since(t.start).Nanoseconds() / 1000000
+		if t.transferType == transferDownload {
+			logger.TransferLog(downloadLogSender, t.path, elapsed, t.bytesSent, t.user.Username, t.connectionID, protocolFTP)
+			go sftpd.ExecuteAction(operationDownload, t.user.Username, t.path, "", t.bytesSent, (t.file != nil))
+		} else {
+			logger.TransferLog(uploadLogSender, t.path, elapsed, t.bytesReceived, t.user.Username, t.connectionID, protocolFTP)
+			if err == nil {
+				t.storeChecksum()
+			}
+			go sftpd.ExecuteAction(operationUpload, t.user.Username, t.path, "", t.bytesReceived+t.offset, (t.file != nil))
+		}
+	} else {
+		logger.Warn(logSender, t.connectionID, "transfer error: %v, path: %#v", t.transferError, t.path)
+		if err == nil {
+			err = t.transferError
+		}
+	}
+	if t.transferType == transferDownload {
+		audit.LogTransfer(false, t.user.Username, protocolFTP, t.connectionID, t.remoteIP, t.path, t.bytesSent,
+			time.Since(t.start), t.transferError)
+	} else {
+		audit.LogTransfer(true, t.user.Username, protocolFTP, t.connectionID, t.remoteIP, t.path, t.bytesReceived,
+			time.Since(t.start), t.transferError)
+	}
+	t.updateQuota(numFiles)
+	return err
+}
+
+func (t *transfer) storeChecksum() {
+	if t.fs == nil {
+		return
+	}
+	localPath := ""
+	if t.file != nil {
+		localPath = t.path
+	}
+	t.checksum.Store(t.fs, t.path, localPath, t.connectionID)
+}
+
+func (t *transfer) closeIO() error {
+	var err error
+	if t.writerAt != nil {
+		err = t.writerAt.Close()
+	} else if t.readerAt != nil {
+		err = t.readerAt.Close()
+	} else {
+		err = t.file.Close()
+	}
+	return err
+}
+
+func (t *transfer) updateQuota(numFiles int) bool {
+	// uploads to remote filesystems are atomic, if there is an error nothing is uploaded
+	if t.file == nil && t.transferError != nil {
+		return false
+	}
+	if t.user.IsFileExcludedFromQuota(t.path) {
+		return false
+	}
+	if t.transferType == transferUpload && (numFiles != 0 || t.bytesReceived > 0) {
+		dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, t.bytesReceived-t.initialSize, false)
+		return true
+	}
+	return false
+}
+
+func (t *transfer) handleThrottle(size int) {
+	var wantedBandwidth int64
+	var trasferredBytes int64
+	t.lock.Lock()
+	if t.transferType == transferDownload {
+		wantedBandwidth = t.user.DownloadBandwidth
+		trasferredBytes = t.bytesSent
+	} else {
+		wantedBandwidth = t.user.UploadBandwidth
+		trasferredBytes = t.bytesReceived
+	}
+	t.lock.Unlock()
+	if wantedBandwidth > 0 {
+		// real and wanted elapsed as milliseconds, bytes as kilobytes
+		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
+		// trasferredBytes / 1000 = KB/s, we multiply for 1000 to get milliseconds
+		wantedElapsed := 1000 * (trasferredBytes / 1000) / wantedBandwidth
+		if wantedElapsed > realElapsed {
+			toSleep := time.Duration(wantedElapsed - realElapsed)
+			time.Sleep(toSleep * time.Millisecond)
+		}
+	}
+	bandwidth.Throttle(t.remoteIP, protocolFTP, t.transferType == transferUpload, int64(size))
+}
+
+func (t *transfer) getStats() sftpd.ConnectionTransfer {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	operationType := operationUpload
+	size := t.bytesReceived
+	if t.transferType == transferDownload {
+		operationType = operationDownload
+		size = t.bytesSent
+	}
+	return sftpd.ConnectionTransfer{
+		OperationType: operationType,
+		StartTime:     utils.GetTimeAsMsSinceEpoch(t.start),
+		Size:          size,
+		LastActivity:  utils.GetTimeAsMsSinceEpoch(t.lastActivity),
+	}
+}
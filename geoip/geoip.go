@@ -0,0 +1,179 @@
+// Package geoip resolves the country of the client IP addresses using a MaxMind DB,
+// for example GeoLite2 Country, and evaluates the country based login restrictions.
+// The restrictions can be defined globally and per user
+package geoip
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const logSender = "geoip"
+
+// UnknownCountry is the user assigned ISO 3166 code used for the IP addresses without a country,
+// for example the private networks. It can be used inside the allowed and denied countries
+const UnknownCountry = "ZZ"
+
+var (
+	mutex         sync.RWMutex
+	reader        *mmdbReader
+	currentConfig Config
+)
+
+// Config defines the GeoIP configuration
+type Config struct {
+	// Path to a MaxMind DB with country data, for example GeoLite2-Country.mmdb.
+	// This can be an absolute path or a path relative to the config dir.
+	// Leave empty to disable GeoIP
+	DatabasePath string `json:"database_path" mapstructure:"database_path"`
+	// logins are allowed only from these countries, 2 letter ISO 3166 codes
+	AllowedCountries []string `json:"allowed_countries" mapstructure:"allowed_countries"`
+	// logins are not allowed from these countries.
+	// Denied countries are evaluated before the allowed ones
+	DeniedCountries []string `json:"denied_countries" mapstructure:"denied_countries"`
+}
+
+func (c *Config) validate() error {
+	if len(c.DatabasePath) == 0 && (len(c.AllowedCountries) > 0 || len(c.DeniedCountries) > 0) {
+		return fmt.Errorf("country restrictions require a GeoIP database")
+	}
+	var err error
+	if c.AllowedCountries, err = NormalizeCountryCodes(c.AllowedCountries); err != nil {
+		return err
+	}
+	c.DeniedCountries, err = NormalizeCountryCodes(c.DeniedCountries)
+	return err
+}
+
+// Initialize loads the configured GeoIP database
+func Initialize(config Config, configDir string) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	if len(config.DatabasePath) == 0 {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reader = nil
+		currentConfig = config
+		return nil
+	}
+	dbPath := config.DatabasePath
+	if !filepath.IsAbs(dbPath) {
+		dbPath = filepath.Join(configDir, dbPath)
+	}
+	buf, err := ioutil.ReadFile(dbPath)
+	if err != nil {
+		return err
+	}
+	r, err := newMMDBReader(buf)
+	if err != nil {
+		return err
+	}
+	mutex.Lock()
+	reader = r
+	currentConfig = config
+	mutex.Unlock()
+
+	logger.Info(logSender, "", "GeoIP database %#v loaded, type: %#v, allowed countries: %v, denied countries: %v",
+		dbPath, r.databaseType, config.AllowedCountries, config.DeniedCountries)
+	return nil
+}
+
+// IsEnabled returns true if a GeoIP database is loaded
+func IsEnabled() bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return reader != nil
+}
+
+// NormalizeCountryCodes validates the given ISO 3166 country codes and returns them upper case
+func NormalizeCountryCodes(codes []string) ([]string, error) {
+	result := make([]string, 0, len(codes))
+	for _, code := range codes {
+		c := strings.ToUpper(strings.TrimSpace(code))
+		if len(c) != 2 || c[0] < 'A' || c[0] > 'Z' || c[1] < 'A' || c[1] > 'Z' {
+			return result, fmt.Errorf("invalid country code %#v", code)
+		}
+		if !utils.IsStringInSlice(c, result) {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// GetCountry returns the ISO 3166 country code for the given IP address.
+// UnknownCountry is returned if the IP address has no country or GeoIP is disabled
+func GetCountry(ip string) string {
+	mutex.RLock()
+	r := reader
+	mutex.RUnlock()
+	if r == nil {
+		return UnknownCountry
+	}
+	parsedIP := net.ParseIP(ip)
+	if parsedIP == nil {
+		return UnknownCountry
+	}
+	record, err := r.lookup(parsedIP)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to lookup IP %v: %v", ip, err)
+		return UnknownCountry
+	}
+	if country := getCountryFromRecord(record); len(country) > 0 {
+		return country
+	}
+	return UnknownCountry
+}
+
+func getCountryFromRecord(record interface{}) string {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	// the registered country is used for the networks without a country, for example anycast ones
+	for _, key := range []string{"country", "registered_country"} {
+		if country, ok := m[key].(map[string]interface{}); ok {
+			if code, ok := country["iso_code"].(string); ok && len(code) > 0 {
+				return strings.ToUpper(code)
+			}
+		}
+	}
+	return ""
+}
+
+// HasRestrictions returns true if there are global country restrictions or the given ones are not empty
+func HasRestrictions(allowedCountries, deniedCountries []string) bool {
+	if len(allowedCountries) > 0 || len(deniedCountries) > 0 {
+		return true
+	}
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(currentConfig.AllowedCountries) > 0 || len(currentConfig.DeniedCountries) > 0
+}
+
+// IsLoginAllowed returns true if the login is allowed from the country of the given IP address
+// and the detected country. The global restrictions are evaluated before the given ones, if
+// an IP is both allowed and denied then login will be denied
+func IsLoginAllowed(ip string, allowedCountries, deniedCountries []string) (bool, string) {
+	country := GetCountry(ip)
+	mutex.RLock()
+	globalAllowed := currentConfig.AllowedCountries
+	globalDenied := currentConfig.DeniedCountries
+	mutex.RUnlock()
+	return isCountryAllowed(country, globalAllowed, globalDenied) &&
+		isCountryAllowed(country, allowedCountries, deniedCountries), country
+}
+
+func isCountryAllowed(country string, allowedCountries, deniedCountries []string) bool {
+	if utils.IsStringInSlice(country, deniedCountries) {
+		return false
+	}
+	return len(allowedCountries) == 0 || utils.IsStringInSlice(country, allowedCountries)
+}
@@ -0,0 +1,341 @@
+package geoip
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the helpers below write a minimal MaxMind DB for the tests
+
+type testNode struct {
+	children [2]*testNode
+	data     [2]int
+}
+
+type testNetwork struct {
+	cidr string
+	data []byte
+}
+
+func encodeTestCtrl(dataType int, size int) []byte {
+	if dataType > 7 {
+		return []byte{byte(size), byte(dataType - 7)}
+	}
+	return []byte{byte(dataType<<5 | size)}
+}
+
+func encodeTestString(s string) []byte {
+	return append(encodeTestCtrl(mmdbTypeString, len(s)), []byte(s)...)
+}
+
+func encodeTestUint(dataType int, v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	for len(b) > 0 && b[0] == 0 {
+		b = b[1:]
+	}
+	return append(encodeTestCtrl(dataType, len(b)), b...)
+}
+
+func encodeTestMap(pairs ...[]byte) []byte {
+	result := encodeTestCtrl(mmdbTypeMap, len(pairs)/2)
+	for _, p := range pairs {
+		result = append(result, p...)
+	}
+	return result
+}
+
+func encodeTestCountry(key, isoCode string) []byte {
+	return encodeTestMap(encodeTestString(key), encodeTestMap(encodeTestString("iso_code"), encodeTestString(isoCode)))
+}
+
+func buildTestDatabase(t *testing.T, ipVersion int, recordSize int, networks []testNetwork) []byte {
+	root := &testNode{data: [2]int{-1, -1}}
+	var dataSection []byte
+	for _, n := range networks {
+		_, ipNet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			t.Fatalf("invalid network %v: %v", n.cidr, err)
+		}
+		ip := ipNet.IP
+		ones, bits := ipNet.Mask.Size()
+		if ipVersion == 6 && bits == 32 {
+			ip = ip.To16()
+			ip[10] = 0
+			ip[11] = 0
+			ones += 96
+		}
+		node := root
+		for i := 0; i < ones; i++ {
+			bit := (ip[i/8] >> (7 - uint(i%8))) & 1
+			if i == ones-1 {
+				node.data[bit] = len(dataSection)
+				break
+			}
+			if node.children[bit] == nil {
+				node.children[bit] = &testNode{data: [2]int{-1, -1}}
+			}
+			node = node.children[bit]
+		}
+		dataSection = append(dataSection, n.data...)
+	}
+	var nodes []*testNode
+	var walk func(n *testNode)
+	walk = func(n *testNode) {
+		nodes = append(nodes, n)
+		for _, c := range n.children {
+			if c != nil {
+				walk(c)
+			}
+		}
+	}
+	walk(root)
+	index := make(map[*testNode]int)
+	for i, n := range nodes {
+		index[n] = i
+	}
+	nodeCount := len(nodes)
+	var tree []byte
+	for _, n := range nodes {
+		var records [2]uint32
+		for bit := 0; bit < 2; bit++ {
+			switch {
+			case n.children[bit] != nil:
+				records[bit] = uint32(index[n.children[bit]])
+			case n.data[bit] >= 0:
+				records[bit] = uint32(nodeCount + mmdbDataSectionSeparatorSize + n.data[bit])
+			default:
+				records[bit] = uint32(nodeCount)
+			}
+		}
+		switch recordSize {
+		case 24:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte(records[1]>>16), byte(records[1]>>8), byte(records[1]))
+		case 28:
+			tree = append(tree, byte(records[0]>>16), byte(records[0]>>8), byte(records[0]),
+				byte((records[0]>>20)&0xF0|(records[1]>>24)&0x0F), byte(records[1]>>16), byte(records[1]>>8),
+				byte(records[1]))
+		default:
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint32(b[0:4], records[0])
+			binary.BigEndian.PutUint32(b[4:8], records[1])
+			tree = append(tree, b...)
+		}
+	}
+	result := append(tree, make([]byte, mmdbDataSectionSeparatorSize)...)
+	result = append(result, dataSection...)
+	result = append(result, mmdbMetadataMarker...)
+	result = append(result, encodeTestMap(
+		encodeTestString("node_count"), encodeTestUint(mmdbTypeUint32, uint32(nodeCount)),
+		encodeTestString("record_size"), encodeTestUint(mmdbTypeUint16, uint32(recordSize)),
+		encodeTestString("ip_version"), encodeTestUint(mmdbTypeUint16, uint32(ipVersion)),
+		encodeTestString("database_type"), encodeTestString("Test-Country"),
+	)...)
+	return result
+}
+
+func getTestNetworks() []testNetwork {
+	italy := encodeTestCountry("country", "IT")
+	// the second Italian network points to the first record
+	pointer := []byte{mmdbTypePointer << 5, 0}
+	return []testNetwork{
+		{cidr: "2.0.0.0/8", data: italy},
+		{cidr: "5.1.0.0/16", data: pointer},
+		{cidr: "3.0.0.0/8", data: encodeTestCountry("registered_country", "us")},
+		{cidr: "4.4.4.0/24", data: encodeTestMap(encodeTestString("country"),
+			encodeTestMap(encodeTestString("geoname_id"), encodeTestUint(mmdbTypeUint32, 3017382),
+				encodeTestString("iso_code"), encodeTestString("FR"),
+				encodeTestString("is_in_european_union"), encodeTestCtrl(mmdbTypeBool, 1)))},
+		{cidr: "2001:db8::/32", data: encodeTestCountry("country", "DE")},
+	}
+}
+
+func writeTestDatabase(t *testing.T, ipVersion int, recordSize int) string {
+	var networks []testNetwork
+	for _, n := range getTestNetworks() {
+		if ip, _, _ := net.ParseCIDR(n.cidr); ipVersion == 4 && ip.To4() == nil {
+			continue
+		}
+		networks = append(networks, n)
+	}
+	dbPath := filepath.Join(os.TempDir(), "test_country.mmdb")
+	err := ioutil.WriteFile(dbPath, buildTestDatabase(t, ipVersion, recordSize, networks), 0666)
+	if err != nil {
+		t.Fatalf("unable to write test database: %v", err)
+	}
+	return dbPath
+}
+
+func TestGetCountry(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		for _, recordSize := range []int{24, 28, 32} {
+			dbPath := writeTestDatabase(t, ipVersion, recordSize)
+			err := Initialize(Config{DatabasePath: dbPath}, os.TempDir())
+			if err != nil {
+				t.Fatalf("unable to initialize GeoIP, IP version %v, record size %v: %v", ipVersion, recordSize, err)
+			}
+			if !IsEnabled() {
+				t.Errorf("GeoIP must be enabled")
+			}
+			expected := map[string]string{
+				"2.3.4.5":   "IT",
+				"5.1.2.3":   "IT",
+				"5.2.2.3":   UnknownCountry,
+				"3.3.3.3":   "US",
+				"4.4.4.4":   "FR",
+				"4.4.5.4":   UnknownCountry,
+				"10.0.0.1":  UnknownCountry,
+				"::1":       UnknownCountry,
+				"invalidip": UnknownCountry,
+			}
+			if ipVersion == 6 {
+				expected["2001:db8::1"] = "DE"
+				expected["2001:db9::1"] = UnknownCountry
+			} else {
+				expected["2001:db8::1"] = UnknownCountry
+			}
+			for ip, country := range expected {
+				if c := GetCountry(ip); c != country {
+					t.Errorf("unexpected country for %v, IP version %v, record size %v: %#v, expected: %#v", ip,
+						ipVersion, recordSize, c, country)
+				}
+			}
+			os.Remove(dbPath)
+		}
+	}
+	err := Initialize(Config{}, os.TempDir())
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if IsEnabled() {
+		t.Errorf("GeoIP must be disabled")
+	}
+	if GetCountry("2.3.4.5") != UnknownCountry {
+		t.Errorf("the country must be unknown with GeoIP disabled")
+	}
+}
+
+func TestInitializeErrors(t *testing.T) {
+	err := Initialize(Config{AllowedCountries: []string{"IT"}}, os.TempDir())
+	if err == nil {
+		t.Errorf("country restrictions without a database must fail")
+	}
+	dbPath := writeTestDatabase(t, 6, 24)
+	err = Initialize(Config{DatabasePath: dbPath, DeniedCountries: []string{"ITA"}}, os.TempDir())
+	if err == nil {
+		t.Errorf("invalid country codes must fail")
+	}
+	err = Initialize(Config{DatabasePath: filepath.Base(dbPath) + ".missing"}, os.TempDir())
+	if err == nil {
+		t.Errorf("a missing database must fail")
+	}
+	invalidDatabases := [][]byte{
+		[]byte("invalid database"),
+		append(make([]byte, 32), mmdbMetadataMarker...),
+		buildTestDatabase(t, 5, 24, nil),
+		buildTestDatabase(t, 6, 20, nil),
+	}
+	buf, err := ioutil.ReadFile(dbPath)
+	if err != nil {
+		t.Fatalf("unable to read test database: %v", err)
+	}
+	// truncate the search tree
+	invalidDatabases = append(invalidDatabases, buf[len(buf)-150:])
+	for _, b := range invalidDatabases {
+		err = ioutil.WriteFile(dbPath, b, 0666)
+		if err != nil {
+			t.Fatalf("unable to write test database: %v", err)
+		}
+		err = Initialize(Config{DatabasePath: filepath.Base(dbPath)}, os.TempDir())
+		if err == nil {
+			t.Errorf("an invalid database must fail")
+		}
+	}
+	os.Remove(dbPath)
+	Initialize(Config{}, os.TempDir())
+}
+
+func TestNormalizeCountryCodes(t *testing.T) {
+	codes, err := NormalizeCountryCodes([]string{"it", " DE ", "IT"})
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(codes) != 2 || codes[0] != "IT" || codes[1] != "DE" {
+		t.Errorf("unexpected country codes: %v", codes)
+	}
+	for _, code := range []string{"", "I", "ITA", "1T", "I-"} {
+		_, err = NormalizeCountryCodes([]string{code})
+		if err == nil {
+			t.Errorf("country code %#v must be invalid", code)
+		}
+	}
+}
+
+func TestIsLoginAllowed(t *testing.T) {
+	dbPath := writeTestDatabase(t, 6, 28)
+	err := Initialize(Config{DatabasePath: dbPath}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize GeoIP: %v", err)
+	}
+	if HasRestrictions(nil, nil) {
+		t.Errorf("no restrictions expected")
+	}
+	if !HasRestrictions([]string{"IT"}, nil) || !HasRestrictions(nil, []string{"IT"}) {
+		t.Errorf("user restrictions expected")
+	}
+	allowed, country := IsLoginAllowed("2.3.4.5", []string{"IT"}, nil)
+	if !allowed || country != "IT" {
+		t.Errorf("login must be allowed, country: %#v", country)
+	}
+	allowed, _ = IsLoginAllowed("3.3.3.3", []string{"IT"}, nil)
+	if allowed {
+		t.Errorf("login must be denied for a country not allowed")
+	}
+	allowed, _ = IsLoginAllowed("2.3.4.5", []string{"IT"}, []string{"IT"})
+	if allowed {
+		t.Errorf("login must be denied for a country both allowed and denied")
+	}
+	allowed, _ = IsLoginAllowed("10.0.0.1", []string{"IT", UnknownCountry}, nil)
+	if !allowed {
+		t.Errorf("login must be allowed for the unknown country")
+	}
+	err = Initialize(Config{
+		DatabasePath:     dbPath,
+		AllowedCountries: []string{"it", "us"},
+		DeniedCountries:  []string{"fr"},
+	}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize GeoIP: %v", err)
+	}
+	if !HasRestrictions(nil, nil) {
+		t.Errorf("global restrictions expected")
+	}
+	allowed, _ = IsLoginAllowed("3.3.3.3", nil, nil)
+	if !allowed {
+		t.Errorf("login must be allowed for a globally allowed country")
+	}
+	allowed, _ = IsLoginAllowed("4.4.4.4", nil, nil)
+	if allowed {
+		t.Errorf("login must be denied for a globally denied country")
+	}
+	// the global restrictions are evaluated before the user ones
+	allowed, _ = IsLoginAllowed("4.4.4.4", []string{"FR"}, nil)
+	if allowed {
+		t.Errorf("login must be denied for a globally denied country")
+	}
+	allowed, _ = IsLoginAllowed("3.3.3.3", []string{"IT"}, nil)
+	if allowed {
+		t.Errorf("login must be denied for a country not allowed for the user")
+	}
+	allowed, _ = IsLoginAllowed("[2001:db8::1]", nil, nil)
+	if allowed {
+		t.Errorf("login must be denied for an invalid IP")
+	}
+	os.Remove(dbPath)
+	Initialize(Config{}, os.TempDir())
+}
@@ -0,0 +1,326 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+)
+
+// MaxMind DB data types, type 0 means extended type
+const (
+	mmdbTypeExtended  = 0
+	mmdbTypePointer   = 1
+	mmdbTypeString    = 2
+	mmdbTypeDouble    = 3
+	mmdbTypeBytes     = 4
+	mmdbTypeUint16    = 5
+	mmdbTypeUint32    = 6
+	mmdbTypeMap       = 7
+	mmdbTypeInt32     = 8
+	mmdbTypeUint64    = 9
+	mmdbTypeUint128   = 10
+	mmdbTypeArray     = 11
+	mmdbTypeContainer = 12
+	mmdbTypeEndMarker = 13
+	mmdbTypeBool      = 14
+	mmdbTypeFloat     = 15
+)
+
+const (
+	// the metadata section starts after the last occurrence of this marker
+	mmdbMetadataMaxSize = 128 * 1024
+	// the data section starts after the search tree and 16 zero bytes
+	mmdbDataSectionSeparatorSize = 16
+	// maximum nesting level for maps and arrays
+	mmdbMaxDepth = 32
+)
+
+var (
+	mmdbMetadataMarker = []byte("\xAB\xCD\xEFMaxMind.com")
+	errInvalidDatabase = errors.New("invalid MaxMind DB")
+)
+
+// mmdbReader is a minimal reader for the MaxMind DB format as described here:
+//
+// https://maxmind.github.io/MaxMind-DB/
+type mmdbReader struct {
+	nodeCount      uint
+	recordSize     uint
+	ipVersion      uint
+	databaseType   string
+	nodeByteSize   uint
+	searchTree     []byte
+	dataSection    []byte
+	ipv4StartNode  uint
+	ipv4StartDepth int
+}
+
+func newMMDBReader(buf []byte) (*mmdbReader, error) {
+	start := len(buf) - mmdbMetadataMaxSize
+	if start < 0 {
+		start = 0
+	}
+	idx := bytes.LastIndex(buf[start:], mmdbMetadataMarker)
+	if idx < 0 {
+		return nil, fmt.Errorf("%v: metadata not found", errInvalidDatabase)
+	}
+	metadataStart := start + idx + len(mmdbMetadataMarker)
+	metadata, _, err := decodeMMDBValue(buf[metadataStart:], 0, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%v: unable to decode metadata: %v", errInvalidDatabase, err)
+	}
+	m, ok := metadata.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%v: unexpected metadata type", errInvalidDatabase)
+	}
+	r := &mmdbReader{
+		nodeCount:  getUintFromMetadata(m, "node_count"),
+		recordSize: getUintFromMetadata(m, "record_size"),
+		ipVersion:  getUintFromMetadata(m, "ip_version"),
+	}
+	r.databaseType, _ = m["database_type"].(string)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("%v: unsupported record size %v", errInvalidDatabase, r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("%v: unsupported IP version %v", errInvalidDatabase, r.ipVersion)
+	}
+	r.nodeByteSize = r.recordSize / 4
+	searchTreeSize := r.nodeCount * r.nodeByteSize
+	dataStart := searchTreeSize + mmdbDataSectionSeparatorSize
+	if r.nodeCount == 0 || dataStart > uint(start+idx) {
+		return nil, fmt.Errorf("%v: invalid search tree size", errInvalidDatabase)
+	}
+	r.searchTree = buf[:searchTreeSize]
+	r.dataSection = buf[dataStart : start+idx]
+	// IPv4 addresses are stored as ::a.b.c.d inside IPv6 databases
+	if r.ipVersion == 6 {
+		node := uint(0)
+		depth := 0
+		for ; depth < 96 && node < r.nodeCount; depth++ {
+			node = r.readRecord(node, 0)
+		}
+		r.ipv4StartNode = node
+		r.ipv4StartDepth = depth
+	}
+	return r, nil
+}
+
+func getUintFromMetadata(m map[string]interface{}, key string) uint {
+	if v, ok := m[key].(uint64); ok {
+		return uint(v)
+	}
+	return 0
+}
+
+// readRecord returns the left (bit 0) or the right (bit 1) record of the given node
+func (r *mmdbReader) readRecord(node uint, bit uint) uint {
+	b := r.searchTree[node*r.nodeByteSize : (node+1)*r.nodeByteSize]
+	switch r.recordSize {
+	case 24:
+		if bit == 0 {
+			return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3])<<16 | uint(b[4])<<8 | uint(b[5])
+	case 28:
+		if bit == 0 {
+			return uint(b[3]&0xF0)<<20 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0F)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		if bit == 0 {
+			return uint(binary.BigEndian.Uint32(b[0:4]))
+		}
+		return uint(binary.BigEndian.Uint32(b[4:8]))
+	}
+}
+
+// lookup returns the data record for the given IP, nil if the IP is not found
+func (r *mmdbReader) lookup(ip net.IP) (interface{}, error) {
+	node := uint(0)
+	depth := 0
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		if r.ipVersion == 6 {
+			node = r.ipv4StartNode
+			depth = r.ipv4StartDepth
+		}
+	} else if r.ipVersion == 4 {
+		return nil, nil
+	}
+	bitCount := len(ip) * 8
+	for i := 0; i < bitCount && node < r.nodeCount; i++ {
+		bit := uint(ip[i>>3]>>(7-uint(i%8))) & 1
+		node = r.readRecord(node, bit)
+		depth++
+	}
+	if node == r.nodeCount {
+		return nil, nil
+	}
+	if node < r.nodeCount {
+		return nil, fmt.Errorf("%v: search tree depth %v exceeded", errInvalidDatabase, depth)
+	}
+	offset := node - r.nodeCount - mmdbDataSectionSeparatorSize
+	if offset >= uint(len(r.dataSection)) {
+		return nil, fmt.Errorf("%v: data offset %v out of range", errInvalidDatabase, offset)
+	}
+	value, _, err := decodeMMDBValue(r.dataSection, offset, 0)
+	return value, err
+}
+
+// decodeMMDBValue decodes the value at the given offset, pointers are relative to buf.
+// It returns the decoded value and the offset for the next value
+func decodeMMDBValue(buf []byte, offset uint, depth int) (interface{}, uint, error) {
+	if depth > mmdbMaxDepth {
+		return nil, 0, errors.New("maximum data structure depth exceeded")
+	}
+	if offset >= uint(len(buf)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	ctrl := buf[offset]
+	offset++
+	dataType := int(ctrl >> 5)
+	if dataType == mmdbTypePointer {
+		pointer, next, err := decodeMMDBPointer(buf, ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := decodeMMDBValue(buf, pointer, depth+1)
+		return value, next, err
+	}
+	if dataType == mmdbTypeExtended {
+		if offset >= uint(len(buf)) {
+			return nil, 0, errors.New("unexpected end of data")
+		}
+		dataType = 7 + int(buf[offset])
+		offset++
+	}
+	size, offset, err := decodeMMDBSize(buf, ctrl, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch dataType {
+	case mmdbTypeMap:
+		m := make(map[string]interface{})
+		for i := uint(0); i < size; i++ {
+			var key, value interface{}
+			key, offset, err = decodeMMDBValue(buf, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			k, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("invalid map key type")
+			}
+			value, offset, err = decodeMMDBValue(buf, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[k] = value
+		}
+		return m, offset, nil
+	case mmdbTypeArray:
+		a := make([]interface{}, 0, size)
+		for i := uint(0); i < size; i++ {
+			var value interface{}
+			value, offset, err = decodeMMDBValue(buf, offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+		}
+		return a, offset, nil
+	case mmdbTypeBool:
+		return size != 0, offset, nil
+	case mmdbTypeContainer, mmdbTypeEndMarker:
+		return nil, offset, nil
+	}
+	if offset+size > uint(len(buf)) {
+		return nil, 0, errors.New("unexpected end of data")
+	}
+	data := buf[offset : offset+size]
+	offset += size
+	switch dataType {
+	case mmdbTypeString:
+		return string(data), offset, nil
+	case mmdbTypeBytes, mmdbTypeUint128:
+		return data, offset, nil
+	case mmdbTypeDouble:
+		if size != 8 {
+			return nil, 0, fmt.Errorf("invalid double size: %v", size)
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), offset, nil
+	case mmdbTypeFloat:
+		if size != 4 {
+			return nil, 0, fmt.Errorf("invalid float size: %v", size)
+		}
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), offset, nil
+	case mmdbTypeUint16, mmdbTypeUint32, mmdbTypeUint64:
+		if size > 8 {
+			return nil, 0, fmt.Errorf("invalid unsigned integer size: %v", size)
+		}
+		var v uint64
+		for _, b := range data {
+			v = v<<8 | uint64(b)
+		}
+		return v, offset, nil
+	case mmdbTypeInt32:
+		if size > 4 {
+			return nil, 0, fmt.Errorf("invalid int32 size: %v", size)
+		}
+		var v uint32
+		for _, b := range data {
+			v = v<<8 | uint32(b)
+		}
+		return int64(int32(v)), offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type: %v", dataType)
+}
+
+func decodeMMDBSize(buf []byte, ctrl byte, offset uint) (uint, uint, error) {
+	size := uint(ctrl & 0x1f)
+	if size < 29 {
+		return size, offset, nil
+	}
+	extraBytes := size - 28
+	if offset+extraBytes > uint(len(buf)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	var v uint
+	for _, b := range buf[offset : offset+extraBytes] {
+		v = v<<8 | uint(b)
+	}
+	switch size {
+	case 29:
+		size = 29 + v
+	case 30:
+		size = 285 + v
+	default:
+		size = 65821 + v
+	}
+	return size, offset + extraBytes, nil
+}
+
+func decodeMMDBPointer(buf []byte, ctrl byte, offset uint) (uint, uint, error) {
+	pointerSize := uint((ctrl>>3)&0x3) + 1
+	if offset+pointerSize > uint(len(buf)) {
+		return 0, 0, errors.New("unexpected end of data")
+	}
+	var v uint
+	if pointerSize != 4 {
+		v = uint(ctrl & 0x7)
+	}
+	for _, b := range buf[offset : offset+pointerSize] {
+		v = v<<8 | uint(b)
+	}
+	switch pointerSize {
+	case 2:
+		v += 2048
+	case 3:
+		v += 526336
+	}
+	return v, offset + pointerSize, nil
+}
@@ -0,0 +1,159 @@
+package httpd
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+const (
+	totpIssuer = "SFTPGo"
+	qrCodeSize = 256
+	// header used to provide the TOTP code, or a recovery code, for the admins with 2FA enabled
+	otpHeader = "X-SFTPGO-OTP"
+)
+
+type totpStatusResponse struct {
+	Enabled bool `json:"enabled"`
+	// number of recovery codes not yet used
+	RecoveryCodes int `json:"recovery_codes"`
+}
+
+type totpSecretResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+	// PNG image, base64 encoded
+	QRCode string `json:"qr_code"`
+}
+
+type totpEnableRequest struct {
+	Secret string `json:"secret"`
+	Code   string `json:"code"`
+}
+
+type recoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+// generateTOTPSecret returns a new secret and the related QR code for the authenticated admin,
+// it is not saved until it is validated using enableAdminTOTP
+func generateTOTPSecret(admin dataprovider.Admin) (totpSecretResponse, error) {
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		return totpSecretResponse{}, err
+	}
+	return getTOTPSecretResponse(admin, secret)
+}
+
+func getTOTPSecretResponse(admin dataprovider.Admin, secret string) (totpSecretResponse, error) {
+	uri := utils.GetTOTPKeyURI(totpIssuer, admin.Username, secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, qrCodeSize)
+	if err != nil {
+		return totpSecretResponse{}, err
+	}
+	return totpSecretResponse{
+		Secret: secret,
+		URI:    uri,
+		QRCode: base64.StdEncoding.EncodeToString(png),
+	}, nil
+}
+
+func getAdminTOTPStatus(w http.ResponseWriter, r *http.Request) {
+	admin, err := dataprovider.AdminExists(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	render.JSON(w, r, totpStatusResponse{
+		Enabled:       admin.HasTOTPSecret(),
+		RecoveryCodes: admin.GetUnusedRecoveryCodes(),
+	})
+}
+
+func generateAdminTOTPSecret(w http.ResponseWriter, r *http.Request) {
+	admin, err := dataprovider.AdminExists(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	resp, err := generateTOTPSecret(admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, resp)
+}
+
+func enableAdminTOTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var req totpEnableRequest
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	codes, err := dataprovider.EnableAdminTOTP(dataProvider, getAdminFromRequest(r).Username, req.Secret, req.Code)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	render.JSON(w, r, recoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+func regenerateAdminRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+	codes, err := dataprovider.RegenerateAdminRecoveryCodes(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	render.JSON(w, r, recoveryCodesResponse{
+		RecoveryCodes: codes,
+	})
+}
+
+func disableAdminTOTP(w http.ResponseWriter, r *http.Request) {
+	err := dataprovider.DisableAdminTOTP(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "2FA disabled", http.StatusOK)
+}
+
+// disableAdminTOTPByID allows to disable the second factor authentication for another admin,
+// for example if the authenticator device and the recovery codes are lost
+func disableAdminTOTPByID(w http.ResponseWriter, r *http.Request) {
+	adminID, err := strconv.ParseInt(chi.URLParam(r, "adminID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid adminID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	admin, err := dataprovider.GetAdminByID(dataProvider, adminID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	err = dataprovider.DisableAdminTOTP(dataProvider, admin.Username)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getAdminRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "2FA disabled", http.StatusOK)
+}
+
+func getAdminRespStatus(err error) int {
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		return http.StatusNotFound
+	}
+	return getRespStatus(err)
+}
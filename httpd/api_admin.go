@@ -0,0 +1,178 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getAdmins(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	username := ""
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["username"]; ok {
+		username = r.URL.Query().Get("username")
+	}
+	admins, err := dataprovider.GetAdmins(dataProvider, limit, offset, order, username)
+	if err == nil {
+		render.JSON(w, r, admins)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getAdminByID(w http.ResponseWriter, r *http.Request) {
+	adminID, err := strconv.ParseInt(chi.URLParam(r, "adminID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid adminID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	admin, err := dataprovider.GetAdminByID(dataProvider, adminID)
+	if err == nil {
+		admin.HideConfidentialData()
+		render.JSON(w, r, admin)
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addAdmin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var admin dataprovider.Admin
+	err := render.DecodeJSON(r.Body, &admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	// the 2FA can only be enabled by the admin itself
+	admin.Filters = dataprovider.AdminFilters{}
+	err = dataprovider.AddAdmin(dataProvider, admin)
+	if err == nil {
+		admin, err = dataprovider.AdminExists(dataProvider, admin.Username)
+		if err == nil {
+			admin.HideConfidentialData()
+			render.JSON(w, r, admin)
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateAdmin(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	adminID, err := strconv.ParseInt(chi.URLParam(r, "adminID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid adminID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	admin, err := dataprovider.GetAdminByID(dataProvider, adminID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentUsername := admin.Username
+	currentPassword := admin.Password
+	currentFilters := admin.Filters
+	admin = dataprovider.Admin{}
+	err = render.DecodeJSON(r.Body, &admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if admin.ID != adminID {
+		sendAPIResponse(w, r, err, "admin ID in request body does not match admin ID in path parameter", http.StatusBadRequest)
+		return
+	}
+	if admin.Username != currentUsername {
+		sendAPIResponse(w, r, err, "the admin username cannot be changed", http.StatusBadRequest)
+		return
+	}
+	// the password is not returned, an empty password means no change
+	if len(admin.Password) == 0 {
+		admin.Password = currentPassword
+	}
+	// the 2FA settings can only be changed using the dedicated APIs
+	admin.Filters = currentFilters
+	if admin.Username == getAdminFromRequest(r).Username {
+		if admin.Status != 1 || !admin.HasPermission(dataprovider.PermAdminManageAdmins) {
+			sendAPIResponse(w, r, err, "you cannot disable yourself or remove your permission to manage admins",
+				http.StatusBadRequest)
+			return
+		}
+	}
+	err = dataprovider.UpdateAdmin(dataProvider, admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Admin updated", http.StatusOK)
+	}
+}
+
+func deleteAdmin(w http.ResponseWriter, r *http.Request) {
+	adminID, err := strconv.ParseInt(chi.URLParam(r, "adminID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid adminID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	admin, err := dataprovider.GetAdminByID(dataProvider, adminID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	if admin.Username == getAdminFromRequest(r).Username {
+		sendAPIResponse(w, r, err, "you cannot delete yourself", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.DeleteAdmin(dataProvider, admin)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Admin deleted", http.StatusOK)
+	}
+}
@@ -0,0 +1,128 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+type tokenResponse struct {
+	AccessToken string `json:"access_token"`
+	ExpiresAt   string `json:"expires_at"`
+}
+
+func getToken(w http.ResponseWriter, r *http.Request) {
+	token, expiresAt, err := createToken(getAdminFromRequest(r), tokenAudienceAPI)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	render.JSON(w, r, tokenResponse{
+		AccessToken: token,
+		ExpiresAt:   expiresAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func getAPIKeys(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	// the admins without the permission to manage admins can only list their keys
+	admin := getAdminFromRequest(r)
+	owner := admin.Username
+	if admin.HasPermission(dataprovider.PermAdminManageAdmins) {
+		owner = r.URL.Query().Get("admin")
+	}
+	keys, err := dataprovider.GetAPIKeys(dataProvider, limit, offset, order, owner)
+	if err == nil {
+		render.JSON(w, r, keys)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addAPIKey(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var req dataprovider.APIKey
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	key, err := dataprovider.GenerateAPIKey(getAdminFromRequest(r), req.Name, req.Scopes)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	key.ExpiresAt = req.ExpiresAt
+	key.Description = req.Description
+	secret := key.Key
+	err = dataprovider.AddAPIKey(dataProvider, key)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	key, err = dataprovider.APIKeyExists(dataProvider, key.KeyID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	// the plain key is returned only here
+	key.Key = key.KeyID + "." + secret
+	render.JSON(w, r, key)
+}
+
+func deleteAPIKey(w http.ResponseWriter, r *http.Request) {
+	key, err := dataprovider.APIKeyExists(dataProvider, chi.URLParam(r, "keyID"))
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	admin := getAdminFromRequest(r)
+	if key.Admin != admin.Username && !admin.HasPermission(dataprovider.PermAdminManageAdmins) {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return
+	}
+	err = dataprovider.DeleteAPIKey(dataProvider, key)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "API key deleted", http.StatusOK)
+	}
+}
@@ -0,0 +1,554 @@
+package httpd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+type clientDirEntry struct {
+	Name string `json:"name"`
+	// file, dir or symlink
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	// unix permissions, for example 0644
+	Mode uint32 `json:"mode"`
+	// last modification time as unix timestamp in milliseconds
+	LastModified int64 `json:"last_modified"`
+}
+
+type clientFileChecksum struct {
+	Path      string `json:"path"`
+	Algorithm string `json:"algorithm"`
+	Checksum  string `json:"checksum"`
+}
+
+func getClientRequestPath(r *http.Request, name string) string {
+	return utils.CleanSFTPPath(r.URL.Query().Get(name))
+}
+
+// auditPermissionDenied emits a permission denied audit event for the given client request
+func auditPermissionDenied(r *http.Request) {
+	c, ok := r.Context().Value(clientConnectionKey).(*clientConnection)
+	if !ok {
+		return
+	}
+	audit.Log(audit.Event{
+		Event:        audit.EventPermissionDenied,
+		Username:     c.User.Username,
+		Protocol:     protocolHTTP,
+		ConnectionID: c.ID,
+		RemoteIP:     c.getRemoteIP(),
+		Path:         getClientRequestPath(r, "path"),
+		TargetPath:   r.URL.Query().Get("target"),
+		Operation:    r.Method + " " + r.URL.Path,
+	})
+}
+
+func sendClientError(w http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case os.ErrNotExist, errNoChecksum:
+		status = http.StatusNotFound
+	case errClientForbidden:
+		status = http.StatusForbidden
+		auditPermissionDenied(r)
+	case errQuotaExceeded, errUploadFileSizeExceeded:
+		status = http.StatusRequestEntityTooLarge
+	case errIsDirectory, errNotDirectory:
+		status = http.StatusBadRequest
+	case errDataTransferQuotaExceeded:
+		status = http.StatusForbidden
+	}
+	sendAPIResponse(w, r, err, "", status)
+}
+
+func clientListDir(w http.ResponseWriter, r *http.Request) {
+	listDir(w, r, getClientConnection(r), getClientRequestPath(r, "path"))
+}
+
+// listDir sends the contents of the given directory as JSON
+func listDir(w http.ResponseWriter, r *http.Request, c *clientConnection, name string) {
+	if !c.User.HasPerm(dataprovider.PermListItems, name) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	c.Log(logger.LevelDebug, "requested list file for dir: %#v", p)
+	files, err := c.fs.ReadDir(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, "error listing directory %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	files = c.User.AddVirtualDirs(files, name)
+	entries := make([]clientDirEntry, 0, len(files))
+	for _, fi := range files {
+		entry := clientDirEntry{
+			Name:         fi.Name(),
+			Type:         "file",
+			Size:         fi.Size(),
+			Mode:         uint32(fi.Mode().Perm()),
+			LastModified: utils.GetTimeAsMsSinceEpoch(fi.ModTime()),
+		}
+		if fi.IsDir() {
+			entry.Type = "dir"
+		} else if fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+			entry.Type = "symlink"
+		}
+		entries = append(entries, entry)
+	}
+	render.JSON(w, r, entries)
+}
+
+func clientMkdir(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	name := getClientRequestPath(r, "path")
+	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(name)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if c.User.IsVirtualFolder(name) {
+		c.Log(logger.LevelWarn, "mkdir not allowed %#v is virtual folder is not allowed", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if err = c.fs.Mkdir(p); err != nil {
+		c.Log(logger.LevelWarn, "error creating dir: %#v error: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	vfs.SetPathPermissions(c.fs, p, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog("Mkdir", p, "", c.User.Username, "", c.ID, protocolHTTP, -1, -1, "", "", "")
+	sendAPIResponse(w, r, nil, "Directory created", http.StatusCreated)
+}
+
+func clientRmdir(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	name := getClientRequestPath(r, "path")
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if c.fs.GetRelativePath(p) == "/" || c.User.IsVirtualFolder(name) {
+		c.Log(logger.LevelWarn, "removing the root dir or a virtual folder is not allowed: %#v", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(name)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	fi, err := c.fs.Lstat(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, "failed to remove a dir %#v: stat error: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if !fi.IsDir() || fi.Mode()&os.ModeSymlink == os.ModeSymlink {
+		c.Log(logger.LevelDebug, "cannot remove %#v is not a directory", p)
+		sendClientError(w, r, errNotDirectory)
+		return
+	}
+	if err = c.fs.Remove(p, true); err != nil {
+		c.Log(logger.LevelWarn, "failed to remove directory %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	logger.CommandLog("Rmdir", p, "", c.User.Username, "", c.ID, protocolHTTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolHTTP, c.ID, c.getRemoteIP(), p, "")
+	sendAPIResponse(w, r, nil, "Directory deleted", http.StatusOK)
+}
+
+func clientDownload(w http.ResponseWriter, r *http.Request) {
+	downloadFile(w, r, getClientConnection(r), getClientRequestPath(r, "path"))
+}
+
+// downloadFile sends the given file as response body
+func downloadFile(w http.ResponseWriter, r *http.Request, c *clientConnection, name string) {
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(name)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelWarn, "reading file %#v is not allowed", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, "error running stat on path %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if fi.IsDir() {
+		sendClientError(w, r, errIsDirectory)
+		return
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(false)
+	if err == nil && maxDataTransfer > 0 && fi.Size() > maxDataTransfer {
+		err = errDataTransferQuotaExceeded
+	}
+	if err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	file, readerAt, cancelFn, err := c.fs.Open(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, "could not open file %#v for reading: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	c.Log(logger.LevelDebug, "fileread requested for path: %#v", p)
+	transfer := newClientTransfer(c, p, transferDownload, file, nil, readerAt, cancelFn, false, 0)
+	transfer.maxDataTransfer = maxDataTransfer
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", fmt.Sprintf("%v", fi.Size()))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%#v", path.Base(name)))
+	w.WriteHeader(http.StatusOK)
+	if _, err = io.Copy(w, transfer); err != nil {
+		transfer.TransferError(err)
+	}
+	transfer.Close()
+}
+
+// clientDownloadZip streams a zip archive with the contents of the requested directory
+func clientDownloadZip(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	name := getClientRequestPath(r, "path")
+	if !c.User.HasPerm(dataprovider.PermListItems, name) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, "error running stat on path %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if !fi.IsDir() {
+		sendClientError(w, r, errNotDirectory)
+		return
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(false)
+	if err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	c.Log(logger.LevelDebug, "zip download requested for dir: %#v", p)
+	transfer := newClientTransfer(c, p, transferDownload, nil, nil, nil, nil, false, 0)
+	transfer.maxDataTransfer = maxDataTransfer
+	zipName := "archive.zip"
+	if name != "/" {
+		zipName = path.Base(name) + ".zip"
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%#v", zipName))
+	w.WriteHeader(http.StatusOK)
+	if err = sftpd.WriteZip(&zipTransferWriter{transfer: transfer, writer: w}, c.User, c.fs, name); err != nil {
+		transfer.TransferError(err)
+	}
+	transfer.closeZip()
+}
+
+// clientGetChecksum sends the checksum stored, as file metadata, after the upload
+func clientGetChecksum(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	name := getClientRequestPath(r, "path")
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(name)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelWarn, "reading the checksum for file %#v is not allowed", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, "error running stat on path %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if fi.IsDir() {
+		sendClientError(w, r, errIsDirectory)
+		return
+	}
+	checksum, err := c.fs.GetFileChecksum(p)
+	if err == vfs.ErrChecksumNotSupported || (err == nil && len(checksum) == 0) {
+		err = errNoChecksum
+	}
+	if err != nil {
+		c.Log(logger.LevelDebug, "unable to get the checksum for path %#v: %v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	render.JSON(w, r, clientFileChecksum{
+		Path:      name,
+		Algorithm: "sha256",
+		Checksum:  checksum,
+	})
+}
+
+func clientUpload(w http.ResponseWriter, r *http.Request) {
+	uploadFile(w, r, getClientConnection(r), getClientRequestPath(r, "path"))
+}
+
+// uploadFile writes the request body to the given file
+func uploadFile(w http.ResponseWriter, r *http.Request, c *clientConnection, name string) {
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelWarn, "writing file %#v is not allowed", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	// the size is checked while writing too, the content length may be unknown
+	if !c.User.IsUploadSizeAllowed(r.ContentLength) {
+		sendClientError(w, r, errUploadFileSizeExceeded)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	filePath := p
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		filePath = c.fs.GetAtomicUploadPath(p)
+	}
+	var transfer *clientTransfer
+	stat, statErr := c.fs.Stat(p)
+	if c.fs.IsNotExist(statErr) {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(name)) {
+			sendClientError(w, r, errClientForbidden)
+			return
+		}
+		transfer, err = handleClientUploadToNewFile(c, p, filePath)
+	} else if statErr != nil {
+		c.Log(logger.LevelError, "error performing file stat %#v: %+v", p, statErr)
+		err = c.getFsError(statErr)
+	} else if stat.IsDir() {
+		c.Log(logger.LevelWarn, "attempted to open a directory for writing to: %#v", p)
+		err = errIsDirectory
+	} else if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(name)) {
+		err = errClientForbidden
+	} else {
+		transfer, err = handleClientUploadToExistingFile(c, p, filePath, stat.Size())
+	}
+	if err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	_, err = io.Copy(transfer, r.Body)
+	if err != nil {
+		transfer.TransferError(err)
+	}
+	err = transfer.Close()
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Upload completed", http.StatusCreated)
+}
+
+func handleClientUploadToNewFile(c *clientConnection, requestPath, filePath string) (*clientTransfer, error) {
+	if !c.hasSpace(true, requestPath) {
+		c.Log(logger.LevelInfo, "denying file write due to space limit")
+		return nil, errQuotaExceeded
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, 0)
+	if err != nil {
+		c.Log(logger.LevelWarn, "error creating file %#v: %+v", requestPath, err)
+		return nil, c.getFsError(err)
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	transfer := newClientTransfer(c, requestPath, transferUpload, file, w, nil, cancelFn, true, 0)
+	transfer.maxDataTransfer = maxDataTransfer
+	return transfer, nil
+}
+
+func handleClientUploadToExistingFile(c *clientConnection, requestPath, filePath string,
+	fileSize int64) (*clientTransfer, error) {
+	var err error
+	if !c.hasSpace(false, requestPath) {
+		c.Log(logger.LevelInfo, "denying file write due to space limit")
+		return nil, errQuotaExceeded
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		err = c.fs.Rename(requestPath, filePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %+v",
+				requestPath, filePath, err)
+			return nil, c.getFsError(err)
+		}
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		c.Log(logger.LevelWarn, "error opening existing file, source: %#v, err: %+v", filePath, err)
+		return nil, c.getFsError(err)
+	}
+	initialSize := int64(0)
+	if vfs.IsLocalOsFs(c.fs) {
+		if !c.User.IsFileExcludedFromQuota(requestPath) {
+			dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+		}
+	} else {
+		initialSize = fileSize
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	transfer := newClientTransfer(c, requestPath, transferUpload, file, w, nil, cancelFn, false, initialSize)
+	transfer.maxDataTransfer = maxDataTransfer
+	return transfer, nil
+}
+
+func clientRename(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	oldName := getClientRequestPath(r, "path")
+	newName := getClientRequestPath(r, "target")
+	sourcePath, err := c.fs.ResolvePath(oldName)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	targetPath, err := c.fs.ResolvePath(newName)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if c.fs.GetRelativePath(sourcePath) == "/" {
+		c.Log(logger.LevelWarn, "renaming root dir is not allowed")
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if c.User.IsVirtualFolder(oldName) || c.User.IsVirtualFolder(newName) {
+		c.Log(logger.LevelWarn, "renaming a virtual folder is not allowed")
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if !c.User.IsFileAllowed(oldName) || !c.User.IsFileAllowed(newName) {
+		if fi, err := c.fs.Lstat(sourcePath); err == nil && fi.Mode().IsRegular() {
+			c.Log(logger.LevelDebug, "renaming file is not allowed, source: %#v target: %#v", oldName, newName)
+			sendClientError(w, r, errClientForbidden)
+			return
+		}
+	}
+	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(newName)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	// renaming a file from or to a virtual folder excluded from the quota changes the used quota
+	var quotaFileInfo os.FileInfo
+	if c.User.IsFileExcludedFromQuota(sourcePath) != c.User.IsFileExcludedFromQuota(targetPath) {
+		fi, err := c.fs.Lstat(sourcePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, "failed to rename %#v: stat error: %+v", sourcePath, err)
+			sendClientError(w, r, c.getFsError(err))
+			return
+		}
+		if fi.IsDir() {
+			c.Log(logger.LevelDebug, "renaming a directory between folders with different quota settings is not allowed, "+
+				"source: %#v target: %#v", oldName, newName)
+			sendClientError(w, r, errClientForbidden)
+			return
+		}
+		quotaFileInfo = fi
+	}
+	if err = c.fs.Rename(sourcePath, targetPath); err != nil {
+		c.Log(logger.LevelWarn, "failed to rename file, source: %#v target: %#v: %+v", sourcePath, targetPath, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	vfs.SetPathPermissions(c.fs, targetPath, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog("Rename", sourcePath, targetPath, c.User.Username, "", c.ID, protocolHTTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventRename, c.User.Username, protocolHTTP, c.ID, c.getRemoteIP(), sourcePath, targetPath)
+	if quotaFileInfo != nil && quotaFileInfo.Mode().IsRegular() {
+		dataprovider.UpdateUserQuotaForRename(dataProvider, c.User, sourcePath, targetPath, quotaFileInfo.Size())
+	}
+	go sftpd.ExecuteAction("rename", c.User.Username, sourcePath, targetPath, 0, vfs.IsLocalOsFs(c.fs))
+	sendAPIResponse(w, r, nil, "Renamed", http.StatusOK)
+}
+
+func clientDeleteFile(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	name := getClientRequestPath(r, "path")
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(name)) {
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelDebug, "removing file %#v is not allowed", name)
+		sendClientError(w, r, errClientForbidden)
+		return
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	fi, err := c.fs.Lstat(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, "failed to remove a file %#v: stat error: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+		c.Log(logger.LevelDebug, "cannot remove %#v is not a file/symlink", p)
+		sendClientError(w, r, errIsDirectory)
+		return
+	}
+	if err = c.fs.Remove(p, false); err != nil {
+		c.Log(logger.LevelWarn, "failed to remove a file/symlink %#v: %+v", p, err)
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	logger.CommandLog("Remove", p, "", c.User.Username, "", c.ID, protocolHTTP, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolHTTP, c.ID, c.getRemoteIP(), p, "")
+	if fi.Mode()&os.ModeSymlink != os.ModeSymlink && !c.User.IsFileExcludedFromQuota(p) {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -fi.Size(), false)
+	}
+	go sftpd.ExecuteAction("delete", c.User.Username, p, "", fi.Size(), vfs.IsLocalOsFs(c.fs))
+	sendAPIResponse(w, r, nil, "File deleted", http.StatusOK)
+}
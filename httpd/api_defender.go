@@ -0,0 +1,104 @@
+package httpd
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+
+	"github.com/drakkan/sftpgo/defender"
+)
+
+type defenderListEntry struct {
+	List  string `json:"list"`
+	Entry string `json:"entry"`
+}
+
+func getDefenderHosts(w http.ResponseWriter, r *http.Request) {
+	hosts, err := defender.GetHosts()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	render.JSON(w, r, hosts)
+}
+
+func getDefenderHost(w http.ResponseWriter, r *http.Request) {
+	ip, err := getIPFromPath(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	host, err := defender.GetHost(ip)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	render.JSON(w, r, host)
+}
+
+func unbanDefenderHost(w http.ResponseWriter, r *http.Request) {
+	ip, err := getIPFromPath(r)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = defender.Unban(ip)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Host unbanned", http.StatusOK)
+}
+
+func getDefenderLists(w http.ResponseWriter, r *http.Request) {
+	lists, err := defender.GetLists()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	render.JSON(w, r, lists)
+}
+
+func addDefenderListEntry(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var req defenderListEntry
+	err := render.DecodeJSON(r.Body, &req)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = defender.AddListEntry(req.List, req.Entry)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Entry added", http.StatusOK)
+}
+
+func removeDefenderListEntry(w http.ResponseWriter, r *http.Request) {
+	err := defender.RemoveListEntry(r.URL.Query().Get("list"), r.URL.Query().Get("entry"))
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getDefenderRespStatus(err))
+		return
+	}
+	sendAPIResponse(w, r, nil, "Entry removed", http.StatusOK)
+}
+
+func getIPFromPath(r *http.Request) (string, error) {
+	ip := strings.TrimSpace(chi.URLParam(r, "ip"))
+	if net.ParseIP(ip) == nil {
+		return ip, errors.New("Invalid IP address")
+	}
+	return ip, nil
+}
+
+func getDefenderRespStatus(err error) int {
+	if err == defender.ErrNotFound {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
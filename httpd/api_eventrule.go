@@ -0,0 +1,160 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/eventmanager"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getEventRules(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	name := ""
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["name"]; ok {
+		name = r.URL.Query().Get("name")
+	}
+	rules, err := dataprovider.GetEventRules(dataProvider, limit, offset, order, name)
+	if err == nil {
+		render.JSON(w, r, rules)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getEventRuleByID(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid ruleID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	rule, err := dataprovider.GetEventRuleByID(dataProvider, ruleID)
+	if err == nil {
+		render.JSON(w, r, rule)
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addEventRule(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var rule dataprovider.EventRule
+	err := render.DecodeJSON(r.Body, &rule)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddEventRule(dataProvider, rule)
+	if err == nil {
+		eventmanager.ReloadRules()
+		rule, err = dataprovider.EventRuleExists(dataProvider, rule.Name)
+		if err == nil {
+			render.JSON(w, r, rule)
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateEventRule(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid ruleID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	rule, err := dataprovider.GetEventRuleByID(dataProvider, ruleID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentName := rule.Name
+	// the settings not included in the request body are removed
+	rule = dataprovider.EventRule{}
+	err = render.DecodeJSON(r.Body, &rule)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if rule.ID != ruleID {
+		sendAPIResponse(w, r, err, "rule ID in request body does not match rule ID in path parameter", http.StatusBadRequest)
+		return
+	}
+	if rule.Name != currentName {
+		sendAPIResponse(w, r, err, "the rule name cannot be changed", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateEventRule(dataProvider, rule)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		eventmanager.ReloadRules()
+		sendAPIResponse(w, r, err, "Event rule updated", http.StatusOK)
+	}
+}
+
+func deleteEventRule(w http.ResponseWriter, r *http.Request) {
+	ruleID, err := strconv.ParseInt(chi.URLParam(r, "ruleID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid ruleID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	rule, err := dataprovider.GetEventRuleByID(dataProvider, ruleID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteEventRule(dataProvider, rule)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		eventmanager.ReloadRules()
+		sendAPIResponse(w, r, err, "Event rule deleted", http.StatusOK)
+	}
+}
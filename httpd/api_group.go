@@ -0,0 +1,190 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getGroups(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	name := ""
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["name"]; ok {
+		name = r.URL.Query().Get("name")
+	}
+	groups, err := dataprovider.GetGroups(dataProvider, limit, offset, order, name)
+	if err == nil {
+		render.JSON(w, r, groups)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getGroupByID(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(dataProvider, groupID)
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideGroupSensitiveData(&group))
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var group dataprovider.Group
+	err := render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddGroup(dataProvider, group)
+	if err == nil {
+		group, err = dataprovider.GroupExists(dataProvider, group.Name)
+		if err == nil {
+			render.JSON(w, r, dataprovider.HideGroupSensitiveData(&group))
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateGroup(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(dataProvider, groupID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentName := group.Name
+	currentFsConfig := group.FsConfig
+	// the settings not included in the request body are removed
+	group = dataprovider.Group{}
+	err = render.DecodeJSON(r.Body, &group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	if group.ID != groupID {
+		sendAPIResponse(w, r, err, "group ID in request body does not match group ID in path parameter", http.StatusBadRequest)
+		return
+	}
+	if group.Name != currentName {
+		sendAPIResponse(w, r, err, "the group name cannot be changed", http.StatusBadRequest)
+		return
+	}
+	// we use the new secrets if different from the hidden old ones
+	if len(currentFsConfig.CryptConfig.Passphrase) > 0 &&
+		utils.RemoveDecryptionKey(currentFsConfig.CryptConfig.Passphrase) == group.FsConfig.CryptConfig.Passphrase {
+		group.FsConfig.CryptConfig.Passphrase = currentFsConfig.CryptConfig.Passphrase
+	}
+	if group.FsConfig.Provider == 1 && currentFsConfig.Provider == 1 {
+		if utils.RemoveDecryptionKey(currentFsConfig.S3Config.AccessSecret) == group.FsConfig.S3Config.AccessSecret ||
+			(len(group.FsConfig.S3Config.AccessSecret) == 0 && len(group.FsConfig.S3Config.AccessKey) > 0) {
+			group.FsConfig.S3Config.AccessSecret = currentFsConfig.S3Config.AccessSecret
+		}
+	}
+	if group.FsConfig.Provider == 3 && currentFsConfig.Provider == 3 {
+		if utils.RemoveDecryptionKey(currentFsConfig.AzBlobConfig.AccountKey) == group.FsConfig.AzBlobConfig.AccountKey ||
+			(len(group.FsConfig.AzBlobConfig.AccountKey) == 0 && len(group.FsConfig.AzBlobConfig.AccountName) > 0) {
+			group.FsConfig.AzBlobConfig.AccountKey = currentFsConfig.AzBlobConfig.AccountKey
+		}
+		if len(currentFsConfig.AzBlobConfig.SASURL) > 0 &&
+			utils.RemoveDecryptionKey(currentFsConfig.AzBlobConfig.SASURL) == group.FsConfig.AzBlobConfig.SASURL {
+			group.FsConfig.AzBlobConfig.SASURL = currentFsConfig.AzBlobConfig.SASURL
+		}
+	}
+	if group.FsConfig.Provider == 4 && currentFsConfig.Provider == 4 {
+		currentSFTPConfig := currentFsConfig.SFTPConfig
+		if len(currentSFTPConfig.Password) > 0 &&
+			utils.RemoveDecryptionKey(currentSFTPConfig.Password) == group.FsConfig.SFTPConfig.Password {
+			group.FsConfig.SFTPConfig.Password = currentSFTPConfig.Password
+		}
+		if len(currentSFTPConfig.PrivateKey) > 0 &&
+			utils.RemoveDecryptionKey(currentSFTPConfig.PrivateKey) == group.FsConfig.SFTPConfig.PrivateKey {
+			group.FsConfig.SFTPConfig.PrivateKey = currentSFTPConfig.PrivateKey
+		}
+	}
+	err = dataprovider.UpdateGroup(dataProvider, group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Group updated", http.StatusOK)
+	}
+}
+
+func deleteGroup(w http.ResponseWriter, r *http.Request) {
+	groupID, err := strconv.ParseInt(chi.URLParam(r, "groupID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid groupID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	group, err := dataprovider.GetGroupByID(dataProvider, groupID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteGroup(dataProvider, group)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Group deleted", http.StatusOK)
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/eventmanager"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 )
@@ -39,7 +40,7 @@ func dumpData(w http.ResponseWriter, r *http.Request) {
 	outputFile = filepath.Join(backupsPath, outputFile)
 	logger.Debug(logSender, "", "dumping data to: %#v", outputFile)
 
-	users, err := dataprovider.DumpUsers(dataProvider)
+	backup, err := dataprovider.DumpData(dataProvider)
 	if err != nil {
 		logger.Warn(logSender, "", "dumping data error: %v, output file: %#v", err, outputFile)
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -47,13 +48,9 @@ func dumpData(w http.ResponseWriter, r *http.Request) {
 	}
 	var dump []byte
 	if indent == "1" {
-		dump, err = json.MarshalIndent(dataprovider.BackupData{
-			Users: users,
-		}, "", "  ")
+		dump, err = json.MarshalIndent(backup, "", "  ")
 	} else {
-		dump, err = json.Marshal(dataprovider.BackupData{
-			Users: users,
-		})
+		dump, err = json.Marshal(backup)
 	}
 	if err == nil {
 		os.MkdirAll(filepath.Dir(outputFile), 0700)
@@ -74,10 +71,17 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
 		return
 	}
-	if !filepath.IsAbs(inputFile) {
-		sendAPIResponse(w, r, fmt.Errorf("Invalid input_file %#v: it must be an absolute path", inputFile), "", http.StatusBadRequest)
+	if len(inputFile) == 0 {
+		sendAPIResponse(w, r, errors.New("Invalid or missing input_file"), "", http.StatusBadRequest)
 		return
 	}
+	if !filepath.IsAbs(inputFile) {
+		if strings.Contains(inputFile, "..") {
+			sendAPIResponse(w, r, fmt.Errorf("Invalid input_file %#v", inputFile), "", http.StatusBadRequest)
+			return
+		}
+		inputFile = filepath.Join(backupsPath, inputFile)
+	}
 	fi, err := os.Stat(inputFile)
 	if err != nil {
 		sendAPIResponse(w, r, err, "", getRespStatus(err))
@@ -101,32 +105,12 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	for _, user := range dump.Users {
-		u, err := dataprovider.UserExists(dataProvider, user.Username)
-		if err == nil {
-			if mode == 1 {
-				logger.Debug(logSender, "", "loaddata mode 1, existing user %#v not updated", u.Username)
-				continue
-			}
-			user.ID = u.ID
-			user.LastLogin = u.LastLogin
-			user.UsedQuotaSize = u.UsedQuotaSize
-			user.UsedQuotaFiles = u.UsedQuotaFiles
-			err = dataprovider.UpdateUser(dataProvider, user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "restoring existing user: %+v, dump file: %#v, error: %v", user, inputFile, err)
-		} else {
-			user.LastLogin = 0
-			user.UsedQuotaSize = 0
-			user.UsedQuotaFiles = 0
-			err = dataprovider.AddUser(dataProvider, user)
-			user.Password = "[redacted]"
-			logger.Debug(logSender, "", "adding new user: %+v, dump file: %#v, error: %v", user, inputFile, err)
-		}
-		if err != nil {
-			sendAPIResponse(w, r, err, "", getRespStatus(err))
-			return
-		}
+	restoredUsers, err := dataprovider.RestoreData(dataProvider, dump, mode)
+	if len(dump.EventRules) > 0 {
+		// the rules could be partially restored on error too
+		eventmanager.ReloadRules()
+	}
+	for _, user := range restoredUsers {
 		if needQuotaScan(scanQuota, &user) {
 			if sftpd.AddQuotaScan(user.Username) {
 				logger.Debug(logSender, "", "starting quota scan for restored user: %#v", user.Username)
@@ -134,7 +118,13 @@ func loadData(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	logger.Debug(logSender, "", "backup restored, users: %v", len(dump.Users))
+	if err != nil {
+		logger.Warn(logSender, "", "restoring data error: %v, input file: %#v", err, inputFile)
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	logger.Debug(logSender, "", "backup restored, users: %v, groups: %v, admins: %v, API keys: %v, input file: %#v",
+		len(dump.Users), len(dump.Groups), len(dump.Admins), len(dump.APIKeys), inputFile)
 	sendAPIResponse(w, r, err, "Data restored", http.StatusOK)
 }
 
@@ -0,0 +1,21 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func checkUserPermission(w http.ResponseWriter, r *http.Request) {
+	result, err := dataprovider.CheckUserPermission(dataProvider, chi.URLParam(r, "username"),
+		r.URL.Query().Get("operation"), r.URL.Query().Get("path"))
+	if err == nil {
+		render.JSON(w, r, result)
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
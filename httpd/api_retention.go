@@ -0,0 +1,34 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/eventmanager"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getRetentionChecks(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, eventmanager.GetRetentionChecks())
+}
+
+func startRetentionCheck(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var check dataprovider.RetentionCheck
+	err := render.DecodeJSON(r.Body, &check)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = eventmanager.StartRetentionCheck(chi.URLParam(r, "username"), check)
+	if err == nil {
+		sendAPIResponse(w, r, err, "Check started", http.StatusAccepted)
+	} else if err == eventmanager.ErrRetentionCheckInProgress {
+		sendAPIResponse(w, r, err, "", http.StatusConflict)
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
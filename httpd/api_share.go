@@ -0,0 +1,291 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const shareAuthRealm = "SFTPGo share"
+
+var (
+	errShareExpired  = errors.New("share expired")
+	errShareNoTokens = errors.New("share usage limit reached")
+)
+
+func getClientShares(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	shares, err := dataprovider.GetShares(dataProvider, limit, offset, order, getClientConnection(r).User.Username)
+	if err == nil {
+		render.JSON(w, r, shares)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getClientShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := getClientShareFromRequest(w, r)
+	if !ok {
+		return
+	}
+	share.HideConfidentialData()
+	render.JSON(w, r, share)
+}
+
+func addClientShare(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var share dataprovider.Share
+	err := render.DecodeJSON(r.Body, &share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	share.ShareID, err = dataprovider.GenerateShareID()
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	share.ID = 0
+	share.Username = c.User.Username
+	share.CreatedAt = 0
+	share.LastUseAt = 0
+	share.UsedTokens = 0
+	share.Path = utils.CleanSFTPPath(share.Path)
+	if err = checkSharePermissions(c, share); err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	err = dataprovider.AddShare(dataProvider, share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	share, err = dataprovider.ShareExists(dataProvider, share.ShareID)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	share.HideConfidentialData()
+	render.JSON(w, r, share)
+}
+
+func deleteClientShare(w http.ResponseWriter, r *http.Request) {
+	share, ok := getClientShareFromRequest(w, r)
+	if !ok {
+		return
+	}
+	err := dataprovider.DeleteShare(dataProvider, share)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "Share deleted", http.StatusOK)
+	}
+}
+
+// getClientShareFromRequest returns the requested share, the users can only access their own shares.
+// If the share cannot be returned the error response is sent
+func getClientShareFromRequest(w http.ResponseWriter, r *http.Request) (dataprovider.Share, bool) {
+	share, err := dataprovider.ShareExists(dataProvider, chi.URLParam(r, "shareID"))
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return share, false
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return share, false
+	}
+	if share.Username != getClientConnection(r).User.Username {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+		return share, false
+	}
+	return share, true
+}
+
+// checkSharePermissions returns an error if the user cannot execute the operations
+// allowed for the share scope on the shared path
+func checkSharePermissions(c *clientConnection, share dataprovider.Share) error {
+	p, err := c.fs.ResolvePath(share.Path)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	switch share.Scope {
+	case dataprovider.ShareScopeRead:
+		if fi.IsDir() {
+			if !c.User.HasPerms([]string{dataprovider.PermListItems, dataprovider.PermDownload}, share.Path) {
+				return errClientForbidden
+			}
+		} else if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(share.Path)) || !c.User.IsFileAllowed(share.Path) {
+			return errClientForbidden
+		}
+	case dataprovider.ShareScopeWrite:
+		if !fi.IsDir() {
+			return errNotDirectory
+		}
+		if !c.User.HasPerm(dataprovider.PermUpload, share.Path) {
+			return errClientForbidden
+		}
+	}
+	return nil
+}
+
+// checkShareAuth validates the requested share and its optional password, the share
+// owner connection is available in the request context for the next handler
+func checkShareAuth(scope int) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ipAddr := utils.GetIPFromRemoteAddress(r.RemoteAddr)
+			if defender.IsBanned(ipAddr) {
+				sendAPIResponse(w, r, errors.New("banned client IP"), "", http.StatusForbidden)
+				return
+			}
+			shareID := chi.URLParam(r, "shareID")
+			_, password, _ := r.BasicAuth()
+			share, user, err := dataprovider.CheckShareAndPass(dataProvider, shareID, password)
+			if err != nil {
+				if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+					defender.AddEvent(ipAddr, defender.HostEventUserNotFound)
+					sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+					return
+				}
+				if share.IsExpired() {
+					sendAPIResponse(w, r, errShareExpired, "", http.StatusNotFound)
+					return
+				}
+				logger.Debug(logSender, "", "unable to use share %#v from %v: %v", shareID, ipAddr, err)
+				if share.IsPasswordProtected() {
+					defender.AddEvent(ipAddr, defender.HostEventLoginFailed)
+					w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", shareAuthRealm))
+					sendAPIResponse(w, r, errors.New(unauthResponse), "", http.StatusUnauthorized)
+					return
+				}
+				sendAPIResponse(w, r, errClientForbidden, "", http.StatusForbidden)
+				return
+			}
+			if share.Scope != scope {
+				sendAPIResponse(w, r, errClientForbidden, "", http.StatusForbidden)
+				return
+			}
+			if !share.HasTokens() {
+				sendAPIResponse(w, r, errShareNoTokens, "", http.StatusForbidden)
+				return
+			}
+			ctx := context.WithValue(r.Context(), shareKey, share)
+			serveClientConnection(w, r.WithContext(ctx), xid.New().String(), user, next)
+		})
+	}
+}
+
+func getShareFromRequest(r *http.Request) dataprovider.Share {
+	return r.Context().Value(shareKey).(dataprovider.Share)
+}
+
+// consumeShareToken must be called before starting a download or an upload using a share
+func consumeShareToken(c *clientConnection, share dataprovider.Share) error {
+	if err := dataprovider.UpdateShareUsage(dataProvider, share.ShareID, 1); err != nil {
+		c.Log(logger.LevelWarn, "unable to update usage for share %#v: %v", share.ShareID, err)
+		return err
+	}
+	return nil
+}
+
+// readShare downloads the shared file or lists the shared directory. For shared directories
+// the optional path query parameter defines a file or a sub directory relative to the share
+func readShare(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	share := getShareFromRequest(r)
+	name := path.Join(share.Path, getClientRequestPath(r, "path"))
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		sendClientError(w, r, c.getFsError(err))
+		return
+	}
+	if fi.IsDir() {
+		listDir(w, r, c, name)
+		return
+	}
+	if err = consumeShareToken(c, share); err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	downloadFile(w, r, c, name)
+}
+
+// uploadToShare uploads a file, with the given base name, inside the shared directory
+func uploadToShare(w http.ResponseWriter, r *http.Request) {
+	c := getClientConnection(r)
+	share := getShareFromRequest(r)
+	fileName := chi.URLParam(r, "name")
+	if fileName == "" || fileName == "." || fileName == ".." || fileName != path.Base(fileName) {
+		sendAPIResponse(w, r, nil, "Invalid file name", http.StatusBadRequest)
+		return
+	}
+	if !isSharedDir(c, share) {
+		sendClientError(w, r, errNotDirectory)
+		return
+	}
+	if err := consumeShareToken(c, share); err != nil {
+		sendClientError(w, r, err)
+		return
+	}
+	uploadFile(w, r, c, path.Join(share.Path, fileName))
+}
+
+func isSharedDir(c *clientConnection, share dataprovider.Share) bool {
+	p, err := c.fs.ResolvePath(share.Path)
+	if err != nil {
+		return false
+	}
+	fi, err := c.fs.Stat(p)
+	return err == nil && fi.IsDir()
+}
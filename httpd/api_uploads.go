@@ -0,0 +1,49 @@
+package httpd
+
+import (
+	"net/http"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getInterruptedUploads(w http.ResponseWriter, r *http.Request) {
+	uploads, err := sftpd.GetInterruptedUploads(chi.URLParam(r, "username"))
+	if err == nil {
+		render.JSON(w, r, uploads)
+	} else {
+		sendInterruptedUploadError(w, r, err)
+	}
+}
+
+func finalizeInterruptedUpload(w http.ResponseWriter, r *http.Request) {
+	_, err := sftpd.FinalizeInterruptedUpload(chi.URLParam(r, "username"), r.URL.Query().Get("path"))
+	if err == nil {
+		sendAPIResponse(w, r, err, "Upload finalized", http.StatusOK)
+	} else {
+		sendInterruptedUploadError(w, r, err)
+	}
+}
+
+func purgeInterruptedUpload(w http.ResponseWriter, r *http.Request) {
+	_, err := sftpd.PurgeInterruptedUpload(chi.URLParam(r, "username"), r.URL.Query().Get("path"))
+	if err == nil {
+		sendAPIResponse(w, r, err, "Upload purged", http.StatusOK)
+	} else {
+		sendInterruptedUploadError(w, r, err)
+	}
+}
+
+func sendInterruptedUploadError(w http.ResponseWriter, r *http.Request, err error) {
+	if err == sftpd.ErrInterruptedUploadNotFound {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else if err == sftpd.ErrUserConnected {
+		sendAPIResponse(w, r, err, "", http.StatusConflict)
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
@@ -104,12 +104,30 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	user, err := dataprovider.GetUserByID(dataProvider, userID)
 	currentPermissions := user.Permissions
 	currentFileExtensions := user.Filters.FileExtensions
+	currentFilePatterns := user.Filters.FilePatterns
+	currentTOTPSecret := user.Filters.TOTPSecret
+	currentCryptPassphrase := user.FsConfig.CryptConfig.Passphrase
 	currentS3AccessSecret := ""
+	currentAzAccountKey := ""
+	currentAzSASURL := ""
+	currentSFTPPassword := ""
+	currentSFTPPrivateKey := ""
 	if user.FsConfig.Provider == 1 {
 		currentS3AccessSecret = user.FsConfig.S3Config.AccessSecret
+	} else if user.FsConfig.Provider == 3 {
+		currentAzAccountKey = user.FsConfig.AzBlobConfig.AccountKey
+		currentAzSASURL = user.FsConfig.AzBlobConfig.SASURL
+	} else if user.FsConfig.Provider == 4 {
+		currentSFTPPassword = user.FsConfig.SFTPConfig.Password
+		currentSFTPPrivateKey = user.FsConfig.SFTPConfig.PrivateKey
 	}
 	user.Permissions = make(map[string][]string)
 	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{}
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{}
+	user.Filters.TOTPSecret = ""
+	user.Filters.UploadMode = ""
+	user.Filters.SetstatMode = ""
+	user.FsConfig.CryptConfig.Passphrase = ""
 	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
 		sendAPIResponse(w, r, err, "", http.StatusNotFound)
 		return
@@ -130,6 +148,19 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 	if len(user.Filters.FileExtensions) == 0 {
 		user.Filters.FileExtensions = currentFileExtensions
 	}
+	// we use new file patterns if passed otherwise the old ones
+	if len(user.Filters.FilePatterns) == 0 {
+		user.Filters.FilePatterns = currentFilePatterns
+	}
+	// we use the new TOTP secret if different from the old one
+	if len(currentTOTPSecret) > 0 && utils.RemoveDecryptionKey(currentTOTPSecret) == user.Filters.TOTPSecret {
+		user.Filters.TOTPSecret = currentTOTPSecret
+	}
+	// we use the new crypt passphrase if different from the old one
+	if len(currentCryptPassphrase) > 0 &&
+		utils.RemoveDecryptionKey(currentCryptPassphrase) == user.FsConfig.CryptConfig.Passphrase {
+		user.FsConfig.CryptConfig.Passphrase = currentCryptPassphrase
+	}
 	// we use the new access secret if different from the old one and not empty
 	if user.FsConfig.Provider == 1 {
 		if utils.RemoveDecryptionKey(currentS3AccessSecret) == user.FsConfig.S3Config.AccessSecret ||
@@ -137,6 +168,26 @@ func updateUser(w http.ResponseWriter, r *http.Request) {
 			user.FsConfig.S3Config.AccessSecret = currentS3AccessSecret
 		}
 	}
+	// we use the new account key if different from the old one and not empty
+	// and the new SAS URL if different from the old one
+	if user.FsConfig.Provider == 3 {
+		if utils.RemoveDecryptionKey(currentAzAccountKey) == user.FsConfig.AzBlobConfig.AccountKey ||
+			(len(user.FsConfig.AzBlobConfig.AccountKey) == 0 && len(user.FsConfig.AzBlobConfig.AccountName) > 0) {
+			user.FsConfig.AzBlobConfig.AccountKey = currentAzAccountKey
+		}
+		if len(currentAzSASURL) > 0 && utils.RemoveDecryptionKey(currentAzSASURL) == user.FsConfig.AzBlobConfig.SASURL {
+			user.FsConfig.AzBlobConfig.SASURL = currentAzSASURL
+		}
+	}
+	// we use the new SFTP password and private key if different from the old ones
+	if user.FsConfig.Provider == 4 {
+		if len(currentSFTPPassword) > 0 && utils.RemoveDecryptionKey(currentSFTPPassword) == user.FsConfig.SFTPConfig.Password {
+			user.FsConfig.SFTPConfig.Password = currentSFTPPassword
+		}
+		if len(currentSFTPPrivateKey) > 0 && utils.RemoveDecryptionKey(currentSFTPPrivateKey) == user.FsConfig.SFTPConfig.PrivateKey {
+			user.FsConfig.SFTPConfig.PrivateKey = currentSFTPPrivateKey
+		}
+	}
 	if user.ID != userID {
 		sendAPIResponse(w, r, err, "user ID in request body does not match user ID in path parameter", http.StatusBadRequest)
 		return
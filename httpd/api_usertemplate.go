@@ -0,0 +1,235 @@
+package httpd
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/render"
+)
+
+func getUserTemplates(w http.ResponseWriter, r *http.Request) {
+	limit := 100
+	offset := 0
+	order := "ASC"
+	name := ""
+	var err error
+	if _, ok := r.URL.Query()["limit"]; ok {
+		limit, err = strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil {
+			err = errors.New("Invalid limit")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+		if limit > 500 {
+			limit = 500
+		}
+	}
+	if _, ok := r.URL.Query()["offset"]; ok {
+		offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
+		if err != nil {
+			err = errors.New("Invalid offset")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["order"]; ok {
+		order = r.URL.Query().Get("order")
+		if order != "ASC" && order != "DESC" {
+			err = errors.New("Invalid order")
+			sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+			return
+		}
+	}
+	if _, ok := r.URL.Query()["name"]; ok {
+		name = r.URL.Query().Get("name")
+	}
+	templates, err := dataprovider.GetUserTemplates(dataProvider, limit, offset, order, name)
+	if err == nil {
+		render.JSON(w, r, hideUserTemplatesSensitiveData(templates))
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func getUserTemplateByID(w http.ResponseWriter, r *http.Request) {
+	templateID, err := strconv.ParseInt(chi.URLParam(r, "templateID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid templateID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	template, err := dataprovider.GetUserTemplateByID(dataProvider, templateID)
+	if err == nil {
+		render.JSON(w, r, dataprovider.HideUserTemplateSensitiveData(&template))
+	} else if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+	} else {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+	}
+}
+
+func addUserTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	var template dataprovider.UserTemplate
+	err := render.DecodeJSON(r.Body, &template)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.AddUserTemplate(dataProvider, template)
+	if err == nil {
+		template, err = dataprovider.UserTemplateExists(dataProvider, template.Name)
+		if err == nil {
+			render.JSON(w, r, dataprovider.HideUserTemplateSensitiveData(&template))
+		} else {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		}
+	} else {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	}
+}
+
+func updateUserTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	templateID, err := strconv.ParseInt(chi.URLParam(r, "templateID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid templateID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	template, err := dataprovider.GetUserTemplateByID(dataProvider, templateID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	currentName := template.Name
+	currentFsConfig := template.User.FsConfig
+	// the settings not included in the request body are removed
+	template = dataprovider.UserTemplate{}
+	err = render.DecodeJSON(r.Body, &template)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	preserveUserTemplateSecrets(&template.User.FsConfig, &currentFsConfig)
+	if template.ID != templateID {
+		sendAPIResponse(w, r, err, "template ID in request body does not match template ID in path parameter", http.StatusBadRequest)
+		return
+	}
+	if template.Name != currentName {
+		sendAPIResponse(w, r, err, "the template name cannot be changed", http.StatusBadRequest)
+		return
+	}
+	err = dataprovider.UpdateUserTemplate(dataProvider, template)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "User template updated", http.StatusOK)
+	}
+}
+
+func deleteUserTemplate(w http.ResponseWriter, r *http.Request) {
+	templateID, err := strconv.ParseInt(chi.URLParam(r, "templateID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid templateID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	template, err := dataprovider.GetUserTemplateByID(dataProvider, templateID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	err = dataprovider.DeleteUserTemplate(dataProvider, template)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+	} else {
+		sendAPIResponse(w, r, err, "User template deleted", http.StatusOK)
+	}
+}
+
+func addUsersFromTemplate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	templateID, err := strconv.ParseInt(chi.URLParam(r, "templateID"), 10, 64)
+	if err != nil {
+		err = errors.New("Invalid templateID")
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	template, err := dataprovider.GetUserTemplateByID(dataProvider, templateID)
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		sendAPIResponse(w, r, err, "", http.StatusNotFound)
+		return
+	} else if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	var entries []dataprovider.UserTemplateEntry
+	err = render.DecodeJSON(r.Body, &entries)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", http.StatusBadRequest)
+		return
+	}
+	users, err := dataprovider.AddUsersFromTemplate(dataProvider, template.Name, entries)
+	if err != nil {
+		sendAPIResponse(w, r, err, "", getRespStatus(err))
+		return
+	}
+	result := make([]dataprovider.User, 0, len(users))
+	for _, user := range users {
+		user, err = dataprovider.UserExists(dataProvider, user.Username)
+		if err != nil {
+			sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+			return
+		}
+		result = append(result, dataprovider.HideUserSensitiveData(&user))
+	}
+	render.Status(r, http.StatusCreated)
+	render.JSON(w, r, result)
+}
+
+// preserveUserTemplateSecrets restores the current secrets if the new ones are the hidden
+// values returned by the API
+func preserveUserTemplateSecrets(fsConfig, currentFsConfig *dataprovider.Filesystem) {
+	keepSecret := func(secret *string, current string) {
+		if len(current) > 0 && utils.RemoveDecryptionKey(current) == *secret {
+			*secret = current
+		}
+	}
+	keepSecret(&fsConfig.CryptConfig.Passphrase, currentFsConfig.CryptConfig.Passphrase)
+	if fsConfig.Provider != currentFsConfig.Provider {
+		return
+	}
+	switch fsConfig.Provider {
+	case 1:
+		keepSecret(&fsConfig.S3Config.AccessSecret, currentFsConfig.S3Config.AccessSecret)
+	case 2:
+		if len(fsConfig.GCSConfig.Credentials) == 0 {
+			fsConfig.GCSConfig.Credentials = currentFsConfig.GCSConfig.Credentials
+		}
+	case 3:
+		keepSecret(&fsConfig.AzBlobConfig.AccountKey, currentFsConfig.AzBlobConfig.AccountKey)
+		keepSecret(&fsConfig.AzBlobConfig.SASURL, currentFsConfig.AzBlobConfig.SASURL)
+	case 4:
+		keepSecret(&fsConfig.SFTPConfig.Password, currentFsConfig.SFTPConfig.Password)
+		keepSecret(&fsConfig.SFTPConfig.PrivateKey, currentFsConfig.SFTPConfig.PrivateKey)
+	}
+}
+
+func hideUserTemplatesSensitiveData(templates []dataprovider.UserTemplate) []dataprovider.UserTemplate {
+	result := make([]dataprovider.UserTemplate, 0, len(templates))
+	for idx := range templates {
+		result = append(result, dataprovider.HideUserTemplateSensitiveData(&templates[idx]))
+	}
+	return result
+}
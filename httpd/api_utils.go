@@ -18,6 +18,9 @@ import (
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/eventmanager"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/go-chi/render"
@@ -27,14 +30,39 @@ var (
 	httpBaseURL  = "http://127.0.0.1:8080"
 	authUsername = ""
 	authPassword = ""
+	authToken    = ""
+	authAPIKey   = ""
+	authOTP      = ""
 )
 
 // SetBaseURLAndCredentials sets the base url and the optional credentials to use for HTTP requests.
-// Default URL is "http://127.0.0.1:8080" with empty credentials
+// Default URL is "http://127.0.0.1:8080" with empty credentials.
+// The token, the API key and the OTP code, if any, are cleared
 func SetBaseURLAndCredentials(url, username, password string) {
 	httpBaseURL = url
 	authUsername = username
 	authPassword = password
+	authToken = ""
+	authAPIKey = ""
+	authOTP = ""
+}
+
+// SetOTP sets the TOTP code, or the recovery code, to send together with the credentials.
+// An empty code means no code
+func SetOTP(code string) {
+	authOTP = code
+}
+
+// SetAuthToken sets the bearer token to use for HTTP requests instead of the credentials.
+// An empty token means no token
+func SetAuthToken(token string) {
+	authToken = token
+}
+
+// SetAPIKey sets the API key to use for HTTP requests if no token is set.
+// An empty key means no API key
+func SetAPIKey(key string) {
+	authAPIKey = key
 }
 
 // gets an HTTP Client with a timeout
@@ -52,8 +80,15 @@ func sendHTTPRequest(method, url string, body io.Reader, contentType string) (*h
 	if len(contentType) > 0 {
 		req.Header.Set("Content-Type", "application/json")
 	}
-	if len(authUsername) > 0 || len(authPassword) > 0 {
+	if len(authToken) > 0 {
+		req.Header.Set("Authorization", "Bearer "+authToken)
+	} else if len(authAPIKey) > 0 {
+		req.Header.Set(apiKeyHeader, authAPIKey)
+	} else if len(authUsername) > 0 || len(authPassword) > 0 {
 		req.SetBasicAuth(authUsername, authPassword)
+		if len(authOTP) > 0 {
+			req.Header.Set(otpHeader, authOTP)
+		}
 	}
 	return getHTTPClient().Do(req)
 }
@@ -216,32 +251,825 @@ func GetUsers(limit int64, offset int64, username string, expectedStatusCode int
 	return users, body, err
 }
 
+// AddGroup adds a new group and checks the received HTTP Status code against expectedStatusCode.
+func AddGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, err := json.Marshal(group)
+	if err != nil {
+		return newGroup, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(groupPath), bytes.NewBuffer(groupAsJSON),
+		"application/json")
+	if err != nil {
+		return newGroup, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newGroup, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newGroup)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// UpdateGroup updates an existing group and checks the received HTTP Status code against expectedStatusCode.
+func UpdateGroup(group dataprovider.Group, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var newGroup dataprovider.Group
+	var body []byte
+	groupAsJSON, err := json.Marshal(group)
+	if err != nil {
+		return group, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(groupPath, strconv.FormatInt(group.ID, 10)),
+		bytes.NewBuffer(groupAsJSON), "application/json")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newGroup, body, err
+	}
+	if err == nil {
+		newGroup, body, err = GetGroupByID(group.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkGroup(&group, &newGroup)
+	}
+	return newGroup, body, err
+}
+
+// RemoveGroup removes an existing group and checks the received HTTP Status code against expectedStatusCode.
+func RemoveGroup(group dataprovider.Group, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(groupPath, strconv.FormatInt(group.ID, 10)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetGroupByID gets a group by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetGroupByID(groupID int64, expectedStatusCode int) (dataprovider.Group, []byte, error) {
+	var group dataprovider.Group
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(groupPath, strconv.FormatInt(groupID, 10)), nil, "")
+	if err != nil {
+		return group, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &group)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return group, body, err
+}
+
+// GetGroups allows to get a list of groups and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a name, the name filter is an exact match
+func GetGroups(limit int64, offset int64, name string, expectedStatusCode int) ([]dataprovider.Group, []byte, error) {
+	var groups []dataprovider.Group
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(groupPath))
+	if err != nil {
+		return groups, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(name) > 0 {
+		q.Add("name", name)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return groups, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &groups)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return groups, body, err
+}
+
+// AddEventRule adds a new event rule and checks the received HTTP Status code against expectedStatusCode.
+func AddEventRule(rule dataprovider.EventRule, expectedStatusCode int) (dataprovider.EventRule, []byte, error) {
+	var newRule dataprovider.EventRule
+	var body []byte
+	ruleAsJSON, err := json.Marshal(rule)
+	if err != nil {
+		return newRule, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(eventRulePath), bytes.NewBuffer(ruleAsJSON),
+		"application/json")
+	if err != nil {
+		return newRule, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newRule, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newRule)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkEventRule(&rule, &newRule)
+	}
+	return newRule, body, err
+}
+
+// UpdateEventRule updates an existing event rule and checks the received HTTP Status code against expectedStatusCode.
+func UpdateEventRule(rule dataprovider.EventRule, expectedStatusCode int) (dataprovider.EventRule, []byte, error) {
+	var newRule dataprovider.EventRule
+	var body []byte
+	ruleAsJSON, err := json.Marshal(rule)
+	if err != nil {
+		return rule, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(eventRulePath, strconv.FormatInt(rule.ID, 10)),
+		bytes.NewBuffer(ruleAsJSON), "application/json")
+	if err != nil {
+		return rule, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newRule, body, err
+	}
+	if err == nil {
+		newRule, body, err = GetEventRuleByID(rule.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkEventRule(&rule, &newRule)
+	}
+	return newRule, body, err
+}
+
+// RemoveEventRule removes an existing event rule and checks the received HTTP Status code against expectedStatusCode.
+func RemoveEventRule(rule dataprovider.EventRule, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(eventRulePath, strconv.FormatInt(rule.ID, 10)),
+		nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetEventRuleByID gets an event rule by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetEventRuleByID(ruleID int64, expectedStatusCode int) (dataprovider.EventRule, []byte, error) {
+	var rule dataprovider.EventRule
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(eventRulePath, strconv.FormatInt(ruleID, 10)),
+		nil, "")
+	if err != nil {
+		return rule, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &rule)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return rule, body, err
+}
+
+// GetEventRules allows to get a list of event rules and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a name, the name filter is an exact match
+func GetEventRules(limit int64, offset int64, name string, expectedStatusCode int) ([]dataprovider.EventRule, []byte, error) {
+	var rules []dataprovider.EventRule
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(eventRulePath))
+	if err != nil {
+		return rules, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(name) > 0 {
+		q.Add("name", name)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return rules, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &rules)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return rules, body, err
+}
+
+// AddUserTemplate adds a new user template and checks the received HTTP Status code against expectedStatusCode.
+func AddUserTemplate(template dataprovider.UserTemplate, expectedStatusCode int) (dataprovider.UserTemplate, []byte, error) {
+	var newTemplate dataprovider.UserTemplate
+	var body []byte
+	templateAsJSON, err := json.Marshal(template)
+	if err != nil {
+		return newTemplate, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userTemplatePath), bytes.NewBuffer(templateAsJSON),
+		"application/json")
+	if err != nil {
+		return newTemplate, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newTemplate, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newTemplate)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkUserTemplate(&template, &newTemplate)
+	}
+	return newTemplate, body, err
+}
+
+// UpdateUserTemplate updates an existing user template and checks the received HTTP Status code against expectedStatusCode.
+func UpdateUserTemplate(template dataprovider.UserTemplate, expectedStatusCode int) (dataprovider.UserTemplate, []byte, error) {
+	var newTemplate dataprovider.UserTemplate
+	var body []byte
+	templateAsJSON, err := json.Marshal(template)
+	if err != nil {
+		return template, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(userTemplatePath, strconv.FormatInt(template.ID, 10)),
+		bytes.NewBuffer(templateAsJSON), "application/json")
+	if err != nil {
+		return template, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newTemplate, body, err
+	}
+	if err == nil {
+		newTemplate, body, err = GetUserTemplateByID(template.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkUserTemplate(&template, &newTemplate)
+	}
+	return newTemplate, body, err
+}
+
+// RemoveUserTemplate removes an existing user template and checks the received HTTP Status code against expectedStatusCode.
+func RemoveUserTemplate(template dataprovider.UserTemplate, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(userTemplatePath, strconv.FormatInt(template.ID, 10)),
+		nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetUserTemplateByID gets an user template by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetUserTemplateByID(templateID int64, expectedStatusCode int) (dataprovider.UserTemplate, []byte, error) {
+	var template dataprovider.UserTemplate
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(userTemplatePath, strconv.FormatInt(templateID, 10)),
+		nil, "")
+	if err != nil {
+		return template, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &template)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return template, body, err
+}
+
+// GetUserTemplates allows to get a list of user templates and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a name, the name filter is an exact match
+func GetUserTemplates(limit int64, offset int64, name string, expectedStatusCode int) ([]dataprovider.UserTemplate, []byte, error) {
+	var templates []dataprovider.UserTemplate
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(userTemplatePath))
+	if err != nil {
+		return templates, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(name) > 0 {
+		q.Add("name", name)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return templates, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &templates)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return templates, body, err
+}
+
+// AddUsersFromTemplate adds the given users using the specified template and checks the received HTTP Status
+// code against expectedStatusCode.
+func AddUsersFromTemplate(template dataprovider.UserTemplate, entries []dataprovider.UserTemplateEntry,
+	expectedStatusCode int) ([]dataprovider.User, []byte, error) {
+	var users []dataprovider.User
+	var body []byte
+	entriesAsJSON, err := json.Marshal(entries)
+	if err != nil {
+		return users, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(userTemplatePath,
+		strconv.FormatInt(template.ID, 10), "users"), bytes.NewBuffer(entriesAsJSON), "application/json")
+	if err != nil {
+		return users, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusCreated {
+		err = render.DecodeJSON(resp.Body, &users)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return users, body, err
+}
+
+// GetToken requests a new token and checks the received HTTP Status code against expectedStatusCode.
+func GetToken(expectedStatusCode int) (string, []byte, error) {
+	var body []byte
+	var response map[string]string
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(tokenPath), nil, "")
+	if err != nil {
+		return "", body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &response)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return response["access_token"], body, err
+}
+
+// AddAPIKey adds a new API key for the authenticated admin and checks the received HTTP Status code
+// against expectedStatusCode. The returned key contains the plain key
+func AddAPIKey(key dataprovider.APIKey, expectedStatusCode int) (dataprovider.APIKey, []byte, error) {
+	var newKey dataprovider.APIKey
+	var body []byte
+	keyAsJSON, err := json.Marshal(key)
+	if err != nil {
+		return newKey, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(apiKeyPath), bytes.NewBuffer(keyAsJSON),
+		"application/json")
+	if err != nil {
+		return newKey, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &newKey)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil && expectedStatusCode == http.StatusOK {
+		if newKey.Name != key.Name || !strings.HasPrefix(newKey.Key, newKey.KeyID+".") {
+			err = errors.New("API key mismatch")
+		}
+	}
+	return newKey, body, err
+}
+
+// RemoveAPIKey removes an existing API key and checks the received HTTP Status code against expectedStatusCode.
+func RemoveAPIKey(key dataprovider.APIKey, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(apiKeyPath, url.PathEscape(key.KeyID)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GenerateAdminTOTPSecret generates a new TOTP secret for the authenticated admin and checks the
+// received HTTP Status code against expectedStatusCode. The secret is not saved
+func GenerateAdminTOTPSecret(expectedStatusCode int) (string, []byte, error) {
+	var body []byte
+	var response totpSecretResponse
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(admin2FAPath, "generate"), nil, "")
+	if err != nil {
+		return "", body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &response)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil && expectedStatusCode == http.StatusOK && (len(response.QRCode) == 0 ||
+		!strings.HasPrefix(response.URI, "otpauth://totp/")) {
+		err = errors.New("invalid TOTP secret response")
+	}
+	return response.Secret, body, err
+}
+
+// EnableAdminTOTP enables the two-factor authentication for the authenticated admin and checks the
+// received HTTP Status code against expectedStatusCode. The recovery codes are returned
+func EnableAdminTOTP(secret, code string, expectedStatusCode int) ([]string, []byte, error) {
+	var body []byte
+	var response recoveryCodesResponse
+	reqAsJSON, err := json.Marshal(totpEnableRequest{Secret: secret, Code: code})
+	if err != nil {
+		return nil, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(admin2FAPath, "enable"),
+		bytes.NewBuffer(reqAsJSON), "application/json")
+	if err != nil {
+		return nil, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &response)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return response.RecoveryCodes, body, err
+}
+
+// DisableAdminTOTP disables the two-factor authentication for the given admin and checks the
+// received HTTP Status code against expectedStatusCode
+func DisableAdminTOTP(admin dataprovider.Admin, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(adminPath, strconv.FormatInt(admin.ID, 10),
+		"2fa"), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetAPIKeys allows to get a list of API keys and checks the received HTTP Status code against expectedStatusCode.
+// The admins with the manage_admins permission get the keys for all the admins, or for the given admin
+// if not empty, the other admins get their keys
+func GetAPIKeys(limit int64, offset int64, admin string, expectedStatusCode int) ([]dataprovider.APIKey, []byte, error) {
+	var keys []dataprovider.APIKey
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(apiKeyPath))
+	if err != nil {
+		return keys, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(admin) > 0 {
+		q.Add("admin", admin)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return keys, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &keys)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return keys, body, err
+}
+
+// AddAdmin adds a new admin and checks the received HTTP Status code against expectedStatusCode.
+func AddAdmin(admin dataprovider.Admin, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var newAdmin dataprovider.Admin
+	var body []byte
+	adminAsJSON, err := json.Marshal(admin)
+	if err != nil {
+		return newAdmin, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(adminPath), bytes.NewBuffer(adminAsJSON),
+		"application/json")
+	if err != nil {
+		return newAdmin, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		body, _ = getResponseBody(resp)
+		return newAdmin, body, err
+	}
+	if err == nil {
+		err = render.DecodeJSON(resp.Body, &newAdmin)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	if err == nil {
+		err = checkAdmin(&admin, &newAdmin)
+	}
+	return newAdmin, body, err
+}
+
+// UpdateAdmin updates an existing admin and checks the received HTTP Status code against expectedStatusCode.
+func UpdateAdmin(admin dataprovider.Admin, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var newAdmin dataprovider.Admin
+	var body []byte
+	adminAsJSON, err := json.Marshal(admin)
+	if err != nil {
+		return admin, body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPut, buildURLRelativeToBase(adminPath, strconv.FormatInt(admin.ID, 10)),
+		bytes.NewBuffer(adminAsJSON), "application/json")
+	if err != nil {
+		return admin, body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if expectedStatusCode != http.StatusOK {
+		return newAdmin, body, err
+	}
+	if err == nil {
+		newAdmin, body, err = GetAdminByID(admin.ID, expectedStatusCode)
+	}
+	if err == nil {
+		err = checkAdmin(&admin, &newAdmin)
+	}
+	return newAdmin, body, err
+}
+
+// RemoveAdmin removes an existing admin and checks the received HTTP Status code against expectedStatusCode.
+func RemoveAdmin(admin dataprovider.Admin, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(adminPath, strconv.FormatInt(admin.ID, 10)), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetAdminByID gets an admin by database id and checks the received HTTP Status code against expectedStatusCode.
+func GetAdminByID(adminID int64, expectedStatusCode int) (dataprovider.Admin, []byte, error) {
+	var admin dataprovider.Admin
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(adminPath, strconv.FormatInt(adminID, 10)), nil, "")
+	if err != nil {
+		return admin, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &admin)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return admin, body, err
+}
+
+// GetAdmins allows to get a list of admins and checks the received HTTP Status code against expectedStatusCode.
+// The number of results can be limited specifying a limit.
+// Some results can be skipped specifying an offset.
+// The results can be filtered specifying a username, the username filter is an exact match
+func GetAdmins(limit int64, offset int64, username string, expectedStatusCode int) ([]dataprovider.Admin, []byte, error) {
+	var admins []dataprovider.Admin
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(adminPath))
+	if err != nil {
+		return admins, body, err
+	}
+	q := url.Query()
+	if limit > 0 {
+		q.Add("limit", strconv.FormatInt(limit, 10))
+	}
+	if offset > 0 {
+		q.Add("offset", strconv.FormatInt(offset, 10))
+	}
+	if len(username) > 0 {
+		q.Add("username", username)
+	}
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return admins, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &admins)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return admins, body, err
+}
+
 // GetQuotaScans gets active quota scans and checks the received HTTP Status code against expectedStatusCode.
 func GetQuotaScans(expectedStatusCode int) ([]sftpd.ActiveQuotaScan, []byte, error) {
 	var quotaScans []sftpd.ActiveQuotaScan
 	var body []byte
-	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(quotaScanPath), nil, "")
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(quotaScanPath), nil, "")
+	if err != nil {
+		return quotaScans, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &quotaScans)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return quotaScans, body, err
+}
+
+// StartQuotaScan start a new quota scan for the given user and checks the received HTTP Status code against expectedStatusCode.
+func StartQuotaScan(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	userAsJSON, err := json.Marshal(user)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(quotaScanPath), bytes.NewBuffer(userAsJSON), "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// GetRetentionChecks returns the active retention checks
+func GetRetentionChecks(expectedStatusCode int) ([]eventmanager.ActiveRetentionCheck, []byte, error) {
+	var checks []eventmanager.ActiveRetentionCheck
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(retentionChecksPath), nil, "")
+	if err != nil {
+		return checks, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &checks)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return checks, body, err
+}
+
+// StartRetentionCheck starts a new retention check for the given username and checks the received HTTP Status code
+// against expectedStatusCode.
+func StartRetentionCheck(username string, check dataprovider.RetentionCheck, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	asJSON, err := json.Marshal(check)
+	if err != nil {
+		return body, err
+	}
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(retentionChecksPath, url.PathEscape(username)),
+		bytes.NewBuffer(asJSON), "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	body, _ = getResponseBody(resp)
+	return body, checkResponse(resp.StatusCode, expectedStatusCode)
+}
+
+// CheckUserPermission checks if the given operation on the given virtual path would be allowed for the specified
+// user and checks the received HTTP Status code against expectedStatusCode.
+func CheckUserPermission(username, operation, virtualPath string, expectedStatusCode int) (dataprovider.PermissionCheck, []byte, error) {
+	var result dataprovider.PermissionCheck
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(permissionCheckPath, url.PathEscape(username)))
+	if err != nil {
+		return result, body, err
+	}
+	q := url.Query()
+	q.Add("operation", operation)
+	q.Add("path", virtualPath)
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodGet, url.String(), nil, "")
+	if err != nil {
+		return result, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &result)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return result, body, err
+}
+
+// GetInterruptedUploads returns the interrupted atomic uploads for the given username and checks the received
+// HTTP Status code against expectedStatusCode.
+func GetInterruptedUploads(username string, expectedStatusCode int) ([]sftpd.InterruptedUpload, []byte, error) {
+	var uploads []sftpd.InterruptedUpload
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(interruptedUploadPath, url.PathEscape(username)),
+		nil, "")
 	if err != nil {
-		return quotaScans, body, err
+		return uploads, body, err
 	}
 	defer resp.Body.Close()
 	err = checkResponse(resp.StatusCode, expectedStatusCode)
 	if err == nil && expectedStatusCode == http.StatusOK {
-		err = render.DecodeJSON(resp.Body, &quotaScans)
+		err = render.DecodeJSON(resp.Body, &uploads)
 	} else {
 		body, _ = getResponseBody(resp)
 	}
-	return quotaScans, body, err
+	return uploads, body, err
 }
 
-// StartQuotaScan start a new quota scan for the given user and checks the received HTTP Status code against expectedStatusCode.
-func StartQuotaScan(user dataprovider.User, expectedStatusCode int) ([]byte, error) {
+// FinalizeInterruptedUpload renames the interrupted upload with the given temporary virtual path to the
+// requested path and checks the received HTTP Status code against expectedStatusCode.
+func FinalizeInterruptedUpload(username, tempPath string, expectedStatusCode int) ([]byte, error) {
+	return sendInterruptedUploadRequest(http.MethodPost, username, "finalize", tempPath, expectedStatusCode)
+}
+
+// PurgeInterruptedUpload removes the interrupted upload with the given temporary virtual path and checks
+// the received HTTP Status code against expectedStatusCode.
+func PurgeInterruptedUpload(username, tempPath string, expectedStatusCode int) ([]byte, error) {
+	return sendInterruptedUploadRequest(http.MethodDelete, username, "", tempPath, expectedStatusCode)
+}
+
+func sendInterruptedUploadRequest(method, username, action, tempPath string, expectedStatusCode int) ([]byte, error) {
 	var body []byte
-	userAsJSON, err := json.Marshal(user)
+	url, err := url.Parse(buildURLRelativeToBase(interruptedUploadPath, url.PathEscape(username), action))
 	if err != nil {
 		return body, err
 	}
-	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(quotaScanPath), bytes.NewBuffer(userAsJSON), "")
+	q := url.Query()
+	q.Add("path", tempPath)
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(method, url.String(), nil, "")
 	if err != nil {
 		return body, err
 	}
@@ -281,6 +1109,26 @@ func CloseConnection(connectionID string, expectedStatusCode int) ([]byte, error
 	return body, err
 }
 
+// CloseUserConnections closes all the active connections for the given username
+func CloseUserConnections(username string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(activeConnectionsPath))
+	if err != nil {
+		return body, err
+	}
+	q := url.Query()
+	q.Add("username", username)
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodDelete, url.String(), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
 // GetVersion returns version details
 func GetVersion(expectedStatusCode int) (utils.VersionInfo, []byte, error) {
 	var version utils.VersionInfo
@@ -317,6 +1165,109 @@ func GetProviderStatus(expectedStatusCode int) (map[string]interface{}, []byte,
 	return response, body, err
 }
 
+// GetDefenderHosts returns the banned hosts and the hosts with a score
+func GetDefenderHosts(expectedStatusCode int) ([]defender.Host, []byte, error) {
+	var hosts []defender.Host
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderHostsPath), nil, "")
+	if err != nil {
+		return hosts, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &hosts)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return hosts, body, err
+}
+
+// GetDefenderHost returns the defender status for the given IP
+func GetDefenderHost(ip string, expectedStatusCode int) (defender.Host, []byte, error) {
+	var host defender.Host
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderHostsPath, ip), nil, "")
+	if err != nil {
+		return host, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &host)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return host, body, err
+}
+
+// UnbanDefenderHost removes the ban and the score for the given IP
+func UnbanDefenderHost(ip string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodDelete, buildURLRelativeToBase(defenderHostsPath, ip), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// GetDefenderLists returns the defender safe and block lists
+func GetDefenderLists(expectedStatusCode int) (defender.Lists, []byte, error) {
+	var lists defender.Lists
+	var body []byte
+	resp, err := sendHTTPRequest(http.MethodGet, buildURLRelativeToBase(defenderListsPath), nil, "")
+	if err != nil {
+		return lists, body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	if err == nil && expectedStatusCode == http.StatusOK {
+		err = render.DecodeJSON(resp.Body, &lists)
+	} else {
+		body, _ = getResponseBody(resp)
+	}
+	return lists, body, err
+}
+
+// AddDefenderListEntry adds an IP address or a CIDR network to the given defender list
+func AddDefenderListEntry(list, entry string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	asJSON, _ := json.Marshal(map[string]string{"list": list, "entry": entry})
+	resp, err := sendHTTPRequest(http.MethodPost, buildURLRelativeToBase(defenderListsPath), bytes.NewBuffer(asJSON),
+		"application/json")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
+// RemoveDefenderListEntry removes an entry added at runtime from the given defender list
+func RemoveDefenderListEntry(list, entry string, expectedStatusCode int) ([]byte, error) {
+	var body []byte
+	url, err := url.Parse(buildURLRelativeToBase(defenderListsPath))
+	if err != nil {
+		return body, err
+	}
+	q := url.Query()
+	q.Add("list", list)
+	q.Add("entry", entry)
+	url.RawQuery = q.Encode()
+	resp, err := sendHTTPRequest(http.MethodDelete, url.String(), nil, "")
+	if err != nil {
+		return body, err
+	}
+	defer resp.Body.Close()
+	err = checkResponse(resp.StatusCode, expectedStatusCode)
+	body, _ = getResponseBody(resp)
+	return body, err
+}
+
 // Dumpdata requests a backup to outputFile.
 // outputFile is relative to the configured backups_path
 func Dumpdata(outputFile, indent string, expectedStatusCode int) (map[string]interface{}, []byte, error) {
@@ -426,9 +1377,188 @@ func checkUser(expected *dataprovider.User, actual *dataprovider.User) error {
 	if err := compareUserVirtualFolders(expected, actual); err != nil {
 		return err
 	}
+	if len(expected.Groups) != len(actual.Groups) {
+		return errors.New("Groups mismatch")
+	}
+	for idx, name := range expected.Groups {
+		if actual.Groups[idx] != name {
+			return errors.New("Groups mismatch")
+		}
+	}
 	return compareEqualsUserFields(expected, actual)
 }
 
+func checkAdmin(expected *dataprovider.Admin, actual *dataprovider.Admin) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual admin ID must be > 0")
+		}
+	} else if actual.ID != expected.ID {
+		return errors.New("admin ID mismatch")
+	}
+	if len(actual.Password) > 0 {
+		return errors.New("admin password must not be visible")
+	}
+	if expected.Username != actual.Username || expected.Description != actual.Description ||
+		expected.Status != actual.Status {
+		return errors.New("Username, description or status mismatch")
+	}
+	if len(expected.Permissions) != len(actual.Permissions) {
+		return errors.New("Permissions mismatch")
+	}
+	for _, p := range expected.Permissions {
+		if !utils.IsStringInSlice(p, actual.Permissions) {
+			return errors.New("Permissions content mismatch")
+		}
+	}
+	return nil
+}
+
+func checkGroup(expected *dataprovider.Group, actual *dataprovider.Group) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual group ID must be > 0")
+		}
+	} else if actual.ID != expected.ID {
+		return errors.New("group ID mismatch")
+	}
+	if expected.Name != actual.Name || expected.Description != actual.Description {
+		return errors.New("Name or description mismatch")
+	}
+	if expected.MaxSessions != actual.MaxSessions || expected.QuotaSize != actual.QuotaSize ||
+		expected.QuotaFiles != actual.QuotaFiles || expected.UploadBandwidth != actual.UploadBandwidth ||
+		expected.DownloadBandwidth != actual.DownloadBandwidth {
+		return errors.New("Limits mismatch")
+	}
+	if len(expected.Permissions) != len(actual.Permissions) {
+		return errors.New("Permissions mismatch")
+	}
+	for dir, perms := range expected.Permissions {
+		actualPerms, ok := actual.Permissions[dir]
+		if !ok {
+			return errors.New("Permissions directories mismatch")
+		}
+		for _, v := range actualPerms {
+			if !utils.IsStringInSlice(v, perms) {
+				return errors.New("Permissions contents mismatch")
+			}
+		}
+	}
+	// the filters and the filesystem are compared using the user helpers
+	expectedUser := &dataprovider.User{Filters: expected.Filters, FsConfig: expected.FsConfig}
+	actualUser := &dataprovider.User{Filters: actual.Filters, FsConfig: actual.FsConfig}
+	if err := compareUserFilters(expectedUser, actualUser); err != nil {
+		return err
+	}
+	return compareUserFsConfig(expectedUser, actualUser)
+}
+
+func checkUserTemplate(expected *dataprovider.UserTemplate, actual *dataprovider.UserTemplate) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual user template ID must be > 0")
+		}
+	} else if actual.ID != expected.ID {
+		return errors.New("user template ID mismatch")
+	}
+	if expected.Name != actual.Name || expected.Description != actual.Description {
+		return errors.New("Name or description mismatch")
+	}
+	if len(actual.User.Username) > 0 || len(actual.User.Password) > 0 {
+		return errors.New("the template user must not have username or password")
+	}
+	if expected.User.HomeDir != actual.User.HomeDir {
+		return errors.New("HomeDir mismatch")
+	}
+	if expected.User.QuotaSize != actual.User.QuotaSize || expected.User.QuotaFiles != actual.User.QuotaFiles {
+		return errors.New("Quota mismatch")
+	}
+	if len(expected.User.Permissions) != len(actual.User.Permissions) {
+		return errors.New("Permissions mismatch")
+	}
+	for dir, perms := range expected.User.Permissions {
+		actualPerms, ok := actual.User.Permissions[dir]
+		if !ok || len(actualPerms) != len(perms) {
+			return errors.New("Permissions directories mismatch")
+		}
+		for _, v := range actualPerms {
+			if !utils.IsStringInSlice(v, perms) {
+				return errors.New("Permissions contents mismatch")
+			}
+		}
+	}
+	if err := compareUserFilters(&expected.User, &actual.User); err != nil {
+		return err
+	}
+	if err := compareUserFsConfig(&expected.User, &actual.User); err != nil {
+		return err
+	}
+	return compareUserVirtualFolders(&expected.User, &actual.User)
+}
+
+func checkEventRule(expected *dataprovider.EventRule, actual *dataprovider.EventRule) error {
+	if expected.ID <= 0 {
+		if actual.ID <= 0 {
+			return errors.New("actual event rule ID must be > 0")
+		}
+	} else if actual.ID != expected.ID {
+		return errors.New("event rule ID mismatch")
+	}
+	if expected.Name != actual.Name || expected.Description != actual.Description {
+		return errors.New("Name or description mismatch")
+	}
+	if expected.Status != actual.Status || expected.Trigger != actual.Trigger {
+		return errors.New("Status or trigger mismatch")
+	}
+	if expected.Trigger == dataprovider.EventTriggerSchedule && expected.Conditions.Schedule != actual.Conditions.Schedule {
+		return errors.New("Schedule mismatch")
+	}
+	if expected.Trigger == dataprovider.EventTriggerFsEvent {
+		if len(expected.Conditions.FsEvents) != len(actual.Conditions.FsEvents) ||
+			len(expected.Conditions.Patterns) != len(actual.Conditions.Patterns) {
+			return errors.New("Filesystem conditions mismatch")
+		}
+		for _, event := range expected.Conditions.FsEvents {
+			if !utils.IsStringInSlice(event, actual.Conditions.FsEvents) {
+				return errors.New("Filesystem events mismatch")
+			}
+		}
+		for _, pattern := range expected.Conditions.Patterns {
+			if !utils.IsStringInSlice(pattern, actual.Conditions.Patterns) {
+				return errors.New("Patterns mismatch")
+			}
+		}
+	}
+	if len(expected.Conditions.Usernames) != len(actual.Conditions.Usernames) {
+		return errors.New("Usernames mismatch")
+	}
+	for _, username := range expected.Conditions.Usernames {
+		if !utils.IsStringInSlice(username, actual.Conditions.Usernames) {
+			return errors.New("Usernames mismatch")
+		}
+	}
+	if expected.Action.Type != actual.Action.Type || expected.Action.Command != actual.Action.Command ||
+		expected.Action.HTTPURL != actual.Action.HTTPURL || expected.Action.Timeout != actual.Action.Timeout ||
+		expected.Action.RetentionHours != actual.Action.RetentionHours ||
+		expected.Action.BackupPath != actual.Action.BackupPath || len(expected.Action.Paths) != len(actual.Action.Paths) {
+		return errors.New("Action mismatch")
+	}
+	for _, p := range expected.Action.Paths {
+		if !utils.IsStringInSlice(p, actual.Action.Paths) {
+			return errors.New("Action paths mismatch")
+		}
+	}
+	if len(expected.Action.Retention) != len(actual.Action.Retention) {
+		return errors.New("Action retention mismatch")
+	}
+	for idx, f := range expected.Action.Retention {
+		if f != actual.Action.Retention[idx] {
+			return errors.New("Action retention mismatch")
+		}
+	}
+	return nil
+}
+
 func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider.User) error {
 	if len(actual.VirtualFolders) != len(expected.VirtualFolders) {
 		return errors.New("Virtual folders mismatch")
@@ -437,7 +1567,8 @@ func compareUserVirtualFolders(expected *dataprovider.User, actual *dataprovider
 		found := false
 		for _, v1 := range expected.VirtualFolders {
 			if path.Clean(v.VirtualPath) == path.Clean(v1.VirtualPath) &&
-				filepath.Clean(v.MappedPath) == filepath.Clean(v1.MappedPath) {
+				filepath.Clean(v.MappedPath) == filepath.Clean(v1.MappedPath) &&
+				v.ExcludeFromQuota == v1.ExcludeFromQuota {
 				found = true
 				break
 			}
@@ -459,6 +1590,16 @@ func compareUserFsConfig(expected *dataprovider.User, actual *dataprovider.User)
 	if err := compareGCSConfig(expected, actual); err != nil {
 		return err
 	}
+	if err := compareAzBlobConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := compareSFTPConfig(expected, actual); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret("crypt passphrase", expected.FsConfig.CryptConfig.Passphrase,
+		actual.FsConfig.CryptConfig.Passphrase); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -472,7 +1613,8 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if expected.FsConfig.S3Config.AccessKey != actual.FsConfig.S3Config.AccessKey {
 		return errors.New("S3 access key mismatch")
 	}
-	if err := checkS3AccessSecret(expected.FsConfig.S3Config.AccessSecret, actual.FsConfig.S3Config.AccessSecret); err != nil {
+	if err := checkEncryptedSecret("S3 access secret", expected.FsConfig.S3Config.AccessSecret,
+		actual.FsConfig.S3Config.AccessSecret); err != nil {
 		return err
 	}
 	if expected.FsConfig.S3Config.Endpoint != actual.FsConfig.S3Config.Endpoint {
@@ -487,6 +1629,9 @@ func compareS3Config(expected *dataprovider.User, actual *dataprovider.User) err
 	if expected.FsConfig.S3Config.UploadConcurrency != actual.FsConfig.S3Config.UploadConcurrency {
 		return errors.New("S3 upload concurrency mismatch")
 	}
+	if expected.FsConfig.S3Config.ResumableUploads != actual.FsConfig.S3Config.ResumableUploads {
+		return errors.New("S3 resumable uploads mismatch")
+	}
 	if expected.FsConfig.S3Config.KeyPrefix != actual.FsConfig.S3Config.KeyPrefix &&
 		expected.FsConfig.S3Config.KeyPrefix+"/" != actual.FsConfig.S3Config.KeyPrefix {
 		return errors.New("S3 key prefix mismatch")
@@ -511,29 +1656,103 @@ func compareGCSConfig(expected *dataprovider.User, actual *dataprovider.User) er
 	return nil
 }
 
-func checkS3AccessSecret(expectedAccessSecret, actualAccessSecret string) error {
-	if len(expectedAccessSecret) > 0 {
-		vals := strings.Split(expectedAccessSecret, "$")
-		if strings.HasPrefix(expectedAccessSecret, "$aes$") && len(vals) == 4 {
-			expectedAccessSecret = utils.RemoveDecryptionKey(expectedAccessSecret)
-			if expectedAccessSecret != actualAccessSecret {
-				return fmt.Errorf("S3 access secret mismatch, expected: %v", expectedAccessSecret)
+func compareAzBlobConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.AzBlobConfig.Container != actual.FsConfig.AzBlobConfig.Container {
+		return errors.New("Azure Blob container mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.AccountName != actual.FsConfig.AzBlobConfig.AccountName {
+		return errors.New("Azure Blob account name mismatch")
+	}
+	if err := checkEncryptedSecret("Azure Blob account key", expected.FsConfig.AzBlobConfig.AccountKey,
+		actual.FsConfig.AzBlobConfig.AccountKey); err != nil {
+		return err
+	}
+	if expected.FsConfig.AzBlobConfig.Endpoint != actual.FsConfig.AzBlobConfig.Endpoint {
+		return errors.New("Azure Blob endpoint mismatch")
+	}
+	if err := checkEncryptedSecret("Azure Blob SAS URL", expected.FsConfig.AzBlobConfig.SASURL,
+		actual.FsConfig.AzBlobConfig.SASURL); err != nil {
+		return err
+	}
+	if expected.FsConfig.AzBlobConfig.UploadPartSize != actual.FsConfig.AzBlobConfig.UploadPartSize {
+		return errors.New("Azure Blob upload part size mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.UploadConcurrency != actual.FsConfig.AzBlobConfig.UploadConcurrency {
+		return errors.New("Azure Blob upload concurrency mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.UseEmulator != actual.FsConfig.AzBlobConfig.UseEmulator {
+		return errors.New("Azure Blob use emulator mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.AccessTier != actual.FsConfig.AzBlobConfig.AccessTier {
+		return errors.New("Azure Blob access tier mismatch")
+	}
+	if expected.FsConfig.AzBlobConfig.KeyPrefix != actual.FsConfig.AzBlobConfig.KeyPrefix &&
+		expected.FsConfig.AzBlobConfig.KeyPrefix+"/" != actual.FsConfig.AzBlobConfig.KeyPrefix {
+		return errors.New("Azure Blob key prefix mismatch")
+	}
+	return nil
+}
+
+func compareSFTPConfig(expected *dataprovider.User, actual *dataprovider.User) error {
+	if expected.FsConfig.SFTPConfig.Endpoint != actual.FsConfig.SFTPConfig.Endpoint {
+		return errors.New("SFTP endpoint mismatch")
+	}
+	if expected.FsConfig.SFTPConfig.Username != actual.FsConfig.SFTPConfig.Username {
+		return errors.New("SFTP username mismatch")
+	}
+	if err := checkEncryptedSecret("SFTP password", expected.FsConfig.SFTPConfig.Password,
+		actual.FsConfig.SFTPConfig.Password); err != nil {
+		return err
+	}
+	if err := checkEncryptedSecret("SFTP private key", expected.FsConfig.SFTPConfig.PrivateKey,
+		actual.FsConfig.SFTPConfig.PrivateKey); err != nil {
+		return err
+	}
+	if len(expected.FsConfig.SFTPConfig.Fingerprints) != len(actual.FsConfig.SFTPConfig.Fingerprints) {
+		return errors.New("SFTP fingerprints mismatch")
+	}
+	for _, fp := range expected.FsConfig.SFTPConfig.Fingerprints {
+		if !utils.IsStringInSlice(fp, actual.FsConfig.SFTPConfig.Fingerprints) {
+			return errors.New("SFTP fingerprints mismatch")
+		}
+	}
+	if expected.FsConfig.SFTPConfig.AcceptAnyHostKey != actual.FsConfig.SFTPConfig.AcceptAnyHostKey {
+		return errors.New("SFTP accept any host key mismatch")
+	}
+	expectedPrefix := expected.FsConfig.SFTPConfig.Prefix
+	if expected.FsConfig.Provider == 4 && len(expectedPrefix) == 0 {
+		expectedPrefix = "/"
+	}
+	if expectedPrefix != actual.FsConfig.SFTPConfig.Prefix &&
+		path.Clean(expectedPrefix) != actual.FsConfig.SFTPConfig.Prefix {
+		return errors.New("SFTP prefix mismatch")
+	}
+	return nil
+}
+
+func checkEncryptedSecret(secretName, expectedSecret, actualSecret string) error {
+	if len(expectedSecret) > 0 {
+		vals := strings.Split(expectedSecret, "$")
+		if kms.IsEncrypted(expectedSecret) {
+			expectedSecret = utils.RemoveDecryptionKey(expectedSecret)
+			if expectedSecret != actualSecret {
+				return fmt.Errorf("%v mismatch, expected: %v", secretName, expectedSecret)
 			}
 		} else {
-			// here we check that actualAccessSecret is aes encrypted without the nonce
-			parts := strings.Split(actualAccessSecret, "$")
-			if !strings.HasPrefix(actualAccessSecret, "$aes$") || len(parts) != 3 {
-				return errors.New("Invalid S3 access secret")
+			// here we check that actualSecret is encrypted without the decryption key
+			parts := strings.Split(actualSecret, "$")
+			if !kms.IsEncryptedWithoutKey(actualSecret) {
+				return fmt.Errorf("Invalid %v", secretName)
 			}
 			if len(parts) == len(vals) {
-				if expectedAccessSecret != actualAccessSecret {
-					return errors.New("S3 encrypted access secret mismatch")
+				if expectedSecret != actualSecret {
+					return fmt.Errorf("%v encrypted mismatch", secretName)
 				}
 			}
 		}
 	} else {
-		if expectedAccessSecret != actualAccessSecret {
-			return errors.New("S3 access secret mismatch")
+		if expectedSecret != actualSecret {
+			return fmt.Errorf("%v mismatch", secretName)
 		}
 	}
 	return nil
@@ -546,6 +1765,12 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 	if len(expected.Filters.DeniedIP) != len(actual.Filters.DeniedIP) {
 		return errors.New("DeniedIP mismatch")
 	}
+	if len(expected.Filters.AllowedCountries) != len(actual.Filters.AllowedCountries) {
+		return errors.New("AllowedCountries mismatch")
+	}
+	if len(expected.Filters.DeniedCountries) != len(actual.Filters.DeniedCountries) {
+		return errors.New("DeniedCountries mismatch")
+	}
 	if len(expected.Filters.DeniedLoginMethods) != len(actual.Filters.DeniedLoginMethods) {
 		return errors.New("Denied login methods mismatch")
 	}
@@ -559,14 +1784,81 @@ func compareUserFilters(expected *dataprovider.User, actual *dataprovider.User)
 			return errors.New("DeniedIP contents mismatch")
 		}
 	}
+	for _, country := range expected.Filters.AllowedCountries {
+		if !utils.IsStringInSlice(strings.ToUpper(country), actual.Filters.AllowedCountries) {
+			return errors.New("AllowedCountries contents mismatch")
+		}
+	}
+	for _, country := range expected.Filters.DeniedCountries {
+		if !utils.IsStringInSlice(strings.ToUpper(country), actual.Filters.DeniedCountries) {
+			return errors.New("DeniedCountries contents mismatch")
+		}
+	}
+	if expected.Filters.MaxUploadFileSize != actual.Filters.MaxUploadFileSize {
+		return errors.New("MaxUploadFileSize mismatch")
+	}
+	if len(expected.Filters.RevokedPublicKeys) != len(actual.Filters.RevokedPublicKeys) {
+		return errors.New("RevokedPublicKeys mismatch")
+	}
+	if len(expected.Filters.LoginMethodRules) != len(actual.Filters.LoginMethodRules) {
+		return errors.New("Login method rules mismatch")
+	}
+	for idx, rule := range expected.Filters.LoginMethodRules {
+		if rule.GetAsString() != actual.Filters.LoginMethodRules[idx].GetAsString() {
+			return errors.New("Login method rules contents mismatch")
+		}
+	}
 	for _, method := range expected.Filters.DeniedLoginMethods {
 		if !utils.IsStringInSlice(method, actual.Filters.DeniedLoginMethods) {
 			return errors.New("Denied login methods contents mismatch")
 		}
 	}
+	if err := checkEncryptedSecret("TOTP secret", expected.Filters.TOTPSecret, actual.Filters.TOTPSecret); err != nil {
+		return err
+	}
+	if expected.Filters.PasswordExpiration != actual.Filters.PasswordExpiration {
+		return errors.New("PasswordExpiration mismatch")
+	}
+	if expected.Filters.UploadMode != actual.Filters.UploadMode {
+		return errors.New("UploadMode mismatch")
+	}
+	if expected.Filters.SetstatMode != actual.Filters.SetstatMode {
+		return errors.New("SetstatMode mismatch")
+	}
 	if err := compareUserFileExtensionsFilters(expected, actual); err != nil {
 		return err
 	}
+	return compareUserFilePatternsFilters(expected, actual)
+}
+
+func compareUserFilePatternsFilters(expected *dataprovider.User, actual *dataprovider.User) error {
+	if len(expected.Filters.FilePatterns) != len(actual.Filters.FilePatterns) {
+		return errors.New("file patterns mismatch")
+	}
+	for _, f := range expected.Filters.FilePatterns {
+		found := false
+		for _, f1 := range actual.Filters.FilePatterns {
+			if path.Clean(f.Path) == path.Clean(f1.Path) {
+				if len(f.AllowedPatterns) != len(f1.AllowedPatterns) || len(f.DeniedPatterns) != len(f1.DeniedPatterns) {
+					return errors.New("file patterns contents mismatch")
+				}
+				for _, p := range f.AllowedPatterns {
+					if !utils.IsStringInSlice(strings.ToLower(p), f1.AllowedPatterns) {
+						return errors.New("file patterns contents mismatch")
+					}
+				}
+				for _, p := range f.DeniedPatterns {
+					if !utils.IsStringInSlice(strings.ToLower(p), f1.DeniedPatterns) {
+						return errors.New("file patterns contents mismatch")
+					}
+				}
+				found = true
+			}
+		}
+		if !found {
+			return errors.New("file patterns contents mismatch")
+		}
+	}
 	return nil
 }
 
@@ -632,11 +1924,23 @@ func compareEqualsUserFields(expected *dataprovider.User, actual *dataprovider.U
 	if expected.DownloadBandwidth != actual.DownloadBandwidth {
 		return errors.New("DownloadBandwidth mismatch")
 	}
+	if expected.UploadDataTransfer != actual.UploadDataTransfer {
+		return errors.New("UploadDataTransfer mismatch")
+	}
+	if expected.DownloadDataTransfer != actual.DownloadDataTransfer {
+		return errors.New("DownloadDataTransfer mismatch")
+	}
+	if expected.DataTransferReset != actual.DataTransferReset {
+		return errors.New("DataTransferReset mismatch")
+	}
 	if expected.Status != actual.Status {
 		return errors.New("Status mismatch")
 	}
 	if expected.ExpirationDate != actual.ExpirationDate {
 		return errors.New("ExpirationDate mismatch")
 	}
+	if expected.ActivationDate != actual.ActivationDate {
+		return errors.New("ActivationDate mismatch")
+	}
 	return nil
 }
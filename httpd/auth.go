@@ -1,6 +1,7 @@
 package httpd
 
 import (
+	"context"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -8,7 +9,9 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
 	unixcrypt "github.com/nathanaelle/password"
@@ -19,6 +22,16 @@ const (
 	authenticationHeader = "WWW-Authenticate"
 	authenticationRealm  = "SFTPGo Web"
 	unauthResponse       = "Unauthorized"
+	forbiddenResponse    = "Forbidden"
+)
+
+const (
+	adminKey    contextKey = "admin"
+	apiKeyIDKey contextKey = "api_key_id"
+	// header used to authenticate using an API key
+	apiKeyHeader = "X-SFTPGO-API-KEY"
+	// cookie used to store the web session token issued after the login
+	webSessionCookie = "sftpgo_web_session"
 )
 
 var (
@@ -108,9 +121,33 @@ func (p *basicAuthProvider) getHashedPassword(username string) (string, bool) {
 	return pwd, ok
 }
 
+// checkAuth authenticates the admins using a bearer token, an API key, HTTP basic authentication
+// or the web session issued after the login from the web interface.
+// If at least an admin is defined inside the data provider the credentials are validated against
+// the admins, otherwise the users defined inside the legacy auth user file, if any, are used and
+// they have all the permissions. API keys require admins defined inside the data provider.
+// The admins with 2FA enabled must provide the TOTP code, or a recovery code, for HTTP basic
+// authentication, using the X-SFTPGO-OTP header.
+// Unauthenticated requests for the web interface are redirected to the login page.
+// The authenticated admin is available in the request context
 func checkAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !validateCredentials(r) {
+		hasAdmins, err := dataprovider.HasAdmins(dataProvider)
+		if err != nil {
+			logger.Warn(logSender, "", "unable to check the defined admins: %v", err)
+			if strings.HasPrefix(r.RequestURI, apiPrefix) {
+				sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+			} else {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		admin, apiKeyID, ok := validateCredentials(w, r, hasAdmins)
+		if !ok {
+			if strings.HasPrefix(r.URL.Path, webBasePath) {
+				http.Redirect(w, r, webLoginPath, http.StatusFound)
+				return
+			}
 			w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", authenticationRealm))
 			if strings.HasPrefix(r.RequestURI, apiPrefix) {
 				sendAPIResponse(w, r, errors.New(unauthResponse), "", http.StatusUnauthorized)
@@ -119,18 +156,209 @@ func checkAuth(next http.Handler) http.Handler {
 			}
 			return
 		}
+		ctx := context.WithValue(r.Context(), adminKey, admin)
+		if len(apiKeyID) > 0 {
+			ctx = context.WithValue(ctx, apiKeyIDKey, apiKeyID)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// denyAPIKeyAuth rejects the requests authenticated using an API key, the API keys cannot
+// be used to issue tokens or to manage API keys
+func denyAPIKeyAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(getAPIKeyIDFromRequest(r)) > 0 {
+			sendAPIResponse(w, r, errors.New(forbiddenResponse), "this API is not allowed using an API key",
+				http.StatusForbidden)
+			return
+		}
 		next.ServeHTTP(w, r)
 	})
 }
 
-func validateCredentials(r *http.Request) bool {
-	if !httpAuth.isEnabled() {
-		return true
+// checkPerm allows the request only if the authenticated admin has the given permission
+func checkPerm(perm string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			admin := getAdminFromRequest(r)
+			if !admin.HasPermission(perm) {
+				if strings.HasPrefix(r.RequestURI, apiPrefix) {
+					sendAPIResponse(w, r, errors.New(forbiddenResponse), "", http.StatusForbidden)
+				} else {
+					http.Error(w, forbiddenResponse, http.StatusForbidden)
+				}
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func getAdminFromRequest(r *http.Request) dataprovider.Admin {
+	if admin, ok := r.Context().Value(adminKey).(dataprovider.Admin); ok {
+		return admin
+	}
+	return dataprovider.Admin{}
+}
+
+func getAPIKeyIDFromRequest(r *http.Request) string {
+	if keyID, ok := r.Context().Value(apiKeyIDKey).(string); ok {
+		return keyID
+	}
+	return ""
+}
+
+// getLegacyAdmin returns an admin with all the permissions, it is used if no admin is defined
+// inside the data provider
+func getLegacyAdmin(username string) dataprovider.Admin {
+	return dataprovider.Admin{
+		Username:    username,
+		Status:      1,
+		Permissions: []string{dataprovider.PermAdminAny},
+	}
+}
+
+// isAuthEnabled returns false if no admin is defined inside the data provider and
+// the legacy auth user file is not configured
+func isAuthEnabled(hasAdmins bool) bool {
+	return hasAdmins || httpAuth.isEnabled()
+}
+
+// validateCredentials returns the authenticated admin and, for API keys, the key id.
+// The web session, if used, is renewed when it is about to expire
+func validateCredentials(w http.ResponseWriter, r *http.Request, hasAdmins bool) (dataprovider.Admin, string, bool) {
+	if !isAuthEnabled(hasAdmins) {
+		return getLegacyAdmin(""), "", true
+	}
+	if token := getBearerToken(r); len(token) > 0 {
+		claims, ok := validateToken(token, tokenAudienceAPI)
+		if !ok {
+			return dataprovider.Admin{}, "", false
+		}
+		admin, ok := getTokenAdmin(claims, hasAdmins)
+		return admin, "", ok
+	}
+	if plainKey := r.Header.Get(apiKeyHeader); len(plainKey) > 0 {
+		if !hasAdmins {
+			return dataprovider.Admin{}, "", false
+		}
+		key, admin, err := dataprovider.CheckAPIKey(dataProvider, plainKey)
+		if err != nil {
+			logger.Debug(logSender, "", "unable to authenticate using API key %#v: %v", key.KeyID, err)
+			return dataprovider.Admin{}, "", false
+		}
+		admin.HideConfidentialData()
+		return admin, key.KeyID, true
 	}
 	username, password, ok := r.BasicAuth()
 	if !ok {
-		return false
+		admin, ok := validateWebSession(w, r, hasAdmins)
+		return admin, "", ok
+	}
+	if hasAdmins {
+		admin, err := dataprovider.CheckAdminAndPassAndCode(dataProvider, username, password, r.Header.Get(otpHeader))
+		if err != nil {
+			logger.Debug(logSender, "", "unable to authenticate admin %#v: %v", username, err)
+			return dataprovider.Admin{}, "", false
+		}
+		admin.HideConfidentialData()
+		return admin, "", true
+	}
+	if validateLegacyCredentials(username, password) {
+		return getLegacyAdmin(username), "", true
+	}
+	return dataprovider.Admin{}, "", false
+}
+
+func getBearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+// validateToken checks the given token for the given audience and returns its claims
+func validateToken(token, audience string) (jwtClaims, bool) {
+	claims, err := verifyToken(token, audience)
+	if err != nil {
+		logger.Debug(logSender, "", "unable to validate token: %v", err)
+		return claims, false
+	}
+	return claims, true
+}
+
+// validateWebSession checks the web session cookie, a new session token is issued if the
+// current one expires within half of its duration, so the active sessions do not expire
+func validateWebSession(w http.ResponseWriter, r *http.Request, hasAdmins bool) (dataprovider.Admin, bool) {
+	cookie, err := r.Cookie(webSessionCookie)
+	if err != nil || len(cookie.Value) == 0 {
+		return dataprovider.Admin{}, false
+	}
+	claims, ok := validateToken(cookie.Value, tokenAudienceWeb)
+	if !ok {
+		return dataprovider.Admin{}, false
+	}
+	admin, ok := getTokenAdmin(claims, hasAdmins)
+	if !ok {
+		return admin, false
 	}
+	if time.Until(time.Unix(claims.ExpiresAt, 0)) < tokenDuration/2 {
+		if err = setWebSession(w, r, admin); err != nil {
+			logger.Warn(logSender, "", "unable to renew the web session for admin %#v: %v", admin.Username, err)
+		}
+	}
+	return admin, true
+}
+
+// setWebSession issues a web session token for the given admin and stores it inside a cookie.
+// The cookie is not sent for cross-site requests
+func setWebSession(w http.ResponseWriter, r *http.Request, admin dataprovider.Admin) error {
+	token, expiresAt, err := createToken(admin, tokenAudienceWeb)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     webSessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return nil
+}
+
+func removeWebSession(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     webSessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// getTokenAdmin returns the admin for the given token claims, the admins defined inside the data
+// provider are loaded again so disabled and deleted admins cannot use the tokens issued before
+func getTokenAdmin(claims jwtClaims, hasAdmins bool) (dataprovider.Admin, bool) {
+	if !hasAdmins {
+		return getLegacyAdmin(claims.Subject), true
+	}
+	admin, err := dataprovider.AdminExists(dataProvider, claims.Subject)
+	if err != nil || admin.Status != 1 {
+		logger.Debug(logSender, "", "unable to validate token for admin %#v: %v", claims.Subject, err)
+		return dataprovider.Admin{}, false
+	}
+	admin.HideConfidentialData()
+	return admin, true
+}
+
+func validateLegacyCredentials(username, password string) bool {
 	if hashedPwd, ok := httpAuth.getHashedPassword(username); ok {
 		if utils.IsStringPrefixInSlice(hashedPwd, bcryptPwdPrefixes) {
 			err := bcrypt.CompareHashAndPassword([]byte(hashedPwd), []byte(password))
@@ -0,0 +1,721 @@
+package httpd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/ratelimiter"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	protocolHTTP = "HTTP"
+	// the last login is updated at most once in this interval, the clients authenticate each request
+	clientLastLoginMinDelay = 10 * time.Minute
+	clientAuthRealm         = "SFTPGo client API"
+)
+
+const (
+	transferUpload = iota
+	transferDownload
+)
+
+const (
+	// same values as the SFTP upload modes
+	uploadModeAtomicWithResume = 2
+)
+
+type contextKey string
+
+const (
+	clientConnectionKey contextKey = "client_connection"
+	shareKey            contextKey = "share"
+)
+
+var (
+	errQuotaExceeded   = errors.New("denying write due to space limit")
+	errClientForbidden = errors.New("permission denied")
+	errIsDirectory     = errors.New("is a directory")
+	errNotDirectory    = errors.New("not a directory")
+	errDisconnected    = errors.New("connection closed")
+	errNoChecksum      = errors.New("no checksum stored for this file")
+
+	errDataTransferQuotaExceeded = errors.New("denying transfer due to data transfer quota limit")
+	errUploadFileSizeExceeded    = errors.New("denying write due to maximum upload file size limit")
+)
+
+// clientConnection details for a request to the end user API.
+// It implements the sftpd.ActiveConnection interface so the request is
+// listed and can be closed using the connections API
+type clientConnection struct {
+	ID            string
+	User          dataprovider.User
+	ClientVersion string
+	RemoteAddr    net.Addr
+	StartTime     time.Time
+	lastActivity  time.Time
+	fs            vfs.Fs
+	ctx           context.Context
+	cancelFn      func()
+	transfers     []*clientTransfer
+	lock          *sync.Mutex
+}
+
+func (c *clientConnection) Log(level logger.LogLevel, format string, v ...interface{}) {
+	logger.Log(level, logSender, c.ID, format, v...)
+}
+
+func (c *clientConnection) getRemoteIP() string {
+	if c.RemoteAddr == nil {
+		return ""
+	}
+	return utils.GetIPFromRemoteAddress(c.RemoteAddr.String())
+}
+
+func (c *clientConnection) GetID() string {
+	return c.ID
+}
+
+func (c *clientConnection) GetUsername() string {
+	return c.User.Username
+}
+
+func (c *clientConnection) GetClientVersion() string {
+	return c.ClientVersion
+}
+
+func (c *clientConnection) GetRemoteAddress() net.Addr {
+	return c.RemoteAddr
+}
+
+func (c *clientConnection) GetProtocol() string {
+	return protocolHTTP
+}
+
+func (c *clientConnection) GetConnectionTime() time.Time {
+	return c.StartTime
+}
+
+func (c *clientConnection) GetLastActivity() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lastActivity := c.lastActivity
+	for _, t := range c.transfers {
+		if stats := t.getStats(); stats.LastActivity > utils.GetTimeAsMsSinceEpoch(lastActivity) {
+			lastActivity = utils.GetTimeFromMsecSinceEpoch(stats.LastActivity)
+		}
+	}
+	return lastActivity
+}
+
+func (c *clientConnection) GetUploadBandwidth() int64 {
+	return c.User.UploadBandwidth
+}
+
+func (c *clientConnection) GetDownloadBandwidth() int64 {
+	return c.User.DownloadBandwidth
+}
+
+func (c *clientConnection) GetTransfers() []sftpd.ConnectionTransfer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	transfers := []sftpd.ConnectionTransfer{}
+	for _, t := range c.transfers {
+		stats := t.getStats()
+		stats.Path = c.fs.GetRelativePath(t.fsPath)
+		transfers = append(transfers, stats)
+	}
+	return transfers
+}
+
+// Disconnect aborts the running request, the transfers in progress will fail
+func (c *clientConnection) Disconnect() error {
+	c.cancelFn()
+	return nil
+}
+
+func (c *clientConnection) isDisconnected() bool {
+	return c.ctx.Err() != nil
+}
+
+func (c *clientConnection) addTransfer(t *clientTransfer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transfers = append(c.transfers, t)
+}
+
+func (c *clientConnection) removeTransfer(t *clientTransfer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for idx, transfer := range c.transfers {
+		if transfer == t {
+			c.transfers = append(c.transfers[:idx], c.transfers[idx+1:]...)
+			break
+		}
+	}
+}
+
+// getFsError converts the filesystem specific errors to the os ones
+func (c *clientConnection) getFsError(err error) error {
+	if c.fs.IsNotExist(err) {
+		return os.ErrNotExist
+	}
+	if c.fs.IsPermission(err) {
+		return errClientForbidden
+	}
+	return err
+}
+
+func (c *clientConnection) hasSpace(checkFiles bool, fsPath string) bool {
+	if c.User.IsFileExcludedFromQuota(fsPath) {
+		return true
+	}
+	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
+		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				c.Log(logger.LevelWarn, "quota enforcement not possible for user %#v: %v", c.User.Username, err)
+				return true
+			}
+			c.Log(logger.LevelWarn, "error getting used quota for %#v: %v", c.User.Username, err)
+			return false
+		}
+		if (checkFiles && c.User.QuotaFiles > 0 && numFile >= c.User.QuotaFiles) ||
+			(c.User.QuotaSize > 0 && size >= c.User.QuotaSize) {
+			c.Log(logger.LevelDebug, "quota exceed for user %#v, num files: %v/%v, size: %v/%v check files: %v",
+				c.User.Username, numFile, c.User.QuotaFiles, size, c.User.QuotaSize, checkFiles)
+			return false
+		}
+	}
+	return true
+}
+
+// getMaxDataTransfer returns the data transfer, as bytes, still allowed for a new upload or download,
+// 0 means no limit. An error is returned if the data transfer quota is exceeded
+func (c *clientConnection) getMaxDataTransfer(isUpload bool) (int64, error) {
+	if !c.User.HasDataTransferRestrictions() {
+		return 0, nil
+	}
+	remaining, err := dataprovider.GetRemainingDataTransfer(dataProvider, c.User, isUpload)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, "data transfer quota enforcement not possible for user %#v: %v", c.User.Username, err)
+			return 0, nil
+		}
+		c.Log(logger.LevelWarn, "error getting used data transfer for %#v: %v", c.User.Username, err)
+		return 0, err
+	}
+	if remaining == 0 {
+		c.Log(logger.LevelInfo, "data transfer quota exceeded for user %#v, is upload? %v", c.User.Username, isUpload)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
+// checkClientAuth authenticates the end users using their SFTPGo credentials.
+// The authenticated connection is available in the request context
+func checkClientAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connectionID := xid.New().String()
+		if defender.IsBanned(utils.GetIPFromRemoteAddress(r.RemoteAddr)) {
+			sendAPIResponse(w, r, errors.New("banned client IP"), "", http.StatusForbidden)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", clientAuthRealm))
+			sendAPIResponse(w, r, errors.New(unauthResponse), "", http.StatusUnauthorized)
+			return
+		}
+		user, err := validateClientUser(username, password, r.RemoteAddr)
+		if err != nil {
+			w.Header().Set(authenticationHeader, fmt.Sprintf("Basic realm=\"%v\"", clientAuthRealm))
+			sendAPIResponse(w, r, errors.New(unauthResponse), "", http.StatusUnauthorized)
+			return
+		}
+		serveClientConnection(w, r, connectionID, user, next)
+	})
+}
+
+// serveClientConnection creates the filesystem and the connection for the given user and
+// serves the request using the given handler. The connection is listed as active until
+// the handler returns
+func serveClientConnection(w http.ResponseWriter, r *http.Request, connectionID string, user dataprovider.User,
+	handler http.Handler) {
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "could create filesystem for user %#v err: %v", user.Username, err)
+		sendAPIResponse(w, r, err, "", http.StatusInternalServerError)
+		return
+	}
+	defer fs.Close()
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+
+	ctx, cancelFn := context.WithCancel(r.Context())
+	defer cancelFn()
+	connection := &clientConnection{
+		ID:            connectionID,
+		User:          user,
+		ClientVersion: r.UserAgent(),
+		RemoteAddr:    getClientRemoteAddr(r.RemoteAddr),
+		StartTime:     time.Now(),
+		lastActivity:  time.Now(),
+		fs:            fs,
+		ctx:           ctx,
+		cancelFn:      cancelFn,
+		lock:          new(sync.Mutex),
+	}
+	sftpd.AddActiveConnection(connection)
+	defer sftpd.RemoveActiveConnection(connection)
+
+	ctx = context.WithValue(ctx, clientConnectionKey, connection)
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func getClientConnection(r *http.Request) *clientConnection {
+	return r.Context().Value(clientConnectionKey).(*clientConnection)
+}
+
+func validateClientUser(username, password, remoteAddr string) (dataprovider.User, error) {
+	method := dataprovider.SSHLoginMethodPassword
+	metrics.AddLoginAttempt(method)
+	user, err := dataprovider.CheckUserAndPass(dataProvider, username, password, utils.GetIPFromRemoteAddress(remoteAddr))
+	if err == nil {
+		err = checkClientLoginConditions(user, method, remoteAddr)
+	}
+	if err != nil {
+		ipAddr := utils.GetIPFromRemoteAddress(remoteAddr)
+		logger.ConnectionFailedLog(username, ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: username, Protocol: protocolHTTP, RemoteIP: ipAddr,
+			LoginMethod: method, Error: err.Error()})
+		addDefenderEvent(ipAddr, err)
+		ratelimiter.DelayLoginFailure(ipAddr, username)
+		metrics.AddLoginResult(method, err)
+		dataprovider.ExecutePostLoginHook(username, method, ipAddr, protocolHTTP, err)
+		return user, err
+	}
+	ratelimiter.ResetLoginFailures(username)
+	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(username, method, utils.GetIPFromRemoteAddress(remoteAddr), protocolHTTP, err)
+	if time.Since(utils.GetTimeFromMsecSinceEpoch(user.LastLogin)) > clientLastLoginMinDelay {
+		logger.Info(logSender, "", "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
+			user.ID, method, user.Username, user.HomeDir, remoteAddr)
+		dataprovider.UpdateLastLogin(dataProvider, user)
+	}
+	return user, nil
+}
+
+func checkClientLoginConditions(user dataprovider.User, loginMethod, remoteAddr string) error {
+	if !filepath.IsAbs(user.HomeDir) {
+		logger.Warn(logSender, "", "user %#v has an invalid home dir: %#v. Home dir must be an absolute path, login not allowed",
+			user.Username, user.HomeDir)
+		return fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
+	}
+	if user.MaxSessions > 0 {
+		activeSessions := sftpd.GetActiveSessions(user.Username)
+		if activeSessions >= user.MaxSessions {
+			logger.Debug(logSender, "", "authentication refused for user: %#v, too many open sessions: %v/%v", user.Username,
+				activeSessions, user.MaxSessions)
+			return fmt.Errorf("too many open sessions: %v", activeSessions)
+		}
+	}
+	if !user.IsLoginMethodAllowed(loginMethod, remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, login method %#v is not allowed", user.Username, loginMethod)
+		return fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
+	}
+	if !user.IsLoginFromAddrAllowed(remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
+	}
+	if allowed, country := user.IsLoginFromCountryAllowed(remoteAddr); !allowed {
+		logger.Debug(logSender, "", "cannot login user %#v, country %#v is not allowed: %v", user.Username, country, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from country %#v", user.Username, country)
+	}
+	return nil
+}
+
+func addDefenderEvent(ipAddr string, err error) {
+	event := defender.HostEventLoginFailed
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		event = defender.HostEventUserNotFound
+	}
+	defender.AddEvent(ipAddr, event)
+}
+
+func getClientRemoteAddr(remoteAddr string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
+
+// clientTransfer is an upload or a download started using the end user API
+type clientTransfer struct {
+	connection    *clientConnection
+	fsPath        string
+	transferType  int
+	file          *os.File
+	writerAt      vfs.PipeWriter
+	readerAt      *pipeat.PipeReaderAt
+	cancelFn      func()
+	start         time.Time
+	lastActivity  time.Time
+	bytesSent     int64
+	bytesReceived int64
+	isNewFile     bool
+	initialSize   int64
+	transferError error
+	isFinished    bool
+	// data transfer, as bytes, allowed for this transfer, 0 means no limit
+	maxDataTransfer int64
+	checksum        *sftpd.UploadChecksum
+	lock            *sync.Mutex
+}
+
+func newClientTransfer(connection *clientConnection, fsPath string, transferType int, file *os.File,
+	writerAt vfs.PipeWriter, readerAt *pipeat.PipeReaderAt, cancelFn func(), isNewFile bool,
+	initialSize int64) *clientTransfer {
+	t := &clientTransfer{
+		connection:   connection,
+		fsPath:       fsPath,
+		transferType: transferType,
+		file:         file,
+		writerAt:     writerAt,
+		readerAt:     readerAt,
+		cancelFn:     cancelFn,
+		start:        time.Now(),
+		lastActivity: time.Now(),
+		isNewFile:    isNewFile,
+		initialSize:  initialSize,
+		lock:         new(sync.Mutex),
+	}
+	if transferType == transferUpload {
+		t.checksum = sftpd.NewUploadChecksum()
+	}
+	connection.addTransfer(t)
+	return t
+}
+
+// Read reads the file to download, it handles download bandwidth throttling too
+func (t *clientTransfer) Read(p []byte) (int, error) {
+	if t.connection.isDisconnected() {
+		t.TransferError(errDisconnected)
+		return 0, errDisconnected
+	}
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	off := t.bytesSent
+	t.lock.Unlock()
+	if t.maxDataTransfer > 0 {
+		remaining := t.maxDataTransfer - off
+		if remaining <= 0 {
+			t.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	var n int
+	var err error
+	if t.readerAt != nil {
+		n, err = t.readerAt.ReadAt(p, off)
+	} else {
+		n, err = t.file.ReadAt(p, off)
+	}
+	t.lock.Lock()
+	t.bytesSent += int64(n)
+	t.lock.Unlock()
+	if err != nil && err != io.EOF {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, err
+}
+
+// Write writes the uploaded data, it handles upload bandwidth throttling too
+func (t *clientTransfer) Write(p []byte) (int, error) {
+	if t.connection.isDisconnected() {
+		t.TransferError(errDisconnected)
+		return 0, errDisconnected
+	}
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	off := t.bytesReceived
+	t.lock.Unlock()
+	if t.maxDataTransfer > 0 && off+int64(len(p)) > t.maxDataTransfer {
+		t.TransferError(errDataTransferQuotaExceeded)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if !t.connection.User.IsUploadSizeAllowed(off + int64(len(p))) {
+		t.TransferError(errUploadFileSizeExceeded)
+		return 0, errUploadFileSizeExceeded
+	}
+	var n int
+	var err error
+	if t.writerAt != nil {
+		n, err = t.writerAt.WriteAt(p, off)
+	} else {
+		n, err = t.file.WriteAt(p, off)
+	}
+	t.checksum.Update(p[:n], off)
+	t.lock.Lock()
+	t.bytesReceived += int64(n)
+	t.lock.Unlock()
+	if err != nil {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, err
+}
+
+// zipTransferWriter writes a zip archive to the response as a download,
+// so the bandwidth and data transfer limits are applied
+type zipTransferWriter struct {
+	transfer *clientTransfer
+	writer   io.Writer
+}
+
+func (z *zipTransferWriter) Write(p []byte) (int, error) {
+	t := z.transfer
+	if t.connection.isDisconnected() {
+		t.TransferError(errDisconnected)
+		return 0, errDisconnected
+	}
+	t.lock.Lock()
+	t.lastActivity = time.Now()
+	off := t.bytesSent
+	t.lock.Unlock()
+	if t.maxDataTransfer > 0 && off+int64(len(p)) > t.maxDataTransfer {
+		t.TransferError(errDataTransferQuotaExceeded)
+		return 0, errDataTransferQuotaExceeded
+	}
+	n, err := z.writer.Write(p)
+	t.lock.Lock()
+	t.bytesSent += int64(n)
+	t.lock.Unlock()
+	if err != nil {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, nil
+}
+
+// TransferError is called if there is an unexpected error.
+// For example network or client issues
+func (t *clientTransfer) TransferError(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.transferError != nil {
+		return
+	}
+	t.transferError = err
+	if t.cancelFn != nil {
+		t.cancelFn()
+	}
+	elapsed := time.Since(t.start).Nanoseconds() / 1000000
+	logger.Warn(logSender, t.connection.ID, "Unexpected error for transfer, path: %#v, error: \"%v\" bytes sent: %v, "+
+		"bytes received: %v transfer running since %v ms", t.fsPath, t.transferError, t.bytesSent, t.bytesReceived, elapsed)
+}
+
+// Close it is called when the transfer is completed.
+// It closes the underlying file, logs the transfer info, updates the user quota (for uploads)
+// and the used data transfer and executes any defined action.
+// If there is an error no action will be executed and, in atomic mode, we try to delete
+// the temporary file
+func (t *clientTransfer) Close() error {
+	t.connection.removeTransfer(t)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isFinished {
+		return errors.New("transfer already closed")
+	}
+	err := t.closeIO()
+	t.isFinished = true
+	numFiles := 0
+	if t.isNewFile {
+		numFiles = 1
+	}
+	metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, protocolHTTP, time.Since(t.start),
+		t.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, t.connection.User, t.bytesReceived, t.bytesSent)
+	var scanErr error
+	if t.transferType == transferUpload && t.file != nil && t.transferError == nil {
+		scanErr = sftpd.ScanUpload(t.file.Name(), t.fsPath, t.connection.User.Username, t.connection.ID, t.bytesReceived)
+		if scanErr != nil {
+			t.transferError = scanErr
+			numFiles--
+			t.bytesReceived = 0
+		}
+	}
+	if t.transferType == transferUpload && t.file != nil && t.file.Name() != t.fsPath && scanErr == nil {
+		if t.transferError == nil || sftpd.GetUserUploadMode(t.connection.User) == uploadModeAtomicWithResume {
+			err = os.Rename(t.file.Name(), t.fsPath)
+			logger.Debug(logSender, t.connection.ID, "atomic upload completed, rename: %#v -> %#v, error: %v",
+				t.file.Name(), t.fsPath, err)
+		} else {
+			err = os.Remove(t.file.Name())
+			logger.Warn(logSender, t.connection.ID, "atomic upload completed with error: \"%v\", delete temporary file: %#v, "+
+				"deletion error: %v", t.transferError, t.file.Name(), err)
+			if err == nil {
+				numFiles--
+				t.bytesReceived = 0
+			}
+		}
+	}
+	if t.transferError == nil {
+		elapsed := time.Since(t.start).Nanoseconds() / 1000000
+		if t.transferType == transferDownload {
+			logger.TransferLog("Download", t.fsPath, elapsed, t.bytesSent, t.connection.User.Username,
+				t.connection.ID, protocolHTTP)
+			go sftpd.ExecuteAction("download", t.connection.User.Username, t.fsPath, "", t.bytesSent, (t.file != nil))
+		} else {
+			logger.TransferLog("Upload", t.fsPath, elapsed, t.bytesReceived, t.connection.User.Username,
+				t.connection.ID, protocolHTTP)
+			if err == nil {
+				t.storeChecksum()
+			}
+			go sftpd.ExecuteAction("upload", t.connection.User.Username, t.fsPath, "", t.bytesReceived, (t.file != nil))
+		}
+	} else {
+		logger.Warn(logSender, t.connection.ID, "transfer error: %v, path: %#v", t.transferError, t.fsPath)
+		if err == nil {
+			err = t.transferError
+		}
+	}
+	if t.transferType == transferDownload {
+		audit.LogTransfer(false, t.connection.User.Username, protocolHTTP, t.connection.ID, t.connection.getRemoteIP(),
+			t.fsPath, t.bytesSent, time.Since(t.start), t.transferError)
+	} else {
+		audit.LogTransfer(true, t.connection.User.Username, protocolHTTP, t.connection.ID, t.connection.getRemoteIP(),
+			t.fsPath, t.bytesReceived, time.Since(t.start), t.transferError)
+	}
+	t.updateQuota(numFiles)
+	return err
+}
+
+// closeZip completes a zip download, there is no file to close and no action to execute
+func (t *clientTransfer) closeZip() {
+	t.connection.removeTransfer(t)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.isFinished {
+		return
+	}
+	t.isFinished = true
+	elapsed := time.Since(t.start)
+	metrics.TransferCompleted(t.bytesSent, 0, transferDownload, protocolHTTP, elapsed, t.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, t.connection.User, 0, t.bytesSent)
+	if t.transferError == nil {
+		logger.TransferLog("Download", t.fsPath, elapsed.Nanoseconds()/1000000, t.bytesSent, t.connection.User.Username,
+			t.connection.ID, protocolHTTP)
+	} else {
+		logger.Warn(logSender, t.connection.ID, "zip transfer error: %v, path: %#v", t.transferError, t.fsPath)
+	}
+	audit.LogTransfer(false, t.connection.User.Username, protocolHTTP, t.connection.ID, t.connection.getRemoteIP(),
+		t.fsPath, t.bytesSent, elapsed, t.transferError)
+}
+
+func (t *clientTransfer) storeChecksum() {
+	localPath := ""
+	if t.file != nil {
+		localPath = t.fsPath
+	}
+	t.checksum.Store(t.connection.fs, t.fsPath, localPath, t.connection.ID)
+}
+
+func (t *clientTransfer) closeIO() error {
+	var err error
+	if t.writerAt != nil {
+		err = t.writerAt.Close()
+	} else if t.readerAt != nil {
+		err = t.readerAt.Close()
+	} else {
+		err = t.file.Close()
+	}
+	return err
+}
+
+func (t *clientTransfer) updateQuota(numFiles int) bool {
+	// uploads to remote filesystems are atomic, if there is an error nothing is uploaded
+	if t.file == nil && t.transferError != nil {
+		return false
+	}
+	if t.connection.User.IsFileExcludedFromQuota(t.fsPath) {
+		return false
+	}
+	if t.transferType == transferUpload && (numFiles != 0 || t.bytesReceived > 0) {
+		dataprovider.UpdateUserQuota(dataProvider, t.connection.User, numFiles, t.bytesReceived-t.initialSize, false)
+		return true
+	}
+	return false
+}
+
+func (t *clientTransfer) handleThrottle(size int) {
+	var wantedBandwidth int64
+	var trasferredBytes int64
+	t.lock.Lock()
+	if t.transferType == transferDownload {
+		wantedBandwidth = t.connection.User.DownloadBandwidth
+		trasferredBytes = t.bytesSent
+	} else {
+		wantedBandwidth = t.connection.User.UploadBandwidth
+		trasferredBytes = t.bytesReceived
+	}
+	t.lock.Unlock()
+	if wantedBandwidth > 0 {
+		// real and wanted elapsed as milliseconds, bytes as kilobytes
+		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
+		// trasferredBytes / 1000 = KB/s, we multiply for 1000 to get milliseconds
+		wantedElapsed := 1000 * (trasferredBytes / 1000) / wantedBandwidth
+		if wantedElapsed > realElapsed {
+			toSleep := time.Duration(wantedElapsed - realElapsed)
+			time.Sleep(toSleep * time.Millisecond)
+		}
+	}
+	bandwidth.Throttle(utils.GetIPFromRemoteAddress(t.connection.RemoteAddr.String()), protocolHTTP,
+		t.transferType == transferUpload, int64(size))
+}
+
+func (t *clientTransfer) getStats() sftpd.ConnectionTransfer {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	operationType := "upload"
+	size := t.bytesReceived
+	if t.transferType == transferDownload {
+		operationType = "download"
+		size = t.bytesSent
+	}
+	return sftpd.ConnectionTransfer{
+		OperationType: operationType,
+		StartTime:     utils.GetTimeAsMsSinceEpoch(t.start),
+		Size:          size,
+		LastActivity:  utils.GetTimeAsMsSinceEpoch(t.lastActivity),
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/drakkan/sftpgo/acme"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/utils"
@@ -25,15 +26,36 @@ const (
 	activeConnectionsPath = "/api/v1/connection"
 	quotaScanPath         = "/api/v1/quota_scan"
 	userPath              = "/api/v1/user"
+	groupPath             = "/api/v1/group"
+	adminPath             = "/api/v1/admin"
+	admin2FAPath          = "/api/v1/admin/2fa"
+	tokenPath             = "/api/v1/token"
+	apiKeyPath            = "/api/v1/apikey"
 	versionPath           = "/api/v1/version"
 	providerStatusPath    = "/api/v1/providerstatus"
+	defenderHostsPath     = "/api/v1/defender/hosts"
+	defenderListsPath     = "/api/v1/defender/lists"
 	dumpDataPath          = "/api/v1/dumpdata"
 	loadDataPath          = "/api/v1/loaddata"
+	clientFilesPath       = "/api/v1/client/files"
+	clientChecksumPath    = "/api/v1/client/files/checksum"
+	clientDirsPath        = "/api/v1/client/dirs"
+	clientZipPath         = "/api/v1/client/dirs/zip"
+	clientSharesPath      = "/api/v1/client/shares"
+	sharesPath            = "/api/v1/shares"
+	eventRulePath         = "/api/v1/eventrule"
+	userTemplatePath      = "/api/v1/usertemplate"
+	retentionChecksPath   = "/api/v1/retention/checks"
+	permissionCheckPath   = "/api/v1/permcheck"
+	interruptedUploadPath = "/api/v1/uploads/interrupted"
 	metricsPath           = "/metrics"
 	webBasePath           = "/web"
 	webUsersPath          = "/web/users"
 	webUserPath           = "/web/user"
 	webConnectionsPath    = "/web/connections"
+	webAdmin2FAPath       = "/web/admin/2fa"
+	webLoginPath          = "/web/login"
+	webLogoutPath         = "/web/logout"
 	webStaticFilesPath    = "/static"
 	maxRestoreSize        = 10485760 // 10 MB
 	maxRequestSize        = 1048576  // 1MB
@@ -44,7 +66,7 @@ var (
 	dataProvider dataprovider.Provider
 	backupsPath  string
 	httpAuth     httpAuthProvider
-	certMgr      *certManager
+	certMgr      *utils.CertManager
 )
 
 // Conf httpd daemon configuration
@@ -63,7 +85,8 @@ type Conf struct {
 	// This can be an absolute path or a path relative to the config dir.
 	// We support HTTP basic authentication and the file format must conform to the one generated using the Apache
 	// htpasswd tool. The supported password formats are bcrypt ($2y$ prefix) and md5 crypt ($apr1$ prefix).
-	// If empty HTTP authentication is disabled
+	// If empty HTTP authentication is disabled.
+	// This file is used only if no admin is defined inside the data provider, its users have all the permissions
 	AuthUserFile string `json:"auth_user_file" mapstructure:"auth_user_file"`
 	// If files containing a certificate and matching private key for the server are provided the server will expect
 	// HTTPS connections.
@@ -71,6 +94,10 @@ type Conf struct {
 	// "paramchange" request to the running service on Windows.
 	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
 	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+	// Passphrase used to derive the signing key for the access tokens. If empty a random key is generated
+	// at each start, so the issued tokens are invalidated on restart and they cannot be shared between
+	// multiple instances
+	SigningPassphrase string `json:"signing_passphrase" mapstructure:"signing_passphrase"`
 }
 
 type apiResponse struct {
@@ -100,6 +127,9 @@ func (c Conf) Initialize(configDir string) error {
 	if err != nil {
 		return err
 	}
+	if err = initializeJWTSigningKey(c.SigningPassphrase); err != nil {
+		return err
+	}
 	certificateFile := getConfigPath(c.CertificateFile, configDir)
 	certificateKeyFile := getConfigPath(c.CertificateKeyFile, configDir)
 	loadTemplates(templatesPath)
@@ -113,7 +143,7 @@ func (c Conf) Initialize(configDir string) error {
 		MaxHeaderBytes: 1 << 16, // 64KB
 	}
 	if len(certificateFile) > 0 && len(certificateKeyFile) > 0 {
-		certMgr, err = newCertManager(certificateFile, certificateKeyFile)
+		certMgr, err = utils.NewCertManager(certificateFile, certificateKeyFile, logSender)
 		if err != nil {
 			return err
 		}
@@ -123,13 +153,17 @@ func (c Conf) Initialize(configDir string) error {
 		httpServer.TLSConfig = config
 		return httpServer.ListenAndServeTLS("", "")
 	}
+	if acme.IsEnabledForProtocol(acme.ProtocolHTTP) {
+		httpServer.TLSConfig = acme.GetTLSConfig()
+		return httpServer.ListenAndServeTLS("", "")
+	}
 	return httpServer.ListenAndServe()
 }
 
 // ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
 func ReloadTLSCertificate() {
 	if certMgr != nil {
-		certMgr.loadCertificate()
+		certMgr.LoadCertificate()
 	}
 }
 
@@ -13,6 +13,7 @@ import (
 	"runtime"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/sftpd"
@@ -624,3 +625,108 @@ func TestQuotaScanInvalidFs(t *testing.T) {
 		t.Error("quota scan with bad fs must fail")
 	}
 }
+
+func TestJWTSigningPassphrase(t *testing.T) {
+	savedKey := jwtSigningKey
+	defer func() {
+		jwtSigningKey = savedKey
+	}()
+	admin := dataprovider.Admin{
+		Username:    "admin",
+		Permissions: []string{dataprovider.PermAdminAny},
+	}
+	if err := initializeJWTSigningKey("signing passphrase"); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	token, _, err := createToken(admin, tokenAudienceAPI)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	// a restart with the same passphrase keeps the tokens valid
+	if err = initializeJWTSigningKey("signing passphrase"); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	claims, err := verifyToken(token, tokenAudienceAPI)
+	if err != nil {
+		t.Errorf("the token must be valid with the same passphrase: %v", err)
+	}
+	if claims.Subject != admin.Username {
+		t.Errorf("unexpected subject: %#v", claims.Subject)
+	}
+	if _, err = verifyToken(token, tokenAudienceWeb); err != errInvalidToken {
+		t.Errorf("an API token must not be accepted as web session, got: %v", err)
+	}
+	if err = initializeJWTSigningKey("another passphrase"); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	if _, err = verifyToken(token, tokenAudienceAPI); err != errInvalidToken {
+		t.Errorf("the token must be invalid with a different passphrase, got: %v", err)
+	}
+	// without a passphrase a random key is generated each time
+	if err = initializeJWTSigningKey(""); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	token, _, err = createToken(admin, tokenAudienceAPI)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	if err = initializeJWTSigningKey(""); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	if _, err = verifyToken(token, tokenAudienceAPI); err != errInvalidToken {
+		t.Errorf("the token must be invalid after regenerating the key, got: %v", err)
+	}
+}
+
+func TestWebSessionRenewal(t *testing.T) {
+	savedKey := jwtSigningKey
+	defer func() {
+		jwtSigningKey = savedKey
+	}()
+	if err := initializeJWTSigningKey(""); err != nil {
+		t.Fatalf("unable to initialize the signing key: %v", err)
+	}
+	claims := jwtClaims{
+		Subject:   "admin",
+		Audience:  tokenAudienceWeb,
+		IssuedAt:  time.Now().Add(-tokenDuration).Unix(),
+		ExpiresAt: time.Now().Add(time.Minute).Unix(),
+	}
+	token, err := encodeToken(claims)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	req, _ := http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req.AddCookie(&http.Cookie{Name: webSessionCookie, Value: token})
+	rr := httptest.NewRecorder()
+	admin, ok := validateWebSession(rr, req, false)
+	if !ok || admin.Username != claims.Subject {
+		t.Errorf("the web session must be valid, admin: %#v", admin.Username)
+	}
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != webSessionCookie || cookies[0].Value == token ||
+		!cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteStrictMode {
+		t.Errorf("the web session about to expire must be renewed: %+v", cookies)
+	}
+	// a new session is not renewed
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req.AddCookie(cookies[0])
+	rr = httptest.NewRecorder()
+	if _, ok = validateWebSession(rr, req, false); !ok {
+		t.Error("the renewed web session must be valid")
+	}
+	if len(rr.Result().Cookies()) != 0 {
+		t.Errorf("a new web session must not be renewed: %+v", rr.Result().Cookies())
+	}
+	// the access tokens cannot be used as web session
+	claims.Audience = tokenAudienceAPI
+	token, err = encodeToken(claims)
+	if err != nil {
+		t.Fatalf("unable to create token: %v", err)
+	}
+	req, _ = http.NewRequest(http.MethodGet, webUsersPath, nil)
+	req.AddCookie(&http.Cookie{Name: webSessionCookie, Value: token})
+	if _, ok = validateWebSession(httptest.NewRecorder(), req, false); ok {
+		t.Error("an access token must not be accepted as web session")
+	}
+}
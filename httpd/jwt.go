@@ -0,0 +1,126 @@
+package httpd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+)
+
+const (
+	tokenDuration = 20 * time.Minute
+	// header for HS256 signed JWTs, it is the only supported algorithm
+	jwtHeader = `{"alg":"HS256","typ":"JWT"}`
+	// the tokens for the REST API cannot be used as web sessions and vice versa
+	tokenAudienceAPI = "API"
+	tokenAudienceWeb = "Web"
+)
+
+var (
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token is expired")
+	// the signing key is derived from the configured passphrase, if any, otherwise it is regenerated
+	// at each start and the issued tokens are invalidated on restart
+	jwtSigningKey []byte
+)
+
+// jwtClaims defines the claims for the tokens issued to the admins
+type jwtClaims struct {
+	ID          string   `json:"jti"`
+	Subject     string   `json:"sub"`
+	Audience    string   `json:"aud"`
+	Permissions []string `json:"permissions"`
+	IssuedAt    int64    `json:"iat"`
+	ExpiresAt   int64    `json:"exp"`
+}
+
+func initializeJWTSigningKey(passphrase string) error {
+	if len(passphrase) > 0 {
+		key := sha256.Sum256([]byte(passphrase))
+		jwtSigningKey = key[:]
+		return nil
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	jwtSigningKey = key
+	return nil
+}
+
+// createToken returns a short-lived token for the given admin and audience and its expiration time
+func createToken(admin dataprovider.Admin, audience string) (string, time.Time, error) {
+	now := time.Now()
+	expiresAt := now.Add(tokenDuration)
+	if len(jwtSigningKey) == 0 {
+		return "", expiresAt, errors.New("the token signing key is not initialized")
+	}
+	claims := jwtClaims{
+		ID:          xid.New().String(),
+		Subject:     admin.Username,
+		Audience:    audience,
+		Permissions: admin.Permissions,
+		IssuedAt:    now.Unix(),
+		ExpiresAt:   expiresAt.Unix(),
+	}
+	token, err := encodeToken(claims)
+	return token, expiresAt, err
+}
+
+// encodeToken returns the signed token for the given claims
+func encodeToken(claims jwtClaims) (string, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(jwtHeader)) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	return unsigned + "." + signToken(unsigned), nil
+}
+
+// verifyToken checks the token signature, audience and expiration and returns its claims
+func verifyToken(token, audience string) (jwtClaims, error) {
+	var claims jwtClaims
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || len(jwtSigningKey) == 0 {
+		return claims, errInvalidToken
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	var h struct {
+		Alg string `json:"alg"`
+	}
+	if err = json.Unmarshal(header, &h); err != nil || h.Alg != "HS256" {
+		return claims, errInvalidToken
+	}
+	if !hmac.Equal([]byte(signToken(parts[0]+"."+parts[1])), []byte(parts[2])) {
+		return claims, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, errInvalidToken
+	}
+	if err = json.Unmarshal(payload, &claims); err != nil || claims.Audience != audience {
+		return claims, errInvalidToken
+	}
+	if claims.ExpiresAt < time.Now().Unix() {
+		return claims, errExpiredToken
+	}
+	return claims, nil
+}
+
+func signToken(unsigned string) string {
+	mac := hmac.New(sha256.New, jwtSigningKey)
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
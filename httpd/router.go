@@ -1,6 +1,7 @@
 package httpd
 
 import (
+	"fmt"
 	"net/http"
 
 	"github.com/drakkan/sftpgo/dataprovider"
@@ -37,6 +38,18 @@ func initializeRouter(staticFilesPath string) {
 		http.Redirect(w, r, webUsersPath, http.StatusMovedPermanently)
 	})
 
+	router.Get(webLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		handleWebLoginGet(w, r)
+	})
+
+	router.Post(webLoginPath, func(w http.ResponseWriter, r *http.Request) {
+		handleWebLoginPost(w, r)
+	})
+
+	router.Get(webLogoutPath, func(w http.ResponseWriter, r *http.Request) {
+		handleWebLogout(w, r)
+	})
+
 	router.Group(func(router chi.Router) {
 		router.Use(checkAuth)
 
@@ -50,6 +63,22 @@ func initializeRouter(staticFilesPath string) {
 			render.JSON(w, r, utils.GetAppVersion())
 		})
 
+		router.With(denyAPIKeyAuth).Get(tokenPath, func(w http.ResponseWriter, r *http.Request) {
+			getToken(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Get(apiKeyPath, func(w http.ResponseWriter, r *http.Request) {
+			getAPIKeys(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Post(apiKeyPath, func(w http.ResponseWriter, r *http.Request) {
+			addAPIKey(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Delete(apiKeyPath+"/{keyID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteAPIKey(w, r)
+		})
+
 		router.Get(providerStatusPath, func(w http.ResponseWriter, r *http.Request) {
 			err := dataprovider.GetProviderStatus(dataProvider)
 			if err != nil {
@@ -59,73 +88,300 @@ func initializeRouter(staticFilesPath string) {
 			}
 		})
 
-		router.Get(activeConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(activeConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
 			render.JSON(w, r, sftpd.GetConnectionsStats())
 		})
 
-		router.Delete(activeConnectionsPath+"/{connectionID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminCloseConnections)).Delete(activeConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
+			handleCloseUserConnections(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminCloseConnections)).Delete(activeConnectionsPath+"/{connectionID}", func(w http.ResponseWriter, r *http.Request) {
 			handleCloseConnection(w, r)
 		})
 
-		router.Get(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Get(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
 			getQuotaScans(w, r)
 		})
 
-		router.Post(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminQuotaScans)).Post(quotaScanPath, func(w http.ResponseWriter, r *http.Request) {
 			startQuotaScan(w, r)
 		})
 
-		router.Get(userPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath, func(w http.ResponseWriter, r *http.Request) {
 			getUsers(w, r)
 		})
 
-		router.Post(userPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminAddUsers)).Post(userPath, func(w http.ResponseWriter, r *http.Request) {
 			addUser(w, r)
 		})
 
-		router.Get(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 			getUserByID(w, r)
 		})
 
-		router.Put(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Put(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 			updateUser(w, r)
 		})
 
-		router.Delete(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Delete(userPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 			deleteUser(w, r)
 		})
 
-		router.Get(dumpDataPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(groupPath, func(w http.ResponseWriter, r *http.Request) {
+			getGroups(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Post(groupPath, func(w http.ResponseWriter, r *http.Request) {
+			addGroup(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(groupPath+"/{groupID}", func(w http.ResponseWriter, r *http.Request) {
+			getGroupByID(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Put(groupPath+"/{groupID}", func(w http.ResponseWriter, r *http.Request) {
+			updateGroup(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Delete(groupPath+"/{groupID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteGroup(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userTemplatePath, func(w http.ResponseWriter, r *http.Request) {
+			getUserTemplates(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Post(userTemplatePath, func(w http.ResponseWriter, r *http.Request) {
+			addUserTemplate(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(userTemplatePath+"/{templateID}", func(w http.ResponseWriter, r *http.Request) {
+			getUserTemplateByID(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Put(userTemplatePath+"/{templateID}", func(w http.ResponseWriter, r *http.Request) {
+			updateUserTemplate(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Delete(userTemplatePath+"/{templateID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteUserTemplate(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminAddUsers)).Post(userTemplatePath+"/{templateID}/users", func(w http.ResponseWriter, r *http.Request) {
+			addUsersFromTemplate(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Get(admin2FAPath, func(w http.ResponseWriter, r *http.Request) {
+			getAdminTOTPStatus(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Delete(admin2FAPath, func(w http.ResponseWriter, r *http.Request) {
+			disableAdminTOTP(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Post(admin2FAPath+"/generate", func(w http.ResponseWriter, r *http.Request) {
+			generateAdminTOTPSecret(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Post(admin2FAPath+"/enable", func(w http.ResponseWriter, r *http.Request) {
+			enableAdminTOTP(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Post(admin2FAPath+"/recoverycodes", func(w http.ResponseWriter, r *http.Request) {
+			regenerateAdminRecoveryCodes(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Get(adminPath, func(w http.ResponseWriter, r *http.Request) {
+			getAdmins(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Post(adminPath, func(w http.ResponseWriter, r *http.Request) {
+			addAdmin(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Get(adminPath+"/{adminID}", func(w http.ResponseWriter, r *http.Request) {
+			getAdminByID(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Put(adminPath+"/{adminID}", func(w http.ResponseWriter, r *http.Request) {
+			updateAdmin(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Delete(adminPath+"/{adminID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteAdmin(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageAdmins)).Delete(adminPath+"/{adminID}/2fa", func(w http.ResponseWriter, r *http.Request) {
+			disableAdminTOTPByID(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHostsPath, func(w http.ResponseWriter, r *http.Request) {
+			getDefenderHosts(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderHostsPath+"/{ip}", func(w http.ResponseWriter, r *http.Request) {
+			getDefenderHost(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminManageDefender)).Delete(defenderHostsPath+"/{ip}", func(w http.ResponseWriter, r *http.Request) {
+			unbanDefenderHost(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminViewDefender)).Get(defenderListsPath, func(w http.ResponseWriter, r *http.Request) {
+			getDefenderLists(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminManageDefender)).Post(defenderListsPath, func(w http.ResponseWriter, r *http.Request) {
+			addDefenderListEntry(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminManageDefender)).Delete(defenderListsPath, func(w http.ResponseWriter, r *http.Request) {
+			removeDefenderListEntry(w, r)
+		})
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(eventRulePath, func(w http.ResponseWriter, r *http.Request) {
+			getEventRules(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Post(eventRulePath, func(w http.ResponseWriter, r *http.Request) {
+			addEventRule(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(eventRulePath+"/{ruleID}", func(w http.ResponseWriter, r *http.Request) {
+			getEventRuleByID(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Put(eventRulePath+"/{ruleID}", func(w http.ResponseWriter, r *http.Request) {
+			updateEventRule(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Delete(eventRulePath+"/{ruleID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteEventRule(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminRetentionChecks)).Get(retentionChecksPath, func(w http.ResponseWriter, r *http.Request) {
+			getRetentionChecks(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminRetentionChecks)).Post(retentionChecksPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+			startRetentionCheck(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(permissionCheckPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+			checkUserPermission(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(interruptedUploadPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+			getInterruptedUploads(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Post(interruptedUploadPath+"/{username}/finalize", func(w http.ResponseWriter, r *http.Request) {
+			finalizeInterruptedUpload(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Delete(interruptedUploadPath+"/{username}", func(w http.ResponseWriter, r *http.Request) {
+			purgeInterruptedUpload(w, r)
+		})
+
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(dumpDataPath, func(w http.ResponseWriter, r *http.Request) {
 			dumpData(w, r)
 		})
 
-		router.Get(loadDataPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminManageSystem)).Get(loadDataPath, func(w http.ResponseWriter, r *http.Request) {
 			loadData(w, r)
 		})
 
-		router.Get(webUsersPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(webUsersPath, func(w http.ResponseWriter, r *http.Request) {
 			handleGetWebUsers(w, r)
 		})
 
-		router.Get(webUserPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminAddUsers)).Get(webUserPath, func(w http.ResponseWriter, r *http.Request) {
 			handleWebAddUserGet(w, r)
 		})
 
-		router.Get(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewUsers)).Get(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 			handleWebUpdateUserGet(chi.URLParam(r, "userID"), w, r)
 		})
 
-		router.Post(webUserPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminAddUsers)).Post(webUserPath, func(w http.ResponseWriter, r *http.Request) {
 			handleWebAddUserPost(w, r)
 		})
 
-		router.Post(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminManageUsers)).Post(webUserPath+"/{userID}", func(w http.ResponseWriter, r *http.Request) {
 			handleWebUpdateUserPost(chi.URLParam(r, "userID"), w, r)
 		})
 
-		router.Get(webConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
+		router.With(checkPerm(dataprovider.PermAdminViewConnections)).Get(webConnectionsPath, func(w http.ResponseWriter, r *http.Request) {
 			handleWebGetConnections(w, r)
 		})
+
+		router.With(denyAPIKeyAuth).Get(webAdmin2FAPath, func(w http.ResponseWriter, r *http.Request) {
+			handleWebAdmin2FAGet(w, r)
+		})
+
+		router.With(denyAPIKeyAuth).Post(webAdmin2FAPath, func(w http.ResponseWriter, r *http.Request) {
+			handleWebAdmin2FAPost(w, r)
+		})
+	})
+
+	router.Group(func(router chi.Router) {
+		router.Use(checkClientAuth)
+
+		router.Get(clientDirsPath, func(w http.ResponseWriter, r *http.Request) {
+			clientListDir(w, r)
+		})
+
+		router.Post(clientDirsPath, func(w http.ResponseWriter, r *http.Request) {
+			clientMkdir(w, r)
+		})
+
+		router.Delete(clientDirsPath, func(w http.ResponseWriter, r *http.Request) {
+			clientRmdir(w, r)
+		})
+
+		router.Get(clientZipPath, func(w http.ResponseWriter, r *http.Request) {
+			clientDownloadZip(w, r)
+		})
+
+		router.Get(clientFilesPath, func(w http.ResponseWriter, r *http.Request) {
+			clientDownload(w, r)
+		})
+
+		router.Get(clientChecksumPath, func(w http.ResponseWriter, r *http.Request) {
+			clientGetChecksum(w, r)
+		})
+
+		router.Post(clientFilesPath, func(w http.ResponseWriter, r *http.Request) {
+			clientUpload(w, r)
+		})
+
+		router.Patch(clientFilesPath, func(w http.ResponseWriter, r *http.Request) {
+			clientRename(w, r)
+		})
+
+		router.Delete(clientFilesPath, func(w http.ResponseWriter, r *http.Request) {
+			clientDeleteFile(w, r)
+		})
+
+		router.Get(clientSharesPath, func(w http.ResponseWriter, r *http.Request) {
+			getClientShares(w, r)
+		})
+
+		router.Post(clientSharesPath, func(w http.ResponseWriter, r *http.Request) {
+			addClientShare(w, r)
+		})
+
+		router.Get(clientSharesPath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+			getClientShare(w, r)
+		})
+
+		router.Delete(clientSharesPath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+			deleteClientShare(w, r)
+		})
+	})
+
+	// the shares are public, they are authenticated using the share id and the optional password
+	router.With(checkShareAuth(dataprovider.ShareScopeRead)).Get(sharesPath+"/{shareID}", func(w http.ResponseWriter, r *http.Request) {
+		readShare(w, r)
+	})
+
+	router.With(checkShareAuth(dataprovider.ShareScopeWrite)).Post(sharesPath+"/{shareID}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		uploadToShare(w, r)
 	})
 
 	router.Group(func(router chi.Router) {
@@ -147,6 +403,19 @@ func handleCloseConnection(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func handleCloseUserConnections(w http.ResponseWriter, r *http.Request) {
+	username := r.URL.Query().Get("username")
+	if username == "" {
+		sendAPIResponse(w, r, nil, "username is mandatory", http.StatusBadRequest)
+		return
+	}
+	if closed := sftpd.CloseUserConnections(username); closed > 0 {
+		sendAPIResponse(w, r, nil, fmt.Sprintf("%v connections closed", closed), http.StatusOK)
+	} else {
+		sendAPIResponse(w, r, nil, "Not Found", http.StatusNotFound)
+	}
+}
+
 func fileServer(r chi.Router, path string, root http.FileSystem) {
 	fs := http.StripPrefix(path, http.FileServer(root))
 
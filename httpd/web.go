@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
@@ -25,8 +26,13 @@ const (
 	templateUser           = "user.html"
 	templateConnections    = "connections.html"
 	templateMessage        = "message.html"
+	templateAdmin2FA       = "admin2fa.html"
+	templateLogin          = "login.html"
 	pageUsersTitle         = "Users"
 	pageConnectionsTitle   = "Connections"
+	pageAdmin2FATitle      = "Two-factor auth"
+	pageLoginTitle         = "Login"
+	pageLogoutTitle        = "Logout"
 	page400Title           = "Bad request"
 	page404Title           = "Not found"
 	page404Body            = "The page you are looking for does not exist."
@@ -51,6 +57,10 @@ type basePage struct {
 	ConnectionsURL    string
 	UsersTitle        string
 	ConnectionsTitle  string
+	Admin2FAURL       string
+	Admin2FATitle     string
+	LogoutURL         string
+	LogoutTitle       string
 	Version           string
 }
 
@@ -75,12 +85,31 @@ type userPage struct {
 	RootDirPerms         []string
 }
 
+type admin2FAPage struct {
+	basePage
+	Error               string
+	Success             string
+	Enabled             bool
+	UnusedRecoveryCodes int
+	Secret              string
+	QRCode              string
+	RecoveryCodes       []string
+}
+
 type messagePage struct {
 	basePage
 	Error   string
 	Success string
 }
 
+type loginPage struct {
+	Title      string
+	CurrentURL string
+	Version    string
+	Username   string
+	Error      string
+}
+
 func loadTemplates(templatesPath string) {
 	usersPaths := []string{
 		filepath.Join(templatesPath, templateBase),
@@ -98,15 +127,23 @@ func loadTemplates(templatesPath string) {
 		filepath.Join(templatesPath, templateBase),
 		filepath.Join(templatesPath, templateMessage),
 	}
+	admin2FAPaths := []string{
+		filepath.Join(templatesPath, templateBase),
+		filepath.Join(templatesPath, templateAdmin2FA),
+	}
 	usersTmpl := utils.LoadTemplate(template.ParseFiles(usersPaths...))
 	userTmpl := utils.LoadTemplate(template.ParseFiles(userPaths...))
 	connectionsTmpl := utils.LoadTemplate(template.ParseFiles(connectionsPaths...))
 	messageTmpl := utils.LoadTemplate(template.ParseFiles(messagePath...))
+	admin2FATmpl := utils.LoadTemplate(template.ParseFiles(admin2FAPaths...))
+	loginTmpl := utils.LoadTemplate(template.ParseFiles(filepath.Join(templatesPath, templateLogin)))
 
 	templates[templateUsers] = usersTmpl
 	templates[templateUser] = userTmpl
 	templates[templateConnections] = connectionsTmpl
 	templates[templateMessage] = messageTmpl
+	templates[templateAdmin2FA] = admin2FATmpl
+	templates[templateLogin] = loginTmpl
 }
 
 func getBasePageData(title, currentURL string) basePage {
@@ -122,6 +159,10 @@ func getBasePageData(title, currentURL string) basePage {
 		ConnectionsURL:    webConnectionsPath,
 		UsersTitle:        pageUsersTitle,
 		ConnectionsTitle:  pageConnectionsTitle,
+		Admin2FAURL:       webAdmin2FAPath,
+		Admin2FATitle:     pageAdmin2FATitle,
+		LogoutURL:         webLogoutPath,
+		LogoutTitle:       pageLogoutTitle,
 		Version:           version.GetVersionAsString(),
 	}
 }
@@ -195,10 +236,14 @@ func getVirtualFoldersFromPostFields(r *http.Request) []vfs.VirtualFolder {
 		if strings.Contains(cleaned, "::") {
 			mapping := strings.Split(cleaned, "::")
 			if len(mapping) > 1 {
-				virtualFolders = append(virtualFolders, vfs.VirtualFolder{
+				vfolder := vfs.VirtualFolder{
 					VirtualPath: strings.TrimSpace(mapping[0]),
 					MappedPath:  strings.TrimSpace(mapping[1]),
-				})
+				}
+				if len(mapping) > 2 {
+					vfolder.ExcludeFromQuota, _ = strconv.ParseBool(strings.TrimSpace(mapping[2]))
+				}
+				virtualFolders = append(virtualFolders, vfolder)
 			}
 		}
 	}
@@ -242,6 +287,27 @@ func getSliceFromDelimitedValues(values, delimiter string) []string {
 	return result
 }
 
+// getLoginMethodRulesFromPostField parses one rule per line as sources::allowed methods::denied methods,
+// the lists are comma separated and they can be empty
+func getLoginMethodRulesFromPostField(value string) []dataprovider.LoginMethodRule {
+	var result []dataprovider.LoginMethodRule
+	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
+		if !strings.Contains(cleaned, "::") {
+			continue
+		}
+		parts := strings.Split(cleaned, "::")
+		rule := dataprovider.LoginMethodRule{
+			Sources:             getSliceFromDelimitedValues(parts[0], ","),
+			AllowedLoginMethods: getSliceFromDelimitedValues(parts[1], ","),
+		}
+		if len(parts) > 2 {
+			rule.DeniedLoginMethods = getSliceFromDelimitedValues(parts[2], ",")
+		}
+		result = append(result, rule)
+	}
+	return result
+}
+
 func getFileExtensionsFromPostField(value string, extesionsType int) []dataprovider.ExtensionsFilter {
 	var result []dataprovider.ExtensionsFilter
 	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
@@ -276,11 +342,75 @@ func getFileExtensionsFromPostField(value string, extesionsType int) []dataprovi
 	return result
 }
 
+func getFilePatternsFromPostField(value string, patternsType int) []dataprovider.PatternsFilter {
+	var result []dataprovider.PatternsFilter
+	for _, cleaned := range getSliceFromDelimitedValues(value, "\n") {
+		if strings.Contains(cleaned, "::") {
+			dirPatterns := strings.Split(cleaned, "::")
+			if len(dirPatterns) > 1 {
+				dir := dirPatterns[0]
+				dir = strings.TrimSpace(dir)
+				patterns := []string{}
+				for _, p := range strings.Split(dirPatterns[1], ",") {
+					cleanedPattern := strings.TrimSpace(p)
+					if len(cleanedPattern) > 0 {
+						patterns = append(patterns, cleanedPattern)
+					}
+				}
+				if len(dir) > 0 {
+					filter := dataprovider.PatternsFilter{
+						Path: dir,
+					}
+					if patternsType == 1 {
+						filter.AllowedPatterns = patterns
+						filter.DeniedPatterns = []string{}
+					} else {
+						filter.DeniedPatterns = patterns
+						filter.AllowedPatterns = []string{}
+					}
+					result = append(result, filter)
+				}
+			}
+		}
+	}
+	return result
+}
+
+func getFilePatternsFromUserPostFields(r *http.Request) []dataprovider.PatternsFilter {
+	allowedPatterns := getFilePatternsFromPostField(r.Form.Get("allowed_patterns"), 1)
+	deniedPatterns := getFilePatternsFromPostField(r.Form.Get("denied_patterns"), 2)
+	patterns := []dataprovider.PatternsFilter{}
+	for _, allowed := range allowedPatterns {
+		for _, denied := range deniedPatterns {
+			if path.Clean(allowed.Path) == path.Clean(denied.Path) {
+				allowed.DeniedPatterns = append(allowed.DeniedPatterns, denied.DeniedPatterns...)
+			}
+		}
+		patterns = append(patterns, allowed)
+	}
+	for _, denied := range deniedPatterns {
+		found := false
+		for _, allowed := range allowedPatterns {
+			if path.Clean(denied.Path) == path.Clean(allowed.Path) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			patterns = append(patterns, denied)
+		}
+	}
+	return patterns
+}
+
 func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 	var filters dataprovider.UserFilters
 	filters.AllowedIP = getSliceFromDelimitedValues(r.Form.Get("allowed_ip"), ",")
 	filters.DeniedIP = getSliceFromDelimitedValues(r.Form.Get("denied_ip"), ",")
+	filters.AllowedCountries = getSliceFromDelimitedValues(r.Form.Get("allowed_countries"), ",")
+	filters.DeniedCountries = getSliceFromDelimitedValues(r.Form.Get("denied_countries"), ",")
 	filters.DeniedLoginMethods = r.Form["ssh_login_methods"]
+	filters.LoginMethodRules = getLoginMethodRulesFromPostField(r.Form.Get("login_method_rules"))
 	allowedExtensions := getFileExtensionsFromPostField(r.Form.Get("allowed_extensions"), 1)
 	deniedExtensions := getFileExtensionsFromPostField(r.Form.Get("denied_extensions"), 2)
 	extensions := []dataprovider.ExtensionsFilter{}
@@ -311,6 +441,9 @@ func getFiltersFromUserPostFields(r *http.Request) dataprovider.UserFilters {
 		extensions = append(extensions, deniedExtensions...)
 	}
 	filters.FileExtensions = extensions
+	filters.FilePatterns = getFilePatternsFromUserPostFields(r)
+	filters.TOTPSecret = r.Form.Get("totp_secret")
+	filters.RevokedPublicKeys = getSliceFromDelimitedValues(r.Form.Get("revoked_public_keys"), "\n")
 	return filters
 }
 
@@ -321,6 +454,7 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		provider = 0
 	}
 	fs.Provider = provider
+	fs.CryptConfig.Passphrase = r.Form.Get("crypt_passphrase")
 	if fs.Provider == 1 {
 		fs.S3Config.Bucket = r.Form.Get("s3_bucket")
 		fs.S3Config.Region = r.Form.Get("s3_region")
@@ -337,6 +471,7 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		if err != nil {
 			return fs, err
 		}
+		fs.S3Config.ResumableUploads = len(r.Form.Get("s3_resumable_uploads")) > 0
 	} else if fs.Provider == 2 {
 		fs.GCSConfig.Bucket = r.Form.Get("gcs_bucket")
 		fs.GCSConfig.StorageClass = r.Form.Get("gcs_storage_class")
@@ -364,6 +499,31 @@ func getFsConfigFromUserPostFields(r *http.Request) (dataprovider.Filesystem, er
 		}
 		fs.GCSConfig.Credentials = base64.StdEncoding.EncodeToString(fileBytes)
 		fs.GCSConfig.AutomaticCredentials = 0
+	} else if fs.Provider == 3 {
+		fs.AzBlobConfig.Container = r.Form.Get("az_container")
+		fs.AzBlobConfig.AccountName = r.Form.Get("az_account_name")
+		fs.AzBlobConfig.AccountKey = r.Form.Get("az_account_key")
+		fs.AzBlobConfig.SASURL = r.Form.Get("az_sas_url")
+		fs.AzBlobConfig.Endpoint = r.Form.Get("az_endpoint")
+		fs.AzBlobConfig.KeyPrefix = r.Form.Get("az_key_prefix")
+		fs.AzBlobConfig.AccessTier = r.Form.Get("az_access_tier")
+		fs.AzBlobConfig.UseEmulator = len(r.Form.Get("az_use_emulator")) > 0
+		fs.AzBlobConfig.UploadPartSize, err = strconv.ParseInt(r.Form.Get("az_upload_part_size"), 10, 64)
+		if err != nil {
+			return fs, err
+		}
+		fs.AzBlobConfig.UploadConcurrency, err = strconv.Atoi(r.Form.Get("az_upload_concurrency"))
+		if err != nil {
+			return fs, err
+		}
+	} else if fs.Provider == 4 {
+		fs.SFTPConfig.Endpoint = r.Form.Get("sftp_endpoint")
+		fs.SFTPConfig.Username = r.Form.Get("sftp_username")
+		fs.SFTPConfig.Password = r.Form.Get("sftp_password")
+		fs.SFTPConfig.PrivateKey = r.Form.Get("sftp_private_key")
+		fs.SFTPConfig.Fingerprints = getSliceFromDelimitedValues(r.Form.Get("sftp_fingerprints"), "\n")
+		fs.SFTPConfig.AcceptAnyHostKey = len(r.Form.Get("sftp_accept_any_host_key")) > 0
+		fs.SFTPConfig.Prefix = r.Form.Get("sftp_prefix")
 	}
 	return fs, nil
 }
@@ -404,6 +564,18 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 	if err != nil {
 		return user, err
 	}
+	dataTransferUL, err := strconv.ParseInt(r.Form.Get("upload_data_transfer"), 10, 64)
+	if err != nil {
+		return user, err
+	}
+	dataTransferDL, err := strconv.ParseInt(r.Form.Get("download_data_transfer"), 10, 64)
+	if err != nil {
+		return user, err
+	}
+	dataTransferReset, err := strconv.Atoi(r.Form.Get("data_transfer_reset"))
+	if err != nil {
+		return user, err
+	}
 	status, err := strconv.Atoi(r.Form.Get("status"))
 	if err != nil {
 		return user, err
@@ -417,28 +589,57 @@ func getUserFromPostFields(r *http.Request) (dataprovider.User, error) {
 		}
 		expirationDateMillis = utils.GetTimeAsMsSinceEpoch(expirationDate)
 	}
+	activationDateMillis := int64(0)
+	activationDateString := r.Form.Get("activation_date")
+	if len(strings.TrimSpace(activationDateString)) > 0 {
+		activationDate, err := time.Parse(webDateTimeFormat, activationDateString)
+		if err != nil {
+			return user, err
+		}
+		activationDateMillis = utils.GetTimeAsMsSinceEpoch(activationDate)
+	}
+	filters := getFiltersFromUserPostFields(r)
+	if passwordExpiration := strings.TrimSpace(r.Form.Get("password_expiration")); len(passwordExpiration) > 0 {
+		filters.PasswordExpiration, err = strconv.Atoi(passwordExpiration)
+		if err != nil {
+			return user, err
+		}
+	}
+	if maxUploadFileSize := strings.TrimSpace(r.Form.Get("max_upload_file_size")); len(maxUploadFileSize) > 0 {
+		filters.MaxUploadFileSize, err = strconv.ParseInt(maxUploadFileSize, 10, 64)
+		if err != nil {
+			return user, err
+		}
+	}
+	filters.UploadMode = r.Form.Get("upload_mode")
+	filters.SetstatMode = r.Form.Get("setstat_mode")
 	fsConfig, err := getFsConfigFromUserPostFields(r)
 	if err != nil {
 		return user, err
 	}
 	user = dataprovider.User{
-		Username:          r.Form.Get("username"),
-		Password:          r.Form.Get("password"),
-		PublicKeys:        publicKeys,
-		HomeDir:           r.Form.Get("home_dir"),
-		VirtualFolders:    getVirtualFoldersFromPostFields(r),
-		UID:               uid,
-		GID:               gid,
-		Permissions:       getUserPermissionsFromPostFields(r),
-		MaxSessions:       maxSessions,
-		QuotaSize:         quotaSize,
-		QuotaFiles:        quotaFiles,
-		UploadBandwidth:   bandwidthUL,
-		DownloadBandwidth: bandwidthDL,
-		Status:            status,
-		ExpirationDate:    expirationDateMillis,
-		Filters:           getFiltersFromUserPostFields(r),
-		FsConfig:          fsConfig,
+		Username:             r.Form.Get("username"),
+		Password:             r.Form.Get("password"),
+		PublicKeys:           publicKeys,
+		HomeDir:              r.Form.Get("home_dir"),
+		VirtualFolders:       getVirtualFoldersFromPostFields(r),
+		UID:                  uid,
+		GID:                  gid,
+		Permissions:          getUserPermissionsFromPostFields(r),
+		MaxSessions:          maxSessions,
+		QuotaSize:            quotaSize,
+		QuotaFiles:           quotaFiles,
+		UploadBandwidth:      bandwidthUL,
+		DownloadBandwidth:    bandwidthDL,
+		UploadDataTransfer:   dataTransferUL,
+		DownloadDataTransfer: dataTransferDL,
+		DataTransferReset:    dataTransferReset,
+		Status:               status,
+		ExpirationDate:       expirationDateMillis,
+		ActivationDate:       activationDateMillis,
+		Filters:              filters,
+		FsConfig:             fsConfig,
+		Groups:               getSliceFromDelimitedValues(r.Form.Get("groups"), ","),
 	}
 	return user, err
 }
@@ -549,3 +750,164 @@ func handleWebGetConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	renderTemplate(w, templateConnections, data)
 }
+
+func renderAdmin2FAPage(w http.ResponseWriter, data admin2FAPage) {
+	data.basePage = getBasePageData(pageAdmin2FATitle, webAdmin2FAPath)
+	renderTemplate(w, templateAdmin2FA, data)
+}
+
+func handleWebAdmin2FAGet(w http.ResponseWriter, r *http.Request) {
+	admin, err := dataprovider.AdminExists(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			renderNotFoundPage(w, err)
+		} else {
+			renderInternalServerErrorPage(w, err)
+		}
+		return
+	}
+	renderAdmin2FAPage(w, admin2FAPage{
+		Enabled:             admin.HasTOTPSecret(),
+		UnusedRecoveryCodes: admin.GetUnusedRecoveryCodes(),
+	})
+}
+
+func handleWebAdmin2FAPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	err := r.ParseForm()
+	if err != nil {
+		renderBadRequestPage(w, err)
+		return
+	}
+	admin, err := dataprovider.AdminExists(dataProvider, getAdminFromRequest(r).Username)
+	if err != nil {
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			renderNotFoundPage(w, err)
+		} else {
+			renderInternalServerErrorPage(w, err)
+		}
+		return
+	}
+	var data admin2FAPage
+	switch r.Form.Get("action") {
+	case "generate":
+		secret, err := generateTOTPSecret(admin)
+		if err != nil {
+			renderInternalServerErrorPage(w, err)
+			return
+		}
+		data.Secret = secret.Secret
+		data.QRCode = secret.QRCode
+	case "enable":
+		secret := r.Form.Get("secret")
+		data.RecoveryCodes, err = dataprovider.EnableAdminTOTP(dataProvider, admin.Username, secret, r.Form.Get("code"))
+		if err != nil {
+			data.Error = err.Error()
+			// show the same secret again so the admin can retry without reconfiguring the authenticator
+			if resp, err := getTOTPSecretResponse(admin, secret); err == nil {
+				data.Secret = resp.Secret
+				data.QRCode = resp.QRCode
+			}
+		} else {
+			data.Enabled = true
+			data.UnusedRecoveryCodes = len(data.RecoveryCodes)
+			data.Success = "Two-factor authentication enabled"
+		}
+	case "regenerate":
+		data.Enabled = admin.HasTOTPSecret()
+		data.RecoveryCodes, err = dataprovider.RegenerateAdminRecoveryCodes(dataProvider, admin.Username)
+		if err != nil {
+			data.Error = err.Error()
+			data.UnusedRecoveryCodes = admin.GetUnusedRecoveryCodes()
+		} else {
+			data.UnusedRecoveryCodes = len(data.RecoveryCodes)
+		}
+	case "disable":
+		err = dataprovider.DisableAdminTOTP(dataProvider, admin.Username)
+		if err != nil {
+			data.Error = err.Error()
+			data.Enabled = admin.HasTOTPSecret()
+			data.UnusedRecoveryCodes = admin.GetUnusedRecoveryCodes()
+		} else {
+			data.Success = "Two-factor authentication disabled"
+		}
+	default:
+		renderBadRequestPage(w, errors.New("invalid action"))
+		return
+	}
+	renderAdmin2FAPage(w, data)
+}
+
+func renderLoginPage(w http.ResponseWriter, username, error string, statusCode int) {
+	version := utils.GetAppVersion()
+	data := loginPage{
+		Title:      pageLoginTitle,
+		CurrentURL: webLoginPath,
+		Version:    version.GetVersionAsString(),
+		Username:   username,
+		Error:      error,
+	}
+	w.WriteHeader(statusCode)
+	renderTemplate(w, templateLogin, data)
+}
+
+func handleWebLoginGet(w http.ResponseWriter, r *http.Request) {
+	hasAdmins, err := dataprovider.HasAdmins(dataProvider)
+	if err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	if !isAuthEnabled(hasAdmins) {
+		http.Redirect(w, r, webUsersPath, http.StatusFound)
+		return
+	}
+	renderLoginPage(w, "", "", http.StatusOK)
+}
+
+// handleWebLoginPost checks the admin credentials and the TOTP code, or a recovery code, once and
+// then issues a web session, the following requests are authenticated using the session cookie
+func handleWebLoginPost(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+	err := r.ParseForm()
+	if err != nil {
+		renderBadRequestPage(w, err)
+		return
+	}
+	hasAdmins, err := dataprovider.HasAdmins(dataProvider)
+	if err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	if !isAuthEnabled(hasAdmins) {
+		http.Redirect(w, r, webUsersPath, http.StatusFound)
+		return
+	}
+	username := r.Form.Get("username")
+	password := r.Form.Get("password")
+	var admin dataprovider.Admin
+	if hasAdmins {
+		admin, err = dataprovider.CheckAdminAndPassAndCode(dataProvider, username, password, r.Form.Get("code"))
+		if err != nil {
+			logger.Debug(logSender, "", "unable to authenticate admin %#v from the web login: %v", username, err)
+			renderLoginPage(w, username, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		admin.HideConfidentialData()
+	} else {
+		if !validateLegacyCredentials(username, password) {
+			renderLoginPage(w, username, "Invalid credentials", http.StatusUnauthorized)
+			return
+		}
+		admin = getLegacyAdmin(username)
+	}
+	if err = setWebSession(w, r, admin); err != nil {
+		renderInternalServerErrorPage(w, err)
+		return
+	}
+	http.Redirect(w, r, webUsersPath, http.StatusFound)
+}
+
+func handleWebLogout(w http.ResponseWriter, r *http.Request) {
+	removeWebSession(w, r)
+	http.Redirect(w, r, webLoginPath, http.StatusFound)
+}
@@ -0,0 +1,81 @@
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+)
+
+const requestTimeout = 30 * time.Second
+
+// awsWrapper encrypts the data keys using a symmetric AWS KMS key
+type awsWrapper struct {
+	keyID string
+	svc   *awskms.KMS
+}
+
+func newAWSWrapper(config AWSConfig) (keyWrapper, error) {
+	if len(config.KeyID) == 0 {
+		return nil, fmt.Errorf("the key ID is required for the KMS provider %#v", ProviderAWS)
+	}
+	awsConfig := aws.NewConfig()
+	if len(config.Region) > 0 {
+		awsConfig.WithRegion(config.Region)
+	}
+	if len(config.AccessKey) > 0 || len(config.AccessSecret) > 0 {
+		awsConfig.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.AccessSecret, "")
+	}
+	if len(config.Endpoint) > 0 {
+		awsConfig.Endpoint = aws.String(config.Endpoint)
+	}
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &awsWrapper{
+		keyID: config.KeyID,
+		svc:   awskms.New(sess),
+	}, nil
+}
+
+func (w *awsWrapper) scheme() string {
+	return ProviderAWS
+}
+
+func (w *awsWrapper) wrap(dataKey []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	out, err := w.svc.EncryptWithContext(ctx, &awskms.EncryptInput{
+		KeyId:     aws.String(w.keyID),
+		Plaintext: dataKey,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(out.CiphertextBlob), nil
+}
+
+func (w *awsWrapper) unwrap(wrappedKey string) ([]byte, error) {
+	blob, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	out, err := w.svc.DecryptWithContext(ctx, &awskms.DecryptInput{
+		CiphertextBlob: blob,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,68 @@
+package kms
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path/filepath"
+
+	cloudkms "google.golang.org/api/cloudkms/v1"
+	"google.golang.org/api/option"
+)
+
+// gcpWrapper encrypts the data keys using a Google Cloud KMS symmetric key
+type gcpWrapper struct {
+	keyName string
+	svc     *cloudkms.Service
+}
+
+func newGCPWrapper(config GCPConfig, configDir string) (keyWrapper, error) {
+	if len(config.KeyName) == 0 {
+		return nil, fmt.Errorf("the key name is required for the KMS provider %#v", ProviderGCP)
+	}
+	var opts []option.ClientOption
+	if len(config.CredentialsFile) > 0 {
+		credentialsFile := config.CredentialsFile
+		if !filepath.IsAbs(credentialsFile) {
+			credentialsFile = filepath.Join(configDir, credentialsFile)
+		}
+		opts = append(opts, option.WithCredentialsFile(credentialsFile))
+	}
+	svc, err := cloudkms.NewService(context.Background(), opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &gcpWrapper{
+		keyName: config.KeyName,
+		svc:     svc,
+	}, nil
+}
+
+func (w *gcpWrapper) scheme() string {
+	return ProviderGCP
+}
+
+func (w *gcpWrapper) wrap(dataKey []byte) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := w.svc.Projects.Locations.KeyRings.CryptoKeys.Encrypt(w.keyName, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return "", err
+	}
+	// the ciphertext is already base64 encoded
+	return resp.Ciphertext, nil
+}
+
+func (w *gcpWrapper) unwrap(wrappedKey string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := w.svc.Projects.Locations.KeyRings.CryptoKeys.Decrypt(w.keyName, &cloudkms.DecryptRequest{
+		Ciphertext: wrappedKey,
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
@@ -0,0 +1,258 @@
+// Package kms encrypts the secrets, such as the cloud storage credentials and the encryption
+// passphrases, before storing them inside the data provider.
+// Each secret is encrypted using AES-GCM and a random data key, the data key is then encrypted
+// using the configured provider: a local master key, AWS KMS, Google Cloud KMS,
+// HashiCorp Vault or a KMS plugin. If no provider is configured the data key is stored
+// in plain text together with the secret, as in the previous SFTPGo versions
+package kms
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender = "kms"
+	// scheme for the secrets encrypted without a provider, see utils.EncryptData
+	legacyScheme = "aes"
+	dataKeySize  = 32
+)
+
+// Supported KMS providers
+const (
+	ProviderLocal  = "local"
+	ProviderAWS    = "aws"
+	ProviderGCP    = "gcp"
+	ProviderVault  = "vault"
+	ProviderPlugin = "plugin"
+)
+
+var (
+	mutex        sync.RWMutex
+	wrapper      keyWrapper
+	validSchemes = []string{legacyScheme, ProviderLocal, ProviderAWS, ProviderGCP, ProviderVault, ProviderPlugin}
+)
+
+// LocalConfig defines the configuration for the local master key provider
+type LocalConfig struct {
+	// Path to the file containing the master key, at least 32 bytes long.
+	// This can be an absolute path or a path relative to the config dir
+	MasterKeyPath string `json:"master_key_path" mapstructure:"master_key_path"`
+}
+
+// AWSConfig defines the configuration for the AWS KMS provider
+type AWSConfig struct {
+	Region string `json:"region" mapstructure:"region"`
+	// Key ID, key ARN, alias name or alias ARN for the symmetric master key
+	KeyID string `json:"key_id" mapstructure:"key_id"`
+	// Leave empty to use the default credentials chain, for example an IAM role
+	AccessKey    string `json:"access_key" mapstructure:"access_key"`
+	AccessSecret string `json:"access_secret" mapstructure:"access_secret"`
+	// Optional endpoint, for example to use a VPC endpoint
+	Endpoint string `json:"endpoint" mapstructure:"endpoint"`
+}
+
+// GCPConfig defines the configuration for the Google Cloud KMS provider
+type GCPConfig struct {
+	// Key resource name: projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>
+	KeyName string `json:"key_name" mapstructure:"key_name"`
+	// Path to the service account JSON credentials, empty means the application default credentials.
+	// This can be an absolute path or a path relative to the config dir
+	CredentialsFile string `json:"credentials_file" mapstructure:"credentials_file"`
+}
+
+// VaultConfig defines the configuration for the HashiCorp Vault transit secrets engine provider
+type VaultConfig struct {
+	// Vault address, for example https://127.0.0.1:8200
+	URL   string `json:"url" mapstructure:"url"`
+	Token string `json:"token" mapstructure:"token"`
+	// Mount path for the transit secrets engine, empty means "transit"
+	MountPath string `json:"mount_path" mapstructure:"mount_path"`
+	// Name of the transit encryption key
+	KeyName string `json:"key_name" mapstructure:"key_name"`
+}
+
+// Config defines the KMS configuration
+type Config struct {
+	// KMS provider: "local", "aws", "gcp", "vault" or "plugin". Leave empty to store
+	// the data keys together with the secrets
+	Provider string      `json:"provider" mapstructure:"provider"`
+	Local    LocalConfig `json:"local" mapstructure:"local"`
+	AWS      AWSConfig   `json:"aws" mapstructure:"aws"`
+	GCP      GCPConfig   `json:"gcp" mapstructure:"gcp"`
+	Vault    VaultConfig `json:"vault" mapstructure:"vault"`
+}
+
+// keyWrapper encrypts and decrypts the data keys using a KMS provider
+type keyWrapper interface {
+	// scheme returns the identifier stored together with the encrypted secrets
+	scheme() string
+	// wrap returns the encrypted data key, it must not contain "$"
+	wrap(dataKey []byte) (string, error)
+	unwrap(wrappedKey string) ([]byte, error)
+}
+
+// Initialize configures the KMS provider. The previous configuration, if any, is replaced
+func Initialize(config Config, configDir string) error {
+	var w keyWrapper
+	var err error
+	switch config.Provider {
+	case "":
+	case ProviderLocal:
+		w, err = newLocalWrapper(config.Local, configDir)
+	case ProviderAWS:
+		w, err = newAWSWrapper(config.AWS)
+	case ProviderGCP:
+		w, err = newGCPWrapper(config.GCP, configDir)
+	case ProviderVault:
+		w, err = newVaultWrapper(config.Vault)
+	case ProviderPlugin:
+		w, err = newPluginWrapper()
+	default:
+		err = fmt.Errorf("unsupported KMS provider %#v", config.Provider)
+	}
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	wrapper = w
+	if w != nil {
+		logger.Debug(logSender, "", "KMS initialized, provider: %#v", config.Provider)
+	}
+	return nil
+}
+
+func getWrapper() keyWrapper {
+	mutex.RLock()
+	defer mutex.RUnlock()
+
+	return wrapper
+}
+
+// IsEnabled returns true if a KMS provider is configured
+func IsEnabled() bool {
+	return getWrapper() != nil
+}
+
+// Encrypt encrypts the given secret using the configured KMS provider
+func Encrypt(data string) (string, error) {
+	w := getWrapper()
+	if w == nil {
+		return utils.EncryptData(data)
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	ciphertext, err := sealData(dataKey, []byte(data))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := w.wrap(dataKey)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to encrypt the data key, provider %#v: %v", w.scheme(), err)
+		return "", err
+	}
+	return fmt.Sprintf("$%v$%v$%x", w.scheme(), wrappedKey, ciphertext), nil
+}
+
+// Decrypt decrypts a secret encrypted using Encrypt. The secrets encrypted without a
+// provider can always be decrypted, the other ones require the same provider used to encrypt them
+func Decrypt(data string) (string, error) {
+	vals := strings.Split(data, "$")
+	if len(vals) != 4 || len(vals[0]) > 0 {
+		return "", errors.New("data to decrypt is not in the correct format")
+	}
+	if vals[1] == legacyScheme {
+		return utils.DecryptData(data)
+	}
+	w := getWrapper()
+	if w == nil || w.scheme() != vals[1] {
+		return "", fmt.Errorf("unable to decrypt data encrypted using the KMS provider %#v, it is not configured", vals[1])
+	}
+	ciphertext, err := hex.DecodeString(vals[3])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := w.unwrap(vals[2])
+	if err != nil {
+		logger.Warn(logSender, "", "unable to decrypt the data key, provider %#v: %v", w.scheme(), err)
+		return "", err
+	}
+	plaintext, err := openData(dataKey, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// IsEncrypted returns true if the given data is an encrypted secret including the data key
+func IsEncrypted(data string) bool {
+	vals := strings.Split(data, "$")
+	return len(vals) == 4 && len(vals[0]) == 0 && utils.IsStringInSlice(vals[1], validSchemes)
+}
+
+// IsEncryptedWithoutKey returns true if the given data is an encrypted secret
+// without the data key, as returned by utils.RemoveDecryptionKey
+func IsEncryptedWithoutKey(data string) bool {
+	vals := strings.Split(data, "$")
+	return len(vals) == 3 && len(vals[0]) == 0 && utils.IsStringInSlice(vals[1], validSchemes)
+}
+
+// NeedsReencryption returns true if the given encrypted secret was not encrypted
+// using the configured KMS provider
+func NeedsReencryption(data string) bool {
+	scheme := legacyScheme
+	if w := getWrapper(); w != nil {
+		scheme = w.scheme()
+	}
+	vals := strings.Split(data, "$")
+	return len(vals) == 4 && vals[1] != scheme
+}
+
+// sealData encrypts data using AES-GCM, the nonce is prepended to the ciphertext
+func sealData(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, data, nil), nil
+}
+
+// openData decrypts data encrypted using sealData
+func openData(key, data []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := gcm.NonceSize()
+	if len(data) < nonceSize {
+		return nil, errors.New("encrypted data is too short")
+	}
+	return gcm.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
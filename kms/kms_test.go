@@ -0,0 +1,213 @@
+package kms
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+func TestLegacyMode(t *testing.T) {
+	if err := Initialize(Config{}, os.TempDir()); err != nil {
+		t.Fatalf("unable to initialize KMS: %v", err)
+	}
+	if IsEnabled() {
+		t.Error("no KMS provider must be enabled")
+	}
+	encrypted, err := Encrypt("secret")
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "$aes$") || !IsEncrypted(encrypted) || NeedsReencryption(encrypted) {
+		t.Errorf("unexpected encrypted secret: %#v", encrypted)
+	}
+	if !IsEncryptedWithoutKey(utils.RemoveDecryptionKey(encrypted)) || IsEncryptedWithoutKey(encrypted) {
+		t.Errorf("unexpected encrypted secret without key: %#v", utils.RemoveDecryptionKey(encrypted))
+	}
+	decrypted, err := Decrypt(encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", decrypted, err)
+	}
+	for _, data := range []string{"secret", "$unknown$a$b", "$local$a$b", "$aes$a$b$c"} {
+		if _, err = Decrypt(data); err == nil {
+			t.Errorf("decrypting %#v must fail", data)
+		}
+		if data != "$local$a$b" && IsEncrypted(data) {
+			t.Errorf("%#v must not be recognized as encrypted", data)
+		}
+	}
+}
+
+func TestLocalProvider(t *testing.T) {
+	keyPath := filepath.Join(os.TempDir(), "kms_master_key")
+	defer os.Remove(keyPath)
+	err := Initialize(Config{Provider: ProviderLocal}, os.TempDir())
+	if err == nil {
+		t.Error("the master key path must be required")
+	}
+	err = Initialize(Config{Provider: ProviderLocal, Local: LocalConfig{MasterKeyPath: "kms_master_key"}}, os.TempDir())
+	if err == nil {
+		t.Error("a missing master key must fail")
+	}
+	ioutil.WriteFile(keyPath, []byte("short key\n"), 0600)
+	err = Initialize(Config{Provider: ProviderLocal, Local: LocalConfig{MasterKeyPath: keyPath}}, os.TempDir())
+	if err == nil {
+		t.Error("a short master key must fail")
+	}
+
+	legacy, err := Encrypt("legacy secret")
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	ioutil.WriteFile(keyPath, []byte(strings.Repeat("k", 32)+"\n"), 0600)
+	err = Initialize(Config{Provider: ProviderLocal, Local: LocalConfig{MasterKeyPath: "kms_master_key"}}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the local KMS provider: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+
+	encrypted, err := Encrypt("secret")
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "$local$") || !IsEncrypted(encrypted) || NeedsReencryption(encrypted) {
+		t.Errorf("unexpected encrypted secret: %#v", encrypted)
+	}
+	if !IsEncryptedWithoutKey(utils.RemoveDecryptionKey(encrypted)) {
+		t.Errorf("unexpected encrypted secret without key: %#v", utils.RemoveDecryptionKey(encrypted))
+	}
+	decrypted, err := Decrypt(encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", decrypted, err)
+	}
+	// the legacy secrets can still be decrypted and they must be encrypted again
+	if !NeedsReencryption(legacy) {
+		t.Error("a legacy secret must be encrypted again")
+	}
+	decrypted, err = Decrypt(legacy)
+	if err != nil || decrypted != "legacy secret" {
+		t.Errorf("unexpected decrypted legacy secret %#v, err: %v", decrypted, err)
+	}
+	// a different master key cannot decrypt
+	ioutil.WriteFile(keyPath, []byte(strings.Repeat("j", 32)), 0600)
+	err = Initialize(Config{Provider: ProviderLocal, Local: LocalConfig{MasterKeyPath: keyPath}}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the local KMS provider: %v", err)
+	}
+	if _, err = Decrypt(encrypted); err == nil {
+		t.Error("decrypt with a different master key must fail")
+	}
+	err = Initialize(Config{}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize KMS: %v", err)
+	}
+	if _, err = Decrypt(encrypted); err == nil {
+		t.Error("decrypt without the KMS provider must fail")
+	}
+}
+
+func TestVaultProvider(t *testing.T) {
+	// a fake transit secrets engine, the ciphertext is the reversed base64 plaintext
+	reverse := func(s string) string {
+		r := []rune(s)
+		for i, j := 0, len(r)-1; i < j; i, j = i+1, j-1 {
+			r[i], r[j] = r[j], r[i]
+		}
+		return string(r)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["permission denied"]}`))
+			return
+		}
+		var req vaultRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		var resp vaultResponse
+		switch r.URL.Path {
+		case "/v1/custom/encrypt/key":
+			resp.Data.Ciphertext = "vault:v1:" + reverse(req.Plaintext)
+		case "/v1/custom/decrypt/key":
+			resp.Data.Plaintext = reverse(strings.TrimPrefix(req.Ciphertext, "vault:v1:"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+			return
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	invalidConfigs := []VaultConfig{
+		{URL: server.URL, Token: "token"},
+		{URL: server.URL, KeyName: "key"},
+		{URL: "ftp://127.0.0.1", Token: "token", KeyName: "key"},
+	}
+	for _, config := range invalidConfigs {
+		if err := Initialize(Config{Provider: ProviderVault, Vault: config}, os.TempDir()); err == nil {
+			t.Errorf("vault config must be invalid: %+v", config)
+		}
+	}
+	err := Initialize(Config{Provider: ProviderVault, Vault: VaultConfig{URL: server.URL + "/", Token: "token",
+		MountPath: "/custom/", KeyName: "key"}}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the Vault KMS provider: %v", err)
+	}
+	defer Initialize(Config{}, os.TempDir())
+
+	encrypted, err := Encrypt("secret")
+	if err != nil {
+		t.Fatalf("unable to encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, "$vault$vault:v1:") || !IsEncrypted(encrypted) {
+		t.Errorf("unexpected encrypted secret: %#v", encrypted)
+	}
+	decrypted, err := Decrypt(encrypted)
+	if err != nil || decrypted != "secret" {
+		t.Errorf("unexpected decrypted secret %#v, err: %v", decrypted, err)
+	}
+
+	err = Initialize(Config{Provider: ProviderVault, Vault: VaultConfig{URL: server.URL, Token: "wrong",
+		MountPath: "custom", KeyName: "key"}}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the Vault KMS provider: %v", err)
+	}
+	if _, err = Decrypt(encrypted); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("decrypt with an invalid token must fail, err: %v", err)
+	}
+	if _, err = Encrypt("secret"); err == nil {
+		t.Error("encrypt with an invalid token must fail")
+	}
+}
+
+func TestInvalidProviders(t *testing.T) {
+	invalidConfigs := []Config{
+		{Provider: "unknown"},
+		{Provider: ProviderAWS},
+		{Provider: ProviderGCP},
+		{Provider: ProviderPlugin},
+	}
+	for _, config := range invalidConfigs {
+		if err := Initialize(config, os.TempDir()); err == nil {
+			t.Errorf("KMS config must be invalid: %+v", config)
+		}
+	}
+	if IsEnabled() {
+		t.Error("no KMS provider must be enabled")
+	}
+	err := Initialize(Config{Provider: ProviderAWS, AWS: AWSConfig{Region: "us-east-1", KeyID: "alias/sftpgo"}},
+		os.TempDir())
+	if err != nil {
+		t.Errorf("unable to initialize the AWS KMS provider: %v", err)
+	}
+	if !IsEnabled() {
+		t.Error("the AWS KMS provider must be enabled")
+	}
+	Initialize(Config{}, os.TempDir())
+}
@@ -0,0 +1,59 @@
+package kms
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const minMasterKeySize = 32
+
+// localWrapper encrypts the data keys using a master key read from a local file
+type localWrapper struct {
+	key []byte
+}
+
+func newLocalWrapper(config LocalConfig, configDir string) (keyWrapper, error) {
+	if len(config.MasterKeyPath) == 0 {
+		return nil, fmt.Errorf("the master key path is required for the KMS provider %#v", ProviderLocal)
+	}
+	keyPath := config.MasterKeyPath
+	if !filepath.IsAbs(keyPath) {
+		keyPath = filepath.Join(configDir, keyPath)
+	}
+	masterKey, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the master key: %v", err)
+	}
+	masterKey = bytes.TrimSpace(masterKey)
+	if len(masterKey) < minMasterKeySize {
+		return nil, fmt.Errorf("the master key must be at least %v bytes long", minMasterKeySize)
+	}
+	key := sha256.Sum256(masterKey)
+	return &localWrapper{
+		key: key[:],
+	}, nil
+}
+
+func (w *localWrapper) scheme() string {
+	return ProviderLocal
+}
+
+func (w *localWrapper) wrap(dataKey []byte) (string, error) {
+	wrapped, err := sealData(w.key, dataKey)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+func (w *localWrapper) unwrap(wrappedKey string) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	return openData(w.key, wrapped)
+}
@@ -0,0 +1,43 @@
+package kms
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"github.com/drakkan/sftpgo/plugin"
+)
+
+// pluginWrapper encrypts the data keys using the configured KMS plugin
+type pluginWrapper struct{}
+
+func newPluginWrapper() (keyWrapper, error) {
+	if !plugin.Handler.HasKMS() {
+		return nil, fmt.Errorf("the KMS provider %#v requires a KMS plugin", ProviderPlugin)
+	}
+	return &pluginWrapper{}, nil
+}
+
+func (w *pluginWrapper) scheme() string {
+	return ProviderPlugin
+}
+
+func (w *pluginWrapper) wrap(dataKey []byte) (string, error) {
+	wrapped, err := plugin.Handler.KMSEncrypt(base64.StdEncoding.EncodeToString(dataKey), "")
+	if err != nil {
+		return "", err
+	}
+	// the plugin output can contain any character
+	return base64.StdEncoding.EncodeToString([]byte(wrapped)), nil
+}
+
+func (w *pluginWrapper) unwrap(wrappedKey string) ([]byte, error) {
+	wrapped, err := base64.StdEncoding.DecodeString(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := plugin.Handler.KMSDecrypt(string(wrapped), "")
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(dataKey)
+}
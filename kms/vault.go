@@ -0,0 +1,116 @@
+package kms
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultVaultMountPath = "transit"
+
+// vaultWrapper encrypts the data keys using the HashiCorp Vault transit secrets engine
+type vaultWrapper struct {
+	baseURL    string
+	token      string
+	mountPath  string
+	keyName    string
+	httpClient *http.Client
+}
+
+type vaultRequest struct {
+	Plaintext  string `json:"plaintext,omitempty"`
+	Ciphertext string `json:"ciphertext,omitempty"`
+}
+
+type vaultResponse struct {
+	Data   vaultRequest `json:"data"`
+	Errors []string     `json:"errors"`
+}
+
+func newVaultWrapper(config VaultConfig) (keyWrapper, error) {
+	if len(config.KeyName) == 0 || len(config.Token) == 0 {
+		return nil, fmt.Errorf("the key name and the token are required for the KMS provider %#v", ProviderVault)
+	}
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, fmt.Errorf("invalid Vault URL %#v", config.URL)
+	}
+	mountPath := strings.Trim(config.MountPath, "/")
+	if len(mountPath) == 0 {
+		mountPath = defaultVaultMountPath
+	}
+	return &vaultWrapper{
+		baseURL:   strings.TrimSuffix(config.URL, "/"),
+		token:     config.Token,
+		mountPath: mountPath,
+		keyName:   config.KeyName,
+		httpClient: &http.Client{
+			Timeout: requestTimeout,
+		},
+	}, nil
+}
+
+func (w *vaultWrapper) scheme() string {
+	return ProviderVault
+}
+
+func (w *vaultWrapper) wrap(dataKey []byte) (string, error) {
+	resp, err := w.sendRequest("encrypt", vaultRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	})
+	if err != nil {
+		return "", err
+	}
+	// the ciphertext has the format vault:v<key version>:<base64 data>
+	return resp.Data.Ciphertext, nil
+}
+
+func (w *vaultWrapper) unwrap(wrappedKey string) ([]byte, error) {
+	resp, err := w.sendRequest("decrypt", vaultRequest{
+		Ciphertext: wrappedKey,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+}
+
+func (w *vaultWrapper) sendRequest(operation string, request vaultRequest) (vaultResponse, error) {
+	var result vaultResponse
+	body, err := json.Marshal(request)
+	if err != nil {
+		return result, err
+	}
+	endpoint := fmt.Sprintf("%v/v1/%v/%v/%v", w.baseURL, w.mountPath, operation, url.PathEscape(w.keyName))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(body))
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("X-Vault-Token", w.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return result, err
+	}
+	if err = json.Unmarshal(respBody, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return result, fmt.Errorf("invalid Vault response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return result, fmt.Errorf("Vault %v error, status code: %v, errors: %v", operation, resp.StatusCode,
+			strings.Join(result.Errors, ", "))
+	}
+	return result, nil
+}
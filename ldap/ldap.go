@@ -0,0 +1,397 @@
+// Package ldap implements the authentication against an LDAP server, for example Active Directory.
+// The credentials are verified using a simple bind and the LDAP attributes and groups are mapped
+// to the SFTPGo user settings
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	goldap "github.com/go-ldap/ldap/v3"
+
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	usernamePlaceholder   = "{{username}}"
+	defaultGroupAttribute = "memberOf"
+	defaultTimeout        = 10
+)
+
+var (
+	// ErrInvalidCredentials is returned if the LDAP server rejects the credentials or the user is not found
+	ErrInvalidCredentials = errors.New("Invalid credentials")
+	attributeRegex        = regexp.MustCompile(`\{\{([a-zA-Z][a-zA-Z0-9-]*)\}\}`)
+)
+
+// GroupMapping defines the settings for the members of an LDAP group
+type GroupMapping struct {
+	// LDAP group, it can be the group DN or its common name. The comparison is case insensitive
+	LDAPGroup string `json:"ldap_group" mapstructure:"ldap_group"`
+	// Permissions granted to the group members, they are merged with the ones granted by the other groups
+	Permissions map[string][]string `json:"permissions" mapstructure:"permissions"`
+	// SFTPGo groups to add the members to
+	Groups []string `json:"groups" mapstructure:"groups"`
+}
+
+// Config defines the LDAP authentication configuration
+type Config struct {
+	// LDAP server URL, for example ldap://ad.example.com or ldaps://ad.example.com:636.
+	// Leave empty to disable the LDAP authentication
+	URL string `json:"url" mapstructure:"url"`
+	// Set to true to upgrade the ldap:// connections to TLS using the StartTLS operation
+	StartTLS bool `json:"start_tls" mapstructure:"start_tls"`
+	// Set to true to skip the server certificate verification, it should be used for testing only
+	SkipTLSVerify bool `json:"skip_tls_verify" mapstructure:"skip_tls_verify"`
+	// DN and password of the service account used to search the users. If the bind DN is empty the users
+	// bind using UserDNTemplate
+	BindDN       string `json:"bind_dn" mapstructure:"bind_dn"`
+	BindPassword string `json:"bind_password" mapstructure:"bind_password"`
+	// Template for the DN used to bind as the user without a search, for example
+	// "uid={{username}},ou=people,dc=example,dc=com" or "{{username}}@example.com" for Active Directory
+	UserDNTemplate string `json:"user_dn_template" mapstructure:"user_dn_template"`
+	// Base DN and filter to search the users, for example "(&(objectClass=user)(sAMAccountName={{username}}))".
+	// They are required if the bind DN is set, otherwise they are optional and the search is executed
+	// after the user bind to read the user attributes
+	BaseDN     string `json:"base_dn" mapstructure:"base_dn"`
+	UserFilter string `json:"user_filter" mapstructure:"user_filter"`
+	// Attribute containing the user groups. Empty means "memberOf"
+	GroupAttribute string `json:"group_attribute" mapstructure:"group_attribute"`
+	// Optional attributes containing the system user and group ids, for example "uidNumber" and "gidNumber"
+	UIDAttribute string `json:"uid_attribute" mapstructure:"uid_attribute"`
+	GIDAttribute string `json:"gid_attribute" mapstructure:"gid_attribute"`
+	// Template for the home directory, for example "/srv/sftpgo/{{username}}". The LDAP attributes can be used
+	// as placeholders too, for example "{{homeDirectory}}". Empty means the users base dir defined for the
+	// data provider
+	HomeDirTemplate string `json:"home_dir_template" mapstructure:"home_dir_template"`
+	// Permissions granted to all the users, the group mappings permissions are added to them
+	DefaultPermissions map[string][]string `json:"default_permissions" mapstructure:"default_permissions"`
+	// Settings for the members of the LDAP groups
+	GroupMappings []GroupMapping `json:"group_mappings" mapstructure:"group_mappings"`
+	// Page size for the user searches. If greater than 0 the searches use the paged results
+	// control, some directories require it for the searches over large subtrees
+	PageSize int `json:"page_size" mapstructure:"page_size"`
+	// Timeout as seconds for the LDAP operations. 0 means 10 seconds
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+}
+
+// User defines the user settings resolved from the LDAP directory
+type User struct {
+	DN          string
+	HomeDir     string
+	UID         int
+	GID         int
+	Permissions map[string][]string
+	Groups      []string
+}
+
+// IsEnabled returns true if the LDAP authentication is configured
+func (c *Config) IsEnabled() bool {
+	return len(c.URL) > 0
+}
+
+// Validate returns an error if the configuration is not valid
+func (c *Config) Validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid LDAP URL %#v: %v", c.URL, err)
+	}
+	if u.Scheme != "ldap" && u.Scheme != "ldaps" {
+		return fmt.Errorf("invalid LDAP URL %#v: the scheme must be ldap or ldaps", c.URL)
+	}
+	if len(u.Hostname()) == 0 {
+		return fmt.Errorf("invalid LDAP URL %#v: the host is missing", c.URL)
+	}
+	if c.StartTLS && u.Scheme == "ldaps" {
+		return fmt.Errorf("invalid LDAP URL %#v: StartTLS requires an ldap URL", c.URL)
+	}
+	if len(c.BindDN) > 0 {
+		if len(c.BaseDN) == 0 || len(c.UserFilter) == 0 {
+			return errors.New("base_dn and user_filter are required to search the users with the bind DN")
+		}
+	} else if !strings.Contains(c.UserDNTemplate, usernamePlaceholder) {
+		return fmt.Errorf("the user DN template must contain the %v placeholder if the bind DN is empty",
+			usernamePlaceholder)
+	}
+	if len(c.UserFilter) > 0 {
+		if !strings.Contains(c.UserFilter, usernamePlaceholder) {
+			return fmt.Errorf("the user filter must contain the %v placeholder", usernamePlaceholder)
+		}
+		if len(c.BaseDN) == 0 {
+			return errors.New("base_dn is required for the user filter")
+		}
+		if _, err := goldap.CompileFilter(strings.Replace(c.UserFilter, usernamePlaceholder, "user", -1)); err != nil {
+			return fmt.Errorf("invalid user filter %#v: %v", c.UserFilter, err)
+		}
+	}
+	for _, mapping := range c.GroupMappings {
+		if len(mapping.LDAPGroup) == 0 {
+			return errors.New("the LDAP group is required for the group mappings")
+		}
+	}
+	if c.PageSize < 0 {
+		return fmt.Errorf("invalid LDAP page size: %v", c.PageSize)
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid LDAP timeout: %v", c.Timeout)
+	}
+	return nil
+}
+
+// Authenticate verifies the given credentials and returns the settings for the user
+func (c *Config) Authenticate(username, password string) (User, error) {
+	var user User
+	if len(username) == 0 || len(password) == 0 {
+		return user, ErrInvalidCredentials
+	}
+	client, err := c.dial()
+	if err != nil {
+		return user, fmt.Errorf("unable to connect to the LDAP server: %v", err)
+	}
+	defer client.Close()
+
+	e, err := c.getUserEntry(client, username, password)
+	if err != nil {
+		return user, err
+	}
+	return c.getUser(username, e)
+}
+
+// dial connects to the LDAP server and upgrades the connection to TLS if StartTLS is enabled
+func (c *Config) dial() (*goldap.Conn, error) {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return nil, err
+	}
+	timeout := c.getTimeout()
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: c.SkipTLSVerify,
+	}
+	client, err := goldap.DialURL(c.URL, goldap.DialWithTLSDialer(tlsConfig, &net.Dialer{Timeout: timeout}))
+	if err != nil {
+		return nil, err
+	}
+	client.SetTimeout(timeout)
+	if c.StartTLS {
+		// a failed StartTLS never falls back to an unencrypted connection
+		if err = client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("unable to start TLS: %v", err)
+		}
+	}
+	return client, nil
+}
+
+// getUserEntry binds as the given user and returns its LDAP entry
+func (c *Config) getUserEntry(client *goldap.Conn, username, password string) (*goldap.Entry, error) {
+	if len(c.BindDN) > 0 {
+		if err := client.Bind(c.BindDN, c.BindPassword); err != nil {
+			return nil, fmt.Errorf("unable to bind as %#v: %v", c.BindDN, err)
+		}
+		e, err := c.searchUser(client, username)
+		if err != nil {
+			return e, err
+		}
+		return e, c.bindUser(client, e.DN, password)
+	}
+	dn := strings.Replace(c.UserDNTemplate, usernamePlaceholder, EscapeDN(username), -1)
+	if err := c.bindUser(client, dn, password); err != nil {
+		return nil, err
+	}
+	if len(c.UserFilter) == 0 {
+		return &goldap.Entry{DN: dn}, nil
+	}
+	return c.searchUser(client, username)
+}
+
+func (c *Config) bindUser(client *goldap.Conn, dn, password string) error {
+	err := client.Bind(dn, password)
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return err
+}
+
+func (c *Config) searchUser(client *goldap.Conn, username string) (*goldap.Entry, error) {
+	filter := strings.Replace(c.UserFilter, usernamePlaceholder, goldap.EscapeFilter(username), -1)
+	// we ask for two entries to detect ambiguous filters
+	request := goldap.NewSearchRequest(c.BaseDN, goldap.ScopeWholeSubtree, goldap.DerefAlways, 2,
+		int(c.getTimeout().Seconds()), false, filter, c.getAttributes(), nil)
+	var result *goldap.SearchResult
+	var err error
+	if c.PageSize > 0 {
+		result, err = client.SearchWithPaging(request, uint32(c.PageSize))
+	} else {
+		result, err = client.Search(request)
+	}
+	if goldap.IsErrorWithCode(err, goldap.LDAPResultSizeLimitExceeded) {
+		return nil, fmt.Errorf("the user filter matches more than one entry for user %#v", username)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to search the user %#v: %v", username, err)
+	}
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("the user filter matches more than one entry for user %#v", username)
+	}
+	if len(result.Entries) == 0 {
+		if len(result.Referrals) > 0 {
+			// the referrals are not followed
+			return nil, fmt.Errorf("the user %#v was not found, the server returned the referrals %v",
+				username, result.Referrals)
+		}
+		return nil, ErrInvalidCredentials
+	}
+	return result.Entries[0], nil
+}
+
+// getAttributes returns the LDAP attributes to read for the users
+func (c *Config) getAttributes() []string {
+	attributes := []string{c.getGroupAttribute()}
+	if len(c.UIDAttribute) > 0 {
+		attributes = append(attributes, c.UIDAttribute)
+	}
+	if len(c.GIDAttribute) > 0 {
+		attributes = append(attributes, c.GIDAttribute)
+	}
+	for _, match := range attributeRegex.FindAllStringSubmatch(c.HomeDirTemplate, -1) {
+		if match[0] != usernamePlaceholder {
+			attributes = append(attributes, match[1])
+		}
+	}
+	return attributes
+}
+
+func (c *Config) getTimeout() time.Duration {
+	if c.Timeout == 0 {
+		return defaultTimeout * time.Second
+	}
+	return time.Duration(c.Timeout) * time.Second
+}
+
+func (c *Config) getGroupAttribute() string {
+	if len(c.GroupAttribute) > 0 {
+		return c.GroupAttribute
+	}
+	return defaultGroupAttribute
+}
+
+// getUser maps the given LDAP entry to the user settings
+func (c *Config) getUser(username string, e *goldap.Entry) (User, error) {
+	user := User{
+		DN:          e.DN,
+		Permissions: make(map[string][]string),
+	}
+	var err error
+	user.HomeDir, err = c.getHomeDir(username, e)
+	if err != nil {
+		return user, err
+	}
+	if user.UID, err = getIntAttribute(e, c.UIDAttribute); err != nil {
+		return user, err
+	}
+	if user.GID, err = getIntAttribute(e, c.GIDAttribute); err != nil {
+		return user, err
+	}
+	addPermissions(user.Permissions, c.DefaultPermissions)
+	memberOf := e.GetEqualFoldAttributeValues(c.getGroupAttribute())
+	for _, mapping := range c.GroupMappings {
+		if !isGroupMember(mapping.LDAPGroup, memberOf) {
+			continue
+		}
+		addPermissions(user.Permissions, mapping.Permissions)
+		for _, group := range mapping.Groups {
+			if !utils.IsStringInSlice(group, user.Groups) {
+				user.Groups = append(user.Groups, group)
+			}
+		}
+	}
+	if len(user.Permissions["/"]) == 0 {
+		return user, fmt.Errorf("no permissions for the root directory are mapped for the LDAP user %#v", e.DN)
+	}
+	return user, nil
+}
+
+func (c *Config) getHomeDir(username string, e *goldap.Entry) (string, error) {
+	homeDir := strings.Replace(c.HomeDirTemplate, usernamePlaceholder, username, -1)
+	var err error
+	homeDir = attributeRegex.ReplaceAllStringFunc(homeDir, func(placeholder string) string {
+		name := placeholder[2 : len(placeholder)-2]
+		values := e.GetEqualFoldAttributeValues(name)
+		if len(values) == 0 {
+			err = fmt.Errorf("attribute %#v not found for the LDAP user %#v", name, e.DN)
+			return ""
+		}
+		return values[0]
+	})
+	return homeDir, err
+}
+
+func getIntAttribute(e *goldap.Entry, name string) (int, error) {
+	if len(name) == 0 {
+		return 0, nil
+	}
+	values := e.GetEqualFoldAttributeValues(name)
+	if len(values) == 0 {
+		return 0, nil
+	}
+	value, err := strconv.Atoi(values[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %#v for attribute %#v: %v", values[0], name, err)
+	}
+	return value, nil
+}
+
+// isGroupMember returns true if the given group matches one of the group DNs, or the
+// common name of one of them
+func isGroupMember(group string, memberOf []string) bool {
+	for _, dn := range memberOf {
+		if strings.EqualFold(group, dn) {
+			return true
+		}
+		rdn := strings.SplitN(dn, ",", 2)[0]
+		if idx := strings.Index(rdn, "="); idx > 0 && strings.EqualFold(rdn[:idx], "cn") &&
+			strings.EqualFold(group, rdn[idx+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+func addPermissions(permissions, toAdd map[string][]string) {
+	for dir, perms := range toAdd {
+		for _, perm := range perms {
+			if !utils.IsStringInSlice(perm, permissions[dir]) {
+				permissions[dir] = append(permissions[dir], perm)
+			}
+		}
+	}
+}
+
+// EscapeDN escapes the distinguished name special characters, as described in RFC4514
+func EscapeDN(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0:
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case (c == ' ' && (i == 0 || i == len(value)-1)) || (c == '#' && i == 0):
+			sb.WriteByte('\\')
+			sb.WriteByte(c)
+		case c == 0:
+			sb.WriteString("\\00")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
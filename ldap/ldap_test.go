@@ -0,0 +1,649 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	goldap "github.com/go-ldap/ldap/v3"
+)
+
+const (
+	serviceDN       = "cn=service,dc=example,dc=com"
+	servicePassword = "service_password"
+	baseDN          = "dc=example,dc=com"
+	userFilter      = "(&(objectClass=user)(sAMAccountName={{username}}))"
+)
+
+type fakeEntry struct {
+	password   string
+	attributes map[string][]string
+}
+
+// fakeServer is a minimal LDAP server for the tests
+type fakeServer struct {
+	sync.Mutex
+	listener  net.Listener
+	tlsConfig *tls.Config
+	entries   map[string]fakeEntry
+	// search result references returned with each search
+	referrals []string
+	// result codes for the StartTLS and the search operations
+	startTLSCode int64
+	searchCode   int64
+	// recorded requests
+	bindDNs       []string
+	filters       []string
+	pagedSearches int
+}
+
+func newFakeServer(t *testing.T, useTLS bool) *fakeServer {
+	s := &fakeServer{
+		tlsConfig: getTestTLSConfig(t),
+		entries: map[string]fakeEntry{
+			serviceDN: {password: servicePassword, attributes: map[string][]string{"objectClass": {"service"}}},
+			"cn=John Doe,ou=users,dc=example,dc=com": {
+				password: "john_password",
+				attributes: map[string][]string{
+					"objectClass":    {"user"},
+					"sAMAccountName": {"john"},
+					"memberOf": {"CN=SFTP Users,OU=Groups,DC=example,DC=com",
+						"CN=SFTP Admins,OU=Groups,DC=example,DC=com"},
+					"uidNumber":     {"1001"},
+					"gidNumber":     {"1002"},
+					"homeDirectory": {"/home/john"},
+				},
+			},
+			"cn=Jane Doe,ou=users,dc=example,dc=com": {
+				password: "jane_password",
+				attributes: map[string][]string{
+					"objectClass":    {"user"},
+					"sAMAccountName": {"jane"},
+				},
+			},
+			"cn=dup1,ou=users,dc=example,dc=com": {
+				password:   "dup_password",
+				attributes: map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"dup"}},
+			},
+			"cn=dup2,ou=users,dc=example,dc=com": {
+				password:   "dup_password",
+				attributes: map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"dup"}},
+			},
+			"cn=many1,ou=users,dc=example,dc=com": {
+				password:   "many_password",
+				attributes: map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"many"}},
+			},
+			"cn=many2,ou=users,dc=example,dc=com": {
+				password:   "many_password",
+				attributes: map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"many"}},
+			},
+			"cn=many3,ou=users,dc=example,dc=com": {
+				password:   "many_password",
+				attributes: map[string][]string{"objectClass": {"user"}, "sAMAccountName": {"many"}},
+			},
+		},
+	}
+	var err error
+	if useTLS {
+		s.listener, err = tls.Listen("tcp", "127.0.0.1:0", s.tlsConfig)
+	} else {
+		s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	go s.serve()
+	return s
+}
+
+func (s *fakeServer) url(scheme string) string {
+	return scheme + "://" + s.listener.Addr().String()
+}
+
+func (s *fakeServer) serve() {
+	for {
+		c, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(c)
+	}
+}
+
+func (s *fakeServer) handle(c net.Conn) {
+	defer func() {
+		c.Close()
+	}()
+	for {
+		message, err := ber.ReadPacket(c)
+		if err != nil || len(message.Children) < 2 {
+			return
+		}
+		id := message.Children[0].Value.(int64)
+		op := message.Children[1]
+		var controls []goldap.Control
+		if len(message.Children) > 2 {
+			for _, child := range message.Children[2].Children {
+				if control, err := goldap.DecodeControl(child); err == nil {
+					controls = append(controls, control)
+				}
+			}
+		}
+		reply := func(response *ber.Packet, responseControls ...goldap.Control) {
+			packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+			packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+			packet.AppendChild(response)
+			if len(responseControls) > 0 {
+				packetControls := ber.Encode(ber.ClassContext, ber.TypeConstructed, 0, nil, "Controls")
+				for _, control := range responseControls {
+					packetControls.AppendChild(control.Encode())
+				}
+				packet.AppendChild(packetControls)
+			}
+			c.Write(packet.Bytes())
+		}
+		switch op.Tag {
+		case goldap.ApplicationBindRequest:
+			dn := op.Children[1].Value.(string)
+			s.Lock()
+			s.bindDNs = append(s.bindDNs, dn)
+			s.Unlock()
+			code := int64(goldap.LDAPResultInvalidCredentials)
+			if e, ok := s.entries[dn]; ok && e.password == op.Children[2].Data.String() {
+				code = goldap.LDAPResultSuccess
+			}
+			reply(newResult(goldap.ApplicationBindResponse, code))
+		case goldap.ApplicationSearchRequest:
+			s.search(op, controls, reply)
+		case goldap.ApplicationExtendedRequest:
+			s.Lock()
+			code := s.startTLSCode
+			s.Unlock()
+			reply(newResult(goldap.ApplicationExtendedResponse, code))
+			if code != goldap.LDAPResultSuccess {
+				continue
+			}
+			tlsConn := tls.Server(c, s.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			c = tlsConn
+		case goldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// search returns the matching entries, one page at a time if the paged results control is used
+func (s *fakeServer) search(op *ber.Packet, controls []goldap.Control,
+	reply func(*ber.Packet, ...goldap.Control)) {
+	filter, _ := goldap.DecompileFilter(op.Children[6])
+	sizeLimit := op.Children[3].Value.(int64)
+	s.Lock()
+	s.filters = append(s.filters, filter)
+	referrals := s.referrals
+	code := s.searchCode
+	s.Unlock()
+
+	var dns []string
+	for dn, e := range s.entries {
+		if strings.HasSuffix(dn, op.Children[0].Value.(string)) && matchFilter(op.Children[6], e) {
+			dns = append(dns, dn)
+		}
+	}
+	sort.Strings(dns)
+	if sizeLimit > 0 && int64(len(dns)) > sizeLimit {
+		dns = dns[:sizeLimit]
+		code = goldap.LDAPResultSizeLimitExceeded
+	}
+	var responseControls []goldap.Control
+	if control := goldap.FindControl(controls, goldap.ControlTypePaging); control != nil {
+		paging := control.(*goldap.ControlPaging)
+		start, _ := strconv.Atoi(string(paging.Cookie))
+		end := start + int(paging.PagingSize)
+		response := goldap.NewControlPaging(paging.PagingSize)
+		if end < len(dns) {
+			response.SetCookie([]byte(strconv.Itoa(end)))
+		} else {
+			end = len(dns)
+		}
+		dns = dns[start:end]
+		responseControls = append(responseControls, response)
+		s.Lock()
+		s.pagedSearches++
+		s.Unlock()
+	}
+	for _, dn := range dns {
+		attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+		for name, values := range s.entries[dn].attributes {
+			vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+			for _, v := range values {
+				vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, v, "Value"))
+			}
+			attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+			attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Name"))
+			attr.AppendChild(vals)
+			attrs.AppendChild(attr)
+		}
+		entry := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultEntry, nil, "Entry")
+		entry.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, "DN"))
+		entry.AppendChild(attrs)
+		reply(entry)
+	}
+	for _, referral := range referrals {
+		reference := ber.Encode(ber.ClassApplication, ber.TypeConstructed, goldap.ApplicationSearchResultReference,
+			nil, "Reference")
+		reference.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, referral, "URI"))
+		reply(reference)
+	}
+	reply(newResult(goldap.ApplicationSearchResultDone, code), responseControls...)
+}
+
+func (s *fakeServer) getBindDNs() []string {
+	s.Lock()
+	defer s.Unlock()
+	return s.bindDNs
+}
+
+func (s *fakeServer) getFilters() []string {
+	s.Lock()
+	defer s.Unlock()
+	return s.filters
+}
+
+func (s *fakeServer) close() {
+	s.listener.Close()
+}
+
+func newResult(op ber.Tag, code int64) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, op, nil, "Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Message"))
+	return result
+}
+
+// matchFilter evaluates the filters used in the tests
+func matchFilter(filter *ber.Packet, e fakeEntry) bool {
+	switch filter.Tag {
+	case goldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !matchFilter(child, e) {
+				return false
+			}
+		}
+		return true
+	case goldap.FilterOr:
+		for _, child := range filter.Children {
+			if matchFilter(child, e) {
+				return true
+			}
+		}
+		return false
+	case goldap.FilterNot:
+		return !matchFilter(filter.Children[0], e)
+	case goldap.FilterPresent:
+		return len(e.attributes[filter.Data.String()]) > 0
+	case goldap.FilterEqualityMatch:
+		for _, v := range e.attributes[filter.Children[0].Value.(string)] {
+			if strings.EqualFold(v, filter.Children[1].Value.(string)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getTestTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate: %v", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+func getTestConfig(s *fakeServer) Config {
+	return Config{
+		URL:             s.url("ldap"),
+		BindDN:          serviceDN,
+		BindPassword:    servicePassword,
+		BaseDN:          baseDN,
+		UserFilter:      userFilter,
+		UIDAttribute:    "uidNumber",
+		GIDAttribute:    "gidNumber",
+		HomeDirTemplate: "/srv/sftpgo/{{username}}",
+		GroupMappings: []GroupMapping{
+			{
+				LDAPGroup:   "sftp users",
+				Permissions: map[string][]string{"/": {"list", "download"}},
+				Groups:      []string{"users"},
+			},
+			{
+				LDAPGroup:   "CN=SFTP Admins,OU=Groups,DC=example,DC=com",
+				Permissions: map[string][]string{"/": {"list", "upload"}, "/admin": {"*"}},
+				Groups:      []string{"admins", "users"},
+			},
+			{
+				LDAPGroup:   "other",
+				Permissions: map[string][]string{"/other": {"*"}},
+				Groups:      []string{"other"},
+			},
+		},
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	if EscapeDN(" a,b=c+#") != "\\ a\\,b\\=c\\+#" || EscapeDN("#a ") != "\\#a\\ " {
+		t.Errorf("unexpected escaped DN: %v %v", EscapeDN(" a,b=c+#"), EscapeDN("#a "))
+	}
+	if EscapeDN("a\\b\"c<d>e;f") != "a\\\\b\\\"c\\<d\\>e\\;f" {
+		t.Errorf("unexpected escaped DN: %v", EscapeDN("a\\b\"c<d>e;f"))
+	}
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	c := getTestConfig(s)
+	if _, err := c.Authenticate("jo*hn(", "john_password"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error: %v", err)
+	}
+	filters := s.getFilters()
+	if len(filters) != 1 || filters[0] != "(&(objectClass=user)(sAMAccountName=jo\\2ahn\\28))" {
+		t.Errorf("the username must be escaped in the filter: %+v", filters)
+	}
+	c = Config{
+		URL:                s.url("ldap"),
+		UserDNTemplate:     "cn={{username}},ou=users,dc=example,dc=com",
+		DefaultPermissions: map[string][]string{"/": {"*"}},
+	}
+	if _, err := c.Authenticate("Doe, John", "john_password"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error: %v", err)
+	}
+	bindDNs := s.getBindDNs()
+	if len(bindDNs) != 2 || bindDNs[1] != "cn=Doe\\, John,ou=users,dc=example,dc=com" {
+		t.Errorf("the username must be escaped in the bind DN: %+v", bindDNs)
+	}
+}
+
+func TestReferrals(t *testing.T) {
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	s.referrals = []string{"ldap://other.example.com/dc=example,dc=com"}
+	c := getTestConfig(s)
+	// the referrals are ignored if the user is found
+	if _, err := c.Authenticate("john", "john_password"); err != nil {
+		t.Errorf("unable to authenticate: %v", err)
+	}
+	// the referrals are not followed
+	_, err := c.Authenticate("missing", "password")
+	if err == nil || err == ErrInvalidCredentials || !strings.Contains(err.Error(), "ldap://other.example.com") {
+		t.Errorf("unexpected error for a referred user: %v", err)
+	}
+	s.referrals = nil
+	s.searchCode = goldap.LDAPResultReferral
+	_, err = c.Authenticate("missing", "password")
+	if err == nil || err == ErrInvalidCredentials {
+		t.Errorf("a referral result must fail: %v", err)
+	}
+}
+
+func TestPagedResults(t *testing.T) {
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	c := getTestConfig(s)
+	c.PageSize = 1
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	user, err := c.Authenticate("john", "john_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if user.DN != "cn=John Doe,ou=users,dc=example,dc=com" || user.UID != 1001 {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	if s.pagedSearches != 1 {
+		t.Errorf("unexpected paged searches: %v", s.pagedSearches)
+	}
+	// the entries are collected from all the pages
+	if _, err = c.Authenticate("dup", "dup_password"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("ambiguous users must fail: %v", err)
+	}
+	if s.pagedSearches != 3 {
+		t.Errorf("unexpected paged searches: %v", s.pagedSearches)
+	}
+	if _, err = c.Authenticate("many", "many_password"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("ambiguous users must fail: %v", err)
+	}
+	c.PageSize = 0
+	if _, err = c.Authenticate("john", "john_password"); err != nil {
+		t.Errorf("unable to authenticate: %v", err)
+	}
+	if s.pagedSearches != 4 {
+		t.Errorf("the paged results control must not be used: %v", s.pagedSearches)
+	}
+}
+
+func TestStartTLSErrors(t *testing.T) {
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	c := getTestConfig(s)
+	c.StartTLS = true
+	s.startTLSCode = goldap.LDAPResultUnwillingToPerform
+	c.SkipTLSVerify = true
+	_, err := c.Authenticate("john", "john_password")
+	if err == nil || !strings.Contains(err.Error(), "unable to start TLS") {
+		t.Errorf("a rejected StartTLS must fail: %v", err)
+	}
+	// no fallback to an unencrypted connection
+	if len(s.getBindDNs()) != 0 {
+		t.Errorf("no bind expected after a failed StartTLS: %+v", s.getBindDNs())
+	}
+	s.startTLSCode = goldap.LDAPResultSuccess
+	c.SkipTLSVerify = false
+	if _, err = c.Authenticate("john", "john_password"); err == nil {
+		t.Error("self signed certificate must fail")
+	}
+	if len(s.getBindDNs()) != 0 {
+		t.Errorf("no bind expected after a failed TLS handshake: %+v", s.getBindDNs())
+	}
+	c.SkipTLSVerify = true
+	if _, err = c.Authenticate("john", "john_password"); err != nil {
+		t.Errorf("unable to authenticate using StartTLS: %v", err)
+	}
+	if len(s.getBindDNs()) != 2 {
+		t.Errorf("unexpected binds: %+v", s.getBindDNs())
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := Config{}
+	if c.IsEnabled() {
+		t.Error("an empty configuration must disable the LDAP authentication")
+	}
+	invalidConfigs := []Config{
+		{URL: "http://127.0.0.1", UserDNTemplate: "uid={{username}}"},
+		{URL: "ldap://", UserDNTemplate: "uid={{username}}"},
+		{URL: "ldap://127.0.0.1"},
+		{URL: "ldap://127.0.0.1", UserDNTemplate: "uid=user"},
+		{URL: "ldap://127.0.0.1", BindDN: serviceDN, BaseDN: baseDN},
+		{URL: "ldap://127.0.0.1", BindDN: serviceDN, BaseDN: baseDN, UserFilter: "(cn=user)"},
+		{URL: "ldap://127.0.0.1", BindDN: serviceDN, BaseDN: baseDN, UserFilter: "(cn={{username}}"},
+		{URL: "ldap://127.0.0.1", UserDNTemplate: "uid={{username}}", UserFilter: userFilter},
+		{URL: "ldap://127.0.0.1", UserDNTemplate: "uid={{username}}", GroupMappings: []GroupMapping{{}}},
+		{URL: "ldap://127.0.0.1", UserDNTemplate: "uid={{username}}", Timeout: -1},
+		{URL: "ldap://127.0.0.1", UserDNTemplate: "uid={{username}}", PageSize: -1},
+		{URL: "ldaps://127.0.0.1", UserDNTemplate: "uid={{username}}", StartTLS: true},
+		{URL: "ldap://127.0.0.1", BindDN: serviceDN, BaseDN: baseDN, UserFilter: "(&(cn={{username}}))(uid=a)"},
+		{URL: "ldap://127.0.0.1", BindDN: serviceDN, BaseDN: baseDN, UserFilter: "cn={{username}}"},
+	}
+	for _, c := range invalidConfigs {
+		if err := c.Validate(); err == nil {
+			t.Errorf("config %+v must fail", c)
+		}
+	}
+	c = Config{URL: "ldaps://127.0.0.1", UserDNTemplate: "{{username}}@example.com"}
+	if err := c.Validate(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestAuthenticateWithSearch(t *testing.T) {
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	c := getTestConfig(s)
+	if err := c.Validate(); err != nil {
+		t.Fatalf("unexpected validation error: %v", err)
+	}
+	user, err := c.Authenticate("john", "john_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if user.DN != "cn=John Doe,ou=users,dc=example,dc=com" || user.HomeDir != "/srv/sftpgo/john" ||
+		user.UID != 1001 || user.GID != 1002 {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	if len(user.Permissions["/"]) != 3 || len(user.Permissions["/admin"]) != 1 || len(user.Permissions) != 2 {
+		t.Errorf("unexpected permissions: %+v", user.Permissions)
+	}
+	if len(user.Groups) != 2 || user.Groups[0] != "users" || user.Groups[1] != "admins" {
+		t.Errorf("unexpected groups: %+v", user.Groups)
+	}
+	if _, err = c.Authenticate("john", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error for invalid password: %v", err)
+	}
+	if _, err = c.Authenticate("john", ""); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error for empty password: %v", err)
+	}
+	if _, err = c.Authenticate("missing", "password"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error for missing user: %v", err)
+	}
+	// the filter is escaped
+	if _, err = c.Authenticate("*", "john_password"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error for wildcard user: %v", err)
+	}
+	if _, err = c.Authenticate("dup", "dup_password"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("ambiguous users must fail: %v", err)
+	}
+	// jane has no groups so no permissions
+	if _, err = c.Authenticate("jane", "jane_password"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("users without permissions must fail: %v", err)
+	}
+	c.DefaultPermissions = map[string][]string{"/": {"list"}}
+	c.HomeDirTemplate = "{{homeDirectory}}"
+	if _, err = c.Authenticate("jane", "jane_password"); err == nil {
+		t.Error("missing home directory attribute must fail")
+	}
+	user, err = c.Authenticate("john", "john_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if user.HomeDir != "/home/john" || len(user.Permissions["/"]) != 3 {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	c.HomeDirTemplate = ""
+	user, err = c.Authenticate("jane", "jane_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if user.HomeDir != "" || user.UID != 0 || len(user.Groups) != 0 || len(user.Permissions["/"]) != 1 {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	c.BindPassword = "wrong"
+	if _, err = c.Authenticate("john", "john_password"); err == nil || err == ErrInvalidCredentials {
+		t.Errorf("invalid service credentials must fail: %v", err)
+	}
+}
+
+func TestAuthenticateWithUserBind(t *testing.T) {
+	s := newFakeServer(t, false)
+	defer s.close()
+
+	c := Config{
+		URL:                s.url("ldap"),
+		UserDNTemplate:     "cn={{username}},ou=users,dc=example,dc=com",
+		DefaultPermissions: map[string][]string{"/": {"*"}},
+	}
+	user, err := c.Authenticate("Jane Doe", "jane_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if user.DN != "cn=Jane Doe,ou=users,dc=example,dc=com" {
+		t.Errorf("unexpected user: %+v", user)
+	}
+	if _, err = c.Authenticate("Jane Doe", "wrong"); err != ErrInvalidCredentials {
+		t.Errorf("unexpected error for invalid password: %v", err)
+	}
+	// search the user attributes after the bind
+	c.BaseDN = baseDN
+	c.UserFilter = "(cn={{username}})"
+	c.GroupMappings = getTestConfig(s).GroupMappings
+	c.DefaultPermissions = nil
+	if _, err = c.Authenticate("John Doe", "john_password"); err == nil {
+		t.Error("the search filter does not match so the login must fail")
+	}
+	c.UserFilter = "(&(objectClass=user)(|(sAMAccountName=john)(cn={{username}})))"
+	// the fake directory stores the common name only in the DN, so use a filter matching the account name
+	user, err = c.Authenticate("John Doe", "john_password")
+	if err != nil {
+		t.Fatalf("unable to authenticate: %v", err)
+	}
+	if len(user.Groups) != 2 || len(user.Permissions["/"]) != 3 {
+		t.Errorf("unexpected user: %+v", user)
+	}
+}
+
+func TestAuthenticateTLS(t *testing.T) {
+	s := newFakeServer(t, true)
+	defer s.close()
+
+	c := getTestConfig(s)
+	c.URL = s.url("ldaps")
+	if _, err := c.Authenticate("john", "john_password"); err == nil {
+		t.Error("self signed certificate must fail")
+	}
+	c.SkipTLSVerify = true
+	if _, err := c.Authenticate("john", "john_password"); err != nil {
+		t.Errorf("unable to authenticate: %v", err)
+	}
+
+	s1 := newFakeServer(t, false)
+	defer s1.close()
+
+	c = getTestConfig(s1)
+	c.StartTLS = true
+	c.SkipTLSVerify = true
+	if _, err := c.Authenticate("john", "john_password"); err != nil {
+		t.Errorf("unable to authenticate using StartTLS: %v", err)
+	}
+	c.URL = "ldap://127.0.0.1:1"
+	if _, err := c.Authenticate("john", "john_password"); err == nil {
+		t.Error("authentication against a missing server must fail")
+	}
+}
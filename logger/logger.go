@@ -48,20 +48,21 @@ func GetLogger() *zerolog.Logger {
 func InitLogger(logFilePath string, logMaxSize int, logMaxBackups int, logMaxAge int, logCompress bool, level zerolog.Level) {
 	zerolog.TimeFieldFormat = dateFormat
 	if isLogFilePathValid(logFilePath) {
-		logger = zerolog.New(&lumberjack.Logger{
+		baseWriter = &lumberjack.Logger{
 			Filename:   logFilePath,
 			MaxSize:    logMaxSize,
 			MaxBackups: logMaxBackups,
 			MaxAge:     logMaxAge,
 			Compress:   logCompress,
-		})
+		}
 		EnableConsoleLogger(level)
 	} else {
-		logger = zerolog.New(logSyncWrapper{
+		baseWriter = logSyncWrapper{
 			output: os.Stdout,
-			lock:   new(sync.Mutex)})
+			lock:   new(sync.Mutex)}
 		consoleLogger = zerolog.Nop()
 	}
+	logger = zerolog.New(baseWriter)
 	logger.Level(level)
 }
 
@@ -0,0 +1,244 @@
+package logger
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	appName        = "sftpgo"
+	sinkTimeout    = 5 * time.Second
+	journaldSocket = "/run/systemd/journal/socket"
+	// syslog facility daemon
+	syslogFacility = 3
+)
+
+var (
+	localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+	// the log file or the standard output, set by InitLogger
+	baseWriter io.Writer
+)
+
+// SinksConfig defines the additional outputs for the logs, they are used together
+// with the log file or the standard output
+type SinksConfig struct {
+	// Syslog output: "local" for the local syslog daemon, "udp://host:port" or
+	// "tcp://host:port" for a remote RFC5424 syslog server. Empty means disabled
+	Syslog string
+	// Minimum level for the syslog output: debug, info, warn, error. Empty means info
+	SyslogLevel string
+	// Set to true to send the logs to the systemd journal
+	Journald bool
+	// Minimum level for the systemd journal output: debug, info, warn, error. Empty means info
+	JournaldLevel string
+}
+
+// levelFilterWriter writes the log events with a level greater or equal than the
+// configured one. The write errors are ignored, so a failing sink does not affect
+// the other log outputs
+type levelFilterWriter struct {
+	minLevel zerolog.Level
+	sink     levelSink
+}
+
+type levelSink interface {
+	writeLevel(level zerolog.Level, p []byte) error
+}
+
+func (w *levelFilterWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *levelFilterWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	if level == zerolog.NoLevel {
+		level = zerolog.InfoLevel
+	}
+	if level >= w.minLevel {
+		w.sink.writeLevel(level, p)
+	}
+	return len(p), nil
+}
+
+// syslogSink sends the log events to a syslog daemon using the RFC5424 format
+type syslogSink struct {
+	sync.Mutex
+	network  string
+	address  string
+	isLocal  bool
+	hostname string
+	conn     net.Conn
+}
+
+func (s *syslogSink) connect() error {
+	if !s.isLocal {
+		conn, err := net.DialTimeout(s.network, s.address, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+		return nil
+	}
+	for _, socket := range localSyslogSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			conn, err := net.DialTimeout(network, socket, sinkTimeout)
+			if err == nil {
+				s.conn = conn
+				s.network = network
+				return nil
+			}
+		}
+	}
+	return errors.New("unable to connect to the local syslog daemon")
+}
+
+func (s *syslogSink) writeLevel(level zerolog.Level, p []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", syslogFacility*8+getSyslogSeverity(level),
+		time.Now().Format(time.RFC3339Nano), s.hostname, appName, os.Getpid(), bytes.TrimRight(p, "\n"))
+	if s.network == "tcp" {
+		// octet counting framing as described in RFC6587
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout))
+	_, err := s.conn.Write([]byte(msg))
+	if err != nil {
+		// we'll try to connect again for the next event
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// journaldSink sends the log events to the systemd journal using its native protocol
+type journaldSink struct {
+	sync.Mutex
+	conn net.Conn
+}
+
+func (s *journaldSink) writeLevel(level zerolog.Level, p []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unixgram", journaldSocket, sinkTimeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	// the log events are JSON encoded so they cannot contain new lines
+	msg := fmt.Sprintf("PRIORITY=%d\nSYSLOG_IDENTIFIER=%s\nSYSLOG_PID=%d\nMESSAGE=%s\n", getSyslogSeverity(level),
+		appName, os.Getpid(), bytes.TrimRight(p, "\n"))
+	_, err := s.conn.Write([]byte(msg))
+	if err != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+// EnableSinks adds the configured sinks to the log outputs. It must be called after InitLogger
+func EnableSinks(config SinksConfig) error {
+	if baseWriter == nil {
+		return errors.New("the logger is not initialized")
+	}
+	writers := []io.Writer{baseWriter}
+	if len(config.Syslog) > 0 {
+		level, err := parseSinkLevel(config.SyslogLevel)
+		if err != nil {
+			return err
+		}
+		sink, err := newSyslogSink(config.Syslog)
+		if err != nil {
+			return err
+		}
+		if err = sink.connect(); err != nil {
+			return fmt.Errorf("unable to connect to syslog %#v: %v", config.Syslog, err)
+		}
+		writers = append(writers, &levelFilterWriter{minLevel: level, sink: sink})
+	}
+	if config.Journald {
+		level, err := parseSinkLevel(config.JournaldLevel)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Stat(journaldSocket); err != nil {
+			return fmt.Errorf("the systemd journal is not available: %v", err)
+		}
+		writers = append(writers, &levelFilterWriter{minLevel: level, sink: &journaldSink{}})
+	}
+	if len(writers) == 1 {
+		return nil
+	}
+	// the sinks never return errors, so a failing sink does not affect the other outputs
+	logger = zerolog.New(zerolog.MultiLevelWriter(writers...))
+	return nil
+}
+
+func newSyslogSink(syslog string) (*syslogSink, error) {
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+	if syslog == "local" {
+		return &syslogSink{isLocal: true, hostname: hostname}, nil
+	}
+	for _, network := range []string{"udp", "tcp"} {
+		if strings.HasPrefix(syslog, network+"://") {
+			address := strings.TrimPrefix(syslog, network+"://")
+			if _, _, err := net.SplitHostPort(address); err != nil {
+				return nil, fmt.Errorf("invalid syslog address %#v: %v", syslog, err)
+			}
+			return &syslogSink{network: network, address: address, hostname: hostname}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid syslog %#v, supported values: local, udp://host:port, tcp://host:port", syslog)
+}
+
+func parseSinkLevel(level string) (zerolog.Level, error) {
+	switch level {
+	case "debug":
+		return zerolog.DebugLevel, nil
+	case "", "info":
+		return zerolog.InfoLevel, nil
+	case "warn":
+		return zerolog.WarnLevel, nil
+	case "error":
+		return zerolog.ErrorLevel, nil
+	default:
+		return zerolog.NoLevel, fmt.Errorf("invalid log level %#v, supported values: debug, info, warn, error", level)
+	}
+}
+
+// getSyslogSeverity returns the syslog severity for the given log level
+func getSyslogSeverity(level zerolog.Level) int {
+	switch level {
+	case zerolog.DebugLevel:
+		return 7
+	case zerolog.WarnLevel:
+		return 4
+	case zerolog.ErrorLevel:
+		return 3
+	case zerolog.FatalLevel, zerolog.PanicLevel:
+		return 2
+	default:
+		return 6
+	}
+}
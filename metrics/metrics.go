@@ -2,11 +2,57 @@
 package metrics
 
 import (
+	"sync"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
+const (
+	transferTypeUpload   = "upload"
+	transferTypeDownload = "download"
+)
+
 var (
+	// protocols with active connections reported at least once, they are set to 0 when
+	// they have no connections instead of disappearing from the protocol labeled gauge
+	knownProtocols      = make(map[string]bool)
+	knownProtocolsMutex sync.Mutex
+
+	// activeConnectionsByProtocol is the metric that reports the number of active connections per protocol
+	activeConnectionsByProtocol = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sftpgo_active_connections_by_protocol",
+		Help: "Number of logged in users per protocol",
+	}, []string{"protocol"})
+
+	// transferSize is the metric that reports the size distribution of the completed transfers
+	transferSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "sftpgo_transfer_size_bytes",
+		Help: "Size distribution of the completed transfers as bytes, partial transfers are included",
+		// from 1 KB to 4 GB
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 12),
+	}, []string{"protocol", "type"})
+
+	// transferDuration is the metric that reports the duration distribution of the completed transfers
+	transferDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sftpgo_transfer_duration_seconds",
+		Help:    "Duration distribution of the completed transfers as seconds, partial transfers are included",
+		Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"protocol", "type"})
+
+	// transferredBytes is the metric that reports the transferred bytes per protocol and direction
+	transferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_transferred_bytes_total",
+		Help: "The total transferred bytes per protocol and transfer type, partial transfers are included",
+	}, []string{"protocol", "type"})
+
+	// transferErrors is the metric that reports the transfer errors per protocol and direction
+	transferErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "sftpgo_transfer_errors_by_protocol_total",
+		Help: "The total number of transfer errors per protocol and transfer type",
+	}, []string{"protocol", "type"})
+
 	// dataproviderAvailability is the metric that reports the availability for the configured data provider
 	dataproviderAvailability = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "sftpgo_dataprovider_availability",
@@ -335,10 +381,97 @@ var (
 		Name: "sftpgo_gcs_head_bucket_errors",
 		Help: "The total number of GCS head bucket errors",
 	})
+
+	// totalAZUploads is the metric that reports the total number of successful Azure Blob uploads
+	totalAZUploads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_uploads_total",
+		Help: "The total number of successful Azure Blob uploads",
+	})
+
+	// totalAZDownloads is the metric that reports the total number of successful Azure Blob downloads
+	totalAZDownloads = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_downloads_total",
+		Help: "The total number of successful Azure Blob downloads",
+	})
+
+	// totalAZUploadErrors is the metric that reports the total number of Azure Blob upload errors
+	totalAZUploadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_errors_total",
+		Help: "The total number of Azure Blob upload errors",
+	})
+
+	// totalAZDownloadErrors is the metric that reports the total number of Azure Blob download errors
+	totalAZDownloadErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_errors_total",
+		Help: "The total number of Azure Blob download errors",
+	})
+
+	// totalAZUploadSize is the metric that reports the total Azure Blob uploads size as bytes
+	totalAZUploadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_upload_size",
+		Help: "The total Azure Blob upload size as bytes, partial uploads are included",
+	})
+
+	// totalAZDownloadSize is the metric that reports the total Azure Blob downloads size as bytes
+	totalAZDownloadSize = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_download_size",
+		Help: "The total Azure Blob download size as bytes, partial downloads are included",
+	})
+
+	// totalAZListObjects is the metric that reports the total successful Azure Blob list objects requests
+	totalAZListObjects = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects",
+		Help: "The total number of successful Azure Blob list objects requests",
+	})
+
+	// totalAZCopyObject is the metric that reports the total successful Azure Blob copy object requests
+	totalAZCopyObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object",
+		Help: "The total number of successful Azure Blob copy object requests",
+	})
+
+	// totalAZDeleteObject is the metric that reports the total successful Azure Blob delete object requests
+	totalAZDeleteObject = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object",
+		Help: "The total number of successful Azure Blob delete object requests",
+	})
+
+	// totalAZListObjectsError is the metric that reports the total Azure Blob list objects errors
+	totalAZListObjectsErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_list_objects_errors",
+		Help: "The total number of Azure Blob list objects errors",
+	})
+
+	// totalAZCopyObjectErrors is the metric that reports the total Azure Blob copy object errors
+	totalAZCopyObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_copy_object_errors",
+		Help: "The total number of Azure Blob copy object errors",
+	})
+
+	// totalAZDeleteObjectErrors is the metric that reports the total Azure Blob delete object errors
+	totalAZDeleteObjectErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_delete_object_errors",
+		Help: "The total number of Azure Blob delete object errors",
+	})
+
+	// totalAZHeadContainer is the metric that reports the total successful Azure Blob head container requests
+	totalAZHeadContainer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container",
+		Help: "The total number of successful Azure Blob head container requests",
+	})
+
+	// totalAZHeadContainerErrors is the metric that reports the total Azure Blob head container errors
+	totalAZHeadContainerErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "sftpgo_az_head_container_errors",
+		Help: "The total number of Azure Blob head container errors",
+	})
 )
 
-// TransferCompleted updates metrics after an upload or a download
-func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err error) {
+// TransferCompleted updates metrics after an upload or a download.
+// The transfer size and duration are tracked per protocol too
+func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, protocol string, elapsed time.Duration, err error) {
+	var transferType string
+	var size int64
 	if transferKind == 0 {
 		// upload
 		if err == nil {
@@ -347,6 +480,8 @@ func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err err
 			totalUploadErrors.Inc()
 		}
 		totalUploadSize.Add(float64(bytesReceived))
+		transferType = transferTypeUpload
+		size = bytesReceived
 	} else {
 		// download
 		if err == nil {
@@ -355,7 +490,15 @@ func TransferCompleted(bytesSent, bytesReceived int64, transferKind int, err err
 			totalDownloadErrors.Inc()
 		}
 		totalDownloadSize.Add(float64(bytesSent))
+		transferType = transferTypeDownload
+		size = bytesSent
 	}
+	if err != nil {
+		transferErrors.WithLabelValues(protocol, transferType).Inc()
+	}
+	transferredBytes.WithLabelValues(protocol, transferType).Add(float64(size))
+	transferSize.WithLabelValues(protocol, transferType).Observe(float64(size))
+	transferDuration.WithLabelValues(protocol, transferType).Observe(elapsed.Seconds())
 }
 
 // S3TransferCompleted updates metrics after an S3 upload or a download
@@ -472,6 +615,63 @@ func GCSHeadBucketCompleted(err error) {
 	}
 }
 
+// AZTransferCompleted updates metrics after an Azure Blob upload or a download
+func AZTransferCompleted(bytes int64, transferKind int, err error) {
+	if transferKind == 0 {
+		// upload
+		if err == nil {
+			totalAZUploads.Inc()
+		} else {
+			totalAZUploadErrors.Inc()
+		}
+		totalAZUploadSize.Add(float64(bytes))
+	} else {
+		// download
+		if err == nil {
+			totalAZDownloads.Inc()
+		} else {
+			totalAZDownloadErrors.Inc()
+		}
+		totalAZDownloadSize.Add(float64(bytes))
+	}
+}
+
+// AZListObjectsCompleted updates metrics after an Azure Blob list objects request terminates
+func AZListObjectsCompleted(err error) {
+	if err == nil {
+		totalAZListObjects.Inc()
+	} else {
+		totalAZListObjectsErrors.Inc()
+	}
+}
+
+// AZCopyObjectCompleted updates metrics after an Azure Blob copy object request terminates
+func AZCopyObjectCompleted(err error) {
+	if err == nil {
+		totalAZCopyObject.Inc()
+	} else {
+		totalAZCopyObjectErrors.Inc()
+	}
+}
+
+// AZDeleteObjectCompleted updates metrics after an Azure Blob delete object request terminates
+func AZDeleteObjectCompleted(err error) {
+	if err == nil {
+		totalAZDeleteObject.Inc()
+	} else {
+		totalAZDeleteObjectErrors.Inc()
+	}
+}
+
+// AZHeadContainerCompleted updates metrics after an Azure Blob head container request terminates
+func AZHeadContainerCompleted(err error) {
+	if err == nil {
+		totalAZHeadContainer.Inc()
+	} else {
+		totalAZHeadContainerErrors.Inc()
+	}
+}
+
 // SSHCommandCompleted update metrics after an SSH command terminates
 func SSHCommandCompleted(err error) {
 	if err == nil {
@@ -496,7 +696,7 @@ func AddLoginAttempt(authMethod string) {
 	switch authMethod {
 	case "publickey":
 		totalKeyLoginAttempts.Inc()
-	case "keyboard-interactive":
+	case "keyboard-interactive", "publickey+keyboard-interactive":
 		totalInteractiveLoginAttempts.Inc()
 	default:
 		totalPasswordLoginAttempts.Inc()
@@ -510,7 +710,7 @@ func AddLoginResult(authMethod string, err error) {
 		switch authMethod {
 		case "publickey":
 			totalKeyLoginOK.Inc()
-		case "keyboard-interactive":
+		case "keyboard-interactive", "publickey+keyboard-interactive":
 			totalInteractiveLoginOK.Inc()
 		default:
 			totalPasswordLoginOK.Inc()
@@ -520,7 +720,7 @@ func AddLoginResult(authMethod string, err error) {
 		switch authMethod {
 		case "publickey":
 			totalKeyLoginFailed.Inc()
-		case "keyboard-interactive":
+		case "keyboard-interactive", "publickey+keyboard-interactive":
 			totalInteractiveLoginFailed.Inc()
 		default:
 			totalPasswordLoginFailed.Inc()
@@ -540,7 +740,16 @@ func HTTPRequestServed(status int) {
 	}
 }
 
-// UpdateActiveConnectionsSize sets the metric for active connections
-func UpdateActiveConnectionsSize(size int) {
+// UpdateActiveConnectionsSize sets the metrics for active connections,
+// connectionsByProtocol is the number of active connections per protocol
+func UpdateActiveConnectionsSize(size int, connectionsByProtocol map[string]int) {
 	activeConnections.Set(float64(size))
+	knownProtocolsMutex.Lock()
+	defer knownProtocolsMutex.Unlock()
+	for protocol := range connectionsByProtocol {
+		knownProtocols[protocol] = true
+	}
+	for protocol := range knownProtocols {
+		activeConnectionsByProtocol.WithLabelValues(protocol).Set(float64(connectionsByProtocol[protocol]))
+	}
 }
@@ -0,0 +1,316 @@
+// Package plugin allows to extend SFTPGo using external executables.
+// A plugin communicates with SFTPGo using gRPC over a loopback connection and it can
+// authenticate users, receive filesystem and user events, or encrypt and decrypt secrets.
+// Plugins can be written in any language; Go plugins can use the Serve function
+package plugin
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender = "plugin"
+)
+
+// Supported plugin types
+const (
+	TypeAuth     = "auth"
+	TypeNotifier = "notifier"
+	TypeKMS      = "kms"
+)
+
+// Supported authentication scopes, they can be combined
+const (
+	AuthScopePassword            = 1
+	AuthScopePublicKey           = 2
+	AuthScopeKeyboardInteractive = 4
+)
+
+var (
+	// Handler defines the plugins manager
+	Handler Manager
+	// ErrNoKMS is returned if a KMS operation is requested and no KMS plugin is configured
+	ErrNoKMS = errors.New("no KMS plugin configured")
+)
+
+// AuthConfig defines the options for the auth plugins
+type AuthConfig struct {
+	// Scope defines the authentication methods handled by the plugin:
+	// 1 means password, 2 public key and 4 keyboard interactive.
+	// The values can be combined, for example 3 means password and public key
+	Scope int `json:"scope" mapstructure:"scope"`
+}
+
+// NotifierConfig defines the options for the notifier plugins
+type NotifierConfig struct {
+	// Filesystem actions to notify, for example "upload", "download", "delete", "rename", "ssh_cmd"
+	FsEvents []string `json:"fs_events" mapstructure:"fs_events"`
+	// User actions to notify: "add", "update", "delete"
+	UserEvents []string `json:"user_events" mapstructure:"user_events"`
+}
+
+// Config defines a plugin configuration
+type Config struct {
+	// Plugin type: "auth", "notifier" or "kms"
+	Type string `json:"type" mapstructure:"type"`
+	// Options for the notifier plugins
+	NotifierOptions NotifierConfig `json:"notifier_options" mapstructure:"notifier_options"`
+	// Options for the auth plugins
+	AuthOptions AuthConfig `json:"auth_options" mapstructure:"auth_options"`
+	// Absolute path to the plugin executable
+	Cmd string `json:"cmd" mapstructure:"cmd"`
+	// Arguments to pass to the plugin executable
+	Args []string `json:"args" mapstructure:"args"`
+	// Optional SHA256 checksum, as hex string, for the plugin executable.
+	// If set it is verified each time the plugin is started
+	SHA256Sum string `json:"sha256sum" mapstructure:"sha256sum"`
+}
+
+func (c *Config) validate() error {
+	switch c.Type {
+	case TypeAuth:
+		if c.AuthOptions.Scope <= 0 || c.AuthOptions.Scope > 7 {
+			return fmt.Errorf("invalid auth scope %v for plugin %#v", c.AuthOptions.Scope, c.Cmd)
+		}
+	case TypeNotifier:
+		if len(c.NotifierOptions.FsEvents) == 0 && len(c.NotifierOptions.UserEvents) == 0 {
+			return fmt.Errorf("no events to notify for plugin %#v", c.Cmd)
+		}
+	case TypeKMS:
+	default:
+		return fmt.Errorf("invalid type %#v for plugin %#v", c.Type, c.Cmd)
+	}
+	if !filepath.IsAbs(c.Cmd) {
+		return fmt.Errorf("invalid plugin command %#v: it must be an absolute path", c.Cmd)
+	}
+	if len(c.SHA256Sum) > 0 && len(c.SHA256Sum) != 64 {
+		return fmt.Errorf("invalid SHA256 checksum %#v for plugin %#v", c.SHA256Sum, c.Cmd)
+	}
+	return nil
+}
+
+// Manager handles the configured plugins
+type Manager struct {
+	mutex     sync.RWMutex
+	auths     []*pluginProcess
+	notifiers []*pluginProcess
+	kms       *pluginProcess
+}
+
+// Initialize starts the given plugins. The previously started plugins, if any, are stopped
+func (m *Manager) Initialize(configs []Config) error {
+	m.Cleanup()
+
+	var auths, notifiers []*pluginProcess
+	var kms *pluginProcess
+	var started []*pluginProcess
+	for idx := range configs {
+		config := configs[idx]
+		err := config.validate()
+		if err == nil && config.Type == TypeKMS && kms != nil {
+			err = errors.New("only one KMS plugin is supported")
+		}
+		var p *pluginProcess
+		if err == nil {
+			p, err = startPlugin(config)
+		}
+		if err != nil {
+			for _, s := range started {
+				s.kill()
+			}
+			return err
+		}
+		started = append(started, p)
+		switch config.Type {
+		case TypeAuth:
+			auths = append(auths, p)
+		case TypeNotifier:
+			notifiers = append(notifiers, p)
+		case TypeKMS:
+			kms = p
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.auths = auths
+	m.notifiers = notifiers
+	m.kms = kms
+	if len(started) > 0 {
+		logger.Info(logSender, "", "plugins initialized, auth: %v, notifiers: %v, kms: %v", len(auths),
+			len(notifiers), kms != nil)
+	}
+	return nil
+}
+
+// HasAuthScope returns true if there is at least an auth plugin for the given scope
+func (m *Manager) HasAuthScope(scope int) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, p := range m.auths {
+		if p.config.AuthOptions.Scope&scope != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate asks the auth plugins for the given scope to authenticate a user.
+// The plugins are tried in order and the user, as JSON, returned by the first one
+// that accepts the credentials is returned. The user format is the same used for
+// the external authentication hook
+func (m *Manager) Authenticate(scope int, request AuthRequest) ([]byte, error) {
+	m.mutex.RLock()
+	var plugins []*pluginProcess
+	for _, p := range m.auths {
+		if p.config.AuthOptions.Scope&scope != 0 {
+			plugins = append(plugins, p)
+		}
+	}
+	m.mutex.RUnlock()
+
+	err := errors.New("no auth plugin for the requested scope")
+	for _, p := range plugins {
+		var resp AuthResponse
+		err = p.invoke(authenticateMethod, &request, &resp)
+		if err == nil {
+			return resp.User, nil
+		}
+		logger.Debug(logSender, "", "plugin %#v, authentication failed for user %#v: %v", p.config.Cmd,
+			request.Username, err)
+	}
+	return nil, err
+}
+
+// NotifyFsEvent sends the given filesystem event to the interested notifier plugins
+func (m *Manager) NotifyFsEvent(action, username, path, target, sshCmd string, fileSize int64) {
+	m.mutex.RLock()
+	var plugins []*pluginProcess
+	for _, p := range m.notifiers {
+		if utils.IsStringInSlice(action, p.config.NotifierOptions.FsEvents) {
+			plugins = append(plugins, p)
+		}
+	}
+	m.mutex.RUnlock()
+
+	if len(plugins) == 0 {
+		return
+	}
+	event := FsEvent{
+		Action:     action,
+		Username:   username,
+		Path:       path,
+		TargetPath: target,
+		SSHCmd:     sshCmd,
+		FileSize:   fileSize,
+		Timestamp:  utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	for _, p := range plugins {
+		if err := p.invoke(notifyFsEventMethod, &event, &emptyResponse{}); err != nil {
+			logger.Warn(logSender, "", "plugin %#v, unable to notify fs event %#v: %v", p.config.Cmd, action, err)
+		}
+	}
+}
+
+// HasUserEventNotifier returns true if at least a notifier plugin is interested in the given user action
+func (m *Manager) HasUserEventNotifier(action string) bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, p := range m.notifiers {
+		if utils.IsStringInSlice(action, p.config.NotifierOptions.UserEvents) {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyUserEvent sends the given user event to the interested notifier plugins.
+// user is the affected user as JSON, the sensitive data must be already removed
+func (m *Manager) NotifyUserEvent(action, username string, user []byte) {
+	m.mutex.RLock()
+	var plugins []*pluginProcess
+	for _, p := range m.notifiers {
+		if utils.IsStringInSlice(action, p.config.NotifierOptions.UserEvents) {
+			plugins = append(plugins, p)
+		}
+	}
+	m.mutex.RUnlock()
+
+	if len(plugins) == 0 {
+		return
+	}
+	event := UserEvent{
+		Action:    action,
+		Username:  username,
+		User:      user,
+		Timestamp: utils.GetTimeAsMsSinceEpoch(time.Now()),
+	}
+	for _, p := range plugins {
+		if err := p.invoke(notifyUserEventMethod, &event, &emptyResponse{}); err != nil {
+			logger.Warn(logSender, "", "plugin %#v, unable to notify user event %#v: %v", p.config.Cmd, action, err)
+		}
+	}
+}
+
+// HasKMS returns true if a KMS plugin is configured
+func (m *Manager) HasKMS() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	return m.kms != nil
+}
+
+// KMSEncrypt encrypts the given payload using the KMS plugin
+func (m *Manager) KMSEncrypt(payload, additionalData string) (string, error) {
+	return m.kmsInvoke(kmsEncryptMethod, payload, additionalData)
+}
+
+// KMSDecrypt decrypts the given payload using the KMS plugin
+func (m *Manager) KMSDecrypt(payload, additionalData string) (string, error) {
+	return m.kmsInvoke(kmsDecryptMethod, payload, additionalData)
+}
+
+func (m *Manager) kmsInvoke(method, payload, additionalData string) (string, error) {
+	m.mutex.RLock()
+	kms := m.kms
+	m.mutex.RUnlock()
+
+	if kms == nil {
+		return "", ErrNoKMS
+	}
+	var resp KMSResponse
+	err := kms.invoke(method, &KMSRequest{
+		Payload:        payload,
+		AdditionalData: additionalData,
+	}, &resp)
+	return resp.Payload, err
+}
+
+// Cleanup stops all the plugins
+func (m *Manager) Cleanup() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for _, p := range m.auths {
+		p.kill()
+	}
+	for _, p := range m.notifiers {
+		p.kill()
+	}
+	if m.kms != nil {
+		m.kms.kill()
+	}
+	m.auths = nil
+	m.notifiers = nil
+	m.kms = nil
+}
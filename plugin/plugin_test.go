@@ -0,0 +1,229 @@
+package plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPlugin implements all the plugin interfaces, the test binary runs it if started as a plugin
+type testPlugin struct {
+	eventsFile string
+}
+
+func (p *testPlugin) Authenticate(request *AuthRequest) (*AuthResponse, error) {
+	if request.Password != "password" {
+		return nil, errors.New("invalid credentials")
+	}
+	user, err := json.Marshal(map[string]interface{}{
+		"username":    request.Username,
+		"home_dir":    filepath.Join(os.TempDir(), request.Username),
+		"permissions": map[string][]string{"/": {"*"}},
+	})
+	return &AuthResponse{User: user}, err
+}
+
+func (p *testPlugin) NotifyFsEvent(event *FsEvent) error {
+	return p.writeEvent(fmt.Sprintf("fs %v %v %v", event.Action, event.Username, event.Path))
+}
+
+func (p *testPlugin) NotifyUserEvent(event *UserEvent) error {
+	return p.writeEvent(fmt.Sprintf("user %v %v", event.Action, event.Username))
+}
+
+func (p *testPlugin) writeEvent(event string) error {
+	f, err := os.OpenFile(p.eventsFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, event)
+	return err
+}
+
+func (p *testPlugin) Encrypt(request *KMSRequest) (*KMSResponse, error) {
+	return &KMSResponse{Payload: "enc:" + request.AdditionalData + ":" + request.Payload}, nil
+}
+
+func (p *testPlugin) Decrypt(request *KMSRequest) (*KMSResponse, error) {
+	prefix := "enc:" + request.AdditionalData + ":"
+	if !strings.HasPrefix(request.Payload, prefix) {
+		return nil, errors.New("unable to decrypt")
+	}
+	return &KMSResponse{Payload: strings.TrimPrefix(request.Payload, prefix)}, nil
+}
+
+func TestMain(m *testing.M) {
+	if os.Getenv(magicCookieKey) == magicCookieValue {
+		if err := Serve(&testPlugin{eventsFile: os.Args[1]}); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func getTestPluginCmd(t *testing.T) (string, string) {
+	cmd, err := os.Executable()
+	if err != nil {
+		t.Fatalf("unable to get the test executable: %v", err)
+	}
+	f, err := os.Open(cmd)
+	if err != nil {
+		t.Fatalf("unable to open the test executable: %v", err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		t.Fatalf("unable to hash the test executable: %v", err)
+	}
+	return cmd, hex.EncodeToString(h.Sum(nil))
+}
+
+func TestInvalidConfig(t *testing.T) {
+	cmd, sum := getTestPluginCmd(t)
+	eventsFile := filepath.Join(os.TempDir(), "plugin_events")
+	invalidConfigs := [][]Config{
+		{{Type: "unknown", Cmd: cmd}},
+		{{Type: TypeKMS, Cmd: "relative/path"}},
+		{{Type: TypeAuth, Cmd: cmd}},
+		{{Type: TypeAuth, Cmd: cmd, AuthOptions: AuthConfig{Scope: 8}}},
+		{{Type: TypeNotifier, Cmd: cmd}},
+		{{Type: TypeKMS, Cmd: cmd, SHA256Sum: "invalid"}},
+		{{Type: TypeKMS, Cmd: cmd, Args: []string{eventsFile}, SHA256Sum: strings.Repeat("a", 64)}},
+		{{Type: TypeKMS, Cmd: cmd, Args: []string{eventsFile}, SHA256Sum: sum}, {Type: TypeKMS, Cmd: cmd}},
+		{{Type: TypeKMS, Cmd: filepath.Join(os.TempDir(), "missing_plugin")}},
+	}
+	for _, configs := range invalidConfigs {
+		if err := Handler.Initialize(configs); err == nil {
+			t.Errorf("plugins configuration must be invalid: %+v", configs)
+		}
+		if Handler.HasKMS() {
+			t.Errorf("no plugin must be started for configuration: %+v", configs)
+		}
+	}
+	if err := Serve(&testPlugin{}); err == nil {
+		t.Error("a plugin not started by SFTPGo must fail")
+	}
+	if _, err := parseHandshake("2|tcp|127.0.0.1:1234|grpc"); err == nil {
+		t.Error("unsupported protocol version must fail")
+	}
+	if _, err := parseHandshake("1|unix|/tmp/socket|grpc"); err == nil {
+		t.Error("unsupported network must fail")
+	}
+}
+
+func TestPlugins(t *testing.T) {
+	cmd, sum := getTestPluginCmd(t)
+	eventsFile := filepath.Join(os.TempDir(), "plugin_events")
+	os.Remove(eventsFile)
+	err := Handler.Initialize([]Config{
+		{
+			Type:        TypeAuth,
+			AuthOptions: AuthConfig{Scope: AuthScopePassword},
+			Cmd:         cmd,
+			Args:        []string{eventsFile},
+			SHA256Sum:   sum,
+		},
+		{
+			Type: TypeNotifier,
+			NotifierOptions: NotifierConfig{
+				FsEvents:   []string{"upload"},
+				UserEvents: []string{"add"},
+			},
+			Cmd:  cmd,
+			Args: []string{eventsFile},
+		},
+		{
+			Type: TypeKMS,
+			Cmd:  cmd,
+			Args: []string{eventsFile},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to initialize plugins: %v", err)
+	}
+	defer Handler.Cleanup()
+
+	if !Handler.HasAuthScope(AuthScopePassword) {
+		t.Error("the password scope must be handled by the auth plugin")
+	}
+	if Handler.HasAuthScope(AuthScopePublicKey | AuthScopeKeyboardInteractive) {
+		t.Error("the public key and keyboard interactive scopes must not be handled")
+	}
+	out, err := Handler.Authenticate(AuthScopePassword, AuthRequest{Username: "user", Password: "password"})
+	if err != nil {
+		t.Errorf("authentication must succeed: %v", err)
+	} else {
+		var user map[string]interface{}
+		if err = json.Unmarshal(out, &user); err != nil || user["username"] != "user" {
+			t.Errorf("unexpected auth response %v, err: %v", string(out), err)
+		}
+	}
+	_, err = Handler.Authenticate(AuthScopePassword, AuthRequest{Username: "user", Password: "wrong"})
+	if err == nil || !strings.Contains(err.Error(), "invalid credentials") {
+		t.Errorf("authentication with invalid credentials must fail, err: %v", err)
+	}
+	_, err = Handler.Authenticate(AuthScopePublicKey, AuthRequest{Username: "user", PublicKey: "key"})
+	if err == nil {
+		t.Error("authentication without a plugin for the scope must fail")
+	}
+
+	Handler.NotifyFsEvent("upload", "user", "/file", "", "", 10)
+	Handler.NotifyFsEvent("download", "user", "/file", "", "", 10)
+	if Handler.HasUserEventNotifier("update") || !Handler.HasUserEventNotifier("add") {
+		t.Error("unexpected user event notifiers")
+	}
+	Handler.NotifyUserEvent("add", "user", []byte(`{"username":"user"}`))
+	Handler.NotifyUserEvent("delete", "user", []byte(`{"username":"user"}`))
+	events, err := ioutil.ReadFile(eventsFile)
+	if err != nil {
+		t.Errorf("unable to read the notified events: %v", err)
+	} else if string(events) != "fs upload user /file\nuser add user\n" {
+		t.Errorf("unexpected notified events: %#v", string(events))
+	}
+
+	if !Handler.HasKMS() {
+		t.Error("the KMS plugin must be available")
+	}
+	encrypted, err := Handler.KMSEncrypt("secret", "data")
+	if err != nil || encrypted != "enc:data:secret" {
+		t.Errorf("unexpected encrypted payload %#v, err: %v", encrypted, err)
+	}
+	decrypted, err := Handler.KMSDecrypt(encrypted, "data")
+	if err != nil || decrypted != "secret" {
+		t.Errorf("unexpected decrypted payload %#v, err: %v", decrypted, err)
+	}
+	if _, err = Handler.KMSDecrypt(encrypted, "other data"); err == nil {
+		t.Error("decrypt with different additional data must fail")
+	}
+
+	// a plugin that exits is restarted on the next call
+	kms := Handler.kms
+	kms.mutex.Lock()
+	kms.cmd.Process.Kill()
+	exited := kms.exited
+	kms.mutex.Unlock()
+	<-exited
+	decrypted, err = Handler.KMSDecrypt(encrypted, "data")
+	if err != nil || decrypted != "secret" {
+		t.Errorf("the KMS plugin must be restarted, decrypted payload %#v, err: %v", decrypted, err)
+	}
+
+	Handler.Cleanup()
+	if Handler.HasKMS() || Handler.HasAuthScope(AuthScopePassword) {
+		t.Error("the plugins must be stopped")
+	}
+	if _, err = Handler.KMSEncrypt("secret", ""); err != ErrNoKMS {
+		t.Errorf("unexpected error without a KMS plugin: %v", err)
+	}
+	os.Remove(eventsFile)
+}
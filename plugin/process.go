@@ -0,0 +1,216 @@
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	startTimeout = 10 * time.Second
+	callTimeout  = 30 * time.Second
+)
+
+// pluginProcess handles a running plugin. If the plugin exits it is restarted on the next call
+type pluginProcess struct {
+	config Config
+	mutex  sync.Mutex
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	conn   *grpc.ClientConn
+	// closed when the plugin process exits
+	exited chan struct{}
+}
+
+func startPlugin(config Config) (*pluginProcess, error) {
+	p := &pluginProcess{
+		config: config,
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// start starts the plugin process and connects to it, the mutex must be held by the caller
+// or the process must not be shared yet
+func (p *pluginProcess) start() error {
+	if err := p.checkSum(); err != nil {
+		return err
+	}
+	handshake := make(chan string, 1)
+	cmd := exec.Command(p.config.Cmd, p.config.Args...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("%v=%v", magicCookieKey, magicCookieValue))
+	cmd.Stdout = &outputWriter{cmd: p.config.Cmd, handshake: handshake}
+	cmd.Stderr = &outputWriter{cmd: p.config.Cmd}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("unable to start plugin %#v: %v", p.config.Cmd, err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		err := cmd.Wait()
+		logger.Debug(logSender, "", "plugin %#v exited, error: %v", p.config.Cmd, err)
+		close(exited)
+	}()
+
+	var addr string
+	select {
+	case line := <-handshake:
+		addr, err = parseHandshake(line)
+	case <-exited:
+		err = fmt.Errorf("plugin %#v exited before the handshake", p.config.Cmd)
+	case <-time.After(startTimeout):
+		err = fmt.Errorf("timeout waiting for the handshake from plugin %#v", p.config.Cmd)
+	}
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), startTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, addr, grpc.WithInsecure(), grpc.WithBlock(),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(codecName)))
+	if err != nil {
+		stdin.Close()
+		cmd.Process.Kill()
+		return fmt.Errorf("unable to connect to plugin %#v: %v", p.config.Cmd, err)
+	}
+	p.cmd = cmd
+	p.stdin = stdin
+	p.conn = conn
+	p.exited = exited
+	logger.Debug(logSender, "", "plugin %#v started, pid: %v, address: %v", p.config.Cmd, cmd.Process.Pid, addr)
+	return nil
+}
+
+func (p *pluginProcess) checkSum() error {
+	if len(p.config.SHA256Sum) == 0 {
+		return nil
+	}
+	f, err := os.Open(p.config.Cmd)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(sum, p.config.SHA256Sum) {
+		return fmt.Errorf("invalid checksum for plugin %#v: got %v, expected %v", p.config.Cmd, sum,
+			p.config.SHA256Sum)
+	}
+	return nil
+}
+
+// getConn returns the connection to the plugin, the plugin is restarted if it exited
+func (p *pluginProcess) getConn() (*grpc.ClientConn, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.conn != nil {
+		select {
+		case <-p.exited:
+			logger.Warn(logSender, "", "plugin %#v is not running, restarting", p.config.Cmd)
+			p.conn.Close()
+			p.stdin.Close()
+			p.conn = nil
+		default:
+			return p.conn, nil
+		}
+	}
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+	return p.conn, nil
+}
+
+func (p *pluginProcess) invoke(method string, req, resp interface{}) error {
+	conn, err := p.getConn()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+	defer cancel()
+	if err = conn.Invoke(ctx, method, req, resp); err != nil {
+		return fmt.Errorf("plugin %#v error: %v", p.config.Cmd, status.Convert(err).Message())
+	}
+	return nil
+}
+
+func (p *pluginProcess) kill() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.conn == nil {
+		return
+	}
+	p.conn.Close()
+	p.stdin.Close()
+	select {
+	case <-p.exited:
+	case <-time.After(2 * time.Second):
+		p.cmd.Process.Kill()
+		<-p.exited
+	}
+	p.conn = nil
+	logger.Debug(logSender, "", "plugin %#v stopped", p.config.Cmd)
+}
+
+// parseHandshake parses a handshake line with the format "<protocol version>|tcp|<address>|grpc"
+// and returns the address to connect to
+func parseHandshake(line string) (string, error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 4 || parts[1] != "tcp" || parts[3] != "grpc" {
+		return "", fmt.Errorf("invalid plugin handshake %#v", line)
+	}
+	if parts[0] != fmt.Sprintf("%v", protocolVersion) {
+		return "", fmt.Errorf("unsupported plugin protocol version %#v", parts[0])
+	}
+	return parts[2], nil
+}
+
+// outputWriter logs the plugin output line by line. If handshake is not nil the
+// first line is sent to it
+type outputWriter struct {
+	cmd       string
+	handshake chan string
+	buf       bytes.Buffer
+	done      bool
+}
+
+func (w *outputWriter) Write(data []byte) (int, error) {
+	w.buf.Write(data)
+	for {
+		idx := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := string(w.buf.Next(idx + 1))
+		if w.handshake != nil && !w.done {
+			w.done = true
+			w.handshake <- line
+			continue
+		}
+		logger.Debug(logSender, "", "plugin %#v output: %v", w.cmd, strings.TrimSpace(line))
+	}
+	return len(data), nil
+}
@@ -0,0 +1,238 @@
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	// the messages are serialized as JSON so no code generation is needed for the plugins
+	codecName             = "json"
+	magicCookieKey        = "SFTPGO_PLUGIN_MAGIC_COOKIE"
+	magicCookieValue      = "a0c5c1f4e30b6f7bb0a3de0ae3a35fccb58437527fc95c4c5ac8b4bcd0c8ca3f"
+	protocolVersion       = 1
+	authServiceName       = "sftpgo.plugin.Auth"
+	notifierServiceName   = "sftpgo.plugin.Notifier"
+	kmsServiceName        = "sftpgo.plugin.KMS"
+	authenticateMethod    = "/" + authServiceName + "/Authenticate"
+	notifyFsEventMethod   = "/" + notifierServiceName + "/NotifyFsEvent"
+	notifyUserEventMethod = "/" + notifierServiceName + "/NotifyUserEvent"
+	kmsEncryptMethod      = "/" + kmsServiceName + "/Encrypt"
+	kmsDecryptMethod      = "/" + kmsServiceName + "/Decrypt"
+)
+
+// AuthRequest defines an authentication request.
+// Password, PublicKey and KeyboardInteractive are mutually exclusive
+type AuthRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+	Password string `json:"password,omitempty"`
+	// public key in authorized keys format
+	PublicKey string `json:"public_key,omitempty"`
+	// true for a keyboard interactive authentication, the plugin accepts or rejects the user,
+	// the interaction with the client is handled by SFTPGo as for the external auth hook
+	KeyboardInteractive bool `json:"keyboard_interactive,omitempty"`
+}
+
+// AuthResponse defines the response for an authentication request
+type AuthResponse struct {
+	// the authenticated user as JSON, an empty username means invalid credentials
+	User json.RawMessage `json:"user"`
+}
+
+// FsEvent defines a filesystem event
+type FsEvent struct {
+	Action     string `json:"action"`
+	Username   string `json:"username"`
+	Path       string `json:"path"`
+	TargetPath string `json:"target_path,omitempty"`
+	SSHCmd     string `json:"ssh_cmd,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	// unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// UserEvent defines an event for a user added, updated or deleted
+type UserEvent struct {
+	Action   string `json:"action"`
+	Username string `json:"username"`
+	// the user as JSON, without the sensitive data
+	User json.RawMessage `json:"user"`
+	// unix timestamp in milliseconds
+	Timestamp int64 `json:"timestamp"`
+}
+
+// KMSRequest defines an encryption or decryption request
+type KMSRequest struct {
+	Payload string `json:"payload"`
+	// optional data to authenticate, the same data used to encrypt is required to decrypt
+	AdditionalData string `json:"additional_data,omitempty"`
+}
+
+// KMSResponse defines the response for an encryption or decryption request
+type KMSResponse struct {
+	Payload string `json:"payload"`
+}
+
+type emptyResponse struct{}
+
+// Authenticator defines the interface to implement for the auth plugins
+type Authenticator interface {
+	Authenticate(request *AuthRequest) (*AuthResponse, error)
+}
+
+// Notifier defines the interface to implement for the notifier plugins
+type Notifier interface {
+	NotifyFsEvent(event *FsEvent) error
+	NotifyUserEvent(event *UserEvent) error
+}
+
+// KMS defines the interface to implement for the KMS plugins
+type KMS interface {
+	Encrypt(request *KMSRequest) (*KMSResponse, error)
+	Decrypt(request *KMSRequest) (*KMSResponse, error)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return codecName
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
+
+func unaryHandler(newRequest func() interface{}, call func(srv, req interface{}) (interface{}, error), method string) func(
+	interface{}, context.Context, func(interface{}) error, grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+		interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := newRequest()
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		if interceptor == nil {
+			return call(srv, req)
+		}
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: method,
+		}
+		return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv, req)
+		})
+	}
+}
+
+var authServiceDesc = grpc.ServiceDesc{
+	ServiceName: authServiceName,
+	HandlerType: (*Authenticator)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Authenticate",
+			Handler: unaryHandler(func() interface{} { return new(AuthRequest) },
+				func(srv, req interface{}) (interface{}, error) {
+					return srv.(Authenticator).Authenticate(req.(*AuthRequest))
+				}, authenticateMethod),
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+var notifierServiceDesc = grpc.ServiceDesc{
+	ServiceName: notifierServiceName,
+	HandlerType: (*Notifier)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "NotifyFsEvent",
+			Handler: unaryHandler(func() interface{} { return new(FsEvent) },
+				func(srv, req interface{}) (interface{}, error) {
+					return &emptyResponse{}, srv.(Notifier).NotifyFsEvent(req.(*FsEvent))
+				}, notifyFsEventMethod),
+		},
+		{
+			MethodName: "NotifyUserEvent",
+			Handler: unaryHandler(func() interface{} { return new(UserEvent) },
+				func(srv, req interface{}) (interface{}, error) {
+					return &emptyResponse{}, srv.(Notifier).NotifyUserEvent(req.(*UserEvent))
+				}, notifyUserEventMethod),
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+var kmsServiceDesc = grpc.ServiceDesc{
+	ServiceName: kmsServiceName,
+	HandlerType: (*KMS)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Encrypt",
+			Handler: unaryHandler(func() interface{} { return new(KMSRequest) },
+				func(srv, req interface{}) (interface{}, error) {
+					return srv.(KMS).Encrypt(req.(*KMSRequest))
+				}, kmsEncryptMethod),
+		},
+		{
+			MethodName: "Decrypt",
+			Handler: unaryHandler(func() interface{} { return new(KMSRequest) },
+				func(srv, req interface{}) (interface{}, error) {
+					return srv.(KMS).Decrypt(req.(*KMSRequest))
+				}, kmsDecryptMethod),
+		},
+	},
+	Streams: []grpc.StreamDesc{},
+}
+
+// Serve runs the given plugin implementation, it must be called from the main function
+// of the plugin executable and it blocks until SFTPGo stops the plugin or exits.
+// impl must implement Authenticator, Notifier or KMS based on the plugin type
+func Serve(impl interface{}) error {
+	if os.Getenv(magicCookieKey) != magicCookieValue {
+		return errors.New("this executable is an SFTPGo plugin, it must be started by SFTPGo")
+	}
+	server := grpc.NewServer()
+	registered := false
+	if a, ok := impl.(Authenticator); ok {
+		server.RegisterService(&authServiceDesc, a)
+		registered = true
+	}
+	if n, ok := impl.(Notifier); ok {
+		server.RegisterService(&notifierServiceDesc, n)
+		registered = true
+	}
+	if k, ok := impl.(KMS); ok {
+		server.RegisterService(&kmsServiceDesc, k)
+		registered = true
+	}
+	if !registered {
+		return errors.New("the plugin must implement Authenticator, Notifier or KMS")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	// SFTPGo keeps our stdin open, we stop if it is closed, for example if SFTPGo crashes
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		server.Stop()
+	}()
+	fmt.Printf("%v|tcp|%v|grpc\n", protocolVersion, listener.Addr().String())
+	return server.Serve(listener)
+}
@@ -0,0 +1,178 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+var loginDelays *loginDelayer
+
+// LoginDelay defines an artificial delay before replying to the failed password authentications.
+// The delay doubles for each consecutive failure from the same source IP or for the same username,
+// up to the configured maximum, so brute force tools are slowed down without locking out the users
+type LoginDelay struct {
+	// Delay, as milliseconds, after the first failure. 0 means disabled
+	Initial int `json:"initial" mapstructure:"initial"`
+	// Maximum delay as milliseconds
+	Max int `json:"max" mapstructure:"max"`
+	// The failures for a source IP or a username are forgotten after this number
+	// of minutes without new failures
+	ResetTime int `json:"reset_time" mapstructure:"reset_time"`
+}
+
+func (d LoginDelay) isEnabled() bool {
+	return d.Initial > 0
+}
+
+func (d LoginDelay) validate() error {
+	if d.Initial < 0 || d.Max < 0 || d.ResetTime < 0 {
+		return fmt.Errorf("invalid login_delay, initial: %v max: %v reset_time: %v", d.Initial, d.Max, d.ResetTime)
+	}
+	if !d.isEnabled() {
+		return nil
+	}
+	if d.Max < d.Initial {
+		return fmt.Errorf("invalid login_delay max %v must be >= %v", d.Max, d.Initial)
+	}
+	if d.ResetTime == 0 {
+		return fmt.Errorf("invalid login_delay reset_time %v", d.ResetTime)
+	}
+	return nil
+}
+
+// DelayLoginFailure records a failed password authentication for the given source IP and
+// username and waits for the resulting delay before returning
+func DelayLoginFailure(ip, username string) {
+	if loginDelays == nil {
+		return
+	}
+	delay := loginDelays.addFailure(ip, username, time.Now())
+	logger.Debug(logSender, "", "delaying failed login from ip %#v for user %#v by %v", ip, username, delay)
+	time.Sleep(delay)
+}
+
+// ResetLoginFailures forgets the failures recorded for the given username, it must be called after a
+// successful login. The failures for the source IP are preserved, otherwise anyone with valid
+// credentials could reset them between the guessing attempts for other users
+func ResetLoginFailures(username string) {
+	if loginDelays == nil {
+		return
+	}
+	loginDelays.reset(username)
+}
+
+type failureEntry struct {
+	count       int
+	lastFailure time.Time
+}
+
+type loginDelayer struct {
+	sync.Mutex
+	config    LoginDelay
+	failures  map[string]*failureEntry
+	softLimit int
+	hardLimit int
+}
+
+func newLoginDelayer(config LoginDelay, softLimit, hardLimit int) *loginDelayer {
+	if !config.isEnabled() {
+		return nil
+	}
+	return &loginDelayer{
+		config:    config,
+		failures:  make(map[string]*failureEntry),
+		softLimit: softLimit,
+		hardLimit: hardLimit,
+	}
+}
+
+func (d *loginDelayer) addFailure(ip, username string, now time.Time) time.Duration {
+	d.Lock()
+	defer d.Unlock()
+
+	count := d.addFailureForKey(getIPKey(ip), now)
+	if username != "" {
+		if userCount := d.addFailureForKey(getUsernameKey(username), now); userCount > count {
+			count = userCount
+		}
+	}
+	return d.getDelay(count)
+}
+
+// addFailureForKey returns the number of consecutive failures for the given key,
+// the caller must hold the lock
+func (d *loginDelayer) addFailureForKey(key string, now time.Time) int {
+	entry, ok := d.failures[key]
+	if !ok || d.isExpired(entry, now) {
+		if !ok {
+			d.cleanup(now)
+		}
+		entry = &failureEntry{}
+		d.failures[key] = entry
+	}
+	entry.count++
+	entry.lastFailure = now
+	return entry.count
+}
+
+func (d *loginDelayer) reset(username string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.failures, getUsernameKey(username))
+}
+
+func (d *loginDelayer) getDelay(count int) time.Duration {
+	delay := d.config.Initial
+	for i := 1; i < count && delay < d.config.Max; i++ {
+		delay *= 2
+	}
+	if delay > d.config.Max {
+		delay = d.config.Max
+	}
+	return time.Duration(delay) * time.Millisecond
+}
+
+func (d *loginDelayer) isExpired(entry *failureEntry, now time.Time) bool {
+	return now.Sub(entry.lastFailure) > time.Duration(d.config.ResetTime)*time.Minute
+}
+
+// cleanup removes the expired entries and, if the hard limit is still exceeded,
+// the least recently updated ones. The caller must hold the lock
+func (d *loginDelayer) cleanup(now time.Time) {
+	if len(d.failures) < d.hardLimit {
+		return
+	}
+	entries := make(bucketList, 0, len(d.failures))
+	for key, entry := range d.failures {
+		if d.isExpired(entry, now) {
+			delete(d.failures, key)
+		} else {
+			entries = append(entries, bucketEntry{key: key, lastUsed: entry.lastFailure})
+		}
+	}
+	// leave room for the new entry
+	numToRemove := len(d.failures) - d.softLimit + 1
+	if numToRemove <= 0 {
+		return
+	}
+	sort.Sort(entries)
+	for idx, entry := range entries {
+		if idx >= numToRemove {
+			break
+		}
+		delete(d.failures, entry.key)
+	}
+}
+
+func getIPKey(ip string) string {
+	return "ip:" + ip
+}
+
+func getUsernameKey(username string) string {
+	return "user:" + username
+}
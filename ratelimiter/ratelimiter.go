@@ -0,0 +1,258 @@
+// Package ratelimiter implements token bucket rate limiters for new connections
+// and authentication attempts, both globally and per source IP
+package ratelimiter
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const logSender = "ratelimiter"
+
+var (
+	connections  *limiter
+	authAttempts *limiter
+)
+
+// Limit defines the average rate, events per second, and the burst size for a token bucket.
+// An average of 0 means no limit
+type Limit struct {
+	// Average number of allowed events per second
+	Average float64 `json:"average" mapstructure:"average"`
+	// Maximum number of events allowed at once, if 0 the burst is equal to the average
+	Burst int `json:"burst" mapstructure:"burst"`
+}
+
+func (l Limit) isEnabled() bool {
+	return l.Average > 0
+}
+
+func (l Limit) getBurst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	if l.Average < 1 {
+		return 1
+	}
+	return l.Average
+}
+
+// Config defines the rate limiters configuration
+type Config struct {
+	// Limit for the new connections accepted by the server, regardless of the source IP
+	Connections Limit `json:"connections" mapstructure:"connections"`
+	// Limit for the new connections from the same source IP
+	ConnectionsPerIP Limit `json:"connections_per_ip" mapstructure:"connections_per_ip"`
+	// Limit for the authentication attempts, regardless of the source IP
+	AuthAttempts Limit `json:"auth_attempts" mapstructure:"auth_attempts"`
+	// Limit for the authentication attempts from the same source IP
+	AuthAttemptsPerIP Limit `json:"auth_attempts_per_ip" mapstructure:"auth_attempts_per_ip"`
+	// The number of per IP token buckets kept in memory will vary between the
+	// soft and hard limit
+	EntriesSoftLimit int `json:"entries_soft_limit" mapstructure:"entries_soft_limit"`
+	EntriesHardLimit int `json:"entries_hard_limit" mapstructure:"entries_hard_limit"`
+	// Increasing delay for the failed password authentications
+	LoginDelay LoginDelay `json:"login_delay" mapstructure:"login_delay"`
+}
+
+func (c *Config) validate() error {
+	for name, l := range map[string]Limit{
+		"connections":          c.Connections,
+		"connections_per_ip":   c.ConnectionsPerIP,
+		"auth_attempts":        c.AuthAttempts,
+		"auth_attempts_per_ip": c.AuthAttemptsPerIP,
+	} {
+		if l.Average < 0 || l.Burst < 0 {
+			return fmt.Errorf("invalid %v limit, average: %v burst: %v", name, l.Average, l.Burst)
+		}
+	}
+	if err := c.LoginDelay.validate(); err != nil {
+		return err
+	}
+	if c.ConnectionsPerIP.isEnabled() || c.AuthAttemptsPerIP.isEnabled() || c.LoginDelay.isEnabled() {
+		if c.EntriesSoftLimit <= 0 {
+			return fmt.Errorf("invalid entries_soft_limit %v", c.EntriesSoftLimit)
+		}
+		if c.EntriesHardLimit <= c.EntriesSoftLimit {
+			return fmt.Errorf("invalid entries_hard_limit %v must be > %v", c.EntriesHardLimit, c.EntriesSoftLimit)
+		}
+	}
+	return nil
+}
+
+// Initialize configures the rate limiters, the limits with an average of 0 are disabled
+func Initialize(config Config) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+	connections = newLimiter(config.Connections, config.ConnectionsPerIP, config.EntriesSoftLimit,
+		config.EntriesHardLimit)
+	authAttempts = newLimiter(config.AuthAttempts, config.AuthAttemptsPerIP, config.EntriesSoftLimit,
+		config.EntriesHardLimit)
+	loginDelays = newLoginDelayer(config.LoginDelay, config.EntriesSoftLimit, config.EntriesHardLimit)
+	logger.Debug(logSender, "", "rate limiters initialized with config %+v", config)
+	return nil
+}
+
+// AllowConnection returns false if a new connection from the given IP exceeds the configured limits
+func AllowConnection(ip string) bool {
+	if connections == nil {
+		return true
+	}
+	if !connections.allow(ip) {
+		logger.Debug(logSender, "", "connection from ip %#v rejected, rate limit exceeded", ip)
+		return false
+	}
+	return true
+}
+
+// AllowAuthAttempt returns false if a new authentication attempt from the given IP exceeds
+// the configured limits
+func AllowAuthAttempt(ip string) bool {
+	if authAttempts == nil {
+		return true
+	}
+	if !authAttempts.allow(ip) {
+		logger.Debug(logSender, "", "authentication attempt from ip %#v rejected, rate limit exceeded", ip)
+		return false
+	}
+	return true
+}
+
+// tokenBucket is refilled at rate tokens per second up to burst tokens.
+// Each allowed event consumes a token
+type tokenBucket struct {
+	rate       float64
+	burst      float64
+	tokens     float64
+	lastUpdate time.Time
+	lastUsed   time.Time
+}
+
+func newTokenBucket(l Limit, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:       l.Average,
+		burst:      l.getBurst(),
+		tokens:     l.getBurst(),
+		lastUpdate: now,
+		lastUsed:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.lastUpdate).Seconds()
+	if elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.lastUpdate = now
+}
+
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	b.lastUsed = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isFull returns true if the bucket has been refilled, it can be removed
+// without changing the limiter behavior
+func (b *tokenBucket) isFull(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+type limiter struct {
+	sync.Mutex
+	global     *tokenBucket
+	perIPLimit Limit
+	perIP      map[string]*tokenBucket
+	softLimit  int
+	hardLimit  int
+}
+
+func newLimiter(global, perIP Limit, softLimit, hardLimit int) *limiter {
+	if !global.isEnabled() && !perIP.isEnabled() {
+		return nil
+	}
+	l := &limiter{
+		perIPLimit: perIP,
+		perIP:      make(map[string]*tokenBucket),
+		softLimit:  softLimit,
+		hardLimit:  hardLimit,
+	}
+	if global.isEnabled() {
+		l.global = newTokenBucket(global, time.Now())
+	}
+	return l
+}
+
+func (l *limiter) allow(ip string) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if l.perIPLimit.isEnabled() {
+		bucket, ok := l.perIP[ip]
+		if !ok {
+			l.cleanup(now)
+			bucket = newTokenBucket(l.perIPLimit, now)
+			l.perIP[ip] = bucket
+		}
+		if !bucket.allow(now) {
+			return false
+		}
+	}
+	if l.global != nil {
+		return l.global.allow(now)
+	}
+	return true
+}
+
+// cleanup removes the full buckets and, if the hard limit is still exceeded,
+// the least recently used ones. The caller must hold the lock
+func (l *limiter) cleanup(now time.Time) {
+	if len(l.perIP) < l.hardLimit {
+		return
+	}
+	buckets := make(bucketList, 0, len(l.perIP))
+	for ip, bucket := range l.perIP {
+		if bucket.isFull(now) {
+			delete(l.perIP, ip)
+		} else {
+			buckets = append(buckets, bucketEntry{key: ip, lastUsed: bucket.lastUsed})
+		}
+	}
+	// leave room for the new bucket
+	numToRemove := len(l.perIP) - l.softLimit + 1
+	if numToRemove <= 0 {
+		return
+	}
+	sort.Sort(buckets)
+	for idx, entry := range buckets {
+		if idx >= numToRemove {
+			break
+		}
+		delete(l.perIP, entry.key)
+	}
+}
+
+type bucketEntry struct {
+	key      string
+	lastUsed time.Time
+}
+
+type bucketList []bucketEntry
+
+func (p bucketList) Len() int           { return len(p) }
+func (p bucketList) Less(i, j int) bool { return p[i].lastUsed.Before(p[j].lastUsed) }
+func (p bucketList) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
@@ -0,0 +1,240 @@
+package ratelimiter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestInvalidConfig(t *testing.T) {
+	config := Config{
+		Connections: Limit{Average: -1},
+	}
+	if err := Initialize(config); err == nil {
+		t.Error("negative average must fail")
+	}
+	config = Config{
+		AuthAttempts: Limit{Average: 1, Burst: -1},
+	}
+	if err := Initialize(config); err == nil {
+		t.Error("negative burst must fail")
+	}
+	config = Config{
+		ConnectionsPerIP: Limit{Average: 1},
+		EntriesSoftLimit: 0,
+		EntriesHardLimit: 10,
+	}
+	if err := Initialize(config); err == nil {
+		t.Error("invalid entries_soft_limit must fail")
+	}
+	config.EntriesSoftLimit = 10
+	if err := Initialize(config); err == nil {
+		t.Error("invalid entries_hard_limit must fail")
+	}
+	// the entries limits are not required without per IP limits
+	config = Config{
+		Connections: Limit{Average: 1},
+	}
+	if err := Initialize(config); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := Initialize(Config{}); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if connections != nil || authAttempts != nil {
+		t.Error("disabled limiters must be nil")
+	}
+	for i := 0; i < 100; i++ {
+		if !AllowConnection("127.0.0.1") || !AllowAuthAttempt("127.0.0.1") {
+			t.Fatal("disabled limiters must allow all the events")
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	config := Config{
+		Connections:       Limit{Average: 1, Burst: 5},
+		AuthAttemptsPerIP: Limit{Average: 1, Burst: 2},
+		EntriesSoftLimit:  5,
+		EntriesHardLimit:  10,
+	}
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize rate limiters: %v", err)
+	}
+	defer Initialize(Config{})
+
+	for i := 0; i < 5; i++ {
+		if !AllowConnection(fmt.Sprintf("127.0.0.%v", i)) {
+			t.Errorf("connection %v must be allowed", i)
+		}
+	}
+	if AllowConnection("127.0.1.1") {
+		t.Error("the global connections limit is exceeded")
+	}
+	for i := 0; i < 2; i++ {
+		if !AllowAuthAttempt("127.0.0.1") {
+			t.Errorf("auth attempt %v must be allowed", i)
+		}
+	}
+	if AllowAuthAttempt("127.0.0.1") {
+		t.Error("the per IP auth attempts limit is exceeded")
+	}
+	if !AllowAuthAttempt("127.0.0.2") {
+		t.Error("the per IP limit must not affect other IPs")
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(Limit{Average: 2}, now)
+	if bucket.burst != 2 {
+		t.Errorf("the burst must be equal to the average: %v", bucket.burst)
+	}
+	if !bucket.allow(now) || !bucket.allow(now) || bucket.allow(now) {
+		t.Error("only 2 events must be allowed")
+	}
+	if bucket.isFull(now) {
+		t.Error("an empty bucket must not be full")
+	}
+	now = now.Add(500 * time.Millisecond)
+	if !bucket.allow(now) || bucket.allow(now) {
+		t.Error("the bucket must be refilled with one token")
+	}
+	if !bucket.isFull(now.Add(time.Hour)) {
+		t.Error("the bucket must be full")
+	}
+	if bucket.tokens != bucket.burst {
+		t.Errorf("the tokens cannot exceed the burst: %v", bucket.tokens)
+	}
+	bucket = newTokenBucket(Limit{Average: 0.1}, now)
+	if bucket.burst != 1 {
+		t.Errorf("the minimum burst is 1: %v", bucket.burst)
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	l := newLimiter(Limit{}, Limit{Average: 1, Burst: 1}, 2, 4)
+	for i := 1; i <= 4; i++ {
+		if !l.allow(fmt.Sprintf("127.0.0.%v", i)) {
+			t.Errorf("the first event for ip %v must be allowed", i)
+		}
+	}
+	if len(l.perIP) != 4 {
+		t.Errorf("unexpected number of buckets: %v", len(l.perIP))
+	}
+	// make the first bucket the most recently used one
+	l.perIP["127.0.0.1"].lastUsed = time.Now().Add(time.Minute)
+	l.allow("127.0.0.5")
+	if len(l.perIP) != 2 {
+		t.Errorf("unexpected number of buckets: %v", len(l.perIP))
+	}
+	if _, ok := l.perIP["127.0.0.1"]; !ok {
+		t.Error("the most recently used bucket must be kept")
+	}
+	if _, ok := l.perIP["127.0.0.5"]; !ok {
+		t.Error("the new bucket must be added")
+	}
+	// full buckets are removed first
+	l.perIP["127.0.0.6"] = newTokenBucket(l.perIPLimit, time.Now())
+	l.perIP["127.0.0.7"] = newTokenBucket(l.perIPLimit, time.Now())
+	l.allow("127.0.0.8")
+	if len(l.perIP) != 2 {
+		t.Errorf("unexpected number of buckets: %v", len(l.perIP))
+	}
+	if _, ok := l.perIP["127.0.0.6"]; ok {
+		t.Error("full buckets must be removed")
+	}
+	if _, ok := l.perIP["127.0.0.1"]; !ok {
+		t.Error("the most recently used bucket must be kept")
+	}
+}
+
+func TestLoginDelay(t *testing.T) {
+	config := Config{
+		LoginDelay: LoginDelay{Initial: -1},
+	}
+	if err := Initialize(config); err == nil {
+		t.Error("negative initial delay must fail")
+	}
+	config.LoginDelay = LoginDelay{Initial: 100, Max: 50, ResetTime: 1}
+	if err := Initialize(config); err == nil {
+		t.Error("max delay lower than the initial one must fail")
+	}
+	config.LoginDelay = LoginDelay{Initial: 100, Max: 500}
+	if err := Initialize(config); err == nil {
+		t.Error("missing reset_time must fail")
+	}
+	config.LoginDelay.ResetTime = 1
+	if err := Initialize(config); err == nil {
+		t.Error("the entries limits are required")
+	}
+	config.EntriesSoftLimit = 10
+	config.EntriesHardLimit = 20
+	if err := Initialize(config); err != nil {
+		t.Fatalf("unable to initialize rate limiters: %v", err)
+	}
+	defer Initialize(Config{})
+
+	d := loginDelays
+	now := time.Now()
+	for idx, expected := range []time.Duration{100, 200, 400, 500, 500} {
+		if delay := d.addFailure("127.0.0.1", "user1", now); delay != expected*time.Millisecond {
+			t.Errorf("unexpected delay for failure %v: %v", idx+1, delay)
+		}
+	}
+	// the highest count between the IP and the username is used
+	if delay := d.addFailure("127.0.0.2", "user1", now); delay != 500*time.Millisecond {
+		t.Errorf("the username failures must be considered: %v", delay)
+	}
+	if delay := d.addFailure("127.0.0.1", "user2", now); delay != 500*time.Millisecond {
+		t.Errorf("the IP failures must be considered: %v", delay)
+	}
+	// a successful login resets the username failures only
+	ResetLoginFailures("user1")
+	if delay := d.addFailure("127.0.0.3", "user1", now); delay != 100*time.Millisecond {
+		t.Errorf("the username failures must be reset: %v", delay)
+	}
+	if delay := d.addFailure("127.0.0.1", "user1", now); delay != 500*time.Millisecond {
+		t.Errorf("the IP failures must be preserved: %v", delay)
+	}
+	// the failures are forgotten after reset_time
+	if delay := d.addFailure("127.0.0.1", "user1", now.Add(2*time.Minute)); delay != 100*time.Millisecond {
+		t.Errorf("the failures must expire: %v", delay)
+	}
+	start := time.Now()
+	DelayLoginFailure("127.0.0.4", "user3")
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("the failed login must be delayed")
+	}
+}
+
+func TestLoginDelayCleanup(t *testing.T) {
+	d := newLoginDelayer(LoginDelay{Initial: 1, Max: 10, ResetTime: 1}, 2, 4)
+	now := time.Now()
+	for i := 1; i <= 4; i++ {
+		d.addFailure(fmt.Sprintf("127.0.0.%v", i), "", now.Add(time.Duration(i)*time.Second))
+	}
+	d.addFailure("127.0.0.5", "", now.Add(5*time.Second))
+	if len(d.failures) != 2 {
+		t.Errorf("unexpected number of entries: %v", len(d.failures))
+	}
+	if _, ok := d.failures[getIPKey("127.0.0.4")]; !ok {
+		t.Error("the most recent entry must be kept")
+	}
+	// expired entries are removed first
+	d.failures[getIPKey("127.0.0.6")] = &failureEntry{count: 1, lastFailure: now.Add(-time.Hour)}
+	d.failures[getIPKey("127.0.0.7")] = &failureEntry{count: 1, lastFailure: now.Add(-time.Hour)}
+	d.addFailure("127.0.0.8", "", now.Add(6*time.Second))
+	if len(d.failures) != 2 {
+		t.Errorf("unexpected number of entries: %v", len(d.failures))
+	}
+	if _, ok := d.failures[getIPKey("127.0.0.6")]; ok {
+		t.Error("expired entries must be removed")
+	}
+	if _, ok := d.failures[getIPKey("127.0.0.5")]; !ok {
+		t.Error("the most recent entry must be kept")
+	}
+	if newLoginDelayer(LoginDelay{}, 2, 4) != nil {
+		t.Error("a disabled login delay must be nil")
+	}
+}
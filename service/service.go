@@ -2,21 +2,37 @@
 package service
 
 import (
+	"context"
 	"fmt"
 	"math/rand"
+	"net"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/drakkan/sftpgo/acme"
+	"github.com/drakkan/sftpgo/antivirus"
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/eventmanager"
+	"github.com/drakkan/sftpgo/ftpd"
+	"github.com/drakkan/sftpgo/geoip"
 	"github.com/drakkan/sftpgo/httpd"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/plugin"
+	"github.com/drakkan/sftpgo/ratelimiter"
 	"github.com/drakkan/sftpgo/sftpd"
 	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/webdavd"
 	"github.com/grandcat/zeroconf"
 	"github.com/rs/zerolog"
 )
@@ -39,6 +55,7 @@ type Service struct {
 	LogMaxAge     int
 	LogCompress   bool
 	LogVerbose    bool
+	LogSinks      logger.SinksConfig
 	PortableMode  int
 	PortableUser  dataprovider.User
 	Shutdown      chan bool
@@ -54,6 +71,10 @@ func (s *Service) Start() error {
 		s.LogFilePath = filepath.Join(s.ConfigDir, s.LogFilePath)
 	}
 	logger.InitLogger(s.LogFilePath, s.LogMaxSize, s.LogMaxBackups, s.LogMaxAge, s.LogCompress, logLevel)
+	if err := logger.EnableSinks(s.LogSinks); err != nil {
+		logger.ErrorToConsole("error initializing the log sinks: %v", err)
+		return err
+	}
 	if s.PortableMode == 1 {
 		logger.EnableConsoleLogger(logLevel)
 		if len(s.LogFilePath) == 0 {
@@ -70,16 +91,82 @@ func (s *Service) Start() error {
 	}
 	providerConf := config.GetProviderConf()
 
-	err := dataprovider.Initialize(providerConf, s.ConfigDir)
+	err := plugin.Handler.Initialize(config.GetPluginsConfig())
+	if err != nil {
+		logger.Error(logSender, "", "error initializing plugins: %v", err)
+		logger.ErrorToConsole("error initializing plugins: %v", err)
+		return err
+	}
+
+	err = kms.Initialize(config.GetKMSConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing KMS: %v", err)
+		logger.ErrorToConsole("error initializing KMS: %v", err)
+		return err
+	}
+
+	err = dataprovider.Initialize(providerConf, s.ConfigDir)
 	if err != nil {
 		logger.Error(logSender, "", "error initializing data provider: %v", err)
 		logger.ErrorToConsole("error initializing data provider: %v", err)
 		return err
 	}
 
+	err = defender.Initialize(config.GetDefenderConfig())
+	if err != nil {
+		logger.Error(logSender, "", "error initializing defender: %v", err)
+		logger.ErrorToConsole("error initializing defender: %v", err)
+		return err
+	}
+
+	err = ratelimiter.Initialize(config.GetRateLimiterConfig())
+	if err != nil {
+		logger.Error(logSender, "", "error initializing rate limiters: %v", err)
+		logger.ErrorToConsole("error initializing rate limiters: %v", err)
+		return err
+	}
+
+	err = bandwidth.Initialize(config.GetBandwidthConfig())
+	if err != nil {
+		logger.Error(logSender, "", "error initializing bandwidth limits: %v", err)
+		logger.ErrorToConsole("error initializing bandwidth limits: %v", err)
+		return err
+	}
+
+	err = audit.Initialize(config.GetAuditConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing audit log: %v", err)
+		logger.ErrorToConsole("error initializing audit log: %v", err)
+		return err
+	}
+
+	err = acme.Initialize(config.GetACMEConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing ACME: %v", err)
+		logger.ErrorToConsole("error initializing ACME: %v", err)
+		return err
+	}
+
+	err = geoip.Initialize(config.GetGeoIPConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing GeoIP: %v", err)
+		logger.ErrorToConsole("error initializing GeoIP: %v", err)
+		return err
+	}
+
+	err = antivirus.Initialize(config.GetAntivirusConfig(), s.ConfigDir)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing antivirus: %v", err)
+		logger.ErrorToConsole("error initializing antivirus: %v", err)
+		return err
+	}
+
 	dataProvider := dataprovider.GetProvider()
 	sftpdConf := config.GetSFTPDConfig()
 	httpdConf := config.GetHTTPDConfig()
+	ftpdConf := config.GetFTPDConfig()
+	webdavdConf := config.GetWebDAVDConfig()
+	telemetryConf := config.GetTelemetryConfig()
 
 	if s.PortableMode == 1 {
 		// create the user for portable mode
@@ -92,9 +179,21 @@ func (s *Service) Start() error {
 
 	sftpd.SetDataProvider(dataProvider)
 
+	err = eventmanager.Initialize(dataProvider)
+	if err != nil {
+		logger.Error(logSender, "", "error initializing event manager: %v", err)
+		logger.ErrorToConsole("error initializing event manager: %v", err)
+		return err
+	}
+
 	go func() {
 		logger.Debug(logSender, "", "initializing SFTP server with config %+v", sftpdConf)
-		if err := sftpdConf.Initialize(s.ConfigDir); err != nil {
+		err := sftpdConf.Initialize(s.ConfigDir)
+		if err == sftpd.ErrServerClosed {
+			// graceful shutdown in progress, the service will be stopped after draining the connections
+			return
+		}
+		if err != nil {
 			logger.Error(logSender, "", "could not start SFTP server: %v", err)
 			logger.ErrorToConsole("could not start SFTP server: %v", err)
 		}
@@ -117,15 +216,102 @@ func (s *Service) Start() error {
 			logger.DebugToConsole("HTTP server not started, disabled in config file")
 		}
 	}
+
+	if ftpdConf.BindPort > 0 {
+		ftpd.SetDataProvider(dataProvider)
+
+		go func() {
+			logger.Debug(logSender, "", "initializing FTP server with config %+v", ftpdConf)
+			if err := ftpdConf.Initialize(s.ConfigDir); err != nil {
+				logger.Error(logSender, "", "could not start FTP server: %v", err)
+				logger.ErrorToConsole("could not start FTP server: %v", err)
+			}
+			s.Shutdown <- true
+		}()
+	} else {
+		logger.Debug(logSender, "", "FTP server not started, disabled in config file")
+		if s.PortableMode != 1 {
+			logger.DebugToConsole("FTP server not started, disabled in config file")
+		}
+	}
+
+	if webdavdConf.BindPort > 0 {
+		webdavd.SetDataProvider(dataProvider)
+
+		go func() {
+			if err := webdavdConf.Initialize(s.ConfigDir); err != nil {
+				logger.Error(logSender, "", "could not start WebDAV server: %v", err)
+				logger.ErrorToConsole("could not start WebDAV server: %v", err)
+			}
+			s.Shutdown <- true
+		}()
+	} else {
+		logger.Debug(logSender, "", "WebDAV server not started, disabled in config file")
+		if s.PortableMode != 1 {
+			logger.DebugToConsole("WebDAV server not started, disabled in config file")
+		}
+	}
+
+	if telemetryConf.BindPort > 0 {
+		go func() {
+			if err := telemetryConf.Initialize(); err != nil {
+				logger.Error(logSender, "", "could not start telemetry server: %v", err)
+				logger.ErrorToConsole("could not start telemetry server: %v", err)
+			}
+			s.Shutdown <- true
+		}()
+	} else {
+		logger.Debug(logSender, "", "telemetry server not started, disabled in config file")
+		if s.PortableMode != 1 {
+			logger.DebugToConsole("telemetry server not started, disabled in config file")
+		}
+	}
 	return nil
 }
 
 // Wait blocks until the service exits
 func (s *Service) Wait() {
 	if s.PortableMode != 1 {
-		registerSigHup()
+		registerSigHup(s)
 	}
+	registerSigTerm(s)
 	<-s.Shutdown
+	acme.Shutdown()
+	plugin.Handler.Cleanup()
+}
+
+// reload reloads the data provider configuration and the TLS certificates. The configuration
+// file is read again to reload the SFTP host keys, login banner and proxy allow list and the
+// defender lists, the other settings require a restart
+func (s *Service) reload() {
+	logger.Debug(logSender, "", "Received reload request")
+	dataprovider.ReloadConfig()
+	httpd.ReloadTLSCertificate()
+	ftpd.ReloadTLSCertificate()
+	webdavd.ReloadTLSCertificate()
+	if err := config.LoadConfig(s.ConfigDir, s.ConfigFile); err != nil {
+		logger.Warn(logSender, "", "unable to load the configuration, SFTP and defender settings not reloaded: %v", err)
+		return
+	}
+	if err := sftpd.Reload(config.GetSFTPDConfig()); err != nil {
+		logger.Warn(logSender, "", "unable to reload the SFTP server configuration: %v", err)
+	}
+	if err := defender.ReloadLists(config.GetDefenderConfig()); err != nil {
+		logger.Warn(logSender, "", "unable to reload the defender lists: %v", err)
+	}
+}
+
+// drainConnections stops accepting new SFTP connections and waits, up to the configured
+// grace time, for the active transfers to finish
+func (s *Service) drainConnections() {
+	graceTime := time.Duration(config.GetSFTPDConfig().GraceTime) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), graceTime)
+	defer cancel()
+	logger.Info(logSender, "", "stopping the SFTP server, grace time: %v", graceTime)
+	if err := sftpd.Shutdown(ctx); err != nil {
+		logger.Warn(logSender, "", "unable to drain the SFTP connections: %v", err)
+	}
+	dataprovider.FlushDelayedQuotaUpdates()
 }
 
 // Stop terminates the service unblocking the Wait method
@@ -159,13 +345,25 @@ func (s *Service) StartPortableMode(sftpdPort int, enabledSSHCommands []string,
 	httpdConf := config.GetHTTPDConfig()
 	httpdConf.BindPort = 0
 	config.SetHTTPDConfig(httpdConf)
+	ftpdConf := config.GetFTPDConfig()
+	ftpdConf.BindPort = 0
+	config.SetFTPDConfig(ftpdConf)
+	webdavdConf := config.GetWebDAVDConfig()
+	webdavdConf.BindPort = 0
+	config.SetWebDAVDConfig(webdavdConf)
+	telemetryConf := config.GetTelemetryConfig()
+	telemetryConf.BindPort = 0
+	config.SetTelemetryConfig(telemetryConf)
 	sftpdConf := config.GetSFTPDConfig()
 	sftpdConf.MaxAuthTries = 12
-	if sftpdPort > 0 {
-		sftpdConf.BindPort = sftpdPort
-	} else {
+	if sftpdPort <= 0 {
 		// dynamic ports starts from 49152
-		sftpdConf.BindPort = 49152 + rand.Intn(15000)
+		sftpdPort = 49152 + rand.Intn(15000)
+	}
+	sftpdConf.Bindings = []sftpd.Binding{
+		{
+			Port: sftpdPort,
+		},
 	}
 	if utils.IsStringInSlice("*", enabledSSHCommands) {
 		sftpdConf.EnabledSSHCommands = sftpd.GetSupportedSSHCommands()
@@ -194,12 +392,12 @@ func (s *Service) StartPortableMode(sftpdPort int, enabledSSHCommands []string,
 			}
 		}
 		mDNSService, err = zeroconf.Register(
-			fmt.Sprintf("SFTPGo portable %v", sftpdConf.BindPort), // service instance name
-			"_sftp-ssh._tcp",   // service type and protocol
-			"local.",           // service domain
-			sftpdConf.BindPort, // service port
-			meta,               // service metadata
-			nil,                // register on all network interfaces
+			fmt.Sprintf("SFTPGo portable %v", sftpdPort), // service instance name
+			"_sftp-ssh._tcp", // service type and protocol
+			"local.",         // service domain
+			sftpdPort,        // service port
+			meta,             // service metadata
+			nil,              // register on all network interfaces
 		)
 		if err != nil {
 			mDNSService = nil
@@ -221,18 +419,59 @@ func (s *Service) StartPortableMode(sftpdPort int, enabledSSHCommands []string,
 	}()
 
 	logger.InfoToConsole("Portable mode ready, SFTP port: %v, user: %#v, password: %#v, public keys: %v, directory: %#v, "+
-		"permissions: %+v, enabled ssh commands: %v file extensions filters: %+v", sftpdConf.BindPort, s.PortableUser.Username,
-		s.PortableUser.Password, s.PortableUser.PublicKeys, s.getPortableDirToServe(), s.PortableUser.Permissions,
-		sftpdConf.EnabledSSHCommands, s.PortableUser.Filters.FileExtensions)
+		"permissions: %+v, enabled ssh commands: %v file extensions filters: %+v file patterns filters: %+v",
+		sftpdPort, s.PortableUser.Username, s.PortableUser.Password, s.PortableUser.PublicKeys,
+		s.getPortableDirToServe(), s.PortableUser.Permissions, sftpdConf.EnabledSSHCommands,
+		s.PortableUser.Filters.FileExtensions, s.PortableUser.Filters.FilePatterns)
+	logger.InfoToConsole("Connect using: %v", s.getPortableConnectionString(sftpdPort))
+	if utils.IsStringInSlice("scp", sftpdConf.EnabledSSHCommands) {
+		logger.InfoToConsole("SCP is enabled, for example: scp -P %v %v@%v:/<file> .", sftpdPort, s.PortableUser.Username,
+			getPortableHost())
+	}
 	return nil
 }
 
+// getPortableConnectionString returns an SFTP URI to connect to the portable mode service
+func (s *Service) getPortableConnectionString(sftpdPort int) string {
+	u := url.URL{
+		Scheme: "sftp",
+		Host:   net.JoinHostPort(getPortableHost(), strconv.Itoa(sftpdPort)),
+	}
+	if len(s.PortableUser.Password) > 0 {
+		u.User = url.UserPassword(s.PortableUser.Username, s.PortableUser.Password)
+	} else {
+		u.User = url.User(s.PortableUser.Username)
+	}
+	return u.String()
+}
+
+// getPortableHost returns the first non loopback IPv4 address or the hostname if no such address is found
+func getPortableHost() string {
+	addrs, err := net.InterfaceAddrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+				return ipNet.IP.String()
+			}
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		return "localhost"
+	}
+	return hostname
+}
+
 func (s *Service) getPortableDirToServe() string {
 	var dirToServe string
 	if s.PortableUser.FsConfig.Provider == 1 {
 		dirToServe = s.PortableUser.FsConfig.S3Config.KeyPrefix
 	} else if s.PortableUser.FsConfig.Provider == 2 {
 		dirToServe = s.PortableUser.FsConfig.GCSConfig.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == 3 {
+		dirToServe = s.PortableUser.FsConfig.AzBlobConfig.KeyPrefix
+	} else if s.PortableUser.FsConfig.Provider == 4 {
+		dirToServe = s.PortableUser.FsConfig.SFTPConfig.Prefix
 	} else {
 		dirToServe = s.PortableUser.HomeDir
 	}
@@ -6,11 +6,11 @@ import (
 	"path/filepath"
 	"strings"
 	"time"
+	"unsafe"
 
-	"github.com/drakkan/sftpgo/dataprovider"
-	"github.com/drakkan/sftpgo/httpd"
 	"github.com/drakkan/sftpgo/logger"
 
+	"golang.org/x/sys/windows"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
@@ -21,6 +21,15 @@ const (
 	serviceDesc = "Full featured and highly configurable SFTP server"
 )
 
+// event IDs for the Windows event log
+const (
+	eventIDStarted uint32 = iota + 1
+	eventIDStopping
+	eventIDStopped
+	eventIDReload
+	eventIDStartError
+)
+
 // Status defines service status
 type Status uint8
 
@@ -64,11 +73,16 @@ func (s Status) String() string {
 
 func (s *WindowsService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (ssec bool, errno uint32) {
 	const cmdsAccepted = svc.AcceptStop | svc.AcceptShutdown | svc.AcceptParamChange
+	elog := openEventLog()
+	defer elog.close()
 	changes <- svc.Status{State: svc.StartPending}
 	if err := s.Service.Start(); err != nil {
+		// a non zero exit code triggers the configured recovery actions
+		elog.error(eventIDStartError, fmt.Sprintf("unable to start the service: %v", err))
 		return true, 1
 	}
 	changes <- svc.Status{State: svc.Running, Accepts: cmdsAccepted}
+	elog.info(eventIDStarted, "service started")
 loop:
 	for {
 		c := <-r
@@ -79,20 +93,57 @@ loop:
 		case svc.Stop, svc.Shutdown:
 			logger.Debug(logSender, "", "Received service stop request")
 			changes <- svc.Status{State: svc.StopPending}
+			elog.info(eventIDStopping, "service stop requested, draining the connections")
+			s.Service.drainConnections()
 			s.Service.Stop()
 			break loop
 		case svc.ParamChange:
-			logger.Debug(logSender, "", "Received reload request")
-			dataprovider.ReloadConfig()
-			httpd.ReloadTLSCertificate()
+			elog.info(eventIDReload, "service reload requested")
+			s.Service.reload()
 		default:
 			continue loop
 		}
 	}
 
+	elog.info(eventIDStopped, "service stopped")
 	return false, 0
 }
 
+// windowsEventLog reports the service lifecycle to the Windows event log,
+// the event source is registered when the service is installed
+type windowsEventLog struct {
+	log *eventlog.Log
+}
+
+func openEventLog() *windowsEventLog {
+	l, err := eventlog.Open(serviceName)
+	if err != nil {
+		logger.Warn(logSender, "", "unable to open the Windows event log: %v", err)
+		return &windowsEventLog{}
+	}
+	return &windowsEventLog{log: l}
+}
+
+func (l *windowsEventLog) info(eventID uint32, msg string) {
+	logger.Info(logSender, "", "%v", msg)
+	if l.log != nil {
+		l.log.Info(eventID, msg)
+	}
+}
+
+func (l *windowsEventLog) error(eventID uint32, msg string) {
+	logger.Error(logSender, "", "%v", msg)
+	if l.log != nil {
+		l.log.Error(eventID, msg)
+	}
+}
+
+func (l *windowsEventLog) close() {
+	if l.log != nil {
+		l.log.Close()
+	}
+}
+
 func (s *WindowsService) RunService() error {
 	exePath, err := s.getExePath()
 	if err != nil {
@@ -200,6 +251,17 @@ func (s *WindowsService) Install(args ...string) error {
 		service.Delete()
 		return fmt.Errorf("unable to set recovery actions: %v", err)
 	}
+	// the recovery actions are executed for crashes only by default, we want them also
+	// if the service stops with an error, for example if it is unable to start
+	failureActionsFlag := struct {
+		failureActionsOnNonCrashFailures int32
+	}{1}
+	err = windows.ChangeServiceConfig2(service.Handle, windows.SERVICE_CONFIG_FAILURE_ACTIONS_FLAG,
+		(*byte)(unsafe.Pointer(&failureActionsFlag)))
+	if err != nil {
+		service.Delete()
+		return fmt.Errorf("unable to enable recovery actions for non crash failures: %v", err)
+	}
 	return nil
 }
 
@@ -1,4 +1,4 @@
 package service
 
-func registerSigHup() {
+func registerSigHup(s *Service) {
 }
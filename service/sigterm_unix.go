@@ -0,0 +1,22 @@
+// +build !windows
+
+package service
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+func registerSigTerm(s *Service) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM)
+	go func() {
+		<-sig
+		logger.Debug(logSender, "", "Received shutdown request")
+		s.drainConnections()
+		s.Shutdown <- true
+	}()
+}
@@ -0,0 +1,4 @@
+package service
+
+// the Windows service is stopped using the service manager, see WindowsService.Execute
+func registerSigTerm(s *Service) {}
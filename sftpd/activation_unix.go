@@ -0,0 +1,65 @@
+// +build !windows
+
+package sftpd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// first file descriptor passed using the socket activation protocol, 0, 1 and 2 are
+// stdin, stdout and stderr
+const listenFdsStart = 3
+
+// getActivationListeners returns the listeners for the sockets passed by systemd, or any
+// other service manager implementing the LISTEN_FDS protocol, if the process is socket
+// activated. The environment variables are unset, so the inherited sockets are used only
+// once and they are not advertised to the child processes, for example the hooks
+func getActivationListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	numFds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || numFds <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); len(fdNames) > 0 {
+		names = strings.Split(fdNames, ":")
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return getListenersFromFds(listenFdsStart, numFds, names)
+}
+
+// getListenersFromFds returns the listeners for numFds consecutive file descriptors
+// starting from firstFd
+func getListenersFromFds(firstFd, numFds int, names []string) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for idx := 0; idx < numFds; idx++ {
+		fd := firstFd + idx
+		syscall.CloseOnExec(fd)
+		name := fmt.Sprintf("LISTEN_FD_%v", fd)
+		if idx < len(names) && len(names[idx]) > 0 {
+			name = names[idx]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		// the listener uses a duplicate of the file descriptor
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("unable to use the inherited socket %#v: %v", name, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
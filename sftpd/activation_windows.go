@@ -0,0 +1,8 @@
+package sftpd
+
+import "net"
+
+// socket activation is not supported on Windows
+func getActivationListeners() ([]net.Listener, error) {
+	return nil, nil
+}
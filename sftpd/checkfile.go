@@ -0,0 +1,197 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// the minimum block size defined for the check-file requests, 0 means a single hash for the whole range
+const checkFileMinBlockSize = 256
+
+// hash algorithms supported for check-file, in order of preference
+var checkFileHashAlgos = []string{"md5", "sha1", "sha256", "sha384", "sha512"}
+
+var (
+	errCheckFileBlockSize = errors.New("invalid check-file block size")
+	errCheckFileTooLarge  = errors.New("too many check-file blocks requested")
+)
+
+type checkFileRequest struct {
+	// SFTP path or file handle
+	name      string
+	algos     []string
+	offset    uint64
+	length    uint64
+	blockSize uint32
+}
+
+// parseCheckFileRequest parses the check-file-name and check-file-handle specific data
+func parseCheckFileRequest(data []byte) (checkFileRequest, bool) {
+	var req checkFileRequest
+	name, data, ok := parseSFTPString(data)
+	if !ok {
+		return req, false
+	}
+	algos, data, ok := parseSFTPString(data)
+	if !ok || len(data) < 20 {
+		return req, false
+	}
+	req.name = name
+	req.algos = strings.Split(algos, ",")
+	req.offset = binary.BigEndian.Uint64(data)
+	req.length = binary.BigEndian.Uint64(data[8:])
+	req.blockSize = binary.BigEndian.Uint32(data[16:])
+	return req, true
+}
+
+func (c *extensionsChannel) handleCheckFile(id uint32, isHandle bool, req checkFileRequest) {
+	updateConnectionActivity(c.connection.ID)
+	sftpPath := req.name
+	ok := true
+	var requests []uint32
+	if isHandle {
+		// the pending writes for the handle must be completed before hashing
+		sftpPath, requests, ok = c.getHandlePath(req.name)
+	}
+
+	go func() {
+		c.waitForRequests(requests)
+		var algo string
+		var hashes []byte
+		var err error
+		if !ok {
+			err = errInvalidHandle
+		} else {
+			algo, hashes, err = c.connection.getFileChecksum(path.Clean("/"+sftpPath), req)
+		}
+		if err != nil {
+			c.connection.Log(logger.LevelWarn, logSender, "check-file error for path %#v: %v", sftpPath, err)
+			c.writeResponse(getSFTPStatusPacket(id, c.connection.getExtensionErrorCode(err), err.Error()))
+			return
+		}
+		response := []byte{0, 0, 0, 0, sftpPacketExtendedReply, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(response[5:], id)
+		response = appendSFTPString(response, checkFileExtension)
+		response = appendSFTPString(response, algo)
+		response = append(response, hashes...)
+		binary.BigEndian.PutUint32(response, uint32(len(response)-4))
+		c.writeResponse(response)
+	}()
+}
+
+// getFileChecksum returns the hash algorithm used and the hashes for the requested range
+// of the file at the given SFTP path. A hash is computed for each block or for the whole
+// range if the block size is 0. The first supported algorithm requested by the client is used
+func (c Connection) getFileChecksum(sftpPath string, req checkFileRequest) (string, []byte, error) {
+	algo := ""
+	for _, a := range req.algos {
+		if getHasher(a) != nil {
+			algo = a
+			break
+		}
+	}
+	if algo == "" {
+		return algo, nil, errExtensionUnsupported
+	}
+	if req.blockSize > 0 && req.blockSize < checkFileMinBlockSize {
+		return algo, nil, errCheckFileBlockSize
+	}
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(sftpPath)) {
+		return algo, nil, sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.User.IsFileAllowed(sftpPath) {
+		c.Log(logger.LevelWarn, logSender, "check-file is not allowed for file %#v", sftpPath)
+		return algo, nil, sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := c.fs.ResolvePath(sftpPath)
+	if err != nil {
+		return algo, nil, err
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		return algo, nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return algo, nil, errExtensionUnsupported
+	}
+	// a zero length means up to the end of the file
+	length := int64(0)
+	if req.offset < uint64(fi.Size()) {
+		length = fi.Size() - int64(req.offset)
+		if req.length > 0 && req.length < uint64(length) {
+			length = int64(req.length)
+		}
+	}
+	blockSize := int64(req.blockSize)
+	if blockSize == 0 || blockSize > length {
+		blockSize = length
+	}
+	if hashes, ok := c.getStoredChecksum(p, req, fi.Size(), length, blockSize); ok {
+		return defaultPipelineChecksum, hashes, nil
+	}
+	hashSize := int64(getHasher(algo).Size())
+	if blockSize > 0 && (length/blockSize+1)*hashSize > maxSFTPPacketLength-1024 {
+		return algo, nil, errCheckFileTooLarge
+	}
+
+	file, r, cancelFn, err := c.fs.Open(p)
+	if err != nil {
+		return algo, nil, err
+	}
+	var reader io.ReaderAt = r
+	if file != nil {
+		reader = file
+	}
+	defer func() {
+		if file != nil {
+			file.Close()
+		} else {
+			r.Close()
+		}
+		if cancelFn != nil {
+			cancelFn()
+		}
+	}()
+
+	c.Log(logger.LevelDebug, logSender, "check-file requested for path: %#v, algo: %v, offset: %v, length: %v, block size: %v",
+		p, algo, req.offset, length, blockSize)
+	src := io.NewSectionReader(reader, int64(req.offset), length)
+	var hashes []byte
+	for offset := int64(0); offset < length || len(hashes) == 0; offset += blockSize {
+		h := getHasher(algo)
+		if _, err := io.CopyN(h, src, blockSize); err != nil && err != io.EOF {
+			return algo, nil, err
+		}
+		hashes = append(hashes, h.Sum(nil)...)
+	}
+	return algo, hashes, nil
+}
+
+// getStoredChecksum returns the SHA-256 checksum stored after the upload, if any. It can be used
+// only if the client accepts sha256 and if a single hash for the whole file is requested
+func (c Connection) getStoredChecksum(fsPath string, req checkFileRequest, size, length, blockSize int64) ([]byte, bool) {
+	if !utils.IsStringInSlice(defaultPipelineChecksum, req.algos) || req.offset != 0 || length != size ||
+		blockSize != length {
+		return nil, false
+	}
+	checksum, err := c.fs.GetFileChecksum(fsPath)
+	if err != nil || len(checksum) != 64 {
+		return nil, false
+	}
+	hashes, err := hex.DecodeString(checksum)
+	if err != nil {
+		return nil, false
+	}
+	c.Log(logger.LevelDebug, logSender, "check-file for path %#v, using the stored checksum", fsPath)
+	return hashes, true
+}
@@ -0,0 +1,275 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"path"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// buffer size used for the server side copies
+const copyBufferSize = 32 * 1024
+
+var errCopyOverlap = errors.New("the source and destination ranges overlap")
+
+type copyDataRequest struct {
+	readHandle  string
+	readOffset  uint64
+	readLength  uint64
+	writeHandle string
+	writeOffset uint64
+}
+
+// parseCopyDataRequest parses the copy-data specific data
+func parseCopyDataRequest(data []byte) (copyDataRequest, bool) {
+	var req copyDataRequest
+	readHandle, data, ok := parseSFTPString(data)
+	if !ok || len(data) < 16 {
+		return req, false
+	}
+	req.readHandle = readHandle
+	req.readOffset = binary.BigEndian.Uint64(data)
+	req.readLength = binary.BigEndian.Uint64(data[8:])
+	writeHandle, data, ok := parseSFTPString(data[16:])
+	if !ok || len(data) < 8 {
+		return req, false
+	}
+	req.writeHandle = writeHandle
+	req.writeOffset = binary.BigEndian.Uint64(data)
+	return req, true
+}
+
+func (c *extensionsChannel) handleCopyData(id uint32, req copyDataRequest) {
+	updateConnectionActivity(c.connection.ID)
+	// the pending requests, for example the writes to the source file, must be completed before copying
+	readPath, requests, readOk := c.getHandlePath(req.readHandle)
+	writePath, _, writeOk := c.getHandlePath(req.writeHandle)
+
+	go func() {
+		c.waitForRequests(requests)
+		var err error
+		if !readOk || !writeOk {
+			err = errInvalidHandle
+		} else {
+			err = c.connection.copyData(path.Clean("/"+readPath), path.Clean("/"+writePath), req)
+		}
+		if err != nil {
+			c.connection.Log(logger.LevelWarn, logSender, "copy-data error from %#v to %#v: %v", readPath, writePath, err)
+			c.writeResponse(getSFTPStatusPacket(id, c.connection.getExtensionErrorCode(err), err.Error()))
+			return
+		}
+		c.writeResponse(getSFTPStatusPacket(id, sftpStatusOK, ""))
+	}()
+}
+
+// copyData copies the requested range of the source file to the upload in progress for
+// the target path. The copied data is accounted as any other upload, so the quota is
+// updated when the write handle is closed
+func (c Connection) copyData(sourcePath, targetPath string, req copyDataRequest) error {
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(sourcePath)) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.User.IsFileAllowed(sourcePath) {
+		c.Log(logger.LevelWarn, logSender, "copy is not allowed for file %#v", sourcePath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	source, err := c.fs.ResolvePath(sourcePath)
+	if err != nil {
+		return err
+	}
+	target, err := c.fs.ResolvePath(targetPath)
+	if err != nil {
+		return err
+	}
+	transfer := getConnectionTransfer(c.ID, target)
+	if transfer == nil {
+		// the write handle is not open for writing
+		return errInvalidHandle
+	}
+	fi, err := c.fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errExtensionUnsupported
+	}
+	// a zero length means up to the end of the file
+	length := int64(0)
+	if req.readOffset < uint64(fi.Size()) {
+		length = fi.Size() - int64(req.readOffset)
+		if req.readLength > 0 && req.readLength < uint64(length) {
+			length = int64(req.readLength)
+		}
+	}
+	if source == target && req.readOffset < req.writeOffset+uint64(length) &&
+		req.writeOffset < req.readOffset+uint64(length) {
+		return errCopyOverlap
+	}
+
+	file, r, cancelFn, err := c.fs.Open(source)
+	if err != nil {
+		return err
+	}
+	var reader io.ReaderAt = r
+	if file != nil {
+		reader = file
+	}
+	defer func() {
+		if file != nil {
+			file.Close()
+		} else {
+			r.Close()
+		}
+		if cancelFn != nil {
+			cancelFn()
+		}
+	}()
+
+	c.Log(logger.LevelDebug, logSender, "copy-data requested from %#v to %#v, read offset: %v, length: %v, write offset: %v",
+		source, target, req.readOffset, length, req.writeOffset)
+	src := io.NewSectionReader(reader, int64(req.readOffset), length)
+	buf := make([]byte, copyBufferSize)
+	offset := int64(req.writeOffset)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, errWrite := transfer.WriteAt(buf[:n], offset); errWrite != nil {
+				return errWrite
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyFile copies the source file to the target path, the target is overwritten if it exists.
+// The quota is checked before copying and updated after the copy
+func (c Connection) copyFile(sourcePath, targetPath string) (int64, error) {
+	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(sourcePath)) {
+		return 0, errPermissionDenied
+	}
+	if !c.User.IsFileAllowed(sourcePath) || !c.User.IsFileAllowed(targetPath) {
+		c.Log(logger.LevelInfo, logSenderSSH, "copy not allowed, source: %#v target: %#v", sourcePath, targetPath)
+		return 0, errPermissionDenied
+	}
+	if c.User.IsVirtualFolder(targetPath) {
+		return 0, errPermissionDenied
+	}
+	source, err := c.fs.ResolvePath(sourcePath)
+	if err != nil {
+		return 0, err
+	}
+	target, err := c.fs.ResolvePath(targetPath)
+	if err != nil {
+		return 0, err
+	}
+	fi, err := c.fs.Stat(source)
+	if err != nil {
+		return 0, err
+	}
+	if !fi.Mode().IsRegular() {
+		return 0, errors.New("the source is not a regular file")
+	}
+	if source == target {
+		return 0, errors.New("the source and the target are the same file")
+	}
+	isNewFile := true
+	previousSize := int64(0)
+	if targetInfo, err := c.fs.Lstat(target); err == nil {
+		if !targetInfo.Mode().IsRegular() {
+			return 0, errors.New("the target is not a regular file")
+		}
+		if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(targetPath)) {
+			return 0, errPermissionDenied
+		}
+		isNewFile = false
+		previousSize = targetInfo.Size()
+	} else if !c.fs.IsNotExist(err) {
+		return 0, err
+	} else if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(targetPath)) {
+		return 0, errPermissionDenied
+	}
+	if err = c.checkCopyQuota(isNewFile, target, fi.Size()-previousSize); err != nil {
+		return 0, err
+	}
+
+	file, r, cancelSourceFn, err := c.fs.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	var reader io.ReadCloser = r
+	if file != nil {
+		reader = file
+	}
+	defer func() {
+		reader.Close()
+		if cancelSourceFn != nil {
+			cancelSourceFn()
+		}
+	}()
+	dstFile, w, cancelTargetFn, err := c.fs.Create(target, 0)
+	if err != nil {
+		return 0, err
+	}
+	var writer io.WriteCloser = w
+	if dstFile != nil {
+		writer = dstFile
+	}
+	written, err := io.Copy(writer, reader)
+	if err != nil && cancelTargetFn != nil {
+		// abort the upload to the cloud storage
+		cancelTargetFn()
+	}
+	if errClose := writer.Close(); err == nil {
+		err = errClose
+	}
+	if err != nil {
+		c.Log(logger.LevelWarn, logSenderSSH, "error copying %#v to %#v: %v", source, target, err)
+		return written, err
+	}
+	vfs.SetPathPermissions(c.fs, target, c.User.GetUID(), c.User.GetGID())
+	if !c.User.IsFileExcludedFromQuota(target) {
+		numFiles := 0
+		if isNewFile {
+			numFiles = 1
+		}
+		dataprovider.UpdateUserQuota(dataProvider, c.User, numFiles, written-previousSize, false)
+	}
+	logger.CommandLog(copyLogSender, source, target, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	return written, nil
+}
+
+// checkCopyQuota returns an error if copying a file with the given size increment,
+// compared to the replaced file, exceeds the quota
+func (c Connection) checkCopyQuota(isNewFile bool, target string, sizeDiff int64) error {
+	if c.User.IsFileExcludedFromQuota(target) || !c.User.HasQuotaRestrictions() {
+		return nil
+	}
+	if !c.hasSpace(isNewFile, target) {
+		return errQuotaExceeded
+	}
+	if c.User.QuotaSize > 0 {
+		_, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				return nil
+			}
+			return err
+		}
+		if size+sizeDiff > c.User.QuotaSize {
+			return errQuotaExceeded
+		}
+	}
+	return nil
+}
@@ -0,0 +1,391 @@
+package sftpd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	statVFSExtension = "statvfs@openssh.com"
+	fsyncExtension   = "fsync@openssh.com"
+	// check-file is advertised, the requests are check-file-name and check-file-handle
+	checkFileExtension     = "check-file"
+	checkFileNameRequest   = "check-file-name"
+	checkFileHandleRequest = "check-file-handle"
+	copyDataExtension      = "copy-data"
+	// SFTP packet types and status codes handled here
+	sftpPacketInit          = 1
+	sftpPacketVersion       = 2
+	sftpPacketOpen          = 3
+	sftpPacketClose         = 4
+	sftpPacketStatus        = 101
+	sftpPacketHandle        = 102
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+	sftpStatusOK            = 0
+	sftpStatusNoSuchFile    = 2
+	sftpStatusPermDenied    = 3
+	sftpStatusFailure       = 4
+	sftpStatusOpUnsupported = 8
+	// same limit used by the SFTP library
+	maxSFTPPacketLength = 256 * 1024
+)
+
+var (
+	errExtensionUnsupported = errors.New("operation not supported")
+	errInvalidHandle        = errors.New("invalid handle")
+)
+
+// extensions added to the version packet, the data is the extension version
+// or, for check-file, the supported hash algorithms
+var advertisedExtensions = []struct {
+	name string
+	data string
+}{
+	{statVFSExtension, "2"},
+	{fsyncExtension, "1"},
+	{checkFileExtension, strings.Join(checkFileHashAlgos, ",")},
+	{copyDataExtension, "1"},
+}
+
+// extensionsChannel wraps the SSH channel used by the SFTP request server and
+// serves the SFTP extensions not supported by the request server:
+// statvfs@openssh.com, fsync@openssh.com, check-file and copy-data.
+// All the other packets are forwarded unchanged, the served extensions are added
+// to the list of extensions advertised by the server in the version packet.
+// The file handles returned by the request server are tracked to find the
+// files for the fsync, check-file-handle and copy-data requests
+type extensionsChannel struct {
+	io.ReadWriteCloser
+	connection  Connection
+	writeLock   sync.Mutex
+	readBuf     []byte
+	versionSent bool
+	// requests forwarded to the request server and not yet answered
+	requestsLock sync.Mutex
+	requestsCond *sync.Cond
+	pending      map[uint32]bool
+	isClosed     bool
+	// SFTP paths for the open requests and for the returned handles
+	opens   map[uint32]string
+	handles map[string]string
+}
+
+func newExtensionsChannel(channel io.ReadWriteCloser, connection Connection) *extensionsChannel {
+	c := &extensionsChannel{
+		ReadWriteCloser: channel,
+		connection:      connection,
+		pending:         make(map[uint32]bool),
+		opens:           make(map[uint32]string),
+		handles:         make(map[string]string),
+	}
+	c.requestsCond = sync.NewCond(&c.requestsLock)
+	return c
+}
+
+// Read returns the data for the request server, the extended requests served here are not forwarded
+func (c *extensionsChannel) Read(p []byte) (int, error) {
+	for len(c.readBuf) == 0 {
+		packet, err := c.readPacket()
+		if err != nil {
+			c.setClosed()
+			abortInterruptedUploads(c.connection.ID, c.getOpenPaths())
+			return 0, err
+		}
+		if c.handleExtendedRequest(packet[4:]) {
+			continue
+		}
+		c.trackRequest(packet[4:])
+		c.readBuf = packet
+	}
+	n := copy(p, c.readBuf)
+	c.readBuf = c.readBuf[n:]
+	return n, nil
+}
+
+// Write sends the packets generated by the request server, the SFTP library
+// writes a complete packet for each call
+func (c *extensionsChannel) Write(p []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	if len(p) > 4 && p[4] == sftpPacketVersion {
+		if !c.versionSent {
+			c.versionSent = true
+			packet := append([]byte{}, p...)
+			for _, extension := range advertisedExtensions {
+				packet = appendSFTPString(packet, extension.name)
+				packet = appendSFTPString(packet, extension.data)
+			}
+			binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+			if _, err := c.ReadWriteCloser.Write(packet); err != nil {
+				return 0, err
+			}
+			return len(p), nil
+		}
+	} else {
+		c.trackResponse(p)
+	}
+	return c.ReadWriteCloser.Write(p)
+}
+
+// Close closes the underlying channel and unblocks the requests waiting for
+// responses that will never be sent
+func (c *extensionsChannel) Close() error {
+	c.setClosed()
+	return c.ReadWriteCloser.Close()
+}
+
+func (c *extensionsChannel) setClosed() {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	c.isClosed = true
+	c.requestsCond.Broadcast()
+}
+
+func (c *extensionsChannel) readPacket() ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.ReadWriteCloser, header); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header)
+	if length == 0 || length > maxSFTPPacketLength {
+		return nil, fmt.Errorf("invalid SFTP packet length: %v", length)
+	}
+	packet := make([]byte, 4+int(length))
+	copy(packet, header)
+	if _, err := io.ReadFull(c.ReadWriteCloser, packet[4:]); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// handleExtendedRequest returns true if the given packet, without the length,
+// is an extended request served here
+func (c *extensionsChannel) handleExtendedRequest(packet []byte) bool {
+	id, request, data, ok := parseExtendedRequest(packet)
+	if !ok {
+		return false
+	}
+	switch request {
+	case statVFSExtension:
+		sftpPath, _, ok := parseSFTPString(data)
+		if !ok {
+			return false
+		}
+		go c.handleStatVFS(id, sftpPath)
+		return true
+	case fsyncExtension:
+		handle, _, ok := parseSFTPString(data)
+		if !ok {
+			return false
+		}
+		c.handleFsync(id, handle)
+		return true
+	case checkFileNameRequest, checkFileHandleRequest:
+		checkFileReq, ok := parseCheckFileRequest(data)
+		if !ok {
+			return false
+		}
+		c.handleCheckFile(id, request == checkFileHandleRequest, checkFileReq)
+		return true
+	case copyDataExtension:
+		copyDataReq, ok := parseCopyDataRequest(data)
+		if !ok {
+			return false
+		}
+		c.handleCopyData(id, copyDataReq)
+		return true
+	}
+	return false
+}
+
+// getHandlePath returns the SFTP path for the given handle and the requests, received
+// before this call, that must be completed before using the file
+func (c *extensionsChannel) getHandlePath(handle string) (string, []uint32, bool) {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	sftpPath, ok := c.handles[handle]
+	var requests []uint32
+	for requestID := range c.pending {
+		requests = append(requests, requestID)
+	}
+	return sftpPath, requests, ok
+}
+
+// getOpenPaths returns the filesystem paths for the handles not yet closed
+func (c *extensionsChannel) getOpenPaths() []string {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	var paths []string
+	for _, sftpPath := range c.handles {
+		if p, err := c.connection.fs.ResolvePath(sftpPath); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+func (c *extensionsChannel) handleFsync(id uint32, handle string) {
+	updateConnectionActivity(c.connection.ID)
+	// the writes received before the fsync request must be completed before syncing
+	sftpPath, requests, ok := c.getHandlePath(handle)
+
+	go func() {
+		c.waitForRequests(requests)
+		var err error
+		if !ok {
+			err = errExtensionUnsupported
+		} else {
+			err = c.connection.syncFile(sftpPath)
+		}
+		if err != nil {
+			c.connection.Log(logger.LevelWarn, logSender, "fsync error for path %#v: %v", sftpPath, err)
+			c.writeResponse(getSFTPStatusPacket(id, c.connection.getExtensionErrorCode(err), err.Error()))
+			return
+		}
+		c.writeResponse(getSFTPStatusPacket(id, sftpStatusOK, ""))
+	}()
+}
+
+func (c *extensionsChannel) waitForRequests(requests []uint32) {
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	for _, id := range requests {
+		for c.pending[id] && !c.isClosed {
+			c.requestsCond.Wait()
+		}
+	}
+}
+
+func (c *extensionsChannel) writeResponse(response []byte) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if _, err := c.ReadWriteCloser.Write(response); err != nil {
+		c.connection.Log(logger.LevelWarn, logSender, "unable to send SFTP extension response: %v", err)
+	}
+}
+
+// trackRequest records the requests forwarded to the request server
+func (c *extensionsChannel) trackRequest(packet []byte) {
+	// the init packet has the version instead of the request id
+	if len(packet) < 5 || packet[0] == sftpPacketInit {
+		return
+	}
+	id := binary.BigEndian.Uint32(packet[1:5])
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	c.pending[id] = true
+	switch packet[0] {
+	case sftpPacketOpen:
+		if sftpPath, _, ok := parseSFTPString(packet[5:]); ok {
+			c.opens[id] = sftpPath
+		}
+	case sftpPacketClose:
+		if handle, _, ok := parseSFTPString(packet[5:]); ok {
+			delete(c.handles, handle)
+		}
+	}
+}
+
+// trackResponse records the handles returned for the open requests and
+// signals the completed requests
+func (c *extensionsChannel) trackResponse(packet []byte) {
+	if len(packet) < 9 {
+		return
+	}
+	id := binary.BigEndian.Uint32(packet[5:9])
+	c.requestsLock.Lock()
+	defer c.requestsLock.Unlock()
+	if sftpPath, ok := c.opens[id]; ok {
+		if packet[4] == sftpPacketHandle {
+			if handle, _, ok := parseSFTPString(packet[9:]); ok {
+				c.handles[handle] = sftpPath
+			}
+		}
+		delete(c.opens, id)
+	}
+	if c.pending[id] {
+		delete(c.pending, id)
+		c.requestsCond.Broadcast()
+	}
+}
+
+func (c Connection) getExtensionErrorCode(err error) uint32 {
+	if err == errExtensionUnsupported {
+		return sftpStatusOpUnsupported
+	}
+	if err == sftp.ErrSSHFxPermissionDenied {
+		return sftpStatusPermDenied
+	}
+	if c.fs.IsNotExist(err) {
+		return sftpStatusNoSuchFile
+	}
+	if c.fs.IsPermission(err) {
+		return sftpStatusPermDenied
+	}
+	return sftpStatusFailure
+}
+
+// syncFile commits the data written for the upload to the given SFTP path to stable storage
+func (c Connection) syncFile(sftpPath string) error {
+	p, err := c.fs.ResolvePath(path.Clean("/" + sftpPath))
+	if err != nil {
+		return err
+	}
+	transfer := getConnectionTransfer(c.ID, p)
+	if transfer == nil {
+		return errExtensionUnsupported
+	}
+	return transfer.Sync()
+}
+
+// parseExtendedRequest returns the request id, the extended request name and the
+// request specific data if the given packet, without the length, is an extended request
+func parseExtendedRequest(packet []byte) (uint32, string, []byte, bool) {
+	if len(packet) < 5 || packet[0] != sftpPacketExtended {
+		return 0, "", nil, false
+	}
+	id := binary.BigEndian.Uint32(packet[1:5])
+	request, data, ok := parseSFTPString(packet[5:])
+	if !ok {
+		return 0, "", nil, false
+	}
+	return id, request, data, true
+}
+
+func parseSFTPString(data []byte) (string, []byte, bool) {
+	if len(data) < 4 {
+		return "", data, false
+	}
+	length := binary.BigEndian.Uint32(data)
+	if uint64(len(data)-4) < uint64(length) {
+		return "", data, false
+	}
+	return string(data[4 : 4+length]), data[4+length:], true
+}
+
+func appendSFTPString(data []byte, s string) []byte {
+	data = append(data, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], uint32(len(s)))
+	return append(data, s...)
+}
+
+func getSFTPStatusPacket(id, code uint32, msg string) []byte {
+	packet := []byte{0, 0, 0, 0, sftpPacketStatus, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(packet[5:], id)
+	binary.BigEndian.PutUint32(packet[9:], code)
+	packet = appendSFTPString(packet, msg)
+	packet = appendSFTPString(packet, "")
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	return packet
+}
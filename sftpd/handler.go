@@ -8,11 +8,13 @@ import (
 	"sync"
 	"time"
 
+	"github.com/drakkan/sftpgo/audit"
 	"github.com/drakkan/sftpgo/vfs"
 	"golang.org/x/crypto/ssh"
 
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 
 	"github.com/pkg/sftp"
 )
@@ -43,9 +45,22 @@ func (c Connection) Log(level logger.LogLevel, sender string, format string, v .
 	logger.Log(level, sender, c.ID, format, v...)
 }
 
+func (c Connection) getRemoteIP() string {
+	if c.RemoteAddr == nil {
+		return ""
+	}
+	return utils.GetIPFromRemoteAddress(c.RemoteAddr.String())
+}
+
 // Fileread creates a reader for a file on the system and returns the reader back.
-func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
+func (c Connection) Fileread(request *sftp.Request) (reader io.ReaderAt, err error) {
 	updateConnectionActivity(c.ID)
+	defer func() { c.auditPermissionDenied(request, err) }()
+
+	if isShuttingDown() {
+		c.Log(logger.LevelInfo, logSender, "denying file read for %#v: %v", request.Filepath, errServerShuttingDown)
+		return nil, sftp.ErrSSHFxFailure
+	}
 
 	if !c.User.HasPerm(dataprovider.PermDownload, path.Dir(request.Filepath)) {
 		return nil, sftp.ErrSSHFxPermissionDenied
@@ -66,6 +81,11 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 		return nil, vfs.GetSFTPError(c.fs, err)
 	}
 
+	maxDataTransfer, err := c.getMaxDataTransfer(false)
+	if err != nil {
+		return nil, err
+	}
+
 	file, r, cancelFn, err := c.fs.Open(p)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "could not open file %#v for reading: %+v", p, err)
@@ -75,33 +95,41 @@ func (c Connection) Fileread(request *sftp.Request) (io.ReaderAt, error) {
 	c.Log(logger.LevelDebug, logSender, "fileread requested for path: %#v", p)
 
 	transfer := Transfer{
-		file:           file,
-		readerAt:       r,
-		writerAt:       nil,
-		cancelFn:       cancelFn,
-		path:           p,
-		start:          time.Now(),
-		bytesSent:      0,
-		bytesReceived:  0,
-		user:           c.User,
-		connectionID:   c.ID,
-		transferType:   transferDownload,
-		lastActivity:   time.Now(),
-		isNewFile:      false,
-		protocol:       c.protocol,
-		transferError:  nil,
-		isFinished:     false,
-		minWriteOffset: 0,
-		expectedSize:   fi.Size(),
-		lock:           new(sync.Mutex),
+		file:            file,
+		readerAt:        r,
+		writerAt:        nil,
+		cancelFn:        cancelFn,
+		path:            p,
+		start:           time.Now(),
+		bytesSent:       0,
+		bytesReceived:   0,
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        c.getRemoteIP(),
+		transferType:    transferDownload,
+		lastActivity:    time.Now(),
+		isNewFile:       false,
+		protocol:        c.protocol,
+		transferError:   nil,
+		isFinished:      false,
+		minWriteOffset:  0,
+		expectedSize:    fi.Size(),
+		maxDataTransfer: maxDataTransfer,
+		lock:            new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
 }
 
 // Filewrite handles the write actions for a file on the system.
-func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
+func (c Connection) Filewrite(request *sftp.Request) (writer io.WriterAt, err error) {
 	updateConnectionActivity(c.ID)
+	defer func() { c.auditPermissionDenied(request, err) }()
+
+	if isShuttingDown() {
+		c.Log(logger.LevelInfo, logSender, "denying file write for %#v: %v", request.Filepath, errServerShuttingDown)
+		return nil, sftp.ErrSSHFxFailure
+	}
 
 	if !c.User.IsFileAllowed(request.Filepath) {
 		c.Log(logger.LevelWarn, logSender, "writing file %#v is not allowed", request.Filepath)
@@ -114,7 +142,7 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 	}
 
 	filePath := p
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
+	if isAtomicUploadEnabled(c.User) && c.fs.IsAtomicUploadSupported() {
 		filePath = c.fs.GetAtomicUploadPath(p)
 	}
 
@@ -146,8 +174,9 @@ func (c Connection) Filewrite(request *sftp.Request) (io.WriterAt, error) {
 
 // Filecmd hander for basic SFTP system calls related to files, but not anything to do with reading
 // or writing to those files.
-func (c Connection) Filecmd(request *sftp.Request) error {
+func (c Connection) Filecmd(request *sftp.Request) (err error) {
 	updateConnectionActivity(c.ID)
+	defer func() { c.auditPermissionDenied(request, err) }()
 
 	p, err := c.fs.ResolvePath(request.Filepath)
 	if err != nil {
@@ -183,6 +212,11 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 			return err
 		}
 		break
+	case "Link":
+		if err = c.handleSFTPLink(p, target, request); err != nil {
+			return err
+		}
+		break
 	case "Remove":
 		return c.handleSFTPRemove(p, request)
 
@@ -203,8 +237,9 @@ func (c Connection) Filecmd(request *sftp.Request) error {
 
 // Filelist is the handler for SFTP filesystem list calls. This will handle calls to list the contents of
 // a directory as well as perform file/folder stat calls.
-func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
+func (c Connection) Filelist(request *sftp.Request) (lister sftp.ListerAt, err error) {
 	updateConnectionActivity(c.ID)
+	defer func() { c.auditPermissionDenied(request, err) }()
 	p, err := c.fs.ResolvePath(request.Filepath)
 	if err != nil {
 		return nil, vfs.GetSFTPError(c.fs, err)
@@ -237,11 +272,41 @@ func (c Connection) Filelist(request *sftp.Request) (sftp.ListerAt, error) {
 		}
 
 		return listerAt([]os.FileInfo{s}), nil
+	case "Readlink":
+		if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(request.Filepath)) {
+			return nil, sftp.ErrSSHFxPermissionDenied
+		}
+
+		c.Log(logger.LevelDebug, logSender, "requested readlink for path: %#v", p)
+		s, err := c.fs.Readlink(p)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "error running readlink on path: %+v", err)
+			return nil, vfs.GetSFTPError(c.fs, err)
+		}
+
+		return listerAt([]os.FileInfo{vfs.NewFileInfo(s, false, 0, time.Now())}), nil
 	default:
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 }
 
+// auditPermissionDenied emits a permission denied audit event if the request was denied
+func (c Connection) auditPermissionDenied(request *sftp.Request, err error) {
+	if err != sftp.ErrSSHFxPermissionDenied {
+		return
+	}
+	audit.Log(audit.Event{
+		Event:        audit.EventPermissionDenied,
+		Username:     c.User.Username,
+		Protocol:     c.protocol,
+		ConnectionID: c.ID,
+		RemoteIP:     c.getRemoteIP(),
+		Path:         request.Filepath,
+		TargetPath:   request.Target,
+		Operation:    request.Method,
+	})
+}
+
 func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 	var target string
 	// If a target is provided in this request validate that it is going to the correct
@@ -257,7 +322,7 @@ func (c Connection) getSFTPCmdTargetPath(requestTarget string) (string, error) {
 }
 
 func (c Connection) handleSFTPSetstat(filePath string, request *sftp.Request) error {
-	if setstatMode == 1 {
+	if isSetstatIgnored(c.User) {
 		return nil
 	}
 	pathForPerms := request.Filepath
@@ -330,11 +395,30 @@ func (c Connection) handleSFTPRename(sourcePath string, targetPath string, reque
 	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(request.Target)) {
 		return sftp.ErrSSHFxPermissionDenied
 	}
+	// renaming a file from or to a virtual folder excluded from the quota changes the used quota
+	var quotaFileInfo os.FileInfo
+	if c.User.IsFileExcludedFromQuota(sourcePath) != c.User.IsFileExcludedFromQuota(targetPath) {
+		fi, err := c.fs.Lstat(sourcePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "failed to rename %#v: stat error: %+v", sourcePath, err)
+			return vfs.GetSFTPError(c.fs, err)
+		}
+		if fi.IsDir() {
+			c.Log(logger.LevelDebug, logSender, "renaming a directory between folders with different quota settings is not allowed, "+
+				"source: %#v target: %#v", request.Filepath, request.Target)
+			return sftp.ErrSSHFxOpUnsupported
+		}
+		quotaFileInfo = fi
+	}
 	if err := c.fs.Rename(sourcePath, targetPath); err != nil {
 		c.Log(logger.LevelWarn, logSender, "failed to rename file, source: %#v target: %#v: %+v", sourcePath, targetPath, err)
 		return vfs.GetSFTPError(c.fs, err)
 	}
 	logger.CommandLog(renameLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventRename, c.User.Username, c.protocol, c.ID, c.getRemoteIP(), sourcePath, targetPath)
+	if quotaFileInfo != nil && quotaFileInfo.Mode().IsRegular() {
+		dataprovider.UpdateUserQuotaForRename(dataProvider, c.User, sourcePath, targetPath, quotaFileInfo.Size())
+	}
 	go executeAction(operationRename, c.User.Username, sourcePath, targetPath, "", 0, vfs.IsLocalOsFs(c.fs))
 	return nil
 }
@@ -369,6 +453,7 @@ func (c Connection) handleSFTPRmdir(dirPath string, request *sftp.Request) error
 	}
 
 	logger.CommandLog(rmdirLogSender, dirPath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, c.protocol, c.ID, c.getRemoteIP(), dirPath, "")
 	return sftp.ErrSSHFxOk
 }
 
@@ -393,6 +478,58 @@ func (c Connection) handleSFTPSymlink(sourcePath string, targetPath string, requ
 	return nil
 }
 
+// handleSFTPLink creates a hard link, both the source and the target paths are
+// already resolved inside the user home dir or inside the virtual folders
+func (c Connection) handleSFTPLink(sourcePath string, targetPath string, request *sftp.Request) error {
+	if c.User.IsVirtualFolder(request.Filepath) || c.User.IsVirtualFolder(request.Target) {
+		c.Log(logger.LevelWarn, logSender, "hard linking a virtual folder is not allowed")
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.User.HasPerm(dataprovider.PermCreateSymlinks, path.Dir(request.Target)) {
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	// the link exposes the source contents inside the target directory, so the source
+	// must be readable too, otherwise the per-directory permissions could be bypassed
+	if !c.User.HasPerms([]string{dataprovider.PermListItems, dataprovider.PermDownload}, path.Dir(request.Filepath)) {
+		c.Log(logger.LevelDebug, logSender, "hard link not allowed, the source %#v is not readable", request.Filepath)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	if !c.User.IsFileAllowed(request.Filepath) || !c.User.IsFileAllowed(request.Target) {
+		c.Log(logger.LevelDebug, logSender, "hard link not allowed, source: %#v target: %#v", request.Filepath,
+			request.Target)
+		return sftp.ErrSSHFxPermissionDenied
+	}
+	fi, err := c.fs.Lstat(sourcePath)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to create hard link for %#v: stat error: %+v", sourcePath, err)
+		return vfs.GetSFTPError(c.fs, err)
+	}
+	if !fi.Mode().IsRegular() {
+		c.Log(logger.LevelDebug, logSender, "cannot create a hard link for %#v, it is not a regular file", sourcePath)
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	if c.User.IsFileExcludedFromQuota(sourcePath) != c.User.IsFileExcludedFromQuota(targetPath) {
+		c.Log(logger.LevelDebug, logSender, "hard links between folders with different quota settings are not allowed, "+
+			"source: %#v target: %#v", request.Filepath, request.Target)
+		return sftp.ErrSSHFxOpUnsupported
+	}
+	// the link is counted as a new file, it is removed from the quota as any other file
+	if !c.hasSpace(true, targetPath) {
+		c.Log(logger.LevelInfo, logSender, "denying hard link creation, quota exceeded, target: %#v", targetPath)
+		return sftp.ErrSSHFxFailure
+	}
+	if err := c.fs.Link(sourcePath, targetPath); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to create hard link %#v -> %#v: %+v", sourcePath, targetPath, err)
+		return vfs.GetSFTPError(c.fs, err)
+	}
+
+	logger.CommandLog(linkLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
+	if !c.User.IsFileExcludedFromQuota(targetPath) {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, 1, fi.Size(), false)
+	}
+	return nil
+}
+
 func (c Connection) handleSFTPMkdir(dirPath string, request *sftp.Request) error {
 	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(request.Filepath)) {
 		return sftp.ErrSSHFxPermissionDenied
@@ -440,7 +577,8 @@ func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) err
 	}
 
 	logger.CommandLog(removeLogSender, filePath, "", c.User.Username, "", c.ID, c.protocol, -1, -1, "", "", "")
-	if fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+	audit.LogOperation(audit.EventDelete, c.User.Username, c.protocol, c.ID, c.getRemoteIP(), filePath, "")
+	if fi.Mode()&os.ModeSymlink != os.ModeSymlink && !c.User.IsFileExcludedFromQuota(filePath) {
 		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -size, false)
 	}
 	go executeAction(operationDelete, c.User.Username, filePath, "", "", fi.Size(), vfs.IsLocalOsFs(c.fs))
@@ -449,11 +587,16 @@ func (c Connection) handleSFTPRemove(filePath string, request *sftp.Request) err
 }
 
 func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.WriterAt, error) {
-	if !c.hasSpace(true) {
+	if !c.hasSpace(true, requestPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+
 	file, w, cancelFn, err := c.fs.Create(filePath, 0)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %+v", requestPath, err)
@@ -463,24 +606,28 @@ func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.
 	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
 
 	transfer := Transfer{
-		file:           file,
-		writerAt:       w,
-		readerAt:       nil,
-		cancelFn:       cancelFn,
-		path:           requestPath,
-		start:          time.Now(),
-		bytesSent:      0,
-		bytesReceived:  0,
-		user:           c.User,
-		connectionID:   c.ID,
-		transferType:   transferUpload,
-		lastActivity:   time.Now(),
-		isNewFile:      true,
-		protocol:       c.protocol,
-		transferError:  nil,
-		isFinished:     false,
-		minWriteOffset: 0,
-		lock:           new(sync.Mutex),
+		file:            file,
+		writerAt:        w,
+		readerAt:        nil,
+		cancelFn:        cancelFn,
+		path:            requestPath,
+		start:           time.Now(),
+		bytesSent:       0,
+		bytesReceived:   0,
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        c.getRemoteIP(),
+		transferType:    transferUpload,
+		lastActivity:    time.Now(),
+		isNewFile:       true,
+		protocol:        c.protocol,
+		transferError:   nil,
+		isFinished:      false,
+		minWriteOffset:  0,
+		maxDataTransfer: maxDataTransfer,
+		fs:              c.fs,
+		checksum:        NewUploadChecksum(),
+		lock:            new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
@@ -489,11 +636,16 @@ func (c Connection) handleSFTPUploadToNewFile(requestPath, filePath string) (io.
 func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, requestPath, filePath string,
 	fileSize int64) (io.WriterAt, error) {
 	var err error
-	if !c.hasSpace(false) {
+	if !c.hasSpace(false, requestPath) {
 		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
 		return nil, sftp.ErrSSHFxFailure
 	}
 
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+
 	minWriteOffset := int64(0)
 	osFlags := getOSOpenFlags(pflags)
 
@@ -503,7 +655,7 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		return nil, sftp.ErrSSHFxOpUnsupported
 	}
 
-	if isAtomicUploadEnabled() && c.fs.IsAtomicUploadSupported() {
+	if isAtomicUploadEnabled(c.User) && c.fs.IsAtomicUploadSupported() {
 		err = c.fs.Rename(requestPath, filePath)
 		if err != nil {
 			c.Log(logger.LevelWarn, logSender, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %+v",
@@ -512,7 +664,12 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		}
 	}
 
-	file, w, cancelFn, err := c.fs.Create(filePath, osFlags)
+	createFlags := osFlags
+	if pflags.Append && osFlags&os.O_TRUNC == 0 && !vfs.IsLocalOsFs(c.fs) {
+		// cloud backends resume the interrupted uploads only if explicitly requested
+		createFlags |= os.O_APPEND
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, createFlags)
 	if err != nil {
 		c.Log(logger.LevelWarn, logSender, "error opening existing file, flags: %v, source: %#v, err: %+v", pflags, filePath, err)
 		return nil, vfs.GetSFTPError(c.fs, err)
@@ -524,7 +681,9 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 		minWriteOffset = fileSize
 	} else {
 		if vfs.IsLocalOsFs(c.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+			if !c.User.IsFileExcludedFromQuota(requestPath) {
+				dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+			}
 		} else {
 			initialSize = fileSize
 		}
@@ -533,31 +692,38 @@ func (c Connection) handleSFTPUploadToExistingFile(pflags sftp.FileOpenFlags, re
 	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
 
 	transfer := Transfer{
-		file:           file,
-		writerAt:       w,
-		readerAt:       nil,
-		cancelFn:       cancelFn,
-		path:           requestPath,
-		start:          time.Now(),
-		bytesSent:      0,
-		bytesReceived:  0,
-		user:           c.User,
-		connectionID:   c.ID,
-		transferType:   transferUpload,
-		lastActivity:   time.Now(),
-		isNewFile:      false,
-		protocol:       c.protocol,
-		transferError:  nil,
-		isFinished:     false,
-		minWriteOffset: minWriteOffset,
-		initialSize:    initialSize,
-		lock:           new(sync.Mutex),
+		file:            file,
+		writerAt:        w,
+		readerAt:        nil,
+		cancelFn:        cancelFn,
+		path:            requestPath,
+		start:           time.Now(),
+		bytesSent:       0,
+		bytesReceived:   0,
+		user:            c.User,
+		connectionID:    c.ID,
+		remoteIP:        c.getRemoteIP(),
+		transferType:    transferUpload,
+		lastActivity:    time.Now(),
+		isNewFile:       false,
+		protocol:        c.protocol,
+		transferError:   nil,
+		isFinished:      false,
+		minWriteOffset:  minWriteOffset,
+		initialSize:     initialSize,
+		maxDataTransfer: maxDataTransfer,
+		fs:              c.fs,
+		checksum:        NewUploadChecksum(),
+		lock:            new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 	return &transfer, nil
 }
 
-func (c Connection) hasSpace(checkFiles bool) bool {
+func (c Connection) hasSpace(checkFiles bool, fsPath string) bool {
+	if c.User.IsFileExcludedFromQuota(fsPath) {
+		return true
+	}
 	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
 		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
 		if err != nil {
@@ -578,6 +744,33 @@ func (c Connection) hasSpace(checkFiles bool) bool {
 	return true
 }
 
+// getMaxDataTransfer returns the data transfer, as bytes, still allowed for a new upload or download,
+// 0 means no limit. An error is returned if the data transfer quota is exceeded
+func (c Connection) getMaxDataTransfer(isUpload bool) (int64, error) {
+	if !c.User.HasDataTransferRestrictions() {
+		return 0, nil
+	}
+	remaining, err := dataprovider.GetRemainingDataTransfer(dataProvider, c.User, isUpload)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, logSender, "data transfer quota enforcement not possible for user %#v: %v",
+				c.User.Username, err)
+			return 0, nil
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used data transfer for %#v: %v", c.User.Username, err)
+		return 0, sftp.ErrSSHFxFailure
+	}
+	if remaining == 0 {
+		c.Log(logger.LevelInfo, logSender, "data transfer quota exceeded for user %#v, is upload? %v", c.User.Username,
+			isUpload)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
+
 func (c Connection) close() error {
 	if c.channel != nil {
 		err := c.channel.Close()
@@ -2,11 +2,20 @@ package sftpd
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -19,7 +28,9 @@ import (
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/drakkan/sftpgo/vfs"
 	"github.com/eikenb/pipeat"
+	"github.com/pires/go-proxyproto"
 	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
 )
 
 type MockChannel struct {
@@ -162,6 +173,204 @@ func TestActionHTTP(t *testing.T) {
 	actions = actionsCopy
 }
 
+func TestActionHTTPPost(t *testing.T) {
+	actionsCopy := actions
+	var attempts int
+	notifications := make(chan actionNotification, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		var notification actionNotification
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&notification) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		notifications <- notification
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	actions = Actions{
+		ExecuteOn:               []string{operationRename},
+		HTTPNotificationURL:     server.URL,
+		HTTPNotificationMethod:  http.MethodPost,
+		HTTPNotificationTimeout: 5,
+		HTTPNotificationRetries: 1,
+	}
+	err := executeAction(operationRename, "username", "/path", "/target", "", 0, true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("the notification must be retried, attempts: %v", attempts)
+	}
+	select {
+	case notification := <-notifications:
+		if notification.Action != operationRename || notification.Username != "username" || notification.Path != "/path" ||
+			notification.TargetPath != "/target" || !notification.LocalFile || notification.Status != 1 {
+			t.Errorf("unexpected notification: %+v", notification)
+		}
+	default:
+		t.Error("notification not received")
+	}
+	// client errors must not be retried
+	attempts = 1
+	actions.HTTPNotificationMethod = http.MethodGet
+	actions.HTTPNotificationRetries = 2
+	err = executeAction(operationRename, "username", "/path", "/target", "", 0, true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("unexpected attempts: %v", attempts)
+	}
+
+	actions = actionsCopy
+}
+
+func TestCheckActions(t *testing.T) {
+	c := Configuration{}
+	c.checkActions()
+	if c.Actions.HTTPNotificationMethod != http.MethodGet {
+		t.Errorf("unexpected method: %v", c.Actions.HTTPNotificationMethod)
+	}
+	c.Actions.HTTPNotificationMethod = http.MethodPut
+	c.Actions.HTTPNotificationRetries = -1
+	c.checkActions()
+	if c.Actions.HTTPNotificationMethod != http.MethodGet {
+		t.Errorf("unsupported methods must fallback to GET: %v", c.Actions.HTTPNotificationMethod)
+	}
+	if c.Actions.HTTPNotificationRetries != 0 {
+		t.Errorf("unexpected retries: %v", c.Actions.HTTPNotificationRetries)
+	}
+}
+
+func TestCheckUploadPipeline(t *testing.T) {
+	invalidSteps := []PipelineStep{
+		{Type: "unknown"},
+		{Type: PipelineStepChecksum, Algorithm: "crc32"},
+		{Type: PipelineStepWebhook, URL: "ftp://127.0.0.1"},
+		{Type: PipelineStepWebhook, URL: "http://127.0.0.1", Timeout: -1},
+		{Type: PipelineStepMove, TargetDir: "relative"},
+		{Type: PipelineStepCopy},
+		{Type: PipelineStepChecksum, Retries: -1},
+		{Type: PipelineStepChecksum, OnFailure: "unknown"},
+	}
+	for _, step := range invalidSteps {
+		c := Configuration{}
+		c.Actions.UploadPipeline = []PipelineStep{step}
+		if err := c.checkUploadPipeline(); err == nil {
+			t.Errorf("step %+v must be invalid", step)
+		}
+	}
+	c := Configuration{}
+	c.Actions.UploadPipeline = []PipelineStep{
+		{Type: PipelineStepChecksum},
+		{Type: PipelineStepWebhook, URL: "https://127.0.0.1/hook"},
+	}
+	if err := c.checkUploadPipeline(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c.Actions.UploadPipeline[0].Algorithm != defaultPipelineChecksum || c.Actions.UploadPipeline[1].Timeout != 15 ||
+		c.Actions.UploadPipeline[1].OnFailure != PipelineOnFailureContinue {
+		t.Errorf("unexpected defaults: %+v", c.Actions.UploadPipeline)
+	}
+}
+
+func TestUploadPipeline(t *testing.T) {
+	actionsCopy := actions
+	defer func() {
+		actions = actionsCopy
+	}()
+	baseDir := filepath.Join(os.TempDir(), "upload_pipeline")
+	os.RemoveAll(baseDir)
+	defer os.RemoveAll(baseDir)
+	uploadDir := filepath.Join(baseDir, "upload")
+	processedDir := filepath.Join(baseDir, "processed")
+	copyDir := filepath.Join(baseDir, "copy")
+	if err := os.MkdirAll(uploadDir, 0700); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	notifications := make(chan pipelineNotification, 5)
+	rejectWebhook := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification pipelineNotification
+		if rejectWebhook || json.NewDecoder(r.Body).Decode(&notification) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		notifications <- notification
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	c := Configuration{}
+	c.Actions.UploadPipeline = []PipelineStep{
+		{Type: PipelineStepChecksum},
+		{Type: PipelineStepCopy, TargetDir: copyDir},
+		{Type: PipelineStepWebhook, URL: server.URL, OnFailure: PipelineOnFailureStop},
+		{Type: PipelineStepMove, TargetDir: processedDir},
+	}
+	if err := c.checkUploadPipeline(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	actions = c.Actions
+	content := []byte("pipeline content")
+	uploadPath := filepath.Join(uploadDir, "file.txt")
+	if err := ioutil.WriteFile(uploadPath, content, 0600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	finalPath := executeUploadPipeline(actions.UploadPipeline, "user", uploadPath, int64(len(content)))
+	movedPath := filepath.Join(processedDir, "user", "file.txt")
+	if finalPath != movedPath {
+		t.Errorf("unexpected final path: %#v", finalPath)
+	}
+	checksum, _ := computeHashForFile(getHasher("sha256"), movedPath)
+	sidecar, err := ioutil.ReadFile(movedPath + ".sha256")
+	if err != nil || string(sidecar) != checksum+"  file.txt\n" {
+		t.Errorf("unexpected sidecar content: %#v, err: %v", string(sidecar), err)
+	}
+	if _, err = os.Stat(filepath.Join(copyDir, "user", "file.txt.sha256")); err != nil {
+		t.Errorf("the sidecar file must be copied: %v", err)
+	}
+	if _, err = os.Stat(uploadPath); !os.IsNotExist(err) {
+		t.Errorf("the uploaded file must be moved: %v", err)
+	}
+	select {
+	case notification := <-notifications:
+		if notification.Username != "user" || notification.Path != uploadPath ||
+			notification.FileSize != int64(len(content)) || notification.Checksums["sha256"] != checksum {
+			t.Errorf("unexpected notification: %+v", notification)
+		}
+	default:
+		t.Error("webhook notification not received")
+	}
+	// a failed webhook stops the pipeline, the file is not moved
+	rejectWebhook = true
+	if err = ioutil.WriteFile(uploadPath, content, 0600); err != nil {
+		t.Fatalf("unable to write file: %v", err)
+	}
+	err = executeAction(operationUpload, "user", uploadPath, "", "", int64(len(content)), true)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = os.Stat(uploadPath); err != nil {
+		t.Errorf("the pipeline must be stopped: %v", err)
+	}
+	// the pipeline is not executed for files not stored on the local filesystem
+	os.Remove(uploadPath + ".sha256")
+	err = executeAction(operationUpload, "user", uploadPath, "", "", int64(len(content)), false)
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err = os.Stat(uploadPath + ".sha256"); !os.IsNotExist(err) {
+		t.Errorf("the pipeline must not be executed for non local files: %v", err)
+	}
+}
+
 func TestRemoveNonexistentTransfer(t *testing.T) {
 	transfer := Transfer{}
 	err := removeTransfer(&transfer)
@@ -225,6 +434,101 @@ func TestUploadResumeInvalidOffset(t *testing.T) {
 	os.Remove(testfile)
 }
 
+func TestTransferSync(t *testing.T) {
+	testfile := filepath.Join(os.TempDir(), "sync_testfile")
+	file, _ := os.Create(testfile)
+	connection := Connection{
+		ID: "fsync_id",
+		fs: vfs.NewOsFs("fsync_id", os.TempDir(), nil),
+	}
+	transfer := Transfer{
+		file:         file,
+		path:         file.Name(),
+		start:        time.Now(),
+		connectionID: connection.ID,
+		transferType: transferUpload,
+		lastActivity: time.Now(),
+		protocol:     protocolSFTP,
+		lock:         new(sync.Mutex),
+	}
+	addTransfer(&transfer)
+	if err := connection.syncFile("sync_testfile"); err != nil {
+		t.Errorf("unexpected sync error: %v", err)
+	}
+	if err := connection.syncFile("/missing"); err != errExtensionUnsupported {
+		t.Errorf("sync without an active upload must be unsupported, err: %v", err)
+	}
+	transfer.file = nil
+	if err := transfer.Sync(); err != errExtensionUnsupported {
+		t.Errorf("sync without a local file must be unsupported, err: %v", err)
+	}
+	transfer.file = file
+	if err := transfer.Close(); err != nil {
+		t.Errorf("unexpected close error: %v", err)
+	}
+	if err := transfer.Sync(); err != errTransferClosed {
+		t.Errorf("sync for a closed transfer must fail, err: %v", err)
+	}
+	if getConnectionTransfer(connection.ID, file.Name()) != nil {
+		t.Error("closed transfers must be removed")
+	}
+	os.Remove(testfile)
+}
+
+func TestTransferSyncPipe(t *testing.T) {
+	r, w, err := pipeat.PipeInDir(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to create pipe: %v", err)
+	}
+	transfer := Transfer{
+		writerAt:     w,
+		transferType: transferUpload,
+		lock:         new(sync.Mutex),
+	}
+	if err := transfer.Sync(); err != errExtensionUnsupported {
+		t.Errorf("sync for a pipe without an upload must be unsupported, err: %v", err)
+	}
+	r.Close()
+	w.Close()
+	// the uploads streamed to the backends, an encrypted filesystem in this test, can be flushed
+	passphrase, err := utils.EncryptData("sync passphrase")
+	if err != nil {
+		t.Fatalf("unable to encrypt passphrase: %v", err)
+	}
+	fs, err := vfs.NewCryptFs(vfs.NewOsFs("sync_id", os.TempDir(), nil), os.TempDir(),
+		vfs.CryptFsConfig{Passphrase: passphrase})
+	if err != nil {
+		t.Fatalf("unable to create crypt fs: %v", err)
+	}
+	testfile := filepath.Join(os.TempDir(), "sync_crypt_testfile")
+	_, cryptWriter, _, err := fs.Create(testfile, 0)
+	if err != nil {
+		t.Fatalf("unable to create file: %v", err)
+	}
+	transfer.writerAt = cryptWriter
+	data := []byte("data to sync")
+	if _, err = cryptWriter.WriteAt(data, 0); err != nil {
+		t.Errorf("unable to write data: %v", err)
+	}
+	if err = transfer.Sync(); err != nil {
+		t.Errorf("unexpected sync error: %v", err)
+	}
+	if err = cryptWriter.Close(); err != nil {
+		t.Errorf("unable to close the writer: %v", err)
+	}
+	// the upload is completed, there is nothing to flush
+	if err = transfer.Sync(); err != errExtensionUnsupported {
+		t.Errorf("sync for a completed upload must be unsupported, err: %v", err)
+	}
+	info, err := fs.Stat(testfile)
+	if err != nil {
+		t.Errorf("unable to stat the uploaded file: %v", err)
+	} else if info.Size() != int64(len(data)) {
+		t.Errorf("unexpected size: %v", info.Size())
+	}
+	os.Remove(testfile)
+}
+
 func TestReadWriteErrors(t *testing.T) {
 	testfile := "testfile"
 	file, _ := os.Create(testfile)
@@ -504,6 +808,49 @@ func TestSetstatModeIgnore(t *testing.T) {
 	setstatMode = originalMode
 }
 
+func TestUserUploadAndSetstatModes(t *testing.T) {
+	oldUploadMode := uploadMode
+	oldSetstatMode := setstatMode
+	defer func() {
+		uploadMode = oldUploadMode
+		setstatMode = oldSetstatMode
+	}()
+	uploadMode = uploadModeAtomic
+	setstatMode = 0
+	user := dataprovider.User{}
+	if GetUserUploadMode(user) != uploadModeAtomic || !isAtomicUploadEnabled(user) {
+		t.Error("the global upload mode must be used if the user has no override")
+	}
+	user.Filters.UploadMode = dataprovider.UploadModeStandard
+	if GetUserUploadMode(user) != uploadModeStandard || isAtomicUploadEnabled(user) {
+		t.Error("the user upload mode must have precedence")
+	}
+	user.Filters.UploadMode = dataprovider.UploadModeAtomicWithResume
+	if GetUserUploadMode(user) != uploadModeAtomicWithResume || !isAtomicUploadEnabled(user) {
+		t.Error("the user upload mode must have precedence")
+	}
+	if isSetstatIgnored(user) {
+		t.Error("setstat must not be ignored")
+	}
+	user.Filters.SetstatMode = dataprovider.SetstatModeIgnore
+	connection := Connection{
+		User: user,
+	}
+	err := connection.handleSFTPSetstat("invalid", nil)
+	if err != nil {
+		t.Errorf("unexpected error: %v setstat should be silently ignored", err)
+	}
+	setstatMode = 1
+	user.Filters.SetstatMode = dataprovider.SetstatModeNormal
+	if isSetstatIgnored(user) {
+		t.Error("the user setstat mode must have precedence")
+	}
+	user.Filters.SetstatMode = ""
+	if !isSetstatIgnored(user) {
+		t.Error("the global setstat mode must be used if the user has no override")
+	}
+}
+
 func TestSFTPGetUsedQuota(t *testing.T) {
 	u := dataprovider.User{}
 	u.HomeDir = "home_rel_path"
@@ -515,7 +862,7 @@ func TestSFTPGetUsedQuota(t *testing.T) {
 	connection := Connection{
 		User: u,
 	}
-	res := connection.hasSpace(false)
+	res := connection.hasSpace(false, "")
 	if res != false {
 		t.Errorf("has space must return false if the user is invalid")
 	}
@@ -876,6 +1223,55 @@ func TestSSHCommandQuotaScan(t *testing.T) {
 	}
 }
 
+func TestGitArgs(t *testing.T) {
+	permissions := make(map[string][]string)
+	permissions["/"] = []string{dataprovider.PermAny}
+	user := dataprovider.User{
+		Permissions: permissions,
+		HomeDir:     os.TempDir(),
+	}
+	fs, _ := user.GetFilesystem("123")
+	conn := Connection{
+		User: user,
+		fs:   fs,
+	}
+	cmd := sshCommand{
+		command:    "git-upload-pack",
+		connection: conn,
+		args:       []string{"--strict", "/repo"},
+	}
+	_, err := cmd.getSystemCommand()
+	if err != errUnsupportedConfig {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cmd.args = []string{"--advertise-refs"}
+	_, err = cmd.getSystemCommand()
+	if err != errUnsupportedConfig {
+		t.Errorf("unexpected error: %v", err)
+	}
+	cmd.args = []string{"'/repo'"}
+	systemCmd, err := cmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !systemCmd.readOnly {
+		t.Error("git-upload-pack must be read only")
+	}
+	if !utils.IsStringInSlice("core.hooksPath="+os.DevNull, systemCmd.cmd.Args) ||
+		!utils.IsStringInSlice("upload-pack", systemCmd.cmd.Args) ||
+		!utils.IsStringInSlice(filepath.Join(os.TempDir(), "repo"), systemCmd.cmd.Args) {
+		t.Errorf("unexpected args: %v", systemCmd.cmd.Args)
+	}
+	cmd.command = "git-receive-pack"
+	systemCmd, err = cmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if systemCmd.readOnly {
+		t.Error("git-receive-pack must not be read only")
+	}
+}
+
 func TestGitVirtualFolders(t *testing.T) {
 	permissions := make(map[string][]string)
 	permissions["/"] = []string{dataprovider.PermAny}
@@ -972,6 +1368,100 @@ func TestRsyncOptions(t *testing.T) {
 	}
 }
 
+func TestRsyncArgs(t *testing.T) {
+	permissions := make(map[string][]string)
+	permissions["/"] = []string{dataprovider.PermAny}
+	user := dataprovider.User{
+		Permissions: permissions,
+		HomeDir:     os.TempDir(),
+	}
+	fs, _ := user.GetFilesystem("123")
+	conn := Connection{
+		User: user,
+		fs:   fs,
+	}
+	invalidArgs := [][]string{
+		{"-vlogDtprze.iLsfxC", ".", "/"},
+		{"--daemon", "--server", ".", "/"},
+		{"--server", "--log-file=/tmp/rsync.log", "-vlogDtprze.iLsfxC", ".", "/"},
+		{"--server", "--temp-dir", "/tmp", ".", "/"},
+		{"--server", "-vlogDtprTze.iLsfxC", ".", "/"},
+		{"--server", "--", ".", "/"},
+		{"--server", "-vlogDtprze.iLsfxC", "/", "/"},
+		{"--server", "-vlogDtprze.iLsfxC", "."},
+		{"--server", "-vlogDtprze.iLsfxC", ".", "/dir1", "/dir2"},
+		{"--server", "-vlogDtprze.iLsfxC", ".", "/", "--rsync-path=/tmp/cmd"},
+	}
+	for _, args := range invalidArgs {
+		sshCmd := sshCommand{
+			command:    "rsync",
+			connection: conn,
+			args:       args,
+		}
+		if _, err := sshCmd.getSystemCommand(); err != errUnsupportedConfig {
+			t.Errorf("rsync args %v must be rejected, err: %v", args, err)
+		}
+	}
+	sshCmd := sshCommand{
+		command:    "rsync",
+		connection: conn,
+		args:       []string{"--server", "--sender", "-vlogDtpre.iLsfxC", ".", "/dir1", "'/dir2/file'"},
+	}
+	cmd, err := sshCmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if !cmd.readOnly || len(cmd.sshPaths) != 2 || cmd.sshPaths[1] != "/dir2/file" {
+		t.Errorf("unexpected command: %+v", cmd)
+	}
+	if !utils.IsStringInSlice(filepath.Join(os.TempDir(), "dir1"), cmd.cmd.Args) ||
+		!utils.IsStringInSlice(filepath.Join(os.TempDir(), "dir2", "file"), cmd.cmd.Args) {
+		t.Errorf("the paths must be resolved: %v", cmd.cmd.Args)
+	}
+	sshCmd.args = []string{"--server", "--sender", "--remove-source-files", "-vlogDtpre.iLsfxC", ".", "/dir1"}
+	cmd, err = sshCmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if cmd.readOnly {
+		t.Error("rsync must not be read only if the source files are removed")
+	}
+	// read only commands require only the download and list permissions
+	buf := make([]byte, 65535)
+	stdErrBuf := make([]byte, 65535)
+	mockSSHChannel := MockChannel{
+		Buffer:       bytes.NewBuffer(buf),
+		StdErrBuffer: bytes.NewBuffer(stdErrBuf),
+	}
+	sshCmd.connection.channel = &mockSSHChannel
+	sshCmd.connection.User.Permissions = map[string][]string{
+		"/":     {dataprovider.PermListItems},
+		"/dir1": {dataprovider.PermDownload, dataprovider.PermListItems},
+	}
+	sshCmd.args = []string{"--server", "--sender", "-vlogDtpre.iLsfxC", ".", "/dir1", "/dir2"}
+	cmd, err = sshCmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = sshCmd.executeSystemCommand(cmd)
+	if err != errPermissionDenied {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// uploads are denied if the quota is exceeded
+	sshCmd.connection.User.Permissions = permissions
+	sshCmd.connection.User.QuotaSize = 100
+	sshCmd.connection.User.UsedQuotaSize = 100
+	sshCmd.args = []string{"--server", "-vlogDtpre.iLsfxC", ".", "/dir1"}
+	cmd, err = sshCmd.getSystemCommand()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = sshCmd.executeSystemCommand(cmd)
+	if err != errQuotaExceeded {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
 func TestSystemCommandErrors(t *testing.T) {
 	buf := make([]byte, 65535)
 	stdErrBuf := make([]byte, 65535)
@@ -1067,6 +1557,106 @@ func TestTransferUpdateQuota(t *testing.T) {
 	}
 }
 
+func TestTransferAbort(t *testing.T) {
+	oldUploadMode := uploadMode
+	uploadMode = uploadModeAtomic
+	defer func() {
+		uploadMode = oldUploadMode
+	}()
+	targetPath := filepath.Join(os.TempDir(), "abort_target")
+	file, err := ioutil.TempFile("", "abort_temp")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	transfer := Transfer{
+		file:         file,
+		path:         targetPath,
+		start:        time.Now(),
+		connectionID: "abort_id",
+		transferType: transferUpload,
+		isNewFile:    true,
+		lock:         new(sync.Mutex),
+	}
+	addTransfer(&transfer)
+	_, err = transfer.WriteAt([]byte("test"), 0)
+	if err != nil {
+		t.Errorf("unexpected write error: %v", err)
+	}
+	mutex.RLock()
+	transfers := getConnectionTransfers("abort_id")
+	mutex.RUnlock()
+	if len(transfers) != 1 {
+		t.Fatalf("unexpected transfers for the connection: %v", len(transfers))
+	}
+	abortTransfers(transfers)
+	_, err = transfer.WriteAt([]byte("test"), 4)
+	if err != errTransferAborted {
+		t.Errorf("unexpected write error for an aborted transfer: %v", err)
+	}
+	_, err = transfer.ReadAt(make([]byte, 4), 0)
+	if err != errTransferAborted {
+		t.Errorf("unexpected read error for an aborted transfer: %v", err)
+	}
+	err = transfer.Close()
+	if err != errTransferAborted {
+		t.Errorf("unexpected close error for an aborted transfer: %v", err)
+	}
+	if _, err = os.Stat(file.Name()); !os.IsNotExist(err) {
+		t.Errorf("the temporary file for an aborted atomic upload must be removed: %v", err)
+	}
+	if _, err = os.Stat(targetPath); !os.IsNotExist(err) {
+		t.Errorf("an aborted atomic upload must not be renamed: %v", err)
+	}
+}
+
+func TestAbortInterruptedUploads(t *testing.T) {
+	r, w, err := pipeat.AsyncWriterPipe()
+	if err != nil {
+		t.Fatalf("unable to create pipe: %v", err)
+	}
+	transfer := Transfer{
+		writerAt:       w,
+		path:           "/interrupted",
+		start:          time.Now(),
+		connectionID:   "interrupted_id",
+		transferType:   transferUpload,
+		minWriteOffset: 10,
+		lock:           new(sync.Mutex),
+	}
+	addTransfer(&transfer)
+	// for resumed uploads the pipe starts at the resume offset
+	_, err = transfer.WriteAt([]byte("test"), 10)
+	if err != nil {
+		t.Errorf("unexpected write error: %v", err)
+	}
+	_, err = transfer.WriteAt([]byte("data"), 14)
+	if err != nil {
+		t.Errorf("unexpected write error: %v", err)
+	}
+	buf := make([]byte, 4)
+	_, err = r.ReadAt(buf, 0)
+	if err != nil || string(buf) != "test" {
+		t.Errorf("unexpected pipe content: %#v, err: %v", string(buf), err)
+	}
+	abortInterruptedUploads("interrupted_id", []string{"/other"})
+	if transfer.isAborted() {
+		t.Error("the transfer for a different path must not be aborted")
+	}
+	abortInterruptedUploads("interrupted_id", []string{"/interrupted"})
+	if !transfer.isAborted() {
+		t.Error("the interrupted upload must be aborted")
+	}
+	_, err = transfer.WriteAt([]byte("test"), 18)
+	if err != errTransferAborted {
+		t.Errorf("unexpected write error for an interrupted upload: %v", err)
+	}
+	r.CloseWithError(errTransferAborted)
+	err = transfer.Close()
+	if err == nil {
+		t.Error("closing an interrupted upload must fail")
+	}
+}
+
 func TestGetConnectionInfo(t *testing.T) {
 	c := ConnectionStatus{
 		Username:      "test_user",
@@ -1516,6 +2106,120 @@ func TestSCPCreateDirs(t *testing.T) {
 	}
 }
 
+func TestSCPParseTimeMessage(t *testing.T) {
+	times, err := parseTimeMessage("T1183832947 0 1183833773 12")
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	} else if times.mtime.Unix() != 1183832947 || times.atime.Unix() != 1183833773 ||
+		times.atime.Nanosecond() != 12000 {
+		t.Errorf("unexpected times: %+v", times)
+	}
+	for _, msg := range []string{"T1183832947 0 1183833773", "Ta 0 1 0", "T1 0 1 1000000", "T-1 0 1 0"} {
+		if _, err = parseTimeMessage(msg); err == nil {
+			t.Errorf("time message %#v must be invalid", msg)
+		}
+	}
+	if !hasWildcards("*.csv") || !hasWildcards("file?.txt") || !hasWildcards("[ab].txt") || hasWildcards("file.txt") {
+		t.Error("unexpected wildcards detection")
+	}
+}
+
+func TestSCPWildcardsAndTimes(t *testing.T) {
+	homeDir := filepath.Join(os.TempDir(), "scp_wildcards")
+	os.RemoveAll(homeDir)
+	defer os.RemoveAll(homeDir)
+	if err := os.MkdirAll(filepath.Join(homeDir, "d.csv"), 0700); err != nil {
+		t.Fatalf("unable to create dir: %v", err)
+	}
+	for _, name := range []string{"a.csv", "b.csv", "c.txt", ".hidden.csv"} {
+		if err := ioutil.WriteFile(filepath.Join(homeDir, name), []byte("hello"), 0600); err != nil {
+			t.Fatalf("unable to write file: %v", err)
+		}
+	}
+	u := dataprovider.User{
+		Username: "test",
+		HomeDir:  homeDir,
+	}
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	fs, _ := u.GetFilesystem("123")
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+	// each downloaded file requires two confirmations, plus the initial one
+	mockSSHChannel := MockChannel{
+		Buffer:       bytes.NewBuffer(make([]byte, 5)),
+		StdErrBuffer: bytes.NewBuffer(nil),
+	}
+	connection := Connection{
+		User:     u,
+		channel:  &mockSSHChannel,
+		netConn:  client,
+		fs:       fs,
+		protocol: protocolSCP,
+	}
+	scpCommand := scpCommand{
+		sshCommand: sshCommand{
+			command:    "scp",
+			connection: connection,
+			args:       []string{"-f", "*.csv"},
+		},
+	}
+	err := scpCommand.handle()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	out := mockSSHChannel.Buffer.String()
+	if !strings.Contains(out, "C0600 5 a.csv\n") || !strings.Contains(out, "C0600 5 b.csv\n") ||
+		strings.Contains(out, "c.txt") || strings.Contains(out, ".hidden.csv") || strings.Contains(out, "d.csv") {
+		t.Errorf("unexpected output: %#v", out)
+	}
+	mockSSHChannel.Buffer = bytes.NewBuffer(make([]byte, 1))
+	scpCommand.args = []string{"-f", "/*.pdf"}
+	err = scpCommand.handle()
+	if err == nil || !strings.Contains(err.Error(), "No such file or directory") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// -d requires an existing directory as target
+	mockSSHChannel.Buffer = bytes.NewBuffer(nil)
+	scpCommand.args = []string{"-d", "-t", "/c.txt"}
+	err = scpCommand.handle()
+	if err == nil || !strings.Contains(err.Error(), "Not a directory") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	// the times sent with -p are applied to the uploaded files and directories
+	mtime := time.Unix(1000000000, 0)
+	mockSSHChannel.Buffer = bytes.NewBufferString("T1000000000 0 1000000000 0\nD0755 0 updir\n" +
+		"T1000000000 0 1000000000 0\nC0644 5 upfile\nhello\x00E\n")
+	scpCommand.pendingTimes = nil
+	scpCommand.args = []string{"-r", "-p", "-d", "-t", "/"}
+	err = scpCommand.handleRecursiveUpload()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	fi, err := os.Stat(filepath.Join(homeDir, "updir", "upfile"))
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("the file times must be preserved, err: %v", err)
+	}
+	fi, err = os.Stat(filepath.Join(homeDir, "updir"))
+	if err != nil || !fi.ModTime().Equal(mtime) {
+		t.Errorf("the directory times must be preserved, err: %v", err)
+	}
+	// the times are ignored without the chtimes permission
+	scpCommand.connection.User.Permissions["/"] = []string{dataprovider.PermUpload, dataprovider.PermOverwrite,
+		dataprovider.PermListItems}
+	mockSSHChannel.Buffer = bytes.NewBufferString("T1000000000 0 1000000000 0\nC0644 5 c.txt\nhello\x00")
+	scpCommand.args = []string{"-p", "-t", "/c.txt"}
+	err = scpCommand.handleRecursiveUpload()
+	if err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	fi, err = os.Stat(filepath.Join(homeDir, "c.txt"))
+	if err != nil || fi.ModTime().Equal(mtime) {
+		t.Errorf("the file times must not be changed, err: %v", err)
+	}
+}
+
 func TestSCPDownloadFileData(t *testing.T) {
 	testfile := "testfile"
 	buf := make([]byte, 65535)
@@ -1731,15 +2435,15 @@ func TestUploadError(t *testing.T) {
 }
 
 func TestConnectionStatusStruct(t *testing.T) {
-	var transfers []connectionTransfer
-	transferUL := connectionTransfer{
+	var transfers []ConnectionTransfer
+	transferUL := ConnectionTransfer{
 		OperationType: operationUpload,
 		StartTime:     utils.GetTimeAsMsSinceEpoch(time.Now()),
 		Size:          123,
 		LastActivity:  utils.GetTimeAsMsSinceEpoch(time.Now()),
 		Path:          "/test.upload",
 	}
-	transferDL := connectionTransfer{
+	transferDL := ConnectionTransfer{
 		OperationType: operationDownload,
 		StartTime:     utils.GetTimeAsMsSinceEpoch(time.Now()),
 		Size:          123,
@@ -1772,6 +2476,59 @@ func TestConnectionStatusStruct(t *testing.T) {
 	}
 }
 
+func TestConnectionTransfersStats(t *testing.T) {
+	start := time.Now()
+	transfer1 := Transfer{
+		connectionID:  "conn1",
+		transferType:  transferUpload,
+		start:         start,
+		bytesReceived: 100,
+		lock:          new(sync.Mutex),
+	}
+	transfer2 := Transfer{
+		connectionID:  "conn1",
+		transferType:  transferUpload,
+		start:         start.Add(-1 * time.Second),
+		bytesReceived: 200,
+		lock:          new(sync.Mutex),
+	}
+	transfer3 := Transfer{
+		connectionID: "conn1",
+		transferType: transferDownload,
+		start:        start.Add(-2 * time.Second),
+		bytesSent:    300,
+		lock:         new(sync.Mutex),
+	}
+	transfer4 := Transfer{
+		connectionID:  "conn2",
+		transferType:  transferUpload,
+		start:         start.Add(-3 * time.Second),
+		bytesReceived: 400,
+		lock:          new(sync.Mutex),
+	}
+	size, startTime := getConnectionTransfersStats(&transfer1)
+	if size != 100 || !startTime.Equal(start) {
+		t.Errorf("unexpected stats, size: %v start: %v", size, startTime)
+	}
+	for _, transfer := range []*Transfer{&transfer1, &transfer2, &transfer3, &transfer4} {
+		addTransfer(transfer)
+	}
+	size, startTime = getConnectionTransfersStats(&transfer1)
+	if size != 300 || !startTime.Equal(transfer2.start) {
+		t.Errorf("unexpected stats, size: %v start: %v", size, startTime)
+	}
+	size, startTime = getConnectionTransfersStats(&transfer3)
+	if size != 300 || !startTime.Equal(transfer3.start) {
+		t.Errorf("unexpected stats, size: %v start: %v", size, startTime)
+	}
+	for _, transfer := range []*Transfer{&transfer1, &transfer2, &transfer3, &transfer4} {
+		err := removeTransfer(transfer)
+		if err != nil {
+			t.Errorf("unable to remove transfer: %v", err)
+		}
+	}
+}
+
 func TestSFTPExtensions(t *testing.T) {
 	initialSFTPExtensions := sftpExtensions
 	c := Configuration{}
@@ -1787,28 +2544,813 @@ func TestSFTPExtensions(t *testing.T) {
 	sftpExtensions = initialSFTPExtensions
 }
 
+func TestTrustedUserCAKeys(t *testing.T) {
+	c := Configuration{}
+	if err := c.initializeCertChecker(os.TempDir()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c.certChecker != nil {
+		t.Error("the cert checker must be nil without trusted user CA keys")
+	}
+	cert := &ssh.Certificate{
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"user"},
+	}
+	if err := c.validateUserCertificate("user", cert); err == nil {
+		t.Error("certificates must be rejected without trusted user CA keys")
+	}
+	caKeyPath := filepath.Join(os.TempDir(), "test_user_ca.pub")
+	err := ioutil.WriteFile(caKeyPath, []byte("invalid key"), 0666)
+	if err != nil {
+		t.Fatalf("unable to write CA key: %v", err)
+	}
+	defer os.Remove(caKeyPath)
+	c.TrustedUserCAKeys = []string{filepath.Base(caKeyPath)}
+	if err := c.initializeCertChecker(os.TempDir()); err == nil {
+		t.Error("an invalid CA key must fail")
+	}
+	var caKeys []ssh.PublicKey
+	content := []byte("# user CA keys\n")
+	for i := 0; i < 2; i++ {
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		key, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			t.Fatalf("unable to create public key: %v", err)
+		}
+		caKeys = append(caKeys, key)
+		content = append(content, ssh.MarshalAuthorizedKey(key)...)
+	}
+	err = ioutil.WriteFile(caKeyPath, append(content, '\n'), 0666)
+	if err != nil {
+		t.Fatalf("unable to write CA key: %v", err)
+	}
+	if err := c.initializeCertChecker(os.TempDir()); err != nil {
+		t.Fatalf("unable to load CA keys: %v", err)
+	}
+	for _, key := range caKeys {
+		if !c.certChecker.IsUserAuthority(key) {
+			t.Error("the key must be a trusted user CA")
+		}
+	}
+	cert.SignatureKey = caKeys[0]
+	cert.ValidPrincipals = nil
+	if err := c.validateUserCertificate("user", cert); err == nil {
+		t.Error("certificates without principals must be rejected")
+	}
+}
+
+type mockConnMetadata struct {
+	clientVersion string
+}
+
+func (m *mockConnMetadata) User() string          { return "user" }
+func (m *mockConnMetadata) SessionID() []byte     { return []byte("session") }
+func (m *mockConnMetadata) ClientVersion() []byte { return []byte(m.clientVersion) }
+func (m *mockConnMetadata) ServerVersion() []byte { return []byte("SSH-2.0-SFTPGo") }
+func (m *mockConnMetadata) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2222}
+}
+func (m *mockConnMetadata) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 2022}
+}
+
+func TestClientVersions(t *testing.T) {
+	c := Configuration{}
+	conn := &mockConnMetadata{clientVersion: "SSH-2.0-libssh_0.6.3"}
+	if err := c.checkClientVersion(conn); err != nil {
+		t.Errorf("any client version must be allowed without restrictions: %v", err)
+	}
+	c.DeniedClientVersions = []string{"SSH-2.0-libssh_0.6*", "SSH-2.0-PuTTY_Release_0.5*"}
+	if err := c.checkClientVersionPatterns(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := c.checkClientVersion(conn); err == nil {
+		t.Error("the client version must be denied")
+	}
+	conn.clientVersion = "SSH-2.0-OpenSSH_8.4"
+	if err := c.checkClientVersion(conn); err != nil {
+		t.Errorf("the client version must be allowed: %v", err)
+	}
+	c.AllowedClientVersions = []string{"SSH-2.0-OpenSSH_*", "SSH-2.0-libssh*"}
+	if err := c.checkClientVersion(conn); err != nil {
+		t.Errorf("the client version must be allowed: %v", err)
+	}
+	conn.clientVersion = "SSH-2.0-Go"
+	if err := c.checkClientVersion(conn); err == nil {
+		t.Error("a client version not in the allowed list must be denied")
+	}
+	// denied patterns are evaluated first
+	conn.clientVersion = "SSH-2.0-libssh_0.6.1"
+	if err := c.checkClientVersion(conn); err == nil {
+		t.Error("the client version must be denied")
+	}
+	c.AllowedClientVersions = []string{"SSH-2.0-[OpenSSH"}
+	if err := c.checkClientVersionPatterns(); err == nil {
+		t.Error("an invalid pattern must fail")
+	}
+	if _, err := c.getServerConfig(os.TempDir()); err == nil {
+		t.Error("the server configuration must fail with an invalid pattern")
+	}
+}
+
+func krlString(data []byte) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(len(data)))
+	return append(b, data...)
+}
+
+func krlUint64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func krlSection(sectionType byte, data []byte) []byte {
+	return append([]byte{sectionType}, krlString(data)...)
+}
+
+func TestRevokedKeys(t *testing.T) {
+	var keys []ssh.PublicKey
+	var caSigner ssh.Signer
+	for i := 0; i < 4; i++ {
+		privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatalf("unable to generate key: %v", err)
+		}
+		key, err := ssh.NewPublicKey(&privKey.PublicKey)
+		if err != nil {
+			t.Fatalf("unable to create public key: %v", err)
+		}
+		keys = append(keys, key)
+		if i == 3 {
+			caSigner, err = ssh.NewSignerFromKey(privKey)
+			if err != nil {
+				t.Fatalf("unable to create signer: %v", err)
+			}
+		}
+	}
+	caKey := keys[3]
+	c := Configuration{}
+	if err := c.loadRevokedKeys(os.TempDir()); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if c.revokedKeys.isRevoked(keys[0]) {
+		t.Error("no key must be revoked without a revocation list")
+	}
+	krlPath := filepath.Join(os.TempDir(), "test_revoked_keys")
+	c.RevokedKeysFile = filepath.Base(krlPath)
+	if err := c.loadRevokedKeys(os.TempDir()); err == nil {
+		t.Error("a missing revoked keys file must fail")
+	}
+	defer os.Remove(krlPath)
+	err := ioutil.WriteFile(krlPath, []byte("# revoked keys\n\n"+string(ssh.MarshalAuthorizedKey(keys[0]))), 0666)
+	if err != nil {
+		t.Fatalf("unable to write revoked keys file: %v", err)
+	}
+	if err := c.loadRevokedKeys(os.TempDir()); err != nil {
+		t.Fatalf("unable to load revoked keys: %v", err)
+	}
+	if !c.revokedKeys.isRevoked(keys[0]) {
+		t.Error("the key must be revoked")
+	}
+	if c.revokedKeys.isRevoked(keys[1]) {
+		t.Error("the key must not be revoked")
+	}
+	cert := &ssh.Certificate{
+		Key:          keys[0],
+		Serial:       10,
+		CertType:     ssh.UserCert,
+		KeyId:        "id",
+		SignatureKey: caKey,
+	}
+	if !c.revokedKeys.isRevoked(cert) {
+		t.Error("a certificate for a revoked key must be revoked")
+	}
+	err = ioutil.WriteFile(krlPath, []byte("invalid key"), 0666)
+	if err != nil {
+		t.Fatalf("unable to write revoked keys file: %v", err)
+	}
+	if err := c.loadRevokedKeys(os.TempDir()); err == nil {
+		t.Error("an invalid revoked keys file must fail")
+	}
+	if c.revokedKeys != nil {
+		t.Error("the revoked keys must be reset if the file cannot be loaded")
+	}
+
+	header := []byte(krlMagic)
+	header = append(header, 0, 0, 0, krlFormatVersion)
+	header = append(header, krlUint64(1)...)
+	header = append(header, krlUint64(uint64(time.Now().Unix()))...)
+	header = append(header, krlUint64(0)...)
+	header = append(header, krlString(nil)...)
+	header = append(header, krlString([]byte("comment"))...)
+
+	certs := krlString(caKey.Marshal())
+	certs = append(certs, krlString(nil)...)
+	certs = append(certs, krlSection(krlSectionCertSerialList, append(krlUint64(1), krlUint64(2)...))...)
+	certs = append(certs, krlSection(krlSectionCertSerialRange, append(krlUint64(100), krlUint64(200)...))...)
+	// serials 1001 and 1003
+	certs = append(certs, krlSection(krlSectionCertSerialBitmap, append(krlUint64(1001), krlString([]byte{0x05})...))...)
+	certs = append(certs, krlSection(krlSectionCertKeyID, krlString([]byte("revoked id")))...)
+	fingerprint := sha256.Sum256(keys[1].Marshal())
+
+	krl := append([]byte{}, header...)
+	krl = append(krl, krlSection(krlSectionCertificates, certs)...)
+	krl = append(krl, krlSection(krlSectionExplicitKey, krlString(keys[0].Marshal()))...)
+	krl = append(krl, krlSection(krlSectionFingerprintSHA256, krlString(fingerprint[:]))...)
+	// the signature section contains the signature key and it is followed by the signature over
+	// the preceding data, more signatures are allowed at the end of the KRL
+	for i := 0; i < 2; i++ {
+		krl = append(krl, krlSection(krlSectionSignature, caKey.Marshal())...)
+		signature, err := caSigner.Sign(rand.Reader, krl)
+		if err != nil {
+			t.Fatalf("unable to sign the KRL: %v", err)
+		}
+		krl = append(krl, krlString(ssh.Marshal(signature))...)
+	}
+	revokedKeys, err := parseRevocationList(krl)
+	if err != nil {
+		t.Fatalf("unable to parse KRL: %v", err)
+	}
+	if !revokedKeys.isRevoked(keys[0]) || !revokedKeys.isRevoked(keys[1]) {
+		t.Error("the keys must be revoked")
+	}
+	if revokedKeys.isRevoked(keys[2]) || revokedKeys.isRevoked(caKey) {
+		t.Error("the keys must not be revoked")
+	}
+	cert.Key = keys[2]
+	for _, serial := range []uint64{1, 2, 100, 150, 200, 1001, 1003} {
+		cert.Serial = serial
+		if !revokedKeys.isRevoked(cert) {
+			t.Errorf("the certificate with serial %v must be revoked", serial)
+		}
+	}
+	for _, serial := range []uint64{0, 3, 99, 201, 1000, 1002, 1004} {
+		cert.Serial = serial
+		if revokedKeys.isRevoked(cert) {
+			t.Errorf("the certificate with serial %v must not be revoked", serial)
+		}
+	}
+	cert.KeyId = "revoked id"
+	if !revokedKeys.isRevoked(cert) {
+		t.Error("the certificate must be revoked by key ID")
+	}
+	cert.SignatureKey = keys[1]
+	cert.KeyId = "id"
+	cert.Serial = 1
+	if !revokedKeys.isRevoked(cert) {
+		t.Error("a certificate signed by a revoked key must be revoked")
+	}
+	_, err = parseRevocationList(krl[:len(krl)-1])
+	if err == nil {
+		t.Error("a truncated KRL must fail")
+	}
+	_, err = parseRevocationList(append(append([]byte{}, header...), krlSection(krlSectionSignature, caKey.Marshal())...))
+	if err == nil {
+		t.Error("a signature section without the signature must fail")
+	}
+	_, err = parseRevocationList(append(append([]byte{}, header...), krlSection(10, nil)...))
+	if err == nil {
+		t.Error("an unsupported KRL section must fail")
+	}
+	_, err = parseRevocationList(append(append([]byte{}, header...), krlSection(krlSectionFingerprintSHA256,
+		krlString([]byte("short")))...))
+	if err == nil {
+		t.Error("an invalid fingerprint must fail")
+	}
+}
+
 func TestProxyProtocolVersion(t *testing.T) {
 	c := Configuration{
 		ProxyProtocol: 1,
 	}
-	proxyListener, _ := c.getProxyListener(nil)
-	if proxyListener.Policy != nil {
+	policy, _ := c.getProxyPolicy()
+	if policy != nil {
 		t.Error("proxy listener policy must be nil")
 	}
 	c.ProxyProtocol = 2
-	proxyListener, _ = c.getProxyListener(nil)
-	if proxyListener.Policy == nil {
+	policy, _ = c.getProxyPolicy()
+	if policy == nil {
 		t.Error("proxy listener policy must be not nil")
 	}
 	c.ProxyProtocol = 1
 	c.ProxyAllowed = []string{"invalid"}
-	_, err := c.getProxyListener(nil)
+	_, err := c.getProxyPolicy()
 	if err == nil {
 		t.Error("get proxy listener with invalid IP must fail")
 	}
 	c.ProxyProtocol = 2
-	_, err = c.getProxyListener(nil)
+	_, err = c.getProxyPolicy()
 	if err == nil {
 		t.Error("get proxy listener with invalid IP must fail")
 	}
 }
+
+func TestServerReload(t *testing.T) {
+	keyPath := filepath.Join(os.TempDir(), "reload_key")
+	newKeyPath := filepath.Join(os.TempDir(), "reload_key_new")
+	for _, k := range []string{keyPath, newKeyPath} {
+		if err := utils.GenerateEd25519Keys(k); err != nil {
+			t.Fatalf("unable to generate host key: %v", err)
+		}
+		defer os.Remove(k)
+		defer os.Remove(k + ".pub")
+	}
+	c := Configuration{
+		Keys:          []Key{{PrivateKey: keyPath}},
+		ProxyProtocol: 2,
+		ProxyAllowed:  []string{"127.0.0.1"},
+	}
+	serverConfig, err := c.getServerConfig(os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to get server config: %v", err)
+	}
+	proxyPolicy, err := c.getProxyPolicy()
+	if err != nil {
+		t.Fatalf("unable to get proxy policy: %v", err)
+	}
+	server := &sshServer{
+		config:       c,
+		configDir:    os.TempDir(),
+		serverConfig: serverConfig,
+		proxyPolicy:  proxyPolicy,
+	}
+	upstream := &net.TCPAddr{IP: net.ParseIP("10.8.0.2"), Port: 2022}
+	if policy, _ := server.getProxyPolicy(upstream); policy != proxyproto.REJECT {
+		t.Errorf("unexpected proxy policy: %v", policy)
+	}
+	reloaded := Configuration{
+		Keys:          []Key{{PrivateKey: newKeyPath}},
+		ProxyProtocol: 1,
+		ProxyAllowed:  []string{"10.8.0.0/24"},
+	}
+	if err = server.reload(reloaded); err != nil {
+		t.Errorf("unable to reload the server: %v", err)
+	}
+	if server.getServerConfig() == serverConfig {
+		t.Error("the server config must be replaced")
+	}
+	if len(server.config.Keys) != 1 || server.config.Keys[0].PrivateKey != newKeyPath {
+		t.Errorf("unexpected host keys after reload: %+v", server.config.Keys)
+	}
+	// the proxy protocol mode requires a restart, only the allow list is reloaded
+	if server.config.ProxyProtocol != 2 {
+		t.Errorf("the proxy protocol must not be reloaded")
+	}
+	if policy, _ := server.getProxyPolicy(upstream); policy != proxyproto.USE {
+		t.Errorf("unexpected proxy policy after reload: %v", policy)
+	}
+	serverConfig = server.getServerConfig()
+	reloaded.Keys = []Key{{PrivateKey: filepath.Join(os.TempDir(), "missing_reload_key")}}
+	if err = server.reload(reloaded); err == nil {
+		t.Error("reload with a missing host key must fail")
+	}
+	reloaded.Keys = []Key{{PrivateKey: keyPath}}
+	reloaded.ProxyAllowed = []string{"invalid"}
+	if err = server.reload(reloaded); err == nil {
+		t.Error("reload with an invalid proxy allow list must fail")
+	}
+	if server.getServerConfig() != serverConfig || server.config.Keys[0].PrivateKey != newKeyPath {
+		t.Error("the current settings must be kept if the reload fails")
+	}
+	server.proxyPolicy = nil
+	if policy, _ := server.getProxyPolicy(upstream); policy != proxyproto.USE {
+		t.Errorf("unexpected proxy policy without allow list: %v", policy)
+	}
+}
+
+func TestExtensionsPackets(t *testing.T) {
+	packet := appendSFTPString([]byte{sftpPacketExtended, 0, 0, 0, 3}, statVFSExtension)
+	id, request, data, ok := parseExtendedRequest(appendSFTPString(packet, "/dir"))
+	if !ok || id != 3 || request != statVFSExtension {
+		t.Errorf("unexpected extended request, id: %v request: %#v", id, request)
+	}
+	if p, _, ok := parseSFTPString(data); !ok || p != "/dir" {
+		t.Errorf("unexpected statvfs path: %#v", p)
+	}
+	if _, _, ok := parseSFTPString(data[:5]); ok {
+		t.Error("a truncated string must be rejected")
+	}
+	if _, _, _, ok := parseExtendedRequest([]byte{sftpPacketExtended, 0, 0, 0, 3, 0, 0, 0, 100}); ok {
+		t.Error("truncated requests must be rejected")
+	}
+	if _, _, _, ok := parseExtendedRequest([]byte{sftpPacketOpen, 0, 0, 0, 3, 0, 0, 0, 0}); ok {
+		t.Error("only extended requests must be parsed")
+	}
+	data = appendSFTPString(appendSFTPString(nil, "/file"), "md5,sha1")
+	if _, ok := parseCheckFileRequest(data); ok {
+		t.Error("a check-file request without range must be rejected")
+	}
+	checkFileReq, ok := parseCheckFileRequest(append(data, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 1, 0))
+	if !ok || checkFileReq.name != "/file" || len(checkFileReq.algos) != 2 || checkFileReq.offset != 1 ||
+		checkFileReq.length != 2 || checkFileReq.blockSize != 256 {
+		t.Errorf("unexpected check-file request: %+v", checkFileReq)
+	}
+	data = append(appendSFTPString(nil, "h1"), 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2)
+	if _, ok := parseCopyDataRequest(data); ok {
+		t.Error("a copy-data request without write handle must be rejected")
+	}
+	copyDataReq, ok := parseCopyDataRequest(append(appendSFTPString(data, "h2"), 0, 0, 0, 0, 0, 0, 0, 3))
+	if !ok || copyDataReq.readHandle != "h1" || copyDataReq.readOffset != 1 || copyDataReq.readLength != 2 ||
+		copyDataReq.writeHandle != "h2" || copyDataReq.writeOffset != 3 {
+		t.Errorf("unexpected copy-data request: %+v", copyDataReq)
+	}
+	mockChannel := MockChannel{
+		Buffer: bytes.NewBuffer([]byte{0, 0, 0, 0}),
+	}
+	c := newExtensionsChannel(&mockChannel, Connection{})
+	if c.handleExtendedRequest(packet) {
+		t.Error("a statvfs request without path must be forwarded")
+	}
+	if c.handleExtendedRequest(appendSFTPString([]byte{sftpPacketExtended, 0, 0, 0, 3}, "posix-rename@openssh.com")) {
+		t.Error("other extended requests must be forwarded")
+	}
+	if _, err := c.Read(make([]byte, 10)); err == nil {
+		t.Error("an empty packet must be rejected")
+	}
+	mockChannel.Buffer = bytes.NewBuffer([]byte{0x7f, 0, 0, 0})
+	if _, err := c.Read(make([]byte, 10)); err == nil {
+		t.Error("a too long packet must be rejected")
+	}
+	// the version packet must advertise the served extensions
+	mockChannel.Buffer = bytes.NewBuffer(nil)
+	version := []byte{0, 0, 0, 5, sftpPacketVersion, 0, 0, 0, 3}
+	if n, err := c.Write(version); err != nil || n != len(version) {
+		t.Errorf("unexpected write result, n: %v, err: %v", n, err)
+	}
+	if !bytes.Contains(mockChannel.Buffer.Bytes(), []byte(statVFSExtension)) {
+		t.Error("the statvfs extension must be advertised")
+	}
+	if !bytes.Contains(mockChannel.Buffer.Bytes(), []byte(fsyncExtension)) {
+		t.Error("the fsync extension must be advertised")
+	}
+	if binary.BigEndian.Uint32(mockChannel.Buffer.Bytes()) != uint32(mockChannel.Buffer.Len()-4) {
+		t.Error("invalid length for the version packet")
+	}
+	status := getSFTPStatusPacket(3, sftpStatusOpUnsupported, "unsupported")
+	if status[4] != sftpPacketStatus || binary.BigEndian.Uint32(status[9:]) != sftpStatusOpUnsupported {
+		t.Errorf("invalid status packet: %v", status)
+	}
+}
+
+func TestFsyncHandlesTracking(t *testing.T) {
+	mockChannel := MockChannel{
+		Buffer: bytes.NewBuffer(nil),
+	}
+	c := newExtensionsChannel(&mockChannel, Connection{})
+	c.trackRequest(appendSFTPString([]byte{sftpPacketOpen, 0, 0, 0, 5}, "/file"))
+	c.trackRequest([]byte{sftpPacketInit, 0, 0, 0, 3})
+	if len(c.pending) != 1 || c.opens[5] != "/file" {
+		t.Errorf("unexpected tracked requests: %+v, opens: %+v", c.pending, c.opens)
+	}
+	handle := appendSFTPString([]byte{0, 0, 0, 0, sftpPacketHandle, 0, 0, 0, 5}, "h1")
+	c.trackResponse(handle)
+	if len(c.pending) != 0 || len(c.opens) != 0 || c.handles["h1"] != "/file" {
+		t.Errorf("unexpected tracked handles: %+v", c.handles)
+	}
+	// the fsync response must wait for the requests received before
+	// SSH_FXP_READ request
+	c.trackRequest([]byte{5, 0, 0, 0, 6})
+	c.handleFsync(7, "unknown")
+	time.Sleep(100 * time.Millisecond)
+	c.writeLock.Lock()
+	if mockChannel.Buffer.Len() > 0 {
+		t.Error("the fsync response must wait for the pending requests")
+	}
+	c.writeLock.Unlock()
+	c.trackResponse(getSFTPStatusPacket(6, sftpStatusOK, ""))
+	for i := 0; i < 100; i++ {
+		c.writeLock.Lock()
+		written := mockChannel.Buffer.Len()
+		c.writeLock.Unlock()
+		if written > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.writeLock.Lock()
+	response := mockChannel.Buffer.Bytes()
+	if len(response) < 13 || binary.BigEndian.Uint32(response[5:]) != 7 ||
+		binary.BigEndian.Uint32(response[9:]) != sftpStatusOpUnsupported {
+		t.Errorf("unexpected fsync response: %v", response)
+	}
+	c.writeLock.Unlock()
+	c.trackRequest(appendSFTPString([]byte{sftpPacketClose, 0, 0, 0, 8}, "h1"))
+	if len(c.handles) != 0 {
+		t.Errorf("closed handles must be removed: %+v", c.handles)
+	}
+	// a closed channel must not block the fsync requests
+	c.handleFsync(9, "unknown")
+	c.Close()
+	c.waitForRequests([]uint32{8})
+}
+
+func TestShutdownDraining(t *testing.T) {
+	transfer := Transfer{
+		path:         "/shutdown_test",
+		start:        time.Now(),
+		connectionID: "shutdown_id",
+		transferType: transferUpload,
+		lastActivity: time.Now(),
+		protocol:     protocolSFTP,
+		lock:         new(sync.Mutex),
+	}
+	// other tests could leave some transfers
+	mutex.Lock()
+	savedTransfers := activeTransfers
+	activeTransfers = nil
+	mutex.Unlock()
+	defer func() {
+		mutex.Lock()
+		activeTransfers = savedTransfers
+		mutex.Unlock()
+	}()
+	addTransfer(&transfer)
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	err := waitForTransfers(ctx)
+	cancel()
+	if err != context.DeadlineExceeded {
+		t.Errorf("unexpected error waiting for the active transfers: %v", err)
+	}
+	go func() {
+		time.Sleep(150 * time.Millisecond)
+		removeTransfer(&transfer)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	err = waitForTransfers(ctx)
+	cancel()
+	if err != nil {
+		t.Errorf("unexpected error waiting for the active transfers: %v", err)
+	}
+
+	shutdownMutex.Lock()
+	shuttingDown = true
+	shutdownMutex.Unlock()
+	defer func() {
+		shutdownMutex.Lock()
+		shuttingDown = false
+		shutdownMutex.Unlock()
+	}()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to create listener: %v", err)
+	}
+	defer listener.Close()
+	if err = addListener(listener); err != ErrServerClosed {
+		t.Errorf("listeners must not be added while shutting down: %v", err)
+	}
+	connection := Connection{
+		User: dataprovider.User{
+			Permissions: map[string][]string{"/": {dataprovider.PermAny}},
+		},
+		fs: vfs.NewOsFs("shutdown_id", os.TempDir(), nil),
+	}
+	if _, err = connection.Fileread(sftp.NewRequest("Get", "/file")); err != sftp.ErrSSHFxFailure {
+		t.Errorf("new downloads must be denied while shutting down: %v", err)
+	}
+	if _, err = connection.Filewrite(sftp.NewRequest("Put", "/file")); err != sftp.ErrSSHFxFailure {
+		t.Errorf("new uploads must be denied while shutting down: %v", err)
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	setConnectionLimits(2, 1)
+	defer setConnectionLimits(0, 0)
+
+	if !addClientConnection("127.0.0.1") {
+		t.Errorf("the first connection must be allowed")
+	}
+	if addClientConnection("127.0.0.1") {
+		t.Errorf("the per host limit must be enforced")
+	}
+	if !addClientConnection("127.0.0.2") {
+		t.Errorf("a connection from another host must be allowed")
+	}
+	if addClientConnection("127.0.0.3") {
+		t.Errorf("the total limit must be enforced")
+	}
+	// a refused connection must be closed before the handshake
+	server, client := net.Pipe()
+	c := Configuration{}
+	done := make(chan bool)
+	go func() {
+		c.AcceptInboundConnection(server, &ssh.ServerConfig{})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the refused connection was not closed")
+	}
+	_, err := client.Write([]byte("SSH-2.0-test\r\n"))
+	if err == nil {
+		t.Errorf("writing to a refused connection must fail")
+	}
+	client.Close()
+	removeClientConnection("127.0.0.2")
+	if !addClientConnection("127.0.0.3") {
+		t.Errorf("the connection must be allowed after a disconnection")
+	}
+	removeClientConnection("127.0.0.1")
+	removeClientConnection("127.0.0.3")
+	clientConnectionsMutex.Lock()
+	if totalClientConnections != 0 || len(clientConnections) != 0 {
+		t.Errorf("unexpected connections: %v, %+v", totalClientConnections, clientConnections)
+	}
+	clientConnectionsMutex.Unlock()
+}
+
+func TestHandshakeLimits(t *testing.T) {
+	setHandshakeLimits(1, 10)
+	defer setHandshakeLimits(0, 0)
+
+	timeout, ok := startHandshake("127.0.0.1")
+	if !ok {
+		t.Errorf("the first handshake must be allowed")
+	}
+	if timeout != 10*time.Second {
+		t.Errorf("unexpected handshake timeout: %v", timeout)
+	}
+	_, ok = startHandshake("127.0.0.1")
+	if ok {
+		t.Errorf("the concurrent handshakes limit must be enforced")
+	}
+	// a refused connection must be closed without starting the handshake
+	server, client := net.Pipe()
+	c := Configuration{}
+	done := make(chan bool)
+	go func() {
+		c.AcceptInboundConnection(server, &ssh.ServerConfig{})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the refused connection was not closed")
+	}
+	client.Close()
+	endHandshake()
+	_, ok = startHandshake("127.0.0.1")
+	if !ok {
+		t.Errorf("the handshake must be allowed when the previous one ends")
+	}
+	endHandshake()
+	setHandshakeLimits(0, 0)
+	timeout, _ = startHandshake("127.0.0.1")
+	if timeout != defaultHandshakeTimeout {
+		t.Errorf("unexpected default handshake timeout: %v", timeout)
+	}
+	endHandshake()
+	clientConnectionsMutex.Lock()
+	if handshakesInProgress != 0 || totalClientConnections != 0 {
+		t.Errorf("unexpected handshakes in progress: %v, connections: %v", handshakesInProgress, totalClientConnections)
+	}
+	clientConnectionsMutex.Unlock()
+}
+
+func TestUploadChecksum(t *testing.T) {
+	if NewUploadChecksum() != nil {
+		t.Errorf("the upload checksums must be disabled by default")
+	}
+	uploadChecksums = true
+	defer func() {
+		uploadChecksums = false
+	}()
+	fs := vfs.NewOsFs("checksum_id", os.TempDir(), nil)
+	testfile := filepath.Join(os.TempDir(), "checksum_file")
+	content := []byte("upload checksum content")
+	err := ioutil.WriteFile(testfile, content, 0666)
+	if err != nil {
+		t.Fatalf("unable to write test file: %v", err)
+	}
+	defer os.Remove(testfile)
+	expected := fmt.Sprintf("%x", sha256.Sum256(content))
+	checksum := NewUploadChecksum()
+	checksum.Update(content[:5], 0)
+	checksum.Update(content[5:], 5)
+	checksum.Store(fs, testfile, testfile, "checksum_id")
+	stored, err := fs.GetFileChecksum(testfile)
+	if err != nil {
+		t.Errorf("unable to get the stored checksum: %v", err)
+	}
+	if len(stored) == 0 {
+		t.Skip("extended attributes are not supported")
+	}
+	if stored != expected {
+		t.Errorf("unexpected checksum: %#v, expected: %#v", stored, expected)
+	}
+	// non sequential writes to a local file, the checksum is computed reading the file
+	err = fs.SetFileChecksum(testfile, "")
+	if err != nil {
+		t.Errorf("unable to remove the stored checksum: %v", err)
+	}
+	checksum = NewUploadChecksum()
+	checksum.Update(content[5:], 5)
+	checksum.Update(content[:5], 0)
+	checksum.Store(fs, testfile, testfile, "checksum_id")
+	stored, _ = fs.GetFileChecksum(testfile)
+	if stored != expected {
+		t.Errorf("unexpected checksum after non sequential writes: %#v, expected: %#v", stored, expected)
+	}
+	// non sequential writes to a remote file, no checksum is stored
+	err = fs.SetFileChecksum(testfile, "")
+	if err != nil {
+		t.Errorf("unable to remove the stored checksum: %v", err)
+	}
+	checksum = NewUploadChecksum()
+	checksum.Update(content[5:], 5)
+	checksum.Store(fs, testfile, "", "checksum_id")
+	stored, _ = fs.GetFileChecksum(testfile)
+	if len(stored) > 0 {
+		t.Errorf("no checksum must be stored for non sequential remote uploads: %#v", stored)
+	}
+	// check-file must return the stored checksum for the whole file
+	fakeChecksum := fmt.Sprintf("%x", sha256.Sum256([]byte("fake")))
+	err = fs.SetFileChecksum(testfile, fakeChecksum)
+	if err != nil {
+		t.Errorf("unable to store the checksum: %v", err)
+	}
+	u := dataprovider.User{}
+	u.Username = "test"
+	u.Permissions = make(map[string][]string)
+	u.Permissions["/"] = []string{dataprovider.PermAny}
+	u.HomeDir = os.TempDir()
+	c := Connection{
+		fs:   fs,
+		User: u,
+	}
+	algo, hashes, err := c.getFileChecksum("/checksum_file", checkFileRequest{algos: []string{"sha256"}})
+	if err != nil {
+		t.Errorf("unexpected check-file error: %v", err)
+	}
+	if algo != "sha256" || fmt.Sprintf("%x", hashes) != fakeChecksum {
+		t.Errorf("the stored checksum must be used, algo: %v, hash: %x", algo, hashes)
+	}
+	// a partial range must be hashed
+	_, hashes, err = c.getFileChecksum("/checksum_file", checkFileRequest{algos: []string{"sha256"}, offset: 1})
+	if err != nil {
+		t.Errorf("unexpected check-file error: %v", err)
+	}
+	if fmt.Sprintf("%x", hashes) != fmt.Sprintf("%x", sha256.Sum256(content[1:])) {
+		t.Errorf("unexpected hash for a partial range: %x", hashes)
+	}
+}
+
+type mockKeepAliveConn struct {
+	sync.Mutex
+	replies  bool
+	requests int
+	closed   chan bool
+}
+
+func (c *mockKeepAliveConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	c.Lock()
+	c.requests++
+	replies := c.replies
+	c.Unlock()
+	if !replies {
+		// an unresponsive peer never replies
+		<-c.closed
+		return false, nil, io.EOF
+	}
+	return false, nil, nil
+}
+
+func (c *mockKeepAliveConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestKeepAlive(t *testing.T) {
+	conn := &mockKeepAliveConn{replies: true, closed: make(chan bool)}
+	stop := startKeepAlive(conn, 10*time.Millisecond, 2, "")
+	time.Sleep(100 * time.Millisecond)
+	stop()
+	select {
+	case <-conn.closed:
+		t.Error("a connection that replies to the keepalives must not be closed")
+	default:
+	}
+	conn.Lock()
+	if conn.requests < 3 {
+		t.Errorf("unexpected number of keepalive requests: %v", conn.requests)
+	}
+	conn.Unlock()
+
+	conn = &mockKeepAliveConn{replies: false, closed: make(chan bool)}
+	stop = startKeepAlive(conn, 10*time.Millisecond, 2, "")
+	defer stop()
+	select {
+	case <-conn.closed:
+	case <-time.After(2 * time.Second):
+		t.Error("an unresponsive connection must be closed")
+	}
+	conn.Lock()
+	if conn.requests != 2 {
+		t.Errorf("unexpected number of keepalive requests: %v", conn.requests)
+	}
+	conn.Unlock()
+}
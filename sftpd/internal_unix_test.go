@@ -3,7 +3,12 @@
 package sftpd
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
 	"os/exec"
+	"strconv"
+	"syscall"
 	"testing"
 )
 
@@ -17,3 +22,73 @@ func TestWrapCmd(t *testing.T) {
 		t.Errorf("unexpected gid")
 	}
 }
+
+func TestActivationListeners(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := getActivationListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("the sockets passed to a different process must be ignored, listeners: %v err: %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "1" {
+		t.Error("the environment must not be changed for a different process")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	os.Setenv("LISTEN_FDS", "0")
+	listeners, err = getActivationListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("unexpected listeners: %v err: %v", listeners, err)
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to create listener: %v", err)
+	}
+	defer listener.Close()
+	f, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("unable to get the listener file: %v", err)
+	}
+	defer f.Close()
+	// getListenersFromFds takes the ownership of the file descriptors, so pass duplicates
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("unable to duplicate the listener file descriptor: %v", err)
+	}
+	listeners, err = getListenersFromFds(fd, 1, []string{"sftp"})
+	if err != nil {
+		t.Fatalf("unable to get the inherited listeners: %v", err)
+	}
+	if len(listeners) != 1 || listeners[0].Addr().String() != listener.Addr().String() {
+		t.Errorf("unexpected inherited listeners: %v", listeners)
+	} else {
+		listeners[0].Close()
+	}
+	file, err := ioutil.TempFile("", "activation")
+	if err != nil {
+		t.Fatalf("unable to create temp file: %v", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	fd, err = syscall.Dup(int(file.Fd()))
+	if err != nil {
+		t.Fatalf("unable to duplicate the file descriptor: %v", err)
+	}
+	if _, err = getListenersFromFds(fd, 1, nil); err == nil {
+		t.Error("a regular file cannot be used as listener")
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	c := Configuration{
+		Bindings: []Binding{{Port: port, ApplyProxyConfig: false}},
+	}
+	if binding := c.getActivationBinding(listener); binding.ApplyProxyConfig {
+		t.Error("the proxy configuration must not be applied to the inherited listener")
+	}
+	c.Bindings = nil
+	if binding := c.getActivationBinding(listener); !binding.ApplyProxyConfig || binding.Port != port {
+		t.Errorf("unexpected binding for the inherited listener: %+v", binding)
+	}
+}
@@ -0,0 +1,222 @@
+package sftpd
+
+import (
+	"errors"
+	"os"
+	"path"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var (
+	// ErrInterruptedUploadNotFound is returned if the given path is not an interrupted atomic upload
+	ErrInterruptedUploadNotFound = errors.New("interrupted upload not found")
+	// ErrUserConnected is returned if an interrupted upload is finalized or purged while the user is connected
+	ErrUserConnected = errors.New("the user has active sessions, the upload could be in progress")
+)
+
+// InterruptedUpload defines a temporary file, used for an atomic upload, that was not
+// renamed to the requested path, for example because the server was stopped or crashed
+// while the upload was in progress
+type InterruptedUpload struct {
+	// virtual path of the temporary file
+	TempPath string `json:"temp_path"`
+	// virtual path the temporary file is renamed to when finalized
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// last modification time as unix timestamp in milliseconds
+	LastModified int64 `json:"last_modified"`
+	// time elapsed since the last modification in seconds
+	Age int64 `json:"age"`
+}
+
+func newInterruptedUpload(tempPath, targetName string, info os.FileInfo) InterruptedUpload {
+	return InterruptedUpload{
+		TempPath:     tempPath,
+		Path:         path.Join(path.Dir(tempPath), targetName),
+		Size:         info.Size(),
+		LastModified: utils.GetTimeAsMsSinceEpoch(info.ModTime()),
+		Age:          int64(time.Since(info.ModTime()).Seconds()),
+	}
+}
+
+// GetInterruptedUploads returns the temporary files of the atomic uploads not renamed
+// to the requested path for the given user, virtual folders included.
+// The uploads in progress are listed too if the user is connected
+func GetInterruptedUploads(username string) ([]InterruptedUpload, error) {
+	uploads := []InterruptedUpload{}
+	user, err := dataprovider.GetUserWithGroupSettings(dataProvider, username)
+	if err != nil {
+		return uploads, err
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		return uploads, err
+	}
+	defer fs.Close()
+
+	if !fs.IsAtomicUploadSupported() {
+		return uploads, nil
+	}
+	dirs := []string{"/"}
+	for _, v := range user.VirtualFolders {
+		dirs = append(dirs, v.VirtualPath)
+	}
+	for _, dir := range dirs {
+		fsPath, err := fs.ResolvePath(dir)
+		if err != nil {
+			return uploads, err
+		}
+		uploads, err = findInterruptedUploads(user, fs, dir, fsPath, uploads)
+		if err != nil {
+			return uploads, err
+		}
+	}
+	return uploads, nil
+}
+
+func findInterruptedUploads(user dataprovider.User, fs vfs.Fs, virtualPath, fsPath string,
+	uploads []InterruptedUpload) ([]InterruptedUpload, error) {
+	contents, err := fs.ReadDir(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return uploads, nil
+		}
+		return uploads, err
+	}
+	for _, info := range contents {
+		childVirtualPath := path.Join(virtualPath, info.Name())
+		if info.IsDir() {
+			// virtual folders are scanned on their own
+			if user.IsVirtualFolder(childVirtualPath) {
+				continue
+			}
+			uploads, err = findInterruptedUploads(user, fs, childVirtualPath, fs.Join(fsPath, info.Name()), uploads)
+			if err != nil {
+				return uploads, err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if targetName, ok := vfs.GetAtomicUploadTarget(info.Name()); ok {
+			uploads = append(uploads, newInterruptedUpload(childVirtualPath, targetName, info))
+		}
+	}
+	return uploads, nil
+}
+
+// FinalizeInterruptedUpload renames the temporary file with the given virtual path to the requested
+// upload path, overwriting the existing file, if any, and updates the user quota as for a completed upload.
+// The user must not be connected
+func FinalizeInterruptedUpload(username, tempPath string) (InterruptedUpload, error) {
+	var upload InterruptedUpload
+	user, fs, err := getUserForInterruptedUpload(username)
+	if err != nil {
+		return upload, err
+	}
+	defer fs.Close()
+
+	upload, fsPath, err := getInterruptedUpload(fs, tempPath)
+	if err != nil {
+		return upload, err
+	}
+	targetPath, err := fs.ResolvePath(upload.Path)
+	if err != nil {
+		return upload, err
+	}
+	numFiles := 1
+	sizeDiff := upload.Size
+	if info, err := fs.Lstat(targetPath); err == nil {
+		if info.IsDir() {
+			return upload, errors.New("the upload path is a directory")
+		}
+		numFiles = 0
+		sizeDiff -= info.Size()
+	} else if !fs.IsNotExist(err) {
+		return upload, err
+	}
+	if err = fs.Rename(fsPath, targetPath); err != nil {
+		return upload, err
+	}
+	if !user.IsFileExcludedFromQuota(targetPath) {
+		dataprovider.UpdateUserQuota(dataProvider, user, numFiles, sizeDiff, false)
+	}
+	logger.Info(logSender, "", "interrupted upload finalized for user %#v, rename: %#v -> %#v, size: %v",
+		username, upload.TempPath, upload.Path, upload.Size)
+	return upload, nil
+}
+
+// PurgeInterruptedUpload removes the temporary file with the given virtual path.
+// The user must not be connected
+func PurgeInterruptedUpload(username, tempPath string) (InterruptedUpload, error) {
+	var upload InterruptedUpload
+	_, fs, err := getUserForInterruptedUpload(username)
+	if err != nil {
+		return upload, err
+	}
+	defer fs.Close()
+
+	upload, fsPath, err := getInterruptedUpload(fs, tempPath)
+	if err != nil {
+		return upload, err
+	}
+	// the interrupted uploads are not included in the quota, only a quota scan counts them
+	if err = fs.Remove(fsPath, false); err != nil {
+		return upload, err
+	}
+	logger.Info(logSender, "", "interrupted upload purged for user %#v, path: %#v, size: %v", username,
+		upload.TempPath, upload.Size)
+	return upload, nil
+}
+
+// getUserForInterruptedUpload returns the user with the given username and its filesystem,
+// the filesystem must be closed by the caller
+func getUserForInterruptedUpload(username string) (dataprovider.User, vfs.Fs, error) {
+	user, err := dataprovider.GetUserWithGroupSettings(dataProvider, username)
+	if err != nil {
+		return user, nil, err
+	}
+	if GetActiveSessions(user.Username) > 0 {
+		return user, nil, ErrUserConnected
+	}
+	fs, err := user.GetFilesystem("")
+	if err != nil {
+		return user, nil, err
+	}
+	if !fs.IsAtomicUploadSupported() {
+		fs.Close()
+		return user, nil, ErrInterruptedUploadNotFound
+	}
+	return user, fs, nil
+}
+
+// getInterruptedUpload returns the interrupted upload with the given virtual path and its filesystem path
+func getInterruptedUpload(fs vfs.Fs, tempPath string) (InterruptedUpload, string, error) {
+	var upload InterruptedUpload
+	tempPath = utils.CleanSFTPPath(tempPath)
+	targetName, ok := vfs.GetAtomicUploadTarget(path.Base(tempPath))
+	if !ok {
+		return upload, "", ErrInterruptedUploadNotFound
+	}
+	fsPath, err := fs.ResolvePath(tempPath)
+	if err != nil {
+		return upload, "", err
+	}
+	info, err := fs.Lstat(fsPath)
+	if err != nil {
+		if fs.IsNotExist(err) {
+			return upload, "", ErrInterruptedUploadNotFound
+		}
+		return upload, "", err
+	}
+	if !info.Mode().IsRegular() {
+		return upload, "", ErrInterruptedUploadNotFound
+	}
+	return newInterruptedUpload(tempPath, targetName, info), fsPath, nil
+}
@@ -0,0 +1,61 @@
+package sftpd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	keepAliveRequest         = "keepalive@openssh.com"
+	defaultKeepAliveCountMax = 3
+)
+
+// keepAliveConn defines the methods used to check if the peer is still alive, ssh.ServerConn implements it
+type keepAliveConn interface {
+	SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error)
+	Close() error
+}
+
+// startKeepAlive sends a keepalive request to the client each interval and closes the connection if
+// countMax consecutive requests are not answered, as the OpenSSH ClientAliveInterval and ClientAliveCountMax
+// settings do. Any reply, even a failure, means that the peer is alive.
+// Closing the connection aborts the transfers in progress, so the resources used by connections behind
+// a NAT that silently expired are released without waiting for the TCP timeouts.
+// The returned function must be called to stop the keepalives
+func startKeepAlive(conn keepAliveConn, interval time.Duration, countMax int, connectionID string) func() {
+	if countMax <= 0 {
+		countMax = defaultKeepAliveCountMax
+	}
+	done := make(chan bool)
+	ticker := time.NewTicker(interval)
+	var unanswered int32
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if n := atomic.LoadInt32(&unanswered); int(n) >= countMax {
+					logger.Info(logSender, connectionID, "no reply to %v keepalive requests, closing the connection", n)
+					conn.Close()
+					return
+				}
+				atomic.AddInt32(&unanswered, 1)
+				go func() {
+					// a closed connection returns an error too, the ticker will be stopped anyway
+					if _, _, err := conn.SendRequest(keepAliveRequest, true, nil); err == nil {
+						atomic.StoreInt32(&unanswered, 0)
+					}
+				}()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,343 @@
+package sftpd
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH KRL format, as documented in PROTOCOL.krl
+const (
+	krlMagic         = "SSHKRL\n\x00"
+	krlFormatVersion = 1
+
+	krlSectionCertificates      = 1
+	krlSectionExplicitKey       = 2
+	krlSectionFingerprintSHA1   = 3
+	krlSectionSignature         = 4
+	krlSectionFingerprintSHA256 = 5
+
+	krlSectionCertSerialList   = 0x20
+	krlSectionCertSerialRange  = 0x21
+	krlSectionCertSerialBitmap = 0x22
+	krlSectionCertKeyID        = 0x23
+)
+
+var errKRLTruncated = errors.New("truncated KRL")
+
+type serialRange struct {
+	min uint64
+	max uint64
+}
+
+type serialBitmap struct {
+	offset uint64
+	bitmap *big.Int
+}
+
+// revokedCerts defines the certificates revoked for a CA, a nil CA key matches any CA
+type revokedCerts struct {
+	caKey   []byte
+	serials map[uint64]bool
+	ranges  []serialRange
+	bitmaps []serialBitmap
+	keyIDs  map[string]bool
+}
+
+func (r *revokedCerts) isRevoked(cert *ssh.Certificate) bool {
+	if r.caKey != nil && !bytes.Equal(r.caKey, cert.SignatureKey.Marshal()) {
+		return false
+	}
+	if r.keyIDs[cert.KeyId] {
+		return true
+	}
+	// certificates without a serial number can be revoked using their key ID only
+	if cert.Serial == 0 {
+		return false
+	}
+	if r.serials[cert.Serial] {
+		return true
+	}
+	for _, sr := range r.ranges {
+		if cert.Serial >= sr.min && cert.Serial <= sr.max {
+			return true
+		}
+	}
+	for _, b := range r.bitmaps {
+		if cert.Serial >= b.offset && cert.Serial-b.offset < uint64(b.bitmap.BitLen()) &&
+			b.bitmap.Bit(int(cert.Serial-b.offset)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// revocationList defines the revoked public keys and certificates loaded from a KRL
+// generated using "ssh-keygen -k" or from a file with a public key per line
+type revocationList struct {
+	keys   map[string]bool
+	sha1   map[string]bool
+	sha256 map[string]bool
+	certs  []*revokedCerts
+}
+
+func newRevocationList() *revocationList {
+	return &revocationList{
+		keys:   make(map[string]bool),
+		sha1:   make(map[string]bool),
+		sha256: make(map[string]bool),
+	}
+}
+
+// isRevoked returns true if the given key is revoked. For certificates the certified key and the
+// signing CA key are checked too, as OpenSSH does
+func (r *revocationList) isRevoked(key ssh.PublicKey) bool {
+	if r == nil {
+		return false
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		for _, rc := range r.certs {
+			if rc.isRevoked(cert) {
+				return true
+			}
+		}
+		return r.isPlainKeyRevoked(cert.Key) || r.isPlainKeyRevoked(cert.SignatureKey)
+	}
+	return r.isPlainKeyRevoked(key)
+}
+
+func (r *revocationList) isPlainKeyRevoked(key ssh.PublicKey) bool {
+	blob := key.Marshal()
+	if r.keys[string(blob)] {
+		return true
+	}
+	sha1Sum := sha1.Sum(blob)
+	if r.sha1[string(sha1Sum[:])] {
+		return true
+	}
+	sha256Sum := sha256.Sum256(blob)
+	return r.sha256[string(sha256Sum[:])]
+}
+
+// parseRevocationList parses a binary KRL or, as fallback, a list of public
+// keys in authorized_keys format
+func parseRevocationList(data []byte) (*revocationList, error) {
+	if bytes.HasPrefix(data, []byte(krlMagic)) {
+		return parseKRL(data)
+	}
+	r := newRevocationList()
+	for idx, line := range bytes.Split(data, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse revoked key at line %v: %v", idx+1, err)
+		}
+		if cert, ok := key.(*ssh.Certificate); ok {
+			key = cert.Key
+		}
+		r.keys[string(key.Marshal())] = true
+	}
+	return r, nil
+}
+
+func parseKRL(data []byte) (*revocationList, error) {
+	buf := &krlBuffer{data: data[len(krlMagic):]}
+	version, err := buf.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if version != krlFormatVersion {
+		return nil, fmt.Errorf("unsupported KRL format version %v", version)
+	}
+	// KRL version, generated date, flags
+	for i := 0; i < 3; i++ {
+		if _, err = buf.readUint64(); err != nil {
+			return nil, err
+		}
+	}
+	// reserved, comment
+	for i := 0; i < 2; i++ {
+		if _, err = buf.readString(); err != nil {
+			return nil, err
+		}
+	}
+	r := newRevocationList()
+	for !buf.empty() {
+		sectionType, err := buf.readByte()
+		if err != nil {
+			return nil, err
+		}
+		sectionData, err := buf.readString()
+		if err != nil {
+			return nil, err
+		}
+		section := &krlBuffer{data: sectionData}
+		switch sectionType {
+		case krlSectionCertificates:
+			rc, err := parseKRLCertificates(section)
+			if err != nil {
+				return nil, err
+			}
+			r.certs = append(r.certs, rc)
+		case krlSectionExplicitKey:
+			err = section.readBlobs(r.keys, 0)
+		case krlSectionFingerprintSHA1:
+			err = section.readBlobs(r.sha1, sha1.Size)
+		case krlSectionFingerprintSHA256:
+			err = section.readBlobs(r.sha256, sha256.Size)
+		case krlSectionSignature:
+			// the section data is the signature key and it is followed by the signature itself.
+			// The KRL signatures are not verified, the file is trusted as the other configuration files
+			_, err = buf.readString()
+		default:
+			return nil, fmt.Errorf("unsupported KRL section type %v", sectionType)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func parseKRLCertificates(buf *krlBuffer) (*revokedCerts, error) {
+	caKey, err := buf.readString()
+	if err != nil {
+		return nil, err
+	}
+	// reserved
+	if _, err = buf.readString(); err != nil {
+		return nil, err
+	}
+	rc := &revokedCerts{
+		serials: make(map[uint64]bool),
+		keyIDs:  make(map[string]bool),
+	}
+	if len(caKey) > 0 {
+		rc.caKey = caKey
+	}
+	for !buf.empty() {
+		sectionType, err := buf.readByte()
+		if err != nil {
+			return nil, err
+		}
+		sectionData, err := buf.readString()
+		if err != nil {
+			return nil, err
+		}
+		section := &krlBuffer{data: sectionData}
+		switch sectionType {
+		case krlSectionCertSerialList:
+			for !section.empty() {
+				serial, err := section.readUint64()
+				if err != nil {
+					return nil, err
+				}
+				rc.serials[serial] = true
+			}
+		case krlSectionCertSerialRange:
+			min, err := section.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			max, err := section.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			rc.ranges = append(rc.ranges, serialRange{min: min, max: max})
+		case krlSectionCertSerialBitmap:
+			offset, err := section.readUint64()
+			if err != nil {
+				return nil, err
+			}
+			bitmap, err := section.readString()
+			if err != nil {
+				return nil, err
+			}
+			rc.bitmaps = append(rc.bitmaps, serialBitmap{offset: offset, bitmap: new(big.Int).SetBytes(bitmap)})
+		case krlSectionCertKeyID:
+			for !section.empty() {
+				keyID, err := section.readString()
+				if err != nil {
+					return nil, err
+				}
+				rc.keyIDs[string(keyID)] = true
+			}
+		default:
+			return nil, fmt.Errorf("unsupported KRL certificate section type %v", sectionType)
+		}
+	}
+	return rc, nil
+}
+
+type krlBuffer struct {
+	data []byte
+}
+
+func (b *krlBuffer) empty() bool {
+	return len(b.data) == 0
+}
+
+func (b *krlBuffer) readByte() (byte, error) {
+	if len(b.data) < 1 {
+		return 0, errKRLTruncated
+	}
+	v := b.data[0]
+	b.data = b.data[1:]
+	return v, nil
+}
+
+func (b *krlBuffer) readUint32() (uint32, error) {
+	if len(b.data) < 4 {
+		return 0, errKRLTruncated
+	}
+	v := binary.BigEndian.Uint32(b.data)
+	b.data = b.data[4:]
+	return v, nil
+}
+
+func (b *krlBuffer) readUint64() (uint64, error) {
+	if len(b.data) < 8 {
+		return 0, errKRLTruncated
+	}
+	v := binary.BigEndian.Uint64(b.data)
+	b.data = b.data[8:]
+	return v, nil
+}
+
+func (b *krlBuffer) readString() ([]byte, error) {
+	length, err := b.readUint32()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(b.data)) < uint64(length) {
+		return nil, errKRLTruncated
+	}
+	v := b.data[:length]
+	b.data = b.data[length:]
+	return v, nil
+}
+
+// readBlobs adds all the strings in the buffer to the given set, if size is greater
+// than 0 the strings must have this length
+func (b *krlBuffer) readBlobs(set map[string]bool, size int) error {
+	for !b.empty() {
+		blob, err := b.readString()
+		if err != nil {
+			return err
+		}
+		if size > 0 && len(blob) != size {
+			return fmt.Errorf("invalid KRL fingerprint length %v, expected %v", len(blob), size)
+		}
+		set[string(blob)] = true
+	}
+	return nil
+}
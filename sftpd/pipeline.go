@@ -0,0 +1,295 @@
+package sftpd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// Supported upload pipeline step types
+const (
+	PipelineStepChecksum = "checksum"
+	PipelineStepWebhook  = "webhook"
+	PipelineStepCopy     = "copy"
+	PipelineStepMove     = "move"
+)
+
+// Supported failure policies for the upload pipeline steps
+const (
+	PipelineOnFailureContinue = "continue"
+	PipelineOnFailureStop     = "stop"
+)
+
+const defaultPipelineChecksum = "sha256"
+
+// PipelineStep defines a step of the upload pipeline
+type PipelineStep struct {
+	// Step type: checksum, webhook, copy or move
+	Type string `json:"type" mapstructure:"type"`
+	// Hash algorithm for the checksum step: md5, sha1, sha256, sha384, sha512. Empty means sha256.
+	// The checksum is stored in a sidecar file named as the uploaded file plus the algorithm as extension
+	Algorithm string `json:"algorithm" mapstructure:"algorithm"`
+	// The URL to notify for the webhook step, the upload details are sent as JSON using a POST request
+	URL string `json:"url" mapstructure:"url"`
+	// Timeout, in seconds, for each webhook attempt. 0 means 15 seconds
+	Timeout int `json:"timeout" mapstructure:"timeout"`
+	// Absolute path to the directory for the copy and move steps. The files are stored inside
+	// a sub directory named as the user
+	TargetDir string `json:"target_dir" mapstructure:"target_dir"`
+	// Number of retries if the step fails. 0 means no retries
+	Retries int `json:"retries" mapstructure:"retries"`
+	// Failure policy: "continue" executes the next steps, "stop" skips the remaining steps.
+	// Empty means continue
+	OnFailure string `json:"on_failure" mapstructure:"on_failure"`
+}
+
+// pipelineNotification defines the JSON body sent by the webhook steps
+type pipelineNotification struct {
+	Username     string            `json:"username"`
+	Path         string            `json:"path"`
+	OriginalPath string            `json:"original_path"`
+	FileSize     int64             `json:"file_size"`
+	Checksums    map[string]string `json:"checksums,omitempty"`
+}
+
+// pipelineState is shared among the steps of a single pipeline execution
+type pipelineState struct {
+	username     string
+	path         string
+	originalPath string
+	fileSize     int64
+	checksums    map[string]string
+	// sidecar files created by the previous steps, they follow the uploaded file for copy and move
+	sidecars []string
+}
+
+func (s *PipelineStep) validate() error {
+	switch s.Type {
+	case PipelineStepChecksum:
+		if len(s.Algorithm) == 0 {
+			s.Algorithm = defaultPipelineChecksum
+		}
+		if !utils.IsStringInSlice(s.Algorithm, checkFileHashAlgos) {
+			return fmt.Errorf("unsupported checksum algorithm %#v", s.Algorithm)
+		}
+	case PipelineStepWebhook:
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid webhook URL %#v", s.URL)
+		}
+		if s.Timeout < 0 {
+			return fmt.Errorf("invalid webhook timeout: %v", s.Timeout)
+		}
+		if s.Timeout == 0 {
+			s.Timeout = 15
+		}
+	case PipelineStepCopy, PipelineStepMove:
+		if !filepath.IsAbs(s.TargetDir) {
+			return fmt.Errorf("the target dir for the %v step must be an absolute path: %#v", s.Type, s.TargetDir)
+		}
+	default:
+		return fmt.Errorf("unsupported step type %#v", s.Type)
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("invalid retries: %v", s.Retries)
+	}
+	switch s.OnFailure {
+	case "":
+		s.OnFailure = PipelineOnFailureContinue
+	case PipelineOnFailureContinue, PipelineOnFailureStop:
+	default:
+		return fmt.Errorf("invalid failure policy %#v", s.OnFailure)
+	}
+	return nil
+}
+
+func (c *Configuration) checkUploadPipeline() error {
+	for idx := range c.Actions.UploadPipeline {
+		step := &c.Actions.UploadPipeline[idx]
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("invalid upload pipeline step %v: %v", idx+1, err)
+		}
+	}
+	return nil
+}
+
+// executeUploadPipeline runs the configured upload pipeline steps, in order, for the given local file.
+// It returns the final path for the file, it differs from the initial one if a move step succeeds
+func executeUploadPipeline(steps []PipelineStep, username, filePath string, fileSize int64) string {
+	state := &pipelineState{
+		username:     username,
+		path:         filePath,
+		originalPath: filePath,
+		fileSize:     fileSize,
+		checksums:    make(map[string]string),
+	}
+	for idx, step := range steps {
+		var err error
+		startTime := time.Now()
+		for attempt := 0; attempt <= step.Retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			err = step.execute(state)
+			if err == nil {
+				break
+			}
+		}
+		logger.Debug(logSender, "", "upload pipeline step %v (%v) executed for file %#v, user %#v, elapsed: %v, error: %v",
+			idx+1, step.Type, state.path, username, time.Since(startTime), err)
+		if err != nil {
+			logger.Warn(logSender, "", "upload pipeline step %v (%v) failed for file %#v, user %#v: %v",
+				idx+1, step.Type, state.path, username, err)
+			if step.OnFailure == PipelineOnFailureStop {
+				break
+			}
+		}
+	}
+	return state.path
+}
+
+func (s *PipelineStep) execute(state *pipelineState) error {
+	switch s.Type {
+	case PipelineStepChecksum:
+		return s.executeChecksum(state)
+	case PipelineStepWebhook:
+		return s.executeWebhook(state)
+	case PipelineStepCopy:
+		return s.executeCopy(state)
+	case PipelineStepMove:
+		return s.executeMove(state)
+	}
+	return fmt.Errorf("unsupported step type %#v", s.Type)
+}
+
+func (s *PipelineStep) executeChecksum(state *pipelineState) error {
+	checksum, err := computeHashForFile(getHasher(s.Algorithm), state.path)
+	if err != nil {
+		return err
+	}
+	sidecar := state.path + "." + s.Algorithm
+	content := fmt.Sprintf("%v  %v\n", checksum, filepath.Base(state.path))
+	if err = ioutil.WriteFile(sidecar, []byte(content), 0644); err != nil {
+		return err
+	}
+	state.checksums[s.Algorithm] = checksum
+	if !utils.IsStringInSlice(sidecar, state.sidecars) {
+		state.sidecars = append(state.sidecars, sidecar)
+	}
+	return nil
+}
+
+func (s *PipelineStep) executeWebhook(state *pipelineState) error {
+	body, err := json.Marshal(pipelineNotification{
+		Username:     state.username,
+		Path:         state.path,
+		OriginalPath: state.originalPath,
+		FileSize:     state.fileSize,
+		Checksums:    state.checksums,
+	})
+	if err != nil {
+		return err
+	}
+	httpClient := &http.Client{
+		Timeout: time.Duration(s.Timeout) * time.Second,
+	}
+	resp, err := httpClient.Post(s.URL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("unexpected webhook status code: %v", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *PipelineStep) getTargetPath(state *pipelineState, name string) (string, error) {
+	targetDir := filepath.Join(s.TargetDir, filepath.Base(state.username))
+	if err := os.MkdirAll(targetDir, 0700); err != nil {
+		return "", err
+	}
+	return filepath.Join(targetDir, filepath.Base(name)), nil
+}
+
+func (s *PipelineStep) executeCopy(state *pipelineState) error {
+	for _, name := range append([]string{state.path}, state.sidecars...) {
+		target, err := s.getTargetPath(state, name)
+		if err != nil {
+			return err
+		}
+		if err = copyLocalFile(name, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *PipelineStep) executeMove(state *pipelineState) error {
+	target, err := s.getTargetPath(state, state.path)
+	if err != nil {
+		return err
+	}
+	if err = moveLocalFile(state.path, target); err != nil {
+		return err
+	}
+	state.path = target
+	var sidecars []string
+	for _, name := range state.sidecars {
+		target, err = s.getTargetPath(state, name)
+		if err == nil {
+			err = moveLocalFile(name, target)
+		}
+		if err != nil {
+			logger.Warn(logSender, "", "unable to move sidecar file %#v: %v", name, err)
+			sidecars = append(sidecars, name)
+			continue
+		}
+		sidecars = append(sidecars, target)
+	}
+	state.sidecars = sidecars
+	return nil
+}
+
+// moveLocalFile renames source to target, the file is copied and then removed if the rename
+// fails, for example because the target is on a different filesystem
+func moveLocalFile(source, target string) error {
+	if err := os.Rename(source, target); err == nil {
+		return nil
+	}
+	if err := copyLocalFile(source, target); err != nil {
+		return err
+	}
+	return os.Remove(source)
+}
+
+func copyLocalFile(source, target string) error {
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
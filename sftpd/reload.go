@@ -0,0 +1,101 @@
+package sftpd
+
+import (
+	"net"
+	"sync"
+
+	"github.com/pires/go-proxyproto"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+var (
+	serversMutex sync.Mutex
+	// running SFTP servers, the settings that can be changed without a restart are reloaded for each of them
+	servers []*sshServer
+)
+
+// sshServer holds the reloadable state for a running SFTP server.
+// The new connections use the last loaded settings, the active ones are not affected
+type sshServer struct {
+	sync.RWMutex
+	config       Configuration
+	configDir    string
+	serverConfig *ssh.ServerConfig
+	proxyPolicy  proxyproto.PolicyFunc
+}
+
+func addServer(server *sshServer) {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+	servers = append(servers, server)
+}
+
+// Reload re-reads the host keys, the trusted user CA keys, the revoked keys and the login banner file and reloads
+// the proxy allow list and the client version lists for the running SFTP servers. The keys and banner paths, the allowed
+// proxies and the client versions are taken from the given configuration, the other settings require a restart.
+// The active connections and transfers are not affected.
+// If a server cannot be reloaded, for example because a host key is invalid, it keeps the
+// current settings and the error is returned
+func Reload(c Configuration) error {
+	serversMutex.Lock()
+	defer serversMutex.Unlock()
+
+	var result error
+	for _, server := range servers {
+		if err := server.reload(c); err != nil {
+			logger.Warn(logSender, "", "unable to reload the SFTP server configuration: %v", err)
+			result = err
+		}
+	}
+	return result
+}
+
+func (s *sshServer) reload(c Configuration) error {
+	s.RLock()
+	config := s.config
+	s.RUnlock()
+
+	config.Keys = c.Keys
+	config.TrustedUserCAKeys = c.TrustedUserCAKeys
+	config.RevokedKeysFile = c.RevokedKeysFile
+	config.AllowedClientVersions = c.AllowedClientVersions
+	config.DeniedClientVersions = c.DeniedClientVersions
+	config.LoginBannerFile = c.LoginBannerFile
+	config.ProxyAllowed = c.ProxyAllowed
+	serverConfig, err := config.getServerConfig(s.configDir)
+	if err != nil {
+		return err
+	}
+	proxyPolicy, err := config.getProxyPolicy()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.config = config
+	s.serverConfig = serverConfig
+	s.proxyPolicy = proxyPolicy
+	logger.Debug(logSender, "", "SFTP server configuration reloaded, host keys: %+v, login banner file: %#v, proxy allowed: %v",
+		config.Keys, config.LoginBannerFile, config.ProxyAllowed)
+	return nil
+}
+
+func (s *sshServer) getServerConfig() *ssh.ServerConfig {
+	s.RLock()
+	defer s.RUnlock()
+	return s.serverConfig
+}
+
+// getProxyPolicy applies the current proxy policy to the given upstream address
+func (s *sshServer) getProxyPolicy(upstream net.Addr) (proxyproto.Policy, error) {
+	s.RLock()
+	policyFunc := s.proxyPolicy
+	s.RUnlock()
+	if policyFunc == nil {
+		return proxyproto.USE, nil
+	}
+	return policyFunc(upstream)
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -29,18 +30,36 @@ var (
 
 type scpCommand struct {
 	sshCommand
+	// times received with the last T message, they are applied to the next file or directory
+	pendingTimes *scpFileTimes
+}
+
+// scpFileTimes defines the times sent by the clients with the -p option
+type scpFileTimes struct {
+	mtime time.Time
+	atime time.Time
 }
 
 func (c *scpCommand) handle() error {
 	var err error
 	addConnection(c.connection)
 	defer removeConnection(c.connection)
+	if isShuttingDown() {
+		c.sendErrorMessage(errServerShuttingDown.Error())
+		return errServerShuttingDown
+	}
 	destPath := c.getDestPath()
 	commandType := c.getCommandType()
 	c.connection.Log(logger.LevelDebug, logSenderSCP, "handle scp command, args: %v user: %v command type: %v, dest path: %#v",
 		c.args, c.connection.User.Username, commandType, destPath)
 	if commandType == "-t" {
 		// -t means "to", so upload
+		if c.isTargetDirectory() {
+			err = c.checkTargetDirectory(destPath)
+			if err != nil {
+				return err
+			}
+		}
 		err = c.handleRecursiveUpload()
 		if err != nil {
 			return err
@@ -52,7 +71,11 @@ func (c *scpCommand) handle() error {
 		if err != nil {
 			return err
 		}
-		err = c.handleDownload(destPath)
+		if hasWildcards(path.Base(destPath)) && !c.pathExists(destPath) {
+			err = c.handleWildcardDownload(destPath)
+		} else {
+			err = c.handleDownload(destPath)
+		}
 		if err != nil {
 			return err
 		}
@@ -68,6 +91,8 @@ func (c *scpCommand) handleRecursiveUpload() error {
 	var err error
 	numDirs := 0
 	destPath := c.getDestPath()
+	// times to apply to the directories in the current path when they are completed
+	var dirsTimes []*scpFileTimes
 	for {
 		err = c.sendConfirmationMessage()
 		if err != nil {
@@ -80,6 +105,10 @@ func (c *scpCommand) handleRecursiveUpload() error {
 		if strings.HasPrefix(command, "E") {
 			numDirs--
 			c.connection.Log(logger.LevelDebug, logSenderSCP, "received end dir command, num dirs: %v", numDirs)
+			if len(dirsTimes) > 0 {
+				c.setTimes(destPath, dirsTimes[len(dirsTimes)-1], true)
+				dirsTimes = dirsTimes[:len(dirsTimes)-1]
+			}
 			if numDirs == 0 {
 				// upload is now complete send confirmation message
 				err = c.sendConfirmationMessage()
@@ -95,6 +124,8 @@ func (c *scpCommand) handleRecursiveUpload() error {
 			if err != nil {
 				return err
 			}
+			times := c.pendingTimes
+			c.pendingTimes = nil
 			if strings.HasPrefix(command, "D") {
 				numDirs++
 				destPath = path.Join(destPath, name)
@@ -102,12 +133,15 @@ func (c *scpCommand) handleRecursiveUpload() error {
 				if err != nil {
 					return err
 				}
+				dirsTimes = append(dirsTimes, times)
 				c.connection.Log(logger.LevelDebug, logSenderSCP, "received start dir command, num dirs: %v destPath: %#v", numDirs, destPath)
 			} else if strings.HasPrefix(command, "C") {
-				err = c.handleUpload(c.getFileUploadDestPath(destPath, name), sizeToRead)
+				uploadPath := c.getFileUploadDestPath(destPath, name)
+				err = c.handleUpload(uploadPath, sizeToRead)
 				if err != nil {
 					return err
 				}
+				c.setTimes(uploadPath, times, false)
 			}
 		}
 		if err != nil || numDirs == 0 {
@@ -189,17 +223,32 @@ func (c *scpCommand) getUploadFileData(sizeToRead int64, transfer *Transfer) err
 }
 
 func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead int64, isNewFile bool, fileSize int64) error {
-	if !c.connection.hasSpace(true) {
+	if !c.connection.hasSpace(true, filePath) {
 		err := fmt.Errorf("denying file write due to space limit")
 		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", filePath, err)
 		c.sendErrorMessage(err.Error())
 		return err
 	}
 
+	maxDataTransfer, err := c.connection.getMaxDataTransfer(true)
+	if err == nil && maxDataTransfer > 0 && sizeToRead > maxDataTransfer {
+		err = errDataTransferQuotaExceeded
+	}
+	if err == nil && !c.connection.User.IsUploadSizeAllowed(sizeToRead) {
+		err = errUploadFileSizeExceeded
+	}
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error uploading file: %#v, err: %v", filePath, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
 	initialSize := int64(0)
 	if !isNewFile {
 		if vfs.IsLocalOsFs(c.connection.fs) {
-			dataprovider.UpdateUserQuota(dataProvider, c.connection.User, 0, -fileSize, false)
+			if !c.connection.User.IsFileExcludedFromQuota(requestPath) {
+				dataprovider.UpdateUserQuota(dataProvider, c.connection.User, 0, -fileSize, false)
+			}
 		} else {
 			initialSize = fileSize
 		}
@@ -214,25 +263,29 @@ func (c *scpCommand) handleUploadFile(requestPath, filePath string, sizeToRead i
 	vfs.SetPathPermissions(c.connection.fs, filePath, c.connection.User.GetUID(), c.connection.User.GetGID())
 
 	transfer := Transfer{
-		file:           file,
-		readerAt:       nil,
-		writerAt:       w,
-		cancelFn:       cancelFn,
-		path:           requestPath,
-		start:          time.Now(),
-		bytesSent:      0,
-		bytesReceived:  0,
-		user:           c.connection.User,
-		connectionID:   c.connection.ID,
-		transferType:   transferUpload,
-		lastActivity:   time.Now(),
-		isNewFile:      isNewFile,
-		protocol:       c.connection.protocol,
-		transferError:  nil,
-		isFinished:     false,
-		minWriteOffset: 0,
-		initialSize:    initialSize,
-		lock:           new(sync.Mutex),
+		file:            file,
+		readerAt:        nil,
+		writerAt:        w,
+		cancelFn:        cancelFn,
+		path:            requestPath,
+		start:           time.Now(),
+		bytesSent:       0,
+		bytesReceived:   0,
+		user:            c.connection.User,
+		connectionID:    c.connection.ID,
+		remoteIP:        c.connection.getRemoteIP(),
+		transferType:    transferUpload,
+		lastActivity:    time.Now(),
+		isNewFile:       isNewFile,
+		protocol:        c.connection.protocol,
+		transferError:   nil,
+		isFinished:      false,
+		minWriteOffset:  0,
+		initialSize:     initialSize,
+		maxDataTransfer: maxDataTransfer,
+		fs:              c.connection.fs,
+		checksum:        NewUploadChecksum(),
+		lock:            new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 
@@ -256,7 +309,7 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return err
 	}
 	filePath := p
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
+	if isAtomicUploadEnabled(c.connection.User) && c.connection.fs.IsAtomicUploadSupported() {
 		filePath = c.connection.fs.GetAtomicUploadPath(p)
 	}
 	stat, statErr := c.connection.fs.Stat(p)
@@ -288,7 +341,7 @@ func (c *scpCommand) handleUpload(uploadFilePath string, sizeToRead int64) error
 		return errPermission
 	}
 
-	if isAtomicUploadEnabled() && c.connection.fs.IsAtomicUploadSupported() {
+	if isAtomicUploadEnabled(c.connection.User) && c.connection.fs.IsAtomicUploadSupported() {
 		err = c.connection.fs.Rename(p, filePath)
 		if err != nil {
 			c.connection.Log(logger.LevelError, logSenderSCP, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %v",
@@ -484,6 +537,16 @@ func (c *scpCommand) handleDownload(filePath string) error {
 		c.sendErrorMessage(errPermission.Error())
 	}
 
+	maxDataTransfer, err := c.connection.getMaxDataTransfer(false)
+	if err == nil && maxDataTransfer > 0 && stat.Size() > maxDataTransfer {
+		err = errDataTransferQuotaExceeded
+	}
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error downloading file: %#v, err: %v", p, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+
 	file, r, cancelFn, err := c.connection.fs.Open(p)
 	if err != nil {
 		c.connection.Log(logger.LevelError, logSenderSCP, "could not open file %#v for reading: %v", p, err)
@@ -492,25 +555,27 @@ func (c *scpCommand) handleDownload(filePath string) error {
 	}
 
 	transfer := Transfer{
-		file:           file,
-		readerAt:       r,
-		writerAt:       nil,
-		cancelFn:       cancelFn,
-		path:           p,
-		start:          time.Now(),
-		bytesSent:      0,
-		bytesReceived:  0,
-		user:           c.connection.User,
-		connectionID:   c.connection.ID,
-		transferType:   transferDownload,
-		lastActivity:   time.Now(),
-		isNewFile:      false,
-		protocol:       c.connection.protocol,
-		transferError:  nil,
-		isFinished:     false,
-		minWriteOffset: 0,
-		expectedSize:   stat.Size(),
-		lock:           new(sync.Mutex),
+		file:            file,
+		readerAt:        r,
+		writerAt:        nil,
+		cancelFn:        cancelFn,
+		path:            p,
+		start:           time.Now(),
+		bytesSent:       0,
+		bytesReceived:   0,
+		user:            c.connection.User,
+		connectionID:    c.connection.ID,
+		remoteIP:        c.connection.getRemoteIP(),
+		transferType:    transferDownload,
+		lastActivity:    time.Now(),
+		isNewFile:       false,
+		protocol:        c.connection.protocol,
+		transferError:   nil,
+		isFinished:      false,
+		minWriteOffset:  0,
+		expectedSize:    stat.Size(),
+		maxDataTransfer: maxDataTransfer,
+		lock:            new(sync.Mutex),
 	}
 	addTransfer(&transfer)
 
@@ -538,6 +603,140 @@ func (c *scpCommand) isRecursive() bool {
 	return utils.IsStringInSlice("-r", c.args)
 }
 
+// isTargetDirectory returns true if the client requires that the upload target is a directory,
+// scp sends the -d option when multiple files are copied
+func (c *scpCommand) isTargetDirectory() bool {
+	return utils.IsStringInSlice("-d", c.args)
+}
+
+func (c *scpCommand) checkTargetDirectory(dirPath string) error {
+	p, err := c.connection.fs.ResolvePath(dirPath)
+	if err == nil {
+		var isDir bool
+		isDir, err = vfs.IsDirectory(c.connection.fs, p)
+		if err == nil && !isDir {
+			err = fmt.Errorf("%v: Not a directory", dirPath)
+		}
+	}
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "invalid target directory %#v: %v", dirPath, err)
+		c.sendErrorMessage(err.Error())
+	}
+	return err
+}
+
+func (c *scpCommand) pathExists(sshPath string) bool {
+	p, err := c.connection.fs.ResolvePath(sshPath)
+	if err != nil {
+		return false
+	}
+	_, err = c.connection.fs.Stat(p)
+	return err == nil
+}
+
+// handleWildcardDownload sends the files, and the directories for recursive copies, matching the given
+// pattern. As for the shell expansion done by OpenSSH, only the last path element can contain wildcards
+// and the hidden files are matched only if the pattern starts with a dot
+func (c *scpCommand) handleWildcardDownload(pattern string) error {
+	dirPath := path.Dir(pattern)
+	namePattern := path.Base(pattern)
+	if !c.connection.User.HasPerm(dataprovider.PermListItems, dirPath) {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error expanding %#v, permission denied", pattern)
+		c.sendErrorMessage(errPermission.Error())
+		return errPermission
+	}
+	p, err := c.connection.fs.ResolvePath(dirPath)
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error expanding %#v, invalid path: %v", pattern, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	files, err := c.connection.fs.ReadDir(p)
+	if err != nil {
+		c.connection.Log(logger.LevelWarn, logSenderSCP, "error expanding %#v: %v", pattern, err)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	files = c.connection.User.AddVirtualDirs(files, dirPath)
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+	var matches []string
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), ".") && !strings.HasPrefix(namePattern, ".") {
+			continue
+		}
+		matched, err := path.Match(namePattern, file.Name())
+		if err != nil {
+			c.sendErrorMessage(err.Error())
+			return err
+		}
+		if matched && (!file.IsDir() || c.isRecursive()) {
+			matches = append(matches, path.Join(dirPath, file.Name()))
+		}
+	}
+	c.connection.Log(logger.LevelDebug, logSenderSCP, "pattern %#v expanded to %v", pattern, matches)
+	if len(matches) == 0 {
+		err = fmt.Errorf("%v: No such file or directory", pattern)
+		c.sendErrorMessage(err.Error())
+		return err
+	}
+	for _, filePath := range matches {
+		if err = c.handleDownload(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTimes applies the times received with the -p option, if any, to the given path.
+// The errors are logged and ignored, as OpenSSH does
+func (c *scpCommand) setTimes(sshPath string, times *scpFileTimes, isDir bool) {
+	if times == nil || isSetstatIgnored(c.connection.User) {
+		return
+	}
+	pathForPerms := sshPath
+	if isDir {
+		pathForPerms = path.Dir(sshPath)
+	}
+	if !c.connection.User.HasPerm(dataprovider.PermChtimes, pathForPerms) {
+		c.connection.Log(logger.LevelDebug, logSenderSCP, "times not preserved for %#v, permission denied", sshPath)
+		return
+	}
+	p, err := c.connection.fs.ResolvePath(sshPath)
+	if err == nil {
+		err = c.connection.fs.Chtimes(p, times.atime, times.mtime)
+	}
+	c.connection.Log(logger.LevelDebug, logSenderSCP, "set times for %#v, mtime: %v atime: %v, err: %v", sshPath,
+		times.mtime, times.atime, err)
+}
+
+// parseTimeMessage parses protocol messages such as:
+// T1183832947 0 1183833773 0
+// the modification time is followed by the access time, both as seconds and microseconds
+func parseTimeMessage(command string) (*scpFileTimes, error) {
+	parts := strings.Split(strings.TrimPrefix(command, "T"), " ")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("invalid time message: %#v", command)
+	}
+	var values [4]int64
+	for idx, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil || v < 0 || (idx%2 == 1 && v > 999999) {
+			return nil, fmt.Errorf("invalid time message: %#v", command)
+		}
+		values[idx] = v
+	}
+	return &scpFileTimes{
+		mtime: time.Unix(values[0], values[1]*1000),
+		atime: time.Unix(values[2], values[3]*1000),
+	}, nil
+}
+
+func hasWildcards(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
 // read the SCP confirmation message and the optional text message
 // the channel will be closed on errors
 func (c *scpCommand) readConfirmationMessage() error {
@@ -619,8 +818,8 @@ func (c *scpCommand) sendProtocolMessage(message string) error {
 	return err
 }
 
-// get the next upload protocol message ignoring T command if any
-// we use our own user setting for permissions
+// get the next upload protocol message, the times received with a T command, if any, are saved
+// and applied to the next uploaded file or directory. We use our own user setting for permissions
 func (c *scpCommand) getNextUploadProtocolMessage() (string, error) {
 	var command string
 	var err error
@@ -630,6 +829,11 @@ func (c *scpCommand) getNextUploadProtocolMessage() (string, error) {
 			return command, err
 		}
 		if strings.HasPrefix(command, "T") {
+			times, parseErr := parseTimeMessage(command)
+			if parseErr != nil {
+				c.connection.Log(logger.LevelWarn, logSenderSCP, "ignoring invalid time message %#v: %v", command, parseErr)
+			}
+			c.pendingTimes = times
 			err = c.sendConfirmationMessage()
 			if err != nil {
 				return command, err
@@ -1,6 +1,7 @@
 package sftpd
 
 import (
+	"bytes"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
@@ -8,14 +9,21 @@ import (
 	"io"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/drakkan/sftpgo/audit"
 	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/ratelimiter"
 	"github.com/drakkan/sftpgo/utils"
 	"github.com/pires/go-proxyproto"
 	"github.com/pkg/sftp"
@@ -23,23 +31,27 @@ import (
 )
 
 const (
-	defaultPrivateRSAKeyName   = "id_rsa"
-	defaultPrivateECDSAKeyName = "id_ecdsa"
+	defaultPrivateRSAKeyName     = "id_rsa"
+	defaultPrivateECDSAKeyName   = "id_ecdsa"
+	defaultPrivateEd25519KeyName = "id_ed25519"
 )
 
 var (
-	sftpExtensions            = []string{"posix-rename@openssh.com"}
+	sftpExtensions            = []string{"posix-rename@openssh.com", "hardlink@openssh.com"}
 	errWrongProxyProtoVersion = errors.New("unacceptable proxy protocol version")
+	errAuthRateLimited        = errors.New("authentication rate limit exceeded")
 )
 
 // Configuration for the SFTP server
 type Configuration struct {
 	// Identification string used by the server
 	Banner string `json:"banner" mapstructure:"banner"`
-	// The port used for serving SFTP requests
+	// Deprecated: please use Bindings
 	BindPort int `json:"bind_port" mapstructure:"bind_port"`
-	// The address to listen on. A blank value means listen on all available network interfaces.
+	// Deprecated: please use Bindings
 	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
+	// Addresses and ports to bind to
+	Bindings []Binding `json:"bindings" mapstructure:"bindings"`
 	// Maximum idle timeout as minutes. If a client is idle for a time that exceeds this setting it will be disconnected.
 	// 0 means disabled
 	IdleTimeout int `json:"idle_timeout" mapstructure:"idle_timeout"`
@@ -63,6 +75,20 @@ type Configuration struct {
 	Actions Actions `json:"actions" mapstructure:"actions"`
 	// Keys are a list of host keys
 	Keys []Key `json:"keys" mapstructure:"keys"`
+	// TrustedUserCAKeys are files containing the public keys, in authorized_keys format, of the
+	// certificate authorities trusted to sign user certificates. The paths can be absolute or
+	// relative to the configuration directory
+	TrustedUserCAKeys []string `json:"trusted_user_ca_keys" mapstructure:"trusted_user_ca_keys"`
+	// RevokedKeysFile is an OpenSSH key revocation list, as generated by "ssh-keygen -k", or a file
+	// with a public key per line. The revoked keys and certificates are denied for all the users.
+	// The path can be absolute or relative to the configuration directory
+	RevokedKeysFile string `json:"revoked_keys_file" mapstructure:"revoked_keys_file"`
+	// AllowedClientVersions, if not empty, defines the shell like patterns, for example "SSH-2.0-OpenSSH_*",
+	// for the client version banners allowed to authenticate, the other clients are rejected
+	AllowedClientVersions []string `json:"allowed_client_versions" mapstructure:"allowed_client_versions"`
+	// DeniedClientVersions defines the shell like patterns for the client version banners not allowed
+	// to authenticate, for example known broken SSH libraries. They are evaluated before the allowed ones
+	DeniedClientVersions []string `json:"denied_client_versions" mapstructure:"denied_client_versions"`
 	// IsSCPEnabled determines if experimental SCP support is enabled.
 	// This setting is deprecated and will be removed in future versions,
 	// please add "scp" to the EnabledSSHCommands list to enable it.
@@ -81,6 +107,10 @@ type Configuration struct {
 	// SetstatMode 0 means "normal mode": requests for changing permissions and owner/group are executed.
 	// 1 means "ignore mode": requests for changing permissions and owner/group are silently ignored.
 	SetstatMode int `json:"setstat_mode" mapstructure:"setstat_mode"`
+	// UploadChecksums enables the SHA-256 computation while the files are uploaded, for any protocol.
+	// The checksum is stored as file metadata: an extended attribute on the local filesystem and object
+	// metadata on cloud backends
+	UploadChecksums bool `json:"upload_checksums" mapstructure:"upload_checksums"`
 	// List of enabled SSH commands.
 	// We support the following SSH commands:
 	// - "scp". SCP is an experimental feature, we have our own SCP implementation since
@@ -98,13 +128,19 @@ type Configuration struct {
 	// - "cd", "pwd". Some mobile SFTP clients does not support the SFTP SSH_FXP_REALPATH and so
 	//      they use "cd" and "pwd" SSH commands to get the initial directory.
 	//      Currently `cd` do nothing and `pwd` always returns the "/" path.
+	// - "sftpgo-copy". Server side copy for the clients that don't support the copy-data SFTP
+	//      extension, usage: "sftpgo-copy <source> <destination>". The quota is checked and updated.
+	// - "sftpgo-zip". Streams a zip archive with the contents of a directory, usage:
+	//      "sftpgo-zip <directory>". The download bandwidth and data transfer limits are applied.
 	//
 	// The following SSH commands are enabled by default: "md5sum", "sha1sum", "cd", "pwd".
 	// "*" enables all supported SSH commands.
 	EnabledSSHCommands []string `json:"enabled_ssh_commands" mapstructure:"enabled_ssh_commands"`
-	// Absolute path to an external program to use for keyboard interactive authentication.
-	// Leave empty to disable this authentication mode.
+	// Deprecated: please use KeyboardInteractiveHook
 	KeyboardInteractiveProgram string `json:"keyboard_interactive_auth_program" mapstructure:"keyboard_interactive_auth_program"`
+	// Absolute path to an external program or an HTTP URL to invoke for keyboard interactive authentication.
+	// Leave empty to disable this authentication mode.
+	KeyboardInteractiveHook string `json:"keyboard_interactive_auth_hook" mapstructure:"keyboard_interactive_auth_hook"`
 	// Support for HAProxy PROXY protocol.
 	// If you are running SFTPGo behind a proxy server such as HAProxy, AWS ELB or NGNIX, you can enable
 	// the proxy protocol. It provides a convenient way to safely transport connection information
@@ -122,12 +158,86 @@ type Configuration struct {
 	// If proxy protocol is set to 2 and we receive a proxy header from an IP that is not in the list then the
 	// connection will be rejected.
 	ProxyAllowed []string `json:"proxy_allowed" mapstructure:"proxy_allowed"`
+	// Maximum time, as seconds, to wait for the active transfers to finish on shutdown, the
+	// remaining connections are closed after this time. 0 means that the connections are
+	// closed without waiting
+	GraceTime int `json:"grace_time" mapstructure:"grace_time"`
+	// Maximum number of concurrent client connections, authenticated or not, for all the bindings.
+	// New connections above this limit are closed before the SSH handshake. 0 means unlimited
+	MaxTotalConnections int `json:"max_total_connections" mapstructure:"max_total_connections"`
+	// Maximum number of concurrent client connections from the same source IP. 0 means unlimited
+	MaxPerHostConnections int `json:"max_per_host_connections" mapstructure:"max_per_host_connections"`
+	// Maximum number of SSH handshakes, including the authentication, in progress at the same time.
+	// New connections above this limit are closed, so slow or half-open connections cannot starve
+	// the legitimate clients. 0 means unlimited
+	MaxConcurrentHandshakes int `json:"max_concurrent_handshakes" mapstructure:"max_concurrent_handshakes"`
+	// Maximum time, as seconds, to complete the SSH handshake and the authentication.
+	// 0 means the default, 120 seconds as OpenSSH
+	HandshakeTimeout int `json:"handshake_timeout" mapstructure:"handshake_timeout"`
+	// Interval, as seconds, for sending keepalive requests to the clients after the authentication.
+	// The idle timeout only detects inactive connections, the keepalives detect the unresponsive peers,
+	// for example behind a NAT that dropped the connection, even while a transfer is in progress.
+	// 0 means disabled
+	KeepAliveInterval int `json:"keepalive_interval" mapstructure:"keepalive_interval"`
+	// Number of consecutive keepalive requests without a reply after which the connection is closed.
+	// 0 means the default, 3 as OpenSSH
+	KeepAliveCountMax int `json:"keepalive_count_max" mapstructure:"keepalive_count_max"`
+	certChecker       *ssh.CertChecker
+	revokedKeys       *revocationList
+	// keyboard interactive hook resolved by configureKeyboardInteractiveAuth
+	keyboardInteractiveHook string
+}
+
+// Binding defines the configuration for a network listener
+type Binding struct {
+	// The address to listen on. A blank value means listen on all available network interfaces.
+	Address string `json:"address" mapstructure:"address"`
+	// The port used for serving requests
+	Port int `json:"port" mapstructure:"port"`
+	// ApplyProxyConfig defines if the proxy protocol settings, if any, must be applied to this binding.
+	// This way you can have bindings that accept the proxy header, for the proxied clients, and
+	// bindings that don't, for example to serve the clients inside the local network
+	ApplyProxyConfig bool `json:"apply_proxy_config" mapstructure:"apply_proxy_config"`
+}
+
+// GetAddress returns the binding address, IPv6 addresses are supported
+func (b Binding) GetAddress() string {
+	return net.JoinHostPort(b.Address, strconv.Itoa(b.Port))
+}
+
+// IsValid returns true if the binding port is greater than 0
+func (b Binding) IsValid() bool {
+	return b.Port > 0
 }
 
 // Key contains information about host keys
 type Key struct {
 	// The private key path relative to the configuration directory or absolute
 	PrivateKey string `json:"private_key" mapstructure:"private_key"`
+	// Optional host certificate for the private key, in OpenSSH format, the path
+	// can be relative to the configuration directory or absolute.
+	// The clients that trust the certificate authority can verify the server
+	// without adding its host key to their known hosts
+	Certificate string `json:"certificate" mapstructure:"certificate"`
+}
+
+// publicKeyStep defines a successful public key authentication that is the first step
+// of a multi-step authentication
+type publicKeyStep struct {
+	user            dataprovider.User
+	keyID           string
+	criticalOptions map[string]string
+}
+
+// login logs in the user authenticated using the public key once the next step succeeds,
+// the next steps only verify the additional credentials, so the user settings, including
+// the certificate restrictions, are the ones resolved for the public key
+func (s *publicKeyStep) login(loginMethod, remoteAddr string) (*ssh.Permissions, error) {
+	sshPerm, err := loginUser(s.user, loginMethod, remoteAddr, s.keyID)
+	if err == nil && s.criticalOptions != nil {
+		sshPerm.CriticalOptions = s.criticalOptions
+	}
+	return sshPerm, err
 }
 
 type authenticationError struct {
@@ -147,11 +257,185 @@ func (c Configuration) Initialize(configDir string) error {
 		logger.Warn(logSender, "", "error reading umask, please fix your config file: %v", err)
 		logger.WarnToConsole("error reading umask, please fix your config file: %v", err)
 	}
+	serverConfig, err := c.getServerConfig(configDir)
+	if err != nil {
+		return err
+	}
+	proxyPolicy, err := c.getProxyPolicy()
+	if err != nil {
+		logger.Warn(logSender, "", "error enabling proxy listener: %v", err)
+		return err
+	}
+	c.configureSFTPExtensions()
+	c.checkSSHCommands()
+	c.checkActions()
+	if err = c.checkUploadPipeline(); err != nil {
+		logger.Warn(logSender, "", "error initializing the upload pipeline: %v", err)
+		return err
+	}
+	server := &sshServer{
+		config:       c,
+		configDir:    configDir,
+		serverConfig: serverConfig,
+		proxyPolicy:  proxyPolicy,
+	}
+
+	listeners, err := c.getListeners(server)
+	if err != nil {
+		return err
+	}
+	actions = c.Actions
+	uploadMode = c.UploadMode
+	setstatMode = c.SetstatMode
+	uploadChecksums = c.UploadChecksums
+	setConnectionLimits(c.MaxTotalConnections, c.MaxPerHostConnections)
+	setHandshakeLimits(c.MaxConcurrentHandshakes, c.HandshakeTimeout)
+	c.checkIdleTimer()
+	for _, listener := range listeners {
+		if err = addListener(listener); err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+	}
+	addServer(server)
+
+	exitChannel := make(chan error, len(listeners))
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			exitChannel <- c.serve(listener, server)
+		}(listener)
+	}
+	return <-exitChannel
+}
+
+// getListeners returns the listeners for the inherited sockets, if the service is socket
+// activated, or it starts a listener for each configured binding.
+// All the listeners are started before serving, so a listen error for one of the bindings
+// is reported without leaving the other bindings running
+func (c Configuration) getListeners(server *sshServer) ([]net.Listener, error) {
+	activationListeners, err := getActivationListeners()
+	if err != nil {
+		logger.Warn(logSender, "", "unable to use the socket activation listeners: %v", err)
+		return nil, err
+	}
+	if len(activationListeners) > 0 {
+		var listeners []net.Listener
+		for _, listener := range activationListeners {
+			listeners = append(listeners, c.wrapListener(listener, c.getActivationBinding(listener), server))
+		}
+		return listeners, nil
+	}
+	bindings := c.getBindings()
+	if len(bindings) == 0 {
+		logger.Warn(logSender, "", "no valid binding configured")
+		return nil, errors.New("no valid binding configured")
+	}
+	var listeners []net.Listener
+	for _, binding := range bindings {
+		listener, err := c.listen(binding, server)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// getActivationBinding returns the configured binding with the same port as the given
+// inherited listener, the proxy configuration is applied to listeners without a matching
+// binding
+func (c Configuration) getActivationBinding(listener net.Listener) Binding {
+	port := 0
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok {
+		port = addr.Port
+	}
+	for _, binding := range c.getBindings() {
+		if binding.Port == port {
+			return binding
+		}
+	}
+	return Binding{
+		Port:             port,
+		ApplyProxyConfig: true,
+	}
+}
+
+// getBindings returns the valid configured bindings or a binding built using the
+// deprecated bind_address and bind_port settings, if no binding is configured
+func (c Configuration) getBindings() []Binding {
+	if len(c.Bindings) == 0 && c.BindPort > 0 {
+		return []Binding{
+			{
+				Address:          c.BindAddress,
+				Port:             c.BindPort,
+				ApplyProxyConfig: true,
+			},
+		}
+	}
+	var bindings []Binding
+	for _, binding := range c.Bindings {
+		if binding.IsValid() {
+			bindings = append(bindings, binding)
+		}
+	}
+	return bindings
+}
+
+// listen starts a listener for the given binding
+func (c Configuration) listen(binding Binding, server *sshServer) (net.Listener, error) {
+	listener, err := net.Listen("tcp", binding.GetAddress())
+	if err != nil {
+		logger.Warn(logSender, "", "error starting listener on address %v: %v", binding.GetAddress(), err)
+		return nil, err
+	}
+	return c.wrapListener(listener, binding, server), nil
+}
+
+// wrapListener returns a proxy protocol listener for the given listener if the proxy
+// protocol is enabled and it must be applied to the binding.
+// The proxy policy is read from the server for each connection so it can be reloaded
+func (c Configuration) wrapListener(listener net.Listener, binding Binding, server *sshServer) net.Listener {
+	if binding.ApplyProxyConfig && c.ProxyProtocol > 0 {
+		logger.Info(logSender, "", "server listener registered address: %v, proxy protocol: %v",
+			listener.Addr().String(), c.ProxyProtocol)
+		return &proxyproto.Listener{
+			Listener: listener,
+			Policy:   server.getProxyPolicy,
+		}
+	}
+	logger.Info(logSender, "", "server listener registered address: %v", listener.Addr().String())
+	return listener
+}
+
+func (c Configuration) serve(listener net.Listener, server *sshServer) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if isShuttingDown() {
+				logger.Info(logSender, "", "server listener %v closed", listener.Addr().String())
+				return ErrServerClosed
+			}
+			logger.Warn(logSender, "", "error accepting connection: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go c.AcceptInboundConnection(conn, server.getServerConfig())
+	}
+}
+
+// getServerConfig returns the SSH server configuration, the host keys, the trusted user
+// certificate authorities and the login banner are loaded from the configured paths
+func (c *Configuration) getServerConfig(configDir string) (*ssh.ServerConfig, error) {
 	serverConfig := &ssh.ServerConfig{
 		NoClientAuth: false,
 		MaxAuthTries: c.MaxAuthTries,
 		PasswordCallback: func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
-			sp, err := c.validatePasswordCredentials(conn, pass)
+			sp, err := c.validatePasswordCredentials(conn, pass, nil)
 			if err != nil {
 				return nil, &authenticationError{err: fmt.Sprintf("could not validate password credentials: %v", err)}
 			}
@@ -159,7 +443,10 @@ func (c Configuration) Initialize(configDir string) error {
 			return sp, nil
 		},
 		PublicKeyCallback: func(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
-			sp, err := c.validatePublicKeyCredentials(conn, string(pubKey.Marshal()))
+			sp, err := c.validatePublicKeyCredentials(conn, pubKey)
+			if _, ok := err.(*ssh.PartialSuccessError); ok {
+				return sp, err
+			}
 			if err != nil {
 				return nil, &authenticationError{err: fmt.Sprintf("could not validate public key credentials: %v", err)}
 			}
@@ -169,9 +456,24 @@ func (c Configuration) Initialize(configDir string) error {
 		ServerVersion: "SSH-2.0-" + c.Banner,
 	}
 
+	err := c.checkClientVersionPatterns()
+	if err != nil {
+		return nil, err
+	}
+
 	err = c.checkHostKeys(configDir)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = c.initializeCertChecker(configDir)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.loadRevokedKeys(configDir)
+	if err != nil {
+		return nil, err
 	}
 
 	for _, k := range c.Keys {
@@ -183,82 +485,58 @@ func (c Configuration) Initialize(configDir string) error {
 
 		privateBytes, err := ioutil.ReadFile(privateFile)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		private, err := ssh.ParsePrivateKey(privateBytes)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Add private key to the server configuration.
 		serverConfig.AddHostKey(private)
+
+		if len(k.Certificate) > 0 {
+			certSigner, err := getHostCertSigner(k.Certificate, configDir, private)
+			if err != nil {
+				logger.Warn(logSender, "", "error loading host certificate %#v: %v", k.Certificate, err)
+				return nil, err
+			}
+			// the certificate has a different key type so it does not replace the private key
+			serverConfig.AddHostKey(certSigner)
+		}
 	}
 
 	c.configureSecurityOptions(serverConfig)
 	c.configureKeyboardInteractiveAuth(serverConfig)
 	c.configureLoginBanner(serverConfig, configDir)
-	c.configureSFTPExtensions()
-	c.checkSSHCommands()
-
-	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort))
-	if err != nil {
-		logger.Warn(logSender, "", "error starting listener on address %s:%d: %v", c.BindAddress, c.BindPort, err)
-		return err
-	}
-	proxyListener, err := c.getProxyListener(listener)
-	if err != nil {
-		logger.Warn(logSender, "", "error enabling proxy listener: %v", err)
-		return err
-	}
-	actions = c.Actions
-	uploadMode = c.UploadMode
-	setstatMode = c.SetstatMode
-	logger.Info(logSender, "", "server listener registered address: %v", listener.Addr().String())
-	c.checkIdleTimer()
-
-	for {
-		var conn net.Conn
-		if proxyListener != nil {
-			conn, err = proxyListener.Accept()
-		} else {
-			conn, err = listener.Accept()
-		}
-		if conn != nil && err == nil {
-			go c.AcceptInboundConnection(conn, serverConfig)
-		}
-	}
+	return serverConfig, nil
 }
 
-func (c *Configuration) getProxyListener(listener net.Listener) (*proxyproto.Listener, error) {
-	var proxyListener *proxyproto.Listener
+// getProxyPolicy returns the policy to apply to the proxy headers based on the proxy
+// protocol mode and the allowed IPs. A nil policy means that the proxy header, if any, is used
+func (c *Configuration) getProxyPolicy() (proxyproto.PolicyFunc, error) {
+	var policyFunc proxyproto.PolicyFunc
 	var err error
-	if c.ProxyProtocol > 0 {
-		var policyFunc func(upstream net.Addr) (proxyproto.Policy, error)
-		if c.ProxyProtocol == 1 && len(c.ProxyAllowed) > 0 {
-			policyFunc, err = proxyproto.LaxWhiteListPolicy(c.ProxyAllowed)
+	if c.ProxyProtocol == 1 && len(c.ProxyAllowed) > 0 {
+		policyFunc, err = proxyproto.LaxWhiteListPolicy(c.ProxyAllowed)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if c.ProxyProtocol == 2 {
+		if len(c.ProxyAllowed) == 0 {
+			policyFunc = func(upstream net.Addr) (proxyproto.Policy, error) {
+				return proxyproto.REQUIRE, nil
+			}
+		} else {
+			policyFunc, err = proxyproto.StrictWhiteListPolicy(c.ProxyAllowed)
 			if err != nil {
 				return nil, err
 			}
 		}
-		if c.ProxyProtocol == 2 {
-			if len(c.ProxyAllowed) == 0 {
-				policyFunc = func(upstream net.Addr) (proxyproto.Policy, error) {
-					return proxyproto.REQUIRE, nil
-				}
-			} else {
-				policyFunc, err = proxyproto.StrictWhiteListPolicy(c.ProxyAllowed)
-				if err != nil {
-					return nil, err
-				}
-			}
-		}
-		proxyListener = &proxyproto.Listener{
-			Listener: listener,
-			Policy:   policyFunc,
-		}
 	}
-	return proxyListener, nil
+	return policyFunc, nil
 }
 
 func (c Configuration) checkIdleTimer() {
@@ -300,25 +578,39 @@ func (c Configuration) configureLoginBanner(serverConfig *ssh.ServerConfig, conf
 	return err
 }
 
-func (c Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
-	if len(c.KeyboardInteractiveProgram) == 0 {
-		return
+// configureKeyboardInteractiveAuth always enables keyboard interactive authentication:
+// it is required for the users with a TOTP secret even if no external hook is configured
+func (c *Configuration) configureKeyboardInteractiveAuth(serverConfig *ssh.ServerConfig) {
+	authHook := c.KeyboardInteractiveHook
+	if len(authHook) == 0 && len(c.KeyboardInteractiveProgram) > 0 {
+		logger.Warn(logSender, "", "keyboard_interactive_auth_program is deprecated, please use keyboard_interactive_auth_hook")
+		logger.WarnToConsole("keyboard_interactive_auth_program is deprecated, please use keyboard_interactive_auth_hook")
+		authHook = c.KeyboardInteractiveProgram
 	}
-	if !filepath.IsAbs(c.KeyboardInteractiveProgram) {
-		logger.WarnToConsole("invalid keyboard interactive authentication program: %#v must be an absolute path",
-			c.KeyboardInteractiveProgram)
-		logger.Warn(logSender, "", "invalid keyboard interactive authentication program: %#v must be an absolute path",
-			c.KeyboardInteractiveProgram)
-		return
-	}
-	_, err := os.Stat(c.KeyboardInteractiveProgram)
-	if err != nil {
-		logger.WarnToConsole("invalid keyboard interactive authentication program:: %v", err)
-		logger.Warn(logSender, "", "invalid keyboard interactive authentication program:: %v", err)
-		return
+	if len(authHook) > 0 {
+		if strings.HasPrefix(authHook, "http") {
+			if u, err := url.Parse(authHook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+				logger.WarnToConsole("invalid keyboard interactive authentication hook: %#v is not a valid HTTP/HTTPS URL",
+					authHook)
+				logger.Warn(logSender, "", "invalid keyboard interactive authentication hook: %#v is not a valid HTTP/HTTPS URL",
+					authHook)
+				authHook = ""
+			}
+		} else if !filepath.IsAbs(authHook) {
+			logger.WarnToConsole("invalid keyboard interactive authentication program: %#v must be an absolute path",
+				authHook)
+			logger.Warn(logSender, "", "invalid keyboard interactive authentication program: %#v must be an absolute path",
+				authHook)
+			authHook = ""
+		} else if _, err := os.Stat(authHook); err != nil {
+			logger.WarnToConsole("invalid keyboard interactive authentication program:: %v", err)
+			logger.Warn(logSender, "", "invalid keyboard interactive authentication program:: %v", err)
+			authHook = ""
+		}
 	}
+	c.keyboardInteractiveHook = authHook
 	serverConfig.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
-		sp, err := c.validateKeyboardInteractiveCredentials(conn, client)
+		sp, err := c.validateKeyboardInteractiveCredentials(conn, client, authHook, nil)
 		if err != nil {
 			return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
 		}
@@ -339,15 +631,42 @@ func (c Configuration) configureSFTPExtensions() error {
 // AcceptInboundConnection handles an inbound connection to the server instance and determines if the request should be served or not.
 func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.ServerConfig) {
 
+	remoteAddr := conn.RemoteAddr()
+	ipAddr := utils.GetIPFromRemoteAddress(remoteAddr.String())
+	if isShuttingDown() {
+		logger.Debug(logSender, "", "connection refused from ip %#v, the server is shutting down", ipAddr)
+		conn.Close()
+		return
+	}
+	if defender.IsBanned(ipAddr) {
+		logger.Debug(logSender, "", "connection refused, ip %#v is banned", ipAddr)
+		conn.Close()
+		return
+	}
+	if !ratelimiter.AllowConnection(ipAddr) {
+		conn.Close()
+		return
+	}
+	if !addClientConnection(ipAddr) {
+		conn.Close()
+		return
+	}
+	defer removeClientConnection(ipAddr)
+	timeout, ok := startHandshake(ipAddr)
+	if !ok {
+		conn.Close()
+		return
+	}
 	// Before beginning a handshake must be performed on the incoming net.Conn
 	// we'll set a Deadline for handshake to complete, the default is 2 minutes as OpenSSH
-	conn.SetDeadline(time.Now().Add(handshakeTimeout))
-	remoteAddr := conn.RemoteAddr()
+	conn.SetDeadline(time.Now().Add(timeout))
 	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	endHandshake()
 	if err != nil {
 		logger.Warn(logSender, "", "failed to accept an incoming connection: %v", err)
 		if _, ok := err.(*ssh.ServerAuthError); !ok {
-			logger.ConnectionFailedLog("", utils.GetIPFromRemoteAddress(remoteAddr.String()), "no_auth_tryed", err.Error())
+			logger.ConnectionFailedLog("", ipAddr, "no_auth_tryed", err.Error())
+			defender.AddEvent(ipAddr, defender.HostEventNoLoginTried)
 		}
 		return
 	}
@@ -358,6 +677,9 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 
 	// Unmarshal cannot fails here and even if it fails we'll have a user with no permissions
 	json.Unmarshal([]byte(sconn.Permissions.Extensions["user"]), &user)
+	var session dataprovider.SessionOverrides
+	json.Unmarshal([]byte(sconn.Permissions.Extensions["session"]), &session)
+	user.SetSessionOverrides(session)
 
 	loginType := sconn.Permissions.Extensions["login_method"]
 	connectionID := hex.EncodeToString(sconn.SessionID())
@@ -369,6 +691,7 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 		conn.Close()
 		return
 	}
+	defer fs.Close()
 
 	connection := Connection{
 		ID:            connectionID,
@@ -387,8 +710,17 @@ func (c Configuration) AcceptInboundConnection(conn net.Conn, config *ssh.Server
 	connection.Log(logger.LevelInfo, logSender, "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
 		user.ID, loginType, user.Username, user.HomeDir, remoteAddr.String())
 	dataprovider.UpdateLastLogin(dataProvider, user)
+	audit.Log(audit.Event{Event: audit.EventLogin, Username: user.Username, Protocol: protocolSSH,
+		ConnectionID: connectionID, RemoteIP: ipAddr, LoginMethod: loginType})
+	defer audit.Log(audit.Event{Event: audit.EventLogout, Username: user.Username, Protocol: protocolSSH,
+		ConnectionID: connectionID, RemoteIP: ipAddr, LoginMethod: loginType})
 
 	go ssh.DiscardRequests(reqs)
+	if c.KeepAliveInterval > 0 {
+		stopKeepAlive := startKeepAlive(sconn, time.Duration(c.KeepAliveInterval)*time.Second, c.KeepAliveCountMax,
+			connectionID)
+		defer stopKeepAlive()
+	}
 
 	for newChannel := range chans {
 		// If its not a session channel we just move on because its not something we
@@ -435,7 +767,7 @@ func (c Configuration) handleSftpConnection(channel ssh.Channel, connection Conn
 	handler := c.createHandler(connection)
 
 	// Create the server instance for the channel using the handler we created above.
-	server := sftp.NewRequestServer(channel, handler)
+	server := sftp.NewRequestServer(newExtensionsChannel(channel, connection), handler)
 
 	if err := server.Serve(); err == io.EOF {
 		connection.Log(logger.LevelDebug, logSender, "connection closed, sending exit status")
@@ -465,14 +797,14 @@ func loginUser(user dataprovider.User, loginMethod, remoteAddr, publicKey string
 		return nil, fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
 	}
 	if user.MaxSessions > 0 {
-		activeSessions := getActiveSessions(user.Username)
+		activeSessions := GetActiveSessions(user.Username)
 		if activeSessions >= user.MaxSessions {
 			logger.Debug(logSender, "", "authentication refused for user: %#v, too many open sessions: %v/%v", user.Username,
 				activeSessions, user.MaxSessions)
 			return nil, fmt.Errorf("too many open sessions: %v", activeSessions)
 		}
 	}
-	if !user.IsLoginMethodAllowed(loginMethod) {
+	if !user.IsLoginMethodAllowed(loginMethod, remoteAddr) {
 		logger.Debug(logSender, "", "cannot login user %#v, login method %#v is not allowed", user.Username, loginMethod)
 		return nil, fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
 	}
@@ -480,7 +812,17 @@ func loginUser(user dataprovider.User, loginMethod, remoteAddr, publicKey string
 		logger.Debug(logSender, "", "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
 		return nil, fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
 	}
+	if allowed, country := user.IsLoginFromCountryAllowed(remoteAddr); !allowed {
+		logger.Debug(logSender, "", "cannot login user %#v, country %#v is not allowed: %v", user.Username, country, remoteAddr)
+		return nil, fmt.Errorf("Login for user %#v is not allowed from country %#v", user.Username, country)
+	}
 
+	// the session overrides are not serialized with the user
+	session, err := json.Marshal(user.GetSessionOverrides())
+	if err != nil {
+		logger.Warn(logSender, "", "error serializing session overrides: %v, authentication rejected", err)
+		return nil, err
+	}
 	json, err := json.Marshal(user)
 	if err != nil {
 		logger.Warn(logSender, "", "error serializing user info: %v, authentication rejected", err)
@@ -492,6 +834,7 @@ func loginUser(user dataprovider.User, loginMethod, remoteAddr, publicKey string
 	p := &ssh.Permissions{}
 	p.Extensions = make(map[string]string)
 	p.Extensions["user"] = string(json)
+	p.Extensions["session"] = string(session)
 	p.Extensions["login_method"] = loginMethod
 	return p, nil
 }
@@ -516,19 +859,37 @@ func (c *Configuration) checkSSHCommands() {
 	c.EnabledSSHCommands = sshCommands
 }
 
+func (c *Configuration) checkActions() {
+	if len(c.Actions.HTTPNotificationMethod) == 0 {
+		c.Actions.HTTPNotificationMethod = http.MethodGet
+	}
+	if c.Actions.HTTPNotificationMethod != http.MethodGet && c.Actions.HTTPNotificationMethod != http.MethodPost {
+		logger.Warn(logSender, "", "unsupported http_notification_method %#v, GET will be used",
+			c.Actions.HTTPNotificationMethod)
+		logger.WarnToConsole("unsupported http_notification_method %#v, GET will be used", c.Actions.HTTPNotificationMethod)
+		c.Actions.HTTPNotificationMethod = http.MethodGet
+	}
+	if c.Actions.HTTPNotificationRetries < 0 {
+		c.Actions.HTTPNotificationRetries = 0
+	}
+}
+
 // If no host keys are defined we try to use or generate the default one.
 func (c *Configuration) checkHostKeys(configDir string) error {
 	if len(c.Keys) == 0 {
-		defaultKeys := []string{defaultPrivateRSAKeyName, defaultPrivateECDSAKeyName}
+		defaultKeys := []string{defaultPrivateRSAKeyName, defaultPrivateECDSAKeyName, defaultPrivateEd25519KeyName}
 		for _, k := range defaultKeys {
 			autoFile := filepath.Join(configDir, k)
 			if _, err := os.Stat(autoFile); os.IsNotExist(err) {
 				logger.Info(logSender, "", "No host keys configured and %#v does not exist; creating new key for server", autoFile)
 				logger.InfoToConsole("No host keys configured and %#v does not exist; creating new key for server", autoFile)
-				if k == defaultPrivateRSAKeyName {
+				switch k {
+				case defaultPrivateRSAKeyName:
 					err = utils.GenerateRSAKeys(autoFile)
-				} else {
+				case defaultPrivateECDSAKeyName:
 					err = utils.GenerateECDSAKeys(autoFile)
+				default:
+					err = utils.GenerateEd25519Keys(autoFile)
 				}
 				if err != nil {
 					return err
@@ -540,54 +901,424 @@ func (c *Configuration) checkHostKeys(configDir string) error {
 	return nil
 }
 
-func (c Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKey string) (*ssh.Permissions, error) {
+// getHostCertSigner returns a signer that presents the given host certificate for the private key
+func getHostCertSigner(certFile, configDir string, private ssh.Signer) (ssh.Signer, error) {
+	if !filepath.IsAbs(certFile) {
+		certFile = filepath.Join(configDir, certFile)
+	}
+	logger.Info(logSender, "", "Loading host certificate: %s", certFile)
+
+	certBytes, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not an SSH certificate", certFile)
+	}
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%#v is not a host certificate, type: %v", certFile, cert.CertType)
+	}
+	return ssh.NewCertSigner(cert, private)
+}
+
+func (c *Configuration) initializeCertChecker(configDir string) error {
+	var caKeys []ssh.PublicKey
+	for _, keyPath := range c.TrustedUserCAKeys {
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(configDir, keyPath)
+		}
+		keyBytes, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			logger.Warn(logSender, "", "error loading trusted user CA key %#v: %v", keyPath, err)
+			logger.WarnToConsole("error loading trusted user CA key %#v: %v", keyPath, err)
+			return err
+		}
+		// a file can contain multiple keys, one per line
+		numKeys := 0
+		for {
+			key, _, _, rest, err := ssh.ParseAuthorizedKey(keyBytes)
+			if err != nil {
+				if numKeys > 0 {
+					break
+				}
+				logger.Warn(logSender, "", "error parsing trusted user CA key %#v: %v", keyPath, err)
+				logger.WarnToConsole("error parsing trusted user CA key %#v: %v", keyPath, err)
+				return err
+			}
+			logger.Info(logSender, "", "trusted user CA key loaded from %#v, fingerprint: %v", keyPath,
+				ssh.FingerprintSHA256(key))
+			caKeys = append(caKeys, key)
+			numKeys++
+			keyBytes = rest
+		}
+	}
+	if len(caKeys) == 0 {
+		c.certChecker = nil
+		return nil
+	}
+	c.certChecker = &ssh.CertChecker{
+		SupportedCriticalOptions: []string{dataprovider.CertOptionRoot, dataprovider.CertOptionReadOnly},
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			for _, k := range caKeys {
+				if bytes.Equal(k.Marshal(), auth.Marshal()) {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return nil
+}
+
+func (c *Configuration) checkClientVersionPatterns() error {
+	for _, pattern := range append(c.AllowedClientVersions, c.DeniedClientVersions...) {
+		if _, err := path.Match(pattern, "SSH-2.0-test"); err != nil {
+			logger.WarnToConsole("invalid client version pattern %#v: %v", pattern, err)
+			return fmt.Errorf("invalid client version pattern %#v: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// checkClientVersion returns an error if the client version banner is denied or, if an allow
+// list is configured, it does not match any allowed pattern
+func (c Configuration) checkClientVersion(conn ssh.ConnMetadata) error {
+	if len(c.AllowedClientVersions) == 0 && len(c.DeniedClientVersions) == 0 {
+		return nil
+	}
+	clientVersion := string(conn.ClientVersion())
+	for _, pattern := range c.DeniedClientVersions {
+		if matched, _ := path.Match(pattern, clientVersion); matched {
+			return c.clientVersionNotAllowed(conn, clientVersion)
+		}
+	}
+	if len(c.AllowedClientVersions) == 0 {
+		return nil
+	}
+	for _, pattern := range c.AllowedClientVersions {
+		if matched, _ := path.Match(pattern, clientVersion); matched {
+			return nil
+		}
+	}
+	return c.clientVersionNotAllowed(conn, clientVersion)
+}
+
+func (c Configuration) clientVersionNotAllowed(conn ssh.ConnMetadata, clientVersion string) error {
+	err := fmt.Errorf("client version %#v not allowed", clientVersion)
+	logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()),
+		"no_auth_tryed", err.Error())
+	return err
+}
+
+func (c *Configuration) loadRevokedKeys(configDir string) error {
+	c.revokedKeys = nil
+	if c.RevokedKeysFile == "" {
+		return nil
+	}
+	krlPath := c.RevokedKeysFile
+	if !filepath.IsAbs(krlPath) {
+		krlPath = filepath.Join(configDir, krlPath)
+	}
+	krlBytes, err := ioutil.ReadFile(krlPath)
+	if err != nil {
+		logger.Warn(logSender, "", "error loading revoked keys file %#v: %v", krlPath, err)
+		logger.WarnToConsole("error loading revoked keys file %#v: %v", krlPath, err)
+		return err
+	}
+	revokedKeys, err := parseRevocationList(krlBytes)
+	if err != nil {
+		logger.Warn(logSender, "", "error parsing revoked keys file %#v: %v", krlPath, err)
+		logger.WarnToConsole("error parsing revoked keys file %#v: %v", krlPath, err)
+		return err
+	}
+	logger.Info(logSender, "", "revoked keys loaded from %#v", krlPath)
+	c.revokedKeys = revokedKeys
+	return nil
+}
+
+// validateUserCertificate checks that the certificate is a valid user certificate,
+// signed by a trusted CA, for the requested username
+func (c Configuration) validateUserCertificate(username string, cert *ssh.Certificate) error {
+	if c.certChecker == nil {
+		return errors.New("user certificates are not accepted, no trusted user CA key is configured")
+	}
+	if cert.CertType != ssh.UserCert {
+		return fmt.Errorf("certificate has type %v, only user certificates are accepted", cert.CertType)
+	}
+	if !c.certChecker.IsUserAuthority(cert.SignatureKey) {
+		return errors.New("certificate signed by an unrecognized authority")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return errors.New("certificate without principals")
+	}
+	return c.certChecker.CheckCert(username, cert)
+}
+
+// getPartialSuccessError returns the partial success response for the public key step of a
+// multi-step authentication, the client can continue using one of the next login methods
+func (c Configuration) getPartialSuccessError(keyStep *publicKeyStep, nextMethods []string) error {
+	var next ssh.ServerAuthCallbacks
+	for _, method := range nextMethods {
+		switch method {
+		case dataprovider.SSHLoginMethodPassword:
+			next.PasswordCallback = func(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+				sp, err := c.validatePasswordCredentials(conn, pass, keyStep)
+				if err != nil {
+					return nil, &authenticationError{err: fmt.Sprintf("could not validate password credentials: %v", err)}
+				}
+
+				return sp, nil
+			}
+		case dataprovider.SSHLoginMethodKeyboardInteractive:
+			next.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				sp, err := c.validateKeyboardInteractiveCredentials(conn, client, c.keyboardInteractiveHook, keyStep)
+				if err != nil {
+					return nil, &authenticationError{err: fmt.Sprintf("could not validate keyboard interactive credentials: %v", err)}
+				}
+
+				return sp, nil
+			}
+		}
+	}
+	return &ssh.PartialSuccessError{Next: next}
+}
+
+func setConnectionLimits(maxTotal, maxPerHost int) {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	maxTotalConnections = maxTotal
+	maxPerHostConnections = maxPerHost
+}
+
+// addClientConnection counts a new connection from the given IP. It returns false, and the
+// connection is not counted, if the configured connection limits are reached
+func addClientConnection(ipAddr string) bool {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	if maxTotalConnections > 0 && totalClientConnections >= maxTotalConnections {
+		logger.Debug(logSender, "", "connection refused from ip %#v, too many connections: %v/%v", ipAddr,
+			totalClientConnections, maxTotalConnections)
+		return false
+	}
+	if maxPerHostConnections > 0 && clientConnections[ipAddr] >= maxPerHostConnections {
+		logger.Debug(logSender, "", "connection refused from ip %#v, too many connections from this ip: %v/%v",
+			ipAddr, clientConnections[ipAddr], maxPerHostConnections)
+		return false
+	}
+	totalClientConnections++
+	clientConnections[ipAddr]++
+	return true
+}
+
+func removeClientConnection(ipAddr string) {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	totalClientConnections--
+	if clientConnections[ipAddr] > 1 {
+		clientConnections[ipAddr]--
+	} else {
+		delete(clientConnections, ipAddr)
+	}
+}
+
+func setHandshakeLimits(maxConcurrent, timeout int) {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	maxHandshakes = maxConcurrent
+	handshakeTimeout = defaultHandshakeTimeout
+	if timeout > 0 {
+		handshakeTimeout = time.Duration(timeout) * time.Second
+	}
+}
+
+// startHandshake returns the handshake timeout and true if a new handshake can start.
+// endHandshake must be called when the handshake ends
+func startHandshake(ipAddr string) (time.Duration, bool) {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	if maxHandshakes > 0 && handshakesInProgress >= maxHandshakes {
+		logger.Debug(logSender, "", "connection refused from ip %#v, too many handshakes in progress: %v/%v", ipAddr,
+			handshakesInProgress, maxHandshakes)
+		return handshakeTimeout, false
+	}
+	handshakesInProgress++
+	return handshakeTimeout, true
+}
+
+func endHandshake() {
+	clientConnectionsMutex.Lock()
+	defer clientConnectionsMutex.Unlock()
+
+	handshakesInProgress--
+}
+
+func addDefenderEvent(ipAddr string, err error) {
+	event := defender.HostEventLoginFailed
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		event = defender.HostEventUserNotFound
+	}
+	defender.AddEvent(ipAddr, event)
+}
+
+func (c Configuration) validatePublicKeyCredentials(conn ssh.ConnMetadata, pubKey ssh.PublicKey) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var keyID string
 	var sshPerm *ssh.Permissions
 
 	method := dataprovider.SSHLoginMethodPublicKey
+	if err = c.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+	if !ratelimiter.AllowAuthAttempt(utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())) {
+		return nil, errAuthRateLimited
+	}
 	metrics.AddLoginAttempt(method)
-	if user, keyID, err = dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), pubKey); err == nil {
+	cert, isCert := pubKey.(*ssh.Certificate)
+	if c.revokedKeys.isRevoked(pubKey) {
+		err = fmt.Errorf("public key %v is revoked", ssh.FingerprintSHA256(pubKey))
+	} else if isCert {
+		if err = c.validateUserCertificate(conn.User(), cert); err == nil {
+			user, keyID, err = dataprovider.CheckUserAndCert(dataProvider, conn.User(), cert,
+				utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+		}
+	} else {
+		user, keyID, err = dataprovider.CheckUserAndPubKey(dataProvider, conn.User(), string(pubKey.Marshal()),
+			utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()))
+	}
+	if err == nil && user.IsPublicKeyRevoked(pubKey) {
+		err = fmt.Errorf("public key %v is revoked for user %#v", ssh.FingerprintSHA256(pubKey), user.Username)
+	}
+	if err == nil {
+		if nextMethods := user.GetNextAuthMethods(method, conn.RemoteAddr().String()); len(nextMethods) > 0 {
+			logger.Debug(logSender, "", "user %#v authenticated with partial success using a public key, next login methods: %v",
+				user.Username, nextMethods)
+			keyStep := &publicKeyStep{
+				user:  user,
+				keyID: keyID,
+			}
+			if isCert {
+				// the source-address critical option is enforced for the partial success too
+				keyStep.criticalOptions = cert.CriticalOptions
+				sshPerm = &ssh.Permissions{CriticalOptions: cert.CriticalOptions}
+			}
+			metrics.AddLoginResult(method, nil)
+			return sshPerm, c.getPartialSuccessError(keyStep, nextMethods)
+		}
 		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), keyID)
+		if err == nil && isCert {
+			// the source-address critical option, if any, is enforced by the SSH server
+			sshPerm.CriticalOptions = cert.CriticalOptions
+		}
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: conn.User(), Protocol: protocolSSH,
+			RemoteIP: ipAddr, LoginMethod: method, Error: err.Error()})
+		// clients usually try all the available keys, so only the attempts
+		// for non existent users are scored
+		if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+			defender.AddEvent(ipAddr, defender.HostEventUserNotFound)
+		}
 	}
 	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(conn.User(), method, utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()),
+		protocolSSH, err)
 	return sshPerm, err
 }
 
-func (c Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte) (*ssh.Permissions, error) {
+// validatePasswordCredentials validates the password, keyStep is not nil if the password
+// is the second step of a multi-step authentication
+func (c Configuration) validatePasswordCredentials(conn ssh.ConnMetadata, pass []byte, keyStep *publicKeyStep) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
 	method := dataprovider.SSHLoginMethodPassword
+	if keyStep != nil {
+		method = dataprovider.SSHLoginMethodKeyAndPassword
+	}
+	if err = c.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+	if !ratelimiter.AllowAuthAttempt(utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())) {
+		return nil, errAuthRateLimited
+	}
 	metrics.AddLoginAttempt(method)
-	if user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass)); err == nil {
-		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+	if user, err = dataprovider.CheckUserAndPass(dataProvider, conn.User(), string(pass),
+		utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())); err == nil {
+		if keyStep != nil {
+			sshPerm, err = keyStep.login(method, conn.RemoteAddr().String())
+		} else {
+			sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+		}
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: conn.User(), Protocol: protocolSSH,
+			RemoteIP: ipAddr, LoginMethod: method, Error: err.Error()})
+		addDefenderEvent(ipAddr, err)
+		ratelimiter.DelayLoginFailure(ipAddr, conn.User())
+	} else {
+		ratelimiter.ResetLoginFailures(conn.User())
 	}
 	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(conn.User(), method, utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()),
+		protocolSSH, err)
 	return sshPerm, err
 }
 
-func (c Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+// validateKeyboardInteractiveCredentials validates the keyboard interactive credentials, keyStep
+// is not nil if the keyboard interactive authentication is the second step of a multi-step authentication
+func (c Configuration) validateKeyboardInteractiveCredentials(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge,
+	authHook string, keyStep *publicKeyStep) (*ssh.Permissions, error) {
 	var err error
 	var user dataprovider.User
 	var sshPerm *ssh.Permissions
 
 	method := dataprovider.SSHLoginMethodKeyboardInteractive
+	if keyStep != nil {
+		method = dataprovider.SSHLoginMethodKeyAndKeyboardInt
+	}
+	if err = c.checkClientVersion(conn); err != nil {
+		return nil, err
+	}
+	if !ratelimiter.AllowAuthAttempt(utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())) {
+		return nil, errAuthRateLimited
+	}
 	metrics.AddLoginAttempt(method)
-	if user, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, conn.User(), c.KeyboardInteractiveProgram, client); err == nil {
-		sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+	if user, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, conn.User(), authHook, client,
+		utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())); err == nil {
+		if keyStep != nil {
+			sshPerm, err = keyStep.login(method, conn.RemoteAddr().String())
+		} else {
+			sshPerm, err = loginUser(user, method, conn.RemoteAddr().String(), "")
+		}
 	}
 	if err != nil {
-		logger.ConnectionFailedLog(conn.User(), utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()), method, err.Error())
+		ipAddr := utils.GetIPFromRemoteAddress(conn.RemoteAddr().String())
+		logger.ConnectionFailedLog(conn.User(), ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: conn.User(), Protocol: protocolSSH,
+			RemoteIP: ipAddr, LoginMethod: method, Error: err.Error()})
+		addDefenderEvent(ipAddr, err)
+		ratelimiter.DelayLoginFailure(ipAddr, conn.User())
+	} else {
+		ratelimiter.ResetLoginFailures(conn.User())
 	}
 	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(conn.User(), method, utils.GetIPFromRemoteAddress(conn.RemoteAddr().String()),
+		protocolSSH, err)
 	return sshPerm, err
 }
@@ -0,0 +1,83 @@
+package sftpd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	// sessionsHeartbeatInterval defines how often the heartbeat for the shared sessions is updated
+	sessionsHeartbeatInterval = 1 * time.Minute
+	// sessionsStaleTimeout defines the time after which a shared session without a heartbeat
+	// is considered stale, for example because the node handling it is no longer running
+	sessionsStaleTimeout = 3 * sessionsHeartbeatInterval
+)
+
+var (
+	// nodeID identifies this instance inside the shared sessions
+	nodeID            = xid.New().String()
+	sessionsHeartbeat sync.Once
+)
+
+// registerSession adds the given connection to the shared sessions, if enabled.
+// The heartbeat for the sessions of this node is started on the first registration
+func registerSession(connectionID, username, protocol string) {
+	if !dataprovider.IsSharedSessionsEnabled() {
+		return
+	}
+	sessionsHeartbeat.Do(startSessionsHeartbeat)
+	err := dataprovider.AddActiveSession(dataProvider, dataprovider.ActiveSession{
+		ConnectionID: connectionID,
+		NodeID:       nodeID,
+		Username:     username,
+		Protocol:     protocol,
+	})
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to register the shared session for user %#v: %v", username, err)
+	}
+}
+
+// unregisterSession removes the given connection from the shared sessions, if enabled
+func unregisterSession(connectionID string) {
+	if !dataprovider.IsSharedSessionsEnabled() {
+		return
+	}
+	err := dataprovider.DeleteActiveSession(dataProvider, nodeID, connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to remove the shared session: %v", err)
+	}
+}
+
+// getSharedSessions returns the number of sessions for the given username on all the nodes
+func getSharedSessions(username string) (int, error) {
+	from := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-sessionsStaleTimeout))
+	return dataprovider.GetActiveSessionsCount(dataProvider, username, from)
+}
+
+func startSessionsHeartbeat() {
+	logger.Debug(logSender, "", "start shared sessions heartbeat, node id: %#v", nodeID)
+	ticker := time.NewTicker(sessionsHeartbeatInterval)
+	go func() {
+		for range ticker.C {
+			updateSessionsHeartbeat()
+		}
+	}()
+}
+
+// updateSessionsHeartbeat updates the heartbeat for the sessions of this node
+// and removes the stale sessions of all the nodes
+func updateSessionsHeartbeat() {
+	if err := dataprovider.UpdateActiveSessionsHeartbeat(dataProvider, nodeID); err != nil {
+		logger.Warn(logSender, "", "unable to update the shared sessions heartbeat: %v", err)
+	}
+	before := utils.GetTimeAsMsSinceEpoch(time.Now().Add(-sessionsStaleTimeout))
+	if err := dataprovider.CleanupActiveSessions(dataProvider, before); err != nil {
+		logger.Warn(logSender, "", "unable to remove the stale shared sessions: %v", err)
+	}
+}
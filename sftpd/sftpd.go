@@ -4,8 +4,11 @@
 package sftpd
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -14,9 +17,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/drakkan/sftpgo/antivirus"
+	"github.com/drakkan/sftpgo/audit"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/plugin"
 	"github.com/drakkan/sftpgo/utils"
 )
 
@@ -30,6 +36,8 @@ const (
 	rmdirLogSender      = "Rmdir"
 	mkdirLogSender      = "Mkdir"
 	symlinkLogSender    = "Symlink"
+	linkLogSender       = "Link"
+	copyLogSender       = "Copy"
 	removeLogSender     = "Remove"
 	chownLogSender      = "Chown"
 	chmodLogSender      = "Chmod"
@@ -40,10 +48,12 @@ const (
 	operationDelete     = "delete"
 	operationRename     = "rename"
 	operationSSHCmd     = "ssh_cmd"
+	operationVirus      = "virus"
 	protocolSFTP        = "SFTP"
 	protocolSCP         = "SCP"
 	protocolSSH         = "SSH"
-	handshakeTimeout    = 2 * time.Minute
+	// default handshake timeout, as OpenSSH
+	defaultHandshakeTimeout = 2 * time.Minute
 )
 
 const (
@@ -55,22 +65,35 @@ const (
 var (
 	mutex                sync.RWMutex
 	openConnections      map[string]Connection
+	externalConnections  map[string]ActiveConnection
 	activeTransfers      []*Transfer
 	idleConnectionTicker *time.Ticker
 	idleTimeout          time.Duration
 	activeQuotaScans     []ActiveQuotaScan
 	dataProvider         dataprovider.Provider
 	actions              Actions
+	fsEventHandler       FsEventHandler
 	uploadMode           int
 	setstatMode          int
-	supportedSSHCommands = []string{"scp", "md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum", "cd", "pwd",
-		"git-receive-pack", "git-upload-pack", "git-upload-archive", "rsync"}
+	uploadChecksums      bool
+	// connections counted for the server level limits, per source IP
+	clientConnectionsMutex sync.Mutex
+	clientConnections      map[string]int
+	totalClientConnections int
+	maxTotalConnections    int
+	maxPerHostConnections  int
+	handshakesInProgress   int
+	maxHandshakes          int
+	handshakeTimeout       = defaultHandshakeTimeout
+	supportedSSHCommands   = []string{"scp", "md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum", "cd", "pwd",
+		"git-receive-pack", "git-upload-pack", "git-upload-archive", "rsync", "sftpgo-copy", "sftpgo-zip"}
 	defaultSSHCommands = []string{"md5sum", "sha1sum", "cd", "pwd"}
 	sshHashCommands    = []string{"md5sum", "sha1sum", "sha256sum", "sha384sum", "sha512sum"}
 	systemCommands     = []string{"git-receive-pack", "git-upload-pack", "git-upload-archive", "rsync"}
 )
 
-type connectionTransfer struct {
+// ConnectionTransfer defines the details for an active upload or download
+type ConnectionTransfer struct {
 	OperationType string `json:"operation_type"`
 	StartTime     int64  `json:"start_time"`
 	Size          int64  `json:"size"`
@@ -93,8 +116,35 @@ type Actions struct {
 	ExecuteOn []string `json:"execute_on" mapstructure:"execute_on"`
 	// Absolute path to the command to execute, empty to disable
 	Command string `json:"command" mapstructure:"command"`
-	// The URL to notify using an HTTP GET, empty to disable
+	// The URL to notify, empty to disable
 	HTTPNotificationURL string `json:"http_notification_url" mapstructure:"http_notification_url"`
+	// HTTP method for the notification: GET sends the action details inside the query string,
+	// POST sends them serialized as JSON inside the request body. Empty means GET
+	HTTPNotificationMethod string `json:"http_notification_method" mapstructure:"http_notification_method"`
+	// Timeout, in seconds, for each notification attempt. 0 means 15 seconds
+	HTTPNotificationTimeout int `json:"http_notification_timeout" mapstructure:"http_notification_timeout"`
+	// Number of retries if the notification fails because of a network error or
+	// an HTTP 5xx status code. 0 means no retries
+	HTTPNotificationRetries int `json:"http_notification_retries" mapstructure:"http_notification_retries"`
+	// Ordered steps executed for each completed upload to a local filesystem, before the upload
+	// action. Empty to disable
+	UploadPipeline []PipelineStep `json:"upload_pipeline" mapstructure:"upload_pipeline"`
+}
+
+// FsEventHandler is notified for each filesystem action, such as uploads and downloads,
+// regardless of the configured actions
+type FsEventHandler func(operation, username, path, target, sshCmd string, fileSize int64)
+
+// actionNotification defines the JSON body sent for POST HTTP notifications
+type actionNotification struct {
+	Action     string `json:"action"`
+	Username   string `json:"username"`
+	Path       string `json:"path"`
+	TargetPath string `json:"target_path,omitempty"`
+	SSHCmd     string `json:"ssh_cmd,omitempty"`
+	FileSize   int64  `json:"file_size,omitempty"`
+	LocalFile  bool   `json:"local_file"`
+	Status     int    `json:"status"`
 }
 
 // ConnectionStatus status for an active connection
@@ -111,12 +161,34 @@ type ConnectionStatus struct {
 	ConnectionTime int64 `json:"connection_time"`
 	// Last activity as unix timestamp in milliseconds
 	LastActivity int64 `json:"last_activity"`
-	// Protocol for this connection: SFTP, SCP, SSH
+	// Protocol for this connection: SFTP, SCP, SSH, FTP, DAV
 	Protocol string `json:"protocol"`
 	// active uploads/downloads
-	Transfers []connectionTransfer `json:"active_transfers"`
+	Transfers []ConnectionTransfer `json:"active_transfers"`
 	// for protocol SSH this is the issued command
 	SSHCommand string `json:"ssh_command"`
+	// Upload and download bandwidth limits, as KB/s, applied to this connection. 0 means unlimited
+	UploadBandwidth   int64 `json:"upload_bandwidth"`
+	DownloadBandwidth int64 `json:"download_bandwidth"`
+}
+
+// ActiveConnection defines the interface to implement for connections handled
+// by protocol servers other than SFTP, for example FTP.
+// The connections added using AddActiveConnection are included in the connections
+// stats, are counted for the max sessions limit and they can be closed via the
+// REST API or for idle timeout as the SFTP ones
+type ActiveConnection interface {
+	GetID() string
+	GetUsername() string
+	GetClientVersion() string
+	GetRemoteAddress() net.Addr
+	GetProtocol() string
+	GetConnectionTime() time.Time
+	GetLastActivity() time.Time
+	GetTransfers() []ConnectionTransfer
+	GetUploadBandwidth() int64
+	GetDownloadBandwidth() int64
+	Disconnect() error
 }
 
 type sshSubsystemExitStatus struct {
@@ -129,6 +201,8 @@ type sshSubsystemExecMsg struct {
 
 func init() {
 	openConnections = make(map[string]Connection)
+	externalConnections = make(map[string]ActiveConnection)
+	clientConnections = make(map[string]int)
 	idleConnectionTicker = time.NewTicker(5 * time.Minute)
 }
 
@@ -175,7 +249,7 @@ func (c ConnectionStatus) GetTransfersAsString() string {
 	return result
 }
 
-func (t connectionTransfer) getConnectionTransferAsString() string {
+func (t ConnectionTransfer) getConnectionTransferAsString() string {
 	result := ""
 	if t.OperationType == operationUpload {
 		result += "UL"
@@ -197,7 +271,19 @@ func SetDataProvider(provider dataprovider.Provider) {
 	dataProvider = provider
 }
 
-func getActiveSessions(username string) int {
+// GetActiveSessions returns the number of active sessions for the given username.
+// The connections added using AddActiveConnection are counted too.
+// If the shared sessions are enabled the sessions on all the nodes are counted,
+// the local sessions are counted if the data provider cannot be queried
+func GetActiveSessions(username string) int {
+	if dataprovider.IsSharedSessionsEnabled() {
+		numSessions, err := getSharedSessions(username)
+		if err == nil {
+			return numSessions
+		}
+		logger.Warn(logSender, "", "unable to get the shared sessions for user %#v, only the local ones are counted: %v",
+			username, err)
+	}
 	mutex.RLock()
 	defer mutex.RUnlock()
 	numSessions := 0
@@ -206,6 +292,11 @@ func getActiveSessions(username string) int {
 			numSessions++
 		}
 	}
+	for _, c := range externalConnections {
+		if c.GetUsername() == username {
+			numSessions++
+		}
+	}
 	return numSessions
 }
 
@@ -258,17 +349,97 @@ func RemoveQuotaScan(username string) error {
 }
 
 // CloseActiveConnection closes an active SFTP connection.
+// The in progress transfers are aborted, so they are not considered completed.
 // It returns true on success
 func CloseActiveConnection(connectionID string) bool {
-	result := false
 	mutex.RLock()
-	defer mutex.RUnlock()
-	if c, ok := openConnections[connectionID]; ok {
+	c, ok := openConnections[connectionID]
+	ext, isExternal := externalConnections[connectionID]
+	transfers := getConnectionTransfers(connectionID)
+	mutex.RUnlock()
+
+	if ok {
+		abortTransfers(transfers)
 		err := c.close()
 		c.Log(logger.LevelDebug, logSender, "close connection requested, close err: %v", err)
-		result = true
+		return true
+	}
+	if isExternal {
+		err := ext.Disconnect()
+		logger.Debug(logSender, connectionID, "close %v connection requested, close err: %v", ext.GetProtocol(), err)
+		return true
+	}
+	return false
+}
+
+// CloseUserConnections closes all the active connections, for any protocol, for the given username.
+// The in progress transfers are aborted. It returns the number of closed connections
+func CloseUserConnections(username string) int {
+	var connections []Connection
+	var externals []ActiveConnection
+	var transfers []*Transfer
+	mutex.RLock()
+	for _, c := range openConnections {
+		if c.User.Username == username {
+			connections = append(connections, c)
+			transfers = append(transfers, getConnectionTransfers(c.ID)...)
+		}
+	}
+	for _, c := range externalConnections {
+		if c.GetUsername() == username {
+			externals = append(externals, c)
+		}
+	}
+	mutex.RUnlock()
+
+	abortTransfers(transfers)
+	for _, c := range connections {
+		err := c.close()
+		c.Log(logger.LevelDebug, logSender, "close user connections requested, close err: %v", err)
+	}
+	for _, c := range externals {
+		err := c.Disconnect()
+		logger.Debug(logSender, c.GetID(), "close user connections requested for %v connection, close err: %v",
+			c.GetProtocol(), err)
+	}
+	return len(connections) + len(externals)
+}
+
+// getConnectionTransfers returns the active transfers for the given connection.
+// The caller must hold the lock
+func getConnectionTransfers(connectionID string) []*Transfer {
+	var transfers []*Transfer
+	for _, t := range activeTransfers {
+		if t.connectionID == connectionID {
+			transfers = append(transfers, t)
+		}
+	}
+	return transfers
+}
+
+// abortTransfers marks the given transfers as aborted, so they fail and they are not
+// considered completed when closed. The caller must not hold the lock, closing
+// a transfer acquires the transfer lock and then the lock
+func abortTransfers(transfers []*Transfer) {
+	for _, t := range transfers {
+		t.TransferError(errTransferAborted)
 	}
-	return result
+}
+
+// abortInterruptedUploads aborts the uploads, for the given connection and paths, in progress to a
+// backend without local files. The client disconnected without closing them, so they are
+// interrupted and must not be stored as completed, this way they can be resumed, if supported
+func abortInterruptedUploads(connectionID string, paths []string) {
+	var transfers []*Transfer
+	mutex.RLock()
+	for _, t := range getConnectionTransfers(connectionID) {
+		if t.transferType == transferUpload && t.file == nil && utils.IsStringInSlice(t.path, paths) {
+			transfers = append(transfers, t)
+		}
+	}
+	mutex.RUnlock()
+
+	abortTransfers(transfers)
 }
 
 // GetConnectionsStats returns stats for active connections
@@ -278,15 +449,17 @@ func GetConnectionsStats() []ConnectionStatus {
 	stats := []ConnectionStatus{}
 	for _, c := range openConnections {
 		conn := ConnectionStatus{
-			Username:       c.User.Username,
-			ConnectionID:   c.ID,
-			ClientVersion:  c.ClientVersion,
-			RemoteAddress:  c.RemoteAddr.String(),
-			ConnectionTime: utils.GetTimeAsMsSinceEpoch(c.StartTime),
-			LastActivity:   utils.GetTimeAsMsSinceEpoch(c.lastActivity),
-			Protocol:       c.protocol,
-			Transfers:      []connectionTransfer{},
-			SSHCommand:     c.command,
+			Username:          c.User.Username,
+			ConnectionID:      c.ID,
+			ClientVersion:     c.ClientVersion,
+			RemoteAddress:     c.RemoteAddr.String(),
+			ConnectionTime:    utils.GetTimeAsMsSinceEpoch(c.StartTime),
+			LastActivity:      utils.GetTimeAsMsSinceEpoch(c.lastActivity),
+			Protocol:          c.protocol,
+			Transfers:         []ConnectionTransfer{},
+			SSHCommand:        c.command,
+			UploadBandwidth:   c.User.UploadBandwidth,
+			DownloadBandwidth: c.User.DownloadBandwidth,
 		}
 		for _, t := range activeTransfers {
 			if t.connectionID == c.ID {
@@ -302,7 +475,7 @@ func GetConnectionsStats() []ConnectionStatus {
 					operationType = operationDownload
 					size = t.bytesSent
 				}
-				connTransfer := connectionTransfer{
+				connTransfer := ConnectionTransfer{
 					OperationType: operationType,
 					StartTime:     utils.GetTimeAsMsSinceEpoch(t.start),
 					Size:          size,
@@ -314,6 +487,20 @@ func GetConnectionsStats() []ConnectionStatus {
 		}
 		stats = append(stats, conn)
 	}
+	for _, c := range externalConnections {
+		stats = append(stats, ConnectionStatus{
+			Username:          c.GetUsername(),
+			ConnectionID:      c.GetID(),
+			ClientVersion:     c.GetClientVersion(),
+			RemoteAddress:     c.GetRemoteAddress().String(),
+			ConnectionTime:    utils.GetTimeAsMsSinceEpoch(c.GetConnectionTime()),
+			LastActivity:      utils.GetTimeAsMsSinceEpoch(c.GetLastActivity()),
+			Protocol:          c.GetProtocol(),
+			Transfers:         c.GetTransfers(),
+			UploadBandwidth:   c.GetUploadBandwidth(),
+			DownloadBandwidth: c.GetDownloadBandwidth(),
+		})
+	}
 	return stats
 }
 
@@ -348,22 +535,32 @@ func CheckIdleConnections() {
 			c.Log(logger.LevelInfo, logSender, "close idle connection, idle time: %v, close error: %v", idleTime, err)
 		}
 	}
+	for _, c := range externalConnections {
+		idleTime := time.Since(c.GetLastActivity())
+		if idleTime > idleTimeout {
+			err := c.Disconnect()
+			logger.Info(logSender, c.GetID(), "close idle %v connection, idle time: %v, close error: %v", c.GetProtocol(),
+				idleTime, err)
+		}
+	}
 	logger.Debug(logSender, "", "check idle connections ended")
 }
 
 func addConnection(c Connection) {
+	registerSession(c.ID, c.User.Username, c.protocol)
 	mutex.Lock()
 	defer mutex.Unlock()
 	openConnections[c.ID] = c
-	metrics.UpdateActiveConnectionsSize(len(openConnections))
+	updateActiveConnectionsMetrics()
 	c.Log(logger.LevelDebug, logSender, "connection added, num open connections: %v", len(openConnections))
 }
 
 func removeConnection(c Connection) {
+	unregisterSession(c.ID)
 	mutex.Lock()
 	defer mutex.Unlock()
 	delete(openConnections, c.ID)
-	metrics.UpdateActiveConnectionsSize(len(openConnections))
+	updateActiveConnectionsMetrics()
 	// we have finished to send data here and most of the time the underlying network connection
 	// is already closed. Sometime a client can still be reading the last sended data, so we set
 	// a deadline instead of directly closing the network connection.
@@ -375,12 +572,95 @@ func removeConnection(c Connection) {
 	c.Log(logger.LevelDebug, logSender, "connection removed, num open connections: %v", len(openConnections))
 }
 
+// AddActiveConnection adds a connection handled by a protocol server other than SFTP
+// to the active ones
+func AddActiveConnection(c ActiveConnection) {
+	auditActiveConnection(audit.EventLogin, c)
+	registerSession(c.GetID(), c.GetUsername(), c.GetProtocol())
+	mutex.Lock()
+	defer mutex.Unlock()
+	externalConnections[c.GetID()] = c
+	updateActiveConnectionsMetrics()
+	logger.Debug(logSender, c.GetID(), "%v connection added, num open connections: %v", c.GetProtocol(),
+		len(openConnections)+len(externalConnections))
+}
+
+// RemoveActiveConnection removes a connection previously added using AddActiveConnection
+func RemoveActiveConnection(c ActiveConnection) {
+	auditActiveConnection(audit.EventLogout, c)
+	unregisterSession(c.GetID())
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(externalConnections, c.GetID())
+	updateActiveConnectionsMetrics()
+	logger.Debug(logSender, c.GetID(), "%v connection removed, num open connections: %v", c.GetProtocol(),
+		len(openConnections)+len(externalConnections))
+}
+
+// auditActiveConnection emits the login or logout audit event for a connection handled
+// by a protocol server other than SFTP
+func auditActiveConnection(event string, c ActiveConnection) {
+	if !audit.IsEnabled() {
+		return
+	}
+	var remoteIP string
+	if c.GetRemoteAddress() != nil {
+		remoteIP = utils.GetIPFromRemoteAddress(c.GetRemoteAddress().String())
+	}
+	audit.Log(audit.Event{Event: event, Username: c.GetUsername(), Protocol: c.GetProtocol(),
+		ConnectionID: c.GetID(), RemoteIP: remoteIP})
+}
+
+// updateActiveConnectionsMetrics updates the total and per protocol active connections metrics.
+// The caller must hold the lock
+func updateActiveConnectionsMetrics() {
+	connectionsByProtocol := make(map[string]int)
+	for _, c := range openConnections {
+		connectionsByProtocol[c.protocol]++
+	}
+	for _, c := range externalConnections {
+		connectionsByProtocol[c.GetProtocol()]++
+	}
+	metrics.UpdateActiveConnectionsSize(len(openConnections)+len(externalConnections), connectionsByProtocol)
+}
+
 func addTransfer(transfer *Transfer) {
 	mutex.Lock()
 	defer mutex.Unlock()
 	activeTransfers = append(activeTransfers, transfer)
 }
 
+// getConnectionTransfersStats returns the bytes transferred by all the active transfers
+// of the same type for the connection of the given transfer and the start time of the oldest one
+func getConnectionTransfersStats(transfer *Transfer) (int64, time.Time) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	transferredBytes := transfer.getTransferredBytes()
+	start := transfer.start
+	for _, t := range activeTransfers {
+		if t == transfer || t.connectionID != transfer.connectionID || t.transferType != transfer.transferType {
+			continue
+		}
+		transferredBytes += t.getTransferredBytes()
+		if t.start.Before(start) {
+			start = t.start
+		}
+	}
+	return transferredBytes, start
+}
+
+// getConnectionTransfer returns the active upload for the given connection and path, if any
+func getConnectionTransfer(connectionID, path string) *Transfer {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, t := range activeTransfers {
+		if t.connectionID == connectionID && t.path == path && t.transferType == transferUpload {
+			return t
+		}
+	}
+	return nil
+}
+
 func removeTransfer(transfer *Transfer) error {
 	mutex.Lock()
 	defer mutex.Unlock()
@@ -411,8 +691,66 @@ func updateConnectionActivity(id string) {
 	}
 }
 
-func isAtomicUploadEnabled() bool {
-	return uploadMode == uploadModeAtomic || uploadMode == uploadModeAtomicWithResume
+func isAtomicUploadEnabled(user dataprovider.User) bool {
+	mode := GetUserUploadMode(user)
+	return mode == uploadModeAtomic || mode == uploadModeAtomicWithResume
+}
+
+// GetUploadMode returns the configured upload mode.
+// Other protocol servers, such as FTP, use the same upload mode
+func GetUploadMode() int {
+	return uploadMode
+}
+
+// GetUserUploadMode returns the upload mode for the given user, the user filters
+// have precedence over the configured upload mode
+func GetUserUploadMode(user dataprovider.User) int {
+	switch user.Filters.UploadMode {
+	case dataprovider.UploadModeStandard:
+		return uploadModeStandard
+	case dataprovider.UploadModeAtomic:
+		return uploadModeAtomic
+	case dataprovider.UploadModeAtomicWithResume:
+		return uploadModeAtomicWithResume
+	}
+	return uploadMode
+}
+
+// isSetstatIgnored returns true if the setstat requests must be ignored for the given user,
+// the user filters have precedence over the configured setstat mode
+func isSetstatIgnored(user dataprovider.User) bool {
+	switch user.Filters.SetstatMode {
+	case dataprovider.SetstatModeNormal:
+		return false
+	case dataprovider.SetstatModeIgnore:
+		return true
+	}
+	return setstatMode == 1
+}
+
+// ExecuteAction executes the configured actions, if any, for the given operation.
+// It allows other protocol servers, such as FTP, to share the SFTP actions
+func ExecuteAction(operation, username, path, target string, fileSize int64, isLocalFile bool) error {
+	return executeAction(operation, username, path, target, "", fileSize, isLocalFile)
+}
+
+// ScanUpload scans a completed upload using the configured antivirus, if any. filePath is the local file
+// to scan and targetPath the final upload path, they differ for atomic uploads. If the file is infected
+// it is deleted or quarantined, the virus action is executed and an error is returned.
+// It allows other protocol servers, such as FTP, to share the antivirus handling
+func ScanUpload(filePath, targetPath, username, connectionID string, fileSize int64) error {
+	quarantinePath, err := antivirus.ScanFile(filePath, targetPath, username, connectionID)
+	if err != nil {
+		go executeAction(operationVirus, username, targetPath, quarantinePath, "", fileSize, true)
+	}
+	return err
+}
+
+// SetFsEventHandler sets the handler notified for the filesystem actions, nil to disable
+func SetFsEventHandler(handler FsEventHandler) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	fsEventHandler = handler
 }
 
 func executeNotificationCommand(operation, username, path, target, sshCmd, fileSize, isLocalFile string) error {
@@ -437,6 +775,16 @@ func executeNotificationCommand(operation, username, path, target, sshCmd, fileS
 
 // executed in a goroutine
 func executeAction(operation, username, path, target, sshCmd string, fileSize int64, isLocalFile bool) error {
+	if operation == operationUpload && isLocalFile && len(actions.UploadPipeline) > 0 {
+		path = executeUploadPipeline(actions.UploadPipeline, username, path, fileSize)
+	}
+	mutex.RLock()
+	handler := fsEventHandler
+	mutex.RUnlock()
+	if handler != nil {
+		handler(operation, username, path, target, sshCmd, fileSize)
+	}
+	plugin.Handler.NotifyFsEvent(operation, username, path, target, sshCmd, fileSize)
 	if !utils.IsStringInSlice(operation, actions.ExecuteOn) {
 		return nil
 	}
@@ -455,40 +803,79 @@ func executeAction(operation, username, path, target, sshCmd string, fileSize in
 		}
 	}
 	if len(actions.HTTPNotificationURL) > 0 {
-		var url *url.URL
-		url, err = url.Parse(actions.HTTPNotificationURL)
-		if err == nil {
-			q := url.Query()
-			q.Add("action", operation)
-			q.Add("username", username)
-			q.Add("path", path)
-			if len(target) > 0 {
-				q.Add("target_path", target)
-			}
-			if len(sshCmd) > 0 {
-				q.Add("ssh_cmd", sshCmd)
-			}
-			if len(size) > 0 {
-				q.Add("file_size", size)
-			}
-			q.Add("local_file", fmt.Sprintf("%t", isLocalFile))
-			url.RawQuery = q.Encode()
-			startTime := time.Now()
-			httpClient := &http.Client{
-				Timeout: 15 * time.Second,
-			}
-			resp, err := httpClient.Get(url.String())
-			respCode := 0
-			if err == nil {
-				respCode = resp.StatusCode
-				resp.Body.Close()
-			}
-			logger.Debug(logSender, "", "notified operation %#v to URL: %v status code: %v, elapsed: %v err: %v",
-				operation, url.String(), respCode, time.Since(startTime), err)
+		err = executeNotificationHTTP(operation, username, path, target, sshCmd, fileSize, isLocalFile)
+	}
+	return err
+}
+
+func executeNotificationHTTP(operation, username, path, target, sshCmd string, fileSize int64, isLocalFile bool) error {
+	notificationURL, err := url.Parse(actions.HTTPNotificationURL)
+	if err != nil {
+		logger.Warn(logSender, "", "Invalid http_notification_url %#v for operation %#v: %v", actions.HTTPNotificationURL,
+			operation, err)
+		return err
+	}
+	var body []byte
+	if actions.HTTPNotificationMethod == http.MethodPost {
+		body, err = json.Marshal(actionNotification{
+			Action:     operation,
+			Username:   username,
+			Path:       path,
+			TargetPath: target,
+			SSHCmd:     sshCmd,
+			FileSize:   fileSize,
+			LocalFile:  isLocalFile,
+			Status:     1,
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		q := notificationURL.Query()
+		q.Add("action", operation)
+		q.Add("username", username)
+		q.Add("path", path)
+		if len(target) > 0 {
+			q.Add("target_path", target)
+		}
+		if len(sshCmd) > 0 {
+			q.Add("ssh_cmd", sshCmd)
+		}
+		if fileSize > 0 {
+			q.Add("file_size", fmt.Sprintf("%v", fileSize))
+		}
+		q.Add("local_file", fmt.Sprintf("%t", isLocalFile))
+		notificationURL.RawQuery = q.Encode()
+	}
+	timeout := 15 * time.Second
+	if actions.HTTPNotificationTimeout > 0 {
+		timeout = time.Duration(actions.HTTPNotificationTimeout) * time.Second
+	}
+	httpClient := &http.Client{
+		Timeout: timeout,
+	}
+	for attempt := 0; attempt <= actions.HTTPNotificationRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		startTime := time.Now()
+		respCode := 0
+		var resp *http.Response
+		var reqErr error
+		if actions.HTTPNotificationMethod == http.MethodPost {
+			resp, reqErr = httpClient.Post(notificationURL.String(), "application/json", bytes.NewBuffer(body))
 		} else {
-			logger.Warn(logSender, "", "Invalid http_notification_url %#v for operation %#v: %v", actions.HTTPNotificationURL,
-				operation, err)
+			resp, reqErr = httpClient.Get(notificationURL.String())
+		}
+		if reqErr == nil {
+			respCode = resp.StatusCode
+			resp.Body.Close()
+		}
+		logger.Debug(logSender, "", "notified operation %#v to URL: %v status code: %v, attempt: %v, elapsed: %v err: %v",
+			operation, notificationURL.String(), respCode, attempt+1, time.Since(startTime), reqErr)
+		if reqErr == nil && respCode < http.StatusInternalServerError {
+			break
 		}
 	}
-	return err
+	return nil
 }
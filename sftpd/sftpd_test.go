@@ -1,12 +1,17 @@
 package sftpd_test
 
 import (
+	"archive/zip"
 	"bufio"
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/sha512"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -14,11 +19,15 @@ import (
 	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strings"
 	"testing"
 	"time"
@@ -29,6 +38,9 @@ import (
 
 	"golang.org/x/crypto/ssh"
 
+	"github.com/drakkan/sftpgo/antivirus"
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
 	"github.com/drakkan/sftpgo/config"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/httpd"
@@ -101,6 +113,8 @@ var (
 	keyIntAuthPath string
 	preLoginPath   string
 	logFilePath    string
+	userCAPath     string
+	userCASigner   ssh.Signer
 )
 
 func TestMain(m *testing.M) {
@@ -120,7 +134,7 @@ func TestMain(m *testing.M) {
 	dataProvider := dataprovider.GetProvider()
 	sftpdConf := config.GetSFTPDConfig()
 	httpdConf := config.GetHTTPDConfig()
-	sftpdConf.BindPort = 2022
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 2022}}
 	sftpdConf.KexAlgorithms = []string{"curve25519-sha256@libssh.org", "ecdh-sha2-nistp256",
 		"ecdh-sha2-nistp384"}
 	sftpdConf.Ciphers = []string{"chacha20-poly1305@openssh.com", "aes128-gcm@openssh.com",
@@ -145,7 +159,7 @@ func TestMain(m *testing.M) {
 	}
 	keyIntAuthPath = filepath.Join(homeBasePath, "keyintauth.sh")
 	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
-	sftpdConf.KeyboardInteractiveProgram = keyIntAuthPath
+	sftpdConf.KeyboardInteractiveHook = keyIntAuthPath
 
 	scpPath, err = exec.LookPath("scp")
 	if err != nil {
@@ -186,6 +200,22 @@ func TestMain(m *testing.M) {
 	if err != nil {
 		logger.WarnToConsole("unable to save gitwrap shell script: %v", err)
 	}
+	userCAPath = filepath.Join(homeBasePath, "user_ca.pub")
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		logger.WarnToConsole("unable to generate user CA key: %v", err)
+		os.Exit(1)
+	}
+	userCASigner, err = ssh.NewSignerFromKey(caKey)
+	if err != nil {
+		logger.WarnToConsole("unable to create user CA signer: %v", err)
+		os.Exit(1)
+	}
+	err = ioutil.WriteFile(userCAPath, ssh.MarshalAuthorizedKey(userCASigner.PublicKey()), 0600)
+	if err != nil {
+		logger.WarnToConsole("unable to save user CA public key to file: %v", err)
+	}
+	sftpdConf.TrustedUserCAKeys = []string{userCAPath}
 	sftpd.SetDataProvider(dataProvider)
 	httpd.SetDataProvider(dataProvider)
 
@@ -202,10 +232,10 @@ func TestMain(m *testing.M) {
 		}
 	}()
 
-	waitTCPListening(fmt.Sprintf("%s:%d", sftpdConf.BindAddress, sftpdConf.BindPort))
+	waitTCPListening(sftpdConf.Bindings[0].GetAddress())
 	waitTCPListening(fmt.Sprintf("%s:%d", httpdConf.BindAddress, httpdConf.BindPort))
 
-	sftpdConf.BindPort = 2222
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 2222, ApplyProxyConfig: true}}
 	sftpdConf.ProxyProtocol = 1
 	go func() {
 		logger.Debug(logSender, "", "initializing SFTP server with config %+v", sftpdConf)
@@ -214,9 +244,12 @@ func TestMain(m *testing.M) {
 		}
 	}()
 
-	waitTCPListening(fmt.Sprintf("%s:%d", sftpdConf.BindAddress, sftpdConf.BindPort))
+	waitTCPListening(sftpdConf.Bindings[0].GetAddress())
 
-	sftpdConf.BindPort = 2224
+	sftpdConf.Bindings = []sftpd.Binding{
+		{Port: 2224, ApplyProxyConfig: true},
+		{Address: "127.0.0.1", Port: 2226, ApplyProxyConfig: false},
+	}
 	sftpdConf.ProxyProtocol = 2
 	go func() {
 		logger.Debug(logSender, "", "initializing SFTP server with config %+v", sftpdConf)
@@ -225,7 +258,8 @@ func TestMain(m *testing.M) {
 		}
 	}()
 
-	waitTCPListening(fmt.Sprintf("%s:%d", sftpdConf.BindAddress, sftpdConf.BindPort))
+	waitTCPListening(sftpdConf.Bindings[0].GetAddress())
+	waitTCPListening(sftpdConf.Bindings[1].GetAddress())
 
 	exitCode := m.Run()
 	os.Remove(logFilePath)
@@ -243,7 +277,7 @@ func TestInitialization(t *testing.T) {
 	config.LoadConfig(configDir, "")
 	sftpdConf := config.GetSFTPDConfig()
 	sftpdConf.Umask = "invalid umask"
-	sftpdConf.BindPort = 2022
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 2022}}
 	sftpdConf.LoginBannerFile = "invalid_file"
 	sftpdConf.IsSCPEnabled = true
 	sftpdConf.EnabledSSHCommands = append(sftpdConf.EnabledSSHCommands, "ls")
@@ -256,18 +290,189 @@ func TestInitialization(t *testing.T) {
 	if err == nil {
 		t.Error("Inizialize must fail, a SFTP server should be already running")
 	}
-	sftpdConf.KeyboardInteractiveProgram = filepath.Join(homeBasePath, "invalid_file")
+	sftpdConf.KeyboardInteractiveProgram = ""
+	sftpdConf.KeyboardInteractiveHook = filepath.Join(homeBasePath, "invalid_file")
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, a SFTP server should be already running")
+	}
+	sftpdConf.KeyboardInteractiveHook = "http://invalid:url"
 	err = sftpdConf.Initialize(configDir)
 	if err == nil {
 		t.Error("Inizialize must fail, a SFTP server should be already running")
 	}
-	sftpdConf.BindPort = 4444
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 4444, ApplyProxyConfig: true}}
 	sftpdConf.ProxyProtocol = 1
 	sftpdConf.ProxyAllowed = []string{"1270.0.0.1"}
 	err = sftpdConf.Initialize(configDir)
 	if err == nil {
 		t.Error("Inizialize must fail, proxy IP allowed is invalid")
 	}
+	sftpdConf.ProxyAllowed = nil
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 0}}
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, no valid binding is configured")
+	}
+	// the first listener must be closed if the second binding cannot be used
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 4445}, {Port: 2022}}
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, a SFTP server should be already running")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:4445")
+	if err != nil {
+		t.Errorf("the listener for the first binding must be closed: %v", err)
+	} else {
+		listener.Close()
+	}
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 4444}}
+	sftpdConf.TrustedUserCAKeys = []string{filepath.Join(homeBasePath, "missing_ca_key")}
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, the trusted user CA key does not exist")
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	hostKeyPath := filepath.Join(homeBasePath, "host_cert_key")
+	hostCertPath := filepath.Join(homeBasePath, "host_cert_key-cert.pub")
+	err := utils.GenerateECDSAKeys(hostKeyPath)
+	if err != nil {
+		t.Fatalf("unable to generate host key: %v", err)
+	}
+	defer os.Remove(hostKeyPath)
+	defer os.Remove(hostKeyPath + ".pub")
+	defer os.Remove(hostCertPath)
+	hostKeyBytes, err := ioutil.ReadFile(hostKeyPath + ".pub")
+	if err != nil {
+		t.Fatalf("unable to read host key: %v", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(hostKeyBytes)
+	if err != nil {
+		t.Fatalf("unable to parse host key: %v", err)
+	}
+	cert := &ssh.Certificate{
+		Key:             hostKey,
+		Serial:          1,
+		CertType:        ssh.UserCert,
+		KeyId:           "test host",
+		ValidPrincipals: []string{"127.0.0.1"},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	err = cert.SignCert(rand.Reader, userCASigner)
+	if err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	ioutil.WriteFile(hostCertPath, ssh.MarshalAuthorizedKey(cert), 0600)
+
+	config.LoadConfig(configDir, "")
+	sftpdConf := config.GetSFTPDConfig()
+	sftpdConf.Bindings = []sftpd.Binding{{Port: 2225}}
+	sftpdConf.Keys = []sftpd.Key{
+		{
+			PrivateKey:  hostKeyPath,
+			Certificate: hostCertPath,
+		},
+	}
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, a user certificate cannot be used as host certificate")
+	}
+	sftpdConf.Keys[0].Certificate = hostKeyPath + ".pub"
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, the host certificate is a plain public key")
+	}
+	sftpdConf.Keys[0].Certificate = filepath.Join(homeBasePath, "missing_cert")
+	err = sftpdConf.Initialize(configDir)
+	if err == nil {
+		t.Error("Inizialize must fail, the host certificate does not exist")
+	}
+	cert.CertType = ssh.HostCert
+	err = cert.SignCert(rand.Reader, userCASigner)
+	if err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	ioutil.WriteFile(hostCertPath, ssh.MarshalAuthorizedKey(cert), 0600)
+	sftpdConf.Keys[0].Certificate = hostCertPath
+	go func() {
+		if err := sftpdConf.Initialize(configDir); err != nil {
+			logger.Error(logSender, "", "could not start SFTP server: %v", err)
+		}
+	}()
+	waitTCPListening(sftpdConf.Bindings[0].GetAddress())
+
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	certChecker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return bytes.Equal(auth.Marshal(), userCASigner.PublicKey().Marshal())
+		},
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:              user.Username,
+		HostKeyCallback:   certChecker.CheckHostKey,
+		HostKeyAlgorithms: []string{ssh.CertAlgoECDSA256v01},
+		Auth:              []ssh.AuthMethod{ssh.Password(defaultPassword)},
+	}
+	conn, err := ssh.Dial("tcp", "127.0.0.1:2225", clientConfig)
+	if err != nil {
+		t.Errorf("unable to connect using the host certificate: %v", err)
+	} else {
+		conn.Close()
+	}
+	// the plain host key is still available
+	clientConfig.HostKeyAlgorithms = []string{ssh.KeyAlgoECDSA256}
+	clientConfig.HostKeyCallback = ssh.FixedHostKey(hostKey)
+	conn, err = ssh.Dial("tcp", "127.0.0.1:2225", clientConfig)
+	if err != nil {
+		t.Errorf("unable to connect using the plain host key: %v", err)
+	} else {
+		conn.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestEd25519HostKey(t *testing.T) {
+	// no host key is configured, so the default keys are generated and used
+	hostKeyBytes, err := ioutil.ReadFile(filepath.Join(configDir, "id_ed25519.pub"))
+	if err != nil {
+		t.Fatalf("unable to read the default ed25519 host key: %v", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey(hostKeyBytes)
+	if err != nil {
+		t.Fatalf("unable to parse host key: %v", err)
+	}
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	clientConfig := &ssh.ClientConfig{
+		User:              user.Username,
+		HostKeyCallback:   ssh.FixedHostKey(hostKey),
+		HostKeyAlgorithms: []string{ssh.KeyAlgoED25519},
+		Auth:              []ssh.AuthMethod{ssh.Password(defaultPassword)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, clientConfig)
+	if err != nil {
+		t.Errorf("unable to connect using the ed25519 host key: %v", err)
+	} else {
+		conn.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
 }
 
 func TestBasicSFTPHandling(t *testing.T) {
@@ -363,10 +568,119 @@ func TestProxyProtocol(t *testing.T) {
 	if err == nil {
 		t.Error("request without a proxy header must be rejected")
 	}
+	// the proxy protocol is not applied to this binding of the same server
+	client, err = getSftpClientWithAddr(user, usePubKey, "127.0.0.1:2226")
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("error getting working dir: %v", err)
+		}
+	}
 	httpd.RemoveUser(user, http.StatusOK)
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestAntivirusUpload(t *testing.T) {
+	// minimal clamd emulation, the streams starting with "infected" are reported as infected
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to listen: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				if _, err := r.ReadString('\x00'); err != nil {
+					return
+				}
+				var data bytes.Buffer
+				size := make([]byte, 4)
+				for {
+					if _, err := io.ReadFull(r, size); err != nil {
+						return
+					}
+					n := binary.BigEndian.Uint32(size)
+					if n == 0 {
+						break
+					}
+					if _, err := io.CopyN(&data, r, int64(n)); err != nil {
+						return
+					}
+				}
+				if bytes.HasPrefix(data.Bytes(), []byte("infected")) {
+					conn.Write([]byte("stream: Test-Signature FOUND\x00"))
+				} else {
+					conn.Write([]byte("stream: OK\x00"))
+				}
+			}(conn)
+		}
+	}()
+	err = antivirus.Initialize(antivirus.Config{Engine: antivirus.EngineClamd, Address: l.Addr().String()}, configDir)
+	if err != nil {
+		t.Fatalf("unable to initialize antivirus: %v", err)
+	}
+	defer antivirus.Initialize(antivirus.Config{}, configDir)
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		cleanFilePath := filepath.Join(homeBasePath, "clean_file.txt")
+		infectedFilePath := filepath.Join(homeBasePath, "infected_file.txt")
+		err = ioutil.WriteFile(cleanFilePath, []byte("clean content"), 0600)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = ioutil.WriteFile(infectedFilePath, []byte("infected content"), 0600)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(cleanFilePath, "clean_file.txt", 13, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(infectedFilePath, "infected_file.txt", 16, client)
+		if err == nil {
+			t.Error("uploading an infected file must fail")
+		}
+		_, err = os.Stat(filepath.Join(user.GetHomeDir(), "infected_file.txt"))
+		if !os.IsNotExist(err) {
+			t.Errorf("the infected file must be deleted: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to get user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != 13 {
+			t.Errorf("the infected file must not be included in the quota, files: %v, size: %v", user.UsedQuotaFiles,
+				user.UsedQuotaSize)
+		}
+		os.Remove(cleanFilePath)
+		os.Remove(infectedFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
 func TestUploadResume(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
@@ -562,7 +876,9 @@ func TestRemove(t *testing.T) {
 
 func TestLink(t *testing.T) {
 	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -586,17 +902,52 @@ func TestLink(t *testing.T) {
 		if err != nil {
 			t.Errorf("error creating symlink: %v", err)
 		}
-		_, err = client.ReadLink(testFileName + ".link")
-		if err == nil {
-			t.Errorf("readlink is currently not implemented so must fail")
+		linkDest, err := client.ReadLink(testFileName + ".link")
+		if err != nil {
+			t.Errorf("readlink error: %v", err)
+		} else if linkDest != "/"+testFileName {
+			t.Errorf("unexpected link destination: %#v", linkDest)
 		}
 		err = client.Symlink(testFileName, testFileName+".link")
 		if err == nil {
 			t.Errorf("creating a symlink to an existing one must fail")
 		}
+		_, err = client.ReadLink(testFileName)
+		if err == nil {
+			t.Errorf("readlink on a regular file must fail")
+		}
 		err = client.Link(testFileName, testFileName+".hlink")
+		if err != nil {
+			t.Errorf("error creating hard link: %v", err)
+		}
+		info, err := client.Stat(testFileName + ".hlink")
+		if err != nil {
+			t.Errorf("stat error: %v", err)
+		} else if info.Size() != testFileSize {
+			t.Errorf("unexpected hard link size: %v", info.Size())
+		}
+		err = client.Link(testFileName, testFileName+".hlink")
+		if err == nil {
+			t.Errorf("creating a hard link to an existing file must fail")
+		}
+		err = client.Mkdir("adir")
+		if err != nil {
+			t.Errorf("mkdir error: %v", err)
+		}
+		err = client.Link("adir", "adir.hlink")
 		if err == nil {
-			t.Errorf("hard link is not supported and must fail")
+			t.Errorf("hard links to directories must fail")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 2 || user.UsedQuotaSize != 2*testFileSize {
+			t.Errorf("unexpected quota, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Remove(testFileName + ".hlink")
+		if err != nil {
+			t.Errorf("error removing hard link: %v", err)
 		}
 		err = client.Remove(testFileName + ".link")
 		if err != nil {
@@ -615,6 +966,119 @@ func TestLink(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestLinkPermissions(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/private"] = []string{dataprovider.PermListItems, dataprovider.PermUpload,
+		dataprovider.PermCreateSymlinks}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = client.Mkdir("private")
+		if err != nil {
+			t.Errorf("mkdir error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join("private", testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		// the source directory has no download permission, the link would make the file readable
+		err = client.Link(path.Join("private", testFileName), testFileName+".hlink")
+		if err == nil || !strings.Contains(err.Error(), sftp.ErrSSHFxPermissionDenied.Error()) {
+			t.Errorf("unexpected error: %v expected: %v", err, sftp.ErrSSHFxPermissionDenied)
+		}
+		_, err = client.Stat(testFileName + ".hlink")
+		if err == nil {
+			t.Errorf("the hard link must not be created")
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLinksOutsideHome(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	// a sibling directory with the same prefix as the user home must not be reachable
+	siblingDir := user.GetHomeDir() + "_sibling"
+	os.MkdirAll(siblingDir, 0777)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(siblingDir, testFileName)
+	err = createTestFile(testFilePath, 100)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	os.MkdirAll(user.GetHomeDir(), 0777)
+	err = os.Symlink(testFilePath, filepath.Join(user.GetHomeDir(), "outside.link"))
+	if err != nil {
+		t.Errorf("unable to create symlink: %v", err)
+	}
+	err = os.Symlink(filepath.Join("..", filepath.Base(siblingDir)), filepath.Join(user.GetHomeDir(), "outside_rel.link"))
+	if err != nil {
+		t.Errorf("unable to create symlink: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		for _, link := range []string{"outside.link", "outside_rel.link"} {
+			_, err = client.ReadLink(link)
+			if err == nil {
+				t.Errorf("readlink outside the home dir must fail for %#v", link)
+			}
+		}
+		_, err = client.Stat("outside.link")
+		if err == nil {
+			t.Error("stat on a symlink pointing outside the home dir must fail")
+		}
+		err = client.Link(path.Join("outside_rel.link", testFileName), "inside.hlink")
+		if err == nil {
+			t.Error("a hard link to a file outside the home dir must fail")
+		}
+		err = client.Link("outside.link", "inside.hlink")
+		if err == nil {
+			t.Error("a hard link to a symlink pointing outside the home dir must fail")
+		}
+		err = client.Symlink(path.Join("..", filepath.Base(siblingDir), testFileName), "inside.link")
+		if err != nil {
+			t.Errorf("unable to create symlink: %v", err)
+		}
+		linkDest, err := client.ReadLink("inside.link")
+		if err != nil {
+			t.Errorf("readlink error: %v", err)
+		} else if linkDest != path.Join("/", filepath.Base(siblingDir), testFileName) {
+			t.Errorf("the symlink must be created inside the home dir, destination: %#v", linkDest)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(siblingDir)
+}
+
 func TestStat(t *testing.T) {
 	usePubKey := false
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -1000,6 +1464,254 @@ func TestLogin(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestLoginUserCert(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getCertSftpClient(user, getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner))
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		if _, err := client.Getwd(); err != nil {
+			t.Errorf("sftp client with a valid user certificate must work: %v", err)
+		}
+	}
+	// the user has no public keys, a certificate is required
+	client, err = getSftpClient(user, true)
+	if err == nil {
+		t.Error("login with a not authorized public key must fail")
+		client.Close()
+	}
+	client, err = getCertSftpClient(user, getUserCert(t, []string{"other"}, ssh.UserCert, userCASigner))
+	if err == nil {
+		t.Error("login with a certificate for a different principal must fail")
+		client.Close()
+	}
+	client, err = getCertSftpClient(user, getUserCert(t, []string{}, ssh.UserCert, userCASigner))
+	if err == nil {
+		t.Error("login with a certificate without principals must fail")
+		client.Close()
+	}
+	client, err = getCertSftpClient(user, getUserCert(t, []string{user.Username}, ssh.HostCert, userCASigner))
+	if err == nil {
+		t.Error("login with a host certificate must fail")
+		client.Close()
+	}
+	untrustedCA, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		t.Fatalf("unable to parse private key: %v", err)
+	}
+	client, err = getCertSftpClient(user, getUserCert(t, []string{user.Username}, ssh.UserCert, untrustedCA))
+	if err == nil {
+		t.Error("login with a certificate signed by an untrusted CA must fail")
+		client.Close()
+	}
+	certSigner := getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner)
+	cert := certSigner.PublicKey().(*ssh.Certificate)
+	cert.ValidBefore = uint64(time.Now().Add(-1 * time.Minute).Unix())
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	certSigner = getCertSigner(t, cert)
+	client, err = getCertSftpClient(user, certSigner)
+	if err == nil {
+		t.Error("login with an expired certificate must fail")
+		client.Close()
+	}
+	cert.ValidBefore = ssh.CertTimeInfinity
+	cert.CriticalOptions = map[string]string{"source-address": "10.8.0.1/32"}
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	client, err = getCertSftpClient(user, getCertSigner(t, cert))
+	if err == nil {
+		t.Error("login with a certificate not valid for the source address must fail")
+		client.Close()
+	}
+	cert.CriticalOptions = map[string]string{"force-command": "/bin/true"}
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	client, err = getCertSftpClient(user, getCertSigner(t, cert))
+	if err == nil {
+		t.Error("login with a certificate with unsupported critical options must fail")
+		client.Close()
+	}
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey}
+	user.Password = defaultPassword
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getCertSftpClient(user, getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner))
+	if err == nil {
+		t.Error("login with a certificate must fail if the public key login method is denied")
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginUserCertSessionOverrides(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/outbound/sub"] = []string{dataprovider.PermListItems}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	if err = os.MkdirAll(filepath.Join(user.GetHomeDir(), "outbound"), 0777); err != nil {
+		t.Fatalf("unable to create outbound dir: %v", err)
+	}
+	if err = createTestFile(filepath.Join(user.GetHomeDir(), "outbound", testFileName), 100); err != nil {
+		t.Fatalf("unable to create test file: %v", err)
+	}
+	if err = createTestFile(filepath.Join(user.GetHomeDir(), testFileName), 100); err != nil {
+		t.Fatalf("unable to create test file: %v", err)
+	}
+	certSigner := getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner)
+	cert := certSigner.PublicKey().(*ssh.Certificate)
+	cert.CriticalOptions = map[string]string{
+		dataprovider.CertOptionRoot:     "/outbound",
+		dataprovider.CertOptionReadOnly: "",
+	}
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	client, err := getCertSftpClient(user, getCertSigner(t, cert))
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		info, err := client.Stat(testFileName)
+		if err != nil {
+			t.Errorf("the file inside the session root must be visible: %v", err)
+		} else if info.Size() != 100 {
+			t.Errorf("unexpected file size: %v", info.Size())
+		}
+		files, err := client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unable to read the session root: %v", err)
+		} else if len(files) != 1 {
+			t.Errorf("only the files inside the session root must be visible: %v", len(files))
+		}
+		if _, err = client.Create("new_file"); err == nil {
+			t.Error("upload must fail for a read only session")
+		}
+		if err = client.Remove(testFileName); err == nil {
+			t.Error("remove must fail for a read only session")
+		}
+		if err = client.Mkdir("sub"); err == nil {
+			t.Error("mkdir must fail for a read only session")
+		}
+	}
+	// the overrides are never saved
+	users, _, err := httpd.GetUsers(0, 0, user.Username, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	} else if len(users) != 1 || users[0].HomeDir != user.HomeDir || len(users[0].Permissions["/"]) != 1 ||
+		users[0].Permissions["/"][0] != dataprovider.PermAny {
+		t.Errorf("the session overrides must not be saved: %+v", users)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginUserCertSessionRootQuota(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	mappedPath := filepath.Join(homeBasePath, "vdirsessionquota")
+	vdirPath := "/vdirsessionquota"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		VirtualPath:      vdirPath,
+		MappedPath:       mappedPath,
+		ExcludeFromQuota: true,
+	})
+	if err := os.MkdirAll(filepath.Join(mappedPath, "sub"), 0777); err != nil {
+		t.Fatalf("unable to create mapped dir: %v", err)
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	if err = createTestFile(testFilePath, testFileSize); err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	certSigner := getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner)
+	cert := certSigner.PublicKey().(*ssh.Certificate)
+	cert.CriticalOptions = map[string]string{
+		dataprovider.CertOptionRoot: path.Join(vdirPath, "sub"),
+	}
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	signer := getCertSigner(t, cert)
+	client, err := getCertSftpClient(user, signer)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		if err = sftpUploadFile(testFilePath, testFileName, testFileSize, client); err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(mappedPath, "sub", testFileName)); err != nil {
+		t.Errorf("the file must be uploaded inside the session root: %v", err)
+	}
+	// the session root is inside a folder excluded from the quota
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
+	} else if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+		t.Errorf("the user quota must not be updated, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+	}
+	// the quota is updated scanning the home dir after the system commands that can write files
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		t.Errorf("unable to connect: %v", err)
+	} else {
+		defer conn.Close()
+		session, err := conn.NewSession()
+		if err != nil {
+			t.Errorf("unable to create ssh session: %v", err)
+		} else {
+			out, err := session.Output("git-receive-pack /")
+			if err == nil || !strings.Contains(string(out), "command unsupported for this configuration") {
+				t.Errorf("the system commands that can write files must fail inside a session root, out: %v", string(out))
+			}
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(mappedPath)
+	os.Remove(testFilePath)
+}
+
 func TestLoginUserStatus(t *testing.T) {
 	usePubKey := true
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -1084,6 +1796,67 @@ func TestLoginUserExpiration(t *testing.T) {
 	} else {
 		defer client.Close()
 	}
+	user.ActivationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) + 60000
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login for a not yet active user must fail")
+		defer client.Close()
+	}
+	user.ActivationDate = utils.GetTimeAsMsSinceEpoch(time.Now()) - 60000
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("login for an active user must succeed: %v", err)
+	} else {
+		defer client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginPasswordExpiration(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.PublicKeys = []string{testPubKey}
+	u.Filters.PasswordExpiration = 1
+	u.LastPasswordChange = utils.GetTimeAsMsSinceEpoch(time.Now().Add(-48 * time.Hour))
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with an expired password must fail")
+		defer client.Close()
+	}
+	client, err = getSftpClient(user, true)
+	if err != nil {
+		t.Errorf("public key login must work with an expired password: %v", err)
+	} else {
+		defer client.Close()
+	}
+	user.Password = defaultPassword
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.Password = defaultPassword
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("login must succeed after a password change: %v", err)
+	} else {
+		defer client.Close()
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
@@ -1179,72 +1952,303 @@ func TestDeniedLoginMethods(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginWithIPFilters(t *testing.T) {
-	usePubKey := true
-	u := getTestUser(usePubKey)
-	u.Filters.DeniedIP = []string{"192.167.0.0/24", "172.18.0.0/16"}
-	u.Filters.AllowedIP = []string{}
+func TestMultiStepLoginMethods(t *testing.T) {
+	u := getTestUser(true)
+	u.Password = defaultPassword
+	u.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey, dataprovider.SSHLoginMethodPassword,
+		dataprovider.SSHLoginMethodKeyboardInteractive, dataprovider.SSHLoginMethodKeyAndKeyboardInt}
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(user, usePubKey)
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		t.Fatalf("unable to parse private key: %v", err)
+	}
+	_, err = getSftpClient(user, true)
+	if err == nil {
+		t.Error("public key only login must fail")
+	}
+	_, err = getSftpClient(user, false)
+	if err == nil {
+		t.Error("password only login must fail")
+	}
+	client, err := getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password(defaultPassword)})
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
-		defer client.Close()
-		_, err := client.Getwd()
-		if err != nil {
-			t.Errorf("sftp client with valid credentials must work")
-		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		_, err = client.ReadDir(".")
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		if user.LastLogin <= 0 {
-			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
+			t.Errorf("unable to read remote dir: %v", err)
 		}
+		client.Close()
 	}
-	user.Filters.AllowedIP = []string{"127.0.0.0/8"}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
-	}
-	client, err = getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("login from an allowed IP must succeed: %v", err)
-	} else {
-		defer client.Close()
+	_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password("wrong password")})
+	if err == nil {
+		t.Error("multi-step login with a wrong password must fail")
 	}
-	user.Filters.AllowedIP = []string{"172.19.0.0/16"}
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+	// the public key must be the first step
+	_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.Password(defaultPassword)})
+	if err == nil {
+		t.Error("multi-step login without a public key must fail")
 	}
-	client, err = getSftpClient(user, usePubKey)
+	_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(userCASigner), ssh.Password(defaultPassword)})
 	if err == nil {
-		t.Errorf("login from an not allowed IP must fail")
-		client.Close()
+		t.Error("multi-step login with an unknown public key must fail")
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+	// the certificate restrictions apply after the password step
+	certSigner := getUserCert(t, []string{user.Username}, ssh.UserCert, userCASigner)
+	cert := certSigner.PublicKey().(*ssh.Certificate)
+	cert.CriticalOptions = map[string]string{
+		dataprovider.CertOptionReadOnly: "",
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestLoginAfterUserUpdateEmptyPwd(t *testing.T) {
-	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
 	}
-	user.Password = ""
-	user.PublicKeys = []string{}
-	// password and public key should remain unchanged
-	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	client, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(getCertSigner(t, cert)),
+		ssh.Password(defaultPassword)})
 	if err != nil {
-		t.Errorf("unable to update user: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		if _, err = client.Create("new_file"); err == nil {
+			t.Error("upload must fail for a read only session")
+		}
+		client.Close()
+	}
+	cert.CriticalOptions = map[string]string{
+		"source-address": "10.8.0.1/32",
+	}
+	if err = cert.SignCert(rand.Reader, userCASigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(getCertSigner(t, cert)),
+		ssh.Password(defaultPassword)})
+	if err == nil {
+		t.Error("multi-step login from an address not allowed by the certificate must fail")
+	}
+	if runtime.GOOS != "windows" {
+		ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
+		keyIntAuth := ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{"1", "2"}, nil
+		})
+		_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), keyIntAuth})
+		if err == nil {
+			t.Error("publickey+keyboard-interactive is denied, login must fail")
+		}
+		user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPublicKey, dataprovider.SSHLoginMethodPassword,
+			dataprovider.SSHLoginMethodKeyboardInteractive, dataprovider.SSHLoginMethodKeyAndPassword}
+		user, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		client, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), keyIntAuth})
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			client.Close()
+		}
+		_, err = getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password(defaultPassword)})
+		if err == nil {
+			t.Error("publickey+password is denied, login must fail")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginMethodRules(t *testing.T) {
+	u := getTestUser(true)
+	u.Password = defaultPassword
+	u.Filters.LoginMethodRules = []dataprovider.LoginMethodRule{
+		{
+			Sources:             []string{"10.8.0.0/16"},
+			AllowedLoginMethods: []string{dataprovider.SSHLoginMethodPassword},
+		},
+		{
+			AllowedLoginMethods: []string{dataprovider.SSHLoginMethodKeyAndPassword},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		t.Fatalf("unable to parse private key: %v", err)
+	}
+	// only the second rule matches the client address
+	_, err = getSftpClient(user, true)
+	if err == nil {
+		t.Error("public key only login must fail")
+	}
+	_, err = getSftpClient(user, false)
+	if err == nil {
+		t.Error("password only login must fail")
+	}
+	client, err := getSftpClientWithAuthMethods(user, []ssh.AuthMethod{ssh.PublicKeys(key), ssh.Password(defaultPassword)})
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		client.Close()
+	}
+	user.Filters.LoginMethodRules[0].Sources = []string{"127.0.0.0/8"}
+	user.Filters.LoginMethodRules[0].AllowedLoginMethods = []string{dataprovider.SSHLoginMethodPassword,
+		dataprovider.SSHLoginMethodPublicKey}
+	user.Password = ""
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.Password = defaultPassword
+	for _, usePubKey := range []bool{true, false} {
+		client, err = getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("login allowed by the first rule must succeed, public key: %v, err: %v", usePubKey, err)
+		} else {
+			client.Close()
+		}
+	}
+	// the denied login methods apply regardless of the rules
+	user.Filters.DeniedLoginMethods = []string{dataprovider.SSHLoginMethodPassword}
+	user.Password = ""
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	user.Password = defaultPassword
+	_, err = getSftpClient(user, false)
+	if err == nil {
+		t.Error("a denied login method must fail even if allowed by a rule")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginWithIPFilters(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.DeniedIP = []string{"192.167.0.0/24", "172.18.0.0/16"}
+	u.Filters.AllowedIP = []string{}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with valid credentials must work")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.LastLogin <= 0 {
+			t.Errorf("last login must be updated after a successful login: %v", user.LastLogin)
+		}
+	}
+	user.Filters.AllowedIP = []string{"127.0.0.0/8"}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("login from an allowed IP must succeed: %v", err)
+	} else {
+		defer client.Close()
+	}
+	user.Filters.AllowedIP = []string{"172.19.0.0/16"}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login from an not allowed IP must fail")
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginWithRevokedPublicKey(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Filters.RevokedPublicKeys = []string{"invalid fingerprint"}
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid revoked keys: %v", err)
+	}
+	u.Filters.RevokedPublicKeys = []string{"SHA256:invalid"}
+	_, _, err = httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid revoked keys: %v", err)
+	}
+	// the public key is converted to its fingerprint
+	u.Filters.RevokedPublicKeys = []string{testPubKey1}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	if len(user.Filters.RevokedPublicKeys) != 1 || !strings.HasPrefix(user.Filters.RevokedPublicKeys[0], "SHA256:") {
+		t.Errorf("unexpected revoked keys: %+v", user.Filters.RevokedPublicKeys)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("sftp client with valid credentials must work")
+		}
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testPubKey))
+	if err != nil {
+		t.Fatalf("unable to parse public key: %v", err)
+	}
+	user.Filters.RevokedPublicKeys = append(user.Filters.RevokedPublicKeys, ssh.FingerprintSHA256(pubKey))
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with a revoked public key must fail")
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestLoginAfterUserUpdateEmptyPwd(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = ""
+	user.PublicKeys = []string{}
+	// password and public key should remain unchanged
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
 	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
@@ -1360,282 +2364,636 @@ func TestLoginKeyboardInteractiveAuth(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestPreLoginScript(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
+func TestKeyboardInteractiveAuthHTTPHook(t *testing.T) {
+	user, _, err := httpd.AddUser(getTestUser(false), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	var requestIDs []string
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req["username"] != user.Username || req["ip"] != "127.0.0.1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		requestIDs = append(requestIDs, req["request_id"].(string))
+		answers, _ := req["answers"].([]interface{})
+		switch {
+		case len(answers) == 0:
+			w.Write([]byte(`{"questions":["Password: "],"echos":[false],"check_password":1}`))
+		case answers[0] == "OK":
+			w.Write([]byte(`{"questions":["Token: "],"instruction":"one time token","echos":[true]}`))
+		case answers[0] == "token":
+			w.Write([]byte(`{"auth_result":1}`))
+		case answers[0] == "invalid":
+			w.Write([]byte(`{"questions":["Token: "],"echos":[]}`))
+		default:
+			w.Write([]byte(`{"auth_result":-1}`))
+		}
+	}))
+	defer hookServer.Close()
+
+	getChallenge := func(token string) ssh.KeyboardInteractiveChallenge {
+		return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			if questions[0] == "Password: " {
+				return []string{defaultPassword}, nil
+			}
+			return []string{token}, nil
+		}
 	}
-	usePubKey := true
-	u := getTestUser(usePubKey)
 	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(u, false), 0755)
-	providerConf.PreLoginProgram = preLoginPath
-	err := dataprovider.Initialize(providerConf, configDir)
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, user.Username, hookServer.URL, getChallenge("token"),
+		"127.0.0.1")
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("keyboard interactive auth using the HTTP hook must succeed: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
+	if len(requestIDs) != 3 || requestIDs[0] != requestIDs[1] || requestIDs[1] != requestIDs[2] {
+		t.Errorf("unexpected request IDs: %v", requestIDs)
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, user.Username, hookServer.URL, getChallenge("wrong"),
+		"127.0.0.1")
+	if err == nil {
+		t.Error("keyboard interactive auth with a wrong token must fail")
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, user.Username, hookServer.URL, getChallenge("invalid"),
+		"127.0.0.1")
+	if err == nil {
+		t.Error("keyboard interactive auth with an invalid hook response must fail")
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, user.Username, hookServer.URL, getChallenge("token"),
+		"127.0.0.2")
+	if err == nil {
+		t.Error("keyboard interactive auth with an unexpected hook status code must fail")
+	}
+	_, err = dataprovider.CheckKeyboardInteractiveAuth(dataProvider, user.Username, hookServer.URL,
+		func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			return []string{"wrong password"}, nil
+		}, "127.0.0.1")
+	if err == nil {
+		t.Error("keyboard interactive auth with a wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
 
+func TestLoginTOTP(t *testing.T) {
+	u := getTestUser(false)
+	u.Filters.TOTPSecret = "invalid secret"
+	_, _, err := httpd.AddUser(u, http.StatusBadRequest)
+	if err != nil {
+		t.Errorf("unexpected error adding user with invalid TOTP secret: %v", err)
+	}
+	secret, err := utils.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatalf("unable to generate TOTP secret: %v", err)
+	}
+	u.Filters.TOTPSecret = secret
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	client, err := getSftpClient(u, usePubKey)
+	if user.Filters.TOTPSecret == secret {
+		t.Error("the TOTP secret must be encrypted")
+	}
+	_, err = getSftpClient(user, false)
+	if err == nil {
+		t.Error("password only login must fail for a user with a TOTP secret")
+	}
+	code, err := utils.GetTOTPCode(secret, time.Now())
+	if err != nil {
+		t.Errorf("unable to get TOTP code: %v", err)
+	}
+	client, err := getTOTPSftpClient(user, defaultPassword, code)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err = client.Getwd()
+		_, err = client.ReadDir(".")
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to read remote dir: %v", err)
 		}
 	}
-	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(user, true), 0755)
-	_, err = getSftpClient(u, usePubKey)
+	_, err = getTOTPSftpClient(user, "invalid password", code)
 	if err == nil {
-		t.Error("pre login script returned a non json response, login must fail")
+		t.Error("TOTP login with an invalid password must fail")
 	}
-	user.Status = 0
-	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(user, false), 0755)
-	_, err = getSftpClient(u, usePubKey)
+	invalidCode, err := utils.GetTOTPCode(secret, time.Now().Add(-5*time.Minute))
+	if err != nil {
+		t.Errorf("unable to get TOTP code: %v", err)
+	}
+	_, err = getTOTPSftpClient(user, defaultPassword, invalidCode)
 	if err == nil {
-		t.Error("pre login script returned a disabled user, login must fail")
+		t.Error("TOTP login with an expired code must fail")
 	}
-	_, err = httpd.RemoveUser(user, http.StatusOK)
+	// updating the user without changing the secret must preserve it
+	user.MaxSessions = 10
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove user: %v", err)
+		t.Errorf("unable to update user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
+	client, err = getTOTPSftpClient(user, defaultPassword, code)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		client.Close()
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(preLoginPath)
+	// remove the secret, password only login must work again
+	user.Filters.TOTPSecret = ""
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, false)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		client.Close()
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := true
+func TestCryptFs(t *testing.T) {
+	usePubKey := false
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 0
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.QuotaSize = 6553600
+	u.FsConfig.CryptConfig.Passphrase = "crypt passphrase"
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
+	if !strings.HasPrefix(user.FsConfig.CryptConfig.Passphrase, "$aes$") {
+		t.Errorf("the passphrase must be stored encrypted: %#v", user.FsConfig.CryptConfig.Passphrase)
+	}
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
-		err = createTestFile(testFilePath, testFileSize)
+		testFilePath := filepath.Join(homeBasePath, "test_file.dat")
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		expectedQuotaSize := int64(0)
+		// a file smaller than a chunk, a file with an exact number of chunks and an empty file
+		for idx, testFileSize := range []int64{65535, 131072, 0} {
+			fileName := fmt.Sprintf("test_crypt%v.dat", idx)
+			createTestFile(testFilePath, testFileSize)
+			err = sftpUploadFile(testFilePath, fileName, testFileSize, client)
+			if err != nil {
+				t.Errorf("file upload error: %v", err)
+			}
+			expectedQuotaSize += testFileSize
+			info, err := os.Stat(filepath.Join(user.GetHomeDir(), fileName))
+			if err != nil {
+				t.Errorf("unable to stat the stored file: %v", err)
+			} else if info.Size() <= testFileSize {
+				t.Errorf("unexpected stored file size: %v, plaintext size: %v", info.Size(), testFileSize)
+			}
+			err = sftpDownloadFile(fileName, localDownloadPath, testFileSize, client)
+			if err != nil {
+				t.Errorf("file download error: %v", err)
+			}
+			uploadedHash, _ := computeHashForFile(sha256.New(), testFilePath)
+			downloadedHash, _ := computeHashForFile(sha256.New(), localDownloadPath)
+			if uploadedHash != downloadedHash {
+				t.Errorf("downloaded file does not match the uploaded one")
+			}
+			os.Remove(localDownloadPath)
+		}
+		createTestFile(testFilePath, 1024)
+		plaintext, _ := ioutil.ReadFile(testFilePath)
+		stored, _ := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), "test_crypt1.dat"))
+		if bytes.Contains(stored, plaintext) {
+			t.Error("the stored file must be encrypted")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
 		if err != nil {
-			t.Errorf("unable to create test file: %v", err)
+			t.Errorf("error getting user: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if user.UsedQuotaFiles != 3 || user.UsedQuotaSize != expectedQuotaSize {
+			t.Errorf("unexpected quota, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
 		if err != nil {
-			t.Errorf("file upload error: %v", err)
+			t.Errorf("error starting quota scan: %v", err)
 		}
-		os.Remove(testFilePath)
-	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
-	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	u.PublicKeys = []string{}
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	client, err = getSftpClient(u, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		err = waitQuotaScans()
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("error waiting for active quota scans: %v", err)
 		}
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
-	}
-	user := users[0]
-	if len(user.PublicKeys) != 0 {
-		t.Errorf("number of public keys mismatch, expected: 0, actual: %v", len(user.PublicKeys))
-	}
-	if user.UsedQuotaSize == 0 {
-		t.Error("quota size must be > 0")
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 3 || user.UsedQuotaSize != expectedQuotaSize {
+			t.Errorf("unexpected quota after scan, files: %v size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		// a modified file must be detected
+		stored[len(stored)-1] ^= 0x01
+		err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "test_crypt1.dat"), stored, 0666)
+		if err != nil {
+			t.Errorf("unable to modify the stored file: %v", err)
+		}
+		err = sftpDownloadFile("test_crypt1.dat", localDownloadPath, 131072, client)
+		if err == nil {
+			t.Error("downloading a modified file must fail")
+		}
+		// a file stored outside SFTPGo cannot be downloaded
+		err = ioutil.WriteFile(filepath.Join(user.GetHomeDir(), "plain.dat"), plaintext, 0666)
+		if err != nil {
+			t.Errorf("unable to write plaintext file: %v", err)
+		}
+		err = sftpDownloadFile("plain.dat", localDownloadPath, 0, client)
+		if err == nil {
+			t.Error("downloading a not encrypted file must fail")
+		}
+		// upload resume is not supported
+		err = sftpUploadResumeFile(testFilePath, "test_crypt0.dat", 0, false, client)
+		if err == nil {
+			t.Error("upload resume must fail for encrypted filesystems")
+		}
+		// updating the user without changing the passphrase must preserve it
+		user.MaxSessions = 10
+		user, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		newClient, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			err = sftpDownloadFile("test_crypt0.dat", localDownloadPath, 65535, newClient)
+			if err != nil {
+				t.Errorf("file download error after user update: %v", err)
+			}
+			newClient.Close()
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
 }
 
-func TestLoginExternalAuthPwd(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
+func TestStatVFS(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 1
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.Permissions["/denied"] = []string{dataprovider.PermUpload}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		// without quota restrictions the filesystem values are reported
+		stat, err := client.StatVFS("/")
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to get statvfs: %v", err)
+		} else if stat.Blocks == 0 || stat.Bsize == 0 {
+			t.Errorf("unexpected statvfs: %+v", stat)
 		}
+		_, err = client.StatVFS("/missing")
+		if err == nil {
+			t.Error("statvfs for a missing path must fail")
+		}
+		_, err = client.StatVFS("/denied")
+		if err == nil {
+			t.Error("statvfs without the list permission must fail")
+		}
+		// the other requests must work as usual
+		_, err = client.ReadDir("/")
+		if err != nil {
+			t.Errorf("unable to read dir: %v", err)
+		}
+		client.Close()
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
+	user.QuotaSize = 409600
+	user.QuotaFiles = 10
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
 	}
-	usePubKey = true
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65536)
+		createTestFile(testFilePath, testFileSize)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		stat, err := client.StatVFS("/")
+		if err != nil {
+			t.Errorf("unable to get statvfs: %v", err)
+		} else {
+			if stat.TotalSpace() != uint64(user.QuotaSize) || stat.FreeSpace() != uint64(user.QuotaSize-testFileSize) {
+				t.Errorf("unexpected space, total: %v free: %v", stat.TotalSpace(), stat.FreeSpace())
+			}
+			if stat.Files != 10 || stat.Ffree != 9 {
+				t.Errorf("unexpected files, total: %v free: %v", stat.Files, stat.Ffree)
+			}
+		}
+		os.Remove(testFilePath)
+		client.Close()
 	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	// encrypted filesystems without quota restrictions are not supported
+	user.QuotaSize = 0
+	user.QuotaFiles = 0
+	user.FsConfig.CryptConfig.Passphrase = "crypt passphrase"
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+		t.Errorf("unable to update user: %v", err)
 	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		_, err = client.StatVFS("/")
+		if err == nil {
+			t.Error("statvfs must be unsupported")
+		}
+		client.Close()
 	}
-	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
 }
 
-func TestLoginExternalAuthPubKey(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
-	usePubKey := true
+func TestCopyData(t *testing.T) {
+	usePubKey := false
 	u := getTestUser(usePubKey)
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 2
-	err := dataprovider.Initialize(providerConf, configDir)
+	u.QuotaFiles = 100
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("unable to add user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-
-	client, err := getSftpClient(u, usePubKey)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(131074)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
+		client.Close()
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
+	content, _ := ioutil.ReadFile(testFilePath)
+	conn, w, r, err := getRawSftpSession(user)
+	if err != nil {
+		t.Errorf("unable to create raw sftp session: %v", err)
+	} else {
+		defer conn.Close()
+		version, err := readRawSFTPPacket(r)
+		if err != nil {
+			t.Errorf("unable to read the version packet: %v", err)
+		} else if !bytes.Contains(version, marshalRawSFTPString(nil, "copy-data")) {
+			t.Errorf("copy-data must be advertised: %q", version)
+		}
+		// SSH_FXF_READ
+		readHandle, err := sendRawSFTPOpen(w, r, testFileName, 1)
+		if err != nil {
+			t.Errorf("unable to open the source file: %v", err)
+		}
+		// SSH_FXF_WRITE | SSH_FXF_CREAT | SSH_FXF_TRUNC
+		writeHandle, err := sendRawSFTPOpen(w, r, testFileName+".copy", 0x1a)
+		if err != nil {
+			t.Errorf("unable to open the destination file: %v", err)
+		}
+		for _, test := range []struct {
+			readHandle  string
+			writeHandle string
+			status      byte
+		}{
+			{"invalid", writeHandle, 4},
+			{readHandle, "invalid", 4},
+			{writeHandle, readHandle, 4},
+			{readHandle, writeHandle, 0},
+		} {
+			response, err := sendCopyDataRequest(w, r, test.readHandle, 0, 0, test.writeHandle, 10)
+			if err != nil {
+				t.Errorf("copy-data error: %v", err)
+			} else if len(response) < 9 || response[0] != 101 || response[8] != test.status {
+				t.Errorf("unexpected copy-data response for %+v: %v", test, response)
+			}
+		}
+		response, err := sendCopyDataRequest(w, r, readHandle, 0, 10, writeHandle, 0)
+		if err != nil || len(response) < 9 || response[8] != 0 {
+			t.Errorf("unexpected copy-data response: %v, err: %v", response, err)
+		}
+		for _, handle := range []string{readHandle, writeHandle} {
+			// SSH_FXP_CLOSE
+			response, err = sendRawSFTPRequest(w, r, 4, marshalRawSFTPString(nil, handle))
+			if err != nil || len(response) < 9 || response[8] != 0 {
+				t.Errorf("unexpected close response: %v, err: %v", response, err)
+			}
+		}
+		copied, err := ioutil.ReadFile(filepath.Join(user.GetHomeDir(), testFileName+".copy"))
+		if err != nil {
+			t.Errorf("unable to read the copied file: %v", err)
+		} else if !bytes.Equal(copied, append(content[:10], content...)) {
+			t.Errorf("unexpected copied data, size: %v", len(copied))
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 2 || user.UsedQuotaSize != 2*testFileSize+10 {
+			t.Errorf("unexpected quota, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
 	}
-	usePubKey = false
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestCheckFile(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+		t.Errorf("unable to add user: %v", err)
 	}
-	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		client.Close()
+	}
+	content, _ := ioutil.ReadFile(testFilePath)
+	conn, w, r, err := getRawSftpSession(user)
+	if err != nil {
+		t.Errorf("unable to create raw sftp session: %v", err)
+	} else {
+		defer conn.Close()
+		version, err := readRawSFTPPacket(r)
+		if err != nil {
+			t.Errorf("unable to read the version packet: %v", err)
+		} else if !bytes.Contains(version, marshalRawSFTPString(nil, "check-file")) {
+			t.Errorf("check-file must be advertised: %q", version)
+		}
+		wholeHash := sha256.Sum256(content)
+		firstHash := sha256.Sum256(content[:32768])
+		secondHash := sha256.Sum256(content[32768:])
+		for _, test := range []struct {
+			algos     string
+			path      string
+			offset    uint64
+			length    uint64
+			blockSize uint32
+			expected  []byte
+		}{
+			{"unknown,sha256,md5", testFileName, 0, 0, 0, wholeHash[:]},
+			{"sha256", testFileName, 0, 0, 32768, append(firstHash[:], secondHash[:]...)},
+			{"sha256", testFileName, 32768, 0, 0, secondHash[:]},
+			{"sha256", testFileName, 0, 32768, 65536, firstHash[:]},
+		} {
+			response, err := sendCheckFileRequest(w, r, test.path, test.algos, test.offset, test.length, test.blockSize)
+			if err != nil {
+				t.Errorf("check-file error: %v", err)
+				continue
+			}
+			expected := []byte{201, 0, 0, 0, 1}
+			expected = marshalRawSFTPString(expected, "check-file")
+			expected = marshalRawSFTPString(expected, "sha256")
+			if !bytes.Equal(response, append(expected, test.expected...)) {
+				t.Errorf("unexpected check-file response for %+v: %v", test, response)
+			}
+		}
+		for _, test := range []struct {
+			algos     string
+			path      string
+			blockSize uint32
+			status    byte
+		}{
+			{"unknown", testFileName, 0, 8},
+			{"md5", testFileName, 100, 4},
+			{"md5", "missing", 0, 2},
+			{"md5", "/", 0, 8},
+		} {
+			response, err := sendCheckFileRequest(w, r, test.path, test.algos, 0, 0, test.blockSize)
+			if err != nil {
+				t.Errorf("check-file error: %v", err)
+				continue
+			}
+			if len(response) < 9 || response[0] != 101 || response[8] != test.status {
+				t.Errorf("unexpected check-file response for %+v: %v", test, response)
+			}
+		}
+	}
+	user.Permissions["/"] = []string{dataprovider.PermListItems}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	conn, w, r, err = getRawSftpSession(user)
+	if err != nil {
+		t.Errorf("unable to create raw sftp session: %v", err)
+	} else {
+		defer conn.Close()
+		readRawSFTPPacket(r)
+		response, err := sendCheckFileRequest(w, r, testFileName, "md5", 0, 0, 0)
+		if err != nil {
+			t.Errorf("check-file error: %v", err)
+		} else if len(response) < 9 || response[0] != 101 || response[8] != 3 {
+			t.Errorf("check-file without download permission must fail: %v", response)
+		}
 	}
-	user := users[0]
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
+	os.Remove(testFilePath)
 	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPreLoginScript(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(u, false), 0755)
+	providerConf.PreLoginHook = preLoginPath
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
 
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(user, true), 0755)
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("pre login script returned a non json response, login must fail")
+	}
+	user.Status = 0
+	ioutil.WriteFile(preLoginPath, getPreLoginScriptContent(user, false), 0755)
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("pre login script returned a disabled user, login must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
 	dataProvider = dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
@@ -1646,22 +3004,39 @@ func TestLoginExternalAuthPubKey(t *testing.T) {
 	}
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
+	os.Remove(preLoginPath)
 }
 
-func TestLoginExternalAuthInteractive(t *testing.T) {
-	if runtime.GOOS == "windows" {
-		t.Skip("this test is not available on Windows")
-	}
+func TestPreLoginHookHTTP(t *testing.T) {
 	usePubKey := false
 	u := getTestUser(usePubKey)
+	var hookRequests []url.Values
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var user dataprovider.User
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		hookRequests = append(hookRequests, r.URL.Query())
+		switch user.Username {
+		case u.Username:
+			if user.ID == 0 {
+				// create the user on the fly
+				json.NewEncoder(w).Encode(u)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer hookServer.Close()
+
 	dataProvider := dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
 	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
-	providerConf.ExternalAuthProgram = extAuthPath
-	providerConf.ExternalAuthScope = 4
+	providerConf.PreLoginHook = hookServer.URL
 	err := dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		t.Errorf("error initializing data provider")
@@ -1669,39 +3044,42 @@ func TestLoginExternalAuthInteractive(t *testing.T) {
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
 
-	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
-	client, err := getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		defer client.Close()
-		_, err := client.Getwd()
+	for i := 0; i < 2; i++ {
+		client, err := getSftpClient(u, usePubKey)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			_, err = client.Getwd()
+			if err != nil {
+				t.Errorf("unable to get working dir: %v", err)
+			}
+			client.Close()
 		}
 	}
-	u.Username = defaultUsername + "1"
-	client, err = getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
-	if err == nil {
-		t.Error("external auth login with invalid user must fail")
+	if len(hookRequests) != 2 {
+		t.Fatalf("unexpected number of pre-login hook requests: %v", len(hookRequests))
 	}
-	usePubKey = true
-	u = getTestUser(usePubKey)
-	client, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("external auth login with valid user but invalid auth scope must fail")
+	if hookRequests[0].Get("login_method") != dataprovider.SSHLoginMethodPassword || hookRequests[0].Get("ip") != "127.0.0.1" {
+		t.Errorf("unexpected pre-login hook query: %v", hookRequests[0])
 	}
 	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to get users: %v, out: %v", err, string(out))
 	}
 	if len(users) != 1 {
-		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+		t.Fatalf("the user must be created by the pre-login hook, users: %v", len(users))
 	}
 	user := users[0]
+	invalidUser := getTestUser(usePubKey)
+	invalidUser.Username = "missing_user"
+	client, err := getSftpClient(invalidUser, usePubKey)
+	if err == nil {
+		t.Error("login must fail if the pre-login hook returns an error")
+		client.Close()
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
 
@@ -1709,26 +3087,143 @@ func TestLoginExternalAuthInteractive(t *testing.T) {
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
 	providerConf = config.GetProviderConf()
+	providerConf.PreLoginHook = "http://"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("an invalid pre-login hook URL must fail")
+	}
+	// the deprecated setting is still used
+	providerConf.PreLoginHook = ""
+	providerConf.PreLoginProgram = "relative_path"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("a relative pre-login hook path must fail")
+	}
+	providerConf.PreLoginProgram = ""
 	err = dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
 		t.Errorf("error initializing data provider")
 	}
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
 }
 
-func TestLoginExternalAuthErrors(t *testing.T) {
+func TestPostLoginHook(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	notifications := make(chan map[string]interface{}, 10)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var notification map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&notification); err == nil {
+			notifications <- notification
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer hookServer.Close()
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	waitNotification := func(timeout time.Duration) map[string]interface{} {
+		select {
+		case n := <-notifications:
+			return n
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	for _, scope := range []int{0, 1, 2} {
+		dataProvider := dataprovider.GetProvider()
+		dataprovider.Close(dataProvider)
+		config.LoadConfig(configDir, "")
+		providerConf := config.GetProviderConf()
+		providerConf.PostLoginHook = hookServer.URL
+		providerConf.PostLoginScope = scope
+		err = dataprovider.Initialize(providerConf, configDir)
+		if err != nil {
+			t.Errorf("error initializing data provider")
+		}
+		httpd.SetDataProvider(dataprovider.GetProvider())
+		sftpd.SetDataProvider(dataprovider.GetProvider())
+
+		client, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			client.Close()
+		}
+		if scope != 1 {
+			n := waitNotification(2 * time.Second)
+			if n == nil {
+				t.Fatalf("missing successful login notification, scope %v", scope)
+			}
+			if n["username"] != user.Username || n["ip"] != "127.0.0.1" || n["protocol"] != "SSH" ||
+				n["login_method"] != dataprovider.SSHLoginMethodPassword || n["status"] != float64(1) {
+				t.Errorf("unexpected notification: %+v", n)
+			}
+		}
+		user.Password = "wrong password"
+		client, err = getSftpClient(user, usePubKey)
+		if err == nil {
+			t.Error("login with a wrong password must fail")
+			client.Close()
+		}
+		user.Password = defaultPassword
+		if scope != 2 {
+			n := waitNotification(2 * time.Second)
+			if n == nil {
+				t.Fatalf("missing failed login notification, scope %v", scope)
+			}
+			if n["username"] != user.Username || n["status"] != float64(0) {
+				t.Errorf("unexpected notification: %+v", n)
+			}
+		}
+		if n := waitNotification(200 * time.Millisecond); n != nil {
+			t.Errorf("unexpected notification for scope %v: %+v", scope, n)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.PostLoginHook = "relative_path"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("a relative post-login hook path must fail")
+	}
+	providerConf.PostLoginHook = "http://"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("an invalid post-login hook URL must fail")
+	}
+	providerConf.PostLoginHook = ""
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginExternalAuthPwdAndPubKey(t *testing.T) {
 	if runtime.GOOS == "windows" {
 		t.Skip("this test is not available on Windows")
 	}
 	usePubKey := true
 	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
 	dataProvider := dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
 	config.LoadConfig(configDir, "")
 	providerConf := config.GetProviderConf()
-	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, true), 0755)
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
 	providerConf.ExternalAuthProgram = extAuthPath
 	providerConf.ExternalAuthScope = 0
 	err := dataprovider.Initialize(providerConf, configDir)
@@ -1738,23 +3233,313 @@ func TestLoginExternalAuthErrors(t *testing.T) {
 	httpd.SetDataProvider(dataprovider.GetProvider())
 	sftpd.SetDataProvider(dataprovider.GetProvider())
 
-	_, err = getSftpClient(u, usePubKey)
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
 	if err == nil {
-		t.Error("login must fail, external auth returns a non json response")
+		t.Error("external auth login with invalid user must fail")
 	}
 	usePubKey = false
 	u = getTestUser(usePubKey)
-	_, err = getSftpClient(u, usePubKey)
-	if err == nil {
-		t.Error("login must fail, external auth returns a non json response")
-	}
-	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	u.PublicKeys = []string{}
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	client, err = getSftpClient(u, usePubKey)
 	if err != nil {
-		t.Errorf("unable to get users: %v, out: %v", err, string(out))
-	}
-	if len(users) != 0 {
-		t.Errorf("number of users mismatch, expected: 0, actual: %v", len(users))
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	if len(user.PublicKeys) != 0 {
+		t.Errorf("number of public keys mismatch, expected: 0, actual: %v", len(user.PublicKeys))
+	}
+	if user.UsedQuotaSize == 0 {
+		t.Error("quota size must be > 0")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestLoginExternalAuthHTTP(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	var authRequests []map[string]string
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var authRequest map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&authRequest); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		authRequests = append(authRequests, authRequest)
+		switch authRequest["username"] {
+		case u.Username:
+			if authRequest["password"] != defaultPassword {
+				json.NewEncoder(w).Encode(dataprovider.User{})
+				return
+			}
+			json.NewEncoder(w).Encode(u)
+		case "invalid_json":
+			w.Write([]byte("text response"))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer authServer.Close()
+
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.ExternalAuthHook = authServer.URL
+	providerConf.ExternalAuthScope = 1
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	if len(authRequests) != 1 {
+		t.Fatalf("unexpected number of auth requests: %v", len(authRequests))
+	}
+	if authRequests[0]["ip"] != "127.0.0.1" || authRequests[0]["password"] != defaultPassword {
+		t.Errorf("unexpected auth request: %+v", authRequests[0])
+	}
+	u.Password = "wrong password"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid password must fail")
+		client.Close()
+	}
+	for _, username := range []string{"invalid_json", "missing_user"} {
+		user := getTestUser(usePubKey)
+		user.Username = username
+		client, err = getSftpClient(user, usePubKey)
+		if err == nil {
+			t.Errorf("external auth login for user %#v must fail", username)
+			client.Close()
+		}
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Fatalf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	providerConf.ExternalAuthHook = "ftp://127.0.0.1/auth"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("a non HTTP external auth hook URL must fail")
+	}
+	providerConf.ExternalAuthHook = "http://"
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("an external auth hook URL without host must fail")
+	}
+	providerConf.ExternalAuthHook = ""
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginExternalAuthSessionRoot(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	authServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			dataprovider.User
+			Session dataprovider.SessionOverrides `json:"session"`
+		}{
+			User:    u,
+			Session: dataprovider.SessionOverrides{Root: "/outbound"},
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer authServer.Close()
+
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.ExternalAuthHook = authServer.URL
+	providerConf.ExternalAuthScope = 1
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	if err = createTestFile(testFilePath, testFileSize); err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		if err = sftpUploadFile(testFilePath, testFileName, testFileSize, client); err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(u.GetHomeDir(), "outbound", testFileName)); err != nil {
+		t.Errorf("the file must be uploaded inside the session root: %v", err)
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Fatalf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	if user.HomeDir != u.HomeDir {
+		t.Errorf("the session root must not be saved, home dir: %#v", user.HomeDir)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.Remove(testFilePath)
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginExternalAuthPwd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.ExternalAuthScope = 1
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = true
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
 	}
+	os.RemoveAll(user.GetHomeDir())
 
 	dataProvider = dataprovider.GetProvider()
 	dataprovider.Close(dataProvider)
@@ -1762,28 +3547,798 @@ func TestLoginExternalAuthErrors(t *testing.T) {
 	providerConf = config.GetProviderConf()
 	err = dataprovider.Initialize(providerConf, configDir)
 	if err != nil {
-		t.Errorf("error initializing data provider")
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestLoginPAM(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("this test is available on Linux only")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = "$pam$"
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	u.Password = defaultPassword
+	// PAM is not enabled
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login for a PAM user must fail if PAM is disabled")
+	}
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.PAM.Service = "sftpgo-test-missing"
+	providerConf.PAM.AutoCreate = true
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("auto create without default permissions must fail")
+	}
+	providerConf.PAM.DefaultPermissions = map[string][]string{"/": {dataprovider.PermAny}}
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider: %v", err)
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	// the PAM service is not defined, the system default rules must deny the login
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login for a PAM user with an undefined PAM service must fail")
+	}
+	u.Username = defaultUsername + "_pam"
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login for a missing user with an undefined PAM service must fail")
+	}
+	users, _, err := httpd.GetUsers(0, 0, u.Username, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v", err)
+	}
+	if len(users) != 0 {
+		t.Errorf("the user must not be added after a failed PAM login: %+v", users)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestLoginExternalAuthPubKey(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.ExternalAuthScope = 2
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	client, err := getSftpClient(u, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestLoginExternalAuthInteractive(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, false), 0755)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.ExternalAuthScope = 4
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	ioutil.WriteFile(keyIntAuthPath, getKeyboardInteractiveScriptContent([]string{"1", "2"}, 0, false, 1), 0755)
+	client, err := getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+	}
+	u.Username = defaultUsername + "1"
+	client, err = getKeyboardInteractiveSftpClient(u, []string{"1", "2"})
+	if err == nil {
+		t.Error("external auth login with invalid user must fail")
+	}
+	usePubKey = true
+	u = getTestUser(usePubKey)
+	client, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("external auth login with valid user but invalid auth scope must fail")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 1 {
+		t.Errorf("number of users mismatch, expected: 1, actual: %v", len(users))
+	}
+	user := users[0]
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestLoginExternalAuthErrors(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("this test is not available on Windows")
+	}
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	ioutil.WriteFile(extAuthPath, getExtAuthScriptContent(u, 0, true), 0755)
+	providerConf.ExternalAuthHook = extAuthPath
+	providerConf.ExternalAuthScope = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login must fail, external auth returns a non json response")
+	}
+	usePubKey = false
+	u = getTestUser(usePubKey)
+	_, err = getSftpClient(u, usePubKey)
+	if err == nil {
+		t.Error("login must fail, external auth returns a non json response")
+	}
+	users, out, err := httpd.GetUsers(0, 0, defaultUsername, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to get users: %v, out: %v", err, string(out))
+	}
+	if len(users) != 0 {
+		t.Errorf("number of users mismatch, expected: 0, actual: %v", len(users))
+	}
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	os.Remove(extAuthPath)
+}
+
+func TestQuotaDisabledError(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.TrackQuota = 0
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 10
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestDelayedQuotaUpdate(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.DelayedQuotaUpdate = 3600
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 2
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		for _, name := range []string{testFileName, testFileName + "1"} {
+			err = sftpUploadFile(testFilePath, name, testFileSize, client)
+			if err != nil {
+				t.Errorf("file upload error: %v", err)
+			}
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("the quota must not be updated yet, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		// the pending changes are included in the quota check
+		err = sftpUploadFile(testFilePath, testFileName+"2", testFileSize, client)
+		if err == nil {
+			t.Error("upload must fail if the quota is exceeded")
+		}
+		dataprovider.FlushDelayedQuotaUpdates()
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 2 || user.UsedQuotaSize != 2*testFileSize {
+			t.Errorf("unexpected quota after flush, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		// the scan discards the pending changes
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		dataprovider.FlushDelayedQuotaUpdates()
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota after scan, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestMaxSessions(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Username += "1"
+	u.MaxSessions = 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+		_, err = client.ReadDir(".")
+		if err != nil {
+			t.Errorf("unable to read remote dir: %v", err)
+		}
+		_, err = getSftpClient(user, usePubKey)
+		if err == nil {
+			t.Errorf("max sessions exceeded, new login should not succeed")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMaxSessionsShared(t *testing.T) {
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.SharedSessions = true
+	err := dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.MaxSessions = 2
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	// a session handled by another node
+	err = dataprovider.AddActiveSession(dataprovider.GetProvider(), dataprovider.ActiveSession{
+		ConnectionID: "connection_id",
+		NodeID:       "other_node",
+		Username:     user.Username,
+		Protocol:     "FTP",
+	})
+	if err != nil {
+		t.Errorf("unable to add the active session: %v", err)
+	}
+	if sftpd.GetActiveSessions(user.Username) != 1 {
+		t.Errorf("the sessions on the other nodes must be counted")
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		_, err := client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir: %v", err)
+		}
+		_, err = getSftpClient(user, usePubKey)
+		if err == nil {
+			t.Errorf("max sessions exceeded, new login should not succeed")
+		}
+		err = dataprovider.DeleteActiveSession(dataprovider.GetProvider(), "other_node", "connection_id")
+		if err != nil {
+			t.Errorf("unable to remove the active session: %v", err)
+		}
+		c, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			c.Close()
+		}
+		client.Close()
+	}
+	// the sessions must be removed from the data provider before disabling the shared sessions
+	for i := 0; i < 50 && sftpd.GetActiveSessions(user.Username) > 0; i++ {
+		time.Sleep(20 * time.Millisecond)
+	}
+	if sftpd.GetActiveSessions(user.Username) != 0 {
+		t.Errorf("the shared sessions must be removed when the connections are closed")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
+func TestQuotaFileReplace(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1000
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	testFileSize := int64(65535)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		expectedQuotaSize := user.UsedQuotaSize + testFileSize
+		expectedQuotaFiles := user.UsedQuotaFiles + 1
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		// now replace the same file, the quota must not change
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if expectedQuotaFiles != user.UsedQuotaFiles {
+			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+		}
+		if expectedQuotaSize != user.UsedQuotaSize {
+			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+		}
+	}
+	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
+	user.QuotaSize = testFileSize - 1
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("error updating user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Errorf("quota size exceeded, file upload must fail")
+		}
+		err = client.Remove(testFileName)
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestGroupSettings(t *testing.T) {
+	usePubKey := false
+	group, _, err := httpd.AddGroup(dataprovider.Group{
+		Name:       "sftp_group",
+		QuotaFiles: 1,
+		Permissions: map[string][]string{
+			"/": {dataprovider.PermListItems, dataprovider.PermDownload, dataprovider.PermUpload},
+		},
+	}, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add group: %v", err)
+	}
+	u := getTestUser(usePubKey)
+	u.Groups = []string{group.Name}
+	u.Permissions = map[string][]string{
+		"/sub": allPerms,
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		// the files quota is inherited from the group
+		err = sftpUploadFile(testFilePath, testFileName+"1", testFileSize, client)
+		if err == nil {
+			t.Errorf("quota files exceeded, file upload must fail")
+		}
+		// the root permissions are inherited from the group and they do not allow to delete
+		err = client.Remove(testFileName)
+		if err == nil {
+			t.Errorf("remove without permission should not succeed")
+		}
+		// the group permissions for the root directory do not allow to create directories
+		err = client.Mkdir("sub")
+		if err == nil {
+			t.Errorf("mkdir without permission should not succeed")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	_, err = httpd.RemoveGroup(group, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove group: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestQuotaScan(t *testing.T) {
+	usePubKey := false
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	expectedQuotaSize := user.UsedQuotaSize + testFileSize
+	expectedQuotaFiles := user.UsedQuotaFiles + 1
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	// create user with the same home dir, so there is at least an untracked file
+	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+	if err != nil {
+		t.Errorf("error starting quota scan: %v", err)
+	}
+	err = waitQuotaScans()
+	if err != nil {
+		t.Errorf("error waiting for active quota scans: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
+	}
+	if expectedQuotaFiles != user.UsedQuotaFiles {
+		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+	}
+	if expectedQuotaSize != user.UsedQuotaSize {
+		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestMultipleQuotaScans(t *testing.T) {
+	if !sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota failed")
+	}
+	if sftpd.AddQuotaScan(defaultUsername) {
+		t.Errorf("add quota must fail if another scan is already active")
+	}
+	sftpd.RemoveQuotaScan(defaultUsername)
+	activeScans := sftpd.GetQuotaScans()
+	if len(activeScans) > 0 {
+		t.Errorf("no quota scan must be active: %v", len(activeScans))
+	}
+}
+
+func TestQuotaSize(t *testing.T) {
+	usePubKey := false
+	testFileSize := int64(65535)
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 1
+	u.QuotaSize = testFileSize - 1
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
+		if err == nil {
+			t.Errorf("user is over quota file upload must fail")
+		}
+		err = client.Remove(testFileName + ".quota")
+		if err != nil {
+			t.Errorf("error removing uploaded file: %v", err)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
 	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
-	os.Remove(extAuthPath)
+	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaDisabledError(t *testing.T) {
-	dataProvider := dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf := config.GetProviderConf()
-	providerConf.TrackQuota = 0
-	err := dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
+func TestDataTransferQuota(t *testing.T) {
 	usePubKey := false
+	testFileSize := int64(655360)
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 10
+	u.UploadDataTransfer = 1
+	u.DownloadDataTransfer = 1
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -1795,7 +4350,7 @@ func TestQuotaDisabledError(t *testing.T) {
 		defer client.Close()
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
-		testFileSize := int64(65535)
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
@@ -1804,31 +4359,53 @@ func TestQuotaDisabledError(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
+		err = sftpUploadFile(testFilePath, testFileName+".1", testFileSize, client)
+		if err == nil {
+			t.Errorf("upload data transfer quota is exceeded, file upload must fail")
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("download data transfer quota is exceeded, file download must fail")
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedUploadDataTransfer < testFileSize || user.UsedUploadDataTransfer > 1048576 {
+			t.Errorf("unexpected used upload data transfer: %v", user.UsedUploadDataTransfer)
+		}
+		if user.UsedDownloadDataTransfer < testFileSize || user.UsedDownloadDataTransfer > 1048576 {
+			t.Errorf("unexpected used download data transfer: %v", user.UsedDownloadDataTransfer)
+		}
+		// the used data transfer cannot be changed updating the user
+		user.UsedUploadDataTransfer = 0
+		user.UploadDataTransfer = 2
+		user, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		if user.UsedUploadDataTransfer < testFileSize {
+			t.Errorf("the used upload data transfer must be preserved: %v", user.UsedUploadDataTransfer)
+		}
 		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
-		t.Errorf("unable to remove: %v", err)
+		t.Errorf("unable to remove user: %v", err)
 	}
 	os.RemoveAll(user.GetHomeDir())
-
-	dataProvider = dataprovider.GetProvider()
-	dataprovider.Close(dataProvider)
-	config.LoadConfig(configDir, "")
-	providerConf = config.GetProviderConf()
-	err = dataprovider.Initialize(providerConf, configDir)
-	if err != nil {
-		t.Errorf("error initializing data provider")
-	}
-	httpd.SetDataProvider(dataprovider.GetProvider())
-	sftpd.SetDataProvider(dataprovider.GetProvider())
 }
 
-func TestMaxSessions(t *testing.T) {
+func TestMaxUploadFileSize(t *testing.T) {
 	usePubKey := false
+	testFileSize := int64(65536)
 	u := getTestUser(usePubKey)
-	u.Username += "1"
-	u.MaxSessions = 1
+	u.Filters.MaxUploadFileSize = testFileSize + 1
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
@@ -1838,18 +4415,25 @@ func TestMaxSessions(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		_, err := client.Getwd()
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
-			t.Errorf("unable to get working dir: %v", err)
+			t.Errorf("unable to create test file: %v", err)
 		}
-		_, err = client.ReadDir(".")
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
-			t.Errorf("unable to read remote dir: %v", err)
+			t.Errorf("file upload error: %v", err)
 		}
-		_, err = getSftpClient(user, usePubKey)
+		err = createTestFile(testFilePath, testFileSize+2)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName+".1", testFileSize+2, client)
 		if err == nil {
-			t.Errorf("max sessions exceeded, new login should not succeed")
+			t.Errorf("maximum upload file size exceeded, file upload must fail")
 		}
+		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
@@ -1858,161 +4442,234 @@ func TestMaxSessions(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaFileReplace(t *testing.T) {
+func TestBandwidthAndConnections(t *testing.T) {
 	usePubKey := false
+	testFileSize := int64(131072)
 	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1000
+	u.UploadBandwidth = 30
+	u.DownloadBandwidth = 25
+	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
+	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
+	// 100 ms tolerance
+	wantedUploadElapsed -= 100
+	wantedDownloadElapsed -= 100
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-	testFileSize := int64(65535)
-	testFileName := "test_file.dat"
-	testFilePath := filepath.Join(homeBasePath, testFileName)
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		expectedQuotaSize := user.UsedQuotaSize + testFileSize
-		expectedQuotaFiles := user.UsedQuotaFiles + 1
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
+		startTime := time.Now()
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
-		if err != nil {
-			t.Errorf("error getting user: %v", err)
-		}
-		// now replace the same file, the quota must not change
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
+		elapsed := time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedUploadElapsed) {
+			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
 		}
-		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		startTime = time.Now()
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
+		waitForActiveTransfer()
+		// wait some additional arbitrary time to wait for transfer activity to happen
+		// it is need to reach all the code in CheckIdleConnections
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		err = <-c
 		if err != nil {
-			t.Errorf("error getting user: %v", err)
+			t.Errorf("file download error: %v", err)
 		}
-		if expectedQuotaFiles != user.UsedQuotaFiles {
-			t.Errorf("quota files does not match, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+		elapsed = time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < (wantedDownloadElapsed) {
+			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
 		}
-		if expectedQuotaSize != user.UsedQuotaSize {
-			t.Errorf("quota size does not match, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+		// test disconnection
+		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
+		waitForActiveTransfer()
+		time.Sleep(100 * time.Millisecond)
+		sftpd.CheckIdleConnections()
+		stats := sftpd.GetConnectionsStats()
+		for _, stat := range stats {
+			if len(stat.Transfers) > 0 && (stat.UploadBandwidth != u.UploadBandwidth ||
+				stat.DownloadBandwidth != u.DownloadBandwidth) {
+				t.Errorf("unexpected bandwidth limits for connection: %+v", stat)
+			}
+			sftpd.CloseActiveConnection(stat.ConnectionID)
 		}
-	}
-	// now set a quota size restriction and upload the same file, upload should fail for space limit exceeded
-	user.QuotaSize = testFileSize - 1
-	user, _, err = httpd.UpdateUser(user, http.StatusOK)
-	if err != nil {
-		t.Errorf("error updating user: %v", err)
-	}
-	client, err = getSftpClient(user, usePubKey)
-	if err != nil {
-		t.Errorf("unable to create sftp client: %v", err)
-	} else {
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		err = <-c
 		if err == nil {
-			t.Errorf("quota size exceeded, file upload must fail")
-		}
-		err = client.Remove(testFileName)
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+			t.Errorf("connection closed upload must fail")
 		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.Remove(testFilePath)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestQuotaScan(t *testing.T) {
+func TestCloseUserConnections(t *testing.T) {
 	usePubKey := false
-	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	testFileSize := int64(65536)
+	u := getTestUser(usePubKey)
+	u.UploadBandwidth = 32
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
-	testFileSize := int64(65535)
-	expectedQuotaSize := user.UsedQuotaSize + testFileSize
-	expectedQuotaFiles := user.UsedQuotaFiles + 1
+	// the connections closed by the previous tests could still be active
+	waitForNoActiveTransfer()
+	if closed := sftpd.CloseUserConnections(user.Username); closed != 0 {
+		t.Errorf("unexpected closed connections without clients: %v", closed)
+	}
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
+		client1, err := getSftpClient(user, usePubKey)
+		if err != nil {
+			t.Errorf("unable to create sftp client: %v", err)
+		} else {
+			defer client1.Close()
+		}
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
-		if err != nil {
-			t.Errorf("file upload error: %v", err)
+		c := sftpUploadNonBlocking(testFilePath, testFileName, testFileSize, client)
+		waitForActiveTransfer()
+		if closed := sftpd.CloseUserConnections(user.Username); closed != 2 {
+			t.Errorf("unexpected closed connections: %v", closed)
+		}
+		err = <-c
+		if err == nil {
+			t.Errorf("upload must fail if the user connections are closed")
 		}
+		waitForNoActiveTransfer()
 		os.Remove(testFilePath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	// create user with the same home dir, so there is at least an untracked file
-	user, _, err = httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
-	if err != nil {
-		t.Errorf("unable to add user: %v", err)
-	}
-	_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestAuditLog(t *testing.T) {
+	auditLogPath := filepath.Join(homeBasePath, "audit.log")
+	err := audit.Initialize(audit.Config{LogFilePath: auditLogPath}, configDir)
 	if err != nil {
-		t.Errorf("error starting quota scan: %v", err)
+		t.Fatalf("unable to initialize audit log: %v", err)
 	}
-	err = waitQuotaScans()
+	defer os.Remove(auditLogPath)
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Permissions["/"] = []string{dataprovider.PermListItems, dataprovider.PermUpload, dataprovider.PermDelete,
+		dataprovider.PermRename}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
-		t.Errorf("error waiting for active quota scans: %v", err)
+		t.Errorf("unable to add user: %v", err)
 	}
-	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
-		t.Errorf("error getting user: %v", err)
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Errorf("download without permission must fail")
+		}
+		err = client.Rename(testFileName, testFileName+"_renamed")
+		if err != nil {
+			t.Errorf("unable to rename: %v", err)
+		}
+		err = client.Remove(testFileName + "_renamed")
+		if err != nil {
+			t.Errorf("unable to remove: %v", err)
+		}
+		// closing the SFTP client does not close the underlying SSH connection
+		sftpd.CloseUserConnections(user.Username)
+		client.Close()
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
 	}
-	if expectedQuotaFiles != user.UsedQuotaFiles {
-		t.Errorf("quota files does not match after scan, expected: %v, actual: %v", expectedQuotaFiles, user.UsedQuotaFiles)
+	expectedEvents := []string{audit.EventLogin, audit.EventUpload, audit.EventPermissionDenied, audit.EventRename,
+		audit.EventDelete, audit.EventLogout}
+	var events []audit.Event
+	// the logout event is emitted asynchronously once the SSH connection is closed
+	for i := 0; i < 20; i++ {
+		events = readAuditEvents(auditLogPath, user.Username)
+		if len(events) >= len(expectedEvents) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	if expectedQuotaSize != user.UsedQuotaSize {
-		t.Errorf("quota size does not match after scan, expected: %v, actual: %v", expectedQuotaSize, user.UsedQuotaSize)
+	audit.Initialize(audit.Config{}, configDir)
+	if len(events) != len(expectedEvents) {
+		t.Errorf("unexpected audit events: %+v", events)
+	} else {
+		for idx, event := range events {
+			if event.Event != expectedEvents[idx] {
+				t.Errorf("unexpected audit event %#v, expected: %#v", event.Event, expectedEvents[idx])
+			}
+			if event.RemoteIP != "127.0.0.1" {
+				t.Errorf("unexpected remote ip for audit event: %+v", event)
+			}
+		}
+		if events[1].SizeBytes != 65535 || events[1].Protocol != "SFTP" {
+			t.Errorf("unexpected upload audit event: %+v", events[1])
+		}
+		if events[2].Operation != "Get" || events[2].Path != "/test_file.dat" {
+			t.Errorf("unexpected permission denied audit event: %+v", events[2])
+		}
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
-	os.RemoveAll(user.GetHomeDir())
-}
-
-func TestMultipleQuotaScans(t *testing.T) {
-	if !sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota failed")
-	}
-	if sftpd.AddQuotaScan(defaultUsername) {
-		t.Errorf("add quota must fail if another scan is already active")
-	}
-	sftpd.RemoveQuotaScan(defaultUsername)
-	activeScans := sftpd.GetQuotaScans()
-	if len(activeScans) > 0 {
-		t.Errorf("no quota scan must be active: %v", len(activeScans))
-	}
-}
-
-func TestQuotaSize(t *testing.T) {
-	usePubKey := false
-	testFileSize := int64(65535)
-	u := getTestUser(usePubKey)
-	u.QuotaFiles = 1
-	u.QuotaSize = testFileSize - 1
-	user, _, err := httpd.AddUser(u, http.StatusOK)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestServerBandwidthLimits(t *testing.T) {
+	err := bandwidth.Initialize(bandwidth.Config{
+		Limits: []bandwidth.Limit{
+			{Sources: []string{"127.0.0.0/8", "::1"}, Protocols: []string{"SFTP"}, UploadBandwidth: 64},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to initialize bandwidth limits: %v", err)
+	}
+	defer bandwidth.Initialize(bandwidth.Config{})
+	usePubKey := true
+	testFileSize := int64(65536)
+	wantedUploadElapsed := 1000*(testFileSize/1000)/64 - 100
+	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
@@ -2027,17 +4684,14 @@ func TestQuotaSize(t *testing.T) {
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota", testFileSize, client)
+		startTime := time.Now()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpUploadFile(testFilePath, testFileName+".quota.1", testFileSize, client)
-		if err == nil {
-			t.Errorf("user is over quota file upload must fail")
-		}
-		err = client.Remove(testFileName + ".quota")
-		if err != nil {
-			t.Errorf("error removing uploaded file: %v", err)
+		elapsed := time.Since(startTime).Nanoseconds() / 1000000
+		if elapsed < wantedUploadElapsed {
+			t.Errorf("server upload bandwidth limit not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
 		}
 		os.Remove(testFilePath)
 	}
@@ -2048,81 +4702,82 @@ func TestQuotaSize(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestBandwidthAndConnections(t *testing.T) {
-	usePubKey := false
-	testFileSize := int64(131072)
+func TestExtensionsFilters(t *testing.T) {
+	usePubKey := true
 	u := getTestUser(usePubKey)
-	u.UploadBandwidth = 30
-	u.DownloadBandwidth = 25
-	wantedUploadElapsed := 1000 * (testFileSize / 1000) / u.UploadBandwidth
-	wantedDownloadElapsed := 1000 * (testFileSize / 1000) / u.DownloadBandwidth
-	// 100 ms tolerance
-	wantedUploadElapsed -= 100
-	wantedDownloadElapsed -= 100
 	user, _, err := httpd.AddUser(u, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to add user: %v", err)
 	}
+	testFileSize := int64(131072)
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
 	client, err := getSftpClient(user, usePubKey)
 	if err != nil {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileName := "test_file.dat"
-		testFilePath := filepath.Join(homeBasePath, testFileName)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		startTime := time.Now()
 		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		elapsed := time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedUploadElapsed) {
-			t.Errorf("upload bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedUploadElapsed)
-		}
-		startTime = time.Now()
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		c := sftpDownloadNonBlocking(testFileName, localDownloadPath, testFileSize, client)
-		waitForActiveTransfer()
-		// wait some additional arbitrary time to wait for transfer activity to happen
-		// it is need to reach all the code in CheckIdleConnections
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		err = <-c
-		if err != nil {
-			t.Errorf("file download error: %v", err)
+	}
+	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:              "/",
+			AllowedExtensions: []string{".zip"},
+			DeniedExtensions:  []string{},
+		},
+	}
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err == nil {
+			t.Error("file upload must fail")
 		}
-		elapsed = time.Since(startTime).Nanoseconds() / 1000000
-		if elapsed < (wantedDownloadElapsed) {
-			t.Errorf("download bandwidth throttling not respected, elapsed: %v, wanted: %v", elapsed, wantedDownloadElapsed)
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
+		if err == nil {
+			t.Error("file download must fail")
 		}
-		// test disconnection
-		c = sftpUploadNonBlocking(testFilePath, testFileName+"_partial", testFileSize, client)
-		waitForActiveTransfer()
-		time.Sleep(100 * time.Millisecond)
-		sftpd.CheckIdleConnections()
-		stats := sftpd.GetConnectionsStats()
-		for _, stat := range stats {
-			sftpd.CloseActiveConnection(stat.ConnectionID)
+		err = client.Rename(testFileName, testFileName+"1")
+		if err == nil {
+			t.Error("rename must fail")
 		}
-		err = <-c
+		err = client.Remove(testFileName)
 		if err == nil {
-			t.Errorf("connection closed upload must fail")
+			t.Error("remove must fail")
+		}
+		err = client.Mkdir("dir.zip")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		err = client.Rename("dir.zip", "dir1.zip")
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
 		}
-		os.Remove(testFilePath)
-		os.Remove(localDownloadPath)
 	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
+	os.Remove(testFilePath)
+	os.Remove(localDownloadPath)
 	os.RemoveAll(user.GetHomeDir())
 }
 
-func TestExtensionsFilters(t *testing.T) {
+func TestPatternsFilters(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
 	user, _, err := httpd.AddUser(u, http.StatusOK)
@@ -2146,12 +4801,16 @@ func TestExtensionsFilters(t *testing.T) {
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
+		err = sftpUploadFile(testFilePath, testFileName+".zip", testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
 	}
-	user.Filters.FileExtensions = []dataprovider.ExtensionsFilter{
+	user.Filters.FilePatterns = []dataprovider.PatternsFilter{
 		{
-			Path:              "/",
-			AllowedExtensions: []string{".zip"},
-			DeniedExtensions:  []string{},
+			Path:            "/",
+			AllowedPatterns: []string{"*.ZIP"},
+			DeniedPatterns:  []string{},
 		},
 	}
 	_, _, err = httpd.UpdateUser(user, http.StatusOK)
@@ -2171,10 +4830,18 @@ func TestExtensionsFilters(t *testing.T) {
 		if err == nil {
 			t.Error("file download must fail")
 		}
+		err = sftpDownloadFile(testFileName+".zip", localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
 		err = client.Rename(testFileName, testFileName+"1")
 		if err == nil {
 			t.Error("rename must fail")
 		}
+		err = client.Rename(testFileName+".zip", testFileName)
+		if err == nil {
+			t.Error("rename must fail")
+		}
 		err = client.Remove(testFileName)
 		if err == nil {
 			t.Error("remove must fail")
@@ -2216,47 +4883,314 @@ func TestVirtualFolders(t *testing.T) {
 		t.Errorf("unable to create sftp client: %v", err)
 	} else {
 		defer client.Close()
-		testFileSize := int64(131072)
+		testFileSize := int64(131072)
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpDownloadFile(path.Join(vdirPath, testFileName), localDownloadPath, testFileSize, client)
+		if err != nil {
+			t.Errorf("file download error: %v", err)
+		}
+		err = client.Rename(vdirPath, "new_name")
+		if err == nil {
+			t.Error("renaming a virtual folder must fail")
+		}
+		err = client.RemoveDirectory(vdirPath)
+		if err == nil {
+			t.Error("removing a virtual folder must fail")
+		}
+		err = client.Mkdir(vdirPath)
+		if err == nil {
+			t.Error("creating a virtual folder must fail")
+		}
+		err = client.Symlink(path.Join(vdirPath, testFileName), vdirPath)
+		if err == nil {
+			t.Error("symlink to a virtual folder must fail")
+		}
+		os.Remove(testFilePath)
+		os.Remove(localDownloadPath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(mappedPath)
+}
+
+func TestVirtualFoldersExcludedFromQuota(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 100
+	mappedPath := filepath.Join(homeBasePath, "vdirquota")
+	vdirPath := "/vdirquota"
+	u.VirtualFolders = append(u.VirtualFolders, vfs.VirtualFolder{
+		VirtualPath:      vdirPath,
+		MappedPath:       mappedPath,
+		ExcludeFromQuota: true,
+	})
+	os.MkdirAll(mappedPath, 0777)
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		// the quota limits are not reported for a folder excluded from the quota
+		stat, err := client.StatVFS(vdirPath)
+		if err != nil {
+			t.Errorf("unable to get statvfs: %v", err)
+		} else if stat.Files == uint64(user.QuotaFiles) {
+			t.Errorf("unexpected statvfs for a folder excluded from quota: %+v", stat)
+		}
+		stat, err = client.StatVFS("/")
+		if err != nil {
+			t.Errorf("unable to get statvfs: %v", err)
+		} else if stat.Files != uint64(user.QuotaFiles) {
+			t.Errorf("unexpected statvfs: %+v", stat)
+		}
+		testFileSize := int64(131072)
+		testFileName := "test_file.dat"
+		testFilePath := filepath.Join(homeBasePath, testFileName)
+		err = createTestFile(testFilePath, testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName+"1"), testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota usage, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		// moving a file outside the excluded folder adds it to the quota
+		err = client.Rename(path.Join(vdirPath, testFileName+"1"), testFileName+"1")
+		if err != nil {
+			t.Errorf("unable to rename file: %v", err)
+		}
+		err = client.Remove(path.Join(vdirPath, testFileName))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 2 || user.UsedQuotaSize != 2*testFileSize {
+			t.Errorf("unexpected quota usage, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Rename(testFileName, path.Join(vdirPath, testFileName))
+		if err != nil {
+			t.Errorf("unable to rename file: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota usage, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
+		}
+		err = client.Rename("subdir", path.Join(vdirPath, "subdir"))
+		if err == nil {
+			t.Error("renaming a directory between folders with different quota settings must fail")
+		}
+		// the quota scan must ignore the excluded folder
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota usage after scan, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		os.Remove(testFilePath)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+	os.RemoveAll(mappedPath)
+}
+
+func TestSFTPBackend(t *testing.T) {
+	usePubKey := false
+	baseUser, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	u := getTestUser(usePubKey)
+	u.Username = defaultUsername + "_sftpfs"
+	u.HomeDir = filepath.Join(homeBasePath, u.Username)
+	u.QuotaSize = 6553600
+	u.FsConfig.Provider = 4
+	u.FsConfig.SFTPConfig = vfs.SFTPFsConfig{
+		Endpoint:     sftpServerAddr,
+		Username:     baseUser.Username,
+		Password:     defaultPassword,
+		Fingerprints: []string{getHostKeyFingerprint(sftpServerAddr)},
+		Prefix:       "/remote",
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
 		testFileName := "test_file.dat"
 		testFilePath := filepath.Join(homeBasePath, testFileName)
+		testFileSize := int64(65535)
 		err = createTestFile(testFilePath, testFileSize)
 		if err != nil {
 			t.Errorf("unable to create test file: %v", err)
 		}
-		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
-		err = sftpUploadFile(testFilePath, path.Join(vdirPath, testFileName), testFileSize, client)
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
 		if err != nil {
 			t.Errorf("file upload error: %v", err)
 		}
-		err = sftpDownloadFile(path.Join(vdirPath, testFileName), localDownloadPath, testFileSize, client)
+		// the file must be stored inside the prefix of the remote account
+		fi, err := os.Stat(filepath.Join(baseUser.GetHomeDir(), "remote", testFileName))
+		if err != nil {
+			t.Errorf("uploaded file not found on the remote server: %v", err)
+		} else if fi.Size() != testFileSize {
+			t.Errorf("unexpected size for the uploaded file: %v", fi.Size())
+		}
+		localDownloadPath := filepath.Join(homeBasePath, "test_download.dat")
+		err = sftpDownloadFile(testFileName, localDownloadPath, testFileSize, client)
 		if err != nil {
 			t.Errorf("file download error: %v", err)
 		}
-		err = client.Rename(vdirPath, "new_name")
-		if err == nil {
-			t.Error("renaming a virtual folder must fail")
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
 		}
-		err = client.RemoveDirectory(vdirPath)
-		if err == nil {
-			t.Error("removing a virtual folder must fail")
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota usage, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
-		err = client.Mkdir(vdirPath)
-		if err == nil {
-			t.Error("creating a virtual folder must fail")
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("unable to create dir: %v", err)
 		}
-		err = client.Symlink(path.Join(vdirPath, testFileName), vdirPath)
+		err = client.Rename(testFileName, path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to rename file: %v", err)
+		}
+		files, err := client.ReadDir("subdir")
+		if err != nil {
+			t.Errorf("unable to read dir: %v", err)
+		}
+		if len(files) != 1 {
+			t.Errorf("unexpected number of files in dir: %v", len(files))
+		}
+		_, err = client.Stat(path.Join("/subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to stat renamed file: %v", err)
+		}
+		_, err = client.Stat(path.Join("..", "..", testFileName))
 		if err == nil {
-			t.Error("symlink to a virtual folder must fail")
+			t.Error("stat outside the prefix must fail")
+		}
+		_, err = httpd.StartQuotaScan(user, http.StatusCreated)
+		if err != nil {
+			t.Errorf("error starting quota scan: %v", err)
+		}
+		err = waitQuotaScans()
+		if err != nil {
+			t.Errorf("error waiting for active quota scans: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 1 || user.UsedQuotaSize != testFileSize {
+			t.Errorf("unexpected quota usage after scan, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		err = client.Remove(path.Join("subdir", testFileName))
+		if err != nil {
+			t.Errorf("unable to remove file: %v", err)
+		}
+		err = client.RemoveDirectory("subdir")
+		if err != nil {
+			t.Errorf("unable to remove dir: %v", err)
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 0 || user.UsedQuotaSize != 0 {
+			t.Errorf("unexpected quota usage after remove, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
 		}
 		os.Remove(testFilePath)
 		os.Remove(localDownloadPath)
 	}
+	// invalid credentials for the remote server, the login must fail
+	user.FsConfig.SFTPConfig.Password = "invalid password"
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login must fail, the remote server rejects the configured credentials")
+	}
+	// a fingerprint that does not match must be rejected
+	user.FsConfig.SFTPConfig.Password = defaultPassword
+	user.FsConfig.SFTPConfig.Fingerprints = []string{"SHA256:RFzBCUItH9LZS0cKB5UE6ceAYhBD5C8GeOBip8Z11+4"}
+	user, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login must fail, the remote host key does not match the configured fingerprint")
+	}
 	_, err = httpd.RemoveUser(user, http.StatusOK)
 	if err != nil {
 		t.Errorf("unable to remove user: %v", err)
 	}
+	_, err = httpd.RemoveUser(baseUser, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
 	os.RemoveAll(user.GetHomeDir())
-	os.RemoveAll(mappedPath)
+	os.RemoveAll(baseUser.GetHomeDir())
 }
 
 func TestMissingFile(t *testing.T) {
@@ -2642,6 +5576,168 @@ func TestPasswordsHashMD5CryptApr1(t *testing.T) {
 	os.RemoveAll(user.GetHomeDir())
 }
 
+func TestPasswordsHashSHA256Crypt(t *testing.T) {
+	sha256CryptPwd := "$5$saltsalt$gOjOtoMpVhru2uyjeJSEc/JaLQWOXMNmlOnj6T4AtC."
+	clearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = sha256CryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = clearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with sha256 crypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with sha256 crypt password: %v", err)
+		}
+	}
+	user.Password = sha256CryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordsHashDESCrypt(t *testing.T) {
+	desCryptPwd := "Xy2PtsPf0839Y"
+	clearPwd := "password"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = desCryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = clearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with DES crypt password: %v", err)
+	} else {
+		defer client.Close()
+		_, err = client.Getwd()
+		if err != nil {
+			t.Errorf("unable to get working dir with DES crypt password: %v", err)
+		}
+	}
+	dbUser, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !strings.HasPrefix(dbUser.Password, "$argon2id$") {
+		t.Errorf("the DES crypt hash must be upgraded after a successful login: %v", dbUser.Password)
+	}
+	user.Password = desCryptPwd
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Errorf("login with wrong password must fail")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestPasswordHashUpgrade(t *testing.T) {
+	bcryptPwd := "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK"
+	bcryptClearPwd := "secret"
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.Password = bcryptPwd
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	user.Password = bcryptClearPwd
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with bcrypt password: %v", err)
+	} else {
+		client.Close()
+	}
+	dbUser, err := dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !strings.HasPrefix(dbUser.Password, "$argon2id$v=19$m=65536,t=1,p=2$") {
+		t.Errorf("the password hash must be upgraded to argon2id: %v", dbUser.Password)
+	}
+	upgradedPwd := dbUser.Password
+
+	dataProvider := dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf := config.GetProviderConf()
+	providerConf.PasswordHashing.Argon2Options.Memory = 8
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err == nil {
+		t.Error("argon2 memory lower than 8 KiB for each thread must fail")
+	}
+	providerConf.PasswordHashing.Argon2Options.Memory = 32768
+	providerConf.PasswordHashing.Argon2Options.Iterations = 2
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider: %v", err)
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+
+	// a failed login must not change the hash
+	user.Password = "wrong"
+	_, err = getSftpClient(user, usePubKey)
+	if err == nil {
+		t.Error("login with wrong password must fail")
+	}
+	dbUser, err = dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if dbUser.Password != upgradedPwd {
+		t.Errorf("the password hash must not change after a failed login: %v", dbUser.Password)
+	}
+	user.Password = bcryptClearPwd
+	client, err = getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to login with argon2id password: %v", err)
+	} else {
+		client.Close()
+	}
+	dbUser, err = dataprovider.UserExists(dataprovider.GetProvider(), user.Username)
+	if err != nil {
+		t.Errorf("unable to get user: %v", err)
+	}
+	if !strings.HasPrefix(dbUser.Password, "$argon2id$v=19$m=32768,t=2,p=2$") {
+		t.Errorf("the password hash must be upgraded to the configured argon2id parameters: %v", dbUser.Password)
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+
+	dataProvider = dataprovider.GetProvider()
+	dataprovider.Close(dataProvider)
+	config.LoadConfig(configDir, "")
+	providerConf = config.GetProviderConf()
+	err = dataprovider.Initialize(providerConf, configDir)
+	if err != nil {
+		t.Errorf("error initializing data provider")
+	}
+	httpd.SetDataProvider(dataprovider.GetProvider())
+	sftpd.SetDataProvider(dataprovider.GetProvider())
+}
+
 func TestPermList(t *testing.T) {
 	usePubKey := true
 	u := getTestUser(usePubKey)
@@ -3636,38 +6732,98 @@ func TestUserPerms(t *testing.T) {
 	if !user.HasPerm(dataprovider.PermListItems, "/p34/p1/file.dat") {
 		t.Error("expected permission not found")
 	}
-	if !user.HasPerm(dataprovider.PermChtimes, "/p/3/4/5/6") {
-		t.Error("expected permission not found")
+	if !user.HasPerm(dataprovider.PermChtimes, "/p/3/4/5/6") {
+		t.Error("expected permission not found")
+	}
+	if !user.HasPerm(dataprovider.PermDownload, "/p/1/test/file.dat") {
+		t.Error("expected permission not found")
+	}
+}
+
+func TestFilterFileExtensions(t *testing.T) {
+	user := getTestUser(true)
+	extension := dataprovider.ExtensionsFilter{
+		Path:              "/test",
+		AllowedExtensions: []string{".jpg", ".png"},
+		DeniedExtensions:  []string{".pdf"},
+	}
+	filters := dataprovider.UserFilters{
+		FileExtensions: []dataprovider.ExtensionsFilter{extension},
+	}
+	user.Filters = filters
+	if !user.IsFileAllowed("/test/test.jPg") {
+		t.Error("this file must be allowed")
+	}
+	if user.IsFileAllowed("/test/test.pdf") {
+		t.Error("this file must be denied")
+	}
+	if !user.IsFileAllowed("/test.pDf") {
+		t.Error("this file must be allowed")
+	}
+	filters.FileExtensions = append(filters.FileExtensions, dataprovider.ExtensionsFilter{
+		Path:              "/",
+		AllowedExtensions: []string{".zip", ".rar", ".pdf"},
+		DeniedExtensions:  []string{".gz"},
+	})
+	user.Filters = filters
+	if user.IsFileAllowed("/test1/test.gz") {
+		t.Error("this file must be denied")
+	}
+	if !user.IsFileAllowed("/test1/test.zip") {
+		t.Error("this file must be allowed")
+	}
+	if user.IsFileAllowed("/test/sub/test.pdf") {
+		t.Error("this file must be denied")
+	}
+	if user.IsFileAllowed("/test1/test.png") {
+		t.Error("this file must be denied")
+	}
+	filters.FileExtensions = append(filters.FileExtensions, dataprovider.ExtensionsFilter{
+		Path:             "/test/sub",
+		DeniedExtensions: []string{".tar"},
+	})
+	user.Filters = filters
+	if user.IsFileAllowed("/test/sub/sub/test.tar") {
+		t.Error("this file must be denied")
+	}
+	if !user.IsFileAllowed("/test/sub/test.gz") {
+		t.Error("this file must be allowed")
 	}
-	if !user.HasPerm(dataprovider.PermDownload, "/p/1/test/file.dat") {
-		t.Error("expected permission not found")
+	if user.IsFileAllowed("/test/test.zip") {
+		t.Error("this file must be denied")
 	}
 }
 
-func TestFilterFileExtensions(t *testing.T) {
+func TestFilterFilePatterns(t *testing.T) {
 	user := getTestUser(true)
-	extension := dataprovider.ExtensionsFilter{
-		Path:              "/test",
-		AllowedExtensions: []string{".jpg", ".png"},
-		DeniedExtensions:  []string{".pdf"},
+	pattern := dataprovider.PatternsFilter{
+		Path:            "/test",
+		AllowedPatterns: []string{"*.jpg", "a*b?.png"},
+		DeniedPatterns:  []string{"*.pdf"},
 	}
 	filters := dataprovider.UserFilters{
-		FileExtensions: []dataprovider.ExtensionsFilter{extension},
+		FilePatterns: []dataprovider.PatternsFilter{pattern},
 	}
 	user.Filters = filters
 	if !user.IsFileAllowed("/test/test.jPg") {
 		t.Error("this file must be allowed")
 	}
+	if !user.IsFileAllowed("/test/AXbC.png") {
+		t.Error("this file must be allowed")
+	}
+	if user.IsFileAllowed("/test/acd.png") {
+		t.Error("this file must be denied")
+	}
 	if user.IsFileAllowed("/test/test.pdf") {
 		t.Error("this file must be denied")
 	}
 	if !user.IsFileAllowed("/test.pDf") {
 		t.Error("this file must be allowed")
 	}
-	filters.FileExtensions = append(filters.FileExtensions, dataprovider.ExtensionsFilter{
-		Path:              "/",
-		AllowedExtensions: []string{".zip", ".rar", ".pdf"},
-		DeniedExtensions:  []string{".gz"},
+	filters.FilePatterns = append(filters.FilePatterns, dataprovider.PatternsFilter{
+		Path:            "/",
+		AllowedPatterns: []string{"*.zip", "*.rar", "*.pdf"},
+		DeniedPatterns:  []string{"*.gz"},
 	})
 	user.Filters = filters
 	if user.IsFileAllowed("/test1/test.gz") {
@@ -3682,9 +6838,9 @@ func TestFilterFileExtensions(t *testing.T) {
 	if user.IsFileAllowed("/test1/test.png") {
 		t.Error("this file must be denied")
 	}
-	filters.FileExtensions = append(filters.FileExtensions, dataprovider.ExtensionsFilter{
-		Path:             "/test/sub",
-		DeniedExtensions: []string{".tar"},
+	filters.FilePatterns = append(filters.FilePatterns, dataprovider.PatternsFilter{
+		Path:           "/test/sub",
+		DeniedPatterns: []string{"*.tar"},
 	})
 	user.Filters = filters
 	if user.IsFileAllowed("/test/sub/sub/test.tar") {
@@ -3696,6 +6852,20 @@ func TestFilterFileExtensions(t *testing.T) {
 	if user.IsFileAllowed("/test/test.zip") {
 		t.Error("this file must be denied")
 	}
+	// patterns and extensions filters must be both respected
+	filters.FileExtensions = []dataprovider.ExtensionsFilter{
+		{
+			Path:             "/",
+			DeniedExtensions: []string{".zip"},
+		},
+	}
+	user.Filters = filters
+	if user.IsFileAllowed("/test1/test.zip") {
+		t.Error("this file must be denied")
+	}
+	if !user.IsFileAllowed("/test1/test.rar") {
+		t.Error("this file must be allowed")
+	}
 }
 
 func TestUserEmptySubDirPerms(t *testing.T) {
@@ -3763,6 +6933,173 @@ func TestUserFiltersIPMaskConditions(t *testing.T) {
 	}
 }
 
+func TestSSHCopyCommand(t *testing.T) {
+	usePubKey := false
+	u := getTestUser(usePubKey)
+	u.QuotaFiles = 3
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileName := "test_file.dat"
+	testFilePath := filepath.Join(homeBasePath, testFileName)
+	testFileSize := int64(65535)
+	err = createTestFile(testFilePath, testFileSize)
+	if err != nil {
+		t.Errorf("unable to create test file: %v", err)
+	}
+	client, err := getSftpClient(user, usePubKey)
+	if err != nil {
+		t.Errorf("unable to create sftp client: %v", err)
+	} else {
+		defer client.Close()
+		err = sftpUploadFile(testFilePath, testFileName, testFileSize, client)
+		if err != nil {
+			t.Errorf("file upload error: %v", err)
+		}
+		err = client.Mkdir("subdir")
+		if err != nil {
+			t.Errorf("mkdir error: %v", err)
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+".copy"), user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy '%v' /subdir/", testFileName), user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
+		}
+		for _, p := range []string{testFileName + ".copy", path.Join("subdir", testFileName)} {
+			info, err := client.Stat(p)
+			if err != nil {
+				t.Errorf("stat error for %#v: %v", p, err)
+			} else if info.Size() != testFileSize {
+				t.Errorf("unexpected size for %#v: %v", p, info.Size())
+			}
+		}
+		user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+		if err != nil {
+			t.Errorf("error getting user: %v", err)
+		}
+		if user.UsedQuotaFiles != 3 || user.UsedQuotaSize != 3*testFileSize {
+			t.Errorf("unexpected quota, files: %v, size: %v", user.UsedQuotaFiles, user.UsedQuotaSize)
+		}
+		// overwriting an existing file does not need a new file
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+".copy"), user, usePubKey)
+		if err != nil {
+			t.Errorf("unexpected copy error: %v", err)
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v %v", testFileName, testFileName+".copy1"), user, usePubKey)
+		if err == nil {
+			t.Error("copy must fail if the quota is exceeded")
+		}
+		for _, args := range []string{testFileName, testFileName + " " + testFileName, "missing " + testFileName + ".copy1",
+			"subdir " + testFileName + ".copy1"} {
+			_, err = runSSHCommand("sftpgo-copy "+args, user, usePubKey)
+			if err == nil {
+				t.Errorf("copy must fail with args %#v", args)
+			}
+		}
+		user.Permissions["/subdir"] = []string{dataprovider.PermListItems}
+		user.QuotaFiles = 0
+		_, _, err = httpd.UpdateUser(user, http.StatusOK)
+		if err != nil {
+			t.Errorf("unable to update user: %v", err)
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy %v /subdir/%v.copy", testFileName, testFileName), user, usePubKey)
+		if err == nil {
+			t.Error("copy without upload permission must fail")
+		}
+		_, err = runSSHCommand(fmt.Sprintf("sftpgo-copy /subdir/%v %v.copy1", testFileName, testFileName), user, usePubKey)
+		if err == nil {
+			t.Error("copy without download permission must fail")
+		}
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.Remove(testFilePath)
+	os.RemoveAll(user.GetHomeDir())
+}
+
+func TestSSHZipCommand(t *testing.T) {
+	usePubKey := true
+	u := getTestUser(usePubKey)
+	u.Permissions["/dir/denied"] = []string{dataprovider.PermUpload}
+	u.Filters.FilePatterns = []dataprovider.PatternsFilter{
+		{
+			Path:            "/dir",
+			DeniedPatterns:  []string{"*.denied"},
+			AllowedPatterns: []string{},
+		},
+	}
+	user, _, err := httpd.AddUser(u, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to add user: %v", err)
+	}
+	testFileSize := int64(65535)
+	for _, p := range []string{"dir/file1.dat", "dir/sub/file2.dat", "dir/file3.denied", "dir/denied/file4.dat"} {
+		err = createTestFile(filepath.Join(user.GetHomeDir(), filepath.FromSlash(p)), testFileSize)
+		if err != nil {
+			t.Errorf("unable to create test file: %v", err)
+		}
+	}
+	out, err := runSSHCommand("sftpgo-zip /dir", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected zip error: %v", err)
+	} else {
+		r, err := zip.NewReader(bytes.NewReader(out), int64(len(out)))
+		if err != nil {
+			t.Errorf("unable to read the zip archive: %v", err)
+		} else {
+			var names []string
+			for _, f := range r.File {
+				names = append(names, f.Name)
+				if !f.FileInfo().IsDir() && f.UncompressedSize64 != uint64(testFileSize) {
+					t.Errorf("unexpected size for %#v: %v", f.Name, f.UncompressedSize64)
+				}
+			}
+			sort.Strings(names)
+			expected := []string{"denied/", "file1.dat", "sub/", "sub/file2.dat"}
+			if !reflect.DeepEqual(names, expected) {
+				t.Errorf("unexpected zip entries: %v", names)
+			}
+		}
+	}
+	for _, args := range []string{"", "/dir/file1.dat", "/missing", "/dir /dir/sub"} {
+		_, err = runSSHCommand("sftpgo-zip "+args, user, usePubKey)
+		if err == nil {
+			t.Errorf("zip must fail with args %#v", args)
+		}
+	}
+	_, err = runSSHCommand("sftpgo-zip /dir/denied", user, usePubKey)
+	if err == nil {
+		t.Error("zip without list permission must fail")
+	}
+	user.DownloadDataTransfer = 1
+	_, _, err = httpd.UpdateUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to update user: %v", err)
+	}
+	_, err = runSSHCommand("sftpgo-zip /dir", user, usePubKey)
+	if err != nil {
+		t.Errorf("unexpected zip error: %v", err)
+	}
+	user, _, err = httpd.GetUserByID(user.ID, http.StatusOK)
+	if err != nil {
+		t.Errorf("error getting user: %v", err)
+	}
+	if user.UsedDownloadDataTransfer == 0 {
+		t.Error("the zip download must be counted as data transfer")
+	}
+	_, err = httpd.RemoveUser(user, http.StatusOK)
+	if err != nil {
+		t.Errorf("unable to remove user: %v", err)
+	}
+	os.RemoveAll(user.GetHomeDir())
+}
+
 func TestSSHCommands(t *testing.T) {
 	usePubKey := false
 	user, _, err := httpd.AddUser(getTestUser(usePubKey), http.StatusOK)
@@ -3917,6 +7254,14 @@ func TestBasicGitCommands(t *testing.T) {
 	if err != nil {
 		t.Errorf("unable to update user: %v", err)
 	}
+	if runtime.GOOS != "windows" {
+		// the repository hooks, for example uploaded via SFTP, must not be executed
+		hookPath := filepath.Join(user.HomeDir, repoName, "hooks", "pre-receive")
+		err = ioutil.WriteFile(hookPath, []byte("#!/bin/sh\nexit 1\n"), 0755)
+		if err != nil {
+			t.Errorf("unable to write git hook: %v", err)
+		}
+	}
 	out, err = pushToGitRepo(clonePath)
 	if err != nil {
 		t.Errorf("unexpected error: %v out: %v", err, string(out))
@@ -4794,6 +8139,21 @@ func TestSCPErrors(t *testing.T) {
 
 // End SCP tests
 
+func readAuditEvents(auditLogPath, username string) []audit.Event {
+	var events []audit.Event
+	data, err := ioutil.ReadFile(auditLogPath)
+	if err != nil {
+		return events
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var event audit.Event
+		if err := json.Unmarshal([]byte(line), &event); err == nil && event.Username == username {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
 func waitTCPListening(address string) {
 	for {
 		conn, err := net.Dial("tcp", address)
@@ -4862,6 +8222,22 @@ func runSSHCommand(command string, user dataprovider.User, usePubKey bool) ([]by
 	return stdout.Bytes(), err
 }
 
+// getHostKeyFingerprint returns the SHA256 fingerprint of the host key offered by the server at addr
+func getHostKeyFingerprint(addr string) string {
+	var fp string
+	config := &ssh.ClientConfig{
+		User: defaultUsername,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fp = ssh.FingerprintSHA256(key)
+			return errors.New("host key fetched")
+		},
+	}
+	if conn, err := ssh.Dial("tcp", addr, config); err == nil {
+		conn.Close()
+	}
+	return fp
+}
+
 func getSftpClientWithAddr(user dataprovider.User, usePubKey bool, addr string) (*sftp.Client, error) {
 	var sftpClient *sftp.Client
 	config := &ssh.ClientConfig{
@@ -4891,6 +8267,72 @@ func getSftpClientWithAddr(user dataprovider.User, usePubKey bool, addr string)
 	return sftpClient, err
 }
 
+func getSftpClientWithAuthMethods(user dataprovider.User, authMethods []ssh.AuthMethod) (*sftp.Client, error) {
+	var sftpClient *sftp.Client
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: authMethods,
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return sftpClient, err
+	}
+	sftpClient, err = sftp.NewClient(conn)
+	return sftpClient, err
+}
+
+func getUserCert(t *testing.T, principals []string, certType uint32, caSigner ssh.Signer) ssh.Signer {
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		t.Fatalf("unable to parse private key: %v", err)
+	}
+	cert := &ssh.Certificate{
+		Key:             key.PublicKey(),
+		Serial:          1,
+		CertType:        certType,
+		KeyId:           "test cert",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-1 * time.Minute).Unix()),
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	if err = cert.SignCert(rand.Reader, caSigner); err != nil {
+		t.Fatalf("unable to sign certificate: %v", err)
+	}
+	return getCertSigner(t, cert)
+}
+
+func getCertSigner(t *testing.T, cert *ssh.Certificate) ssh.Signer {
+	key, err := ssh.ParsePrivateKey([]byte(testPrivateKey))
+	if err != nil {
+		t.Fatalf("unable to parse private key: %v", err)
+	}
+	signer, err := ssh.NewCertSigner(cert, key)
+	if err != nil {
+		t.Fatalf("unable to create certificate signer: %v", err)
+	}
+	return signer
+}
+
+func getCertSftpClient(user dataprovider.User, signer ssh.Signer) (*sftp.Client, error) {
+	var sftpClient *sftp.Client
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return sftpClient, err
+	}
+	sftpClient, err = sftp.NewClient(conn)
+	return sftpClient, err
+}
+
 func getSftpClient(user dataprovider.User, usePubKey bool) (*sftp.Client, error) {
 	return getSftpClientWithAddr(user, usePubKey, sftpServerAddr)
 }
@@ -4916,6 +8358,30 @@ func getKeyboardInteractiveSftpClient(user dataprovider.User, answers []string)
 	return sftpClient, err
 }
 
+func getTOTPSftpClient(user dataprovider.User, password, code string) (*sftp.Client, error) {
+	var sftpClient *sftp.Client
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				if len(questions) == 1 && strings.HasPrefix(questions[0], "Password") {
+					return []string{password}, nil
+				}
+				return []string{code}, nil
+			}),
+		},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return sftpClient, err
+	}
+	sftpClient, err = sftp.NewClient(conn)
+	return sftpClient, err
+}
+
 func createTestFile(path string, size int64) error {
 	baseDir := filepath.Dir(path)
 	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
@@ -5317,3 +8783,113 @@ func printLatestLogs(maxNumberOfLines int) {
 		logger.DebugToConsole(line)
 	}
 }
+
+// getRawSftpSession returns an SFTP session on which the packets can be sent directly,
+// the init packet is already sent
+func getRawSftpSession(user dataprovider.User) (*ssh.Client, io.WriteCloser, io.Reader, error) {
+	config := &ssh.ClientConfig{
+		User: user.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			return nil
+		},
+		Auth: []ssh.AuthMethod{ssh.Password(defaultPassword)},
+	}
+	conn, err := ssh.Dial("tcp", sftpServerAddr, config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	session, err := conn.NewSession()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	w, err := session.StdinPipe()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	if err = session.RequestSubsystem("sftp"); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	// SSH_FXP_INIT, version 3
+	if _, err = w.Write([]byte{0, 0, 0, 5, 1, 0, 0, 0, 3}); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, w, r, nil
+}
+
+func sendCheckFileRequest(w io.Writer, r io.Reader, name, algos string, offset, length uint64, blockSize uint32) ([]byte, error) {
+	packet := marshalRawSFTPString(nil, "check-file-name")
+	packet = marshalRawSFTPString(packet, name)
+	packet = marshalRawSFTPString(packet, algos)
+	data := make([]byte, 20)
+	binary.BigEndian.PutUint64(data, offset)
+	binary.BigEndian.PutUint64(data[8:], length)
+	binary.BigEndian.PutUint32(data[16:], blockSize)
+	// SSH_FXP_EXTENDED
+	return sendRawSFTPRequest(w, r, 200, append(packet, data...))
+}
+
+func sendCopyDataRequest(w io.Writer, r io.Reader, readHandle string, readOffset, readLength uint64, writeHandle string,
+	writeOffset uint64) ([]byte, error) {
+	packet := marshalRawSFTPString(nil, "copy-data")
+	packet = marshalRawSFTPString(packet, readHandle)
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint64(data, readOffset)
+	binary.BigEndian.PutUint64(data[8:], readLength)
+	packet = marshalRawSFTPString(append(packet, data...), writeHandle)
+	data = make([]byte, 8)
+	binary.BigEndian.PutUint64(data, writeOffset)
+	// SSH_FXP_EXTENDED
+	return sendRawSFTPRequest(w, r, 200, append(packet, data...))
+}
+
+// sendRawSFTPOpen opens the given path with the given SFTP flags and returns the handle
+func sendRawSFTPOpen(w io.Writer, r io.Reader, name string, pflags uint32) (string, error) {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint32(data, pflags)
+	// SSH_FXP_OPEN
+	response, err := sendRawSFTPRequest(w, r, 3, append(marshalRawSFTPString(nil, name), data...))
+	if err != nil {
+		return "", err
+	}
+	// SSH_FXP_HANDLE
+	if len(response) < 9 || response[0] != 102 {
+		return "", fmt.Errorf("unexpected open response: %v", response)
+	}
+	return string(response[9:]), nil
+}
+
+// sendRawSFTPRequest sends a request with id 1 and returns the response without the length
+func sendRawSFTPRequest(w io.Writer, r io.Reader, packetType byte, data []byte) ([]byte, error) {
+	packet := append([]byte{0, 0, 0, 0, packetType, 0, 0, 0, 1}, data...)
+	binary.BigEndian.PutUint32(packet, uint32(len(packet)-4))
+	if _, err := w.Write(packet); err != nil {
+		return nil, err
+	}
+	return readRawSFTPPacket(r)
+}
+
+// readRawSFTPPacket returns the next SFTP packet without the length
+func readRawSFTPPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, binary.BigEndian.Uint32(header))
+	_, err := io.ReadFull(r, packet)
+	return packet, err
+}
+
+func marshalRawSFTPString(b []byte, s string) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(s)))
+	return append(append(b, length...), s...)
+}
@@ -0,0 +1,98 @@
+package sftpd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+var (
+	// ErrServerClosed is returned by Initialize after a call to Shutdown
+	ErrServerClosed = errors.New("sftpd: server closed")
+	// errServerShuttingDown is returned to the clients that try to start a new transfer while draining
+	errServerShuttingDown = errors.New("the server is shutting down, new transfers are not allowed")
+	shutdownMutex         sync.Mutex
+	listeners             []net.Listener
+	shuttingDown          bool
+	// interval to check for the active transfers while draining the connections
+	drainCheckInterval = 100 * time.Millisecond
+)
+
+// Shutdown gracefully stops the SFTP server: the listeners are closed, so no new connections
+// are accepted, the active connections cannot start new transfers and the active transfers can
+// finish until the given context is done. The connections still open after the transfers are
+// completed, or when the context is done, are closed.
+// It returns the context error if the transfers are not completed before the context is done
+func Shutdown(ctx context.Context) error {
+	shutdownMutex.Lock()
+	shuttingDown = true
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			logger.Warn(logSender, "", "unable to close listener %v: %v", l.Addr().String(), err)
+		}
+	}
+	listeners = nil
+	shutdownMutex.Unlock()
+
+	numConnections, numTransfers := getActiveSessionsCount()
+	logger.Info(logSender, "", "shutdown requested, active connections: %v, active transfers: %v", numConnections, numTransfers)
+	err := waitForTransfers(ctx)
+	if err != nil {
+		_, numTransfers = getActiveSessionsCount()
+		logger.Warn(logSender, "", "shutdown grace time expired, %v active transfers will be aborted", numTransfers)
+	}
+	closeActiveConnections()
+	return err
+}
+
+// addListener registers a listener to close on shutdown
+func addListener(l net.Listener) error {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	if shuttingDown {
+		return ErrServerClosed
+	}
+	listeners = append(listeners, l)
+	return nil
+}
+
+func isShuttingDown() bool {
+	shutdownMutex.Lock()
+	defer shutdownMutex.Unlock()
+	return shuttingDown
+}
+
+func waitForTransfers(ctx context.Context) error {
+	ticker := time.NewTicker(drainCheckInterval)
+	defer ticker.Stop()
+	for {
+		if _, numTransfers := getActiveSessionsCount(); numTransfers == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// getActiveSessionsCount returns the number of SFTP/SCP/SSH connections and transfers
+func getActiveSessionsCount() (int, int) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return len(openConnections), len(activeTransfers)
+}
+
+func closeActiveConnections() {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	for _, c := range openConnections {
+		err := c.close()
+		c.Log(logger.LevelDebug, logSender, "connection closed on shutdown, close err: %v", err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -39,8 +40,25 @@ type sshCommand struct {
 type systemCommand struct {
 	cmd      *exec.Cmd
 	realPath string
+	// SFTP paths affected by the command, if empty the last argument is used
+	sshPaths []string
+	// true if the command does not modify the filesystem, for example rsync in sender mode
+	readOnly bool
 }
 
+// permissions required for the system commands that can modify the filesystem
+var systemCommandPerms = []string{dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermCreateDirs,
+	dataprovider.PermListItems, dataprovider.PermOverwrite, dataprovider.PermDelete, dataprovider.PermRename}
+
+// rsync long options not allowed: they reference paths outside the transferred ones or
+// change the server behavior
+var rsyncDeniedOptions = []string{"--daemon", "--config", "--rsync-path", "--log-file", "--temp-dir", "--partial-dir",
+	"--backup-dir", "--compare-dest", "--copy-dest", "--link-dest", "--files-from", "--exclude-from", "--include-from",
+	"--write-batch", "--only-write-batch", "--read-batch", "--password-file", "--filter"}
+
+// rsync short options not allowed, -T is the same as --temp-dir
+const rsyncDeniedShortOptions = "T"
+
 func processSSHCommand(payload []byte, connection *Connection, channel ssh.Channel, enabledSSHCommands []string) bool {
 	var msg sshSubsystemExecMsg
 	if err := ssh.Unmarshal(payload, &msg); err == nil {
@@ -83,6 +101,9 @@ func (c *sshCommand) handle() error {
 	addConnection(c.connection)
 	defer removeConnection(c.connection)
 	updateConnectionActivity(c.connection.ID)
+	if isShuttingDown() {
+		return c.sendErrorResponse(errServerShuttingDown)
+	}
 	if utils.IsStringInSlice(c.command, sshHashCommands) {
 		return c.handleHashCommands()
 	} else if utils.IsStringInSlice(c.command, systemCommands) {
@@ -91,6 +112,10 @@ func (c *sshCommand) handle() error {
 			return c.sendErrorResponse(err)
 		}
 		return c.executeSystemCommand(command)
+	} else if c.command == "sftpgo-copy" {
+		return c.handleCopy()
+	} else if c.command == "sftpgo-zip" {
+		return c.handleZip()
 	} else if c.command == "cd" {
 		c.sendExitStatus(nil)
 	} else if c.command == "pwd" {
@@ -105,18 +130,7 @@ func (c *sshCommand) handleHashCommands() error {
 	if !vfs.IsLocalOsFs(c.connection.fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
 	}
-	var h hash.Hash
-	if c.command == "md5sum" {
-		h = md5.New()
-	} else if c.command == "sha1sum" {
-		h = sha1.New()
-	} else if c.command == "sha256sum" {
-		h = sha256.New()
-	} else if c.command == "sha384sum" {
-		h = sha512.New384()
-	} else {
-		h = sha512.New()
-	}
+	h := getHasher(strings.TrimSuffix(c.command, "sum"))
 	var response string
 	if len(c.args) == 0 {
 		// without args we need to read the string to hash from stdin
@@ -151,17 +165,65 @@ func (c *sshCommand) handleHashCommands() error {
 	return nil
 }
 
+// handleCopy copies a file server side, if the destination is a directory
+// the file is copied inside it
+func (c *sshCommand) handleCopy() error {
+	if len(c.args) != 2 {
+		return c.sendErrorResponse(errors.New("usage: sftpgo-copy <source> <destination>"))
+	}
+	sourcePath := path.Clean(cleanCommandPath(c.args[0]))
+	targetPath := path.Clean(c.getDestPath())
+	if p, err := c.connection.fs.ResolvePath(targetPath); err == nil {
+		if fi, err := c.connection.fs.Stat(p); err == nil && fi.IsDir() {
+			targetPath = path.Join(targetPath, path.Base(sourcePath))
+		}
+	}
+	written, err := c.connection.copyFile(sourcePath, targetPath)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
+	c.connection.Log(logger.LevelDebug, logSenderSSH, "file %#v copied to %#v, size: %v", sourcePath, targetPath, written)
+	c.sendExitStatus(nil)
+	return nil
+}
+
 func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 	if !vfs.IsLocalOsFs(c.connection.fs) {
 		return c.sendErrorResponse(errUnsupportedConfig)
 	}
-	if c.connection.User.QuotaFiles > 0 && c.connection.User.UsedQuotaFiles > c.connection.User.QuotaFiles {
-		return c.sendErrorResponse(errQuotaExceeded)
+	if !command.readOnly {
+		// the quota is updated scanning the home dir after the command, a session root
+		// is only a subtree of the real home dir
+		if c.connection.User.HasSessionRoot() {
+			return c.sendErrorResponse(errUnsupportedConfig)
+		}
+		if c.connection.User.QuotaFiles > 0 && c.connection.User.UsedQuotaFiles > c.connection.User.QuotaFiles {
+			return c.sendErrorResponse(errQuotaExceeded)
+		}
+		if c.connection.User.QuotaSize > 0 && c.connection.User.UsedQuotaSize >= c.connection.User.QuotaSize {
+			return c.sendErrorResponse(errQuotaExceeded)
+		}
+	}
+	// system commands read and write files directly so the data transfer cannot be tracked
+	if c.connection.User.HasDataTransferRestrictions() {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	// and the size of the written files cannot be limited
+	if !command.readOnly && c.connection.User.Filters.MaxUploadFileSize > 0 {
+		return c.sendErrorResponse(errUnsupportedConfig)
+	}
+	perms := systemCommandPerms
+	if command.readOnly {
+		perms = []string{dataprovider.PermDownload, dataprovider.PermListItems}
 	}
-	perms := []string{dataprovider.PermDownload, dataprovider.PermUpload, dataprovider.PermCreateDirs, dataprovider.PermListItems,
-		dataprovider.PermOverwrite, dataprovider.PermDelete, dataprovider.PermRename}
-	if !c.connection.User.HasPerms(perms, c.getDestPath()) {
-		return c.sendErrorResponse(errPermissionDenied)
+	sshPaths := command.sshPaths
+	if len(sshPaths) == 0 {
+		sshPaths = []string{c.getDestPath()}
+	}
+	for _, p := range sshPaths {
+		if !c.connection.User.HasPerms(perms, p) {
+			return c.sendErrorResponse(errPermissionDenied)
+		}
 	}
 
 	stdin, err := command.cmd.StdinPipe()
@@ -193,7 +255,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 	go func() {
 		defer stdin.Close()
 		remainingQuotaSize := int64(0)
-		if c.connection.User.QuotaSize > 0 {
+		if c.connection.User.QuotaSize > 0 && !command.readOnly {
 			remainingQuotaSize = c.connection.User.QuotaSize - c.connection.User.UsedQuotaSize
 		}
 		transfer := Transfer{
@@ -204,6 +266,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 			bytesReceived:  0,
 			user:           c.connection.User,
 			connectionID:   c.connection.ID,
+			remoteIP:       c.connection.getRemoteIP(),
 			transferType:   transferUpload,
 			lastActivity:   time.Now(),
 			isNewFile:      false,
@@ -232,6 +295,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 			bytesReceived:  0,
 			user:           c.connection.User,
 			connectionID:   c.connection.ID,
+			remoteIP:       c.connection.getRemoteIP(),
 			transferType:   transferDownload,
 			lastActivity:   time.Now(),
 			isNewFile:      false,
@@ -261,6 +325,7 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 			bytesReceived:  0,
 			user:           c.connection.User,
 			connectionID:   c.connection.ID,
+			remoteIP:       c.connection.getRemoteIP(),
 			transferType:   transferDownload,
 			lastActivity:   time.Now(),
 			isNewFile:      false,
@@ -284,7 +349,9 @@ func (c *sshCommand) executeSystemCommand(command systemCommand) error {
 	<-commandResponse
 	err = command.cmd.Wait()
 	c.sendExitStatus(err)
-	c.rescanHomeDir()
+	if !command.readOnly {
+		c.rescanHomeDir()
+	}
 	return err
 }
 
@@ -320,6 +387,14 @@ func (c *sshCommand) checkGitAllowed() error {
 			}
 		}
 	}
+	for _, f := range c.connection.User.Filters.FilePatterns {
+		if f.Path == gitPath || f.Path == "/" || strings.HasPrefix(gitPath, f.Path+"/") {
+			c.connection.Log(logger.LevelDebug, logSenderSSH,
+				"git is not supported inside folder with files patterns filters %#v user %#v", gitPath,
+				c.connection.User.Username)
+			return errUnsupportedConfig
+		}
+	}
 	return nil
 }
 
@@ -331,7 +406,18 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 	args := make([]string, len(c.args))
 	copy(args, c.args)
 	var path string
-	if len(c.args) > 0 {
+	if c.command == "rsync" {
+		var err error
+		args, err = c.getRsyncArgs(&command)
+		if err != nil {
+			return command, err
+		}
+		path = command.realPath
+	} else if len(c.args) > 0 {
+		if strings.HasPrefix(c.command, "git-") && (len(c.args) != 1 || strings.HasPrefix(c.args[0], "-")) {
+			c.connection.Log(logger.LevelDebug, logSenderSSH, "unexpected arguments for %#v: %v", c.command, c.args)
+			return command, errUnsupportedConfig
+		}
 		var err error
 		sshPath := c.getDestPath()
 		path, err = c.connection.fs.ResolvePath(sshPath)
@@ -346,10 +432,11 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 		if err := c.checkGitAllowed(); err != nil {
 			return command, err
 		}
+		command.readOnly = c.command != "git-receive-pack"
 	}
 	if c.command == "rsync" {
-		// if the user has virtual folders or file extensions filters we don't allow rsync since the rsync command
-		// interacts with the filesystem directly and it is not aware about virtual folders/extensions files filters
+		// if the user has virtual folders or file extensions/patterns filters we don't allow rsync since the rsync
+		// command interacts with the filesystem directly and it is not aware about virtual folders/files filters
 		if len(c.connection.User.VirtualFolders) > 0 {
 			c.connection.Log(logger.LevelDebug, logSenderSSH, "user %#v has virtual folders, rsync is not supported",
 				c.connection.User.Username)
@@ -360,6 +447,11 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 				c.connection.User.Username)
 			return command, errUnsupportedConfig
 		}
+		if len(c.connection.User.Filters.FilePatterns) > 0 {
+			c.connection.Log(logger.LevelDebug, logSenderSSH, "user %#v has file patterns filter, rsync is not supported",
+				c.connection.User.Username)
+			return command, errUnsupportedConfig
+		}
 		// we cannot avoid that rsync creates symlinks so if the user has the permission
 		// to create symlinks we add the option --safe-links to the received rsync command if
 		// it is not already set. This should prevent to create symlinks that point outside
@@ -377,7 +469,14 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 		}
 	}
 	c.connection.Log(logger.LevelDebug, logSenderSSH, "new system command %#v, with args: %v path: %v", c.command, args, path)
-	cmd := exec.Command(c.command, args...)
+	name := c.command
+	if strings.HasPrefix(c.command, "git-") {
+		// the repository hooks could be uploaded using the other protocols and executed
+		// by a push, so they are disabled
+		args = append([]string{"-c", "core.hooksPath=" + os.DevNull, strings.TrimPrefix(c.command, "git-")}, args...)
+		name = "git"
+	}
+	cmd := exec.Command(name, args...)
 	uid := c.connection.User.GetUID()
 	gid := c.connection.User.GetGID()
 	cmd = wrapCmd(cmd, uid, gid)
@@ -386,6 +485,72 @@ func (c *sshCommand) getSystemCommand() (systemCommand, error) {
 	return command, nil
 }
 
+// getRsyncArgs validates the arguments for the rsync server and resolves the requested paths.
+// Only the server mode is allowed, the first non option argument must be "." and the following ones are the
+// paths to transfer, in receiver mode a single destination path is allowed
+func (c *sshCommand) getRsyncArgs(command *systemCommand) ([]string, error) {
+	if len(c.args) == 0 || c.args[0] != "--server" {
+		c.connection.Log(logger.LevelDebug, logSenderSSH, "rsync server mode is required, args: %v", c.args)
+		return nil, errUnsupportedConfig
+	}
+	args := make([]string, 0, len(c.args))
+	isSender := false
+	removeSource := false
+	numPositional := 0
+	for _, arg := range c.args {
+		if strings.HasPrefix(arg, "-") && numPositional == 0 {
+			if !isRsyncOptionAllowed(arg) {
+				c.connection.Log(logger.LevelDebug, logSenderSSH, "rsync option %#v is not allowed", arg)
+				return nil, errUnsupportedConfig
+			}
+			if arg == "--sender" {
+				isSender = true
+			}
+			if arg == "--remove-source-files" || arg == "--remove-sent-files" {
+				removeSource = true
+			}
+			args = append(args, arg)
+			continue
+		}
+		numPositional++
+		if numPositional == 1 {
+			if arg != "." {
+				c.connection.Log(logger.LevelDebug, logSenderSSH, "unexpected rsync argument %#v", arg)
+				return nil, errUnsupportedConfig
+			}
+			args = append(args, arg)
+			continue
+		}
+		sshPath := cleanCommandPath(arg)
+		p, err := c.connection.fs.ResolvePath(sshPath)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, p)
+		command.sshPaths = append(command.sshPaths, sshPath)
+		command.realPath = p
+	}
+	if len(command.sshPaths) == 0 || (!isSender && len(command.sshPaths) > 1) {
+		c.connection.Log(logger.LevelDebug, logSenderSSH, "invalid rsync paths: %v", command.sshPaths)
+		return nil, errUnsupportedConfig
+	}
+	command.readOnly = isSender && !removeSource
+	return args, nil
+}
+
+func isRsyncOptionAllowed(arg string) bool {
+	if arg == "--" {
+		return false
+	}
+	if strings.HasPrefix(arg, "--") {
+		name := strings.SplitN(arg, "=", 2)[0]
+		return !utils.IsStringInSlice(name, rsyncDeniedOptions)
+	}
+	// short options cluster, for example -vlogDtprze.iLsfxC, the chars after "e" are the protocol capabilities
+	flags := strings.SplitN(arg[1:], "e", 2)[0]
+	return !strings.ContainsAny(flags, rsyncDeniedShortOptions)
+}
+
 func (c *sshCommand) rescanHomeDir() error {
 	quotaTracking := dataprovider.GetQuotaTracking()
 	if (!c.connection.User.HasQuotaRestrictions() && quotaTracking == 2) || quotaTracking == 0 {
@@ -413,10 +578,16 @@ func (c *sshCommand) getDestPath() string {
 	if len(c.args) == 0 {
 		return ""
 	}
-	destPath := strings.Trim(c.args[len(c.args)-1], "'")
-	destPath = strings.Trim(destPath, "\"")
-	result := utils.CleanSFTPPath(destPath)
-	if strings.HasSuffix(destPath, "/") && !strings.HasSuffix(result, "/") {
+	return cleanCommandPath(c.args[len(c.args)-1])
+}
+
+// cleanCommandPath removes the quotes from a path argument and returns the cleaned path,
+// the trailing slash is preserved
+func cleanCommandPath(arg string) string {
+	p := strings.Trim(arg, "'")
+	p = strings.Trim(p, "\"")
+	result := utils.CleanSFTPPath(p)
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(result, "/") {
 		result += "/"
 	}
 	return result
@@ -458,6 +629,24 @@ func (c *sshCommand) sendExitStatus(err error) {
 	}
 }
 
+// getHasher returns the hash implementation for the given algorithm, md5, sha1, sha256,
+// sha384 and sha512 are supported. It returns nil for unsupported algorithms
+func getHasher(algo string) hash.Hash {
+	switch algo {
+	case "md5":
+		return md5.New()
+	case "sha1":
+		return sha1.New()
+	case "sha256":
+		return sha256.New()
+	case "sha384":
+		return sha512.New384()
+	case "sha512":
+		return sha512.New()
+	}
+	return nil
+}
+
 func computeHashForFile(hasher hash.Hash, path string) (string, error) {
 	hash := ""
 	f, err := os.Open(path)
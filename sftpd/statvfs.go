@@ -0,0 +1,97 @@
+package sftpd
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/sftp"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// block size used to report the quota limits
+const statVFSBlockSize = 4096
+
+func (c *extensionsChannel) handleStatVFS(id uint32, sftpPath string) {
+	updateConnectionActivity(c.connection.ID)
+	stat, err := c.connection.getStatVFS(sftpPath)
+	if err == nil {
+		stat.ID = id
+		var data []byte
+		data, err = stat.MarshalBinary()
+		if err == nil {
+			response := make([]byte, 4, 4+len(data))
+			binary.BigEndian.PutUint32(response, uint32(len(data)))
+			c.writeResponse(append(response, data...))
+			return
+		}
+	}
+	c.writeResponse(getSFTPStatusPacket(id, c.connection.getExtensionErrorCode(err), err.Error()))
+}
+
+// getStatVFS returns the filesystem statistics for the given SFTP path.
+// If the user has quota restrictions the quota limits and the remaining quota are reported
+// instead of the real filesystem values
+func (c Connection) getStatVFS(sftpPath string) (*sftp.StatVFS, error) {
+	if !c.User.HasPerm(dataprovider.PermListItems, sftpPath) {
+		return nil, sftp.ErrSSHFxPermissionDenied
+	}
+	p, err := c.fs.ResolvePath(sftpPath)
+	if err != nil {
+		return nil, err
+	}
+	var stat *sftp.StatVFS
+	if vfs.IsLocalOsFs(c.fs) {
+		stat, err = getStatFS(p)
+		if err != nil && err != errExtensionUnsupported {
+			c.Log(logger.LevelWarn, logSender, "unable to get statvfs for path %#v: %v", p, err)
+			return nil, err
+		}
+	}
+	if (c.User.QuotaSize > 0 || c.User.QuotaFiles > 0) && !c.User.IsFileExcludedFromQuota(p) {
+		numFiles, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err == nil {
+			if stat == nil {
+				stat = &sftp.StatVFS{
+					Bsize:   statVFSBlockSize,
+					Frsize:  statVFSBlockSize,
+					Namemax: 255,
+				}
+			}
+			c.setQuotaStatVFS(stat, numFiles, size)
+		} else if _, ok := err.(*dataprovider.MethodDisabledError); !ok {
+			c.Log(logger.LevelWarn, logSender, "error getting used quota for %#v: %v", c.User.Username, err)
+			return nil, err
+		}
+	}
+	if stat == nil {
+		return nil, errExtensionUnsupported
+	}
+	c.Log(logger.LevelDebug, logSender, "statvfs for path %#v: %+v", sftpPath, *stat)
+	return stat, nil
+}
+
+// setQuotaStatVFS replaces the filesystem values with the quota ones
+func (c Connection) setQuotaStatVFS(stat *sftp.StatVFS, numFiles int, size int64) {
+	if c.User.QuotaSize > 0 {
+		free := c.User.QuotaSize - size
+		if free < 0 {
+			free = 0
+		}
+		stat.Bsize = statVFSBlockSize
+		stat.Frsize = statVFSBlockSize
+		stat.Blocks = uint64(c.User.QuotaSize / statVFSBlockSize)
+		stat.Bfree = uint64(free / statVFSBlockSize)
+		stat.Bavail = stat.Bfree
+	}
+	if c.User.QuotaFiles > 0 {
+		free := c.User.QuotaFiles - numFiles
+		if free < 0 {
+			free = 0
+		}
+		stat.Files = uint64(c.User.QuotaFiles)
+		stat.Ffree = uint64(free)
+		stat.Favail = stat.Ffree
+	}
+}
@@ -0,0 +1,29 @@
+// +build darwin
+
+package sftpd
+
+import (
+	"syscall"
+
+	"github.com/pkg/sftp"
+)
+
+func getStatFS(path string) (*sftp.StatVFS, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return nil, err
+	}
+	return &sftp.StatVFS{
+		Bsize: uint64(stat.Bsize),
+		// the fragment size is not available, the block size is used
+		Frsize:  uint64(stat.Bsize),
+		Blocks:  stat.Blocks,
+		Bfree:   stat.Bfree,
+		Bavail:  stat.Bavail,
+		Files:   stat.Files,
+		Ffree:   stat.Ffree,
+		Favail:  stat.Ffree,
+		Flag:    uint64(stat.Flags),
+		Namemax: 1024,
+	}, nil
+}
@@ -0,0 +1,11 @@
+// +build !darwin,!linux
+
+package sftpd
+
+import "github.com/pkg/sftp"
+
+// getStatFS is not supported on this platform, the statvfs requests are
+// served only for users with quota restrictions
+func getStatFS(path string) (*sftp.StatVFS, error) {
+	return nil, errExtensionUnsupported
+}
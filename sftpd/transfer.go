@@ -8,9 +8,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
 	"github.com/drakkan/sftpgo/dataprovider"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/vfs"
 	"github.com/eikenb/pipeat"
 )
 
@@ -20,14 +23,17 @@ const (
 )
 
 var (
-	errTransferClosed = errors.New("transfer already closed")
+	errTransferClosed            = errors.New("transfer already closed")
+	errTransferAborted           = errors.New("transfer aborted")
+	errDataTransferQuotaExceeded = errors.New("denying transfer due to data transfer quota limit")
+	errUploadFileSizeExceeded    = errors.New("denying write due to maximum upload file size limit")
 )
 
 // Transfer contains the transfer details for an upload or a download.
 // It implements the io Reader and Writer interface to handle files downloads and uploads
 type Transfer struct {
 	file           *os.File
-	writerAt       *pipeat.PipeWriterAt
+	writerAt       vfs.PipeWriter
 	readerAt       *pipeat.PipeReaderAt
 	cancelFn       func()
 	path           string
@@ -36,6 +42,7 @@ type Transfer struct {
 	bytesReceived  int64
 	user           dataprovider.User
 	connectionID   string
+	remoteIP       string
 	transferType   int
 	lastActivity   time.Time
 	isNewFile      bool
@@ -45,7 +52,12 @@ type Transfer struct {
 	minWriteOffset int64
 	expectedSize   int64
 	initialSize    int64
-	lock           *sync.Mutex
+	// data transfer, as bytes, allowed for this transfer, 0 means no limit
+	maxDataTransfer int64
+	// filesystem and checksum for the uploads, the checksum is nil if disabled
+	fs       vfs.Fs
+	checksum *UploadChecksum
+	lock     *sync.Mutex
 }
 
 // TransferError is called if there is an unexpected error.
@@ -69,6 +81,21 @@ func (t *Transfer) TransferError(err error) {
 // It handles download bandwidth throttling too
 func (t *Transfer) ReadAt(p []byte, off int64) (n int, err error) {
 	t.lastActivity = time.Now()
+	if t.isAborted() {
+		return 0, errTransferAborted
+	}
+	if t.maxDataTransfer > 0 {
+		t.lock.Lock()
+		remaining := t.maxDataTransfer - t.bytesSent
+		t.lock.Unlock()
+		if remaining <= 0 {
+			t.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
 	var readed int
 	var e error
 	if t.readerAt != nil {
@@ -83,7 +110,7 @@ func (t *Transfer) ReadAt(p []byte, off int64) (n int, err error) {
 		t.TransferError(e)
 		return readed, e
 	}
-	t.handleThrottle()
+	t.handleThrottle(readed)
 	return readed, e
 }
 
@@ -91,32 +118,50 @@ func (t *Transfer) ReadAt(p []byte, off int64) (n int, err error) {
 // It handles upload bandwidth throttling too
 func (t *Transfer) WriteAt(p []byte, off int64) (n int, err error) {
 	t.lastActivity = time.Now()
+	if t.isAborted() {
+		return 0, errTransferAborted
+	}
 	if off < t.minWriteOffset {
 		err := fmt.Errorf("Invalid write offset: %v minimum valid value: %v", off, t.minWriteOffset)
 		t.TransferError(err)
 		return 0, err
 	}
+	if t.maxDataTransfer > 0 {
+		t.lock.Lock()
+		exceeded := t.bytesReceived+int64(len(p)) > t.maxDataTransfer
+		t.lock.Unlock()
+		if exceeded {
+			t.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+	}
+	if !t.user.IsUploadSizeAllowed(off + int64(len(p))) {
+		t.TransferError(errUploadFileSizeExceeded)
+		return 0, errUploadFileSizeExceeded
+	}
 	var written int
 	var e error
 	if t.writerAt != nil {
-		written, e = t.writerAt.WriteAt(p, off)
+		// for resumed uploads the pipe starts at the resume offset
+		written, e = t.writerAt.WriteAt(p, off-t.minWriteOffset)
 	} else {
 		written, e = t.file.WriteAt(p, off)
 	}
 	t.lock.Lock()
 	t.bytesReceived += int64(written)
 	t.lock.Unlock()
+	t.checksum.Update(p[:written], off)
 	if e != nil {
 		t.TransferError(e)
 		return written, e
 	}
-	t.handleThrottle()
+	t.handleThrottle(written)
 	return written, e
 }
 
 // Close it is called when the transfer is completed.
 // It closes the underlying file, logs the transfer info, updates the user quota (for uploads)
-// and executes any defined action.
+// and the used data transfer and executes any defined action.
 // If there is an error no action will be executed and, in atomic mode, we try to delete
 // the temporary file
 func (t *Transfer) Close() error {
@@ -131,9 +176,19 @@ func (t *Transfer) Close() error {
 	if t.isNewFile {
 		numFiles = 1
 	}
-	metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.transferError)
-	if t.transferType == transferUpload && t.file != nil && t.file.Name() != t.path {
-		if t.transferError == nil || uploadMode == uploadModeAtomicWithResume {
+	metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.protocol, time.Since(t.start), t.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, t.user, t.bytesReceived, t.bytesSent)
+	var scanErr error
+	if t.transferType == transferUpload && t.file != nil && t.transferError == nil {
+		scanErr = ScanUpload(t.file.Name(), t.path, t.user.Username, t.connectionID, t.bytesReceived)
+		if scanErr != nil {
+			t.transferError = scanErr
+			numFiles--
+			t.bytesReceived = 0
+		}
+	}
+	if t.transferType == transferUpload && t.file != nil && t.file.Name() != t.path && scanErr == nil {
+		if t.transferError == nil || GetUserUploadMode(t.user) == uploadModeAtomicWithResume {
 			err = os.Rename(t.file.Name(), t.path)
 			logger.Debug(logSender, t.connectionID, "atomic upload completed, rename: %#v -> %#v, error: %v",
 				t.file.Name(), t.path, err)
@@ -154,6 +209,9 @@ func (t *Transfer) Close() error {
 			go executeAction(operationDownload, t.user.Username, t.path, "", "", t.bytesSent, (t.file != nil))
 		} else {
 			logger.TransferLog(uploadLogSender, t.path, elapsed, t.bytesReceived, t.user.Username, t.connectionID, t.protocol)
+			if err == nil {
+				t.storeChecksum()
+			}
 			go executeAction(operationUpload, t.user.Username, t.path, "", "", t.bytesReceived+t.minWriteOffset, (t.file != nil))
 		}
 	} else {
@@ -162,11 +220,66 @@ func (t *Transfer) Close() error {
 			err = t.transferError
 		}
 	}
+	if t.transferType == transferDownload {
+		audit.LogTransfer(false, t.user.Username, t.protocol, t.connectionID, t.remoteIP, t.path, t.bytesSent,
+			time.Since(t.start), t.transferError)
+	} else {
+		audit.LogTransfer(true, t.user.Username, t.protocol, t.connectionID, t.remoteIP, t.path, t.bytesReceived,
+			time.Since(t.start), t.transferError)
+	}
 	removeTransfer(t)
 	t.updateQuota(numFiles)
 	return err
 }
 
+// Sync commits the data written so far to stable storage.
+// For the uploads streamed to cloud storage backends, SFTP backends and encrypted filesystems
+// it waits until the written data are consumed by the backend upload and, for multipart uploads,
+// until the parts being uploaded are completed. The data smaller than a part are stored, and the
+// object is visible, only when the file is closed
+func (t *Transfer) Sync() error {
+	t.lock.Lock()
+	if t.isFinished {
+		t.lock.Unlock()
+		return errTransferClosed
+	}
+	if t.file != nil {
+		defer t.lock.Unlock()
+		return t.file.Sync()
+	}
+	writerAt := t.writerAt
+	t.lock.Unlock()
+	if writerAt == nil {
+		return errExtensionUnsupported
+	}
+	// the lock is not held while waiting, the writes in progress must be able to complete
+	if err := vfs.SyncPipeUpload(writerAt); err != nil {
+		if err == vfs.ErrSyncNotSupported {
+			return errExtensionUnsupported
+		}
+		return err
+	}
+	return nil
+}
+
+// isAborted returns true if the connection for this transfer was killed
+func (t *Transfer) isAborted() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.transferError == errTransferAborted
+}
+
+func (t *Transfer) storeChecksum() {
+	if t.fs == nil {
+		return
+	}
+	localPath := ""
+	if t.file != nil {
+		localPath = t.path
+	}
+	t.checksum.Store(t.fs, t.path, localPath, t.connectionID)
+}
+
 func (t *Transfer) closeIO() error {
 	var err error
 	if t.writerAt != nil {
@@ -184,6 +297,9 @@ func (t *Transfer) updateQuota(numFiles int) bool {
 	if t.file == nil && t.transferError != nil {
 		return false
 	}
+	if t.user.IsFileExcludedFromQuota(t.path) {
+		return false
+	}
 	if t.transferType == transferUpload && (numFiles != 0 || t.bytesReceived > 0) {
 		dataprovider.UpdateUserQuota(dataProvider, t.user, numFiles, t.bytesReceived-t.initialSize, false)
 		return true
@@ -191,19 +307,21 @@ func (t *Transfer) updateQuota(numFiles int) bool {
 	return false
 }
 
-func (t *Transfer) handleThrottle() {
+// handleThrottle must be called after transferring size bytes, it applies both the user
+// and the server level bandwidth limits
+func (t *Transfer) handleThrottle(size int) {
 	var wantedBandwidth int64
-	var trasferredBytes int64
 	if t.transferType == transferDownload {
 		wantedBandwidth = t.user.DownloadBandwidth
-		trasferredBytes = t.bytesSent
 	} else {
 		wantedBandwidth = t.user.UploadBandwidth
-		trasferredBytes = t.bytesReceived
 	}
 	if wantedBandwidth > 0 {
+		// the bandwidth limit applies to the whole connection so we consider
+		// all the active transfers of the same type
+		trasferredBytes, start := getConnectionTransfersStats(t)
 		// real and wanted elapsed as milliseconds, bytes as kilobytes
-		realElapsed := time.Since(t.start).Nanoseconds() / 1000000
+		realElapsed := time.Since(start).Nanoseconds() / 1000000
 		// trasferredBytes / 1000 = KB/s, we multiply for 1000 to get milliseconds
 		wantedElapsed := 1000 * (trasferredBytes / 1000) / wantedBandwidth
 		if wantedElapsed > realElapsed {
@@ -211,6 +329,14 @@ func (t *Transfer) handleThrottle() {
 			time.Sleep(toSleep * time.Millisecond)
 		}
 	}
+	bandwidth.Throttle(t.remoteIP, t.protocol, t.transferType == transferUpload, int64(size))
+}
+
+func (t *Transfer) getTransferredBytes() int64 {
+	if t.transferType == transferDownload {
+		return t.bytesSent
+	}
+	return t.bytesReceived
 }
 
 // used for ssh commands.
@@ -255,11 +381,12 @@ func (t *Transfer) copyFromReaderToWriter(dst io.Writer, src io.Reader, maxWrite
 			}
 			break
 		}
-		t.handleThrottle()
+		t.handleThrottle(nr)
 	}
 	t.transferError = err
 	if t.bytesSent > 0 || t.bytesReceived > 0 || err != nil {
-		metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.transferError)
+		metrics.TransferCompleted(t.bytesSent, t.bytesReceived, t.transferType, t.protocol, time.Since(t.start),
+			t.transferError)
 	}
 	return written, err
 }
@@ -0,0 +1,91 @@
+package sftpd
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+// UploadChecksum computes the SHA-256 checksum of an upload while the data is received.
+// The checksum is computed only for sequential writes starting from the beginning of the
+// file, for local files it is computed again reading the file after non sequential writes.
+// All the methods can be called on a nil UploadChecksum, they do nothing in this case
+type UploadChecksum struct {
+	sync.Mutex
+	hasher hash.Hash
+	offset int64
+	valid  bool
+}
+
+// NewUploadChecksum returns the checksum for a new upload or nil if the upload
+// checksums are disabled
+func NewUploadChecksum() *UploadChecksum {
+	if !uploadChecksums {
+		return nil
+	}
+	return &UploadChecksum{
+		hasher: sha256.New(),
+		valid:  true,
+	}
+}
+
+// Update adds the data written at the given offset to the checksum
+func (c *UploadChecksum) Update(p []byte, off int64) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if !c.valid {
+		return
+	}
+	if off != c.offset {
+		c.valid = false
+		return
+	}
+	c.hasher.Write(p)
+	c.offset += int64(len(p))
+}
+
+// Store saves the checksum as metadata for the uploaded file. localPath is the path
+// for the uploads to a local file and it must be empty for the other uploads
+func (c *UploadChecksum) Store(fs vfs.Fs, fsPath, localPath, connectionID string) {
+	if c == nil {
+		return
+	}
+	checksum, err := c.getChecksum(localPath)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "unable to compute the checksum for path %#v: %v", fsPath, err)
+		return
+	}
+	if len(checksum) == 0 {
+		logger.Debug(logSender, connectionID, "checksum not available for path %#v, the upload was not sequential",
+			fsPath)
+		return
+	}
+	err = fs.SetFileChecksum(fsPath, checksum)
+	logger.Debug(logSender, connectionID, "checksum stored for path %#v, sha256: %v, err: %v", fsPath, checksum, err)
+}
+
+func (c *UploadChecksum) getChecksum(localPath string) (string, error) {
+	c.Lock()
+	defer c.Unlock()
+	if len(localPath) > 0 {
+		info, err := os.Stat(localPath)
+		if err != nil {
+			return "", err
+		}
+		// the writes did not cover the whole file, for example an upload resume
+		if !c.valid || info.Size() != c.offset {
+			return computeHashForFile(sha256.New(), localPath)
+		}
+	} else if !c.valid {
+		return "", nil
+	}
+	return fmt.Sprintf("%x", c.hasher.Sum(nil)), nil
+}
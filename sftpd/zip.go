@@ -0,0 +1,202 @@
+package sftpd
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var errZipNotDirectory = errors.New("the requested path is not a directory")
+
+// WriteZip writes to w a zip archive with the contents of the given directory, the directory
+// itself is the archive root. The directories without the list permission, the files without
+// the download permission or denied by the file filters and the symlinks are skipped
+func WriteZip(w io.Writer, user dataprovider.User, fs vfs.Fs, dirPath string) error {
+	zipWriter := zip.NewWriter(w)
+	if err := addZipDir(zipWriter, user, fs, dirPath, ""); err != nil {
+		zipWriter.Close()
+		return err
+	}
+	return zipWriter.Close()
+}
+
+func addZipDir(zipWriter *zip.Writer, user dataprovider.User, fs vfs.Fs, dirPath, entryPrefix string) error {
+	if !user.HasPerm(dataprovider.PermListItems, dirPath) {
+		return nil
+	}
+	p, err := fs.ResolvePath(dirPath)
+	if err != nil {
+		return err
+	}
+	files, err := fs.ReadDir(p)
+	if err != nil {
+		return err
+	}
+	files = user.AddVirtualDirs(files, dirPath)
+	for _, fi := range files {
+		sftpPath := path.Join(dirPath, fi.Name())
+		entryName := path.Join(entryPrefix, fi.Name())
+		if fi.IsDir() {
+			header := &zip.FileHeader{
+				Name:     entryName + "/",
+				Modified: fi.ModTime(),
+			}
+			header.SetMode(os.ModeDir | 0755)
+			if _, err = zipWriter.CreateHeader(header); err != nil {
+				return err
+			}
+			if err = addZipDir(zipWriter, user, fs, sftpPath, entryName); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() || !user.HasPerm(dataprovider.PermDownload, dirPath) || !user.IsFileAllowed(sftpPath) {
+			continue
+		}
+		if err = addZipFile(zipWriter, fs, sftpPath, entryName, fi); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addZipFile(zipWriter *zip.Writer, fs vfs.Fs, sftpPath, entryName string, fi os.FileInfo) error {
+	p, err := fs.ResolvePath(sftpPath)
+	if err != nil {
+		return err
+	}
+	file, r, cancelFn, err := fs.Open(p)
+	if err != nil {
+		return err
+	}
+	var reader io.ReadCloser = r
+	if file != nil {
+		reader = file
+	}
+	defer func() {
+		reader.Close()
+		if cancelFn != nil {
+			cancelFn()
+		}
+	}()
+	header := &zip.FileHeader{
+		Name:     entryName,
+		Method:   zip.Deflate,
+		Modified: fi.ModTime(),
+	}
+	header.SetMode(fi.Mode())
+	entryWriter, err := zipWriter.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entryWriter, reader)
+	return err
+}
+
+// zipTransferWriter writes the zip archive to the SSH channel as a download,
+// so the bandwidth and data transfer limits are applied
+type zipTransferWriter struct {
+	transfer *Transfer
+	writer   io.Writer
+}
+
+func (z *zipTransferWriter) Write(p []byte) (int, error) {
+	t := z.transfer
+	t.lastActivity = time.Now()
+	if t.isAborted() {
+		return 0, errTransferAborted
+	}
+	if t.maxDataTransfer > 0 {
+		t.lock.Lock()
+		exceeded := t.bytesSent+int64(len(p)) > t.maxDataTransfer
+		t.lock.Unlock()
+		if exceeded {
+			t.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+	}
+	n, err := z.writer.Write(p)
+	t.lock.Lock()
+	t.bytesSent += int64(n)
+	t.lock.Unlock()
+	if err != nil {
+		t.TransferError(err)
+		return n, err
+	}
+	t.handleThrottle(n)
+	return n, nil
+}
+
+// handleZip streams a zip archive with the contents of the requested directory
+func (c *sshCommand) handleZip() error {
+	if len(c.args) != 1 {
+		return c.sendErrorResponse(errors.New("usage: sftpgo-zip <directory>"))
+	}
+	sshPath := strings.TrimSuffix(c.getDestPath(), "/")
+	if sshPath == "" {
+		sshPath = "/"
+	}
+	if !c.connection.User.HasPerm(dataprovider.PermListItems, sshPath) {
+		return c.sendErrorResponse(errPermissionDenied)
+	}
+	p, err := c.connection.fs.ResolvePath(sshPath)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
+	fi, err := c.connection.fs.Stat(p)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
+	if !fi.IsDir() {
+		return c.sendErrorResponse(errZipNotDirectory)
+	}
+	maxDataTransfer, err := c.connection.getMaxDataTransfer(false)
+	if err != nil {
+		return c.sendErrorResponse(err)
+	}
+	transfer := &Transfer{
+		path:            p,
+		start:           time.Now(),
+		user:            c.connection.User,
+		connectionID:    c.connection.ID,
+		remoteIP:        c.connection.getRemoteIP(),
+		transferType:    transferDownload,
+		lastActivity:    time.Now(),
+		protocol:        c.connection.protocol,
+		maxDataTransfer: maxDataTransfer,
+		lock:            new(sync.Mutex),
+	}
+	addTransfer(transfer)
+	defer removeTransfer(transfer)
+
+	err = WriteZip(&zipTransferWriter{transfer: transfer, writer: c.connection.channel}, c.connection.User,
+		c.connection.fs, sshPath)
+	if err != nil {
+		transfer.TransferError(err)
+	}
+	elapsed := time.Since(transfer.start)
+	metrics.TransferCompleted(transfer.bytesSent, 0, transferDownload, transfer.protocol, elapsed, transfer.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, transfer.user, 0, transfer.bytesSent)
+	audit.LogTransfer(false, transfer.user.Username, transfer.protocol, transfer.connectionID, transfer.remoteIP, p,
+		transfer.bytesSent, elapsed, transfer.transferError)
+	if err != nil {
+		// part of the archive could be already sent, we only report the failure using the exit status
+		c.sendExitStatus(err)
+		return err
+	}
+	logger.TransferLog(downloadLogSender, p, elapsed.Nanoseconds()/1000000, transfer.bytesSent, transfer.user.Username,
+		transfer.connectionID, transfer.protocol)
+	c.sendExitStatus(nil)
+	return nil
+}
@@ -0,0 +1,82 @@
+// Package telemetry provides a dedicated HTTP listener for the monitoring endpoints:
+// the health check, the Prometheus metrics and, if enabled, the Go profiler.
+// The admin REST API is not exposed on this listener
+package telemetry
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/go-chi/chi"
+	"github.com/go-chi/chi/middleware"
+	"github.com/go-chi/render"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	logSender    = "telemetry"
+	healthzPath  = "/healthz"
+	metricsPath  = "/metrics"
+	profilerPath = "/debug"
+)
+
+// Conf telemetry server configuration
+type Conf struct {
+	// The port used for serving the telemetry endpoints. 0 disables the telemetry server. Default: 0
+	BindPort int `json:"bind_port" mapstructure:"bind_port"`
+	// The address to listen on. A blank value means listen on all available network interfaces. Default: "127.0.0.1"
+	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
+	// Enable the Go profiler, its endpoints are available under "/debug/pprof/". Default: false
+	EnableProfiler bool `json:"enable_profiler" mapstructure:"enable_profiler"`
+}
+
+type healthResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Initialize starts the telemetry server, it blocks until the server stops
+func (c Conf) Initialize() error {
+	logger.Debug(logSender, "", "initializing telemetry server with config %+v", c)
+	httpServer := &http.Server{
+		Addr:           fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort),
+		Handler:        c.getRouter(),
+		ReadTimeout:    60 * time.Second,
+		WriteTimeout:   60 * time.Second,
+		IdleTimeout:    120 * time.Second,
+		MaxHeaderBytes: 1 << 16, // 64KB
+	}
+	return httpServer.ListenAndServe()
+}
+
+func (c Conf) getRouter() http.Handler {
+	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
+	router.Use(middleware.RealIP)
+	router.Use(middleware.Recoverer)
+
+	router.Get(healthzPath, checkHealth)
+	router.Handle(metricsPath, promhttp.Handler())
+	if c.EnableProfiler {
+		logger.Info(logSender, "", "the Go profiler is enabled, endpoints: %v/pprof/", profilerPath)
+		router.Mount(profilerPath, middleware.Profiler())
+	}
+	return router
+}
+
+// checkHealth reports the service as healthy if the data provider is available
+func checkHealth(w http.ResponseWriter, r *http.Request) {
+	resp := healthResponse{
+		Status: "ok",
+	}
+	if err := dataprovider.GetProviderStatus(dataprovider.GetProvider()); err != nil {
+		logger.Warn(logSender, "", "health check failed, data provider error: %v", err)
+		resp.Status = "error"
+		resp.Error = err.Error()
+		render.Status(r, http.StatusServiceUnavailable)
+	}
+	render.JSON(w, r, resp)
+}
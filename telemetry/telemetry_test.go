@@ -0,0 +1,65 @@
+package telemetry
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/drakkan/sftpgo/dataprovider"
+)
+
+func executeRequest(handler http.Handler, method, path string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func TestTelemetryRouter(t *testing.T) {
+	err := dataprovider.Initialize(dataprovider.Config{
+		Driver:          dataprovider.MemoryDataProviderName,
+		CredentialsPath: os.TempDir(),
+	}, os.TempDir())
+	if err != nil {
+		t.Fatalf("unable to initialize the data provider: %v", err)
+	}
+	defer dataprovider.Close(dataprovider.GetProvider())
+
+	router := Conf{}.getRouter()
+	rr := executeRequest(router, http.MethodGet, healthzPath)
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected health check status code: %v", rr.Code)
+	}
+	var resp healthResponse
+	if err = json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Errorf("unable to decode health check response: %v", err)
+	} else if resp.Status != "ok" {
+		t.Errorf("unexpected health check response: %+v", resp)
+	}
+	rr = executeRequest(router, http.MethodGet, metricsPath)
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "go_goroutines") {
+		t.Errorf("unexpected metrics response, status code: %v", rr.Code)
+	}
+	rr = executeRequest(router, http.MethodGet, profilerPath+"/pprof/")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("the profiler must be disabled, status code: %v", rr.Code)
+	}
+	// the admin API is not exposed
+	rr = executeRequest(router, http.MethodGet, "/api/v1/user")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("the admin API must not be available, status code: %v", rr.Code)
+	}
+
+	router = Conf{EnableProfiler: true}.getRouter()
+	rr = executeRequest(router, http.MethodGet, profilerPath+"/pprof/")
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected profiler status code: %v", rr.Code)
+	}
+	rr = executeRequest(router, http.MethodGet, profilerPath+"/pprof/goroutine?debug=1")
+	if rr.Code != http.StatusOK {
+		t.Errorf("unexpected goroutine profile status code: %v", rr.Code)
+	}
+}
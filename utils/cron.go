@@ -0,0 +1,134 @@
+package utils
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type cronField struct {
+	name string
+	min  int
+	max  int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12},
+	{name: "day of week", min: 0, max: 7},
+}
+
+// CronSchedule is a parsed cron expression with the standard five fields:
+// minute, hour, day of month, month and day of week
+type CronSchedule struct {
+	minute     uint64
+	hour       uint64
+	dayOfMonth uint64
+	month      uint64
+	dayOfWeek  uint64
+	// true if the day of month and the day of week are both restricted,
+	// a time matches if either of them matches in this case
+	dayOr bool
+}
+
+// ParseCronSchedule parses a cron expression such as "*/15 * * * *" or "0 3 * * 1-5".
+// Each field supports "*", single values, ranges, comma separated lists and steps.
+// For the day of week both 0 and 7 mean Sunday
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid cron expression %#v: expected %v fields, got %v", spec, len(cronFields),
+			len(fields))
+	}
+	var values [5]uint64
+	for idx, field := range fields {
+		bits, err := parseCronField(field, cronFields[idx])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %#v: %v", spec, err)
+		}
+		values[idx] = bits
+	}
+	schedule := &CronSchedule{
+		minute:     values[0],
+		hour:       values[1],
+		dayOfMonth: values[2],
+		month:      values[3],
+		dayOfWeek:  values[4],
+		dayOr:      fields[2] != "*" && fields[4] != "*",
+	}
+	// Sunday can be defined as 0 or 7
+	if schedule.dayOfWeek&(1<<7) != 0 {
+		schedule.dayOfWeek |= 1
+	}
+	return schedule, nil
+}
+
+func parseCronField(field string, def cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		start, end, step := def.min, def.max, 1
+		rangeSpec := part
+		if idx := strings.Index(part, "/"); idx >= 0 {
+			var err error
+			step, err = strconv.Atoi(part[idx+1:])
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %#v for %v", part, def.name)
+			}
+			rangeSpec = part[:idx]
+		}
+		if rangeSpec != "*" {
+			var err error
+			if idx := strings.Index(rangeSpec, "-"); idx >= 0 {
+				start, err = parseCronValue(rangeSpec[:idx], def)
+				if err != nil {
+					return 0, err
+				}
+				end, err = parseCronValue(rangeSpec[idx+1:], def)
+				if err != nil {
+					return 0, err
+				}
+				if start > end {
+					return 0, fmt.Errorf("invalid range %#v for %v", rangeSpec, def.name)
+				}
+			} else {
+				start, err = parseCronValue(rangeSpec, def)
+				if err != nil {
+					return 0, err
+				}
+				// "5/10" means from 5 to the max value with step 10
+				if step == 1 {
+					end = start
+				}
+			}
+		}
+		for value := start; value <= end; value += step {
+			bits |= 1 << uint(value)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(value string, def cronField) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil || v < def.min || v > def.max {
+		return 0, fmt.Errorf("invalid value %#v for %v, allowed range: %v-%v", value, def.name, def.min, def.max)
+	}
+	return v, nil
+}
+
+// Matches returns true if the given time, truncated to the minute, matches the schedule
+func (s *CronSchedule) Matches(t time.Time) bool {
+	if s.minute&(1<<uint(t.Minute())) == 0 || s.hour&(1<<uint(t.Hour())) == 0 ||
+		s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	domMatch := s.dayOfMonth&(1<<uint(t.Day())) != 0
+	dowMatch := s.dayOfWeek&(1<<uint(t.Weekday())) != 0
+	if s.dayOr {
+		return domMatch || dowMatch
+	}
+	return domMatch && dowMatch
+}
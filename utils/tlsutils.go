@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"crypto/tls"
+	"sync"
+
+	"github.com/drakkan/sftpgo/logger"
+)
+
+// CertManager defines a TLS certificate manager, the certificate can be reloaded on demand
+type CertManager struct {
+	cert      *tls.Certificate
+	certPath  string
+	keyPath   string
+	logSender string
+	lock      *sync.RWMutex
+}
+
+// LoadCertificate loads the configured x509 key pair, the previous certificate is kept on error
+func (m *CertManager) LoadCertificate() error {
+	newCert, err := tls.LoadX509KeyPair(m.certPath, m.keyPath)
+	if err != nil {
+		logger.Warn(m.logSender, "", "unable to load certificate: %v", err)
+		return err
+	}
+	logger.Debug(m.logSender, "", "certificate successfully loaded")
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.cert = &newCert
+	return nil
+}
+
+// GetCertificateFunc returns the loaded certificate
+func (m *CertManager) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		m.lock.RLock()
+		defer m.lock.RUnlock()
+		return m.cert, nil
+	}
+}
+
+// NewCertManager creates a new certificate manager for the given certificate and key files,
+// logSender is used for the log messages
+func NewCertManager(certificateFile, certificateKeyFile, logSender string) (*CertManager, error) {
+	manager := &CertManager{
+		cert:      nil,
+		certPath:  certificateFile,
+		keyPath:   certificateKeyFile,
+		logSender: logSender,
+		lock:      new(sync.RWMutex),
+	}
+	err := manager.LoadCertificate()
+	if err != nil {
+		return nil, err
+	}
+	return manager, nil
+}
@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+	// number of time steps before and after the current one accepted to handle clock drift
+	totpSkew = 1
+)
+
+// GenerateTOTPSecret returns a new random base32 encoded secret suitable for TOTP
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// GetTOTPKeyURI returns the otpauth URI for the given base32 encoded secret, authenticator
+// apps can import it, usually scanning a QR code
+func GetTOTPKeyURI(issuer, accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprintf("%v", totpDigits))
+	v.Set("period", fmt.Sprintf("%v", totpPeriod))
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + accountName,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+// DecodeTOTPSecret decodes a base32 encoded TOTP secret, padding and spaces are optional
+func DecodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(strings.TrimSpace(secret), " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// GetTOTPCode returns the RFC 6238 code for the given base32 encoded secret at the given time.
+// Codes are 6 digits long and they change every 30 seconds, HMAC-SHA1 is used
+func GetTOTPCode(secret string, t time.Time) (string, error) {
+	key, err := DecodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return getTOTPCodeForCounter(key, uint64(t.Unix()/totpPeriod)), nil
+}
+
+// ValidateTOTPCode returns true if the given code is valid for the base32 encoded secret.
+// The codes for the previous and the next time step are accepted too
+func ValidateTOTPCode(secret, code string) bool {
+	_, ok := ValidateTOTPCodeAfterStep(secret, code, 0)
+	return ok
+}
+
+// ValidateTOTPCodeAfterStep is like ValidateTOTPCode but it accepts only the codes for the time
+// steps after lastStep and it returns the matching time step. Storing the returned step and
+// passing it on the next validation prevents the reuse of an accepted code
+func ValidateTOTPCodeAfterStep(secret, code string, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	key, err := DecodeTOTPSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	counter := time.Now().Unix() / totpPeriod
+	for i := int64(-totpSkew); i <= totpSkew; i++ {
+		step := counter + i
+		if step <= lastStep {
+			continue
+		}
+		expected := getTOTPCodeForCounter(key, uint64(step))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// getTOTPCodeForCounter implements the HOTP algorithm as defined in RFC 4226
+func getTOTPCodeForCounter(key []byte, counter uint64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
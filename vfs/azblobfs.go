@@ -0,0 +1,691 @@
+package vfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/eikenb/pipeat"
+)
+
+const azureDefaultEndpoint = "blob.core.windows.net"
+
+// AzBlobFsConfig defines the configuration for Azure Blob Storage based filesystem
+type AzBlobFsConfig struct {
+	Container string `json:"container,omitempty"`
+	// Storage Account Name, leave blank to use SAS URL
+	AccountName string `json:"account_name,omitempty"`
+	// Storage Account Key leave blank to use SAS URL.
+	// The access key is stored encrypted (AES-256-GCM)
+	AccountKey string `json:"account_key,omitempty"`
+	// Optional endpoint. Default is "blob.core.windows.net".
+	// If you use the emulator the endpoint must include the protocol,
+	// for example "http://127.0.0.1:10000"
+	Endpoint string `json:"endpoint,omitempty"`
+	// Shared access signature URL, leave blank if using account/key.
+	// The SAS URL is stored encrypted (AES-256-GCM)
+	SASURL string `json:"sas_url,omitempty"`
+	// KeyPrefix is similar to a chroot directory for local filesystem.
+	// If specified then the SFTPGo user will only see objects that starts
+	// with this prefix and so you can restrict access to a specific
+	// folder. The prefix, if not empty, must not start with "/" and must
+	// end with "/".
+	// If empty the whole container contents will be available
+	KeyPrefix string `json:"key_prefix,omitempty"`
+	// The buffer size (in MB) to use for multipart uploads.
+	// If this value is set to zero, the default value (4MB) will be used.
+	// Please note that if the upload bandwidth between the SFTP client and SFTPGo is greater than
+	// the upload bandwidth between SFTPGo and Azure then the SFTP client have to wait for the upload
+	// of the last parts to Azure after it ends the file upload to SFTPGo, and it may time out.
+	// Keep this in mind if you customize these parameters.
+	UploadPartSize int64 `json:"upload_part_size,omitempty"`
+	// How many parts are uploaded in parallel
+	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// Set to true if you use an Azure emulator such as Azurite
+	UseEmulator bool `json:"use_emulator,omitempty"`
+	// Blob Access Tier
+	AccessTier string `json:"access_tier,omitempty"`
+}
+
+// AzureBlobFs is a Fs implementation for Azure Blob storage.
+type AzureBlobFs struct {
+	connectionID   string
+	localTempDir   string
+	config         AzBlobFsConfig
+	containerURL   azblob.ContainerURL
+	ctxTimeout     time.Duration
+	ctxLongTimeout time.Duration
+}
+
+// NewAzBlobFs returns an AzBlobFs object that allows to interact with Azure Blob storage
+func NewAzBlobFs(connectionID, localTempDir string, config AzBlobFsConfig) (Fs, error) {
+	fs := AzureBlobFs{
+		connectionID:   connectionID,
+		localTempDir:   localTempDir,
+		config:         config,
+		ctxTimeout:     30 * time.Second,
+		ctxLongTimeout: 300 * time.Second,
+	}
+	if err := ValidateAzBlobFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	if len(fs.config.AccountKey) > 0 {
+		accountKey, err := kms.Decrypt(fs.config.AccountKey)
+		if err != nil {
+			return fs, err
+		}
+		fs.config.AccountKey = accountKey
+	}
+	if kms.IsEncrypted(fs.config.SASURL) {
+		sasURL, err := kms.Decrypt(fs.config.SASURL)
+		if err != nil {
+			return fs, err
+		}
+		fs.config.SASURL = sasURL
+	}
+	fs.setConfigDefaults()
+
+	if len(fs.config.SASURL) > 0 {
+		u, err := url.Parse(fs.config.SASURL)
+		if err != nil {
+			return fs, fmt.Errorf("invalid SAS URL: %v", err)
+		}
+		parts := azblob.NewBlobURLParts(*u)
+		if len(parts.ContainerName) > 0 {
+			if len(fs.config.Container) > 0 && fs.config.Container != parts.ContainerName {
+				return fs, fmt.Errorf("Container name in SAS URL %#v and container provided %#v do not match",
+					parts.ContainerName, fs.config.Container)
+			}
+			fs.containerURL = azblob.NewContainerURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+		} else {
+			if len(fs.config.Container) == 0 {
+				return fs, errors.New("container is required with this SAS URL")
+			}
+			serviceURL := azblob.NewServiceURL(*u, azblob.NewPipeline(azblob.NewAnonymousCredential(), azblob.PipelineOptions{}))
+			fs.containerURL = serviceURL.NewContainerURL(fs.config.Container)
+		}
+		return fs, nil
+	}
+
+	credential, err := azblob.NewSharedKeyCredential(fs.config.AccountName, fs.config.AccountKey)
+	if err != nil {
+		return fs, fmt.Errorf("invalid credentials: %v", err)
+	}
+	var u *url.URL
+	if fs.config.UseEmulator {
+		u, err = url.Parse(fmt.Sprintf("%s/%s", fs.config.Endpoint, fs.config.AccountName))
+	} else {
+		u, err = url.Parse(fmt.Sprintf("https://%s.%s", fs.config.AccountName, fs.config.Endpoint))
+	}
+	if err != nil {
+		return fs, fmt.Errorf("invalid credentials: %v", err)
+	}
+	pipeline := azblob.NewPipeline(credential, azblob.PipelineOptions{})
+	serviceURL := azblob.NewServiceURL(*u, pipeline)
+	fs.containerURL = serviceURL.NewContainerURL(fs.config.Container)
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs AzureBlobFs) Name() string {
+	if len(fs.config.SASURL) > 0 {
+		return fmt.Sprintf("Azure Blob SAS URL %#v", fs.config.Container)
+	}
+	return fmt.Sprintf("Azure Blob container %#v", fs.config.Container)
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs AzureBlobFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs AzureBlobFs) Stat(name string) (os.FileInfo, error) {
+	if len(name) == 0 || name == "." {
+		err := fs.checkIfBucketExists()
+		if err != nil {
+			return nil, err
+		}
+		return NewFileInfo(name, true, 0, time.Time{}), nil
+	}
+	if fs.config.KeyPrefix == name+"/" {
+		return NewFileInfo(name, true, 0, time.Time{}), nil
+	}
+	attrs, isDir, err := fs.headObject(name)
+	if err == nil {
+		if isDir {
+			return NewFileInfo(name, true, 0, attrs.LastModified()), nil
+		}
+		return NewFileInfo(name, false, attrs.ContentLength(), attrs.LastModified()), nil
+	}
+	if !fs.IsNotExist(err) {
+		return nil, err
+	}
+	// now check if this is a prefix (virtual directory)
+	hasContents, err := fs.hasContents(name)
+	if err != nil {
+		return nil, err
+	}
+	if hasContents {
+		return NewFileInfo(name, true, 0, time.Time{}), nil
+	}
+	return nil, errors.New("404 no such file or directory")
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs AzureBlobFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.Stat(name)
+}
+
+// Open opens the named file for reading
+func (fs AzureBlobFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	blobDownloadResponse, err := blobBlockURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false)
+	if err != nil {
+		r.Close()
+		w.Close()
+		cancelFn()
+		return nil, nil, nil, err
+	}
+	body := blobDownloadResponse.Body(azblob.RetryReaderOptions{
+		MaxRetryRequests: 3,
+	})
+
+	go func() {
+		defer cancelFn()
+		defer body.Close()
+
+		n, err := io.Copy(w, body)
+		w.CloseWithError(err)
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+		metrics.AZTransferCompleted(n, 1, err)
+	}()
+
+	return nil, r, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs AzureBlobFs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	upload := newPipeUpload(r, w)
+
+	go func() {
+		defer cancelFn()
+
+		_, err := azblob.UploadStreamToBlockBlob(ctx, upload, blobBlockURL, azblob.UploadStreamToBlockBlobOptions{
+			BufferSize: int(fs.config.UploadPartSize),
+			MaxBuffers: fs.config.UploadConcurrency,
+		})
+		if err == nil && len(fs.config.AccessTier) > 0 {
+			_, err = blobBlockURL.SetTier(ctx, azblob.AccessTierType(fs.config.AccessTier), azblob.LeaseAccessConditions{})
+		}
+		upload.finish(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, r.GetReadedBytes(), err)
+		metrics.AZTransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+
+	return nil, w, cancelFn, nil
+}
+
+// Rename renames (moves) source to target.
+// We don't support renaming non empty directories since we should
+// rename all the contents too and this could take long time: think
+// about directories with thousands of files, for each file we should
+// execute a StartCopyFromURL call.
+func (fs AzureBlobFs) Rename(source, target string) error {
+	if source == target {
+		return nil
+	}
+	fi, err := fs.Stat(source)
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		hasContents, err := fs.hasContents(source)
+		if err != nil {
+			return err
+		}
+		if hasContents {
+			return fmt.Errorf("Cannot rename non empty directory: %#v", source)
+		}
+		if !strings.HasSuffix(source, "/") {
+			source += "/"
+		}
+		if !strings.HasSuffix(target, "/") {
+			target += "/"
+		}
+	}
+	dstBlobURL := fs.containerURL.NewBlobURL(target)
+	srcURL := fs.containerURL.NewBlobURL(source).URL()
+
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
+	defer cancelFn()
+
+	resp, err := dstBlobURL.StartCopyFromURL(ctx, srcURL, azblob.Metadata{}, azblob.ModifiedAccessConditions{},
+		azblob.BlobAccessConditions{})
+	if err != nil {
+		metrics.AZCopyObjectCompleted(err)
+		return err
+	}
+	copyStatus := resp.CopyStatus()
+	nErrors := 0
+	for copyStatus == azblob.CopyStatusPending {
+		// Poll until the copy is complete.
+		time.Sleep(500 * time.Millisecond)
+		propertiesResp, err := dstBlobURL.GetProperties(ctx, azblob.BlobAccessConditions{})
+		if err != nil {
+			// A GetProperties failure may be transient, so allow a couple
+			// of them before giving up.
+			nErrors++
+			if ctx.Err() != nil || nErrors == 3 {
+				metrics.AZCopyObjectCompleted(err)
+				return err
+			}
+		} else {
+			copyStatus = propertiesResp.CopyStatus()
+		}
+	}
+	if copyStatus != azblob.CopyStatusSuccess {
+		err := fmt.Errorf("Copy failed with status: %s", copyStatus)
+		metrics.AZCopyObjectCompleted(err)
+		return err
+	}
+	metrics.AZCopyObjectCompleted(nil)
+	return fs.Remove(source, fi.IsDir())
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs AzureBlobFs) Remove(name string, isDir bool) error {
+	if isDir {
+		hasContents, err := fs.hasContents(name)
+		if err != nil {
+			return err
+		}
+		if hasContents {
+			return fmt.Errorf("Cannot remove non empty directory: %#v", name)
+		}
+		if !strings.HasSuffix(name, "/") {
+			name += "/"
+		}
+	}
+	blobBlockURL := fs.containerURL.NewBlockBlobURL(name)
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err := blobBlockURL.Delete(ctx, azblob.DeleteSnapshotsOptionNone, azblob.BlobAccessConditions{})
+	metrics.AZDeleteObjectCompleted(err)
+	return err
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs AzureBlobFs) Mkdir(name string) error {
+	_, err := fs.Stat(name)
+	if !fs.IsNotExist(err) {
+		return err
+	}
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	_, w, _, err := fs.Create(name, 0)
+	if err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// Symlink creates source as a symbolic link to target.
+func (AzureBlobFs) Symlink(source, target string) error {
+	return errors.New("403 symlinks are not supported")
+}
+
+// Link creates target as a hard link to source.
+func (AzureBlobFs) Link(source, target string) error {
+	return errors.New("403 hard links are not supported")
+}
+
+// Readlink returns the destination of the named symbolic link.
+func (AzureBlobFs) Readlink(name string) (string, error) {
+	return "", errors.New("403 symlinks are not supported")
+}
+
+// Chown changes the numeric uid and gid of the named file.
+// Silently ignored.
+func (AzureBlobFs) Chown(name string, uid int, gid int) error {
+	return nil
+}
+
+// Chmod changes the mode of the named file to mode.
+// Silently ignored.
+func (AzureBlobFs) Chmod(name string, mode os.FileMode) error {
+	return nil
+}
+
+// Chtimes changes the access and modification times of the named file.
+// Not supported on Azure Blob storage.
+func (AzureBlobFs) Chtimes(name string, atime, mtime time.Time) error {
+	return errors.New("403 chtimes is not supported")
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs AzureBlobFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	var result []os.FileInfo
+	// dirname must be already cleaned
+	prefix := ""
+	if len(dirname) > 0 && dirname != "." {
+		prefix = strings.TrimPrefix(dirname, "/")
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+
+	prefixes := make(map[string]bool)
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		listBlob, err := fs.containerURL.ListBlobsHierarchySegment(ctx, marker, "/", azblob.ListBlobsSegmentOptions{
+			Prefix: prefix,
+		})
+		cancelFn()
+		if err != nil {
+			metrics.AZListObjectsCompleted(err)
+			return nil, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobPrefix := range listBlob.Segment.BlobPrefixes {
+			// we don't support prefixes == "/" this will be sent if a key starts with "/"
+			if blobPrefix.Name == "/" {
+				continue
+			}
+			name := strings.TrimSuffix(strings.TrimPrefix(blobPrefix.Name, prefix), "/")
+			if _, ok := prefixes[name]; ok {
+				continue
+			}
+			result = append(result, NewFileInfo(name, true, 0, time.Time{}))
+			prefixes[name] = true
+		}
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			name := strings.TrimPrefix(blobInfo.Name, prefix)
+			size := int64(0)
+			if blobInfo.Properties.ContentLength != nil {
+				size = *blobInfo.Properties.ContentLength
+			}
+			isDir := false
+			if strings.HasSuffix(name, "/") {
+				isDir = true
+				name = strings.TrimSuffix(name, "/")
+			}
+			if len(name) == 0 {
+				continue
+			}
+			if isDir {
+				if _, ok := prefixes[name]; ok {
+					continue
+				}
+				prefixes[name] = true
+			}
+			result = append(result, NewFileInfo(name, isDir, size, blobInfo.Properties.LastModified))
+		}
+	}
+
+	metrics.AZListObjectsCompleted(nil)
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Upload Resume is not supported on Azure Blob
+func (AzureBlobFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// SetFileChecksum stores the SHA-256 checksum for the named file as blob metadata
+func (fs AzureBlobFs) SetFileChecksum(name, checksum string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	metadata := azblob.Metadata{}
+	if len(checksum) > 0 {
+		metadata[azChecksumMetadataKey] = checksum
+	}
+	_, err := fs.containerURL.NewBlobURL(name).SetMetadata(ctx, metadata, azblob.BlobAccessConditions{})
+	return err
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file, if any
+func (fs AzureBlobFs) GetFileChecksum(name string) (string, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	response, err := fs.containerURL.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil {
+		return "", err
+	}
+	return response.NewMetadata()[azChecksumMetadataKey], nil
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Azure Blob uploads are already atomic, we don't need to upload to a temporary
+// file
+func (AzureBlobFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (AzureBlobFs) IsNotExist(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.Response() != nil && storageErr.Response().StatusCode == http.StatusNotFound {
+			return true
+		}
+		if storageErr.ServiceCode() == azblob.ServiceCodeContainerNotFound ||
+			storageErr.ServiceCode() == azblob.ServiceCodeBlobNotFound {
+			return true
+		}
+	}
+
+	return strings.Contains(err.Error(), "404")
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (AzureBlobFs) IsPermission(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	if storageErr, ok := err.(azblob.StorageError); ok {
+		if storageErr.Response() != nil {
+			code := storageErr.Response().StatusCode
+			if code == http.StatusForbidden || code == http.StatusUnauthorized {
+				return true
+			}
+		}
+		if storageErr.ServiceCode() == azblob.ServiceCodeInsufficientAccountPermissions ||
+			storageErr.ServiceCode() == azblob.ServiceCodeInvalidAuthenticationInfo ||
+			storageErr.ServiceCode() == azblob.ServiceCodeUnauthorizedBlobOverwrite {
+			return true
+		}
+	}
+
+	return strings.Contains(err.Error(), "403")
+}
+
+// CheckRootPath creates the specified root directory if it does not exists
+func (fs AzureBlobFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	osFs.CheckRootPath(username, uid, gid)
+	return fs.checkIfBucketExists() != nil
+}
+
+// ScanRootDirContents returns the number of files contained in the bucket,
+// and their size
+func (fs AzureBlobFs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+		listBlob, err := fs.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{
+			Prefix: fs.config.KeyPrefix,
+		})
+		cancelFn()
+		if err != nil {
+			metrics.AZListObjectsCompleted(err)
+			return numFiles, size, err
+		}
+		marker = listBlob.NextMarker
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			isDir := strings.HasSuffix(blobInfo.Name, "/")
+			blobSize := int64(0)
+			if blobInfo.Properties.ContentLength != nil {
+				blobSize = *blobInfo.Properties.ContentLength
+			}
+			// directory placeholders created by Mkdir must not be counted as files
+			if isDir && blobSize == 0 {
+				continue
+			}
+			numFiles++
+			size += blobSize
+		}
+	}
+
+	metrics.AZListObjectsCompleted(nil)
+	return numFiles, size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload.
+// Azure Blob Storage uploads are already atomic, we never call this method
+func (AzureBlobFs) GetAtomicUploadPath(name string) string {
+	return ""
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTP users
+func (fs AzureBlobFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if !path.IsAbs(rel) {
+		rel = "/" + rel
+	}
+	if len(fs.config.KeyPrefix) > 0 {
+		if !strings.HasPrefix(rel, "/"+fs.config.KeyPrefix) {
+			rel = "/"
+		}
+		rel = path.Clean("/" + strings.TrimPrefix(rel, "/"+fs.config.KeyPrefix))
+	}
+	return rel
+}
+
+// Join joins any number of path elements into a single path
+func (AzureBlobFs) Join(elem ...string) string {
+	return strings.TrimPrefix(path.Join(elem...), "/")
+}
+
+// Close releases the resources associated to this Fs implementation.
+// It does nothing for Azure Blob
+func (AzureBlobFs) Close() error {
+	return nil
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path
+func (fs AzureBlobFs) ResolvePath(sftpPath string) (string, error) {
+	if !path.IsAbs(sftpPath) {
+		sftpPath = path.Clean("/" + sftpPath)
+	}
+	return fs.Join(fs.config.KeyPrefix, strings.TrimPrefix(sftpPath, "/")), nil
+}
+
+// headObject returns the properties for the blob with the given name or for
+// the directory placeholder created by Mkdir. The returned bool is true if
+// the properties refer to a directory
+func (fs *AzureBlobFs) headObject(name string) (*azblob.BlobGetPropertiesResponse, bool, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	isDir := strings.HasSuffix(name, "/")
+	response, err := fs.containerURL.NewBlobURL(name).GetProperties(ctx, azblob.BlobAccessConditions{})
+	if err != nil && !isDir && fs.IsNotExist(err) {
+		isDir = true
+		response, err = fs.containerURL.NewBlobURL(name+"/").GetProperties(ctx, azblob.BlobAccessConditions{})
+	}
+	return response, isDir, err
+}
+
+// hasContents returns true if there is at least a blob with the given directory prefix
+func (fs *AzureBlobFs) hasContents(name string) (bool, error) {
+	result := false
+	prefix := ""
+	if len(name) > 0 && name != "." {
+		prefix = strings.TrimPrefix(name, "/")
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+	}
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	listBlob, err := fs.containerURL.ListBlobsFlatSegment(ctx, azblob.Marker{}, azblob.ListBlobsSegmentOptions{
+		Prefix:     prefix,
+		MaxResults: 2,
+	})
+	metrics.AZListObjectsCompleted(err)
+	if err != nil {
+		return result, err
+	}
+	for _, blobInfo := range listBlob.Segment.BlobItems {
+		// the directory placeholder itself is not a content
+		if blobInfo.Name != prefix {
+			result = true
+			break
+		}
+	}
+	return result, nil
+}
+
+func (fs *AzureBlobFs) checkIfBucketExists() error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+
+	_, err := fs.containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{})
+	metrics.AZHeadContainerCompleted(err)
+	return err
+}
+
+func (fs *AzureBlobFs) setConfigDefaults() {
+	if len(fs.config.Endpoint) == 0 {
+		fs.config.Endpoint = azureDefaultEndpoint
+	}
+	if fs.config.UploadPartSize == 0 {
+		fs.config.UploadPartSize = 4
+	}
+	fs.config.UploadPartSize *= 1024 * 1024
+	if fs.config.UploadConcurrency == 0 {
+		fs.config.UploadConcurrency = 2
+	}
+}
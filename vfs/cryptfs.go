@@ -0,0 +1,365 @@
+package vfs
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/eikenb/pipeat"
+	"golang.org/x/crypto/hkdf"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+)
+
+const (
+	// cryptFsName is the name for the encrypted Fs implementation
+	cryptFsName = "cryptfs"
+	// size of the plaintext chunks, each chunk is encrypted and authenticated on its own
+	cryptChunkSize = 64 * 1024
+	cryptSaltSize  = 32
+	// size of the GCM authentication tag added to each chunk
+	cryptTagSize = 16
+)
+
+var (
+	cryptMagic      = []byte("SFGE")
+	cryptHeaderSize = int64(len(cryptMagic) + cryptSaltSize)
+	errCryptHeader  = errors.New("invalid encrypted file header")
+	errCryptTrunc   = errors.New("encrypted file is truncated")
+)
+
+// CryptFsConfig defines the configuration for an encrypted filesystem.
+// The encryption is applied on top of the configured storage provider
+type CryptFsConfig struct {
+	// Passphrase used to derive the encryption keys, it is stored encrypted (AES-256-GCM).
+	// Empty means no encryption
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// CryptFs is a Fs implementation that encrypts the file contents before
+// storing them using the wrapped Fs. Each file has its own random salt and
+// the key is derived from the user passphrase using HKDF-SHA256.
+// The contents are split in chunks encrypted using AES-256-GCM, so any
+// modification or truncation is detected while downloading.
+// File names and directory structure are not encrypted
+type CryptFs struct {
+	Fs
+	localTempDir string
+	passphrase   []byte
+}
+
+// NewCryptFs returns a CryptFs object that encrypts the contents stored using the given Fs
+func NewCryptFs(fs Fs, localTempDir string, config CryptFsConfig) (Fs, error) {
+	if len(config.Passphrase) == 0 {
+		return nil, errors.New("the passphrase cannot be empty")
+	}
+	passphrase, err := kms.Decrypt(config.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	return &CryptFs{
+		Fs:           fs,
+		localTempDir: localTempDir,
+		passphrase:   []byte(passphrase),
+	}, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs *CryptFs) Name() string {
+	return fmt.Sprintf("%v %v", cryptFsName, fs.Fs.Name())
+}
+
+// Stat returns a FileInfo describing the named file, the size is the plaintext one
+func (fs *CryptFs) Stat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Stat(name)
+	if err != nil {
+		return info, err
+	}
+	return newCryptFileInfo(info), nil
+}
+
+// Lstat returns a FileInfo describing the named file, the size is the plaintext one
+func (fs *CryptFs) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.Fs.Lstat(name)
+	if err != nil {
+		return info, err
+	}
+	return newCryptFileInfo(info), nil
+}
+
+// Open opens the named file for reading, the contents are decrypted while reading
+func (fs *CryptFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	f, r, cancelFn, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var src io.ReadCloser = r
+	if f != nil {
+		src = f
+	}
+	pr, pw, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		src.Close()
+		if cancelFn != nil {
+			cancelFn()
+		}
+		return nil, nil, nil, err
+	}
+	go func() {
+		n, err := fs.decrypt(pw, src)
+		pw.CloseWithError(err)
+		src.Close()
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, pr, cancelFn, nil
+}
+
+// Create creates or opens the named file for writing, the contents are encrypted while writing
+func (fs *CryptFs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
+	pr, pw, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, w, cancelFn, err := fs.Fs.Create(name, flag)
+	if err != nil {
+		pr.Close()
+		pw.Close()
+		return nil, nil, nil, err
+	}
+	var dst io.WriteCloser = w
+	upload := newPipeUpload(pr, pw)
+	if f != nil {
+		dst = f
+		upload.flush = f.Sync
+	} else {
+		// the encrypted data are flushed by the underlying filesystem
+		upload.flush = func() error {
+			return SyncPipeUpload(w)
+		}
+	}
+	go func() {
+		n, err := fs.encrypt(dst, upload)
+		if errClose := dst.Close(); err == nil {
+			err = errClose
+		}
+		upload.finish(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, pw, cancelFn, nil
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries, the sizes are the plaintext ones
+func (fs *CryptFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	list, err := fs.Fs.ReadDir(dirname)
+	if err != nil {
+		return list, err
+	}
+	result := make([]os.FileInfo, 0, len(list))
+	for _, info := range list {
+		result = append(result, newCryptFileInfo(info))
+	}
+	return result, nil
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Upload resume is not supported on encrypted filesystems since the
+// contents are written sequentially
+func (*CryptFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Uploads to encrypted filesystems are streamed to the final path
+func (*CryptFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their plaintext size
+func (fs *CryptFs) ScanRootDirContents() (int, int64, error) {
+	rootPath, err := fs.ResolvePath("/")
+	if err != nil {
+		return 0, 0, err
+	}
+	return fs.getDirSize(rootPath)
+}
+
+func (fs *CryptFs) getDirSize(dirname string) (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	list, err := fs.ReadDir(dirname)
+	if err != nil {
+		return numFiles, size, err
+	}
+	for _, info := range list {
+		if info.IsDir() {
+			num, s, err := fs.getDirSize(fs.Join(dirname, info.Name()))
+			if err != nil {
+				return numFiles, size, err
+			}
+			numFiles += num
+			size += s
+		} else if info.Mode().IsRegular() {
+			numFiles++
+			size += info.Size()
+		}
+	}
+	return numFiles, size, nil
+}
+
+func (fs *CryptFs) getAEAD(salt []byte) (cipher.AEAD, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, fs.passphrase, salt, []byte(cryptFsName)), key); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// getChunkNonce returns the nonce for the chunk with the given sequence number.
+// The last chunk has a different nonce so a truncation on a chunk boundary is detected
+func getChunkNonce(aead cipher.AEAD, seq uint64, isLast bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce, seq)
+	if isLast {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encrypt reads the plaintext from src and writes the encrypted contents to dst.
+// All the chunks, except the last one, are full. The last chunk is smaller than
+// a full one and it can be empty.
+// It returns the number of plaintext bytes read
+func (fs *CryptFs) encrypt(dst io.Writer, src io.Reader) (int64, error) {
+	salt := make([]byte, cryptSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return 0, err
+	}
+	aead, err := fs.getAEAD(salt)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = dst.Write(append(append([]byte{}, cryptMagic...), salt...)); err != nil {
+		return 0, err
+	}
+	var written int64
+	// we need to read one byte more than the chunk size to know if this is the last chunk
+	buf := make([]byte, cryptChunkSize+1)
+	sealed := make([]byte, 0, cryptChunkSize+aead.Overhead())
+	pending := 0
+	// some readers, for example the pipes, return the same data again if read after EOF
+	isEOF := false
+	for seq := uint64(0); ; seq++ {
+		if !isEOF {
+			n, err := io.ReadFull(src, buf[pending:])
+			pending += n
+			if err != nil {
+				if err != io.EOF && err != io.ErrUnexpectedEOF {
+					return written, err
+				}
+				isEOF = true
+			}
+		}
+		// a full chunk is never the last one, an empty last chunk will follow
+		isLast := isEOF && pending < cryptChunkSize
+		chunkSize := pending
+		if !isLast {
+			chunkSize = cryptChunkSize
+		}
+		sealed = aead.Seal(sealed[:0], getChunkNonce(aead, seq, isLast), buf[:chunkSize], nil)
+		if _, err := dst.Write(sealed); err != nil {
+			return written, err
+		}
+		written += int64(chunkSize)
+		if isLast {
+			return written, nil
+		}
+		pending = copy(buf, buf[chunkSize:pending])
+	}
+}
+
+// decrypt reads the encrypted contents from src and writes the plaintext to dst.
+// It returns the number of plaintext bytes written
+func (fs *CryptFs) decrypt(dst io.Writer, src io.Reader) (int64, error) {
+	header := make([]byte, cryptHeaderSize)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, errCryptHeader
+	}
+	if !bytes.Equal(header[:len(cryptMagic)], cryptMagic) {
+		return 0, errCryptHeader
+	}
+	aead, err := fs.getAEAD(header[len(cryptMagic):])
+	if err != nil {
+		return 0, err
+	}
+	var written int64
+	buf := make([]byte, cryptChunkSize+aead.Overhead())
+	plain := make([]byte, 0, cryptChunkSize)
+	for seq := uint64(0); ; seq++ {
+		n, err := io.ReadFull(src, buf)
+		if err == io.EOF {
+			// the last chunk is always present, even if empty
+			return written, errCryptTrunc
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return written, err
+		}
+		// only the last chunk can be smaller than a full one
+		isLast := err != nil
+		plain, err = aead.Open(plain[:0], getChunkNonce(aead, seq, isLast), buf[:n], nil)
+		if err != nil {
+			return written, err
+		}
+		if _, err := dst.Write(plain); err != nil {
+			return written, err
+		}
+		written += int64(len(plain))
+		if isLast {
+			return written, nil
+		}
+	}
+}
+
+// getCryptPlaintextSize returns the plaintext size for an encrypted file of the given size
+func getCryptPlaintextSize(size int64) int64 {
+	size -= cryptHeaderSize
+	if size <= 0 {
+		return 0
+	}
+	encryptedChunkSize := int64(cryptChunkSize + cryptTagSize)
+	plaintextSize := (size / encryptedChunkSize) * cryptChunkSize
+	if remaining := size % encryptedChunkSize; remaining > cryptTagSize {
+		plaintextSize += remaining - cryptTagSize
+	}
+	return plaintextSize
+}
+
+// cryptFileInfo reports the plaintext size for the regular files
+type cryptFileInfo struct {
+	os.FileInfo
+}
+
+func newCryptFileInfo(info os.FileInfo) os.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	return cryptFileInfo{FileInfo: info}
+}
+
+// Size returns the plaintext size of the file
+func (fi cryptFileInfo) Size() int64 {
+	return getCryptPlaintextSize(fi.FileInfo.Size())
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
@@ -12,6 +13,7 @@ import (
 	"time"
 
 	"cloud.google.com/go/storage"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/eikenb/pipeat"
@@ -69,7 +71,21 @@ func NewGCSFs(connectionID, localTempDir string, config GCSFsConfig) (Fs, error)
 	if fs.config.AutomaticCredentials > 0 {
 		fs.svc, err = storage.NewClient(ctx)
 	} else {
-		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsFile(fs.config.CredentialFile))
+		var credentials []byte
+		credentials, err = ioutil.ReadFile(fs.config.CredentialFile)
+		if err != nil {
+			return fs, err
+		}
+		// the credentials are encrypted if a KMS provider is configured
+		if kms.IsEncrypted(string(credentials)) {
+			var decrypted string
+			decrypted, err = kms.Decrypt(string(credentials))
+			if err != nil {
+				return fs, err
+			}
+			credentials = []byte(decrypted)
+		}
+		fs.svc, err = storage.NewClient(ctx, option.WithCredentialsJSON(credentials))
 	}
 	return fs, err
 }
@@ -167,7 +183,7 @@ func (fs GCSFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error
 }
 
 // Create creates or opens the named file for writing
-func (fs GCSFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+func (fs GCSFs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
 	r, w, err := pipeat.PipeInDir(fs.localTempDir)
 	if err != nil {
 		return nil, nil, nil, err
@@ -179,11 +195,12 @@ func (fs GCSFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, f
 	if len(fs.config.StorageClass) > 0 {
 		objectWriter.ObjectAttrs.StorageClass = fs.config.StorageClass
 	}
+	upload := newPipeUpload(r, w)
 	go func() {
 		defer cancelFn()
 		defer objectWriter.Close()
-		n, err := io.Copy(objectWriter, r)
-		r.CloseWithError(err)
+		n, err := io.Copy(objectWriter, upload)
+		upload.finish(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
 		metrics.GCSTransferCompleted(n, 0, err)
 	}()
@@ -276,6 +293,16 @@ func (GCSFs) Symlink(source, target string) error {
 	return errors.New("403 symlinks are not supported")
 }
 
+// Link creates target as a hard link to source.
+func (GCSFs) Link(source, target string) error {
+	return errors.New("403 hard links are not supported")
+}
+
+// Readlink returns the destination of the named symbolic link.
+func (GCSFs) Readlink(name string) (string, error) {
+	return "", errors.New("403 symlinks are not supported")
+}
+
 // Chown changes the numeric uid and gid of the named file.
 // Silently ignored.
 func (GCSFs) Chown(name string, uid int, gid int) error {
@@ -289,7 +316,7 @@ func (GCSFs) Chmod(name string, mode os.FileMode) error {
 }
 
 // Chtimes changes the access and modification times of the named file.
-// Silently ignored.
+// Not supported on GCS.
 func (GCSFs) Chtimes(name string, atime, mtime time.Time) error {
 	return errors.New("403 chtimes is not supported")
 }
@@ -339,13 +366,34 @@ func (fs GCSFs) ReadDir(dirname string) ([]os.FileInfo, error) {
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
-// SFTP Resume is not supported on S3
+// SFTP Resume is not supported on GCS
 func (GCSFs) IsUploadResumeSupported() bool {
 	return false
 }
 
+// SetFileChecksum stores the SHA-256 checksum for the named file as object metadata
+func (fs GCSFs) SetFileChecksum(name, checksum string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	_, err := fs.svc.Bucket(fs.config.Bucket).Object(name).Update(ctx, storage.ObjectAttrsToUpdate{
+		Metadata: map[string]string{checksumMetadataKey: checksum},
+	})
+	return err
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file, if any
+func (fs GCSFs) GetFileChecksum(name string) (string, error) {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxTimeout))
+	defer cancelFn()
+	attrs, err := fs.svc.Bucket(fs.config.Bucket).Object(name).Attrs(ctx)
+	if err != nil {
+		return "", err
+	}
+	return attrs.Metadata[checksumMetadataKey], nil
+}
+
 // IsAtomicUploadSupported returns true if atomic upload is supported.
-// S3 uploads are already atomic, we don't need to upload to a temporary
+// GCS uploads are already atomic, we don't need to upload to a temporary
 // file
 func (GCSFs) IsAtomicUploadSupported() bool {
 	return false
@@ -416,6 +464,11 @@ func (fs GCSFs) ScanRootDirContents() (int, int64, error) {
 		if !attrs.Deleted.IsZero() {
 			continue
 		}
+		// objects ending with "/" are the placeholders created by Mkdir,
+		// they are directories and so they must not be counted as files
+		if strings.HasSuffix(attrs.Name, "/") && attrs.Size == 0 {
+			continue
+		}
 		numFiles++
 		size += attrs.Size
 	}
@@ -424,7 +477,7 @@ func (fs GCSFs) ScanRootDirContents() (int, int64, error) {
 }
 
 // GetAtomicUploadPath returns the path to use for an atomic upload.
-// S3 uploads are already atomic, we never call this method for S3
+// GCS uploads are already atomic, we never call this method for GCS
 func (GCSFs) GetAtomicUploadPath(name string) string {
 	return ""
 }
@@ -453,6 +506,12 @@ func (GCSFs) Join(elem ...string) string {
 	return strings.TrimPrefix(path.Join(elem...), "/")
 }
 
+// Close releases the resources associated to this Fs implementation.
+// It does nothing for GCS
+func (GCSFs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs GCSFs) ResolvePath(sftpPath string) (string, error) {
 	if !path.IsAbs(sftpPath) {
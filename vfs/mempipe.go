@@ -0,0 +1,257 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var errMemPipeWriterClosed = errors.New("write on closed pipe")
+
+// memPipeChunk is a piece of data written to a memPipe and not yet read
+type memPipeChunk struct {
+	offset int64
+	data   []byte
+}
+
+func (c *memPipeChunk) end() int64 {
+	return c.offset + int64(len(c.data))
+}
+
+// memPipe is an in-memory pipe: the data can be written at any offset after the read one,
+// and they are kept in memory until the reader reads them sequentially.
+// The writers block while the contiguous data not yet read reach the pipe size, so the memory
+// usage is bounded by the size plus the data written ahead, out of order, by the client
+type memPipe struct {
+	sync.Mutex
+	cond *sync.Cond
+	size int64
+	// chunks written after the read offset, sorted and not overlapping
+	chunks   []*memPipeChunk
+	readOff  int64
+	writeOff int64
+	end      int64
+	readed   int64
+	written  int64
+	rerr     error
+	werr     error
+}
+
+// memPipeReader is the reader side of a memPipe, it can be used only as io.Reader
+type memPipeReader struct {
+	pipe *memPipe
+}
+
+// memPipeWriter is the writer side of a memPipe
+type memPipeWriter struct {
+	pipe *memPipe
+}
+
+// newMemPipe returns a synchronous in-memory pipe, closing the writer blocks until the reader is closed
+func newMemPipe(size int64) (*memPipeReader, *memPipeWriter) {
+	p := &memPipe{
+		size: size,
+	}
+	p.cond = sync.NewCond(p)
+	return &memPipeReader{pipe: p}, &memPipeWriter{pipe: p}
+}
+
+// buffered returns the contiguous bytes, after the read offset, available for reading
+func (p *memPipe) buffered() int64 {
+	end := p.readOff
+	for _, c := range p.chunks {
+		if c.offset != end {
+			break
+		}
+		end = c.end()
+	}
+	return end - p.readOff
+}
+
+// store copies data at the given offset, the data already stored at the same offsets are overwritten
+func (p *memPipe) store(data []byte, off int64) {
+	end := off + int64(len(data))
+	idx := sort.Search(len(p.chunks), func(i int) bool {
+		return p.chunks[i].end() > off
+	})
+	var added []*memPipeChunk
+	for _, c := range p.chunks[idx:] {
+		if off >= end || c.offset >= end {
+			break
+		}
+		if c.offset > off {
+			added = append(added, newMemPipeChunk(data[:c.offset-off], off))
+			data = data[c.offset-off:]
+			off = c.offset
+		}
+		n := copy(c.data[off-c.offset:], data)
+		data = data[n:]
+		off += int64(n)
+	}
+	if len(data) > 0 {
+		added = append(added, newMemPipeChunk(data, off))
+	}
+	if len(added) > 0 {
+		p.chunks = append(p.chunks, added...)
+		sort.Slice(p.chunks, func(i, j int) bool {
+			return p.chunks[i].offset < p.chunks[j].offset
+		})
+	}
+	if end > p.end {
+		p.end = end
+	}
+}
+
+func newMemPipeChunk(data []byte, off int64) *memPipeChunk {
+	c := &memPipeChunk{
+		offset: off,
+		data:   make([]byte, len(data)),
+	}
+	copy(c.data, data)
+	return c
+}
+
+// WriteAt writes len(b) bytes at the given offset, it blocks while the pipe is full
+func (w *memPipeWriter) WriteAt(b []byte, off int64) (int, error) {
+	p := w.pipe
+	p.Lock()
+	defer p.Unlock()
+
+	for p.rerr == nil && p.werr == nil && p.buffered() >= p.size {
+		p.cond.Wait()
+	}
+	if p.rerr != nil {
+		return 0, p.rerr
+	}
+	if p.werr != nil {
+		return 0, errMemPipeWriterClosed
+	}
+	if off < p.readOff {
+		return 0, fmt.Errorf("unable to write at offset %v, the data up to offset %v were already read", off, p.readOff)
+	}
+	p.store(b, off)
+	p.written += int64(len(b))
+	p.cond.Broadcast()
+	return len(b), nil
+}
+
+// Write writes len(b) bytes after the ones written by the previous Write
+func (w *memPipeWriter) Write(b []byte) (int, error) {
+	w.pipe.Lock()
+	off := w.pipe.writeOff
+	w.pipe.Unlock()
+
+	n, err := w.WriteAt(b, off)
+
+	w.pipe.Lock()
+	w.pipe.writeOff += int64(n)
+	w.pipe.Unlock()
+	return n, err
+}
+
+// GetWrittenBytes returns the bytes written
+func (w *memPipeWriter) GetWrittenBytes() int64 {
+	w.pipe.Lock()
+	defer w.pipe.Unlock()
+	return w.pipe.written
+}
+
+// Close lets the reader know that writing is complete and waits for the reader to be closed
+func (w *memPipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError sets the error returned to the reader, once it reads the contiguous
+// written data, and otherwise behaves like Close
+func (w *memPipeWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	p := w.pipe
+	p.Lock()
+	defer p.Unlock()
+
+	if p.werr == nil {
+		p.werr = err
+		p.cond.Broadcast()
+	}
+	for p.rerr == nil {
+		p.cond.Wait()
+	}
+	return nil
+}
+
+// Read reads the available data at the read offset, it blocks until some data are available.
+// After the writer is closed, the gaps left by the writer are read as zeros
+func (r *memPipeReader) Read(b []byte) (int, error) {
+	p := r.pipe
+	p.Lock()
+	defer p.Unlock()
+
+	for p.rerr == nil && p.werr == nil && p.buffered() == 0 {
+		p.cond.Wait()
+	}
+	if p.rerr != nil {
+		return 0, p.rerr
+	}
+	n := 0
+	for n < len(b) && len(p.chunks) > 0 && p.chunks[0].offset == p.readOff {
+		c := p.chunks[0]
+		copied := copy(b[n:], c.data)
+		c.data = c.data[copied:]
+		c.offset += int64(copied)
+		if len(c.data) == 0 {
+			p.chunks[0] = nil
+			p.chunks = p.chunks[1:]
+		}
+		n += copied
+		p.readOff += int64(copied)
+	}
+	if n == 0 && p.werr == io.EOF && p.readOff < p.end {
+		// the writer completed the upload leaving a gap
+		gap := p.end - p.readOff
+		if len(p.chunks) > 0 {
+			gap = p.chunks[0].offset - p.readOff
+		}
+		if gap > int64(len(b)) {
+			gap = int64(len(b))
+		}
+		n = int(gap)
+		for i := range b[:n] {
+			b[i] = 0
+		}
+		p.readOff += gap
+	}
+	p.readed += int64(n)
+	p.cond.Broadcast()
+	if n == 0 {
+		return 0, p.werr
+	}
+	return n, nil
+}
+
+// GetReadedBytes returns the bytes read
+func (r *memPipeReader) GetReadedBytes() int64 {
+	r.pipe.Lock()
+	defer r.pipe.Unlock()
+	return r.pipe.readed
+}
+
+// CloseWithError sets the error returned to the writer, or io.EOF if err is nil, and unblocks it
+func (r *memPipeReader) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	p := r.pipe
+	p.Lock()
+	defer p.Unlock()
+
+	if p.rerr == nil {
+		p.rerr = err
+		p.chunks = nil
+		p.cond.Broadcast()
+	}
+	return nil
+}
@@ -64,7 +64,7 @@ func (OsFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
 }
 
 // Create creates or opens the named file for writing
-func (OsFs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
+func (OsFs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
 	var err error
 	var f *os.File
 	if flag == 0 {
@@ -96,6 +96,29 @@ func (OsFs) Symlink(source, target string) error {
 	return os.Symlink(source, target)
 }
 
+// Link creates target as a hard link to source.
+func (OsFs) Link(source, target string) error {
+	return os.Link(source, target)
+}
+
+// Readlink returns the SFTP path for the destination of the named symbolic link.
+// Links pointing outside the user home directory and the virtual folders are not resolved
+func (fs OsFs) Readlink(name string) (string, error) {
+	p, err := os.Readlink(name)
+	if err != nil {
+		return p, err
+	}
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(filepath.Dir(name), p)
+	}
+	p = filepath.Clean(p)
+	if !fs.isInsideRoot(p) {
+		fsLog(fs, logger.LevelWarn, "symlink %#v points outside the user home: %#v", name, p)
+		return "", os.ErrPermission
+	}
+	return fs.GetRelativePath(p), nil
+}
+
 // Chown changes the numeric uid and gid of the named file.
 func (OsFs) Chown(name string, uid int, gid int) error {
 	return os.Chown(name, uid, gid)
@@ -175,6 +198,9 @@ func (fs OsFs) CheckRootPath(username string, uid int, gid int) bool {
 func (fs OsFs) ScanRootDirContents() (int, int64, error) {
 	numFiles, size, err := fs.getDirSize(fs.rootDir)
 	for _, v := range fs.virtualFolders {
+		if v.ExcludeFromQuota {
+			continue
+		}
 		num, s, err := fs.getDirSize(v.MappedPath)
 		if err != nil {
 			if fs.IsNotExist(err) {
@@ -193,7 +219,7 @@ func (fs OsFs) ScanRootDirContents() (int, int64, error) {
 func (OsFs) GetAtomicUploadPath(name string) string {
 	dir := filepath.Dir(name)
 	guid := xid.New().String()
-	return filepath.Join(dir, ".sftpgo-upload."+guid+"."+filepath.Base(name))
+	return filepath.Join(dir, atomicUploadPrefix+guid+"."+filepath.Base(name))
 }
 
 // GetRelativePath returns the path for a file relative to the user's home dir.
@@ -223,6 +249,12 @@ func (OsFs) Join(elem ...string) string {
 	return filepath.Join(elem...)
 }
 
+// Close releases the resources associated to this Fs implementation.
+// It does nothing for local filesystem
+func (OsFs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs OsFs) ResolvePath(sftpPath string) (string, error) {
 	if !filepath.IsAbs(fs.rootDir) {
@@ -336,6 +368,20 @@ func (fs *OsFs) findFirstExistingDir(path, rootPath string) (string, error) {
 	return p, err
 }
 
+// isInsideRoot returns true if the given path is inside the root dir or a virtual folder,
+// symbolic links are not evaluated
+func (fs OsFs) isInsideRoot(name string) bool {
+	if isSameOrSubPath(name, fs.rootDir) {
+		return true
+	}
+	for _, v := range fs.virtualFolders {
+		if isSameOrSubPath(name, v.MappedPath) {
+			return true
+		}
+	}
+	return false
+}
+
 func (fs *OsFs) isSubDir(sub, rootPath string) error {
 	// rootPath must exist and it is already a validated absolute path
 	parent, err := filepath.EvalSymlinks(rootPath)
@@ -343,7 +389,8 @@ func (fs *OsFs) isSubDir(sub, rootPath string) error {
 		fsLog(fs, logger.LevelWarn, "invalid root path %#v: %v", rootPath, err)
 		return err
 	}
-	if !strings.HasPrefix(sub, parent) {
+	// a sibling directory sharing the same prefix, for example "/home/user1" and "/home/user", is not a sub dir
+	if !isSameOrSubPath(sub, parent) {
 		err = fmt.Errorf("path %#v is not inside: %#v", sub, parent)
 		fsLog(fs, logger.LevelWarn, "error: %v ", err)
 		return err
@@ -351,6 +398,11 @@ func (fs *OsFs) isSubDir(sub, rootPath string) error {
 	return nil
 }
 
+func isSameOrSubPath(name, dir string) bool {
+	dir = filepath.Clean(dir)
+	return name == dir || strings.HasPrefix(name, strings.TrimSuffix(dir, string(os.PathSeparator))+string(os.PathSeparator))
+}
+
 func (fs *OsFs) createMissingDirs(filePath string, uid, gid int) error {
 	dirsToCreate, err := fs.findNonexistentDirs(filePath, fs.rootDir)
 	if err != nil {
@@ -0,0 +1,127 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pipeSyncPollInterval = 50 * time.Millisecond
+	pipeSyncTimeout      = 2 * time.Minute
+)
+
+var (
+	// ErrSyncNotSupported is returned if the given writer is not used for an upload in progress
+	ErrSyncNotSupported = errors.New("sync is not supported for this upload")
+	errPipeSyncTimeout  = errors.New("timeout waiting for the upload to consume the written data")
+)
+
+// pipeReader is the reader side of the pipe returned by Create, read by the backend
+type pipeReader interface {
+	io.Reader
+	CloseWithError(err error) error
+	GetReadedBytes() int64
+}
+
+var pipeUploads = struct {
+	sync.Mutex
+	uploads map[PipeWriter]*pipeUpload
+}{
+	uploads: make(map[PipeWriter]*pipeUpload),
+}
+
+// pipeUpload tracks an upload reading from the pipe returned by Create,
+// so the data written so far can be flushed to the backend on request.
+// The backends must read the pipe using the pipeUpload itself
+type pipeUpload struct {
+	// bytes read from the pipe and the end offset of the read in progress, if any.
+	// The pipe reads block until the requested buffer is full
+	consumed  int64
+	requested int64
+	reader    pipeReader
+	writer    PipeWriter
+	done      chan bool
+	err       error
+	// flush, if not nil, waits for the backend to store the data read from the pipe so far
+	flush func() error
+}
+
+// newPipeUpload registers the upload for the given pipe, finish must be called when the upload ends
+func newPipeUpload(r pipeReader, w PipeWriter) *pipeUpload {
+	u := &pipeUpload{
+		reader: r,
+		writer: w,
+		done:   make(chan bool),
+	}
+	pipeUploads.Lock()
+	pipeUploads.uploads[w] = u
+	pipeUploads.Unlock()
+	return u
+}
+
+// Read reads from the pipe and tracks the consumed data
+func (u *pipeUpload) Read(p []byte) (int, error) {
+	atomic.StoreInt64(&u.requested, atomic.LoadInt64(&u.consumed)+int64(len(p)))
+	n, err := u.reader.Read(p)
+	atomic.AddInt64(&u.consumed, int64(n))
+	return n, err
+}
+
+// isCaughtUp returns true if the backend read the data up to offset or it is waiting
+// for more data, for example to fill a multipart upload part
+func (u *pipeUpload) isCaughtUp(offset int64) bool {
+	return atomic.LoadInt64(&u.consumed) >= offset || atomic.LoadInt64(&u.requested) >= offset
+}
+
+// finish closes the reader side of the pipe with the given error and unregisters the upload
+func (u *pipeUpload) finish(err error) {
+	pipeUploads.Lock()
+	delete(pipeUploads.uploads, u.writer)
+	u.err = err
+	close(u.done)
+	pipeUploads.Unlock()
+	u.reader.CloseWithError(err)
+}
+
+// sync waits until the backend has read all the data written so far, or until it is waiting for more
+// data, and then flushes them, if supported
+func (u *pipeUpload) sync() error {
+	target := u.writer.GetWrittenBytes()
+	deadline := time.Now().Add(pipeSyncTimeout)
+	for !u.isCaughtUp(target) {
+		if time.Now().After(deadline) {
+			return errPipeSyncTimeout
+		}
+		select {
+		case <-u.done:
+			return u.err
+		case <-time.After(pipeSyncPollInterval):
+		}
+	}
+	select {
+	case <-u.done:
+		return u.err
+	default:
+	}
+	if u.flush != nil {
+		return u.flush()
+	}
+	return nil
+}
+
+// SyncPipeUpload flushes the data written so far to the given writer, returned by Create, to the
+// backend: it waits until the upload has consumed them and returns the upload error, if any.
+// The data smaller than a multipart upload part, or than an encryption chunk, can be stored only
+// when the upload is completed, so they are stored, and the object is visible, after closing the writer
+func SyncPipeUpload(w PipeWriter) error {
+	pipeUploads.Lock()
+	u, ok := pipeUploads.uploads[w]
+	pipeUploads.Unlock()
+	if !ok {
+		return ErrSyncNotSupported
+	}
+	return u.sync()
+}
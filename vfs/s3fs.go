@@ -15,6 +15,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
 	"github.com/drakkan/sftpgo/metrics"
 	"github.com/drakkan/sftpgo/utils"
@@ -46,6 +47,11 @@ type S3FsConfig struct {
 	UploadPartSize int64 `json:"upload_part_size,omitempty"`
 	// How many parts are uploaded in parallel
 	UploadConcurrency int `json:"upload_concurrency,omitempty"`
+	// ResumableUploads allows to resume the interrupted uploads. The state of the failed multipart
+	// uploads is kept in memory, keyed by object and client: a client reconnecting and resuming
+	// from the uploaded size, as reported by stat, continues the same multipart upload.
+	// Interrupted uploads not resumed within 24 hours are aborted
+	ResumableUploads bool `json:"resumable_uploads,omitempty"`
 }
 
 // S3Fs is a Fs implementation for Amazon S3 compatible object storage.
@@ -78,7 +84,7 @@ func NewS3Fs(connectionID, localTempDir string, config S3FsConfig) (Fs, error) {
 	}
 
 	if len(fs.config.AccessSecret) > 0 {
-		accessSecret, err := utils.DecryptData(fs.config.AccessSecret)
+		accessSecret, err := kms.Decrypt(fs.config.AccessSecret)
 		if err != nil {
 			return fs, err
 		}
@@ -135,6 +141,11 @@ func (fs S3Fs) Stat(name string) (os.FileInfo, error) {
 	if "/"+fs.config.KeyPrefix == name+"/" {
 		return NewFileInfo(name, true, 0, time.Time{}), nil
 	}
+	if fs.config.ResumableUploads {
+		if upload, ok := pendingS3Uploads.get(fs.getPendingUploadKey(name)); ok {
+			return NewFileInfo(name, false, upload.size, upload.updatedAt), nil
+		}
+	}
 	prefix := path.Dir(name)
 	if prefix == "/" || prefix == "." {
 		prefix = ""
@@ -203,26 +214,28 @@ func (fs S3Fs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error)
 }
 
 // Create creates or opens the named file for writing
-func (fs S3Fs) Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error) {
-	r, w, err := pipeat.PipeInDir(fs.localTempDir)
-	if err != nil {
-		return nil, nil, nil, err
+func (fs S3Fs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
+	if fs.config.ResumableUploads && !strings.HasSuffix(name, "/") {
+		return fs.createResumable(name, flag)
 	}
+	// the written data are buffered in memory up to a part size, no local temporary file is needed
+	r, w := newMemPipe(fs.config.UploadPartSize)
 	ctx, cancelFn := context.WithCancel(context.Background())
 	uploader := s3manager.NewUploaderWithClient(fs.svc)
+	upload := newPipeUpload(r, w)
 	go func() {
 		defer cancelFn()
 		key := name
 		response, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
 			Bucket:       aws.String(fs.config.Bucket),
 			Key:          aws.String(key),
-			Body:         r,
+			Body:         upload,
 			StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
 		}, func(u *s3manager.Uploader) {
 			u.Concurrency = fs.config.UploadConcurrency
 			u.PartSize = fs.config.UploadPartSize
 		})
-		r.CloseWithError(err)
+		upload.finish(err)
 		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, response: %v, readed bytes: %v, err: %+v",
 			name, response, r.GetReadedBytes(), err)
 		metrics.S3TransferCompleted(r.GetReadedBytes(), 0, err)
@@ -323,6 +336,16 @@ func (S3Fs) Symlink(source, target string) error {
 	return errors.New("403 symlinks are not supported")
 }
 
+// Link creates target as a hard link to source.
+func (S3Fs) Link(source, target string) error {
+	return errors.New("403 hard links are not supported")
+}
+
+// Readlink returns the destination of the named symbolic link.
+func (S3Fs) Readlink(name string) (string, error) {
+	return "", errors.New("403 symlinks are not supported")
+}
+
 // Chown changes the numeric uid and gid of the named file.
 // Silently ignored.
 func (S3Fs) Chown(name string, uid int, gid int) error {
@@ -380,9 +403,45 @@ func (fs S3Fs) ReadDir(dirname string) ([]os.FileInfo, error) {
 }
 
 // IsUploadResumeSupported returns true if upload resume is supported.
-// SFTP Resume is not supported on S3
-func (S3Fs) IsUploadResumeSupported() bool {
-	return false
+// Only the interrupted uploads can be resumed and only if resumable uploads are enabled
+func (fs S3Fs) IsUploadResumeSupported() bool {
+	return fs.config.ResumableUploads
+}
+
+// SetFileChecksum stores the SHA-256 checksum for the named file as object metadata.
+// S3 metadata cannot be modified, so the object is copied over itself, this does not
+// work for objects bigger than 5GB
+func (fs S3Fs) SetFileChecksum(name, checksum string) error {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(fs.ctxLongTimeout))
+	defer cancelFn()
+	metadata := map[string]*string{}
+	if len(checksum) > 0 {
+		metadata[checksumMetadataKey] = aws.String(checksum)
+	}
+	_, err := fs.svc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(fs.config.Bucket),
+		CopySource:        aws.String(fs.Join(fs.config.Bucket, name)),
+		Key:               aws.String(name),
+		Metadata:          metadata,
+		MetadataDirective: aws.String(s3.MetadataDirectiveReplace),
+		StorageClass:      utils.NilIfEmpty(fs.config.StorageClass),
+	})
+	metrics.S3CopyObjectCompleted(err)
+	return err
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file, if any
+func (fs S3Fs) GetFileChecksum(name string) (string, error) {
+	obj, err := fs.getObjectDetails(name)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range obj.Metadata {
+		if strings.EqualFold(k, checksumMetadataKey) {
+			return aws.StringValue(v), nil
+		}
+	}
+	return "", nil
 }
 
 // IsAtomicUploadSupported returns true if atomic upload is supported.
@@ -485,6 +544,12 @@ func (S3Fs) Join(elem ...string) string {
 	return path.Join(elem...)
 }
 
+// Close releases the resources associated to this Fs implementation.
+// It does nothing for S3
+func (S3Fs) Close() error {
+	return nil
+}
+
 // ResolvePath returns the matching filesystem path for the specified sftp path
 func (fs S3Fs) ResolvePath(sftpPath string) (string, error) {
 	if !path.IsAbs(sftpPath) {
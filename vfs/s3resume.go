@@ -0,0 +1,341 @@
+package vfs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+// s3PendingUploadTTL defines how long the state for an interrupted upload is preserved.
+// Expired multipart uploads are aborted
+const s3PendingUploadTTL = 24 * time.Hour
+
+var errS3ResumeNotPossible = errors.New("upload resume is only supported for interrupted uploads")
+
+// s3PendingUpload is an interrupted multipart upload that can be resumed
+type s3PendingUpload struct {
+	svc      *s3.S3
+	bucket   string
+	key      string
+	uploadID string
+	// contiguous completed parts starting from part number 1
+	parts     []*s3.CompletedPart
+	size      int64
+	updatedAt time.Time
+}
+
+type s3PendingUploads struct {
+	sync.Mutex
+	uploads map[string]*s3PendingUpload
+}
+
+var pendingS3Uploads = s3PendingUploads{
+	uploads: make(map[string]*s3PendingUpload),
+}
+
+// add stores the given interrupted upload and aborts the expired ones
+func (p *s3PendingUploads) add(key string, upload *s3PendingUpload) {
+	var expired []*s3PendingUpload
+	p.Lock()
+	for k, u := range p.uploads {
+		if time.Since(u.updatedAt) > s3PendingUploadTTL {
+			expired = append(expired, u)
+			delete(p.uploads, k)
+		}
+	}
+	if old, ok := p.uploads[key]; ok && old.uploadID != upload.uploadID {
+		expired = append(expired, old)
+	}
+	p.uploads[key] = upload
+	p.Unlock()
+
+	for _, u := range expired {
+		go u.abort()
+	}
+}
+
+// get returns the interrupted upload for the given key, if any
+func (p *s3PendingUploads) get(key string) (*s3PendingUpload, bool) {
+	p.Lock()
+	defer p.Unlock()
+	u, ok := p.uploads[key]
+	if !ok || time.Since(u.updatedAt) > s3PendingUploadTTL {
+		return nil, false
+	}
+	return u, true
+}
+
+// remove removes and returns the interrupted upload for the given key, if any.
+// A removed upload is owned by the caller, so two clients cannot resume it concurrently
+func (p *s3PendingUploads) remove(key string) *s3PendingUpload {
+	p.Lock()
+	defer p.Unlock()
+	u, ok := p.uploads[key]
+	if !ok {
+		return nil
+	}
+	delete(p.uploads, key)
+	if time.Since(u.updatedAt) > s3PendingUploadTTL {
+		go u.abort()
+		return nil
+	}
+	return u
+}
+
+func (u *s3PendingUpload) abort() {
+	ctx, cancelFn := context.WithDeadline(context.Background(), time.Now().Add(30*time.Second))
+	defer cancelFn()
+	_, err := u.svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(u.bucket),
+		Key:      aws.String(u.key),
+		UploadId: aws.String(u.uploadID),
+	})
+	logger.Debug(fmt.Sprintf("S3Fs bucket: %#v", u.bucket), "", "multipart upload %#v for key %#v aborted, err: %v", u.uploadID, u.key, err)
+}
+
+// getPendingUploadKey returns the key for the interrupted uploads, they are keyed by
+// object and client, the client is identified by its endpoint and credentials
+func (fs S3Fs) getPendingUploadKey(name string) string {
+	return fmt.Sprintf("%v|%v|%v|%v", fs.config.Endpoint, fs.config.AccessKey, fs.config.Bucket, name)
+}
+
+// s3InflightParts counts the parts being uploaded, so a sync can wait for them
+type s3InflightParts struct {
+	sync.Mutex
+	cond  *sync.Cond
+	count int
+	// the first part upload error, if any
+	err error
+}
+
+func newS3InflightParts() *s3InflightParts {
+	p := &s3InflightParts{}
+	p.cond = sync.NewCond(&p.Mutex)
+	return p
+}
+
+func (p *s3InflightParts) add() {
+	p.Lock()
+	defer p.Unlock()
+	p.count++
+}
+
+func (p *s3InflightParts) done(err error) {
+	p.Lock()
+	defer p.Unlock()
+	p.count--
+	if err != nil && p.err == nil {
+		p.err = err
+	}
+	p.cond.Broadcast()
+}
+
+// wait waits until the parts being uploaded are completed and returns the first part upload error, if any
+func (p *s3InflightParts) wait() error {
+	p.Lock()
+	defer p.Unlock()
+	for p.count > 0 {
+		p.cond.Wait()
+	}
+	return p.err
+}
+
+// createResumable is like Create but the multipart upload state is preserved if the upload fails.
+// If flag contains os.O_APPEND the interrupted upload for name is resumed and the written data
+// are appended after the already uploaded parts
+func (fs S3Fs) createResumable(name string, flag int) (*os.File, PipeWriter, func(), error) {
+	key := fs.getPendingUploadKey(name)
+	var upload *s3PendingUpload
+	if flag&os.O_APPEND != 0 {
+		upload = pendingS3Uploads.remove(key)
+		if upload == nil {
+			return nil, nil, nil, errS3ResumeNotPossible
+		}
+	} else if old := pendingS3Uploads.remove(key); old != nil {
+		go old.abort()
+	}
+	r, w := newMemPipe(fs.config.UploadPartSize)
+	ctx, cancelFn := context.WithCancel(context.Background())
+	inflight := newS3InflightParts()
+	pipe := newPipeUpload(r, w)
+	pipe.flush = inflight.wait
+	go func() {
+		defer cancelFn()
+		isResume := upload != nil
+		pending, err := fs.uploadParts(ctx, name, pipe, upload, inflight)
+		if err != nil && pending != nil {
+			pending.updatedAt = time.Now()
+			pendingS3Uploads.add(key, pending)
+		}
+		pipe.finish(err)
+		fsLog(fs, logger.LevelDebug, "resumable upload completed, path: %#v, resume: %v, readed bytes: %v, err: %+v",
+			name, isResume, r.GetReadedBytes(), err)
+		metrics.S3TransferCompleted(r.GetReadedBytes(), 0, err)
+	}()
+	return nil, w, cancelFn, nil
+}
+
+// uploadParts uploads the content of r as parts of the given multipart upload, after the already
+// completed parts, and then completes the upload. A new multipart upload is created if upload is nil.
+// On error the returned upload, if not nil, contains the completed parts and can be resumed
+func (fs S3Fs) uploadParts(ctx context.Context, name string, r io.Reader, upload *s3PendingUpload,
+	inflight *s3InflightParts) (*s3PendingUpload, error) {
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var err error
+	var uploadErr error
+	completed := make(map[int64]*s3.CompletedPart)
+	sizes := make(map[int64]int64)
+	guard := make(chan bool, fs.config.UploadConcurrency)
+	partNumber := int64(0)
+	if upload != nil {
+		partNumber = int64(len(upload.parts))
+	}
+	for {
+		buf := make([]byte, fs.config.UploadPartSize)
+		n, readErr := io.ReadFull(r, buf)
+		if readErr == io.EOF && upload == nil {
+			// empty file, multipart uploads require at least a part
+			return nil, fs.putEmptyObject(ctx, name)
+		}
+		if n > 0 {
+			if upload == nil {
+				upload, err = fs.createMultipartUpload(ctx, name)
+				if err != nil {
+					return nil, err
+				}
+			}
+			partNumber++
+			guard <- true
+			wg.Add(1)
+			inflight.add()
+			go func(number int64, data []byte) {
+				var e error
+				defer func() {
+					<-guard
+					inflight.done(e)
+					wg.Done()
+				}()
+				var etag *string
+				etag, e = fs.uploadPart(ctx, upload, number, data)
+				lock.Lock()
+				defer lock.Unlock()
+				if e != nil {
+					if uploadErr == nil {
+						uploadErr = e
+					}
+					return
+				}
+				completed[number] = &s3.CompletedPart{ETag: etag, PartNumber: aws.Int64(number)}
+				sizes[number] = int64(len(data))
+			}(partNumber, buf[:n])
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+		if readErr != nil {
+			err = readErr
+			break
+		}
+		lock.Lock()
+		e := uploadErr
+		lock.Unlock()
+		if e != nil {
+			break
+		}
+	}
+	wg.Wait()
+	if upload == nil {
+		return nil, err
+	}
+	for number := int64(len(upload.parts)) + 1; ; number++ {
+		part, ok := completed[number]
+		if !ok {
+			break
+		}
+		upload.parts = append(upload.parts, part)
+		upload.size += sizes[number]
+	}
+	if err == nil {
+		err = uploadErr
+	}
+	if err == nil && ctx.Err() != nil {
+		// the transfer was aborted, the writer closed the pipe after the cancellation
+		err = ctx.Err()
+	}
+	if err == nil && int64(len(upload.parts)) != partNumber {
+		err = fmt.Errorf("unable to upload all the parts, completed: %v, expected: %v", len(upload.parts), partNumber)
+	}
+	if err != nil {
+		return upload, err
+	}
+	if err = fs.completeMultipartUpload(ctx, upload); err != nil {
+		return upload, err
+	}
+	return nil, nil
+}
+
+func (fs S3Fs) createMultipartUpload(ctx context.Context, name string) (*s3PendingUpload, error) {
+	res, err := fs.svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(fs.config.Bucket),
+		Key:          aws.String(name),
+		StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &s3PendingUpload{
+		svc:       fs.svc,
+		bucket:    fs.config.Bucket,
+		key:       name,
+		uploadID:  aws.StringValue(res.UploadId),
+		updatedAt: time.Now(),
+	}, nil
+}
+
+func (fs S3Fs) uploadPart(ctx context.Context, upload *s3PendingUpload, number int64, data []byte) (*string, error) {
+	res, err := fs.svc.UploadPartWithContext(ctx, &s3.UploadPartInput{
+		Bucket:     aws.String(upload.bucket),
+		Key:        aws.String(upload.key),
+		UploadId:   aws.String(upload.uploadID),
+		PartNumber: aws.Int64(number),
+		Body:       bytes.NewReader(data),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.ETag, nil
+}
+
+func (fs S3Fs) completeMultipartUpload(ctx context.Context, upload *s3PendingUpload) error {
+	_, err := fs.svc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(upload.bucket),
+		Key:      aws.String(upload.key),
+		UploadId: aws.String(upload.uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: upload.parts,
+		},
+	})
+	return err
+}
+
+func (fs S3Fs) putEmptyObject(ctx context.Context, name string) error {
+	_, err := fs.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:       aws.String(fs.config.Bucket),
+		Key:          aws.String(name),
+		Body:         bytes.NewReader(nil),
+		StorageClass: utils.NilIfEmpty(fs.config.StorageClass),
+	})
+	return err
+}
@@ -0,0 +1,386 @@
+package vfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/drakkan/sftpgo/kms"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/eikenb/pipeat"
+	"github.com/pkg/sftp"
+	"github.com/rs/xid"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// sftpFsName is the name for the SFTP Fs implementation
+	sftpFsName = "sftpfs"
+)
+
+// SFTPFsConfig defines the configuration for a SFTP based filesystem
+type SFTPFsConfig struct {
+	// remote SFTP server address as host:port
+	Endpoint string `json:"endpoint,omitempty"`
+	Username string `json:"username,omitempty"`
+	// Password and PrivateKey are stored encrypted (AES-256-GCM).
+	// At least one of them is required
+	Password   string `json:"password,omitempty"`
+	PrivateKey string `json:"private_key,omitempty"`
+	// SHA256 fingerprints to validate the remote server host key,
+	// for example "SHA256:...". At least one fingerprint is required
+	// unless AcceptAnyHostKey is set
+	Fingerprints []string `json:"fingerprints,omitempty"`
+	// AcceptAnyHostKey disables the host key validation if no fingerprint is
+	// provided, this is insecure and a warning is logged for each connection
+	AcceptAnyHostKey bool `json:"accept_any_host_key,omitempty"`
+	// Prefix is the remote directory to use as user's root directory.
+	// It must be an absolute path, if empty "/" will be used
+	Prefix string `json:"prefix,omitempty"`
+}
+
+// SFTPFs is a Fs implementation for SFTP backends
+type SFTPFs struct {
+	connectionID string
+	localTempDir string
+	config       SFTPFsConfig
+	sshClient    *ssh.Client
+	sftpClient   *sftp.Client
+}
+
+// NewSFTPFs returns an SFTPFs object that allows to interact with a remote SFTP server
+func NewSFTPFs(connectionID, localTempDir string, config SFTPFsConfig) (Fs, error) {
+	fs := SFTPFs{
+		connectionID: connectionID,
+		localTempDir: localTempDir,
+		config:       config,
+	}
+	if err := ValidateSFTPFsConfig(&fs.config); err != nil {
+		return fs, err
+	}
+	if len(fs.config.Password) > 0 {
+		password, err := kms.Decrypt(fs.config.Password)
+		if err != nil {
+			return fs, err
+		}
+		fs.config.Password = password
+	}
+	if len(fs.config.PrivateKey) > 0 {
+		privateKey, err := kms.Decrypt(fs.config.PrivateKey)
+		if err != nil {
+			return fs, err
+		}
+		fs.config.PrivateKey = privateKey
+	}
+	clientConfig := &ssh.ClientConfig{
+		User: fs.config.Username,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			fp := ssh.FingerprintSHA256(key)
+			if len(fs.config.Fingerprints) == 0 && fs.config.AcceptAnyHostKey {
+				fsLog(fs, logger.LevelWarn, "host key verification disabled, accepting host key %#v for %#v",
+					fp, fs.config.Endpoint)
+				return nil
+			}
+			if utils.IsStringInSlice(fp, fs.config.Fingerprints) {
+				return nil
+			}
+			return fmt.Errorf("invalid fingerprint %#v", fp)
+		},
+		ClientVersion: "SSH-2.0-SFTPGo",
+		Timeout:       10 * time.Second,
+	}
+	if len(fs.config.PrivateKey) > 0 {
+		signer, err := ssh.ParsePrivateKey([]byte(fs.config.PrivateKey))
+		if err != nil {
+			return fs, fmt.Errorf("invalid private key: %v", err)
+		}
+		clientConfig.Auth = append(clientConfig.Auth, ssh.PublicKeys(signer))
+	}
+	if len(fs.config.Password) > 0 {
+		clientConfig.Auth = append(clientConfig.Auth, ssh.Password(fs.config.Password))
+	}
+	sshClient, err := ssh.Dial("tcp", fs.config.Endpoint, clientConfig)
+	if err != nil {
+		return fs, err
+	}
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return fs, err
+	}
+	fs.sshClient = sshClient
+	fs.sftpClient = sftpClient
+	return fs, nil
+}
+
+// Name returns the name for the Fs implementation
+func (fs SFTPFs) Name() string {
+	return fmt.Sprintf("%v %#v", sftpFsName, fs.config.Endpoint)
+}
+
+// ConnectionID returns the SSH connection ID associated to this Fs implementation
+func (fs SFTPFs) ConnectionID() string {
+	return fs.connectionID
+}
+
+// Stat returns a FileInfo describing the named file
+func (fs SFTPFs) Stat(name string) (os.FileInfo, error) {
+	return fs.sftpClient.Stat(name)
+}
+
+// Lstat returns a FileInfo describing the named file
+func (fs SFTPFs) Lstat(name string) (os.FileInfo, error) {
+	return fs.sftpClient.Lstat(name)
+}
+
+// Open opens the named file for reading
+func (fs SFTPFs) Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error) {
+	r, w, err := pipeat.AsyncWriterPipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, err := fs.sftpClient.Open(name)
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+	go func() {
+		n, err := io.Copy(w, f)
+		w.CloseWithError(err)
+		f.Close()
+		fsLog(fs, logger.LevelDebug, "download completed, path: %#v size: %v, err: %v", name, n, err)
+	}()
+	return nil, r, nil, nil
+}
+
+// Create creates or opens the named file for writing
+func (fs SFTPFs) Create(name string, flag int) (*os.File, PipeWriter, func(), error) {
+	r, w, err := pipeat.PipeInDir(fs.localTempDir)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var f *sftp.File
+	if flag == 0 {
+		f, err = fs.sftpClient.Create(name)
+	} else {
+		f, err = fs.sftpClient.OpenFile(name, flag)
+	}
+	if err != nil {
+		r.Close()
+		w.Close()
+		return nil, nil, nil, err
+	}
+	upload := newPipeUpload(r, w)
+	go func() {
+		n, err := io.Copy(f, upload)
+		if errClose := f.Close(); err == nil {
+			err = errClose
+		}
+		upload.finish(err)
+		fsLog(fs, logger.LevelDebug, "upload completed, path: %#v, readed bytes: %v, err: %v", name, n, err)
+	}()
+	return nil, w, nil, nil
+}
+
+// Rename renames (moves) source to target
+func (fs SFTPFs) Rename(source, target string) error {
+	return fs.sftpClient.Rename(source, target)
+}
+
+// Remove removes the named file or (empty) directory.
+func (fs SFTPFs) Remove(name string, isDir bool) error {
+	if isDir {
+		return fs.sftpClient.RemoveDirectory(name)
+	}
+	return fs.sftpClient.Remove(name)
+}
+
+// Mkdir creates a new directory with the specified name and default permissions
+func (fs SFTPFs) Mkdir(name string) error {
+	return fs.sftpClient.Mkdir(name)
+}
+
+// Symlink creates source as a symbolic link to target.
+func (fs SFTPFs) Symlink(source, target string) error {
+	return fs.sftpClient.Symlink(source, target)
+}
+
+// Link creates target as a hard link to source.
+func (fs SFTPFs) Link(source, target string) error {
+	return fs.sftpClient.Link(source, target)
+}
+
+// Readlink returns the SFTP path for the destination of the named symbolic link.
+// Links pointing outside the configured prefix are not resolved
+func (fs SFTPFs) Readlink(name string) (string, error) {
+	p, err := fs.sftpClient.ReadLink(name)
+	if err != nil {
+		return p, err
+	}
+	if !path.IsAbs(p) {
+		p = path.Join(path.Dir(name), p)
+	}
+	p = path.Clean(p)
+	if fs.config.Prefix != "/" && p != fs.config.Prefix && !strings.HasPrefix(p, fs.config.Prefix+"/") {
+		fsLog(fs, logger.LevelWarn, "symlink %#v points outside the prefix %#v", name, fs.config.Prefix)
+		return "", os.ErrPermission
+	}
+	return fs.GetRelativePath(p), nil
+}
+
+// Chown changes the numeric uid and gid of the named file.
+func (fs SFTPFs) Chown(name string, uid int, gid int) error {
+	return fs.sftpClient.Chown(name, uid, gid)
+}
+
+// Chmod changes the mode of the named file to mode
+func (fs SFTPFs) Chmod(name string, mode os.FileMode) error {
+	return fs.sftpClient.Chmod(name, mode)
+}
+
+// Chtimes changes the access and modification times of the named file
+func (fs SFTPFs) Chtimes(name string, atime, mtime time.Time) error {
+	return fs.sftpClient.Chtimes(name, atime, mtime)
+}
+
+// ReadDir reads the directory named by dirname and returns
+// a list of directory entries.
+func (fs SFTPFs) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return fs.sftpClient.ReadDir(dirname)
+}
+
+// IsUploadResumeSupported returns true if upload resume is supported.
+// Upload resume is not supported on SFTP backends since the writes
+// to the remote server are sequential
+func (SFTPFs) IsUploadResumeSupported() bool {
+	return false
+}
+
+// SetFileChecksum stores the SHA-256 checksum for the named file.
+// Not supported on SFTP backends
+func (SFTPFs) SetFileChecksum(name, checksum string) error {
+	return ErrChecksumNotSupported
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file.
+// Not supported on SFTP backends
+func (SFTPFs) GetFileChecksum(name string) (string, error) {
+	return "", ErrChecksumNotSupported
+}
+
+// IsAtomicUploadSupported returns true if atomic upload is supported.
+// Uploads to SFTP backends are streamed to the final path
+func (SFTPFs) IsAtomicUploadSupported() bool {
+	return false
+}
+
+// IsNotExist returns a boolean indicating whether the error is known to
+// report that a file or directory does not exist
+func (SFTPFs) IsNotExist(err error) bool {
+	return os.IsNotExist(err)
+}
+
+// IsPermission returns a boolean indicating whether the error is known to
+// report that permission is denied.
+func (SFTPFs) IsPermission(err error) bool {
+	if statusErr, ok := err.(*sftp.StatusError); ok {
+		return statusErr.Code == 3 // ssh_FX_PERMISSION_DENIED
+	}
+	return os.IsPermission(err)
+}
+
+// CheckRootPath creates the root directory if it does not exists
+func (fs SFTPFs) CheckRootPath(username string, uid int, gid int) bool {
+	// we need a local directory for temporary files
+	osFs := NewOsFs(fs.ConnectionID(), fs.localTempDir, nil)
+	osFs.CheckRootPath(username, uid, gid)
+	if fs.config.Prefix == "/" {
+		return true
+	}
+	_, err := fs.Stat(fs.config.Prefix)
+	if fs.IsNotExist(err) {
+		err = fs.sftpClient.MkdirAll(fs.config.Prefix)
+		fsLog(fs, logger.LevelDebug, "root directory %#v for user %#v does not exist, try to create, mkdir error: %v",
+			fs.config.Prefix, username, err)
+	}
+	return err == nil
+}
+
+// ScanRootDirContents returns the number of files contained in the root
+// directory and their size
+func (fs SFTPFs) ScanRootDirContents() (int, int64, error) {
+	numFiles := 0
+	size := int64(0)
+	walker := fs.sftpClient.Walk(fs.config.Prefix)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return numFiles, size, err
+		}
+		info := walker.Stat()
+		if info != nil && info.Mode().IsRegular() {
+			size += info.Size()
+			numFiles++
+		}
+	}
+	return numFiles, size, nil
+}
+
+// GetAtomicUploadPath returns the path to use for an atomic upload
+func (SFTPFs) GetAtomicUploadPath(name string) string {
+	dir := path.Dir(name)
+	guid := xid.New().String()
+	return path.Join(dir, atomicUploadPrefix+guid+"."+path.Base(name))
+}
+
+// GetRelativePath returns the path for a file relative to the user's home dir.
+// This is the path as seen by SFTP users
+func (fs SFTPFs) GetRelativePath(name string) string {
+	rel := path.Clean(name)
+	if rel == "." {
+		rel = ""
+	}
+	if fs.config.Prefix != "/" {
+		if rel != fs.config.Prefix && !strings.HasPrefix(rel, fs.config.Prefix+"/") {
+			rel = ""
+		} else {
+			rel = strings.TrimPrefix(rel, fs.config.Prefix)
+		}
+	}
+	return path.Join("/", rel)
+}
+
+// Join joins any number of path elements into a single path
+func (SFTPFs) Join(elem ...string) string {
+	return path.Join(elem...)
+}
+
+// ResolvePath returns the matching filesystem path for the specified sftp path.
+// Symbolic links are resolved by the remote server, the account used to
+// connect to it should be restricted to avoid to follow links outside
+// the configured prefix
+func (fs SFTPFs) ResolvePath(sftpPath string) (string, error) {
+	if !path.IsAbs(fs.config.Prefix) {
+		return "", fmt.Errorf("Invalid prefix: %v", fs.config.Prefix)
+	}
+	return path.Join(fs.config.Prefix, utils.CleanSFTPPath(sftpPath)), nil
+}
+
+// Close closes the connection to the remote SFTP server
+func (fs SFTPFs) Close() error {
+	if fs.sftpClient == nil {
+		return errors.New("sftp client not connected")
+	}
+	err := fs.sftpClient.Close()
+	if errSSH := fs.sshClient.Close(); err == nil {
+		err = errSSH
+	}
+	fsLog(fs, logger.LevelDebug, "connection to %#v closed, err: %v", fs.config.Endpoint, err)
+	return err
+}
@@ -4,17 +4,48 @@ package vfs
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"os"
 	"path"
 	"runtime"
 	"strings"
 	"time"
 
+	"github.com/drakkan/sftpgo/kms"
 	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
 	"github.com/eikenb/pipeat"
 	"github.com/pkg/sftp"
+	"github.com/rs/xid"
 )
 
+const (
+	// metadata key for the SHA-256 checksum stored for the uploaded files
+	checksumMetadataKey = "sftpgo-sha256"
+	// Azure Blob metadata keys must be valid C# identifiers
+	azChecksumMetadataKey = "sftpgo_sha256"
+	// extended attribute for the SHA-256 checksum on the local filesystem
+	checksumXattrName = "user.sftpgo.sha256"
+	// prefix for the temporary files used for atomic uploads, it is followed by
+	// a unique id, a dot and the name of the uploaded file
+	atomicUploadPrefix = ".sftpgo-upload."
+)
+
+// ErrChecksumNotSupported is returned if storing file checksums is not supported
+var ErrChecksumNotSupported = errors.New("storing file checksums is not supported")
+
+// PipeWriter is the writer side of the pipe returned by Create for the backends that
+// upload the written data while the transfer is in progress. Close waits for the upload end
+type PipeWriter interface {
+	io.Writer
+	io.WriterAt
+	io.Closer
+	CloseWithError(err error) error
+	GetWrittenBytes() int64
+}
+
 // Fs defines the interface for filesystem backends
 type Fs interface {
 	Name() string
@@ -22,17 +53,21 @@ type Fs interface {
 	Stat(name string) (os.FileInfo, error)
 	Lstat(name string) (os.FileInfo, error)
 	Open(name string) (*os.File, *pipeat.PipeReaderAt, func(), error)
-	Create(name string, flag int) (*os.File, *pipeat.PipeWriterAt, func(), error)
+	Create(name string, flag int) (*os.File, PipeWriter, func(), error)
 	Rename(source, target string) error
 	Remove(name string, isDir bool) error
 	Mkdir(name string) error
 	Symlink(source, target string) error
+	Link(source, target string) error
+	Readlink(name string) (string, error)
 	Chown(name string, uid int, gid int) error
 	Chmod(name string, mode os.FileMode) error
 	Chtimes(name string, atime, mtime time.Time) error
 	ReadDir(dirname string) ([]os.FileInfo, error)
 	IsUploadResumeSupported() bool
 	IsAtomicUploadSupported() bool
+	SetFileChecksum(name, checksum string) error
+	GetFileChecksum(name string) (string, error)
 	CheckRootPath(username string, uid int, gid int) bool
 	ResolvePath(sftpPath string) (string, error)
 	IsNotExist(err error) bool
@@ -41,6 +76,23 @@ type Fs interface {
 	GetAtomicUploadPath(name string) string
 	GetRelativePath(name string) string
 	Join(elem ...string) string
+	Close() error
+}
+
+// GetAtomicUploadTarget returns the file name the given temporary file name, generated for an atomic
+// upload, will be renamed to. The second return value is false if the name is not an atomic upload one
+func GetAtomicUploadTarget(name string) (string, bool) {
+	if !strings.HasPrefix(name, atomicUploadPrefix) {
+		return "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(name, atomicUploadPrefix), ".", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", false
+	}
+	if _, err := xid.FromString(parts[0]); err != nil {
+		return "", false
+	}
+	return parts[1], true
 }
 
 // VirtualFolder defines a mapping between a SFTP/SCP virtual path and a
@@ -49,9 +101,12 @@ type Fs interface {
 // it must be a sub directory. The parent directory for the specified virtual
 // path must exist. SFTPGo will try to automatically create any missing
 // parent directory for the configured virtual folders at user login.
+// If ExcludeFromQuota is true the files inside the mapped path are not included
+// in the user quota and they are ignored by the quota scans.
 type VirtualFolder struct {
-	VirtualPath string `json:"virtual_path"`
-	MappedPath  string `json:"mapped_path"`
+	VirtualPath      string `json:"virtual_path"`
+	MappedPath       string `json:"mapped_path"`
+	ExcludeFromQuota bool   `json:"exclude_from_quota"`
 }
 
 // IsDirectory checks if a path exists and is a directory
@@ -138,13 +193,82 @@ func ValidateGCSFsConfig(config *GCSFsConfig, credentialsFilePath string) error
 	return nil
 }
 
+// ValidateAzBlobFsConfig returns nil if the specified Azure Blob config is valid, otherwise an error
+func ValidateAzBlobFsConfig(config *AzBlobFsConfig) error {
+	if len(config.SASURL) > 0 {
+		// an encrypted SAS URL is validated after decryption
+		if !kms.IsEncrypted(config.SASURL) {
+			if _, err := url.Parse(config.SASURL); err != nil {
+				return fmt.Errorf("invalid SAS URL: %v", err)
+			}
+		}
+	} else {
+		if len(config.Container) == 0 {
+			return errors.New("container cannot be empty")
+		}
+		if len(config.AccountName) == 0 || len(config.AccountKey) == 0 {
+			return errors.New("credentials cannot be empty")
+		}
+	}
+	if len(config.KeyPrefix) > 0 {
+		if strings.HasPrefix(config.KeyPrefix, "/") {
+			return errors.New("key_prefix cannot start with /")
+		}
+		config.KeyPrefix = path.Clean(config.KeyPrefix)
+		if !strings.HasSuffix(config.KeyPrefix, "/") {
+			config.KeyPrefix += "/"
+		}
+	}
+	if config.UploadPartSize < 0 {
+		return fmt.Errorf("invalid upload part size: %v", config.UploadPartSize)
+	}
+	if config.UploadConcurrency < 0 {
+		return fmt.Errorf("invalid upload concurrency: %v", config.UploadConcurrency)
+	}
+	if len(config.AccessTier) > 0 && !utils.IsStringInSlice(config.AccessTier, []string{"Archive", "Hot", "Cool"}) {
+		return fmt.Errorf("invalid access tier %#v, valid values: Archive, Hot, Cool", config.AccessTier)
+	}
+	return nil
+}
+
+// ValidateSFTPFsConfig returns nil if the specified SFTP config is valid
+// otherwise an error
+func ValidateSFTPFsConfig(config *SFTPFsConfig) error {
+	if len(config.Endpoint) == 0 {
+		return errors.New("endpoint cannot be empty")
+	}
+	if _, _, err := net.SplitHostPort(config.Endpoint); err != nil {
+		return fmt.Errorf("invalid endpoint %#v: %v", config.Endpoint, err)
+	}
+	if len(config.Username) == 0 {
+		return errors.New("username cannot be empty")
+	}
+	if len(config.Password) == 0 && len(config.PrivateKey) == 0 {
+		return errors.New("credentials cannot be empty")
+	}
+	if len(config.Prefix) == 0 {
+		config.Prefix = "/"
+	}
+	if !path.IsAbs(config.Prefix) {
+		return fmt.Errorf("invalid prefix %#v: it must be an absolute path", config.Prefix)
+	}
+	config.Prefix = path.Clean(config.Prefix)
+	if len(config.Fingerprints) == 0 && !config.AcceptAnyHostKey {
+		return errors.New("at least one fingerprint is required to validate the remote host key")
+	}
+	for _, fp := range config.Fingerprints {
+		if !strings.HasPrefix(fp, "SHA256:") {
+			return fmt.Errorf("invalid fingerprint %#v, only SHA256 fingerprints are supported", fp)
+		}
+	}
+	return nil
+}
+
 // SetPathPermissions calls fs.Chown.
-// It does nothing for local filesystem on windows
+// It does nothing for local filesystem on windows and for remote filesystems
 func SetPathPermissions(fs Fs, path string, uid int, gid int) {
-	if IsLocalOsFs(fs) {
-		if runtime.GOOS == "windows" {
-			return
-		}
+	if !IsLocalOsFs(fs) || runtime.GOOS == "windows" {
+		return
 	}
 	if err := fs.Chown(path, uid, gid); err != nil {
 		fsLog(fs, logger.LevelWarn, "error chowning path %v: %v", path, err)
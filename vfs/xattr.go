@@ -0,0 +1,36 @@
+// +build linux darwin freebsd
+
+package vfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SetFileChecksum stores the SHA-256 checksum for the named file as an extended
+// attribute. An empty checksum removes the stored one
+func (OsFs) SetFileChecksum(name, checksum string) error {
+	if len(checksum) == 0 {
+		err := unix.Removexattr(name, checksumXattrName)
+		if err != nil && os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return unix.Setxattr(name, checksumXattrName, []byte(checksum), 0)
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file, if any
+func (OsFs) GetFileChecksum(name string) (string, error) {
+	buf := make([]byte, 128)
+	n, err := unix.Getxattr(name, checksumXattrName, buf)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", err
+		}
+		// the attribute does not exist or extended attributes are not supported
+		return "", nil
+	}
+	return string(buf[:n]), nil
+}
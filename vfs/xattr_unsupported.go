@@ -0,0 +1,15 @@
+// +build !linux,!darwin,!freebsd
+
+package vfs
+
+// SetFileChecksum stores the SHA-256 checksum for the named file.
+// Extended attributes are not supported on this OS
+func (OsFs) SetFileChecksum(name, checksum string) error {
+	return ErrChecksumNotSupported
+}
+
+// GetFileChecksum returns the SHA-256 checksum stored for the named file.
+// Extended attributes are not supported on this OS
+func (OsFs) GetFileChecksum(name string) (string, error) {
+	return "", ErrChecksumNotSupported
+}
@@ -0,0 +1,536 @@
+package webdavd
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+var (
+	errQuotaExceeded = errors.New("denying write due to space limit")
+	errIsDirectory   = errors.New("is a directory")
+	errNotDirectory  = errors.New("not a directory")
+	errDisconnected  = errors.New("connection closed")
+)
+
+// Connection details for a WebDAV request.
+// It implements the webdav.FileSystem interface using the user's filesystem
+type Connection struct {
+	// Unique identifier for the connection
+	ID string
+	// logged in user's details
+	User dataprovider.User
+	// client's user agent
+	ClientVersion string
+	// Remote address for this connection
+	RemoteAddr net.Addr
+	// start time for this connection
+	StartTime    time.Time
+	lastActivity time.Time
+	fs           vfs.Fs
+	ctx          context.Context
+	cancelFn     func()
+	transfers    []*webDavFile
+	lock         *sync.Mutex
+}
+
+// Log outputs a log entry to the configured logger
+func (c *Connection) Log(level logger.LogLevel, sender string, format string, v ...interface{}) {
+	logger.Log(level, sender, c.ID, format, v...)
+}
+
+func (c *Connection) getRemoteIP() string {
+	if c.RemoteAddr == nil {
+		return ""
+	}
+	return utils.GetIPFromRemoteAddress(c.RemoteAddr.String())
+}
+
+// GetID returns the connection identifier
+func (c *Connection) GetID() string {
+	return c.ID
+}
+
+// GetUsername returns the authenticated username
+func (c *Connection) GetUsername() string {
+	return c.User.Username
+}
+
+// GetClientVersion returns the client's user agent
+func (c *Connection) GetClientVersion() string {
+	return c.ClientVersion
+}
+
+// GetRemoteAddress returns the remote address for this connection
+func (c *Connection) GetRemoteAddress() net.Addr {
+	return c.RemoteAddr
+}
+
+// GetProtocol returns the protocol for this connection
+func (c *Connection) GetProtocol() string {
+	return protocolWebDAV
+}
+
+// GetConnectionTime returns the connection start time
+func (c *Connection) GetConnectionTime() time.Time {
+	return c.StartTime
+}
+
+// GetLastActivity returns the last activity for this connection,
+// the activity on the active transfers, if any, is considered too
+func (c *Connection) GetLastActivity() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	lastActivity := c.lastActivity
+	for _, t := range c.transfers {
+		if stats := t.getStats(); stats.LastActivity > utils.GetTimeAsMsSinceEpoch(lastActivity) {
+			lastActivity = utils.GetTimeFromMsecSinceEpoch(stats.LastActivity)
+		}
+	}
+	return lastActivity
+}
+
+// GetUploadBandwidth returns the upload bandwidth limit, as KB/s, for this connection
+func (c *Connection) GetUploadBandwidth() int64 {
+	return c.User.UploadBandwidth
+}
+
+// GetDownloadBandwidth returns the download bandwidth limit, as KB/s, for this connection
+func (c *Connection) GetDownloadBandwidth() int64 {
+	return c.User.DownloadBandwidth
+}
+
+// GetTransfers returns the active transfers
+func (c *Connection) GetTransfers() []sftpd.ConnectionTransfer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	transfers := []sftpd.ConnectionTransfer{}
+	for _, t := range c.transfers {
+		stats := t.getStats()
+		stats.Path = c.fs.GetRelativePath(t.fsPath)
+		transfers = append(transfers, stats)
+	}
+	return transfers
+}
+
+// Disconnect aborts the running request, the transfers in progress will fail
+func (c *Connection) Disconnect() error {
+	c.cancelFn()
+	return nil
+}
+
+func (c *Connection) isDisconnected() bool {
+	return c.ctx.Err() != nil
+}
+
+// auditPermissionDenied emits a permission denied audit event if the operation was denied
+func (c *Connection) auditPermissionDenied(operation, name, target string, err error) {
+	if err != os.ErrPermission {
+		return
+	}
+	audit.Log(audit.Event{
+		Event:        audit.EventPermissionDenied,
+		Username:     c.User.Username,
+		Protocol:     protocolWebDAV,
+		ConnectionID: c.ID,
+		RemoteIP:     c.getRemoteIP(),
+		Path:         name,
+		TargetPath:   target,
+		Operation:    operation,
+	})
+}
+
+func (c *Connection) updateActivity() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.lastActivity = time.Now()
+}
+
+func (c *Connection) addTransfer(t *webDavFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.transfers = append(c.transfers, t)
+}
+
+func (c *Connection) removeTransfer(t *webDavFile) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for idx, transfer := range c.transfers {
+		if transfer == t {
+			c.transfers = append(c.transfers[:idx], c.transfers[idx+1:]...)
+			break
+		}
+	}
+}
+
+// getFsError converts the filesystem specific errors to the os ones,
+// so the webdav handler can return the proper HTTP status codes
+func (c *Connection) getFsError(err error) error {
+	if c.fs.IsNotExist(err) {
+		return os.ErrNotExist
+	}
+	if c.fs.IsPermission(err) {
+		return os.ErrPermission
+	}
+	return err
+}
+
+// Mkdir creates a directory, it is required by the webdav.FileSystem interface
+func (c *Connection) Mkdir(ctx context.Context, name string, perm os.FileMode) (err error) {
+	c.updateActivity()
+	defer func() { c.auditPermissionDenied("Mkdir", name, "", err) }()
+	name = utils.CleanSFTPPath(name)
+	if !c.User.HasPerm(dataprovider.PermCreateDirs, path.Dir(name)) {
+		return os.ErrPermission
+	}
+	if c.User.IsVirtualFolder(name) {
+		c.Log(logger.LevelWarn, logSender, "mkdir not allowed %#v is virtual folder is not allowed", name)
+		return os.ErrPermission
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	if err = c.fs.Mkdir(p); err != nil {
+		c.Log(logger.LevelWarn, logSender, "error creating dir: %#v error: %+v", p, err)
+		return c.getFsError(err)
+	}
+	vfs.SetPathPermissions(c.fs, p, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog(mkdirLogSender, p, "", c.User.Username, "", c.ID, protocolWebDAV, -1, -1, "", "", "")
+	return nil
+}
+
+// Stat returns the info for the given path, it is required by the webdav.FileSystem interface
+func (c *Connection) Stat(ctx context.Context, name string) (info os.FileInfo, err error) {
+	c.updateActivity()
+	defer func() { c.auditPermissionDenied("Stat", name, "", err) }()
+	name = utils.CleanSFTPPath(name)
+	if !c.User.HasPerm(dataprovider.PermListItems, path.Dir(name)) {
+		return nil, os.ErrPermission
+	}
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		return nil, c.getFsError(err)
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "error running stat on path %#v: %+v", p, err)
+		return nil, c.getFsError(err)
+	}
+	return fi, nil
+}
+
+// OpenFile opens the given path for reading or writing, it is required by the webdav.FileSystem interface.
+// For downloads the underlying file is opened on the first read, this way
+// PROPFIND requests don't start any transfer
+func (c *Connection) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (file webdav.File, err error) {
+	c.updateActivity()
+	defer func() { c.auditPermissionDenied("OpenFile", name, "", err) }()
+	name = utils.CleanSFTPPath(name)
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		return nil, c.getFsError(err)
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 && flag&os.O_CREATE != 0 {
+		return c.handleUpload(name, p)
+	}
+	fi, err := c.fs.Stat(p)
+	if err != nil {
+		c.Log(logger.LevelDebug, logSender, "error running stat on path %#v: %+v", p, err)
+		return nil, c.getFsError(err)
+	}
+	return newWebDavFile(c, name, p, fi, transferDownload), nil
+}
+
+// RemoveAll removes the given file or directory, directories are removed recursively.
+// It is required by the webdav.FileSystem interface
+func (c *Connection) RemoveAll(ctx context.Context, name string) (err error) {
+	c.updateActivity()
+	defer func() { c.auditPermissionDenied("RemoveAll", name, "", err) }()
+	name = utils.CleanSFTPPath(name)
+	p, err := c.fs.ResolvePath(name)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	if c.fs.GetRelativePath(p) == "/" {
+		c.Log(logger.LevelWarn, logSender, "removing root dir is not allowed")
+		return os.ErrPermission
+	}
+	fi, err := c.fs.Lstat(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove %#v: stat error: %+v", p, err)
+		return c.getFsError(err)
+	}
+	if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+		return c.removeDir(name, p)
+	}
+	return c.removeFile(name, p, fi)
+}
+
+func (c *Connection) removeDir(name, p string) error {
+	if c.User.IsVirtualFolder(name) {
+		c.Log(logger.LevelWarn, logSender, "removing a virtual folder is not allowed: %#v", name)
+		return os.ErrPermission
+	}
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(name)) {
+		return os.ErrPermission
+	}
+	files, err := c.fs.ReadDir(p)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error listing directory %#v to remove: %+v", p, err)
+		return c.getFsError(err)
+	}
+	for _, fi := range files {
+		childName := path.Join(name, fi.Name())
+		childPath := c.fs.Join(p, fi.Name())
+		if fi.IsDir() && fi.Mode()&os.ModeSymlink != os.ModeSymlink {
+			err = c.removeDir(childName, childPath)
+		} else {
+			err = c.removeFile(childName, childPath, fi)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err = c.fs.Remove(p, true); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove directory %#v: %+v", p, err)
+		return c.getFsError(err)
+	}
+	logger.CommandLog(rmdirLogSender, p, "", c.User.Username, "", c.ID, protocolWebDAV, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolWebDAV, c.ID, c.getRemoteIP(), p, "")
+	return nil
+}
+
+func (c *Connection) removeFile(name, p string, fi os.FileInfo) error {
+	if !c.User.HasPerm(dataprovider.PermDelete, path.Dir(name)) {
+		return os.ErrPermission
+	}
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelDebug, logSender, "removing file %#v is not allowed", p)
+		return os.ErrPermission
+	}
+	if err := c.fs.Remove(p, false); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to remove a file/symlink %#v: %+v", p, err)
+		return c.getFsError(err)
+	}
+	logger.CommandLog(removeLogSender, p, "", c.User.Username, "", c.ID, protocolWebDAV, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventDelete, c.User.Username, protocolWebDAV, c.ID, c.getRemoteIP(), p, "")
+	if fi.Mode()&os.ModeSymlink != os.ModeSymlink && !c.User.IsFileExcludedFromQuota(p) {
+		dataprovider.UpdateUserQuota(dataProvider, c.User, -1, -fi.Size(), false)
+	}
+	go sftpd.ExecuteAction(operationDelete, c.User.Username, p, "", fi.Size(), vfs.IsLocalOsFs(c.fs))
+	return nil
+}
+
+// Rename renames a file or a directory, it is required by the webdav.FileSystem interface
+func (c *Connection) Rename(ctx context.Context, oldName, newName string) (err error) {
+	c.updateActivity()
+	defer func() { c.auditPermissionDenied("Rename", oldName, newName, err) }()
+	oldName = utils.CleanSFTPPath(oldName)
+	newName = utils.CleanSFTPPath(newName)
+	sourcePath, err := c.fs.ResolvePath(oldName)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	targetPath, err := c.fs.ResolvePath(newName)
+	if err != nil {
+		return c.getFsError(err)
+	}
+	if c.fs.GetRelativePath(sourcePath) == "/" {
+		c.Log(logger.LevelWarn, logSender, "renaming root dir is not allowed")
+		return os.ErrPermission
+	}
+	if c.User.IsVirtualFolder(oldName) || c.User.IsVirtualFolder(newName) {
+		c.Log(logger.LevelWarn, logSender, "renaming a virtual folder is not allowed")
+		return os.ErrPermission
+	}
+	if !c.User.IsFileAllowed(oldName) || !c.User.IsFileAllowed(newName) {
+		if fi, err := c.fs.Lstat(sourcePath); err == nil && fi.Mode().IsRegular() {
+			c.Log(logger.LevelDebug, logSender, "renaming file is not allowed, source: %#v target: %#v", oldName, newName)
+			return os.ErrPermission
+		}
+	}
+	if !c.User.HasPerm(dataprovider.PermRename, path.Dir(newName)) {
+		return os.ErrPermission
+	}
+	// renaming a file from or to a virtual folder excluded from the quota changes the used quota
+	var quotaFileInfo os.FileInfo
+	if c.User.IsFileExcludedFromQuota(sourcePath) != c.User.IsFileExcludedFromQuota(targetPath) {
+		fi, err := c.fs.Lstat(sourcePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "failed to rename %#v: stat error: %+v", sourcePath, err)
+			return c.getFsError(err)
+		}
+		if fi.IsDir() {
+			c.Log(logger.LevelDebug, logSender, "renaming a directory between folders with different quota settings is not allowed, "+
+				"source: %#v target: %#v", oldName, newName)
+			return os.ErrPermission
+		}
+		quotaFileInfo = fi
+	}
+	if err = c.fs.Rename(sourcePath, targetPath); err != nil {
+		c.Log(logger.LevelWarn, logSender, "failed to rename file, source: %#v target: %#v: %+v", sourcePath, targetPath, err)
+		return c.getFsError(err)
+	}
+	vfs.SetPathPermissions(c.fs, targetPath, c.User.GetUID(), c.User.GetGID())
+	logger.CommandLog(renameLogSender, sourcePath, targetPath, c.User.Username, "", c.ID, protocolWebDAV, -1, -1, "", "", "")
+	audit.LogOperation(audit.EventRename, c.User.Username, protocolWebDAV, c.ID, c.getRemoteIP(), sourcePath, targetPath)
+	if quotaFileInfo != nil && quotaFileInfo.Mode().IsRegular() {
+		dataprovider.UpdateUserQuotaForRename(dataProvider, c.User, sourcePath, targetPath, quotaFileInfo.Size())
+	}
+	go sftpd.ExecuteAction(operationRename, c.User.Username, sourcePath, targetPath, 0, vfs.IsLocalOsFs(c.fs))
+	return nil
+}
+
+func (c *Connection) handleUpload(name, p string) (webdav.File, error) {
+	if !c.User.IsFileAllowed(name) {
+		c.Log(logger.LevelWarn, logSender, "writing file %#v is not allowed", name)
+		return nil, os.ErrPermission
+	}
+	filePath := p
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		filePath = c.fs.GetAtomicUploadPath(p)
+	}
+	stat, statErr := c.fs.Stat(p)
+	if c.fs.IsNotExist(statErr) {
+		if !c.User.HasPerm(dataprovider.PermUpload, path.Dir(name)) {
+			return nil, os.ErrPermission
+		}
+		return c.handleUploadToNewFile(name, p, filePath)
+	}
+	if statErr != nil {
+		c.Log(logger.LevelError, logSender, "error performing file stat %#v: %+v", p, statErr)
+		return nil, c.getFsError(statErr)
+	}
+	if stat.IsDir() {
+		c.Log(logger.LevelWarn, logSender, "attempted to open a directory for writing to: %#v", p)
+		return nil, errIsDirectory
+	}
+	if !c.User.HasPerm(dataprovider.PermOverwrite, path.Dir(name)) {
+		return nil, os.ErrPermission
+	}
+	return c.handleUploadToExistingFile(name, p, filePath, stat.Size())
+}
+
+func (c *Connection) handleUploadToNewFile(name, requestPath, filePath string) (webdav.File, error) {
+	if !c.hasSpace(true, requestPath) {
+		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
+		return nil, errQuotaExceeded
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, 0)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error creating file %#v: %+v", requestPath, err)
+		return nil, c.getFsError(err)
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	t := newWebDavFile(c, name, requestPath, nil, transferUpload)
+	t.maxDataTransfer = maxDataTransfer
+	t.setUploadFile(file, w, cancelFn, true, 0)
+	return t, nil
+}
+
+func (c *Connection) handleUploadToExistingFile(name, requestPath, filePath string, fileSize int64) (webdav.File, error) {
+	var err error
+	if !c.hasSpace(false, requestPath) {
+		c.Log(logger.LevelInfo, logSender, "denying file write due to space limit")
+		return nil, errQuotaExceeded
+	}
+	maxDataTransfer, err := c.getMaxDataTransfer(true)
+	if err != nil {
+		return nil, err
+	}
+	if sftpd.GetUserUploadMode(c.User) != 0 && c.fs.IsAtomicUploadSupported() {
+		err = c.fs.Rename(requestPath, filePath)
+		if err != nil {
+			c.Log(logger.LevelWarn, logSender, "error renaming existing file for atomic upload, source: %#v, dest: %#v, err: %+v",
+				requestPath, filePath, err)
+			return nil, c.getFsError(err)
+		}
+	}
+	file, w, cancelFn, err := c.fs.Create(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		c.Log(logger.LevelWarn, logSender, "error opening existing file, source: %#v, err: %+v", filePath, err)
+		return nil, c.getFsError(err)
+	}
+	initialSize := int64(0)
+	if vfs.IsLocalOsFs(c.fs) {
+		if !c.User.IsFileExcludedFromQuota(requestPath) {
+			dataprovider.UpdateUserQuota(dataProvider, c.User, 0, -fileSize, false)
+		}
+	} else {
+		initialSize = fileSize
+	}
+	vfs.SetPathPermissions(c.fs, filePath, c.User.GetUID(), c.User.GetGID())
+	t := newWebDavFile(c, name, requestPath, nil, transferUpload)
+	t.maxDataTransfer = maxDataTransfer
+	t.setUploadFile(file, w, cancelFn, false, initialSize)
+	return t, nil
+}
+
+func (c *Connection) hasSpace(checkFiles bool, fsPath string) bool {
+	if c.User.IsFileExcludedFromQuota(fsPath) {
+		return true
+	}
+	if (checkFiles && c.User.QuotaFiles > 0) || c.User.QuotaSize > 0 {
+		numFile, size, err := dataprovider.GetUsedQuota(dataProvider, c.User.Username)
+		if err != nil {
+			if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+				c.Log(logger.LevelWarn, logSender, "quota enforcement not possible for user %#v: %v", c.User.Username, err)
+				return true
+			}
+			c.Log(logger.LevelWarn, logSender, "error getting used quota for %#v: %v", c.User.Username, err)
+			return false
+		}
+		if (checkFiles && c.User.QuotaFiles > 0 && numFile >= c.User.QuotaFiles) ||
+			(c.User.QuotaSize > 0 && size >= c.User.QuotaSize) {
+			c.Log(logger.LevelDebug, logSender, "quota exceed for user %#v, num files: %v/%v, size: %v/%v check files: %v",
+				c.User.Username, numFile, c.User.QuotaFiles, size, c.User.QuotaSize, checkFiles)
+			return false
+		}
+	}
+	return true
+}
+
+// getMaxDataTransfer returns the data transfer, as bytes, still allowed for a new upload or download,
+// 0 means no limit. An error is returned if the data transfer quota is exceeded
+func (c *Connection) getMaxDataTransfer(isUpload bool) (int64, error) {
+	if !c.User.HasDataTransferRestrictions() {
+		return 0, nil
+	}
+	remaining, err := dataprovider.GetRemainingDataTransfer(dataProvider, c.User, isUpload)
+	if err != nil {
+		if _, ok := err.(*dataprovider.MethodDisabledError); ok {
+			c.Log(logger.LevelWarn, logSender, "data transfer quota enforcement not possible for user %#v: %v",
+				c.User.Username, err)
+			return 0, nil
+		}
+		c.Log(logger.LevelWarn, logSender, "error getting used data transfer for %#v: %v", c.User.Username, err)
+		return 0, err
+	}
+	if remaining == 0 {
+		c.Log(logger.LevelInfo, logSender, "data transfer quota exceeded for user %#v, is upload? %v", c.User.Username,
+			isUpload)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if remaining < 0 {
+		return 0, nil
+	}
+	return remaining, nil
+}
@@ -0,0 +1,456 @@
+package webdavd
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/eikenb/pipeat"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/bandwidth"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+	"github.com/drakkan/sftpgo/vfs"
+)
+
+const (
+	transferUpload = iota
+	transferDownload
+)
+
+const (
+	// same values as the SFTP upload modes
+	uploadModeAtomicWithResume = 2
+)
+
+var (
+	errTransferClosed            = errors.New("transfer already closed")
+	errSeekNotSupported          = errors.New("seek is not supported for uploads")
+	errInvalidSeekPosition       = errors.New("invalid seek position")
+	errDataTransferQuotaExceeded = errors.New("denying transfer due to data transfer quota limit")
+	errUploadFileSizeExceeded    = errors.New("denying write due to maximum upload file size limit")
+)
+
+// webDavFile implements the webdav.File interface.
+// A download is started on the first read and an upload when the file is opened,
+// the transfer ends when the file is closed
+type webDavFile struct {
+	connection    *Connection
+	name          string
+	fsPath        string
+	info          os.FileInfo
+	transferType  int
+	file          *os.File
+	writerAt      vfs.PipeWriter
+	readerAt      *pipeat.PipeReaderAt
+	cancelFn      func()
+	isTransfer    bool
+	start         time.Time
+	lastActivity  time.Time
+	bytesSent     int64
+	bytesReceived int64
+	readOffset    int64
+	isNewFile     bool
+	initialSize   int64
+	transferError error
+	isFinished    bool
+	dirContents   []os.FileInfo
+	dirOffset     int
+	// data transfer, as bytes, allowed for this transfer, 0 means no limit
+	maxDataTransfer int64
+	// checksum for the uploads, nil if disabled
+	checksum *sftpd.UploadChecksum
+	lock     *sync.Mutex
+}
+
+func newWebDavFile(connection *Connection, name, fsPath string, info os.FileInfo, transferType int) *webDavFile {
+	return &webDavFile{
+		connection:   connection,
+		name:         name,
+		fsPath:       fsPath,
+		info:         info,
+		transferType: transferType,
+		lock:         new(sync.Mutex),
+	}
+}
+
+func (f *webDavFile) setUploadFile(file *os.File, w vfs.PipeWriter, cancelFn func(), isNewFile bool, initialSize int64) {
+	f.file = file
+	f.writerAt = w
+	f.cancelFn = cancelFn
+	f.isNewFile = isNewFile
+	f.initialSize = initialSize
+	f.checksum = sftpd.NewUploadChecksum()
+	f.startTransfer()
+}
+
+func (f *webDavFile) startTransfer() {
+	f.isTransfer = true
+	f.start = time.Now()
+	f.lastActivity = time.Now()
+	f.connection.addTransfer(f)
+}
+
+// openForRead checks the download permissions and opens the underlying file
+func (f *webDavFile) openForRead() (err error) {
+	defer func() { f.connection.auditPermissionDenied("Read", f.name, "", err) }()
+	if !f.connection.User.HasPerm(dataprovider.PermDownload, path.Dir(f.name)) {
+		return os.ErrPermission
+	}
+	if !f.connection.User.IsFileAllowed(f.name) {
+		f.connection.Log(logger.LevelWarn, logSender, "reading file %#v is not allowed", f.name)
+		return os.ErrPermission
+	}
+	maxDataTransfer, err := f.connection.getMaxDataTransfer(false)
+	if err != nil {
+		return err
+	}
+	file, r, cancelFn, err := f.connection.fs.Open(f.fsPath)
+	if err != nil {
+		f.connection.Log(logger.LevelWarn, logSender, "could not open file %#v for reading: %+v", f.fsPath, err)
+		return f.connection.getFsError(err)
+	}
+	f.connection.Log(logger.LevelDebug, logSender, "fileread requested for path: %#v", f.fsPath)
+	f.lock.Lock()
+	f.maxDataTransfer = maxDataTransfer
+	f.file = file
+	f.readerAt = r
+	f.cancelFn = cancelFn
+	f.lock.Unlock()
+	f.startTransfer()
+	return nil
+}
+
+// Read reads the file to download, the download is started on the first read.
+// It handles download bandwidth throttling too
+func (f *webDavFile) Read(p []byte) (int, error) {
+	if f.transferType != transferDownload || f.info.IsDir() {
+		return 0, errIsDirectory
+	}
+	if !f.isTransfer {
+		if err := f.openForRead(); err != nil {
+			return 0, err
+		}
+	}
+	if f.connection.isDisconnected() {
+		f.TransferError(errDisconnected)
+		return 0, errDisconnected
+	}
+	f.lock.Lock()
+	f.lastActivity = time.Now()
+	off := f.readOffset
+	remaining := f.maxDataTransfer - f.bytesSent
+	f.lock.Unlock()
+	if f.maxDataTransfer > 0 {
+		if remaining <= 0 {
+			f.TransferError(errDataTransferQuotaExceeded)
+			return 0, errDataTransferQuotaExceeded
+		}
+		if int64(len(p)) > remaining {
+			p = p[:remaining]
+		}
+	}
+	var n int
+	var err error
+	if f.readerAt != nil {
+		n, err = f.readerAt.ReadAt(p, off)
+	} else {
+		n, err = f.file.ReadAt(p, off)
+	}
+	f.lock.Lock()
+	f.readOffset += int64(n)
+	f.bytesSent += int64(n)
+	f.lock.Unlock()
+	if err != nil && err != io.EOF {
+		f.TransferError(err)
+		return n, err
+	}
+	f.handleThrottle(n)
+	return n, err
+}
+
+// Write writes the uploaded data, it handles upload bandwidth throttling too
+func (f *webDavFile) Write(p []byte) (int, error) {
+	if f.transferType != transferUpload {
+		return 0, os.ErrPermission
+	}
+	if f.connection.isDisconnected() {
+		f.TransferError(errDisconnected)
+		return 0, errDisconnected
+	}
+	f.lock.Lock()
+	f.lastActivity = time.Now()
+	off := f.bytesReceived
+	exceeded := f.maxDataTransfer > 0 && f.bytesReceived+int64(len(p)) > f.maxDataTransfer
+	f.lock.Unlock()
+	if exceeded {
+		f.TransferError(errDataTransferQuotaExceeded)
+		return 0, errDataTransferQuotaExceeded
+	}
+	if !f.connection.User.IsUploadSizeAllowed(off + int64(len(p))) {
+		f.TransferError(errUploadFileSizeExceeded)
+		return 0, errUploadFileSizeExceeded
+	}
+	var n int
+	var err error
+	if f.writerAt != nil {
+		n, err = f.writerAt.WriteAt(p, off)
+	} else {
+		n, err = f.file.WriteAt(p, off)
+	}
+	f.lock.Lock()
+	f.bytesReceived += int64(n)
+	f.lock.Unlock()
+	f.checksum.Update(p[:n], off)
+	if err != nil {
+		f.TransferError(err)
+		return n, err
+	}
+	f.handleThrottle(n)
+	return n, err
+}
+
+// Seek sets the offset for the next read, it is not supported for uploads
+func (f *webDavFile) Seek(offset int64, whence int) (int64, error) {
+	if f.transferType != transferDownload {
+		return 0, errSeekNotSupported
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = f.readOffset + offset
+	case io.SeekEnd:
+		newOffset = f.info.Size() + offset
+	default:
+		return 0, errInvalidSeekPosition
+	}
+	if newOffset < 0 {
+		return 0, errInvalidSeekPosition
+	}
+	f.readOffset = newOffset
+	return newOffset, nil
+}
+
+// Readdir returns the directory contents, as described for os.File.Readdir
+func (f *webDavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if f.transferType != transferDownload || !f.info.IsDir() {
+		return nil, errNotDirectory
+	}
+	if f.dirContents == nil {
+		if !f.connection.User.HasPerm(dataprovider.PermListItems, f.name) {
+			f.connection.auditPermissionDenied("Readdir", f.name, "", os.ErrPermission)
+			return nil, os.ErrPermission
+		}
+		f.connection.Log(logger.LevelDebug, logSender, "requested list file for dir: %#v", f.fsPath)
+		files, err := f.connection.fs.ReadDir(f.fsPath)
+		if err != nil {
+			f.connection.Log(logger.LevelWarn, logSender, "error listing directory: %+v", err)
+			return nil, f.connection.getFsError(err)
+		}
+		f.dirContents = f.connection.User.AddVirtualDirs(files, f.name)
+	}
+	remaining := f.dirContents[f.dirOffset:]
+	if count <= 0 {
+		f.dirOffset = len(f.dirContents)
+		return remaining, nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(remaining) {
+		count = len(remaining)
+	}
+	f.dirOffset += count
+	return remaining[:count], nil
+}
+
+// Stat returns the file info, for uploads the size is the number of bytes received so far
+func (f *webDavFile) Stat() (os.FileInfo, error) {
+	if f.transferType == transferUpload {
+		f.lock.Lock()
+		defer f.lock.Unlock()
+		return vfs.NewFileInfo(path.Base(f.name), false, f.bytesReceived, time.Now()), nil
+	}
+	return f.info, nil
+}
+
+// TransferError is called if there is an unexpected error.
+// For example network or client issues
+func (f *webDavFile) TransferError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.transferError != nil {
+		return
+	}
+	f.transferError = err
+	if f.cancelFn != nil {
+		f.cancelFn()
+	}
+	elapsed := time.Since(f.start).Nanoseconds() / 1000000
+	logger.Warn(logSender, f.connection.ID, "Unexpected error for transfer, path: %#v, error: \"%v\" bytes sent: %v, "+
+		"bytes received: %v transfer running since %v ms", f.fsPath, f.transferError, f.bytesSent, f.bytesReceived, elapsed)
+}
+
+// Close it is called when the transfer is completed.
+// It closes the underlying file, logs the transfer info, updates the user quota (for uploads)
+// and the used data transfer and executes any defined action.
+// If there is an error no action will be executed and, in atomic mode, we try to delete
+// the temporary file
+func (f *webDavFile) Close() error {
+	if !f.isTransfer {
+		return nil
+	}
+	f.connection.removeTransfer(f)
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.isFinished {
+		return errTransferClosed
+	}
+	err := f.closeIO()
+	f.isFinished = true
+	numFiles := 0
+	if f.isNewFile {
+		numFiles = 1
+	}
+	metrics.TransferCompleted(f.bytesSent, f.bytesReceived, f.transferType, protocolWebDAV, time.Since(f.start),
+		f.transferError)
+	dataprovider.UpdateUserDataTransfer(dataProvider, f.connection.User, f.bytesReceived, f.bytesSent)
+	var scanErr error
+	if f.transferType == transferUpload && f.file != nil && f.transferError == nil {
+		scanErr = sftpd.ScanUpload(f.file.Name(), f.fsPath, f.connection.User.Username, f.connection.ID, f.bytesReceived)
+		if scanErr != nil {
+			f.transferError = scanErr
+			numFiles--
+			f.bytesReceived = 0
+		}
+	}
+	if f.transferType == transferUpload && f.file != nil && f.file.Name() != f.fsPath && scanErr == nil {
+		if f.transferError == nil || sftpd.GetUserUploadMode(f.connection.User) == uploadModeAtomicWithResume {
+			err = os.Rename(f.file.Name(), f.fsPath)
+			logger.Debug(logSender, f.connection.ID, "atomic upload completed, rename: %#v -> %#v, error: %v",
+				f.file.Name(), f.fsPath, err)
+		} else {
+			err = os.Remove(f.file.Name())
+			logger.Warn(logSender, f.connection.ID, "atomic upload completed with error: \"%v\", delete temporary file: %#v, "+
+				"deletion error: %v", f.transferError, f.file.Name(), err)
+			if err == nil {
+				numFiles--
+				f.bytesReceived = 0
+			}
+		}
+	}
+	if f.transferError == nil {
+		elapsed := time.Since(f.start).Nanoseconds() / 1000000
+		if f.transferType == transferDownload {
+			logger.TransferLog(downloadLogSender, f.fsPath, elapsed, f.bytesSent, f.connection.User.Username,
+				f.connection.ID, protocolWebDAV)
+			go sftpd.ExecuteAction(operationDownload, f.connection.User.Username, f.fsPath, "", f.bytesSent, (f.file != nil))
+		} else {
+			logger.TransferLog(uploadLogSender, f.fsPath, elapsed, f.bytesReceived, f.connection.User.Username,
+				f.connection.ID, protocolWebDAV)
+			if err == nil {
+				localPath := ""
+				if f.file != nil {
+					localPath = f.fsPath
+				}
+				f.checksum.Store(f.connection.fs, f.fsPath, localPath, f.connection.ID)
+			}
+			go sftpd.ExecuteAction(operationUpload, f.connection.User.Username, f.fsPath, "", f.bytesReceived, (f.file != nil))
+		}
+	} else {
+		logger.Warn(logSender, f.connection.ID, "transfer error: %v, path: %#v", f.transferError, f.fsPath)
+		if err == nil {
+			err = f.transferError
+		}
+	}
+	if f.transferType == transferDownload {
+		audit.LogTransfer(false, f.connection.User.Username, protocolWebDAV, f.connection.ID, f.connection.getRemoteIP(),
+			f.fsPath, f.bytesSent, time.Since(f.start), f.transferError)
+	} else {
+		audit.LogTransfer(true, f.connection.User.Username, protocolWebDAV, f.connection.ID, f.connection.getRemoteIP(),
+			f.fsPath, f.bytesReceived, time.Since(f.start), f.transferError)
+	}
+	f.updateQuota(numFiles)
+	return err
+}
+
+func (f *webDavFile) closeIO() error {
+	var err error
+	if f.writerAt != nil {
+		err = f.writerAt.Close()
+	} else if f.readerAt != nil {
+		err = f.readerAt.Close()
+	} else {
+		err = f.file.Close()
+	}
+	return err
+}
+
+func (f *webDavFile) updateQuota(numFiles int) bool {
+	// uploads to remote filesystems are atomic, if there is an error nothing is uploaded
+	if f.file == nil && f.transferError != nil {
+		return false
+	}
+	if f.connection.User.IsFileExcludedFromQuota(f.fsPath) {
+		return false
+	}
+	if f.transferType == transferUpload && (numFiles != 0 || f.bytesReceived > 0) {
+		dataprovider.UpdateUserQuota(dataProvider, f.connection.User, numFiles, f.bytesReceived-f.initialSize, false)
+		return true
+	}
+	return false
+}
+
+func (f *webDavFile) handleThrottle(size int) {
+	var wantedBandwidth int64
+	var trasferredBytes int64
+	f.lock.Lock()
+	if f.transferType == transferDownload {
+		wantedBandwidth = f.connection.User.DownloadBandwidth
+		trasferredBytes = f.bytesSent
+	} else {
+		wantedBandwidth = f.connection.User.UploadBandwidth
+		trasferredBytes = f.bytesReceived
+	}
+	f.lock.Unlock()
+	if wantedBandwidth > 0 {
+		// real and wanted elapsed as milliseconds, bytes as kilobytes
+		realElapsed := time.Since(f.start).Nanoseconds() / 1000000
+		// trasferredBytes / 1000 = KB/s, we multiply for 1000 to get milliseconds
+		wantedElapsed := 1000 * (trasferredBytes / 1000) / wantedBandwidth
+		if wantedElapsed > realElapsed {
+			toSleep := time.Duration(wantedElapsed - realElapsed)
+			time.Sleep(toSleep * time.Millisecond)
+		}
+	}
+	bandwidth.Throttle(utils.GetIPFromRemoteAddress(f.connection.RemoteAddr.String()), protocolWebDAV,
+		f.transferType == transferUpload, int64(size))
+}
+
+func (f *webDavFile) getStats() sftpd.ConnectionTransfer {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	operationType := operationUpload
+	size := f.bytesReceived
+	if f.transferType == transferDownload {
+		operationType = operationDownload
+		size = f.bytesSent
+	}
+	return sftpd.ConnectionTransfer{
+		OperationType: operationType,
+		StartTime:     utils.GetTimeAsMsSinceEpoch(f.start),
+		Size:          size,
+		LastActivity:  utils.GetTimeAsMsSinceEpoch(f.lastActivity),
+	}
+}
@@ -0,0 +1,178 @@
+package webdavd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"golang.org/x/net/webdav"
+
+	"github.com/drakkan/sftpgo/audit"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/defender"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/metrics"
+	"github.com/drakkan/sftpgo/ratelimiter"
+	"github.com/drakkan/sftpgo/sftpd"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+var (
+	errInvalidCredentials = errors.New("invalid credentials")
+)
+
+type webDavServer struct {
+	// WebDAV locks are relative to the user home dirs so we need a lock system for each user
+	lockSystems map[string]webdav.LockSystem
+	lock        *sync.Mutex
+}
+
+func (s *webDavServer) getLockSystem(username string) webdav.LockSystem {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if ls, ok := s.lockSystems[username]; ok {
+		return ls
+	}
+	ls := webdav.NewMemLS()
+	s.lockSystems[username] = ls
+	return ls
+}
+
+// ServeHTTP authenticates the request and serves it using the user's filesystem.
+// Each request is tracked as an active connection while it is running
+func (s *webDavServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	connectionID := xid.New().String()
+	if defender.IsBanned(utils.GetIPFromRemoteAddress(r.RemoteAddr)) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"SFTPGo WebDAV\"")
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	user, err := s.validateUser(username, password, r.RemoteAddr)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"SFTPGo WebDAV\"")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	fs, err := user.GetFilesystem(connectionID)
+	if err != nil {
+		logger.Warn(logSender, connectionID, "could create filesystem for user %#v err: %v", user.Username, err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer fs.Close()
+	fs.CheckRootPath(user.Username, user.GetUID(), user.GetGID())
+
+	ctx, cancelFn := context.WithCancel(r.Context())
+	defer cancelFn()
+	connection := &Connection{
+		ID:            connectionID,
+		User:          user,
+		ClientVersion: r.UserAgent(),
+		RemoteAddr:    getRemoteAddr(r.RemoteAddr),
+		StartTime:     time.Now(),
+		lastActivity:  time.Now(),
+		fs:            fs,
+		ctx:           ctx,
+		cancelFn:      cancelFn,
+		lock:          new(sync.Mutex),
+	}
+	sftpd.AddActiveConnection(connection)
+	defer sftpd.RemoveActiveConnection(connection)
+
+	connection.Log(logger.LevelDebug, logSender, "new %v request for path %#v", r.Method, r.URL.Path)
+	handler := webdav.Handler{
+		FileSystem: connection,
+		LockSystem: s.getLockSystem(user.Username),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				connection.Log(logger.LevelDebug, logSender, "%v request for %#v error: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	handler.ServeHTTP(w, r.WithContext(ctx))
+}
+
+func (s *webDavServer) validateUser(username, password, remoteAddr string) (dataprovider.User, error) {
+	method := dataprovider.SSHLoginMethodPassword
+	metrics.AddLoginAttempt(method)
+	user, err := dataprovider.CheckUserAndPass(dataProvider, username, password, utils.GetIPFromRemoteAddress(remoteAddr))
+	if err == nil {
+		err = checkLoginConditions(user, method, remoteAddr)
+	}
+	if err != nil {
+		ipAddr := utils.GetIPFromRemoteAddress(remoteAddr)
+		logger.ConnectionFailedLog(username, ipAddr, method, err.Error())
+		audit.Log(audit.Event{Event: audit.EventLoginFailed, Username: username, Protocol: protocolWebDAV, RemoteIP: ipAddr,
+			LoginMethod: method, Error: err.Error()})
+		addDefenderEvent(ipAddr, err)
+		ratelimiter.DelayLoginFailure(ipAddr, username)
+		metrics.AddLoginResult(method, err)
+		dataprovider.ExecutePostLoginHook(username, method, ipAddr, protocolWebDAV, err)
+		return user, errInvalidCredentials
+	}
+	ratelimiter.ResetLoginFailures(username)
+	metrics.AddLoginResult(method, err)
+	dataprovider.ExecutePostLoginHook(username, method, utils.GetIPFromRemoteAddress(remoteAddr), protocolWebDAV, err)
+	if time.Since(utils.GetTimeFromMsecSinceEpoch(user.LastLogin)) > lastLoginMinDelay {
+		logger.Info(logSender, "", "User id: %d, logged in with: %#v, username: %#v, home_dir: %#v remote addr: %#v",
+			user.ID, method, user.Username, user.HomeDir, remoteAddr)
+		dataprovider.UpdateLastLogin(dataProvider, user)
+	}
+	return user, nil
+}
+
+func checkLoginConditions(user dataprovider.User, loginMethod, remoteAddr string) error {
+	if !filepath.IsAbs(user.HomeDir) {
+		logger.Warn(logSender, "", "user %#v has an invalid home dir: %#v. Home dir must be an absolute path, login not allowed",
+			user.Username, user.HomeDir)
+		return fmt.Errorf("cannot login user with invalid home dir: %#v", user.HomeDir)
+	}
+	if user.MaxSessions > 0 {
+		activeSessions := sftpd.GetActiveSessions(user.Username)
+		if activeSessions >= user.MaxSessions {
+			logger.Debug(logSender, "", "authentication refused for user: %#v, too many open sessions: %v/%v", user.Username,
+				activeSessions, user.MaxSessions)
+			return fmt.Errorf("too many open sessions: %v", activeSessions)
+		}
+	}
+	if !user.IsLoginMethodAllowed(loginMethod, remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, login method %#v is not allowed", user.Username, loginMethod)
+		return fmt.Errorf("Login method %#v is not allowed for user %#v", loginMethod, user.Username)
+	}
+	if !user.IsLoginFromAddrAllowed(remoteAddr) {
+		logger.Debug(logSender, "", "cannot login user %#v, remote address is not allowed: %v", user.Username, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from this address: %v", user.Username, remoteAddr)
+	}
+	if allowed, country := user.IsLoginFromCountryAllowed(remoteAddr); !allowed {
+		logger.Debug(logSender, "", "cannot login user %#v, country %#v is not allowed: %v", user.Username, country, remoteAddr)
+		return fmt.Errorf("Login for user %#v is not allowed from country %#v", user.Username, country)
+	}
+	return nil
+}
+
+func addDefenderEvent(ipAddr string, err error) {
+	event := defender.HostEventLoginFailed
+	if _, ok := err.(*dataprovider.RecordNotFoundError); ok {
+		event = defender.HostEventUserNotFound
+	}
+	defender.AddEvent(ipAddr, event)
+}
+
+func getRemoteAddr(remoteAddr string) net.Addr {
+	addr, err := net.ResolveTCPAddr("tcp", remoteAddr)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	return addr
+}
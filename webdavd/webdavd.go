@@ -0,0 +1,113 @@
+// Package webdavd implements a WebDAV server, RFC 4918, on top of golang.org/x/net/webdav.
+// The users, authentication backends, permissions, quota and upload modes are the same used for SFTP.
+package webdavd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/drakkan/sftpgo/acme"
+	"github.com/drakkan/sftpgo/dataprovider"
+	"github.com/drakkan/sftpgo/logger"
+	"github.com/drakkan/sftpgo/utils"
+)
+
+const (
+	logSender         = "webdavd"
+	uploadLogSender   = "Upload"
+	downloadLogSender = "Download"
+	renameLogSender   = "Rename"
+	rmdirLogSender    = "Rmdir"
+	mkdirLogSender    = "Mkdir"
+	removeLogSender   = "Remove"
+	operationDownload = "download"
+	operationUpload   = "upload"
+	operationDelete   = "delete"
+	operationRename   = "rename"
+	protocolWebDAV    = "DAV"
+	// the last login is updated at most once in this interval, WebDAV clients
+	// authenticate each request
+	lastLoginMinDelay = 10 * time.Minute
+)
+
+var (
+	dataProvider dataprovider.Provider
+	certMgr      *utils.CertManager
+)
+
+// Configuration for the WebDAV server
+type Configuration struct {
+	// The port used for serving WebDAV requests. 0 disable the WebDAV server. Default: 0
+	BindPort int `json:"bind_port" mapstructure:"bind_port"`
+	// The address to listen on. A blank value means listen on all available network interfaces.
+	BindAddress string `json:"bind_address" mapstructure:"bind_address"`
+	// If files containing a certificate and matching private key for the server are provided the server will expect
+	// HTTPS connections.
+	// Certificate and key files can be reloaded on demand sending a "SIGHUP" signal on Unix based systems and a
+	// "paramchange" request to the running service on Windows.
+	CertificateFile    string `json:"certificate_file" mapstructure:"certificate_file"`
+	CertificateKeyFile string `json:"certificate_key_file" mapstructure:"certificate_key_file"`
+}
+
+// SetDataProvider sets the data provider to use to authenticate users and to get/update their disk quota
+func SetDataProvider(provider dataprovider.Provider) {
+	dataProvider = provider
+}
+
+// Initialize configures and starts the WebDAV server
+func (c Configuration) Initialize(configDir string) error {
+	var err error
+	logger.Debug(logSender, "", "initializing WebDAV server with config %+v", c)
+	server := &webDavServer{
+		lockSystems: make(map[string]webdav.LockSystem),
+		lock:        new(sync.Mutex),
+	}
+	httpServer := &http.Server{
+		Addr:              fmt.Sprintf("%s:%d", c.BindAddress, c.BindPort),
+		Handler:           server,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       120 * time.Second,
+		MaxHeaderBytes:    1 << 16, // 64KB
+	}
+	certificateFile := getConfigPath(c.CertificateFile, configDir)
+	certificateKeyFile := getConfigPath(c.CertificateKeyFile, configDir)
+	if len(certificateFile) > 0 && len(certificateKeyFile) > 0 {
+		certMgr, err = utils.NewCertManager(certificateFile, certificateKeyFile, logSender)
+		if err != nil {
+			return err
+		}
+		httpServer.TLSConfig = &tls.Config{
+			GetCertificate: certMgr.GetCertificateFunc(),
+			MinVersion:     tls.VersionTLS12,
+		}
+		return httpServer.ListenAndServeTLS("", "")
+	}
+	if acme.IsEnabledForProtocol(acme.ProtocolWebDAV) {
+		httpServer.TLSConfig = acme.GetTLSConfig()
+		return httpServer.ListenAndServeTLS("", "")
+	}
+	return httpServer.ListenAndServe()
+}
+
+// ReloadTLSCertificate reloads the TLS certificate and key from the configured paths
+func ReloadTLSCertificate() {
+	if certMgr != nil {
+		certMgr.LoadCertificate()
+	}
+}
+
+func getConfigPath(name, configDir string) string {
+	if !utils.IsFileInputValid(name) {
+		return ""
+	}
+	if len(name) > 0 && !filepath.IsAbs(name) {
+		return filepath.Join(configDir, name)
+	}
+	return name
+}